@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxAbuseSources bounds the source IPs AbuseIPDBReporter follows
+	maxAbuseSources = 100000
+	// maxAbuseUsernames bounds the usernames kept for the comment of a report
+	maxAbuseUsernames = 10
+	// AbuseIPDB truncates longer comments
+	maxAbuseComment = 1024
+	// AbuseIPDB categories: brute-force and SSH
+	abuseCategoryBruteForce = "18"
+	abuseCategorySSH        = "22"
+)
+
+const defaultAbuseComment = `{{.Attempts}} {{upper .Protocol}} login attempts on a honeypot{{if .Usernames}}, usernames: {{join .Usernames ", "}}{{end}}`
+
+// abuseSource is what a source IP attempted since it was last reported.
+type abuseSource struct {
+	protocol string
+	attempts int
+	users    []string
+	first    time.Time
+	last     time.Time
+	reported time.Time
+}
+
+// AbuseReport is what the comment template of a report gets.
+type AbuseReport struct {
+	IP        string
+	Protocol  string
+	Attempts  int
+	Usernames []string
+	First     time.Time
+	Last      time.Time
+}
+
+// AbuseIPDBReporter reports the source IPs brute-forcing the honeypot to
+// AbuseIPDB once they made enough attempts, reporting an IP again only after
+// an interval.
+type AbuseIPDBReporter struct {
+	url         string
+	apiKey      string
+	minAttempts int
+	interval    time.Duration
+	categories  []string
+	comment     *template.Template
+	dailyLimit  int
+	anonymizer  *Anonymizer
+	client      *http.Client
+	tracer      trace.Tracer
+	queue       chan AbuseReport
+
+	mu        sync.Mutex
+	sources   map[string]*abuseSource
+	lastPrune time.Time
+	day       string
+	reports   int
+	paused    time.Time
+}
+
+func NewAbuseIPDBReporter(url string, apiKey string, minAttempts int, interval time.Duration, categories []string, comment *template.Template, dailyLimit int, anonymizer *Anonymizer, tracer trace.Tracer) *AbuseIPDBReporter {
+	return &AbuseIPDBReporter{
+		url:         url,
+		apiKey:      apiKey,
+		minAttempts: max(minAttempts, 1),
+		interval:    interval,
+		categories:  categories,
+		comment:     comment,
+		dailyLimit:  dailyLimit,
+		anonymizer:  anonymizer,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		tracer:      tracer,
+		queue:       make(chan AbuseReport, 100),
+		sources:     map[string]*abuseSource{},
+	}
+}
+
+// abuseIPDBReporterFromEnv returns nil unless ABUSEIPDB_REPORT is set.
+func abuseIPDBReporterFromEnv(anonymizer *Anonymizer, tracer trace.Tracer) (*AbuseIPDBReporter, error) {
+	if os.Getenv("ABUSEIPDB_REPORT") != "true" {
+		return nil, nil
+	}
+	apiKey := os.Getenv("ABUSEIPDB_API_KEY")
+	if apiKey == "" {
+		return nil, fmt.Errorf("ABUSEIPDB_API_KEY is required to report to AbuseIPDB")
+	}
+	if anonymizer != nil && anonymizer.truncateIPs {
+		return nil, fmt.Errorf("the source IPs are anonymized")
+	}
+
+	interval := getEnvDuration("ABUSEIPDB_REPORT_INTERVAL", 24*time.Hour)
+	if interval < 15*time.Minute {
+		return nil, fmt.Errorf("ABUSEIPDB_REPORT_INTERVAL must be at least 15m, AbuseIPDB refusing more frequent reports of an IP")
+	}
+	categories := splitList(getEnv("ABUSEIPDB_REPORT_CATEGORIES", abuseCategoryBruteForce+","+abuseCategorySSH))
+	for _, category := range categories {
+		if _, err := strconv.Atoi(category); err != nil {
+			return nil, fmt.Errorf("invalid ABUSEIPDB_REPORT_CATEGORIES category %q", category)
+		}
+	}
+	text, err := templateFromEnv("ABUSEIPDB_REPORT_TEMPLATE", defaultAbuseComment)
+	if err != nil {
+		return nil, err
+	}
+	comment, err := parseAlertTemplate("ABUSEIPDB_REPORT_TEMPLATE", text, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAbuseIPDBReporter(getEnv("ABUSEIPDB_URL", "https://api.abuseipdb.com/api/v2")+"/report", apiKey,
+		getEnvInt("ABUSEIPDB_REPORT_MIN_ATTEMPTS", 5), interval, categories, comment,
+		getEnvInt("ABUSEIPDB_REPORT_DAILY_LIMIT", 1000), anonymizer, tracer), nil
+}
+
+// Observe counts the authentication attempts of public source IPs, queuing
+// a report of the IP once it made enough of them.
+func (r *AbuseIPDBReporter) Observe(ctx context.Context, event Event) {
+	sshInfo := event.SSHInfo
+	if !isPasswordAttempt(sshInfo) && sshInfo.Function != "public_key" {
+		return
+	}
+	if ip := net.ParseIP(sshInfo.RemoteHost); ip == nil || isPrivateIP(ip) {
+		return
+	}
+	// The usernames of the comment are anonymized as configured
+	user := r.anonymizer.Anonymize(event).SSHInfo.User
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := sshInfo.Timestamp
+	r.prune(now)
+
+	source, found := r.sources[sshInfo.RemoteHost]
+	if !found {
+		if len(r.sources) >= maxAbuseSources {
+			return
+		}
+		source = &abuseSource{}
+		r.sources[sshInfo.RemoteHost] = source
+	}
+	if now.Sub(source.reported) < r.interval {
+		return
+	}
+	if source.attempts == 0 {
+		source.first, source.protocol = now, sshInfo.Protocol
+	}
+	source.attempts += max(sshInfo.AttemptCount, 1)
+	source.last = now
+	if user != "" && len(source.users) < maxAbuseUsernames && !slices.Contains(source.users, user) {
+		source.users = append(source.users, user)
+	}
+	if source.attempts < r.minAttempts {
+		return
+	}
+
+	report := AbuseReport{
+		IP:        sshInfo.RemoteHost,
+		Protocol:  source.protocol,
+		Attempts:  source.attempts,
+		Usernames: source.users,
+		First:     source.first,
+		Last:      source.last,
+	}
+	*source = abuseSource{reported: now}
+	select {
+	case r.queue <- report:
+	default:
+		slog.WarnContext(ctx, "AbuseIPDB report queue full, dropping report", "ip", report.IP)
+	}
+}
+
+// prune forgets the source IPs neither attempting nor reported for an
+// interval, at most once an interval.
+func (r *AbuseIPDBReporter) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < r.interval {
+		return
+	}
+	r.lastPrune = now
+
+	for ip, source := range r.sources {
+		if now.Sub(source.last) > r.interval && now.Sub(source.reported) > r.interval {
+			delete(r.sources, ip)
+		}
+	}
+}
+
+// Run sends the queued reports, one at a time.
+func (r *AbuseIPDBReporter) Run() {
+	for report := range r.queue {
+		r.Report(context.Background(), report)
+	}
+}
+
+// Report sends report to AbuseIPDB, unless the daily limit is reached or
+// AbuseIPDB asked to wait.
+func (r *AbuseIPDBReporter) Report(ctx context.Context, report AbuseReport) {
+	now := time.Now()
+	r.mu.Lock()
+	if day := now.UTC().Format(time.DateOnly); day != r.day {
+		r.day, r.reports = day, 0
+	}
+	skip := now.Before(r.paused) || r.dailyLimit > 0 && r.reports >= r.dailyLimit
+	if !skip {
+		r.reports++
+	}
+	r.mu.Unlock()
+	if skip {
+		slog.DebugContext(ctx, "Skipped AbuseIPDB report, rate limited", "ip", report.IP)
+		return
+	}
+
+	ctx, span := r.tracer.Start(
+		ctx,
+		"reportAbuseIPDB",
+		trace.WithAttributes(attribute.String("ip", report.IP), attribute.Int("attempts", report.Attempts)))
+	defer span.End()
+
+	err := r.report(ctx, report)
+	metrics.RecordAbuseIPDBReport(ctx, err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Failed to report to AbuseIPDB", "ip", report.IP, "error", err)
+		return
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Reported '%s' to AbuseIPDB", report.IP))
+	slog.InfoContext(ctx, "Reported to AbuseIPDB", "ip", report.IP, "attempts", report.Attempts)
+}
+
+func (r *AbuseIPDBReporter) report(ctx context.Context, report AbuseReport) error {
+	var comment strings.Builder
+	if err := r.comment.Execute(&comment, report); err != nil {
+		return fmt.Errorf("failed to render comment: %v", err)
+	}
+	text := []rune(comment.String())
+	text = text[:min(len(text), maxAbuseComment)]
+
+	// The SSH category only fits the attempts made on SSH
+	var categories []string
+	for _, category := range r.categories {
+		if category != abuseCategorySSH || report.Protocol == "ssh" {
+			categories = append(categories, category)
+		}
+	}
+	if len(categories) == 0 {
+		categories = []string{abuseCategoryBruteForce}
+	}
+
+	form := url.Values{
+		"ip":         {report.IP},
+		"categories": {strings.Join(categories, ",")},
+		"comment":    {string(text)},
+		"timestamp":  {report.Last.UTC().Format(time.RFC3339)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Key", r.apiKey)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait, err := parseTime(resp.Header.Get("Retry-After"))
+		if err != nil || wait <= 0 {
+			wait = time.Hour
+		}
+		r.mu.Lock()
+		r.paused = time.Now().Add(wait)
+		r.mu.Unlock()
+		return fmt.Errorf("rate limited for %s: %s", wait, abuseIPDBError(body))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, abuseIPDBError(body))
+	}
+
+	return nil
+}
+
+// abuseIPDBError returns the detail of the errors AbuseIPDB answered with, or
+// the body itself.
+func abuseIPDBError(body []byte) string {
+	var result struct {
+		Errors []struct {
+			Detail string `json:"detail"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &result) != nil || len(result.Errors) == 0 {
+		return strings.TrimSpace(string(body))
+	}
+
+	details := make([]string, len(result.Errors))
+	for i, e := range result.Errors {
+		details[i] = e.Detail
+	}
+	return strings.Join(details, "; ")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ActiveSession is an SSH session in progress.
+type ActiveSession struct {
+	SessionID  string `json:"session_id"`
+	RemoteHost string `json:"remote_host"`
+	User       string `json:"user"`
+	// Kind is "shell", "exec", "sftp" or "session" for sessions that are
+	// only held open
+	Kind    string    `json:"kind"`
+	Command string    `json:"command,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// SessionTracker keeps the sessions in progress, for the API.
+type SessionTracker struct {
+	mu       sync.Mutex
+	next     uint64
+	sessions map[uint64]ActiveSession
+}
+
+func NewSessionTracker() *SessionTracker {
+	return &SessionTracker{sessions: map[uint64]ActiveSession{}}
+}
+
+// Track registers session as in progress until the returned function is
+// called.
+func (t *SessionTracker) Track(session ActiveSession) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	id := t.next
+	t.sessions[id] = session
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		delete(t.sessions, id)
+	}
+}
+
+// Sessions returns the sessions in progress, oldest first.
+func (t *SessionTracker) Sessions() []ActiveSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]ActiveSession, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(a, b int) bool {
+		return sessions[a].Started.Before(sessions[b].Started)
+	})
+
+	return sessions
+}
+
+// RecentEvents keeps the last events written, anonymized as they are for
+// the sinks.
+type RecentEvents struct {
+	mu         sync.Mutex
+	events     []EventDocument
+	next       int
+	anonymizer *Anonymizer
+}
+
+func NewRecentEvents(size int, anonymizer *Anonymizer) *RecentEvents {
+	return &RecentEvents{events: make([]EventDocument, 0, size), anonymizer: anonymizer}
+}
+
+func (r *RecentEvents) Observe(ctx context.Context, event Event) {
+	document := newEventDocument(r.anonymizer.Anonymize(event))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cap(r.events) == 0 {
+		return
+	}
+	if len(r.events) < cap(r.events) {
+		r.events = append(r.events, document)
+		return
+	}
+	r.events[r.next] = document
+	r.next = (r.next + 1) % len(r.events)
+}
+
+// Events returns up to limit of the recent events, most recent first.
+func (r *RecentEvents) Events(limit int) []EventDocument {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := min(limit, len(r.events))
+	events := make([]EventDocument, 0, n)
+	for i := 0; i < n; i++ {
+		// The most recent is just before the next one to overwrite
+		index := (r.next - 1 - i + 2*len(r.events)) % len(r.events)
+		events = append(events, r.events[index])
+	}
+
+	return events
+}
+
+// SourceCount is the number of events from a country or AS.
+type SourceCount struct {
+	Name   string `json:"name"`
+	Events int64  `json:"events"`
+}
+
+// SourceCounter counts the events per source country and AS since startup.
+type SourceCounter struct {
+	mu        sync.Mutex
+	countries map[string]int64
+	asns      map[string]int64
+}
+
+func NewSourceCounter() *SourceCounter {
+	return &SourceCounter{countries: map[string]int64{}, asns: map[string]int64{}}
+}
+
+func (c *SourceCounter) Observe(ctx context.Context, event Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if country := event.IPInfo.Country; country != "" {
+		c.countries[country]++
+	}
+	if org := event.IPInfo.Org; org != "" {
+		c.asns[org]++
+	}
+}
+
+// Countries returns the countries, most events first.
+func (c *SourceCounter) Countries() []SourceCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return sortedCounts(c.countries)
+}
+
+// ASNs returns the ASes, as "AS<number> <name>", most events first.
+func (c *SourceCounter) ASNs() []SourceCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return sortedCounts(c.asns)
+}
+
+func sortedCounts(counts map[string]int64) []SourceCount {
+	sorted := make([]SourceCount, 0, len(counts))
+	for name, events := range counts {
+		sorted = append(sorted, SourceCount{Name: name, Events: events})
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		if sorted[a].Events != sorted[b].Events {
+			return sorted[a].Events > sorted[b].Events
+		}
+		return sorted[a].Name < sorted[b].Name
+	})
+
+	return sorted
+}
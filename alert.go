@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert is a notable event that matched an alert rule.
+type Alert struct {
+	Rule         string
+	Severity     string
+	Summary      string
+	Event        Event
+	DashboardURL string
+	Timestamp    time.Time
+	// Immediate alerts are neither throttled nor held back by digests.
+	Immediate bool
+
+	// Digest lists the alerts summarised by a digest alert.
+	Digest []Alert
+}
+
+// Notifier delivers alerts to an external service.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// AlertRule decides whether an event deserves an alert. Match is called for
+// every enriched event and may keep state of its own.
+type AlertRule interface {
+	Name() string
+	Match(event Event) (Alert, bool)
+}
+
+var alertRules = map[string]func() AlertRule{
+	"first_seen_country": func() AlertRule {
+		return &firstSeenCountryRule{seen: map[string]struct{}{}}
+	},
+	"first_seen_ip": func() AlertRule {
+		return &firstSeenIPRule{seen: cache.New(getEnvDuration("ALERT_FIRST_SEEN_IP_TTL", 24*time.Hour), 10*time.Minute)}
+	},
+	"key_reuse": func() AlertRule {
+		return &keyReuseRule{}
+	},
+	"honeytoken": func() AlertRule {
+		return &honeytokenRule{}
+	},
+	"canarytoken": func() AlertRule {
+		return &canarytokenRule{}
+	},
+	"session": func() AlertRule {
+		return &sessionRule{}
+	},
+	"spray": func() AlertRule {
+		return &sprayRule{}
+	},
+	"client_anomaly": func() AlertRule {
+		return &clientAnomalyRule{}
+	},
+	"payload": func() AlertRule {
+		return &payloadRule{}
+	},
+	"yara": func() AlertRule {
+		return &yaraRule{}
+	},
+}
+
+// honeytokenRule fires on the "honeytoken" events following the attempts
+// using one of the ALERT_HONEYTOKENS, bypassing the throttle and digests.
+type honeytokenRule struct{}
+
+func (r *honeytokenRule) Name() string { return "honeytoken" }
+
+func (r *honeytokenRule) Match(event Event) (Alert, bool) {
+	sshInfo := event.SSHInfo
+	if sshInfo.Function != "honeytoken" {
+		return Alert{}, false
+	}
+
+	summary := fmt.Sprintf("Honeytoken credential for '%s' used by %s", sshInfo.User, sshInfo.RemoteHost)
+	if sshInfo.KeyFingerprint != "" {
+		summary = fmt.Sprintf("Honeytoken key %s offered for '%s' by %s", sshInfo.KeyFingerprint, sshInfo.User, sshInfo.RemoteHost)
+	}
+
+	return Alert{
+		Severity:  SeverityCritical,
+		Summary:   summary,
+		Immediate: true,
+	}, true
+}
+
+// canarytokenRule fires on the "canarytoken" events of the Canarytokens
+// planted in the shell being triggered, bypassing the throttle and digests.
+type canarytokenRule struct{}
+
+func (r *canarytokenRule) Name() string { return "canarytoken" }
+
+func (r *canarytokenRule) Match(event Event) (Alert, bool) {
+	sshInfo := event.SSHInfo
+	if sshInfo.Function != "canarytoken" {
+		return Alert{}, false
+	}
+
+	return Alert{
+		Severity:  SeverityCritical,
+		Summary:   fmt.Sprintf("Canarytoken %s planted in %s triggered by %s", sshInfo.Canarytoken, sshInfo.Path, sshInfo.RemoteHost),
+		Immediate: true,
+	}, true
+}
+
+// sessionRule fires when a client that got in opens a session.
+type sessionRule struct{}
+
+func (r *sessionRule) Name() string { return "session" }
+
+func (r *sessionRule) Match(event Event) (Alert, bool) {
+	sshInfo := event.SSHInfo
+	if sshInfo.Function != "session" {
+		return Alert{}, false
+	}
+
+	return Alert{
+		Severity: SeverityWarning,
+		Summary:  fmt.Sprintf("Session opened by %s as '%s'", sshInfo.RemoteHost, sshInfo.User),
+	}, true
+}
+
+// sprayRule fires on the "spray" events of the SprayDetector.
+type sprayRule struct{}
+
+func (r *sprayRule) Name() string { return "spray" }
+
+func (r *sprayRule) Match(event Event) (Alert, bool) {
+	sshInfo := event.SSHInfo
+	if sshInfo.Function != "spray" {
+		return Alert{}, false
+	}
+
+	return Alert{
+		Severity: SeverityWarning,
+		Summary: fmt.Sprintf("Password spraying from %s, one password tried against %d usernames on %d ports",
+			sshInfo.RemoteHost, sshInfo.SprayUsernames, sshInfo.SprayPorts),
+	}, true
+}
+
+// clientAnomalyRule fires on the "client_anomaly" events of the
+// ClientVersionStats.
+type clientAnomalyRule struct{}
+
+func (r *clientAnomalyRule) Name() string { return "client_anomaly" }
+
+func (r *clientAnomalyRule) Match(event Event) (Alert, bool) {
+	sshInfo := event.SSHInfo
+	if sshInfo.Function != "client_anomaly" {
+		return Alert{}, false
+	}
+
+	severity := SeverityInfo
+	if sshInfo.Anomaly == AnomalyNewClient {
+		severity = SeverityWarning
+	}
+
+	return Alert{
+		Severity: severity,
+		Summary:  fmt.Sprintf("SSH client never seen before from %s: '%s' with HASSH %s", sshInfo.RemoteHost, sshInfo.ClientVersion, sshInfo.HASSH),
+	}, true
+}
+
+// payloadRule fires when a file is uploaded or downloaded into the
+// honeypot's filesystem, on the "file" and "download" events rather than the
+// "sample" ones following them.
+type payloadRule struct{}
+
+func (r *payloadRule) Name() string { return "payload" }
+
+func (r *payloadRule) Match(event Event) (Alert, bool) {
+	sshInfo := event.SSHInfo
+	if sshInfo.FileSHA256 == "" || sshInfo.Function == "sample" {
+		return Alert{}, false
+	}
+
+	source := sshInfo.Path
+	if sshInfo.URL != "" {
+		source = sshInfo.URL
+	}
+
+	return Alert{
+		Severity: SeverityWarning,
+		Summary:  fmt.Sprintf("Payload %s captured from %s (%s)", sshInfo.FileSHA256[:min(12, len(sshInfo.FileSHA256))], sshInfo.RemoteHost, source),
+	}, true
+}
+
+// yaraRule fires when a sample matches YARA rules.
+type yaraRule struct{}
+
+func (r *yaraRule) Name() string { return "yara" }
+
+func (r *yaraRule) Match(event Event) (Alert, bool) {
+	sshInfo := event.SSHInfo
+	if len(sshInfo.YaraMatches) == 0 {
+		return Alert{}, false
+	}
+
+	return Alert{
+		Severity: SeverityCritical,
+		Summary: fmt.Sprintf("Sample %s from %s matches YARA rules %s", sshInfo.FileSHA256[:min(12, len(sshInfo.FileSHA256))], sshInfo.RemoteHost,
+			strings.Join(sshInfo.YaraMatches, ", ")),
+	}, true
+}
+
+// keyReuseRule fires when a public key is first seen from a second source
+// IP, or whenever a key of a known campaign is offered.
+type keyReuseRule struct{}
+
+func (r *keyReuseRule) Name() string { return "key_reuse" }
+
+func (r *keyReuseRule) Match(event Event) (Alert, bool) {
+	analysis := event.Analysis
+	if analysis.KeyCampaign != "" {
+		return Alert{
+			Severity: SeverityWarning,
+			Summary:  fmt.Sprintf("Public key of campaign '%s' offered by %s", analysis.KeyCampaign, event.SSHInfo.RemoteHost),
+		}, true
+	}
+
+	if analysis.KeyReused {
+		return Alert{
+			Severity: SeverityInfo,
+			Summary:  fmt.Sprintf("Public key reused from a second source IP %s", event.SSHInfo.RemoteHost),
+		}, true
+	}
+
+	return Alert{}, false
+}
+
+type firstSeenCountryRule struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func (r *firstSeenCountryRule) Name() string { return "first_seen_country" }
+
+func (r *firstSeenCountryRule) Match(event Event) (Alert, bool) {
+	country := event.IPInfo.Country
+	if country == "" {
+		return Alert{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.seen[country]; found {
+		return Alert{}, false
+	}
+	r.seen[country] = struct{}{}
+
+	return Alert{
+		Severity: SeverityInfo,
+		Summary:  fmt.Sprintf("First attack seen from %s", country),
+	}, true
+}
+
+type firstSeenIPRule struct {
+	seen *cache.Cache
+}
+
+func (r *firstSeenIPRule) Name() string { return "first_seen_ip" }
+
+func (r *firstSeenIPRule) Match(event Event) (Alert, bool) {
+	if r.seen.Add(event.SSHInfo.RemoteHost, struct{}{}, cache.DefaultExpiration) != nil {
+		return Alert{}, false
+	}
+
+	return Alert{
+		Severity: SeverityInfo,
+		Summary:  fmt.Sprintf("New attacker %s", event.SSHInfo.RemoteHost),
+	}, true
+}
+
+// alertDedupKey groups repeated alerts of the same rule for the same source,
+// so incident tools update one incident instead of opening many.
+func alertDedupKey(alert Alert) string {
+	return fmt.Sprintf("ssh-honeypot/%s/%s", alert.Rule, alert.Event.SSHInfo.RemoteHost)
+}
+
+// alertDetails flattens the interesting event attributes of an alert.
+func alertDetails(alert Alert) map[string]string {
+	sshInfo := alert.Event.SSHInfo
+	ipInfo := alert.Event.IPInfo
+
+	details := map[string]string{
+		"rule":           alert.Rule,
+		"severity":       alert.Severity,
+		"remote_host":    sshInfo.RemoteHost,
+		"local_port":     sshInfo.LocalPort,
+		"function":       sshInfo.Function,
+		"user":           sshInfo.User,
+		"password":       sshInfo.Password,
+		"key_type":       sshInfo.KeyType,
+		"client_version": sshInfo.ClientVersion,
+		"country":        ipInfo.Country,
+		"city":           ipInfo.City,
+		"org":            ipInfo.Org,
+	}
+	for key, value := range details {
+		if value == "" {
+			delete(details, key)
+		}
+	}
+
+	return details
+}
+
+// severityFilter only forwards alerts of at least a minimum severity.
+type severityFilter struct {
+	Notifier
+	minSeverity string
+}
+
+func (f severityFilter) Notify(ctx context.Context, alert Alert) error {
+	if severityRank(alert.Severity) < severityRank(f.minSeverity) {
+		return nil
+	}
+
+	return f.Notifier.Notify(ctx, alert)
+}
+
+// notifiersFromEnv builds every notifier whose settings are present in the
+// environment.
+func notifiersFromEnv() ([]Notifier, error) {
+	var notifiers []Notifier
+
+	if webhookURL := os.Getenv("SLACK_WEBHOOK_URL"); webhookURL != "" {
+		templateText, err := templateFromEnv("SLACK_TEMPLATE", defaultSlackTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		slack, err := NewSlackNotifier(webhookURL, os.Getenv("SLACK_CHANNEL"), templateText)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Slack notifier: %v", err)
+		}
+		notifiers = append(notifiers, slack)
+	}
+
+	if webhookURL := os.Getenv("TEAMS_WEBHOOK_URL"); webhookURL != "" {
+		templateText, err := templateFromEnv("TEAMS_TEMPLATE", defaultTeamsTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		teams, err := NewTeamsNotifier(webhookURL, templateText)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Teams notifier: %v", err)
+		}
+		notifiers = append(notifiers, teams)
+	}
+
+	if webhookURL := os.Getenv("DISCORD_WEBHOOK_URL"); webhookURL != "" {
+		templateText, err := templateFromEnv("DISCORD_TEMPLATE", defaultDiscordTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		discord, err := NewDiscordNotifier(webhookURL, os.Getenv("DISCORD_USERNAME"), templateText)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Discord notifier: %v", err)
+		}
+		notifiers = append(notifiers, discord)
+	}
+
+	if botToken := os.Getenv("TELEGRAM_BOT_TOKEN"); botToken != "" {
+		chatID := os.Getenv("TELEGRAM_CHAT_ID")
+		if chatID == "" {
+			return nil, fmt.Errorf("TELEGRAM_CHAT_ID is not set")
+		}
+
+		templateText, err := templateFromEnv("TELEGRAM_TEMPLATE", defaultTelegramTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		telegram, err := NewTelegramNotifier(botToken, chatID, templateText)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Telegram notifier: %v", err)
+		}
+
+		if digest := getEnvDuration("TELEGRAM_DIGEST_INTERVAL", 0); digest > 0 {
+			notifiers = append(notifiers, NewDigestNotifier(telegram, digest))
+		} else {
+			notifiers = append(notifiers, telegram)
+		}
+	}
+
+	if topic := os.Getenv("NTFY_TOPIC"); topic != "" {
+		templateText, err := templateFromEnv("NTFY_TEMPLATE", defaultPushTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		ntfy, err := NewNtfyNotifier(getEnv("NTFY_URL", "https://ntfy.sh"), topic, os.Getenv("NTFY_TOKEN"), templateText)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ntfy notifier: %v", err)
+		}
+		notifiers = append(notifiers, ntfy)
+	}
+
+	if appToken := os.Getenv("PUSHOVER_APP_TOKEN"); appToken != "" {
+		userKey := os.Getenv("PUSHOVER_USER_KEY")
+		if userKey == "" {
+			return nil, fmt.Errorf("PUSHOVER_USER_KEY is not set")
+		}
+
+		templateText, err := templateFromEnv("PUSHOVER_TEMPLATE", defaultPushTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		pushover, err := NewPushoverNotifier(appToken, userKey, templateText)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Pushover notifier: %v", err)
+		}
+		notifiers = append(notifiers, pushover)
+	}
+
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		var templates EmailTemplates
+		var err error
+		if templates.Subject, err = templateFromEnv("SMTP_SUBJECT_TEMPLATE", defaultEmailSubjectTemplate); err != nil {
+			return nil, err
+		}
+		if templates.Text, err = templateFromEnv("SMTP_TEXT_TEMPLATE", defaultEmailTextTemplate); err != nil {
+			return nil, err
+		}
+		if templates.HTML, err = templateFromEnv("SMTP_HTML_TEMPLATE", defaultEmailHTMLTemplate); err != nil {
+			return nil, err
+		}
+
+		email, err := NewEmailNotifier(
+			smtpHost,
+			getEnv("SMTP_PORT", "587"),
+			getEnv("SMTP_SECURITY", SMTPSecurityStartTLS),
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+			os.Getenv("SMTP_FROM"),
+			splitList(os.Getenv("SMTP_TO")),
+			templates,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create email notifier: %v", err)
+		}
+
+		notifiers = append(notifiers, severityFilter{
+			Notifier:    email,
+			minSeverity: getEnv("SMTP_MIN_SEVERITY", SeverityInfo),
+		})
+	}
+
+	if routingKey := os.Getenv("PAGERDUTY_ROUTING_KEY"); routingKey != "" {
+		summaryTemplate, err := templateFromEnv("PAGERDUTY_SUMMARY_TEMPLATE", defaultPagerDutySummaryTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		pagerDuty, err := NewPagerDutyNotifier(routingKey, summaryTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create PagerDuty notifier: %v", err)
+		}
+
+		notifiers = append(notifiers, severityFilter{
+			Notifier:    pagerDuty,
+			minSeverity: getEnv("PAGERDUTY_MIN_SEVERITY", SeverityCritical),
+		})
+	}
+
+	if apiKey := os.Getenv("OPSGENIE_API_KEY"); apiKey != "" {
+		messageTemplate, err := templateFromEnv("OPSGENIE_MESSAGE_TEMPLATE", defaultOpsgenieMessageTemplate)
+		if err != nil {
+			return nil, err
+		}
+		descriptionTemplate, err := templateFromEnv("OPSGENIE_DESCRIPTION_TEMPLATE", defaultOpsgenieDescriptionTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		opsgenie, err := NewOpsgenieNotifier(getEnv("OPSGENIE_API_URL", "https://api.opsgenie.com"), apiKey, messageTemplate, descriptionTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Opsgenie notifier: %v", err)
+		}
+
+		notifiers = append(notifiers, severityFilter{
+			Notifier:    opsgenie,
+			minSeverity: getEnv("OPSGENIE_MIN_SEVERITY", SeverityCritical),
+		})
+	}
+
+	return notifiers, nil
+}
+
+// Alerter evaluates alert rules against enriched events and fans matching
+// alerts out to every notifier from a single background worker, so slow
+// webhooks never hold up the pipeline.
+type Alerter struct {
+	rules        []AlertRule
+	rulesMu      sync.RWMutex
+	notifiers    []Notifier
+	dashboardURL string
+	throttle     *AlertThrottle
+	queue        chan Alert
+	tracer       trace.Tracer
+	done         chan struct{}
+}
+
+func NewAlerter(ruleNames []string, notifiers []Notifier, dashboardURL string, throttle *AlertThrottle, tracer trace.Tracer) (*Alerter, error) {
+	a := &Alerter{
+		notifiers:    notifiers,
+		dashboardURL: dashboardURL,
+		throttle:     throttle,
+		queue:        make(chan Alert, 256),
+		tracer:       tracer,
+		done:         make(chan struct{}),
+	}
+
+	if err := a.SetRules(ruleNames); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// SetRules replaces the evaluated rules. Rules that were already enabled
+// are kept as they are, along with what they remember of past events.
+func (a *Alerter) SetRules(ruleNames []string) error {
+	a.rulesMu.Lock()
+	defer a.rulesMu.Unlock()
+
+	var rules []AlertRule
+	for _, name := range ruleNames {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		newRule, ok := alertRules[name]
+		if !ok {
+			return fmt.Errorf("unknown alert rule '%s'", name)
+		}
+
+		rule := newRule()
+		for _, current := range a.rules {
+			if current.Name() == name {
+				rule = current
+			}
+		}
+		rules = append(rules, rule)
+	}
+	a.rules = rules
+
+	return nil
+}
+
+func (a *Alerter) Start() {
+	go func() {
+		defer close(a.done)
+
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case alert, ok := <-a.queue:
+				if !ok {
+					return
+				}
+				a.dispatch(alert)
+			case <-ticker.C:
+				for _, rollUp := range a.throttle.RollUps() {
+					a.dispatch(rollUp)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops accepting alerts and waits for the queued ones to be sent.
+func (a *Alerter) Close() {
+	close(a.queue)
+	<-a.done
+
+	// Digests still pending are sent
+	for _, notifier := range a.notifiers {
+		if closer, ok := notifier.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				slog.Error("Failed to close notifier", "notifier", notifier.Name(), "error", err)
+			}
+		}
+	}
+}
+
+// Observe evaluates every rule against event and queues the resulting alerts.
+func (a *Alerter) Observe(ctx context.Context, event Event) {
+	if len(a.notifiers) == 0 {
+		return
+	}
+
+	a.rulesMu.RLock()
+	rules := a.rules
+	a.rulesMu.RUnlock()
+
+	for _, rule := range rules {
+		alert, ok := rule.Match(event)
+		if !ok {
+			continue
+		}
+
+		alert.Rule = rule.Name()
+		alert.Event = event
+		alert.DashboardURL = a.dashboardURL
+		alert.Timestamp = time.Now()
+		a.Raise(alert)
+	}
+}
+
+// Raise queues an alert without blocking, dropping it if the queue is full.
+// Repeated alerts are held back by the throttle and rolled up later, unless
+// immediate.
+func (a *Alerter) Raise(alert Alert) {
+	if !alert.Immediate && !a.throttle.Allow(alert) {
+		return
+	}
+
+	select {
+	case a.queue <- alert:
+	default:
+		slog.Warn("Alert queue full, dropping alert", "rule", alert.Rule, "remote_host", alert.Event.SSHInfo.RemoteHost)
+	}
+}
+
+func (a *Alerter) dispatch(alert Alert) {
+	for _, notifier := range a.notifiers {
+		ctx, span := a.tracer.Start(
+			context.Background(),
+			"notify",
+			trace.WithAttributes(
+				attribute.String("notifier", notifier.Name()),
+				attribute.String("rule", alert.Rule)))
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := notifier.Notify(ctx, alert)
+		cancel()
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.ErrorContext(ctx, "Failed to send alert", "rule", alert.Rule, "notifier", notifier.Name(), "error", err)
+		} else {
+			span.SetStatus(codes.Ok, fmt.Sprintf("Sent '%s' alert via %s", alert.Rule, notifier.Name()))
+		}
+		span.End()
+	}
+}
+
+// postJSON posts payload as JSON to url and fails on any non-2xx response.
+func postJSON(ctx context.Context, url string, payload any, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
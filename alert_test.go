@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertThrottle(t *testing.T) {
+	throttle := NewAlertThrottle(time.Hour, 2)
+	alert := func(rule string, host string) Alert {
+		return Alert{Rule: rule, Event: Event{SSHInfo: SSHInfo{RemoteHost: host}}}
+	}
+
+	if !throttle.Allow(alert("spray", "203.0.113.7")) {
+		t.Fatal("first alert throttled")
+	}
+	if throttle.Allow(alert("spray", "203.0.113.7")) {
+		t.Error("same rule and source IP not deduplicated")
+	}
+	if !throttle.Allow(alert("spray", "203.0.113.8")) {
+		t.Error("other source IP deduplicated")
+	}
+	if throttle.Allow(alert("session", "203.0.113.7")) {
+		t.Error("rate limit of 2 alerts a minute not applied")
+	}
+}
+
+func TestAlertRules(t *testing.T) {
+	tests := []struct {
+		rule    string
+		events  []Event
+		matches []bool
+	}{
+		{
+			rule: "honeytoken",
+			events: []Event{
+				{SSHInfo: SSHInfo{Function: "honeytoken", User: "backup"}},
+				{SSHInfo: SSHInfo{Function: "password", User: "backup"}},
+			},
+			matches: []bool{true, false},
+		},
+		{
+			rule: "first_seen_country",
+			events: []Event{
+				{IPInfo: IPInfo{Country: "PT"}},
+				{IPInfo: IPInfo{Country: "PT"}},
+				{IPInfo: IPInfo{Country: "CN"}},
+				{IPInfo: IPInfo{}},
+			},
+			matches: []bool{true, false, true, false},
+		},
+		{
+			rule: "key_reuse",
+			events: []Event{
+				{},
+				{Analysis: Analysis{KeyReused: true}},
+				{Analysis: Analysis{KeyCampaign: "mirai"}},
+			},
+			matches: []bool{false, true, true},
+		},
+	}
+
+	for _, test := range tests {
+		rule := alertRules[test.rule]()
+		for i, event := range test.events {
+			if _, matched := rule.Match(event); matched != test.matches[i] {
+				t.Errorf("%s: event %d matched = %t, want %t", test.rule, i, matched, test.matches[i])
+			}
+		}
+	}
+}
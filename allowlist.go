@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// AllowlistLog keeps the events of allowlisted IPs apart from the dataset,
+// appending them as JSON lines to a file of their own. The file is kept open
+// and written by a goroutine of its own, off the capture path, the events
+// being dropped while its queue is full, or once it is closed.
+type AllowlistLog struct {
+	path    string
+	file    *os.File
+	queue   chan SSHInfo
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// allowlistLogFromEnv returns nil, the events of allowlisted IPs being
+// discarded, unless ALLOWLIST_LOG_PATH is set.
+func allowlistLogFromEnv() (*AllowlistLog, error) {
+	path := os.Getenv("ALLOWLIST_LOG_PATH")
+	if path == "" {
+		return nil, nil
+	}
+
+	return NewAllowlistLog(path, getEnvInt("ALLOWLIST_LOG_QUEUE_SIZE", 1024))
+}
+
+func NewAllowlistLog(path string, queueSize int) (*AllowlistLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &AllowlistLog{
+		path:  path,
+		file:  file,
+		queue: make(chan SSHInfo, queueSize),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+
+	return l, nil
+}
+
+// Write queues sshInfo to be appended to the log, laid out as in the event
+// file, returning false when the queue is full or the log closed.
+func (l *AllowlistLog) Write(sshInfo SSHInfo) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return false
+	}
+	select {
+	case l.queue <- sshInfo:
+		return true
+	default:
+		if dropped := l.dropped.Add(1); dropped%100 == 1 {
+			slog.Warn("Allowlist log queue full, dropping event", "path", l.path, "dropped", dropped)
+		}
+		return false
+	}
+}
+
+func (l *AllowlistLog) run() {
+	defer close(l.done)
+
+	for sshInfo := range l.queue {
+		line, err := json.Marshal(newEventDocument(Event{SSHInfo: sshInfo}))
+		if err == nil {
+			_, err = l.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			slog.Error("Failed to log event from allowlisted IP", "path", l.path, "error", err)
+		}
+	}
+}
+
+// Close writes what is queued and closes the file, the events written after
+// it being dropped.
+func (l *AllowlistLog) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	close(l.queue)
+	l.mu.Unlock()
+	<-l.done
+
+	return l.file.Close()
+}
+
+// allowlistCapture wraps capture to keep the events of allowlisted IPs, such
+// as an operator testing their own honeypot, out of the dataset, the
+// detectors and the alerts, writing them to log instead when it isn't nil.
+func allowlistCapture(capture func(SSHInfo) bool, log *AllowlistLog) func(SSHInfo) bool {
+	return func(sshInfo SSHInfo) bool {
+		if !currentSettings().Allowed(net.ParseIP(sshInfo.RemoteHost)) {
+			return capture(sshInfo)
+		}
+
+		slog.Debug("Skipping event from allowlisted IP", "function", sshInfo.Function, "remote_host", sshInfo.RemoteHost)
+		if log != nil {
+			log.Write(sshInfo)
+		}
+
+		return true
+	}
+}
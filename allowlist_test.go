@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAllowlistLogWriteAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "allowlisted.jsonl")
+	log, err := NewAllowlistLog(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !log.Write(SSHInfo{Function: "password", RemoteHost: "192.0.2.1", User: "root"}) {
+		t.Fatal("event dropped")
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Events of late producers, e.g. fleet nodes, are dropped
+	if log.Write(SSHInfo{Function: "password", RemoteHost: "192.0.2.1", User: "admin"}) {
+		t.Error("event written after Close")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"root"`) {
+		t.Errorf("log = %q", data)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// annotationTags are the tags of an annotation for alert, for filtering them
+// on dashboards.
+func annotationTags(alert Alert) []string {
+	return []string{"ssh-honeypot", alert.Rule, alert.Severity}
+}
+
+// annotationTime is when the event of alert happened, rather than when it was
+// raised.
+func annotationTime(alert Alert) time.Time {
+	if timestamp := alert.Event.SSHInfo.Timestamp; !timestamp.IsZero() {
+		return timestamp
+	}
+
+	return alert.Timestamp
+}
+
+// GrafanaAnnotator turns alerts into annotations through the Grafana HTTP
+// API, overlaid on the dashboard of dashboardUID if set, or on every
+// dashboard querying them otherwise.
+type GrafanaAnnotator struct {
+	url          string
+	apiKey       string
+	dashboardUID string
+}
+
+func NewGrafanaAnnotator(url string, apiKey string, dashboardUID string) *GrafanaAnnotator {
+	return &GrafanaAnnotator{
+		url:          strings.TrimRight(url, "/"),
+		apiKey:       apiKey,
+		dashboardUID: dashboardUID,
+	}
+}
+
+func (a *GrafanaAnnotator) Name() string {
+	return "grafana"
+}
+
+func (a *GrafanaAnnotator) Notify(ctx context.Context, alert Alert) error {
+	payload := map[string]any{
+		"time": annotationTime(alert).UnixMilli(),
+		"tags": annotationTags(alert),
+		"text": alert.Summary,
+	}
+	if a.dashboardUID != "" {
+		payload["dashboardUID"] = a.dashboardUID
+	}
+
+	var headers map[string]string
+	if a.apiKey != "" {
+		headers = map[string]string{"Authorization": "Bearer " + a.apiKey}
+	}
+
+	return postJSON(ctx, a.url+"/api/annotations", payload, headers)
+}
+
+// InfluxAnnotator writes alerts as points of the "annotation" measurement
+// next to the events, for annotation queries of InfluxDB data sources.
+type InfluxAnnotator struct {
+	writeAPI InfluxdbWriteAPI
+}
+
+func (a InfluxAnnotator) Name() string {
+	return "influxdb"
+}
+
+func (a InfluxAnnotator) Notify(ctx context.Context, alert Alert) error {
+	point := influxdb2.NewPointWithMeasurement("annotation").
+		AddTag("rule", alert.Rule).
+		AddTag("severity", alert.Severity).
+		AddField("title", alert.Rule).
+		AddField("text", alert.Summary).
+		AddField("tags", strings.Join(annotationTags(alert), ",")).
+		SetTime(annotationTime(alert))
+	if remoteHost := alert.Event.SSHInfo.RemoteHost; remoteHost != "" {
+		point.AddField("remote_host", remoteHost)
+	}
+
+	return a.writeAPI.WriteAPIBlocking.WritePoint(ctx, point)
+}
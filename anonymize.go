@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Credential modes, how an Anonymizer anonymizes passwords and public keys.
+const (
+	// CredentialsDrop removes them
+	CredentialsDrop = "drop"
+	// CredentialsHash replaces them by a keyed hash, so the same one still
+	// counts as one
+	CredentialsHash = "hash"
+	// CredentialsTruncate keeps the first characters of passwords and the
+	// type of public keys
+	CredentialsTruncate = "truncate"
+)
+
+// truncatedPasswordLength is the number of characters CredentialsTruncate
+// keeps of passwords.
+const truncatedPasswordLength = 3
+
+// Anonymizer strips personal data from events before they are stored, while
+// keeping them usable for trend analysis: IPs are truncated to their network,
+// usernames replaced by a keyed hash, so the same username still counts as
+// one, and passwords and public keys dropped, hashed or truncated.
+type Anonymizer struct {
+	truncateIPs   bool
+	hashUsers     bool
+	anonPasswords bool
+	anonKeys      bool
+	credentials   string
+	salt          []byte
+}
+
+// NewAnonymizer builds an anonymizer for the given fields, any of "ip",
+// "user", "password" and "key", passwords and keys being anonymized as set by
+// credentials, one of the credential modes, CredentialsDrop by default.
+func NewAnonymizer(fields []string, credentials string, salt string) (*Anonymizer, error) {
+	a := &Anonymizer{credentials: credentials, salt: []byte(salt)}
+	for _, field := range fields {
+		switch field {
+		case "ip":
+			a.truncateIPs = true
+		case "user":
+			a.hashUsers = true
+		case "password":
+			a.anonPasswords = true
+		case "key":
+			a.anonKeys = true
+		default:
+			return nil, fmt.Errorf("unknown field to anonymize '%s'", field)
+		}
+	}
+
+	switch credentials {
+	case "":
+		a.credentials = CredentialsDrop
+	case CredentialsDrop, CredentialsHash, CredentialsTruncate:
+	default:
+		return nil, fmt.Errorf("unknown credential anonymization '%s'", credentials)
+	}
+
+	if a.hashUsers && salt == "" {
+		return nil, fmt.Errorf("a salt is required to hash usernames")
+	}
+	if (a.anonPasswords || a.anonKeys) && a.credentials == CredentialsHash && salt == "" {
+		return nil, fmt.Errorf("a salt is required to hash credentials")
+	}
+
+	return a, nil
+}
+
+// Anonymize returns a copy of event with the configured fields anonymized. A
+// nil anonymizer leaves events untouched.
+func (a *Anonymizer) Anonymize(event Event) Event {
+	if a == nil {
+		return event
+	}
+
+	if a.truncateIPs {
+		event.SSHInfo.RemoteHost = truncateIP(event.SSHInfo.RemoteHost)
+		event.SSHInfo.RemotePort = ""
+		event.IPInfo.IP = truncateIP(event.IPInfo.IP)
+	}
+	if a.hashUsers && event.SSHInfo.User != "" {
+		event.SSHInfo.User = a.hash(event.SSHInfo.User)
+	}
+	if a.anonPasswords && event.SSHInfo.Password != "" {
+		switch a.credentials {
+		case CredentialsHash:
+			event.SSHInfo.Password = a.hash(event.SSHInfo.Password)
+		case CredentialsTruncate:
+			event.SSHInfo.Password = truncatePassword(event.SSHInfo.Password)
+		default:
+			event.SSHInfo.Password = ""
+		}
+	}
+	if a.anonKeys && event.SSHInfo.Key != "" {
+		switch a.credentials {
+		case CredentialsHash:
+			event.SSHInfo.Key = a.hash(event.SSHInfo.Key)
+			event.SSHInfo.KeyFingerprint = a.hash(event.SSHInfo.KeyFingerprint)
+		case CredentialsTruncate:
+			// The key type and size, already in KeyType and KeyBits, are all
+			// that is kept
+			event.SSHInfo.Key, _, _ = strings.Cut(event.SSHInfo.Key, " ")
+			event.SSHInfo.KeyFingerprint = ""
+		default:
+			event.SSHInfo.Key = ""
+			event.SSHInfo.KeyFingerprint = ""
+		}
+		event.SSHInfo.KeyMD5 = ""
+	}
+
+	return event
+}
+
+// hash returns the HMAC-SHA256 of value keyed with the salt, shortened to 64
+// bits, plenty to tell apart the values of a honeypot.
+func (a *Anonymizer) hash(value string) string {
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// truncatePassword keeps the first characters of password.
+func truncatePassword(password string) string {
+	runes := []rune(password)
+	if len(runes) <= truncatedPasswordLength {
+		return string(runes[:1])
+	}
+
+	return string(runes[:truncatedPasswordLength])
+}
+
+// truncateIP keeps the /24 of IPv4 and the /48 of IPv6 addresses.
+func truncateIP(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return value
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// AnonymizingEncoder anonymizes events before handing them to the wrapped
+// encoder, so only the sink using it sees anonymized data.
+type AnonymizingEncoder struct {
+	BatchEncoder
+	Anonymizer *Anonymizer
+}
+
+func (e AnonymizingEncoder) Encode(buf *bytes.Buffer, event Event) {
+	e.BatchEncoder.Encode(buf, e.Anonymizer.Anonymize(event))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func anonymizerEvent() Event {
+	return Event{
+		SSHInfo: SSHInfo{
+			RemoteHost:     "203.0.113.7",
+			RemotePort:     "51234",
+			User:           "root",
+			Password:       "hunter2",
+			Key:            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 comment",
+			KeyFingerprint: "SHA256:abc",
+			KeyMD5:         "MD5:ab:cd",
+		},
+		IPInfo: IPInfo{IP: "203.0.113.7", Country: "PT"},
+	}
+}
+
+func TestAnonymizer(t *testing.T) {
+	anonymizer, err := NewAnonymizer([]string{"ip", "user", "password", "key"}, CredentialsTruncate, "salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := anonymizer.Anonymize(anonymizerEvent())
+	sshInfo := event.SSHInfo
+	if sshInfo.RemoteHost != "203.0.113.0" || event.IPInfo.IP != "203.0.113.0" || sshInfo.RemotePort != "" {
+		t.Errorf("IP not truncated: %s:%s, %s", sshInfo.RemoteHost, sshInfo.RemotePort, event.IPInfo.IP)
+	}
+	if sshInfo.User == "root" || len(sshInfo.User) != 16 {
+		t.Errorf("user not hashed: %q", sshInfo.User)
+	}
+	if sshInfo.Password != "hun" {
+		t.Errorf("password = %q, want it truncated", sshInfo.Password)
+	}
+	if sshInfo.Key != "ssh-ed25519" || sshInfo.KeyFingerprint != "" || sshInfo.KeyMD5 != "" {
+		t.Errorf("key not truncated: %q %q %q", sshInfo.Key, sshInfo.KeyFingerprint, sshInfo.KeyMD5)
+	}
+	if event.IPInfo.Country != "PT" {
+		t.Error("country anonymized")
+	}
+
+	// The same username counts as one
+	if again := anonymizer.Anonymize(anonymizerEvent()); again.SSHInfo.User != sshInfo.User {
+		t.Error("hash of the username not stable")
+	}
+	if truncateIP("2001:db8:1:2::7") != "2001:db8:1::" {
+		t.Errorf("IPv6 truncated to %s", truncateIP("2001:db8:1:2::7"))
+	}
+}
+
+func TestAnonymizerCredentials(t *testing.T) {
+	dropped, err := NewAnonymizer([]string{"password", "key"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := dropped.Anonymize(anonymizerEvent()); event.SSHInfo.Password != "" || event.SSHInfo.Key != "" || event.SSHInfo.User != "root" {
+		t.Errorf("credentials not dropped: %+v", event.SSHInfo)
+	}
+
+	hashed, err := NewAnonymizer([]string{"password"}, CredentialsHash, "salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := hashed.Anonymize(anonymizerEvent()).SSHInfo.Password; password == "hunter2" || strings.Contains(password, "hunter") {
+		t.Errorf("password not hashed: %q", password)
+	}
+
+	if _, err := NewAnonymizer([]string{"user"}, "", ""); err == nil {
+		t.Error("usernames hashed without a salt")
+	}
+	if _, err := NewAnonymizer([]string{"email"}, "", ""); err == nil {
+		t.Error("unknown field accepted")
+	}
+}
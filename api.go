@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// API serves JSON views of the honeypot's in-process state, and a few
+// administrative actions. With a token, requests must carry it as a bearer
+// token.
+type API struct {
+	mux    *http.ServeMux
+	token  atomic.Pointer[string]
+	mu     sync.Mutex
+	server *http.Server
+}
+
+func NewAPI(token string) *API {
+	a := &API{mux: http.NewServeMux()}
+	a.SetToken(token)
+	return a
+}
+
+// SetToken replaces the token requests must carry, none for no
+// authentication.
+func (a *API) SetToken(token string) {
+	a.token.Store(&token)
+}
+
+// authorized checks the bearer token of r, answering it when it's missing or
+// wrong. Without a token, only the requests not required to be
+// authenticated are.
+func (a *API) authorized(w http.ResponseWriter, r *http.Request, required bool) bool {
+	want := *a.token.Load()
+	if want == "" {
+		if required {
+			http.Error(w, "API_TOKEN is not set, actions are disabled", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ssh-honeypot"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// Handle registers a JSON endpoint; fn is called for every GET request and
+// its result is encoded as the response body.
+func (a *API) Handle(path string, fn func(r *http.Request) (any, error)) {
+	a.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(w, r, false) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result, err := fn(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, result)
+	})
+}
+
+// HandleAction registers a JSON endpoint for an action; fn is called for
+// every POST request and its result is encoded as the response body. Actions
+// always require the token, being refused when none is set.
+func (a *API) HandleAction(path string, fn func(r *http.Request) (any, error)) {
+	a.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(w, r, true) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result, err := fn(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		writeJSON(w, result)
+	})
+}
+
+// HandleProbe registers an endpoint for load balancers and orchestrators,
+// served without authentication.
+func (a *API) HandleProbe(path string, handler http.Handler) {
+	a.mux.Handle(path, handler)
+}
+
+// HandleStream registers a long-lived endpoint, e.g. an event stream,
+// served by handler for every GET request until the client goes away or the
+// server shuts down.
+func (a *API) HandleStream(path string, handler http.Handler) {
+	a.HandleGet(path, handler)
+}
+
+// HandleGet registers an endpoint served by handler for every GET request,
+// for the ones not answering with JSON views, e.g. streams or feeds.
+func (a *API) HandleGet(path string, handler http.Handler) {
+	a.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(w, r, false) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves the API on addr.
+func (a *API) ListenAndServe(addr string) error {
+	server := newHTTPServer(addr, a.mux)
+	a.mu.Lock()
+	a.server = server
+	a.mu.Unlock()
+
+	slog.Info("Starting API server", "addr", addr)
+	return server.ListenAndServe()
+}
+
+// Shutdown stops the API server, letting in-flight requests finish until ctx
+// is done.
+func (a *API) Shutdown(ctx context.Context) error {
+	a.mu.Lock()
+	server := a.server
+	a.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// newHTTPServer returns a server for handler on addr whose requests are
+// cancelled when it shuts down, as streams would otherwise keep it from
+// ever finishing.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	server.RegisterOnShutdown(cancel)
+
+	return server
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("Failed to encode API response", "error", err)
+	}
+}
+
+// checkExposure refuses to serve the API on addr beyond the loopback
+// interface without token.
+func checkExposure(addr string, token string) error {
+	loopback, err := isLoopbackAddr(addr)
+	if err != nil || loopback || token != "" {
+		return err
+	}
+
+	return fmt.Errorf("API_TOKEN must be set to serve the API on '%s', beyond the loopback interface", addr)
+}
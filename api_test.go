@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIAuthorization(t *testing.T) {
+	api := NewAPI("")
+	api.Handle("/view", func(r *http.Request) (any, error) {
+		return "view", nil
+	})
+	api.HandleAction("/action", func(r *http.Request) (any, error) {
+		return "done", nil
+	})
+
+	status := func(method string, path string, token string) int {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := status(http.MethodGet, "/view", ""); code != http.StatusOK {
+		t.Errorf("view without a token: %d", code)
+	}
+	if code := status(http.MethodPost, "/action", ""); code != http.StatusForbidden {
+		t.Errorf("action without a token: %d", code)
+	}
+
+	api.SetToken("secret")
+	for _, test := range []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{http.MethodGet, "/view", "", http.StatusUnauthorized},
+		{http.MethodGet, "/view", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/view", "secret", http.StatusOK},
+		{http.MethodPost, "/action", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/action", "secret", http.StatusOK},
+		{http.MethodGet, "/action", "secret", http.StatusMethodNotAllowed},
+	} {
+		if code := status(test.method, test.path, test.token); code != test.code {
+			t.Errorf("%s %s with '%s': %d, want %d", test.method, test.path, test.token, code, test.code)
+		}
+	}
+}
+
+func TestCheckExposure(t *testing.T) {
+	tests := []struct {
+		addr  string
+		token string
+		err   bool
+	}{
+		{"127.0.0.1:8099", "", false},
+		{"localhost:8099", "", false},
+		{"[::1]:8099", "", false},
+		{":8099", "", true},
+		{"0.0.0.0:8099", "", true},
+		{":8099", "secret", false},
+	}
+	for _, test := range tests {
+		if err := checkExposure(test.addr, test.token); (err != nil) != test.err {
+			t.Errorf("checkExposure(%s, '%s') = %v", test.addr, test.token, err)
+		}
+	}
+}
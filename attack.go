@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// MITRE ATT&CK techniques attached to events.
+const (
+	TechniqueBruteForce           = "T1110"
+	TechniquePasswordGuessing     = "T1110.001"
+	TechniquePasswordSpraying     = "T1110.003"
+	TechniqueDefaultAccounts      = "T1078.001"
+	TechniqueRemoteServicesSSH    = "T1021.004"
+	TechniqueUnixShell            = "T1059.004"
+	TechniqueIngressToolTransfer  = "T1105"
+	TechniqueSSHAuthorizedKeys    = "T1098.004"
+	TechniqueAccountManipulation  = "T1098"
+	TechniqueCron                 = "T1053.003"
+	TechniqueSystemInfoDiscovery  = "T1082"
+	TechniqueClearCommandHistory  = "T1070.003"
+	TechniqueResourceHijacking    = "T1496"
+	TechniqueDisableSecurityTools = "T1562.001"
+	TechniqueProtocolTunneling    = "T1572"
+)
+
+// commandTechniques map what a command does to the technique it implements.
+var commandTechniques = []struct {
+	technique string
+	pattern   *regexp.Regexp
+}{
+	{TechniqueIngressToolTransfer, regexp.MustCompile(`\b(wget|curl|tftp|ftpget|scp)\b`)},
+	{TechniqueSSHAuthorizedKeys, regexp.MustCompile(`authorized_keys`)},
+	{TechniqueAccountManipulation, regexp.MustCompile(`\b(passwd|chpasswd|useradd|usermod)\b`)},
+	{TechniqueCron, regexp.MustCompile(`\bcrontab\b|/etc/cron`)},
+	{TechniqueSystemInfoDiscovery, regexp.MustCompile(`\buname\b|/proc/cpuinfo|\blscpu\b|\bnproc\b|/etc/os-release`)},
+	{TechniqueClearCommandHistory, regexp.MustCompile(`history\s+-c|\.bash_history|HISTFILE`)},
+	{TechniqueResourceHijacking, regexp.MustCompile(`xmrig|minerd|stratum\+tcp`)},
+	{TechniqueDisableSecurityTools, regexp.MustCompile(`setenforce\s+0|ufw\s+disable|iptables\s+-F|systemctl\s+stop\s+\S*(firewall|apparmor)`)},
+}
+
+// attackTechniques returns the ATT&CK techniques observed in event, in the
+// order they were matched.
+func attackTechniques(event Event) []string {
+	sshInfo := event.SSHInfo
+
+	switch sshInfo.Function {
+	case "password", "keyboard_interactive":
+		techniques := []string{TechniquePasswordGuessing}
+		if event.Analysis.PasswordPattern == PasswordDefault {
+			techniques = append(techniques, TechniqueDefaultAccounts)
+		}
+		return techniques
+	case "public_key":
+		return []string{TechniqueBruteForce}
+	case "spray":
+		return []string{TechniquePasswordSpraying}
+	case "session":
+		techniques := []string{TechniqueRemoteServicesSSH}
+		if sshInfo.Subsystem == "sftp" {
+			techniques = append(techniques, TechniqueIngressToolTransfer)
+		}
+		if sshInfo.Command != "" {
+			techniques = append(techniques, TechniqueUnixShell)
+			techniques = appendCommandTechniques(techniques, sshInfo.Command)
+		}
+		return techniques
+	case "command":
+		return appendCommandTechniques([]string{TechniqueUnixShell}, sshInfo.Command)
+	case "local_forward", "reverse_forward":
+		return []string{TechniqueProtocolTunneling}
+	}
+
+	return nil
+}
+
+// appendCommandTechniques appends the techniques matched by command that are
+// not in techniques yet.
+func appendCommandTechniques(techniques []string, command string) []string {
+	for _, candidate := range commandTechniques {
+		if !candidate.pattern.MatchString(command) {
+			continue
+		}
+
+		known := false
+		for _, technique := range techniques {
+			known = known || technique == candidate.technique
+		}
+		if !known {
+			techniques = append(techniques, candidate.technique)
+		}
+	}
+
+	return techniques
+}
+
+func annotateAttackTechniques(ctx context.Context, event *Event) {
+	event.Analysis.Techniques = strings.Join(attackTechniques(*event), ",")
+}
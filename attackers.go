@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Credential attack patterns.
+const (
+	PatternBruteForce = "brute_force"
+	PatternSpraying   = "spraying"
+	PatternStuffing   = "stuffing"
+	PatternMixed      = "mixed"
+)
+
+// Source IP classes, from what the source did rather than which credentials
+// it tried.
+const (
+	// ClassScanner connected and left without trying any credential, e.g.
+	// grabbing the banner
+	ClassScanner = "scanner"
+	// ClassSingleCredential tried a single credential, maybe repeatedly
+	ClassSingleCredential = "single_credential"
+	// ClassGuessing tried a few credentials, below the brute force rate
+	ClassGuessing = "guessing"
+	// ClassBruteForce tried credentials at bruteForceRate or faster
+	ClassBruteForce = "brute_force"
+	// ClassInteractive got in and opened a session
+	ClassInteractive = "interactive"
+)
+
+const (
+	// Attempts needed before a source IP's pattern is classified.
+	minPatternAttempts = 5
+
+	// Attempts within a minute making a source IP a brute forcer.
+	bruteForceRate = 10
+
+	// Distinct values remembered per source IP and kind.
+	maxAttackerCredentials = 1000
+)
+
+// Attacker is the aggregate record of a single source IP.
+type Attacker struct {
+	IP                  string    `json:"ip"`
+	FirstSeen           time.Time `json:"first_seen"`
+	LastSeen            time.Time `json:"last_seen"`
+	TotalAttempts       int       `json:"total_attempts"`
+	DistinctCredentials int       `json:"distinct_credentials"`
+	Pattern             string    `json:"pattern,omitempty"`
+	Class               string    `json:"class,omitempty"`
+	// PeakRate is the most attempts made within a minute
+	PeakRate int `json:"peak_rate,omitempty"`
+
+	// The credentials tried since startup, used to classify the pattern.
+	// They are not persisted, so after a restart distinct_credentials may
+	// count a credential tried before and after again.
+	usernames        map[string]struct{}
+	passwords        map[string]struct{}
+	credentials      map[string]struct{}
+	passwordAttempts int
+	minute           time.Time
+	minuteAttempts   int
+	interactive      bool
+}
+
+// AttackerStore tracks every source IP: when it was first and last seen, how
+// many attempts and distinct credentials it tried, and how it goes about
+// guessing credentials. Records are kept in a local JSON file and expire after
+// the retention period without activity.
+type AttackerStore struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	records   map[string]*Attacker
+	lastPrune time.Time
+	dirty     bool
+}
+
+func NewAttackerStore(path string, retention time.Duration) (*AttackerStore, error) {
+	s := &AttackerStore{
+		path:      path,
+		retention: retention,
+		records:   map[string]*Attacker{},
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var attackers []*Attacker
+	if err := json.Unmarshal(content, &attackers); err != nil {
+		slog.Warn("Discarding attacker store", "path", path, "error", err)
+		return s, nil
+	}
+	for _, attacker := range attackers {
+		s.records[attacker.IP] = attacker
+	}
+
+	return s, nil
+}
+
+// Annotate updates the record of the event's source IP and tags the event
+// with its attack pattern and class, flagging the first event of an unknown
+// IP.
+func (s *AttackerStore) Annotate(ctx context.Context, event *Event) {
+	sshInfo := event.SSHInfo
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(sshInfo.Timestamp)
+	s.dirty = true
+
+	record, found := s.records[sshInfo.RemoteHost]
+	if !found {
+		record = &Attacker{
+			IP:        sshInfo.RemoteHost,
+			FirstSeen: sshInfo.Timestamp,
+		}
+		s.records[sshInfo.RemoteHost] = record
+		event.Analysis.NewAttacker = true
+	}
+	if record.usernames == nil {
+		record.usernames = map[string]struct{}{}
+		record.passwords = map[string]struct{}{}
+		record.credentials = map[string]struct{}{}
+	}
+	record.LastSeen = sshInfo.Timestamp
+
+	switch sshInfo.Function {
+	case "password", "keyboard_interactive":
+		record.TotalAttempts++
+		record.passwordAttempts++
+		addBounded(record.usernames, sshInfo.User)
+		addBounded(record.passwords, sshInfo.Password)
+		record.addCredential(sshInfo.User + "\x00" + sshInfo.Password)
+
+		if record.passwordAttempts >= minPatternAttempts {
+			record.Pattern = credentialPattern(len(record.usernames), len(record.passwords), len(record.credentials))
+		}
+	case "public_key":
+		record.TotalAttempts++
+		record.addCredential(sshInfo.User + "\x00" + sshInfo.Key)
+	case "session", "command":
+		record.interactive = true
+	}
+	if isPasswordAttempt(sshInfo) || sshInfo.Function == "public_key" {
+		record.countRate(sshInfo.Timestamp, max(sshInfo.AttemptCount, 1))
+	}
+	record.Class = record.class()
+
+	event.Analysis.AttackPattern = record.Pattern
+	event.Analysis.SourceClass = record.Class
+}
+
+// countRate counts attempts towards the minute of timestamp, keeping the
+// peak rate.
+func (a *Attacker) countRate(timestamp time.Time, attempts int) {
+	minute := timestamp.Truncate(time.Minute)
+	if !minute.Equal(a.minute) {
+		a.minute, a.minuteAttempts = minute, 0
+	}
+	a.minuteAttempts += attempts
+	a.PeakRate = max(a.PeakRate, a.minuteAttempts)
+}
+
+// class returns the class of the source IP, from its most telling behavior
+// so far: a session over the rate of its attempts over how many credentials
+// it tried. A class persisted before a restart is only ever upgraded.
+func (a *Attacker) class() string {
+	switch {
+	case a.interactive || a.Class == ClassInteractive:
+		return ClassInteractive
+	case a.PeakRate >= bruteForceRate:
+		return ClassBruteForce
+	case a.DistinctCredentials > 1 || a.Class == ClassGuessing:
+		return ClassGuessing
+	case a.DistinctCredentials == 1:
+		return ClassSingleCredential
+	default:
+		return ClassScanner
+	}
+}
+
+func (a *Attacker) addCredential(credential string) {
+	if _, seen := a.credentials[credential]; seen {
+		return
+	}
+
+	a.DistinctCredentials++
+	addBounded(a.credentials, credential)
+}
+
+// credentialPattern classifies a source IP from how many distinct usernames,
+// passwords and pairs it tried:
+//   - brute force: few usernames, many passwords each
+//   - spraying: many usernames, few passwords tried against all of them
+//   - stuffing: many usernames and passwords, each used in a single pair
+//     as found in leaked credential dumps
+func credentialPattern(usernames int, passwords int, pairs int) string {
+	userRatio := float64(usernames) / float64(pairs)
+	passwordRatio := float64(passwords) / float64(pairs)
+
+	switch {
+	case userRatio <= 0.3 && passwordRatio > 0.5:
+		return PatternBruteForce
+	case passwordRatio <= 0.3 && userRatio > 0.5:
+		return PatternSpraying
+	case userRatio >= 0.8 && passwordRatio >= 0.8:
+		return PatternStuffing
+	default:
+		return PatternMixed
+	}
+}
+
+func addBounded(set map[string]struct{}, value string) {
+	if len(set) < maxAttackerCredentials {
+		set[value] = struct{}{}
+	}
+}
+
+// prune forgets source IPs idle for longer than the retention, at most once
+// a minute.
+func (s *AttackerStore) prune(now time.Time) {
+	if s.retention <= 0 || now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+
+	for ip, record := range s.records {
+		if now.Sub(record.LastSeen) > s.retention {
+			delete(s.records, ip)
+		}
+	}
+}
+
+// Attackers returns up to limit records, most recently seen first.
+func (s *AttackerStore) Attackers(limit int) []Attacker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attackers := make([]Attacker, 0, len(s.records))
+	for _, record := range s.records {
+		attackers = append(attackers, Attacker{
+			IP:                  record.IP,
+			FirstSeen:           record.FirstSeen,
+			LastSeen:            record.LastSeen,
+			TotalAttempts:       record.TotalAttempts,
+			DistinctCredentials: record.DistinctCredentials,
+			Pattern:             record.Pattern,
+			Class:               record.Class,
+			PeakRate:            record.PeakRate,
+		})
+	}
+
+	sort.Slice(attackers, func(i, j int) bool {
+		return attackers[i].LastSeen.After(attackers[j].LastSeen)
+	})
+	if limit > 0 && len(attackers) > limit {
+		attackers = attackers[:limit]
+	}
+
+	return attackers
+}
+
+// Save writes the records to the store file, atomically replacing it.
+func (s *AttackerStore) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	content, err := json.Marshal(s.Attackers(0))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func persistAttackerStore(s *AttackerStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.Save(); err != nil {
+			slog.Error("Failed to save attacker store", "error", err)
+		}
+	}
+}
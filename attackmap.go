@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	attackMapBucketSize = 5 * time.Minute
+	attackMapBuckets    = int(24 * time.Hour / attackMapBucketSize)
+)
+
+// attackOrigin is a source IP located by enrichment, and what it did over a
+// bucket.
+type attackOrigin struct {
+	ip        string
+	latitude  float64
+	longitude float64
+	country   string
+	city      string
+	org       string
+	events    int
+	attempts  int
+	lastSeen  time.Time
+}
+
+type attackMapBucket struct {
+	start   time.Time
+	origins map[string]*attackOrigin
+}
+
+// AttackMap keeps the located source IPs of the last day, in 5 minute
+// buckets, to be drawn on a world map as GeoJSON.
+type AttackMap struct {
+	mu      sync.Mutex
+	buckets []*attackMapBucket
+}
+
+func NewAttackMap() *AttackMap {
+	return &AttackMap{buckets: make([]*attackMapBucket, attackMapBuckets)}
+}
+
+// Observe counts the event towards its source IP, when it was located.
+func (m *AttackMap) Observe(ctx context.Context, event Event) {
+	sshInfo, ipInfo := event.SSHInfo, event.IPInfo
+	if ipInfo.Latitude == 0 && ipInfo.Longitude == 0 {
+		return
+	}
+
+	start := sshInfo.Timestamp.Truncate(attackMapBucketSize)
+	if time.Since(start) >= 24*time.Hour {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slot := int(start.Unix()/int64(attackMapBucketSize/time.Second)) % attackMapBuckets
+	bucket := m.buckets[slot]
+	if bucket == nil || !bucket.start.Equal(start) {
+		bucket = &attackMapBucket{start: start, origins: map[string]*attackOrigin{}}
+		m.buckets[slot] = bucket
+	}
+
+	origin, found := bucket.origins[sshInfo.RemoteHost]
+	if !found {
+		if len(bucket.origins) >= maxSourcesPerBucket {
+			return
+		}
+		origin = &attackOrigin{ip: sshInfo.RemoteHost}
+		bucket.origins[sshInfo.RemoteHost] = origin
+	}
+	origin.latitude, origin.longitude = ipInfo.Latitude, ipInfo.Longitude
+	origin.country, origin.city, origin.org = ipInfo.Country, ipInfo.City, ipInfo.Org
+	origin.events++
+	if isPasswordAttempt(sshInfo) || sshInfo.Function == "public_key" {
+		origin.attempts += max(sshInfo.AttemptCount, 1)
+	}
+	if sshInfo.Timestamp.After(origin.lastSeen) {
+		origin.lastSeen = sshInfo.Timestamp
+	}
+}
+
+// GeoJSON is a GeoJSON FeatureCollection (RFC 7946).
+type GeoJSON struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string          `json:"type"`
+	Geometry   GeoJSONGeometry `json:"geometry"`
+	Properties map[string]any  `json:"properties"`
+}
+
+type GeoJSONGeometry struct {
+	Type string `json:"type"`
+	// Coordinates are the longitude and the latitude, in that order
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// GeoJSON returns a point for each of the limit source IPs with the most
+// attempts over window, rounded up to whole buckets, the most events first
+// among equals. Their properties carry the attempts, as the weight of the
+// point, the events and when the IP was last seen.
+func (m *AttackMap) GeoJSON(window time.Duration, limit int) (GeoJSON, error) {
+	if window <= 0 || window > 24*time.Hour {
+		return GeoJSON{}, fmt.Errorf("window must be between 0 and 24h, got %s", window)
+	}
+
+	m.mu.Lock()
+	origins := map[string]*attackOrigin{}
+	since := time.Now().Add(-window).Truncate(attackMapBucketSize)
+	for _, bucket := range m.buckets {
+		if bucket == nil || bucket.start.Before(since) {
+			continue
+		}
+		for ip, origin := range bucket.origins {
+			merged, found := origins[ip]
+			if !found {
+				merged = &attackOrigin{}
+				*merged = *origin
+				merged.events, merged.attempts = 0, 0
+				origins[ip] = merged
+			}
+			merged.events += origin.events
+			merged.attempts += origin.attempts
+			if origin.lastSeen.After(merged.lastSeen) {
+				// The most recent location wins
+				events, attempts := merged.events, merged.attempts
+				*merged = *origin
+				merged.events, merged.attempts = events, attempts
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	sorted := make([]*attackOrigin, 0, len(origins))
+	for _, origin := range origins {
+		sorted = append(sorted, origin)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].attempts != sorted[j].attempts {
+			return sorted[i].attempts > sorted[j].attempts
+		}
+		if sorted[i].events != sorted[j].events {
+			return sorted[i].events > sorted[j].events
+		}
+		return sorted[i].ip < sorted[j].ip
+	})
+	if limit > 0 && len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+
+	collection := GeoJSON{Type: "FeatureCollection", Features: make([]GeoJSONFeature, 0, len(sorted))}
+	for _, origin := range sorted {
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: GeoJSONGeometry{Type: "Point", Coordinates: [2]float64{origin.longitude, origin.latitude}},
+			Properties: map[string]any{
+				"ip":        origin.ip,
+				"country":   origin.country,
+				"city":      origin.city,
+				"org":       origin.org,
+				"attempts":  origin.attempts,
+				"events":    origin.events,
+				"last_seen": origin.lastSeen,
+			},
+		})
+	}
+
+	return collection, nil
+}
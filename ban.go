@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Ban is a source IP that made too many authentication attempts.
+type Ban struct {
+	IP        string    `json:"ip"`
+	Attempts  int       `json:"attempts"`
+	Timestamp time.Time `json:"timestamp"`
+	BanTime   int       `json:"ban_time"`
+}
+
+// Banner bans the source IPs making threshold authentication attempts within
+// findTime, as fail2ban would, so other services on the network can block
+// them: bans are logged in a format fail2ban parses, passed to a command and
+// posted to a URL. A banned IP isn't banned again before banTime has passed.
+// Bans are carried out by a single worker so slow commands or APIs never hold
+// up the pipeline.
+type Banner struct {
+	threshold int
+	findTime  time.Duration
+	banTime   time.Duration
+	logPath   string
+	command   []string
+	url       string
+	tracer    trace.Tracer
+
+	mu        sync.Mutex
+	attempts  map[string][]time.Time
+	banned    map[string]time.Time
+	lastPrune time.Time
+
+	queue chan Ban
+	done  chan struct{}
+}
+
+func NewBanner(threshold int, findTime time.Duration, banTime time.Duration, logPath string, command string, banURL string, tracer trace.Tracer) *Banner {
+	return &Banner{
+		threshold: threshold,
+		findTime:  findTime,
+		banTime:   banTime,
+		logPath:   logPath,
+		command:   strings.Fields(command),
+		url:       banURL,
+		tracer:    tracer,
+		attempts:  map[string][]time.Time{},
+		banned:    map[string]time.Time{},
+		queue:     make(chan Ban, 256),
+		done:      make(chan struct{}),
+	}
+}
+
+func (b *Banner) Start() {
+	go func() {
+		defer close(b.done)
+		for ban := range b.queue {
+			b.dispatch(ban)
+		}
+	}()
+}
+
+// Close stops accepting bans and waits for the queued ones to be carried out.
+func (b *Banner) Close() {
+	close(b.queue)
+	<-b.done
+}
+
+// Observe counts the authentication attempts of the event's source IP and
+// queues a ban once they reach the threshold within the find time.
+func (b *Banner) Observe(ctx context.Context, event Event) {
+	sshInfo := event.SSHInfo
+	switch sshInfo.Function {
+	case "password", "keyboard_interactive", "public_key":
+	default:
+		return
+	}
+
+	b.mu.Lock()
+	now := sshInfo.Timestamp
+	b.prune(now)
+	if until, found := b.banned[sshInfo.RemoteHost]; found && now.Before(until) {
+		b.mu.Unlock()
+		return
+	}
+
+	attempts := append(recentAttempts(b.attempts[sshInfo.RemoteHost], now.Add(-b.findTime)), now)
+	if len(attempts) < b.threshold {
+		b.attempts[sshInfo.RemoteHost] = attempts
+		b.mu.Unlock()
+		return
+	}
+	delete(b.attempts, sshInfo.RemoteHost)
+	b.banned[sshInfo.RemoteHost] = now.Add(b.banTime)
+	b.mu.Unlock()
+
+	ban := Ban{
+		IP:        sshInfo.RemoteHost,
+		Attempts:  len(attempts),
+		Timestamp: now,
+		BanTime:   int(b.banTime.Seconds()),
+	}
+	select {
+	case b.queue <- ban:
+	default:
+		slog.WarnContext(ctx, "Ban queue full, dropping ban", "remote_host", ban.IP)
+	}
+}
+
+// prune forgets the attempts older than the find time and the expired bans,
+// at most once per find time.
+func (b *Banner) prune(now time.Time) {
+	if now.Sub(b.lastPrune) < b.findTime {
+		return
+	}
+	b.lastPrune = now
+
+	since := now.Add(-b.findTime)
+	for ip, attempts := range b.attempts {
+		if attempts = recentAttempts(attempts, since); len(attempts) == 0 {
+			delete(b.attempts, ip)
+		} else {
+			b.attempts[ip] = attempts
+		}
+	}
+	for ip, until := range b.banned {
+		if !now.Before(until) {
+			delete(b.banned, ip)
+		}
+	}
+}
+
+// recentAttempts returns the attempts made after since, attempts being in
+// chronological order.
+func recentAttempts(attempts []time.Time, since time.Time) []time.Time {
+	for i, attempt := range attempts {
+		if attempt.After(since) {
+			return attempts[i:]
+		}
+	}
+
+	return nil
+}
+
+func (b *Banner) dispatch(ban Ban) {
+	ctx, span := b.tracer.Start(
+		context.Background(),
+		"ban",
+		trace.WithAttributes(
+			attribute.String("remote_host", ban.IP),
+			attribute.Int("attempts", ban.Attempts)))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "Banning source IP", "remote_host", ban.IP, "attempts", ban.Attempts)
+	metrics.RecordBan(ctx)
+
+	var failed []string
+	if b.logPath != "" {
+		if err := b.writeLog(ban); err != nil {
+			span.RecordError(err)
+			failed = append(failed, "log")
+			slog.ErrorContext(ctx, "Failed to write ban log", "path", b.logPath, "error", err)
+		}
+	}
+	if len(b.command) > 0 {
+		if err := b.runCommand(ctx, ban); err != nil {
+			span.RecordError(err)
+			failed = append(failed, "command")
+			slog.ErrorContext(ctx, "Failed to run ban command", "remote_host", ban.IP, "error", err)
+		}
+	}
+	if b.url != "" {
+		if err := postJSON(ctx, b.url, ban, nil); err != nil {
+			span.RecordError(err)
+			failed = append(failed, "url")
+			slog.ErrorContext(ctx, "Failed to post ban", "remote_host", ban.IP, "error", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		span.SetStatus(codes.Error, "failed to ban through "+strings.Join(failed, ", "))
+	} else {
+		span.SetStatus(codes.Ok, fmt.Sprintf("Banned '%s'", ban.IP))
+	}
+}
+
+// writeLog appends a line for ban to the ban log, in the format of the
+// fail2ban filter given in the README.
+func (b *Banner) writeLog(ban Ban) error {
+	file, err := os.OpenFile(b.logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(file, "%s ssh-honeypot[%d]: Ban %s after %d authentication attempts\n",
+		ban.Timestamp.UTC().Format(time.DateTime), os.Getpid(), ban.IP, ban.Attempts)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// runCommand runs the ban command, its {ip} placeholders replaced with the
+// banned IP. It isn't run through a shell, the IP coming from the network.
+func (b *Banner) runCommand(ctx context.Context, ban Ban) error {
+	args := make([]string, len(b.command))
+	for i, arg := range b.command {
+		args[i] = strings.ReplaceAll(arg, "{ip}", ban.IP)
+	}
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Credentials remembered per source IP and per campaign.
+	maxProfileCredentials  = 200
+	maxCampaignCredentials = 2000
+
+	// Source IPs not seen for this long start over with a fresh profile.
+	campaignProfileTTL = 24 * time.Hour
+)
+
+// sourceProfile is what a single source IP has shown so far.
+type sourceProfile struct {
+	credentials map[string]struct{}
+	client      string
+	hassh       string
+	timing      int
+	campaign    *campaign
+	lastSeen    time.Time
+}
+
+type campaign struct {
+	id          string
+	client      string
+	hassh       string
+	timing      int
+	credentials map[string]struct{}
+	sourceIPs   map[string]struct{}
+	events      int
+	attempts    int
+	firstSeen   time.Time
+	lastSeen    time.Time
+}
+
+type Campaign struct {
+	ID          string    `json:"id"`
+	Client      string    `json:"client"`
+	HASSH       string    `json:"hassh,omitempty"`
+	SourceIPs   []string  `json:"source_ips"`
+	Credentials int       `json:"credentials"`
+	Events      int       `json:"events"`
+	Attempts    int       `json:"attempts"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// CampaignClusterer groups source IPs into campaigns. An IP joins a campaign
+// once it has tried enough credentials and most of them were already tried by
+// the campaign, from the same client and with a similar authentication
+// cadence. With matchHASSH, the client must also have the same HASSH, which
+// tells apart builds of a tool sharing a version string. Every event of an IP
+// in a campaign is tagged with the campaign ID.
+type CampaignClusterer struct {
+	mu             sync.Mutex
+	profiles       map[string]*sourceProfile
+	campaigns      map[string]*campaign
+	minCredentials int
+	similarity     float64
+	ttl            time.Duration
+	matchHASSH     bool
+	lastPrune      time.Time
+}
+
+func NewCampaignClusterer(minCredentials int, similarity float64, ttl time.Duration, matchHASSH bool) *CampaignClusterer {
+	return &CampaignClusterer{
+		profiles:       map[string]*sourceProfile{},
+		campaigns:      map[string]*campaign{},
+		minCredentials: minCredentials,
+		similarity:     similarity,
+		ttl:            ttl,
+		matchHASSH:     matchHASSH,
+	}
+}
+
+func (c *CampaignClusterer) Annotate(ctx context.Context, event *Event) {
+	sshInfo := event.SSHInfo
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prune(sshInfo.Timestamp)
+
+	profile, found := c.profiles[sshInfo.RemoteHost]
+	if !found {
+		profile = &sourceProfile{
+			credentials: map[string]struct{}{},
+			timing:      -1,
+		}
+		c.profiles[sshInfo.RemoteHost] = profile
+	}
+	profile.lastSeen = sshInfo.Timestamp
+
+	profile.client = event.Analysis.Tool
+	if profile.client == "" {
+		profile.client = sshInfo.ClientVersion
+	}
+	if c.matchHASSH && sshInfo.HASSH != "" {
+		profile.hassh = sshInfo.HASSH
+	}
+	if timing := timingBucket(sshInfo.Signals.AuthIntervals); timing >= 0 {
+		profile.timing = timing
+	}
+
+	credential := campaignCredential(sshInfo)
+	if credential != "" && len(profile.credentials) < maxProfileCredentials {
+		profile.credentials[credential] = struct{}{}
+	}
+
+	if profile.campaign == nil && len(profile.credentials) >= c.minCredentials {
+		profile.campaign = c.assign(sshInfo.RemoteHost, profile)
+	}
+
+	if campaign := profile.campaign; campaign != nil {
+		campaign.events++
+		if credential != "" {
+			campaign.attempts++
+		}
+		campaign.lastSeen = sshInfo.Timestamp
+		if credential != "" && len(campaign.credentials) < maxCampaignCredentials {
+			campaign.credentials[credential] = struct{}{}
+		}
+		event.Analysis.Campaign = campaign.id
+	}
+}
+
+// assign returns the campaign most similar to profile, starting a new one if
+// none is similar enough.
+func (c *CampaignClusterer) assign(ip string, profile *sourceProfile) *campaign {
+	var best *campaign
+	bestSimilarity := c.similarity
+	for _, candidate := range c.campaigns {
+		if candidate.client != profile.client || candidate.hassh != profile.hassh || !similarTiming(candidate.timing, profile.timing) {
+			continue
+		}
+
+		shared := 0
+		for credential := range profile.credentials {
+			if _, ok := candidate.credentials[credential]; ok {
+				shared++
+			}
+		}
+
+		similarity := float64(shared) / float64(len(profile.credentials))
+		if similarity >= bestSimilarity {
+			best = candidate
+			bestSimilarity = similarity
+		}
+	}
+
+	if best == nil {
+		best = &campaign{
+			id:          campaignID(profile),
+			client:      profile.client,
+			hassh:       profile.hassh,
+			timing:      profile.timing,
+			credentials: map[string]struct{}{},
+			sourceIPs:   map[string]struct{}{},
+			firstSeen:   profile.lastSeen,
+		}
+		c.campaigns[best.id] = best
+	}
+
+	best.sourceIPs[ip] = struct{}{}
+	for credential := range profile.credentials {
+		if len(best.credentials) >= maxCampaignCredentials {
+			break
+		}
+		best.credentials[credential] = struct{}{}
+	}
+
+	return best
+}
+
+// prune forgets idle source IPs and campaigns, at most once a minute.
+func (c *CampaignClusterer) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+
+	for ip, profile := range c.profiles {
+		if now.Sub(profile.lastSeen) > campaignProfileTTL {
+			delete(c.profiles, ip)
+		}
+	}
+	for id, campaign := range c.campaigns {
+		if now.Sub(campaign.lastSeen) > c.ttl {
+			delete(c.campaigns, id)
+		}
+	}
+}
+
+// Campaigns returns the active campaigns, largest first.
+func (c *CampaignClusterer) Campaigns() []Campaign {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	campaigns := make([]Campaign, 0, len(c.campaigns))
+	for _, campaign := range c.campaigns {
+		sourceIPs := make([]string, 0, len(campaign.sourceIPs))
+		for ip := range campaign.sourceIPs {
+			sourceIPs = append(sourceIPs, ip)
+		}
+		sort.Strings(sourceIPs)
+
+		campaigns = append(campaigns, Campaign{
+			ID:          campaign.id,
+			Client:      campaign.client,
+			HASSH:       campaign.hassh,
+			SourceIPs:   sourceIPs,
+			Credentials: len(campaign.credentials),
+			Events:      campaign.events,
+			Attempts:    campaign.attempts,
+			FirstSeen:   campaign.firstSeen,
+			LastSeen:    campaign.lastSeen,
+		})
+	}
+
+	sort.Slice(campaigns, func(a, b int) bool {
+		return len(campaigns[a].SourceIPs) > len(campaigns[b].SourceIPs)
+	})
+
+	return campaigns
+}
+
+func campaignCredential(sshInfo SSHInfo) string {
+	switch sshInfo.Function {
+	case "password", "keyboard_interactive":
+		return sshInfo.User + "\x00" + sshInfo.Password
+	case "public_key":
+		return sshInfo.User + "\x00" + sshInfo.Key
+	}
+
+	return ""
+}
+
+// campaignID derives a stable ID from the campaign's founding profile.
+func campaignID(profile *sourceProfile) string {
+	credentials := make([]string, 0, len(profile.credentials))
+	for credential := range profile.credentials {
+		credentials = append(credentials, credential)
+	}
+	sort.Strings(credentials)
+
+	hash := sha256.New()
+	hash.Write([]byte(profile.client))
+	if profile.hassh != "" {
+		hash.Write([]byte{0})
+		hash.Write([]byte(profile.hassh))
+	}
+	for _, credential := range credentials {
+		hash.Write([]byte{0})
+		hash.Write([]byte(credential))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:6])
+}
+
+// timingBucket is the base 2 logarithm of the mean authentication interval
+// in milliseconds, or -1 without intervals.
+func timingBucket(intervals []time.Duration) int {
+	if len(intervals) == 0 {
+		return -1
+	}
+
+	var total time.Duration
+	for _, interval := range intervals {
+		total += interval
+	}
+	mean := float64(total.Milliseconds()) / float64(len(intervals))
+
+	return int(math.Log2(mean + 1))
+}
+
+func similarTiming(a int, b int) bool {
+	if a < 0 || b < 0 {
+		return true
+	}
+
+	return math.Abs(float64(a-b)) <= 1
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Kinds of Canarytokens planted in the shell's filesystem.
+const (
+	CanarytokenAWSKeys = "aws_keys"
+	CanarytokenWeb     = "web"
+)
+
+// canarytokenFiles are where each kind of token is planted, and how.
+var canarytokenFiles = map[string]struct {
+	path   string
+	perm   fs.FileMode
+	render func(token Canarytoken) string
+}{
+	CanarytokenAWSKeys: {"/root/.aws/credentials", 0o600, func(token Canarytoken) string {
+		return fmt.Sprintf("[default]\naws_access_key_id = %s\naws_secret_access_key = %s\nregion = us-east-1\n",
+			token.AccessKeyID, token.SecretAccessKey)
+	}},
+	CanarytokenWeb: {"/root/backup.sh", 0o700, func(token Canarytoken) string {
+		return fmt.Sprintf("#!/bin/sh\n# Nightly database backup, pushed to the offsite store\nset -e\n"+
+			"mysqldump --all-databases | gzip > /var/backups/db.sql.gz\ncurl -fsS -X POST -H 'Content-Type: application/gzip' "+
+			"--data-binary @/var/backups/db.sql.gz '%s'\n", token.URL)
+	}},
+}
+
+// Canarytoken is a token of a Canarytokens server (canarytokens.org or a
+// self-hosted one), either generated through its API or written to the
+// tokens file by hand.
+type Canarytoken struct {
+	Kind  string `json:"kind"`
+	Token string `json:"token"`
+	// Auth is the token's manage secret, needed to poll its incidents
+	Auth            string `json:"auth,omitempty"`
+	URL             string `json:"url,omitempty"`
+	AccessKeyID     string `json:"aws_access_key_id,omitempty"`
+	SecretAccessKey string `json:"aws_secret_access_key,omitempty"`
+	// LastHit is when the last incident seen was, earlier ones being skipped
+	LastHit time.Time `json:"last_hit,omitempty"`
+}
+
+// canarytokenHit is an incident of a token, the token being triggered.
+type canarytokenHit struct {
+	Time      time.Time
+	SrcIP     string
+	Channel   string
+	UserAgent string
+}
+
+// Canarytokens plants Canarytokens in the filesystem of the shell, AWS keys
+// and a URL, and polls the Canarytokens server for their incidents: an
+// attacker using one proves the credentials or data taken from the honeypot
+// were exfiltrated and used elsewhere. Every incident is captured as a
+// "canarytoken" event from the IP that triggered it.
+type Canarytokens struct {
+	server string
+	path   string
+	client *http.Client
+	tracer trace.Tracer
+
+	mu     sync.Mutex
+	tokens []Canarytoken
+}
+
+// NewCanarytokens loads the tokens of path, generating the missing kinds of
+// generate through the API of server, registered with email or webhook to
+// be notified of their incidents by the server too.
+func NewCanarytokens(server string, path string, generate []string, email string, webhook string, tracer trace.Tracer) (*Canarytokens, error) {
+	c := &Canarytokens{
+		server: strings.TrimSuffix(server, "/"),
+		path:   path,
+		client: &http.Client{Timeout: 30 * time.Second},
+		tracer: tracer,
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &c.tokens); err != nil {
+			return nil, fmt.Errorf("invalid Canarytokens file '%s': %v", path, err)
+		}
+	}
+	for _, token := range c.tokens {
+		if _, ok := canarytokenFiles[token.Kind]; !ok {
+			return nil, fmt.Errorf("unknown Canarytoken kind '%s', must be '%s' or '%s'", token.Kind, CanarytokenAWSKeys, CanarytokenWeb)
+		}
+	}
+
+	generated := false
+	for _, kind := range generate {
+		if _, ok := canarytokenFiles[kind]; !ok {
+			return nil, fmt.Errorf("unknown Canarytoken kind '%s', must be '%s' or '%s'", kind, CanarytokenAWSKeys, CanarytokenWeb)
+		}
+		if slices.ContainsFunc(c.tokens, func(token Canarytoken) bool { return token.Kind == kind }) {
+			continue
+		}
+		if email == "" && webhook == "" {
+			return nil, errors.New("CANARYTOKENS_EMAIL or CANARYTOKENS_WEBHOOK is required to generate Canarytokens")
+		}
+
+		token, err := c.generate(kind, email, webhook)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate a '%s' Canarytoken: %w", kind, err)
+		}
+		slog.Info("Generated Canarytoken", "kind", kind, "token", token.Token)
+		c.tokens = append(c.tokens, token)
+		generated = true
+	}
+	if generated {
+		if err := c.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// canarytokensFromEnv returns nil unless CANARYTOKENS_PATH is set.
+func canarytokensFromEnv(tracer trace.Tracer) (*Canarytokens, error) {
+	path := os.Getenv("CANARYTOKENS_PATH")
+	if path == "" {
+		return nil, nil
+	}
+
+	return NewCanarytokens(getEnv("CANARYTOKENS_URL", "https://canarytokens.org"), path, splitList(os.Getenv("CANARYTOKENS_GENERATE")),
+		os.Getenv("CANARYTOKENS_EMAIL"), os.Getenv("CANARYTOKENS_WEBHOOK"), tracer)
+}
+
+// generate asks the server for a new token of kind.
+func (c *Canarytokens) generate(kind string, email string, webhook string) (Canarytoken, error) {
+	form := url.Values{
+		"type":        {kind},
+		"email":       {email},
+		"webhook_url": {webhook},
+		"memo":        {fmt.Sprintf("ssh-honeypot %s: %s", node.ID, canarytokenFiles[kind].path)},
+	}
+	resp, err := c.client.PostForm(c.server+"/generate", form)
+	if err != nil {
+		return Canarytoken{}, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Canarytoken{}, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// Older servers answer with Token, Auth and Url, newer ones with
+	// token, auth_token and token_url
+	var generated struct {
+		Token           string `json:"token"`
+		Auth            string `json:"auth"`
+		AuthToken       string `json:"auth_token"`
+		URL             string `json:"url"`
+		TokenURL        string `json:"token_url"`
+		AccessKeyID     string `json:"aws_access_key_id"`
+		SecretAccessKey string `json:"aws_secret_access_key"`
+		Error           string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &generated); err != nil {
+		return Canarytoken{}, err
+	}
+	if generated.Token == "" {
+		return Canarytoken{}, fmt.Errorf("no token generated: %s", generated.Error)
+	}
+
+	token := Canarytoken{
+		Kind:            kind,
+		Token:           generated.Token,
+		Auth:            generated.Auth,
+		URL:             generated.URL,
+		AccessKeyID:     generated.AccessKeyID,
+		SecretAccessKey: generated.SecretAccessKey,
+	}
+	if token.Auth == "" {
+		token.Auth = generated.AuthToken
+	}
+	if token.URL == "" {
+		token.URL = generated.TokenURL
+	}
+	if kind == CanarytokenAWSKeys && (token.AccessKeyID == "" || token.SecretAccessKey == "") {
+		return Canarytoken{}, errors.New("no AWS keys generated")
+	}
+
+	return token, nil
+}
+
+// Plant adds the files carrying the tokens to fileSystem.
+func (c *Canarytokens) Plant(fileSystem *FileSystem) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, token := range c.tokens {
+		file := canarytokenFiles[token.Kind]
+		if err := fileSystem.AddFile(file.path, file.render(token), file.perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run polls the incidents every interval until ctx is done.
+func (c *Canarytokens) Run(ctx context.Context, capture func(SSHInfo) bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Poll(ctx, capture)
+		}
+	}
+}
+
+// Poll captures the incidents of every token since the last one seen.
+func (c *Canarytokens) Poll(ctx context.Context, capture func(SSHInfo) bool) {
+	c.mu.Lock()
+	tokens := slices.Clone(c.tokens)
+	c.mu.Unlock()
+
+	changed := false
+	for i, token := range tokens {
+		if token.Auth == "" {
+			continue
+		}
+
+		hits, err := c.incidents(ctx, token)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to poll Canarytoken incidents", "kind", token.Kind, "token", token.Token, "error", err)
+			continue
+		}
+		for _, hit := range hits {
+			if !hit.Time.After(token.LastHit) {
+				continue
+			}
+			tokens[i].LastHit = hit.Time
+			changed = true
+
+			slog.Warn("Canarytoken triggered", "kind", token.Kind, "remote_host", hit.SrcIP, "channel", hit.Channel)
+			capture(SSHInfo{
+				RemoteHost:  hit.SrcIP,
+				UserAgent:   hit.UserAgent,
+				Path:        canarytokenFiles[token.Kind].path,
+				Function:    "canarytoken",
+				Protocol:    strings.ToLower(hit.Channel),
+				Canarytoken: token.Kind,
+				Node:        node,
+				Timestamp:   hit.Time,
+			})
+		}
+	}
+	if !changed {
+		return
+	}
+
+	c.mu.Lock()
+	c.tokens = tokens
+	c.mu.Unlock()
+	if err := c.save(); err != nil {
+		slog.ErrorContext(ctx, "Failed to save Canarytokens", "path", c.path, "error", err)
+	}
+}
+
+// incidents returns the incidents of token, oldest first.
+func (c *Canarytokens) incidents(ctx context.Context, token Canarytoken) ([]canarytokenHit, error) {
+	ctx, span := c.tracer.Start(ctx, "pollCanarytoken", trace.WithAttributes(attribute.String("canarytoken.kind", token.Kind)))
+	defer span.End()
+
+	query := url.Values{"fmt": {"incidentlist_json"}, "token": {token.Token}, "auth": {token.Auth}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+"/download?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	hits, err := parseCanarytokenIncidents(body)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("canarytoken.incidents", len(hits)))
+	span.SetStatus(codes.Ok, fmt.Sprintf("Got %d incidents", len(hits)))
+
+	return hits, nil
+}
+
+// parseCanarytokenIncidents reads the incident list of a token, either a
+// "hits" list as newer servers send, or incidents keyed by their Unix time as
+// older ones do.
+func parseCanarytokenIncidents(body []byte) ([]canarytokenHit, error) {
+	type incident struct {
+		TimeOfHit    json.Number `json:"time_of_hit"`
+		SrcIP        string      `json:"src_ip"`
+		InputChannel string      `json:"input_channel"`
+		UserAgent    string      `json:"useragent"`
+	}
+
+	var newer struct {
+		Hits []incident `json:"hits"`
+	}
+	var older map[string]json.RawMessage
+	incidents := map[string]incident{}
+	if err := json.Unmarshal(body, &newer); err == nil && newer.Hits != nil {
+		for i, hit := range newer.Hits {
+			incidents[strconv.Itoa(i)] = hit
+		}
+	} else if err := json.Unmarshal(body, &older); err == nil {
+		for key, raw := range older {
+			var hit incident
+			if err := json.Unmarshal(raw, &hit); err != nil {
+				continue
+			}
+			if hit.TimeOfHit == "" {
+				hit.TimeOfHit = json.Number(key)
+			}
+			incidents[key] = hit
+		}
+	} else {
+		return nil, fmt.Errorf("unexpected incident list: %v", err)
+	}
+
+	hits := make([]canarytokenHit, 0, len(incidents))
+	for _, incident := range incidents {
+		seconds, err := incident.TimeOfHit.Float64()
+		if err != nil || incident.SrcIP == "" {
+			continue
+		}
+		hits = append(hits, canarytokenHit{
+			Time:      time.Unix(0, int64(seconds*float64(time.Second))),
+			SrcIP:     incident.SrcIP,
+			Channel:   incident.InputChannel,
+			UserAgent: incident.UserAgent,
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].Time.Before(hits[j].Time)
+	})
+
+	return hits, nil
+}
+
+// save writes the tokens to their file, atomically replacing it.
+func (c *Canarytokens) save() error {
+	c.mu.Lock()
+	content, err := json.MarshalIndent(c.tokens, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"time"
+)
+
+// humanLikelihood scores how likely the timing signals are to come from a
+// human at a keyboard, from 0 (clearly automated) to 1 (clearly human). It
+// reports false when there is nothing to judge from yet.
+//
+// Each available signal yields its own score, combined as a weighted
+// average: keystroke timing is the strongest signal, window changes (a
+// resized terminal) and X11 forwarding requests come next and
+// authentication cadence is the weakest.
+func humanLikelihood(signals TimingSignals) (float64, bool) {
+	var score, weight float64
+
+	if len(signals.AuthIntervals) > 0 {
+		score += authCadenceScore(signals.AuthIntervals)
+		weight++
+	}
+
+	if len(signals.KeystrokeIntervals) >= 5 {
+		score += 3 * keystrokeScore(signals.KeystrokeIntervals)
+		weight += 3
+	}
+
+	if signals.WindowChanges > 0 {
+		score += 2 * 0.9
+		weight += 2
+	}
+
+	if signals.X11Requested {
+		score += 2 * 0.95
+		weight += 2
+	}
+
+	if weight == 0 {
+		return 0, false
+	}
+
+	return math.Round(score/weight*100) / 100, true
+}
+
+// authCadenceScore: tools retry credentials back to back at a steady pace,
+// people take seconds between attempts and are irregular about it.
+func authCadenceScore(intervals []time.Duration) float64 {
+	median, variation := intervalStats(intervals)
+
+	switch {
+	case median < 500*time.Millisecond:
+		return 0.05
+	case median < 2*time.Second:
+		return 0.2
+	case variation > 0.5:
+		return 0.7
+	default:
+		return 0.5
+	}
+}
+
+// keystrokeScore: human typing has gaps between roughly 30ms and 1.5s that
+// vary a lot, while pasted or scripted input arrives in bursts.
+func keystrokeScore(intervals []time.Duration) float64 {
+	var human, burst int
+	for _, interval := range intervals {
+		switch {
+		case interval < 10*time.Millisecond:
+			burst++
+		case interval >= 30*time.Millisecond && interval <= 1500*time.Millisecond:
+			human++
+		}
+	}
+
+	total := float64(len(intervals))
+	score := 0.7*float64(human)/total - 0.5*float64(burst)/total
+	if _, variation := intervalStats(intervals); variation > 0.3 {
+		score += 0.3
+	}
+
+	return math.Max(0, math.Min(1, score))
+}
+
+// intervalStats returns the median and the coefficient of variation of
+// intervals.
+func intervalStats(intervals []time.Duration) (time.Duration, float64) {
+	sorted := slices.Clone(intervals)
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+
+	var sum float64
+	for _, interval := range intervals {
+		sum += float64(interval)
+	}
+	mean := sum / float64(len(intervals))
+	if mean == 0 {
+		return median, 0
+	}
+
+	var squares float64
+	for _, interval := range intervals {
+		squares += math.Pow(float64(interval)-mean, 2)
+	}
+
+	return median, math.Sqrt(squares/float64(len(intervals))) / mean
+}
+
+// annotateHumanLikelihood attaches the human likelihood score to events that
+// carry enough timing signals.
+func annotateHumanLikelihood(ctx context.Context, event *Event) {
+	if score, ok := humanLikelihood(event.SSHInfo.Signals); ok {
+		event.Analysis.HumanLikelihood = &score
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// cliFlag maps a command-line flag onto the environment variable holding the
+// same setting, so flags take precedence over the environment, which takes
+// precedence over the configuration file.
+type cliFlag struct {
+	name     string
+	env      string
+	fallback string
+	usage    string
+	isBool   bool
+}
+
+var cliFlags = []cliFlag{
+	{name: "port", env: "SSH_PORT", fallback: "2222", usage: "comma separated SSH ports to listen on"},
+	{name: "listen-network", env: "LISTEN_NETWORK", fallback: "dual", usage: "network to listen on, 'dual', 'tcp4' or 'tcp6'"},
+	{name: "listen-address", env: "LISTEN_ADDRESS", usage: "comma separated IP addresses and interface names to listen on, every address of the network when unset"},
+	{name: "telnet-port", env: "TELNET_PORT", usage: "telnet port to listen on, telnet is disabled when unset"},
+	{name: "tarpit-port", env: "TARPIT_PORT", usage: "SSH tarpit port to listen on, the tarpit is disabled when unset"},
+	{name: "host-key", env: "HOST_KEY_PATH", fallback: "./host_key", usage: "path to the SSH host key, generated when missing"},
+	{name: "host-key-types", env: "HOST_KEY_TYPES", fallback: "rsa", usage: "comma separated types of the host keys, 'rsa', 'ecdsa' or 'ed25519'"},
+	{name: "api-addr", env: "API_LISTEN_ADDR", usage: "address of the HTTP API, disabled when unset"},
+	{name: "dashboard-addr", env: "DASHBOARD_LISTEN_ADDR", usage: "address of the web dashboard, disabled when unset"},
+	{name: "influxdb-url", env: "INFLUXDB_URL", usage: "InfluxDB URL"},
+	{name: "influxdb-token", env: "INFLUXDB_TOKEN", usage: "InfluxDB token"},
+	{name: "influxdb-org", env: "INFLUXDB_ORG", usage: "InfluxDB organization"},
+	{name: "influxdb-bucket", env: "INFLUXDB_BUCKET", usage: "InfluxDB bucket"},
+	{name: "influxdb-non-blocking", env: "INFLUXDB_NON_BLOCKING_WRITES", usage: "write to InfluxDB asynchronously", isBool: true},
+	{name: "stdout", env: "STDOUT_EVENTS", usage: "write events to stdout as JSON lines", isBool: true},
+	{name: "write-private-ips", env: "INFLUXDB_WRITE_PRIVATE_IPS", usage: "store events from private and loopback IPs", isBool: true},
+	{name: "ipinfo-token", env: "IPINFOIO_TOKEN", usage: "ipinfo.io tokens, comma separated, ip-api.com is used when unset"},
+	{name: "geoip-city-db", env: "GEOIP_CITY_DB", usage: "path to a GeoLite2 City database"},
+	{name: "geoip-asn-db", env: "GEOIP_ASN_DB", usage: "path to a GeoLite2 ASN database"},
+	{name: "geoip-offline", env: "GEOIP_OFFLINE", usage: "never fall back to online geolocation providers", isBool: true},
+	{name: "max-timeout", env: "CONNECTION_MAX_TIMEOUT", fallback: DeadlineTimeout.String(), usage: "maximum connection duration"},
+	{name: "idle-timeout", env: "CONNECTION_IDLE_TIMEOUT", fallback: IdleTimeout.String(), usage: "connection idle timeout"},
+	{name: "otel-endpoint", env: "OTEL_EXPORTER_OTLP_ENDPOINT", usage: "OTLP collector endpoint, default localhost:4317 over gRPC and localhost:4318 over HTTP"},
+	{name: "otel-protocol", env: "OTEL_EXPORTER_OTLP_PROTOCOL", fallback: "grpc", usage: "OTLP protocol, 'grpc' or 'http/protobuf'"},
+	{name: "log-format", env: "LOG_FORMAT", fallback: "text", usage: "log format, 'text' or 'json'"},
+	{name: "tui", env: "TUI_ENABLED", usage: "show a live view of the honeypot in the terminal, logs included", isBool: true},
+	{name: "log-level", env: "LOG_LEVEL", fallback: "info", usage: "log level, 'debug', 'info', 'warn' or 'error'"},
+}
+
+// subcommands run instead of the honeypot when named as the first argument,
+// with the arguments following it.
+var subcommands = map[string]func(args []string) error{
+	"export-credentials": exportCredentials,
+	"top-attackers":      topAttackers,
+	"simulate":           simulate,
+}
+
+// boolFlag is a string flag accepting no value, like flag.Bool, so that
+// "--geoip-offline" works while an unset flag stays distinguishable.
+type boolFlag struct {
+	value *string
+}
+
+func (f boolFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f boolFlag) Set(value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*f.value = strconv.FormatBool(parsed)
+	return nil
+}
+
+func (f boolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// parseFlags parses the command line, exporting every flag given to its
+// environment variable, and returns the configuration file path.
+func parseFlags(args []string) (string, error) {
+	flags := flag.NewFlagSet("ssh-honeypot", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML configuration file (env CONFIG_FILE)")
+
+	values := make([]string, len(cliFlags))
+	for i, f := range cliFlags {
+		usage := fmt.Sprintf("%s (env %s", f.usage, f.env)
+		if f.fallback != "" {
+			usage += ", default " + f.fallback
+		}
+		usage += ")"
+
+		if f.isBool {
+			flags.Var(boolFlag{&values[i]}, f.name, usage)
+		} else {
+			flags.StringVar(&values[i], f.name, "", usage)
+		}
+	}
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: ssh-honeypot [flags]\n       ssh-honeypot export-credentials [flags]\n       ssh-honeypot top-attackers [flags]\n       ssh-honeypot simulate [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Settings are taken from flags, then environment variables, then the\nconfiguration file, then defaults.\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	if flags.NArg() > 0 {
+		err := fmt.Errorf("unexpected argument '%s'", flags.Arg(0))
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		return "", err
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for i, f := range cliFlags {
+		if !set[f.name] {
+			continue
+		}
+		if err := os.Setenv(f.env, values[i]); err != nil {
+			return "", err
+		}
+	}
+
+	return *configPath, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// clickhouseSchema is the events table, %s being its name. Low cardinality
+// strings are dictionary encoded, and rows written twice by retried batches
+// are collapsed by the ReplacingMergeTree on merges.
+const clickhouseSchema = `CREATE TABLE IF NOT EXISTS %s (
+	id                       String,
+	timestamp                DateTime64(9, 'UTC'),
+	function                 LowCardinality(String),
+	protocol                 LowCardinality(String),
+	user                     String,
+	password                 String,
+	key                      String,
+	key_type                 LowCardinality(String),
+	key_fingerprint          String,
+	key_md5                  String,
+	key_bits                 UInt16,
+	command                  String,
+	subsystem                LowCardinality(String),
+	remote_host              String,
+	remote_port              String,
+	local_host               LowCardinality(String),
+	local_port               LowCardinality(String),
+	client_version           LowCardinality(String),
+	hassh                    LowCardinality(String),
+	session_id               String,
+	anomaly                  LowCardinality(String),
+	anomaly_detail           String,
+	attempt                  UInt32,
+	node_id                  LowCardinality(String),
+	node_region              LowCardinality(String),
+	node_deployment          LowCardinality(String),
+	city                     LowCardinality(String),
+	region                   LowCardinality(String),
+	country                  LowCardinality(String),
+	org                      LowCardinality(String),
+	latitude                 Float64,
+	longitude                Float64,
+	tool                     LowCardinality(String),
+	tool_category            LowCardinality(String),
+	campaign                 String,
+	password_pattern         LowCardinality(String),
+	techniques               Array(LowCardinality(String)),
+	attack_pattern           LowCardinality(String),
+	source_class             LowCardinality(String),
+	wordlist                 LowCardinality(String),
+	greynoise_classification LowCardinality(String)
+) ENGINE = ReplacingMergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (function, remote_host, timestamp, id)`
+
+// clickhouseRow flattens an EventDocument into the columns of the events
+// table, fields without a column being skipped by the server.
+type clickhouseRow struct {
+	EventDocument
+	ID        string  `json:"id"`
+	Time      string  `json:"timestamp"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+}
+
+// ClickHouseSink inserts events into a ClickHouse table through the HTTP
+// interface, one INSERT per batch. With async inserts the server buffers
+// the rows of concurrent inserts into larger parts itself.
+type ClickHouseSink struct {
+	url         string
+	database    string
+	table       string
+	username    string
+	password    string
+	asyncInsert bool
+	client      *http.Client
+	tracer      trace.Tracer
+}
+
+func NewClickHouseSink(url string, database string, table string, username string, password string, asyncInsert bool, tracer trace.Tracer) *ClickHouseSink {
+	return &ClickHouseSink{
+		url:         strings.TrimSuffix(url, "/"),
+		database:    database,
+		table:       table,
+		username:    username,
+		password:    password,
+		asyncInsert: asyncInsert,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		tracer:      tracer,
+	}
+}
+
+func clickhouseSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	url := os.Getenv("CLICKHOUSE_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	sink := NewClickHouseSink(url, os.Getenv("CLICKHOUSE_DATABASE"), getEnv("CLICKHOUSE_TABLE", "ssh_honeypot_events"),
+		os.Getenv("CLICKHOUSE_USERNAME"), os.Getenv("CLICKHOUSE_PASSWORD"), getEnv("CLICKHOUSE_ASYNC_INSERT", "true") == "true", tracer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := sink.EnsureTable(ctx); err != nil {
+		slog.Warn("Failed to create the ClickHouse table", "error", err)
+	}
+
+	return sink, nil
+}
+
+func (s *ClickHouseSink) Name() string {
+	return "clickhouse"
+}
+
+// EnsureTable creates the events table when missing.
+func (s *ClickHouseSink) EnsureTable(ctx context.Context) error {
+	return s.exec(ctx, fmt.Sprintf(clickhouseSchema, s.table), nil, nil)
+}
+
+func (s *ClickHouseSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToClickHouse",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range batch.Events {
+		document := newEventDocument(event)
+		row := clickhouseRow{
+			EventDocument: document,
+			ID:            document.ID,
+			Time:          document.Timestamp.Format(time.RFC3339Nano),
+		}
+		if document.Location != nil {
+			row.Latitude = document.Location.Lat
+			row.Longitude = document.Location.Lon
+		}
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	settings := url.Values{
+		"date_time_input_format":           {"best_effort"},
+		"input_format_skip_unknown_fields": {"1"},
+	}
+	if s.asyncInsert {
+		settings.Set("async_insert", "1")
+		settings.Set("wait_for_async_insert", "1")
+	}
+
+	if err := s.exec(ctx, fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", s.table), settings, body.Bytes()); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Inserted %d events", len(batch.Events)))
+	return nil
+}
+
+// Enforce deletes the events older than before, making the sink a
+// RetentionTarget. The deletion is a mutation ClickHouse applies in the
+// background.
+func (s *ClickHouseSink) Enforce(ctx context.Context, before time.Time) error {
+	query := fmt.Sprintf("ALTER TABLE %s DELETE WHERE timestamp < toDateTime64('%s', 9, 'UTC')",
+		s.table, before.UTC().Format("2006-01-02 15:04:05.000000000"))
+	return s.exec(ctx, query, nil, nil)
+}
+
+// exec runs query, with body appended to it as its data when set.
+func (s *ClickHouseSink) exec(ctx context.Context, query string, settings url.Values, body []byte) error {
+	params := url.Values{"query": {query}}
+	if s.database != "" {
+		params.Set("database", s.database)
+	}
+	for key, values := range settings {
+		params[key] = values
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if s.username != "" {
+		req.Header.Set("X-ClickHouse-User", s.username)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		response, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("ClickHouse responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(response))
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxClientVersions bounds the client version and HASSH combinations
+	// ClientVersionStats follows
+	maxClientVersions = 10000
+	// maxClientSourceIPs bounds the source IPs remembered per combination
+	maxClientSourceIPs = 100
+)
+
+// Client anomalies, from the most to the least unusual.
+const (
+	AnomalyNewClient            = "new_client"
+	AnomalyNewClientVersion     = "new_client_version"
+	AnomalyNewHASSH             = "new_hassh"
+	AnomalyNewClientCombination = "new_client_combination"
+)
+
+// ClientVersion is what was seen of a client version string with a HASSH.
+type ClientVersion struct {
+	ClientVersion string    `json:"client_version"`
+	HASSH         string    `json:"hassh"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	Events        int       `json:"events"`
+	SourceIPs     []string  `json:"source_ips"`
+}
+
+type clientVersionKey struct {
+	version string
+	hassh   string
+}
+
+// clientVersionState is the layout of the state file.
+type clientVersionState struct {
+	Since   time.Time       `json:"since"`
+	Clients []ClientVersion `json:"clients"`
+}
+
+// ClientVersionStats keeps statistics on the SSH client version strings and
+// HASSH fingerprints seen, flagging the combinations never seen before, a
+// hint of new attack tooling. Only the clients that got through the key
+// exchange are followed, banner grabbers having no HASSH. Nothing is flagged
+// during the learning period following the first client ever seen, while the
+// usual tooling is learned. The statistics are kept in a local JSON file, so
+// they survive restarts.
+type ClientVersionStats struct {
+	path     string
+	learning time.Duration
+
+	mu       sync.Mutex
+	since    time.Time
+	clients  map[clientVersionKey]*ClientVersion
+	versions map[string]int
+	hasshes  map[string]int
+	dirty    bool
+}
+
+func NewClientVersionStats(path string, learning time.Duration) (*ClientVersionStats, error) {
+	s := &ClientVersionStats{
+		path:     path,
+		learning: learning,
+		clients:  map[clientVersionKey]*ClientVersion{},
+		versions: map[string]int{},
+		hasshes:  map[string]int{},
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state clientVersionState
+	if err := json.Unmarshal(content, &state); err != nil {
+		slog.Warn("Discarding client version statistics", "path", path, "error", err)
+		return s, nil
+	}
+	s.since = state.Since
+	for i := range state.Clients {
+		s.add(&state.Clients[i])
+	}
+
+	return s, nil
+}
+
+// clientVersionStatsFromEnv keeps the statistics in memory only when
+// CLIENT_VERSIONS_PATH is set to an empty value.
+func clientVersionStatsFromEnv() (*ClientVersionStats, error) {
+	path, found := os.LookupEnv("CLIENT_VERSIONS_PATH")
+	if !found {
+		path = "./client_versions.json"
+	}
+
+	stats, err := NewClientVersionStats(path, getEnvDuration("CLIENT_ANOMALY_LEARNING_PERIOD", 24*time.Hour))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", path, err)
+	}
+
+	return stats, nil
+}
+
+func (s *ClientVersionStats) add(client *ClientVersion) {
+	s.clients[clientVersionKey{client.ClientVersion, client.HASSH}] = client
+	s.versions[client.ClientVersion]++
+	s.hasshes[client.HASSH]++
+}
+
+// Observe counts the event of sshInfo towards its client, returning a
+// "client_anomaly" event, a copy of it carrying the anomaly, the first time
+// the client is seen after the learning period.
+func (s *ClientVersionStats) Observe(sshInfo SSHInfo) (SSHInfo, bool) {
+	if sshInfo.ClientVersion == "" || sshInfo.HASSH == "" {
+		return SSHInfo{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := sshInfo.Timestamp
+	if s.since.IsZero() {
+		s.since = now
+	}
+	s.dirty = true
+
+	key := clientVersionKey{sshInfo.ClientVersion, sshInfo.HASSH}
+	if client, found := s.clients[key]; found {
+		client.Events++
+		client.LastSeen = now
+		if len(client.SourceIPs) < maxClientSourceIPs && !slices.Contains(client.SourceIPs, sshInfo.RemoteHost) {
+			client.SourceIPs = append(client.SourceIPs, sshInfo.RemoteHost)
+		}
+		return SSHInfo{}, false
+	}
+	if len(s.clients) >= maxClientVersions {
+		return SSHInfo{}, false
+	}
+
+	anomaly := AnomalyNewClientCombination
+	newVersion, newHASSH := s.versions[sshInfo.ClientVersion] == 0, s.hasshes[sshInfo.HASSH] == 0
+	switch {
+	case newVersion && newHASSH:
+		anomaly = AnomalyNewClient
+	case newVersion:
+		anomaly = AnomalyNewClientVersion
+	case newHASSH:
+		anomaly = AnomalyNewHASSH
+	}
+	s.add(&ClientVersion{
+		ClientVersion: sshInfo.ClientVersion,
+		HASSH:         sshInfo.HASSH,
+		FirstSeen:     now,
+		LastSeen:      now,
+		Events:        1,
+		SourceIPs:     []string{sshInfo.RemoteHost},
+	})
+	if now.Sub(s.since) < s.learning {
+		return SSHInfo{}, false
+	}
+
+	sshInfo.Function = "client_anomaly"
+	sshInfo.Anomaly = anomaly
+	sshInfo.AnomalyDetail = fmt.Sprintf("%s with HASSH %s", sshInfo.ClientVersion, sshInfo.HASSH)
+	return sshInfo, true
+}
+
+// Capture wraps capture to follow the first event of a client never seen
+// before with a "client_anomaly" event of its own.
+func (s *ClientVersionStats) Capture(capture func(SSHInfo) bool) func(SSHInfo) bool {
+	return func(sshInfo SSHInfo) bool {
+		captured := capture(sshInfo)
+		if anomalyInfo, found := s.Observe(sshInfo); found {
+			slog.Warn("New SSH client", "remote_host", sshInfo.RemoteHost, "anomaly", anomalyInfo.Anomaly,
+				"client_version", sshInfo.ClientVersion, "hassh", sshInfo.HASSH)
+			capture(anomalyInfo)
+		}
+
+		return captured
+	}
+}
+
+// Clients returns the combinations seen, those of the most events first.
+func (s *ClientVersionStats) Clients() []ClientVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients := make([]ClientVersion, 0, len(s.clients))
+	for _, client := range s.clients {
+		copied := *client
+		copied.SourceIPs = slices.Clone(client.SourceIPs)
+		clients = append(clients, copied)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Events != clients[j].Events {
+			return clients[i].Events > clients[j].Events
+		}
+		return clients[i].FirstSeen.Before(clients[j].FirstSeen)
+	})
+
+	return clients
+}
+
+// Save writes the statistics to the state file, atomically replacing it.
+func (s *ClientVersionStats) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	s.dirty = false
+	since := s.since
+	s.mu.Unlock()
+
+	content, err := json.Marshal(clientVersionState{Since: since, Clients: s.Clients()})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Run saves the statistics every interval.
+func (s *ClientVersionStats) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.Save(); err != nil {
+			slog.Error("Failed to save client version statistics", "error", err)
+		}
+	}
+}
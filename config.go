@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// SSHListenerConfig is an additional SSH listener, its settings defaulting to
+// those of the listener section.
+type SSHListenerConfig struct {
+	Port         int      `yaml:"port" toml:"port"`
+	SSHVersion   string   `yaml:"ssh_version" toml:"ssh_version"`
+	SSHBanner    string   `yaml:"ssh_banner" toml:"ssh_banner"`
+	HostKeyPath  string   `yaml:"host_key_path" toml:"host_key_path"`
+	HostKeyTypes []string `yaml:"host_key_types" toml:"host_key_types"`
+}
+
+// Config is the configuration file layout. Every setting maps to the
+// environment variable named by its env tag: the file only provides defaults
+// for those variables, so a variable set in the environment always wins.
+type Config struct {
+	Listener struct {
+		SSHPort        int      `yaml:"ssh_port" toml:"ssh_port" env:"SSH_PORT"`
+		Network        string   `yaml:"network" toml:"network" env:"LISTEN_NETWORK"`
+		Addresses      []string `yaml:"addresses" toml:"addresses" env:"LISTEN_ADDRESS"`
+		TelnetPort     int      `yaml:"telnet_port" toml:"telnet_port" env:"TELNET_PORT"`
+		HostKeyPath    string   `yaml:"host_key_path" toml:"host_key_path" env:"HOST_KEY_PATH"`
+		HostKeyTypes   []string `yaml:"host_key_types" toml:"host_key_types" env:"HOST_KEY_TYPES"`
+		HostKeyRotate  string   `yaml:"host_key_rotate_interval" toml:"host_key_rotate_interval" env:"HOST_KEY_ROTATE_INTERVAL"`
+		HostKeyOverlap string   `yaml:"host_key_rotate_overlap" toml:"host_key_rotate_overlap" env:"HOST_KEY_ROTATE_OVERLAP"`
+		APIListenAddr  string   `yaml:"api_listen_addr" toml:"api_listen_addr" env:"API_LISTEN_ADDR"`
+		APIToken       string   `yaml:"api_token" toml:"api_token" env:"API_TOKEN"`
+		DashboardAddr  string   `yaml:"dashboard_listen_addr" toml:"dashboard_listen_addr" env:"DASHBOARD_LISTEN_ADDR"`
+		SSHVersion     string   `yaml:"ssh_version" toml:"ssh_version" env:"SSH_VERSION"`
+		SSHVersionMode string   `yaml:"ssh_version_mode" toml:"ssh_version_mode" env:"SSH_VERSION_MODE"`
+		SSHVersions    []string `yaml:"ssh_versions" toml:"ssh_versions" env:"SSH_VERSIONS"`
+		SSHBanner      string   `yaml:"ssh_banner" toml:"ssh_banner" env:"SSH_BANNER"`
+		MaxConnections string   `yaml:"max_connections" toml:"max_connections" env:"MAX_CONNECTIONS"`
+		ConnOverflow   string   `yaml:"connection_overflow" toml:"connection_overflow" env:"CONNECTION_OVERFLOW"`
+
+		// Additional SSH listeners, whose variables are suffixed with their
+		// port, see applyListeners
+		SSHListeners []SSHListenerConfig `yaml:"ssh_listeners" toml:"ssh_listeners"`
+	} `yaml:"listener" toml:"listener"`
+
+	Allowlist        []string `yaml:"allowlist" toml:"allowlist" env:"ALLOWLIST"`
+	AllowlistLogPath string   `yaml:"allowlist_log_path" toml:"allowlist_log_path" env:"ALLOWLIST_LOG_PATH"`
+	Policies         []string `yaml:"policies" toml:"policies" env:"POLICIES"`
+
+	Tarpit struct {
+		Port       int    `yaml:"port" toml:"port" env:"TARPIT_PORT"`
+		Delay      string `yaml:"delay" toml:"delay" env:"TARPIT_DELAY"`
+		LineLength int    `yaml:"line_length" toml:"line_length" env:"TARPIT_LINE_LENGTH"`
+		MaxClients int    `yaml:"max_clients" toml:"max_clients" env:"TARPIT_MAX_CLIENTS"`
+	} `yaml:"tarpit" toml:"tarpit"`
+
+	HTTP struct {
+		Port      int    `yaml:"port" toml:"port" env:"HTTP_PORT"`
+		HTTPSPort int    `yaml:"https_port" toml:"https_port" env:"HTTPS_PORT"`
+		CertFile  string `yaml:"cert_file" toml:"cert_file" env:"HTTPS_CERT_FILE"`
+		KeyFile   string `yaml:"key_file" toml:"key_file" env:"HTTPS_KEY_FILE"`
+		Realm     string `yaml:"realm" toml:"realm" env:"HTTP_REALM"`
+		Title     string `yaml:"title" toml:"title" env:"HTTP_TITLE"`
+	} `yaml:"http" toml:"http"`
+
+	InfluxDB struct {
+		URL                string   `yaml:"url" toml:"url" env:"INFLUXDB_URL"`
+		Token              string   `yaml:"token" toml:"token" env:"INFLUXDB_TOKEN"`
+		Org                string   `yaml:"org" toml:"org" env:"INFLUXDB_ORG"`
+		Bucket             string   `yaml:"bucket" toml:"bucket" env:"INFLUXDB_BUCKET"`
+		Version            int      `yaml:"version" toml:"version" env:"INFLUXDB_VERSION"`
+		Username           string   `yaml:"username" toml:"username" env:"INFLUXDB_USERNAME"`
+		Password           string   `yaml:"password" toml:"password" env:"INFLUXDB_PASSWORD"`
+		Database           string   `yaml:"database" toml:"database" env:"INFLUXDB_DATABASE"`
+		RetentionPolicy    string   `yaml:"retention_policy" toml:"retention_policy" env:"INFLUXDB_RETENTION_POLICY"`
+		NonBlockingWrites  bool     `yaml:"non_blocking_writes" toml:"non_blocking_writes" env:"INFLUXDB_NON_BLOCKING_WRITES"`
+		WritePrivateIPs    bool     `yaml:"write_private_ips" toml:"write_private_ips" env:"INFLUXDB_WRITE_PRIVATE_IPS"`
+		BatchSize          int      `yaml:"batch_size" toml:"batch_size" env:"INFLUXDB_BATCH_SIZE"`
+		FlushInterval      string   `yaml:"flush_interval" toml:"flush_interval" env:"INFLUXDB_FLUSH_INTERVAL"`
+		MaxRetries         int      `yaml:"max_retries" toml:"max_retries" env:"INFLUXDB_MAX_RETRIES"`
+		RetryBufferLimit   int      `yaml:"retry_buffer_limit" toml:"retry_buffer_limit" env:"INFLUXDB_RETRY_BUFFER_LIMIT"`
+		Measurement        string   `yaml:"measurement" toml:"measurement" env:"INFLUXDB_MEASUREMENT"`
+		SessionMeasurement string   `yaml:"session_measurement" toml:"session_measurement" env:"INFLUXDB_SESSION_MEASUREMENT"`
+		Tags               []string `yaml:"tags" toml:"tags" env:"INFLUXDB_TAGS"`
+	} `yaml:"influxdb" toml:"influxdb"`
+
+	Stdout struct {
+		Events bool   `yaml:"events" toml:"events" env:"STDOUT_EVENTS"`
+		Format string `yaml:"format" toml:"format" env:"STDOUT_FORMAT"`
+	} `yaml:"stdout" toml:"stdout"`
+
+	EventFile struct {
+		Path           string `yaml:"path" toml:"path" env:"EVENT_FILE_PATH"`
+		MaxSize        int    `yaml:"max_size" toml:"max_size" env:"EVENT_FILE_MAX_SIZE"`
+		RotateInterval string `yaml:"rotate_interval" toml:"rotate_interval" env:"EVENT_FILE_ROTATE_INTERVAL"`
+		Compress       bool   `yaml:"compress" toml:"compress" env:"EVENT_FILE_COMPRESS"`
+		MaxBackups     int    `yaml:"max_backups" toml:"max_backups" env:"EVENT_FILE_MAX_BACKUPS"`
+		Format         string `yaml:"format" toml:"format" env:"EVENT_FILE_FORMAT"`
+	} `yaml:"event_file" toml:"event_file"`
+
+	Spool struct {
+		Dir            string `yaml:"dir" toml:"dir" env:"SPOOL_DIR"`
+		MaxSize        int    `yaml:"max_size" toml:"max_size" env:"SPOOL_MAX_SIZE"`
+		ReplayInterval string `yaml:"replay_interval" toml:"replay_interval" env:"SPOOL_REPLAY_INTERVAL"`
+	} `yaml:"spool" toml:"spool"`
+
+	Elasticsearch struct {
+		URL      string `yaml:"url" toml:"url" env:"ELASTICSEARCH_URL"`
+		Index    string `yaml:"index" toml:"index" env:"ELASTICSEARCH_INDEX"`
+		Template string `yaml:"template" toml:"template" env:"ELASTICSEARCH_TEMPLATE"`
+		Username string `yaml:"username" toml:"username" env:"ELASTICSEARCH_USERNAME"`
+		Password string `yaml:"password" toml:"password" env:"ELASTICSEARCH_PASSWORD"`
+		APIKey   string `yaml:"api_key" toml:"api_key" env:"ELASTICSEARCH_API_KEY"`
+	} `yaml:"elasticsearch" toml:"elasticsearch"`
+
+	Kafka struct {
+		Brokers  []string `yaml:"brokers" toml:"brokers" env:"KAFKA_BROKERS"`
+		Topic    string   `yaml:"topic" toml:"topic" env:"KAFKA_TOPIC"`
+		TLS      bool     `yaml:"tls" toml:"tls" env:"KAFKA_TLS"`
+		Username string   `yaml:"username" toml:"username" env:"KAFKA_USERNAME"`
+		Password string   `yaml:"password" toml:"password" env:"KAFKA_PASSWORD"`
+	} `yaml:"kafka" toml:"kafka"`
+
+	Postgres struct {
+		DSN         string `yaml:"dsn" toml:"dsn" env:"POSTGRES_DSN"`
+		TimescaleDB bool   `yaml:"timescaledb" toml:"timescaledb" env:"POSTGRES_TIMESCALEDB"`
+	} `yaml:"postgres" toml:"postgres"`
+
+	SQLite struct {
+		Path string `yaml:"path" toml:"path" env:"SQLITE_PATH"`
+	} `yaml:"sqlite" toml:"sqlite"`
+
+	ClickHouse struct {
+		URL         string `yaml:"url" toml:"url" env:"CLICKHOUSE_URL"`
+		Database    string `yaml:"database" toml:"database" env:"CLICKHOUSE_DATABASE"`
+		Table       string `yaml:"table" toml:"table" env:"CLICKHOUSE_TABLE"`
+		Username    string `yaml:"username" toml:"username" env:"CLICKHOUSE_USERNAME"`
+		Password    string `yaml:"password" toml:"password" env:"CLICKHOUSE_PASSWORD"`
+		AsyncInsert string `yaml:"async_insert" toml:"async_insert" env:"CLICKHOUSE_ASYNC_INSERT"`
+	} `yaml:"clickhouse" toml:"clickhouse"`
+
+	Webhook struct {
+		URLs       []string `yaml:"urls" toml:"urls" env:"WEBHOOK_URLS"`
+		Headers    []string `yaml:"headers" toml:"headers" env:"WEBHOOK_HEADERS"`
+		Secret     string   `yaml:"secret" toml:"secret" env:"WEBHOOK_SECRET"`
+		MaxElapsed string   `yaml:"max_elapsed" toml:"max_elapsed" env:"WEBHOOK_MAX_ELAPSED"`
+	} `yaml:"webhook" toml:"webhook"`
+
+	Syslog struct {
+		Addr     string `yaml:"addr" toml:"addr" env:"SYSLOG_ADDR"`
+		Protocol string `yaml:"protocol" toml:"protocol" env:"SYSLOG_PROTOCOL"`
+		Format   string `yaml:"format" toml:"format" env:"SYSLOG_FORMAT"`
+		Facility int    `yaml:"facility" toml:"facility" env:"SYSLOG_FACILITY"`
+	} `yaml:"syslog" toml:"syslog"`
+
+	GELF struct {
+		Addr      string `yaml:"addr" toml:"addr" env:"GELF_ADDR"`
+		Protocol  string `yaml:"protocol" toml:"protocol" env:"GELF_PROTOCOL"`
+		ChunkSize int    `yaml:"chunk_size" toml:"chunk_size" env:"GELF_CHUNK_SIZE"`
+	} `yaml:"gelf" toml:"gelf"`
+
+	Loki struct {
+		URL      string `yaml:"url" toml:"url" env:"LOKI_URL"`
+		TenantID string `yaml:"tenant_id" toml:"tenant_id" env:"LOKI_TENANT_ID"`
+		Username string `yaml:"username" toml:"username" env:"LOKI_USERNAME"`
+		Password string `yaml:"password" toml:"password" env:"LOKI_PASSWORD"`
+	} `yaml:"loki" toml:"loki"`
+
+	NATS struct {
+		URL     string `yaml:"url" toml:"url" env:"NATS_URL"`
+		Subject string `yaml:"subject" toml:"subject" env:"NATS_SUBJECT"`
+		Stream  string `yaml:"stream" toml:"stream" env:"NATS_STREAM"`
+		Creds   string `yaml:"creds" toml:"creds" env:"NATS_CREDS"`
+	} `yaml:"nats" toml:"nats"`
+
+	Redis struct {
+		URL          string `yaml:"url" toml:"url" env:"REDIS_URL"`
+		Stream       string `yaml:"stream" toml:"stream" env:"REDIS_STREAM"`
+		StreamMaxLen int    `yaml:"stream_maxlen" toml:"stream_maxlen" env:"REDIS_STREAM_MAXLEN"`
+	} `yaml:"redis" toml:"redis"`
+
+	S3 struct {
+		Endpoint      string `yaml:"endpoint" toml:"endpoint" env:"S3_ENDPOINT"`
+		Bucket        string `yaml:"bucket" toml:"bucket" env:"S3_BUCKET"`
+		Prefix        string `yaml:"prefix" toml:"prefix" env:"S3_PREFIX"`
+		Region        string `yaml:"region" toml:"region" env:"S3_REGION"`
+		AccessKey     string `yaml:"access_key" toml:"access_key" env:"S3_ACCESS_KEY"`
+		SecretKey     string `yaml:"secret_key" toml:"secret_key" env:"S3_SECRET_KEY"`
+		UseSSL        string `yaml:"use_ssl" toml:"use_ssl" env:"S3_USE_SSL"`
+		MaxObjectSize int    `yaml:"max_object_size" toml:"max_object_size" env:"S3_MAX_OBJECT_SIZE"`
+		FlushInterval string `yaml:"flush_interval" toml:"flush_interval" env:"S3_FLUSH_INTERVAL"`
+	} `yaml:"s3" toml:"s3"`
+
+	MQTT struct {
+		Broker      string `yaml:"broker" toml:"broker" env:"MQTT_BROKER"`
+		TopicPrefix string `yaml:"topic_prefix" toml:"topic_prefix" env:"MQTT_TOPIC_PREFIX"`
+		QoS         string `yaml:"qos" toml:"qos" env:"MQTT_QOS"`
+		ClientID    string `yaml:"client_id" toml:"client_id" env:"MQTT_CLIENT_ID"`
+		Username    string `yaml:"username" toml:"username" env:"MQTT_USERNAME"`
+		Password    string `yaml:"password" toml:"password" env:"MQTT_PASSWORD"`
+	} `yaml:"mqtt" toml:"mqtt"`
+
+	HPFeeds struct {
+		Host        string `yaml:"host" toml:"host" env:"HPFEEDS_HOST"`
+		Ident       string `yaml:"ident" toml:"ident" env:"HPFEEDS_IDENT"`
+		Secret      string `yaml:"secret" toml:"secret" env:"HPFEEDS_SECRET"`
+		Channel     string `yaml:"channel" toml:"channel" env:"HPFEEDS_CHANNEL"`
+		Format      string `yaml:"format" toml:"format" env:"HPFEEDS_FORMAT"`
+		SessionIdle string `yaml:"session_idle" toml:"session_idle" env:"HPFEEDS_SESSION_IDLE"`
+	} `yaml:"hpfeeds" toml:"hpfeeds"`
+
+	Geo struct {
+		IPInfoToken      string   `yaml:"ipinfo_token" toml:"ipinfo_token" env:"IPINFOIO_TOKEN"`
+		IPInfoQuota      int      `yaml:"ipinfo_monthly_quota" toml:"ipinfo_monthly_quota" env:"IPINFOIO_MONTHLY_QUOTA"`
+		IPInfoReserve    int      `yaml:"ipinfo_quota_reserve" toml:"ipinfo_quota_reserve" env:"IPINFOIO_QUOTA_RESERVE"`
+		CityDB           string   `yaml:"city_db" toml:"city_db" env:"GEOIP_CITY_DB"`
+		ASNDB            string   `yaml:"asn_db" toml:"asn_db" env:"GEOIP_ASN_DB"`
+		Offline          bool     `yaml:"offline" toml:"offline" env:"GEOIP_OFFLINE"`
+		Providers        []string `yaml:"providers" toml:"providers" env:"GEO_PROVIDERS"`
+		BreakerThreshold int      `yaml:"breaker_threshold" toml:"breaker_threshold" env:"GEO_BREAKER_THRESHOLD"`
+		BreakerCooldown  string   `yaml:"breaker_cooldown" toml:"breaker_cooldown" env:"GEO_BREAKER_COOLDOWN"`
+		CachePath        string   `yaml:"cache_path" toml:"cache_path" env:"GEO_CACHE_PATH"`
+		CacheTTL         string   `yaml:"cache_ttl" toml:"cache_ttl" env:"GEO_CACHE_TTL"`
+		MemoryCacheSize  int      `yaml:"memory_cache_size" toml:"memory_cache_size" env:"GEO_MEMORY_CACHE_SIZE"`
+		MemoryCacheBytes int      `yaml:"memory_cache_max_bytes" toml:"memory_cache_max_bytes" env:"GEO_MEMORY_CACHE_MAX_BYTES"`
+		MemoryCacheTTLs  []string `yaml:"memory_cache_ttls" toml:"memory_cache_ttls" env:"GEO_MEMORY_CACHE_TTLS"`
+	} `yaml:"geo" toml:"geo"`
+
+	Timeouts struct {
+		ConnectionMax    string `yaml:"connection_max" toml:"connection_max" env:"CONNECTION_MAX_TIMEOUT"`
+		ConnectionIdle   string `yaml:"connection_idle" toml:"connection_idle" env:"CONNECTION_IDLE_TIMEOUT"`
+		EnrichMaxElapsed string `yaml:"enrich_max_elapsed" toml:"enrich_max_elapsed" env:"PIPELINE_ENRICH_MAX_ELAPSED"`
+		WriteMaxElapsed  string `yaml:"write_max_elapsed" toml:"write_max_elapsed" env:"PIPELINE_WRITE_MAX_ELAPSED"`
+		PipelineFlush    string `yaml:"pipeline_flush" toml:"pipeline_flush" env:"PIPELINE_FLUSH_INTERVAL"`
+		SeenFilterWindow string `yaml:"seen_filter_window" toml:"seen_filter_window" env:"SEEN_FILTER_WINDOW"`
+		PipelineStats    string `yaml:"pipeline_stats_interval" toml:"pipeline_stats_interval" env:"PIPELINE_STATS_INTERVAL"`
+		DedupWindow      string `yaml:"dedup_window" toml:"dedup_window" env:"PIPELINE_DEDUP_WINDOW"`
+	} `yaml:"timeouts" toml:"timeouts"`
+
+	OTel struct {
+		Endpoint          string `yaml:"endpoint" toml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+		Protocol          string `yaml:"protocol" toml:"protocol" env:"OTEL_EXPORTER_OTLP_PROTOCOL"`
+		Sampler           string `yaml:"sampler" toml:"sampler" env:"OTEL_TRACES_SAMPLER"`
+		SamplerArg        string `yaml:"sampler_arg" toml:"sampler_arg" env:"OTEL_TRACES_SAMPLER_ARG"`
+		TraceRateLimit    int    `yaml:"trace_rate_limit" toml:"trace_rate_limit" env:"TRACE_RATE_LIMIT"`
+		LogsExporter      string `yaml:"logs_exporter" toml:"logs_exporter" env:"OTEL_LOGS_EXPORTER"`
+		ServiceName       string `yaml:"service_name" toml:"service_name" env:"OTEL_SERVICE_NAME"`
+		Insecure          string `yaml:"insecure" toml:"insecure" env:"OTEL_EXPORTER_OTLP_INSECURE"`
+		Certificate       string `yaml:"certificate" toml:"certificate" env:"OTEL_EXPORTER_OTLP_CERTIFICATE"`
+		ClientCertificate string `yaml:"client_certificate" toml:"client_certificate" env:"OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE"`
+		ClientKey         string `yaml:"client_key" toml:"client_key" env:"OTEL_EXPORTER_OTLP_CLIENT_KEY"`
+		Headers           string `yaml:"headers" toml:"headers" env:"OTEL_EXPORTER_OTLP_HEADERS"`
+	} `yaml:"otel" toml:"otel"`
+
+	Alerting struct {
+		Rules []string `yaml:"rules" toml:"rules" env:"ALERT_RULES"`
+	} `yaml:"alerting" toml:"alerting"`
+
+	MISP struct {
+		URL          string   `yaml:"url" toml:"url" env:"MISP_URL"`
+		APIKey       string   `yaml:"api_key" toml:"api_key" env:"MISP_API_KEY"`
+		Interval     string   `yaml:"interval" toml:"interval" env:"MISP_INTERVAL"`
+		Distribution int      `yaml:"distribution" toml:"distribution" env:"MISP_DISTRIBUTION"`
+		ThreatLevel  int      `yaml:"threat_level" toml:"threat_level" env:"MISP_THREAT_LEVEL"`
+		Tags         []string `yaml:"tags" toml:"tags" env:"MISP_TAGS"`
+	} `yaml:"misp" toml:"misp"`
+
+	DShield struct {
+		Enabled  bool   `yaml:"enabled" toml:"enabled" env:"DSHIELD_ENABLED"`
+		UserID   string `yaml:"user_id" toml:"user_id" env:"DSHIELD_USER_ID"`
+		APIKey   string `yaml:"api_key" toml:"api_key" env:"DSHIELD_API_KEY"`
+		Interval string `yaml:"interval" toml:"interval" env:"DSHIELD_INTERVAL"`
+	} `yaml:"dshield" toml:"dshield"`
+
+	STIX struct {
+		Enabled           bool   `yaml:"enabled" toml:"enabled" env:"STIX_ENABLED"`
+		Identity          string `yaml:"identity" toml:"identity" env:"STIX_IDENTITY"`
+		Retention         string `yaml:"retention" toml:"retention" env:"STIX_RETENTION"`
+		TAXIIPushURL      string `yaml:"taxii_push_url" toml:"taxii_push_url" env:"TAXII_PUSH_URL"`
+		TAXIIUsername     string `yaml:"taxii_username" toml:"taxii_username" env:"TAXII_USERNAME"`
+		TAXIIPassword     string `yaml:"taxii_password" toml:"taxii_password" env:"TAXII_PASSWORD"`
+		TAXIIPushInterval string `yaml:"taxii_push_interval" toml:"taxii_push_interval" env:"TAXII_PUSH_INTERVAL"`
+	} `yaml:"stix" toml:"stix"`
+
+	Ban struct {
+		Threshold int    `yaml:"threshold" toml:"threshold" env:"BAN_THRESHOLD"`
+		FindTime  string `yaml:"find_time" toml:"find_time" env:"BAN_FIND_TIME"`
+		BanTime   string `yaml:"ban_time" toml:"ban_time" env:"BAN_TIME"`
+		LogPath   string `yaml:"log_path" toml:"log_path" env:"BAN_LOG_PATH"`
+		Command   string `yaml:"command" toml:"command" env:"BAN_COMMAND"`
+		URL       string `yaml:"url" toml:"url" env:"BAN_URL"`
+	} `yaml:"ban" toml:"ban"`
+
+	Log struct {
+		Format string `yaml:"format" toml:"format" env:"LOG_FORMAT"`
+		Level  string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+	} `yaml:"log" toml:"log"`
+}
+
+// LoadConfig reads a YAML or TOML configuration file, picked by extension,
+// rejecting unknown keys and invalid values.
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse '%s': %v", path, err)
+		}
+	case ".toml":
+		metadata, err := toml.Decode(string(content), &config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse '%s': %v", path, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("failed to parse '%s': unknown key '%s'", path, undecoded[0])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file '%s', must be .yaml, .yml or .toml", path)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config '%s': %v", path, err)
+	}
+
+	return &config, nil
+}
+
+// Validate checks the settings that would otherwise only fail, or be
+// silently replaced by their default, once in use.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if port := c.Listener.SSHPort; port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("listener.ssh_port: %d is not a valid port", port))
+	}
+	ports := map[int]bool{2222: true}
+	if c.Listener.SSHPort != 0 {
+		ports = map[int]bool{c.Listener.SSHPort: true}
+	}
+	for i, listener := range c.Listener.SSHListeners {
+		if listener.Port <= 0 || listener.Port > 65535 {
+			errs = append(errs, fmt.Errorf("listener.ssh_listeners[%d].port: %d is not a valid port", i, listener.Port))
+		} else if ports[listener.Port] {
+			errs = append(errs, fmt.Errorf("listener.ssh_listeners[%d].port: %d is already listened on", i, listener.Port))
+		}
+		ports[listener.Port] = true
+		for _, keyType := range listener.HostKeyTypes {
+			if _, ok := hostKeyTypes[keyType]; !ok {
+				errs = append(errs, fmt.Errorf("listener.ssh_listeners[%d].host_key_types: '%s' is not 'rsa', 'ecdsa' or 'ed25519'", i, keyType))
+			}
+		}
+	}
+	if port := c.Listener.TelnetPort; port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("listener.telnet_port: %d is not a valid port", port))
+	}
+	if port := c.Tarpit.Port; port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("tarpit.port: %d is not a valid port", port))
+	}
+	if port := c.HTTP.Port; port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("http.port: %d is not a valid port", port))
+	}
+	if port := c.HTTP.HTTPSPort; port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("http.https_port: %d is not a valid port", port))
+	}
+	if (c.HTTP.CertFile == "") != (c.HTTP.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("http: cert_file and key_file must be set together"))
+	}
+
+	if c.InfluxDB.URL != "" {
+		if u, err := url.Parse(c.InfluxDB.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("influxdb.url: '%s' is not an http(s) URL", c.InfluxDB.URL))
+		}
+	}
+	for _, tag := range c.InfluxDB.Tags {
+		if tag != "all" && !slices.Contains(lineProtocolAttributes, tag) {
+			errs = append(errs, fmt.Errorf("influxdb.tags: unknown attribute '%s'", tag))
+		}
+	}
+	if c.Elasticsearch.URL != "" {
+		if u, err := url.Parse(c.Elasticsearch.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("elasticsearch.url: '%s' is not an http(s) URL", c.Elasticsearch.URL))
+		}
+	}
+	if c.Loki.URL != "" {
+		if u, err := url.Parse(c.Loki.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("loki.url: '%s' is not an http(s) URL", c.Loki.URL))
+		}
+	}
+	if c.MISP.URL != "" {
+		if u, err := url.Parse(c.MISP.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("misp.url: '%s' is not an http(s) URL", c.MISP.URL))
+		}
+	}
+	if c.STIX.TAXIIPushURL != "" {
+		if u, err := url.Parse(c.STIX.TAXIIPushURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("stix.taxii_push_url: '%s' is not an http(s) URL", c.STIX.TAXIIPushURL))
+		}
+	}
+	if c.Ban.URL != "" {
+		if u, err := url.Parse(c.Ban.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("ban.url: '%s' is not an http(s) URL", c.Ban.URL))
+		}
+	}
+	if c.ClickHouse.URL != "" {
+		if u, err := url.Parse(c.ClickHouse.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("clickhouse.url: '%s' is not an http(s) URL", c.ClickHouse.URL))
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value string
+	}{
+		{"timeouts.connection_max", c.Timeouts.ConnectionMax},
+		{"timeouts.connection_idle", c.Timeouts.ConnectionIdle},
+		{"timeouts.enrich_max_elapsed", c.Timeouts.EnrichMaxElapsed},
+		{"timeouts.write_max_elapsed", c.Timeouts.WriteMaxElapsed},
+		{"timeouts.pipeline_flush", c.Timeouts.PipelineFlush},
+		{"timeouts.seen_filter_window", c.Timeouts.SeenFilterWindow},
+		{"timeouts.pipeline_stats_interval", c.Timeouts.PipelineStats},
+		{"webhook.max_elapsed", c.Webhook.MaxElapsed},
+		{"listener.host_key_rotate_interval", c.Listener.HostKeyRotate},
+		{"listener.host_key_rotate_overlap", c.Listener.HostKeyOverlap},
+		{"s3.flush_interval", c.S3.FlushInterval},
+		{"event_file.rotate_interval", c.EventFile.RotateInterval},
+		{"tarpit.delay", c.Tarpit.Delay},
+		{"geo.cache_ttl", c.Geo.CacheTTL},
+		{"influxdb.flush_interval", c.InfluxDB.FlushInterval},
+		{"spool.replay_interval", c.Spool.ReplayInterval},
+		{"misp.interval", c.MISP.Interval},
+		{"dshield.interval", c.DShield.Interval},
+		{"stix.retention", c.STIX.Retention},
+		{"stix.taxii_push_interval", c.STIX.TAXIIPushInterval},
+		{"geo.breaker_cooldown", c.Geo.BreakerCooldown},
+		{"ban.find_time", c.Ban.FindTime},
+		{"ban.ban_time", c.Ban.BanTime},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(d.value); err != nil || duration < 0 {
+			errs = append(errs, fmt.Errorf("%s: '%s' is not a valid duration, e.g. '30s' or '5m'", d.name, d.value))
+		}
+	}
+
+	for _, entry := range c.Allowlist {
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			errs = append(errs, fmt.Errorf("allowlist: '%s' is not an IP or CIDR", entry))
+		}
+	}
+
+	for _, provider := range c.Geo.Providers {
+		if _, ok := geoProviders[provider]; !ok {
+			errs = append(errs, fmt.Errorf("geo.providers: '%s' is not 'geolite2', 'ipinfo.io' or 'ip-api.com'", provider))
+		}
+	}
+
+	if _, err := parseGeoMemoryTTLs(c.Geo.MemoryCacheTTLs); err != nil {
+		errs = append(errs, fmt.Errorf("geo.memory_cache_ttls: %v", err))
+	}
+
+	for _, entry := range c.Policies {
+		if _, err := parsePolicyRule(entry); err != nil {
+			errs = append(errs, fmt.Errorf("policies: %v", err))
+		}
+	}
+
+	for _, keyType := range c.Listener.HostKeyTypes {
+		if _, ok := hostKeyTypes[keyType]; !ok {
+			errs = append(errs, fmt.Errorf("listener.host_key_types: '%s' is not 'rsa', 'ecdsa' or 'ed25519'", keyType))
+		}
+	}
+
+	if network := c.Listener.Network; network != "" {
+		if _, ok := listenNetworks[network]; !ok {
+			errs = append(errs, fmt.Errorf("listener.network: '%s' is not 'dual', 'tcp4' or 'tcp6'", network))
+		}
+	}
+	// Anything else than an IP is taken for an interface name, resolved when
+	// the listeners start as the interface may not be up yet
+	for _, address := range c.Listener.Addresses {
+		if strings.Contains(address, ":") && net.ParseIP(strings.Trim(address, "[]")) == nil {
+			errs = append(errs, fmt.Errorf("listener.addresses: '%s' is not an IP address", address))
+		}
+	}
+
+	if maxConns := c.Listener.MaxConnections; maxConns != "" {
+		if n, err := strconv.Atoi(maxConns); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("listener.max_connections: '%s' is not a positive number or 0", maxConns))
+		}
+	}
+	if overflow := c.Listener.ConnOverflow; overflow != "" && overflow != "wait" && overflow != "reject" {
+		errs = append(errs, fmt.Errorf("listener.connection_overflow: '%s' is not 'wait' or 'reject'", overflow))
+	}
+
+	if mode := c.Listener.SSHVersionMode; mode != "" && mode != "fixed" && mode != "listener" && mode != "connection" {
+		errs = append(errs, fmt.Errorf("listener.ssh_version_mode: '%s' is not 'fixed', 'listener' or 'connection'", mode))
+	}
+
+	if protocol := c.Syslog.Protocol; protocol != "" && protocol != "udp" && protocol != "tcp" && protocol != "tls" {
+		errs = append(errs, fmt.Errorf("syslog.protocol: '%s' is not 'udp', 'tcp' or 'tls'", protocol))
+	}
+	for _, format := range [][2]string{{"stdout.format", c.Stdout.Format}, {"event_file.format", c.EventFile.Format}} {
+		if format[1] != "" && format[1] != "document" && format[1] != "cowrie" {
+			errs = append(errs, fmt.Errorf("%s: '%s' is not 'document' or 'cowrie'", format[0], format[1]))
+		}
+	}
+	if format := c.Syslog.Format; format != "" && format != "cef" && format != "rfc5424" {
+		errs = append(errs, fmt.Errorf("syslog.format: '%s' is not 'cef' or 'rfc5424'", format))
+	}
+
+	if qos := c.MQTT.QoS; qos != "" && qos != "0" && qos != "1" && qos != "2" {
+		errs = append(errs, fmt.Errorf("mqtt.qos: '%s' is not 0, 1 or 2", qos))
+	}
+
+	if format := c.HPFeeds.Format; format != "" && format != "cowrie" && format != "document" {
+		errs = append(errs, fmt.Errorf("hpfeeds.format: '%s' is not 'cowrie' or 'document'", format))
+	}
+
+	if protocol := c.GELF.Protocol; protocol != "" && protocol != "udp" && protocol != "tcp" && protocol != "tls" {
+		errs = append(errs, fmt.Errorf("gelf.protocol: '%s' is not 'udp', 'tcp' or 'tls'", protocol))
+	}
+
+	if _, err := parseWebhookHeaders(c.Webhook.Headers); err != nil {
+		errs = append(errs, fmt.Errorf("webhook.headers: %v", err))
+	}
+
+	for _, rule := range c.Alerting.Rules {
+		if _, ok := alertRules[rule]; !ok {
+			errs = append(errs, fmt.Errorf("alerting.rules: unknown rule '%s'", rule))
+		}
+	}
+
+	if format := strings.ToLower(c.Log.Format); format != "" && format != "text" && format != "json" {
+		errs = append(errs, fmt.Errorf("log.format: '%s' must be 'text' or 'json'", c.Log.Format))
+	}
+	if c.Log.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+			errs = append(errs, fmt.Errorf("log.level: '%s' must be 'debug', 'info', 'warn' or 'error'", c.Log.Level))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Apply sets the environment variable of every setting present in the file,
+// unless the environment already sets it, and returns the variables it set.
+func (c *Config) Apply() ([]string, error) {
+	var applied []string
+	if err := applyEnv(reflect.ValueOf(c).Elem(), &applied); err != nil {
+		return applied, err
+	}
+	err := c.applyListeners(&applied)
+	return applied, err
+}
+
+// applyListeners sets the variables of the additional SSH listeners, which
+// have no fixed names: their ports are appended to SSH_PORT, unless it's set
+// in the environment, and their settings go to the variables suffixed with
+// their port, e.g. SSH_VERSION_22.
+func (c *Config) applyListeners(applied *[]string) error {
+	if len(c.Listener.SSHListeners) == 0 {
+		return nil
+	}
+
+	if _, set := os.LookupEnv("SSH_PORT"); !set || slices.Contains(*applied, "SSH_PORT") {
+		ports := []string{getEnv("SSH_PORT", "2222")}
+		for _, listener := range c.Listener.SSHListeners {
+			ports = append(ports, strconv.Itoa(listener.Port))
+		}
+		if err := os.Setenv("SSH_PORT", strings.Join(ports, ",")); err != nil {
+			return err
+		}
+		if !slices.Contains(*applied, "SSH_PORT") {
+			*applied = append(*applied, "SSH_PORT")
+		}
+	}
+
+	for _, listener := range c.Listener.SSHListeners {
+		port := strconv.Itoa(listener.Port)
+		for key, setting := range map[string]string{
+			"SSH_VERSION_" + port:    listener.SSHVersion,
+			"SSH_BANNER_" + port:     listener.SSHBanner,
+			"HOST_KEY_PATH_" + port:  listener.HostKeyPath,
+			"HOST_KEY_TYPES_" + port: strings.Join(listener.HostKeyTypes, ","),
+		} {
+			if _, set := os.LookupEnv(key); set || setting == "" {
+				continue
+			}
+			if err := os.Setenv(key, setting); err != nil {
+				return err
+			}
+			*applied = append(*applied, key)
+		}
+	}
+
+	return nil
+}
+
+func applyEnv(value reflect.Value, applied *[]string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, applied); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := value.Type().Field(i).Tag.Get("env")
+		if key == "" || field.IsZero() {
+			continue
+		}
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+
+		var setting string
+		switch field.Kind() {
+		case reflect.Int:
+			setting = strconv.FormatInt(field.Int(), 10)
+		case reflect.Bool:
+			setting = strconv.FormatBool(field.Bool())
+		case reflect.Slice:
+			setting = strings.Join(field.Interface().([]string), ",")
+		default:
+			setting = field.String()
+		}
+		if err := os.Setenv(key, setting); err != nil {
+			return err
+		}
+		*applied = append(*applied, key)
+	}
+
+	return nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+type connRecordKey struct{}
+
+// ConnRecord holds the state shared by every event captured on a single
+// SSH connection. It is attached to the ssh.Context when the connection is
+// accepted and looked up through getConnRecord.
+type ConnRecord struct {
+	mu        sync.Mutex
+	attempts  int
+	actions   map[string]struct{}
+	createdAt time.Time
+
+	hassh string
+
+	lastAttempt   time.Time
+	lastKeystroke time.Time
+	signals       TimingSignals
+
+	// bannerShown is when the pre-authentication banner was sent, answering
+	// the first authentication request, and bannerAnswered whether that
+	// request has been handled since.
+	bannerShown    time.Time
+	bannerAnswered bool
+
+	// ptyModes are the terminal modes of the latest pty request
+	ptyModes string
+
+	// files is the view of the fake filesystem shared by the sessions of
+	// the connection
+	files *FSView
+	// samples are the SHA256 of the samples captured over the connection
+	samples map[string]struct{}
+
+	// channels counts the session channels opened, and bytesIn and
+	// bytesOut the bytes read from and written to them
+	channels atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// TimingSignals are the raw timing observations of a connection used to tell
+// automated clients from humans.
+type TimingSignals struct {
+	AuthIntervals      []time.Duration
+	KeystrokeIntervals []time.Duration
+	WindowChanges      int
+	// X11Requested is whether the client asked for X11 forwarding, which
+	// only people at a desktop do.
+	X11Requested bool
+	// BannerDelay is how long the client took to send another authentication
+	// request after being shown the pre-authentication banner, zero until it
+	// does.
+	BannerDelay time.Duration
+}
+
+// Bounds the timing observations kept per connection.
+const maxTimingSamples = 1000
+
+// Bounds the window_change events captured per connection, resizing a
+// terminal by dragging sends many.
+const maxWindowChangeEvents = 50
+
+func newConnRecord() *ConnRecord {
+	return &ConnRecord{
+		actions:   map[string]struct{}{},
+		createdAt: time.Now(),
+	}
+}
+
+func attachConnRecord(sshContext ssh.Context) *ConnRecord {
+	record := newConnRecord()
+	sshContext.SetValue(connRecordKey{}, record)
+
+	return record
+}
+
+func getConnRecord(sshContext ssh.Context) *ConnRecord {
+	if record, ok := sshContext.Value(connRecordKey{}).(*ConnRecord); ok {
+		return record
+	}
+
+	return attachConnRecord(sshContext)
+}
+
+// observeAttempt registers an authentication attempt and reports whether it
+// is a new action on this connection. A client offering the same credential
+// twice, e.g. a public key queried before being signed, is a single action
+// and must only produce one event. New attempts get their 1-based index
+// assigned to sshInfo.Attempt.
+func (r *ConnRecord) observeAttempt(sshInfo *SSHInfo) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := strings.Join([]string{sshInfo.Function, sshInfo.User, sshInfo.Password, sshInfo.Key}, "\x00")
+	if _, seen := r.actions[key]; seen {
+		return false
+	}
+
+	r.actions[key] = struct{}{}
+	r.attempts++
+	sshInfo.Attempt = r.attempts
+
+	now := time.Now()
+	r.observeAfterBanner(now)
+	if !r.lastAttempt.IsZero() && len(r.signals.AuthIntervals) < maxTimingSamples {
+		r.signals.AuthIntervals = append(r.signals.AuthIntervals, now.Sub(r.lastAttempt))
+	}
+	r.lastAttempt = now
+	sshInfo.Signals = r.timingSignals()
+
+	return true
+}
+
+// recordBanner registers the pre-authentication banner being sent.
+func (r *ConnRecord) recordBanner() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.bannerShown = time.Now()
+}
+
+// recordAuthRequest registers an authentication request, of any method,
+// having been handled.
+func (r *ConnRecord) recordAuthRequest() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.observeAfterBanner(time.Now())
+	if !r.bannerShown.IsZero() {
+		r.bannerAnswered = true
+	}
+}
+
+// observeAfterBanner records the banner delay when the client sends an
+// authentication request past the one the banner answered.
+func (r *ConnRecord) observeAfterBanner(now time.Time) {
+	if r.bannerAnswered && r.signals.BannerDelay == 0 {
+		r.signals.BannerDelay = now.Sub(r.bannerShown)
+	}
+}
+
+// leftAtBanner reports whether the client was shown the banner and never
+// proceeded with another authentication request, along with how long ago it
+// was shown.
+func (r *ConnRecord) leftAtBanner() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.bannerShown.IsZero() || r.signals.BannerDelay > 0 {
+		return 0, false
+	}
+
+	return time.Since(r.bannerShown), true
+}
+
+func (r *ConnRecord) setHASSH(hassh string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hassh = hassh
+}
+
+func (r *ConnRecord) HASSH() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.hassh
+}
+
+func (r *ConnRecord) hasAttempts() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.attempts > 0
+}
+
+// fileSystem returns the view of the fake filesystem of the connection,
+// created with newView by the first session asking for it.
+func (r *ConnRecord) fileSystem(newView func() *FSView) *FSView {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.files == nil {
+		r.files = newView()
+	}
+
+	return r.files
+}
+
+// newSample registers a sample captured over the connection, and reports
+// whether it is the first time it is.
+func (r *ConnRecord) newSample(sha256 string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.samples[sha256]; found {
+		return false
+	}
+	if r.samples == nil {
+		r.samples = map[string]struct{}{}
+	}
+	r.samples[sha256] = struct{}{}
+
+	return true
+}
+
+// openChannel registers a session channel being opened, and reports whether
+// it is the first one of the connection.
+func (r *ConnRecord) openChannel() bool {
+	return r.channels.Add(1) == 1
+}
+
+// SessionTraffic returns the session channels opened so far, and the bytes
+// read from and written to them.
+func (r *ConnRecord) SessionTraffic() (channels int, bytesIn int64, bytesOut int64) {
+	return int(r.channels.Load()), r.bytesIn.Load(), r.bytesOut.Load()
+}
+
+// recordInput registers n bytes of session input received at once, and
+// returns their intervals. Bytes after the first one arrived together with
+// it, so they count as zero intervals, which is what pasted or scripted
+// input looks like.
+func (r *ConnRecord) recordInput(n int) []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var intervals []time.Duration
+	for i := 0; i < n && len(intervals) < maxTimingSamples; i++ {
+		if i == 0 && r.lastKeystroke.IsZero() {
+			continue
+		}
+		if i == 0 {
+			intervals = append(intervals, now.Sub(r.lastKeystroke))
+		} else {
+			intervals = append(intervals, 0)
+		}
+	}
+	r.lastKeystroke = now
+
+	kept := min(len(intervals), maxTimingSamples-len(r.signals.KeystrokeIntervals))
+	r.signals.KeystrokeIntervals = append(r.signals.KeystrokeIntervals, intervals[:max(kept, 0)]...)
+
+	return intervals
+}
+
+func (r *ConnRecord) recordX11Request() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.signals.X11Requested = true
+}
+
+// recordWindowChange registers a resize of the terminal, returning how many
+// there were on the connection.
+func (r *ConnRecord) recordWindowChange() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.signals.WindowChanges++
+	return r.signals.WindowChanges
+}
+
+func (r *ConnRecord) setPtyModes(modes string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ptyModes = modes
+}
+
+func (r *ConnRecord) PtyModes() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ptyModes
+}
+
+// TimingSignals returns a copy of the timing observations so far.
+func (r *ConnRecord) TimingSignals() TimingSignals {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.timingSignals()
+}
+
+func (r *ConnRecord) timingSignals() TimingSignals {
+	return TimingSignals{
+		AuthIntervals:      slices.Clone(r.signals.AuthIntervals),
+		KeystrokeIntervals: slices.Clone(r.signals.KeystrokeIntervals),
+		WindowChanges:      r.signals.WindowChanges,
+		X11Requested:       r.signals.X11Requested,
+		BannerDelay:        r.signals.BannerDelay,
+	}
+}
+
+// newSSHInfo captures the connection metadata common to every event emitted
+// for sshContext.
+func newSSHInfo(sshContext ssh.Context, function string) SSHInfo {
+	remoteHost, remotePort := addrHostPort(sshContext.RemoteAddr())
+	localHost, localPort := addrHostPort(sshContext.LocalAddr())
+
+	sshInfo := SSHInfo{
+		User:          sshContext.User(),
+		RemoteHost:    remoteHost,
+		RemotePort:    remotePort,
+		LocalHost:     localHost,
+		LocalPort:     localPort,
+		ClientVersion: sshContext.ClientVersion(),
+		HASSH:         getConnRecord(sshContext).HASSH(),
+		SessionID:     sshContext.SessionID(),
+		Function:      function,
+		Protocol:      "ssh",
+		Node:          node,
+		Timestamp:     time.Now(),
+	}
+	if policy := connPolicy(sshContext); policy != PolicyDefault {
+		sshInfo.Policy = policy
+	}
+
+	return sshInfo
+}
+
+// deadlineConn enforces the connection timeouts itself, so they can come
+// from the reloadable Settings instead of being fixed on the ssh.Server. The
+// server calls SetDeadline before every read and write, which is taken as
+// the cue to push the idle deadline, never past the maximum one.
+type deadlineConn struct {
+	net.Conn
+	idleTimeout time.Duration
+	maxDeadline time.Time
+}
+
+func newDeadlineConn(conn net.Conn, maxTimeout time.Duration, idleTimeout time.Duration) *deadlineConn {
+	c := &deadlineConn{Conn: conn, idleTimeout: idleTimeout}
+	if maxTimeout > 0 {
+		c.maxDeadline = time.Now().Add(maxTimeout)
+	}
+
+	return c
+}
+
+func (c *deadlineConn) SetDeadline(time.Time) error {
+	deadline := c.maxDeadline
+	if c.idleTimeout > 0 {
+		idleDeadline := time.Now().Add(c.idleTimeout)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+
+	return c.Conn.SetDeadline(deadline)
+}
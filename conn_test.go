@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace/noop"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestObserveAttemptPublicKeyQueriedThenSigned(t *testing.T) {
+	record := newConnRecord()
+	query := SSHInfo{Function: "public_key", User: "root", Key: "ssh-ed25519 AAAA"}
+	signed := query
+
+	if !record.observeAttempt(&query) {
+		t.Fatal("query not observed as a new attempt")
+	}
+	if record.observeAttempt(&signed) {
+		t.Error("signed request observed as a new attempt")
+	}
+	if query.Attempt != 1 {
+		t.Errorf("attempt = %d, want 1", query.Attempt)
+	}
+}
+
+func TestObserveAttemptRepeatedPassword(t *testing.T) {
+	record := newConnRecord()
+
+	first := SSHInfo{Function: "password", User: "root", Password: "123456"}
+	repeated := first
+	other := SSHInfo{Function: "password", User: "root", Password: "admin"}
+
+	if !record.observeAttempt(&first) {
+		t.Fatal("first password not observed")
+	}
+	if record.observeAttempt(&repeated) {
+		t.Error("repeated password observed as a new attempt")
+	}
+	if !record.observeAttempt(&other) {
+		t.Fatal("other password not observed")
+	}
+	if other.Attempt != 2 {
+		t.Errorf("attempt = %d, want 2", other.Attempt)
+	}
+}
+
+// TestSessionEmitsOnlySession runs an exec session against the server of
+// the listeners, expecting a single event of each kind.
+func TestSessionEmitsOnlySession(t *testing.T) {
+	t.Setenv("SHELL_CREDENTIALS", "root:123456")
+	loadTestSettings(t)
+
+	tracer := noop.NewTracerProvider().Tracer("test")
+	persona, err := personaFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shell, err := shellFromEnv(persona, tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeys, err := NewHostKeyRing(filepath.Join(t.TempDir(), "host_key"), []string{"ed25519"}, 0, tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var functions []string
+	capture := func(sshInfo SSHInfo) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		functions = append(functions, sshInfo.Function)
+		return true
+	}
+	server := newServer("22", hostKeys, SSHServerEnv{
+		Capture:  capture,
+		Shell:    shell,
+		Tarpit:   NewTarpit(time.Second, 32, 1, capture),
+		Sessions: NewSessionTracker(),
+		Tracer:   tracer,
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client, err := gossh.Dial("tcp", listener.Addr().String(), &gossh.ClientConfig{
+		User:            "root",
+		Auth:            []gossh.AuthMethod{gossh.Password("123456")},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Setenv("LANG", "C")
+	if _, err := session.Output("uname -a"); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	want := []string{"password", "session", "session_end"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := slices.Clone(functions)
+		mu.Unlock()
+		if len(got) >= len(want) || time.Now().After(deadline) {
+			// Late duplicates would follow
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			got = slices.Clone(functions)
+			mu.Unlock()
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("events = %v, want %v", got, want)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// cowrieTimeFormat is the timestamp layout of cowrie's JSON log.
+const cowrieTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// eventLineEncoder returns how the sinks writing lines of JSON lay events
+// out: "document" as an EventDocument, or "cowrie" as cowrie's JSON log
+// does, for its log analyzers and dashboards.
+func eventLineEncoder(format string) (func(*json.Encoder, Event) error, error) {
+	switch format {
+	case "document":
+		return func(encoder *json.Encoder, event Event) error {
+			return encoder.Encode(newEventDocument(event))
+		}, nil
+	case "cowrie":
+		return func(encoder *json.Encoder, event Event) error {
+			for _, record := range newCowrieRecords(event) {
+				if err := encoder.Encode(record); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown event format '%s', expected 'document' or 'cowrie'", format)
+}
+
+// newCowrieRecords returns the records of cowrie's JSON log standing for
+// event. The first attempt of a connection is preceded by the records cowrie
+// logs as connections are accepted, the events cowrie has no equivalent for
+// getting an "ssh-honeypot." eventid of their own.
+func newCowrieRecords(event Event) []map[string]any {
+	sshInfo := event.SSHInfo
+	newRecord := func(eventID string, message string) map[string]any {
+		return map[string]any{
+			"eventid":   eventID,
+			"timestamp": sshInfo.Timestamp.UTC().Format(cowrieTimeFormat),
+			"src_ip":    sshInfo.RemoteHost,
+			"session":   sshInfo.SessionID,
+			"sensor":    sshInfo.Node.ID,
+			"protocol":  sshInfo.Protocol,
+			"message":   message,
+		}
+	}
+
+	var records []map[string]any
+	if sshInfo.Attempt == 1 {
+		connect := newRecord("cowrie.session.connect", fmt.Sprintf("New connection: %s:%s (%s:%s) [session: %s]",
+			sshInfo.RemoteHost, sshInfo.RemotePort, sshInfo.LocalHost, sshInfo.LocalPort, sshInfo.SessionID))
+		connect["src_port"], connect["dst_ip"], connect["dst_port"] = cowriePort(sshInfo.RemotePort), sshInfo.LocalHost, cowriePort(sshInfo.LocalPort)
+		records = append(records, connect)
+		if sshInfo.ClientVersion != "" {
+			version := newRecord("cowrie.client.version", "Remote SSH version: "+sshInfo.ClientVersion)
+			version["version"] = sshInfo.ClientVersion
+			records = append(records, version)
+		}
+		if sshInfo.HASSH != "" {
+			kex := newRecord("cowrie.client.kex", "SSH client hassh fingerprint: "+sshInfo.HASSH)
+			kex["hassh"] = sshInfo.HASSH
+			records = append(records, kex)
+		}
+	}
+
+	switch sshInfo.Function {
+	case "password", "keyboard_interactive":
+		record := newRecord("cowrie.login.failed", fmt.Sprintf("login attempt [%s/%s] failed", sshInfo.User, sshInfo.Password))
+		if sshInfo.Accepted {
+			record = newRecord("cowrie.login.success", fmt.Sprintf("login attempt [%s/%s] succeeded", sshInfo.User, sshInfo.Password))
+		}
+		record["username"], record["password"] = sshInfo.User, sshInfo.Password
+		records = append(records, record)
+	case "public_key":
+		fingerprint := strings.TrimPrefix(sshInfo.KeyMD5, "MD5:")
+		record := newRecord("cowrie.client.fingerprint", fmt.Sprintf("public key attempt for user %s of type %s with fingerprint %s",
+			sshInfo.User, sshInfo.KeyType, fingerprint))
+		record["username"], record["fingerprint"] = sshInfo.User, fingerprint
+		record["key"], record["type"] = strings.TrimSpace(sshInfo.Key), sshInfo.KeyType
+		records = append(records, record)
+	case "session":
+		for _, variable := range sshInfo.Env {
+			name, value, _ := strings.Cut(variable, "=")
+			record := newRecord("cowrie.client.var", fmt.Sprintf("request_env: %s=%s", name, value))
+			record["name"], record["value"] = name, value
+			records = append(records, record)
+		}
+		if sshInfo.Term != "" {
+			records = append(records, cowrieSize(newRecord, sshInfo))
+		}
+		if sshInfo.Command != "" {
+			record := newRecord("cowrie.command.input", "CMD: "+sshInfo.Command)
+			record["input"] = sshInfo.Command
+			records = append(records, record)
+		}
+	case "command":
+		record := newRecord("cowrie.command.input", "CMD: "+sshInfo.Command)
+		record["input"] = sshInfo.Command
+		records = append(records, record)
+	case "window_change":
+		records = append(records, cowrieSize(newRecord, sshInfo))
+	case "download":
+		if sshInfo.FileSHA256 == "" {
+			record := newRecord("cowrie.session.file_download.failed", "Attempt to download file(s) from URL ("+sshInfo.URL+") failed")
+			record["url"] = sshInfo.URL
+			records = append(records, record)
+			break
+		}
+		record := newRecord("cowrie.session.file_download", fmt.Sprintf("Downloaded URL (%s) with SHA-256 %s to %s", sshInfo.URL, sshInfo.FileSHA256, sshInfo.Path))
+		record["url"], record["shasum"], record["outfile"], record["destfile"] = sshInfo.URL, sshInfo.FileSHA256, sshInfo.Path, sshInfo.Path
+		records = append(records, record)
+	case "file":
+		if sshInfo.FileOperation != "write" {
+			records = append(records, cowrieOwnRecord(newRecord, event))
+			break
+		}
+		record := newRecord("cowrie.session.file_upload", fmt.Sprintf("Saved upload of %s with SHA-256 %s", sshInfo.Path, sshInfo.FileSHA256))
+		record["filename"], record["outfile"], record["shasum"] = path.Base(sshInfo.Path), sshInfo.Path, sshInfo.FileSHA256
+		records = append(records, record)
+	case "local_forward":
+		record := newRecord("cowrie.direct-tcpip.request", fmt.Sprintf("direct-tcp connection request to %s:%s", sshInfo.ForwardHost, sshInfo.ForwardPort))
+		record["dst_ip"], record["dst_port"] = sshInfo.ForwardHost, cowriePort(sshInfo.ForwardPort)
+		record["src_port"] = cowriePort(sshInfo.RemotePort)
+		records = append(records, record)
+	case "session_end":
+		record := newRecord("cowrie.session.closed", fmt.Sprintf("Connection lost after %.1f seconds", sshInfo.Duration.Seconds()))
+		record["duration"] = sshInfo.Duration.Seconds()
+		records = append(records, record)
+	default:
+		records = append(records, cowrieOwnRecord(newRecord, event))
+	}
+
+	return records
+}
+
+func cowrieSize(newRecord func(string, string) map[string]any, sshInfo SSHInfo) map[string]any {
+	record := newRecord("cowrie.client.size", fmt.Sprintf("Terminal Size: %d %d", sshInfo.TermWidth, sshInfo.TermHeight))
+	record["width"], record["height"] = sshInfo.TermWidth, sshInfo.TermHeight
+	return record
+}
+
+// cowrieOwnRecord lays out the events cowrie has no equivalent for, with the
+// fields of their EventDocument.
+func cowrieOwnRecord(newRecord func(string, string) map[string]any, event Event) map[string]any {
+	function := event.SSHInfo.Function
+	record := newRecord("ssh-honeypot."+function, syslogEvents[function].name)
+	document, _ := json.Marshal(newEventDocument(event))
+	var fields map[string]any
+	json.Unmarshal(document, &fields)
+	for name, value := range fields {
+		if _, found := record[name]; !found && name != "@timestamp" && name != "function" {
+			record[name] = value
+		}
+	}
+
+	return record
+}
+
+// cowriePort returns port as the number cowrie logs.
+func cowriePort(port string) any {
+	if number, err := strconv.Atoi(port); err == nil {
+		return number
+	}
+
+	return port
+}
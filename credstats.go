@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	credentialBucketSize = 5 * time.Minute
+	credentialBuckets    = int(24 * time.Hour / credentialBucketSize)
+
+	// Distinct values tracked per bucket and kind, further values are only
+	// counted towards the total.
+	maxCredentialKeysPerBucket = 10000
+)
+
+type credentialBucket struct {
+	start     time.Time
+	usernames map[string]int
+	passwords map[string]int
+	pairs     map[string]int
+	total     int
+}
+
+type CredentialCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type CredentialSummary struct {
+	Window    string            `json:"window"`
+	Total     int               `json:"total"`
+	Usernames []CredentialCount `json:"usernames"`
+	Passwords []CredentialCount `json:"passwords"`
+	Pairs     []CredentialCount `json:"pairs"`
+}
+
+// CredentialStats keeps rolling counts of the usernames, passwords and
+// username/password pairs tried over the last day, in 5 minute buckets, so
+// top-N summaries for the last hour and day can be computed without querying
+// the raw events.
+type CredentialStats struct {
+	mu      sync.Mutex
+	buckets []*credentialBucket
+	topN    int
+}
+
+func NewCredentialStats(topN int) *CredentialStats {
+	return &CredentialStats{
+		buckets: make([]*credentialBucket, credentialBuckets),
+		topN:    topN,
+	}
+}
+
+// Observe counts the credentials of password and public key attempts, those
+// collapsed by the Deduper included.
+func (s *CredentialStats) Observe(ctx context.Context, event Event) {
+	sshInfo := event.SSHInfo
+	if !isPasswordAttempt(sshInfo) && sshInfo.Function != "public_key" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.bucket(sshInfo.Timestamp)
+	if bucket == nil {
+		return
+	}
+
+	attempts := max(sshInfo.AttemptCount, 1)
+	bucket.total += attempts
+	countCredential(bucket.usernames, sshInfo.User, attempts)
+	if isPasswordAttempt(sshInfo) {
+		countCredential(bucket.passwords, sshInfo.Password, attempts)
+		countCredential(bucket.pairs, sshInfo.User+":"+sshInfo.Password, attempts)
+	}
+}
+
+func countCredential(counts map[string]int, value string, attempts int) {
+	if _, found := counts[value]; found || len(counts) < maxCredentialKeysPerBucket {
+		counts[value] += attempts
+	}
+}
+
+// bucket returns the bucket for timestamp, recycling the slot of a bucket
+// that fell out of the day window. Timestamps older than a day are ignored.
+func (s *CredentialStats) bucket(timestamp time.Time) *credentialBucket {
+	start := timestamp.Truncate(credentialBucketSize)
+	if time.Since(start) >= 24*time.Hour {
+		return nil
+	}
+
+	slot := int(start.Unix()/int64(credentialBucketSize/time.Second)) % credentialBuckets
+	bucket := s.buckets[slot]
+	if bucket == nil || !bucket.start.Equal(start) {
+		bucket = &credentialBucket{
+			start:     start,
+			usernames: map[string]int{},
+			passwords: map[string]int{},
+			pairs:     map[string]int{},
+		}
+		s.buckets[slot] = bucket
+	}
+
+	return bucket
+}
+
+// Summary returns the top usernames, passwords and pairs over window.
+func (s *CredentialStats) Summary(name string, window time.Duration) CredentialSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usernames := map[string]int{}
+	passwords := map[string]int{}
+	pairs := map[string]int{}
+	summary := CredentialSummary{Window: name}
+
+	since := time.Now().Add(-window)
+	for _, bucket := range s.buckets {
+		if bucket == nil || bucket.start.Add(credentialBucketSize).Before(since) {
+			continue
+		}
+
+		summary.Total += bucket.total
+		mergeCounts(usernames, bucket.usernames)
+		mergeCounts(passwords, bucket.passwords)
+		mergeCounts(pairs, bucket.pairs)
+	}
+
+	summary.Usernames = topCounts(usernames, s.topN)
+	summary.Passwords = topCounts(passwords, s.topN)
+	summary.Pairs = topCounts(pairs, s.topN)
+
+	return summary
+}
+
+// Summaries returns the summary of every supported window.
+func (s *CredentialStats) Summaries() []CredentialSummary {
+	return []CredentialSummary{
+		s.Summary("1h", time.Hour),
+		s.Summary("24h", 24*time.Hour),
+	}
+}
+
+func mergeCounts(into map[string]int, from map[string]int) {
+	for value, count := range from {
+		into[value] += count
+	}
+}
+
+func topCounts(counts map[string]int, n int) []CredentialCount {
+	top := make([]CredentialCount, 0, len(counts))
+	for value, count := range counts {
+		top = append(top, CredentialCount{Value: value, Count: count})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Value < top[j].Value
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+// Points renders the current summaries as InfluxDB points, one per ranked
+// value, so dashboards can chart the top credentials without group-bys over
+// the raw events.
+func (s *CredentialStats) Points(now time.Time) []*write.Point {
+	var points []*write.Point
+
+	for _, summary := range s.Summaries() {
+		points = append(points, influxdb2.NewPointWithMeasurement("credential_stats").
+			AddTag("window", summary.Window).
+			AddTag("kind", "total").
+			AddField("count", summary.Total).
+			SetTime(now))
+
+		for kind, counts := range map[string][]CredentialCount{
+			"username": summary.Usernames,
+			"password": summary.Passwords,
+			"pair":     summary.Pairs,
+		} {
+			for rank, count := range counts {
+				points = append(points, influxdb2.NewPointWithMeasurement("credential_stats").
+					AddTag("window", summary.Window).
+					AddTag("kind", kind).
+					AddTag("rank", fmt.Sprintf("%02d", rank+1)).
+					AddField("value", count.Value).
+					AddField("count", count.Count).
+					SetTime(now))
+			}
+		}
+	}
+
+	return points
+}
+
+// writeCredentialStats periodically writes the credential summaries to
+// InfluxDB.
+func writeCredentialStats(stats *CredentialStats, writeAPI InfluxdbWriteAPI, interval time.Duration, tracer trace.Tracer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		ctx, span := tracer.Start(
+			context.Background(),
+			"writeCredentialStats")
+
+		err := writeAPI.WriteAPIBlocking.WritePoint(ctx, stats.Points(now)...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.ErrorContext(ctx, "Failed to write credential statistics", "error", err)
+		} else {
+			span.SetStatus(codes.Ok, "Wrote credential statistics")
+		}
+		span.End()
+	}
+}
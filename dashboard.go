@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// Dashboard serves a web UI over the API: an attack map, recent credentials,
+// top source countries and ASes, and the sessions in progress. The API is
+// served alongside it, so the page only needs the one address.
+type Dashboard struct {
+	handler http.Handler
+	mu      sync.Mutex
+	server  *http.Server
+}
+
+func NewDashboard(api *API) *Dashboard {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", api.mux)
+	mux.Handle("/events", api.mux)
+	mux.Handle("/", http.FileServer(http.FS(files)))
+
+	return &Dashboard{handler: mux}
+}
+
+// ListenAndServe serves the dashboard on addr.
+func (d *Dashboard) ListenAndServe(addr string) error {
+	server := newHTTPServer(addr, d.handler)
+	d.mu.Lock()
+	d.server = server
+	d.mu.Unlock()
+
+	slog.Info("Starting dashboard server", "addr", addr)
+	return server.ListenAndServe()
+}
+
+// Shutdown stops the dashboard server, letting in-flight requests finish
+// until ctx is done.
+func (d *Dashboard) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	server := d.server
+	d.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
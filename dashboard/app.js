@@ -0,0 +1,140 @@
+"use strict";
+
+// With API_TOKEN set, open the dashboard as /#token=<token>.
+const token = new URLSearchParams(location.hash.slice(1)).get("token");
+const refreshInterval = 5000;
+
+async function api(path) {
+  const headers = token ? { Authorization: "Bearer " + token } : {};
+  const response = await fetch(path, { headers });
+  if (!response.ok) {
+    throw new Error(path + ": " + response.status + " " + response.statusText);
+  }
+  return response.json();
+}
+
+function cell(text, className) {
+  const td = document.createElement("td");
+  td.textContent = text === undefined || text === null ? "" : String(text);
+  td.title = td.textContent;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function fillTable(id, rows, columns) {
+  const body = document.querySelector("#" + id + " tbody");
+  body.replaceChildren();
+  if (rows.length === 0) {
+    const tr = document.createElement("tr");
+    const td = cell("Nothing yet", "empty");
+    td.colSpan = columns;
+    tr.append(td);
+    body.append(tr);
+    return;
+  }
+  for (const row of rows) {
+    const tr = document.createElement("tr");
+    tr.append(...row);
+    body.append(tr);
+  }
+}
+
+function since(timestamp) {
+  const seconds = Math.max(0, Math.round((Date.now() - new Date(timestamp)) / 1000));
+  if (seconds < 60) {
+    return seconds + "s";
+  }
+  if (seconds < 3600) {
+    return Math.floor(seconds / 60) + "m " + (seconds % 60) + "s";
+  }
+  return Math.floor(seconds / 3600) + "h " + Math.floor((seconds % 3600) / 60) + "m";
+}
+
+function time(timestamp) {
+  return new Date(timestamp).toLocaleTimeString();
+}
+
+function drawMap(cells) {
+  const canvas = document.getElementById("map");
+  const context = canvas.getContext("2d");
+  const { width, height } = canvas;
+  const x = (longitude) => ((longitude + 180) / 360) * width;
+  const y = (latitude) => ((90 - latitude) / 180) * height;
+
+  context.clearRect(0, 0, width, height);
+
+  context.strokeStyle = "#2a3242";
+  context.lineWidth = 1;
+  for (let longitude = -180; longitude <= 180; longitude += 30) {
+    context.beginPath();
+    context.moveTo(x(longitude), 0);
+    context.lineTo(x(longitude), height);
+    context.stroke();
+  }
+  for (let latitude = -90; latitude <= 90; latitude += 30) {
+    context.beginPath();
+    context.moveTo(0, y(latitude));
+    context.lineTo(width, y(latitude));
+    context.stroke();
+  }
+
+  context.fillStyle = "#273041";
+  for (const ring of WORLD) {
+    context.beginPath();
+    ring.forEach(([longitude, latitude], i) => {
+      if (i === 0) {
+        context.moveTo(x(longitude), y(latitude));
+      } else {
+        context.lineTo(x(longitude), y(latitude));
+      }
+    });
+    context.closePath();
+    context.fill();
+  }
+
+  const max = Math.max(1, ...cells.map((c) => c.count));
+  context.fillStyle = "rgba(229, 83, 75, 0.55)";
+  context.strokeStyle = "#e5534b";
+  for (const c of cells) {
+    const radius = 3 + 17 * Math.sqrt(c.count / max);
+    context.beginPath();
+    context.arc(x(c.longitude), y(c.latitude), radius, 0, 2 * Math.PI);
+    context.fill();
+    context.stroke();
+  }
+}
+
+async function refresh() {
+  const status = document.getElementById("status");
+  try {
+    const [cells, sessions, events, countries, asns] = await Promise.all([
+      api("/api/geohashes"),
+      api("/api/sessions"),
+      api("/api/events?limit=200"),
+      api("/api/countries"),
+      api("/api/asns"),
+    ]);
+
+    drawMap(cells);
+    fillTable("sessions", sessions.map((s) => [
+      cell(s.remote_host), cell(s.user), cell(s.kind), cell(s.command), cell(since(s.started)),
+    ]), 5);
+    const credentials = events.filter((e) => e.function === "password" || e.function === "keyboard_interactive");
+    fillTable("credentials", credentials.slice(0, 50).map((e) => [
+      cell(time(e["@timestamp"])), cell(e.remote_host), cell(e.country), cell(e.user), cell(e.password),
+    ]), 5);
+    fillTable("countries", countries.slice(0, 20).map((c) => [cell(c.name), cell(c.events, "count")]), 2);
+    fillTable("asns", asns.slice(0, 20).map((c) => [cell(c.name), cell(c.events, "count")]), 2);
+
+    status.className = "";
+    status.textContent = "Updated " + new Date().toLocaleTimeString();
+  } catch (error) {
+    status.className = "error";
+    status.textContent = error.message;
+  }
+}
+
+refresh();
+setInterval(refresh, refreshInterval);
@@ -0,0 +1,51 @@
+// Coarse outlines of the continents as [longitude, latitude] rings, enough to
+// place the attack map's points.
+const WORLD = [
+  // North America
+  [[-168, 66], [-162, 70], [-141, 70], [-125, 70], [-95, 72], [-80, 73], [-62, 66], [-56, 52], [-66, 45],
+    [-70, 41], [-76, 35], [-81, 31], [-80, 25], [-82, 28], [-90, 30], [-97, 27], [-97, 21], [-90, 21], [-87, 15],
+    [-83, 9], [-78, 8], [-80, 7], [-86, 11], [-92, 15], [-105, 20], [-110, 24], [-115, 30], [-117, 33], [-123, 38],
+    [-124, 47], [-130, 55], [-140, 60], [-152, 59], [-165, 55], [-158, 59], [-166, 62]],
+  // Greenland
+  [[-52, 60], [-44, 60], [-22, 70], [-18, 77], [-30, 83], [-60, 82], [-72, 78], [-56, 72]],
+  // South America
+  [[-78, 8], [-72, 12], [-62, 10], [-52, 5], [-44, -2], [-35, -6], [-39, -14], [-41, -22], [-48, -26], [-53, -34],
+    [-58, -38], [-65, -42], [-66, -48], [-69, -52], [-72, -54], [-75, -48], [-73, -38], [-71, -28], [-70, -18],
+    [-76, -14], [-81, -6], [-80, 0], [-77, 4]],
+  // Europe
+  [[-10, 36], [-9, 43], [-2, 44], [-5, 48], [2, 51], [8, 54], [8, 57], [11, 59], [5, 62], [14, 68], [25, 71],
+    [41, 67], [31, 62], [23, 60], [21, 55], [12, 54], [19, 55], [28, 57], [40, 47], [29, 41], [26, 38], [23, 36],
+    [20, 40], [16, 38], [12, 44], [8, 44], [3, 43], [-2, 37]],
+  // Great Britain and Ireland
+  [[-5, 50], [1, 51], [2, 53], [-2, 56], [-2, 58], [-6, 58], [-5, 55], [-3, 54], [-5, 52]],
+  [[-10, 52], [-6, 52], [-6, 55], [-8, 55], [-10, 54]],
+  // Africa
+  [[-17, 21], [-10, 30], [-6, 36], [10, 37], [11, 33], [20, 31], [32, 31], [35, 28], [43, 12], [51, 12], [45, 2],
+    [40, -3], [40, -11], [35, -24], [32, -29], [27, -34], [18, -35], [15, -27], [12, -17], [13, -6], [9, -1],
+    [9, 4], [4, 6], [-8, 4], [-13, 8], [-17, 14]],
+  // Madagascar
+  [[44, -25], [47, -25], [50, -15], [49, -12], [44, -17]],
+  // Asia
+  [[26, 40], [36, 36], [35, 31], [43, 13], [52, 17], [57, 22], [50, 30], [57, 26], [67, 25], [73, 20], [77, 8],
+    [80, 15], [88, 22], [92, 22], [98, 16], [104, 1], [104, 10], [109, 12], [106, 20], [110, 21], [117, 24],
+    [122, 30], [121, 37], [119, 39], [126, 37], [129, 35], [129, 42], [135, 43], [141, 48], [141, 53], [137, 54],
+    [156, 51], [160, 55], [163, 60], [178, 62], [180, 65], [180, 69], [160, 70], [140, 72], [113, 74], [104, 78],
+    [90, 76], [80, 73], [68, 69], [60, 69], [45, 68], [41, 67], [31, 62], [28, 57], [40, 47], [29, 41]],
+  // Japan
+  [[130, 31], [135, 34], [140, 35], [142, 40], [140, 41], [138, 38], [133, 35], [130, 34]],
+  [[140, 42], [145, 43], [145, 45], [142, 46], [140, 43]],
+  // Indonesia and Philippines
+  [[95, 5], [106, -3], [106, -6], [115, -8], [110, -8], [105, -6], [100, -1]],
+  [[109, 1], [117, 7], [119, 5], [117, -1], [114, -4], [110, -3]],
+  [[119, -1], [125, 1], [121, -5]],
+  [[131, -1], [141, -3], [150, -6], [147, -10], [141, -9], [137, -5]],
+  [[120, 18], [122, 18], [124, 14], [126, 7], [122, 7], [121, 12]],
+  // Australia
+  [[114, -22], [122, -18], [129, -15], [136, -12], [137, -16], [142, -11], [146, -19], [153, -26], [151, -34],
+    [146, -39], [140, -38], [135, -35], [131, -31], [124, -34], [115, -34]],
+  // New Zealand
+  [[172, -35], [178, -38], [175, -41], [168, -46], [167, -45], [174, -40]],
+  // Antarctica
+  [[-180, -72], [-120, -74], [-60, -64], [-30, -78], [0, -70], [60, -67], [120, -66], [180, -70], [180, -90],
+    [-180, -90]],
+];
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// debugHandler serves the net/http/pprof profiles. They are registered on a
+// mux of their own rather than the default one, which the imported packages
+// could add handlers to.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// debugListener serves the profiles on the loopback interface only, as they
+// give away the internals of the process and profiling costs CPU.
+func debugListener(port string) Listener {
+	server := newHTTPServer("127.0.0.1:"+port, debugHandler())
+	return Listener{
+		Serve:    server.ListenAndServe,
+		Shutdown: server.Shutdown,
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// dedupKey identifies the attempts collapsed together.
+type dedupKey struct {
+	remoteHost string
+	protocol   string
+	function   string
+	user       string
+	password   string
+}
+
+// heldAttempt is the first of the attempts of a key, counting those repeating
+// it until it expires.
+type heldAttempt struct {
+	sshInfo SSHInfo
+	expires time.Time
+}
+
+// Deduper collapses the identical failed attempts a source repeats within a
+// window into the first one, held until the window is over and then carrying
+// their number in AttemptCount. It is only used by the normalize stage, so
+// needs no locking.
+type Deduper struct {
+	window  time.Duration
+	maxHeld int
+	held    map[dedupKey]*heldAttempt
+}
+
+// NewDeduper returns nil for a window of 0, attempts being passed on as they
+// are. Past maxHeld held attempts, new ones are passed on right away.
+func NewDeduper(window time.Duration, maxHeld int) *Deduper {
+	if window <= 0 {
+		return nil
+	}
+
+	return &Deduper{window: window, maxHeld: maxHeld, held: map[dedupKey]*heldAttempt{}}
+}
+
+// Hold reports whether sshInfo is held, either as the first of its key or
+// counted as a repeat of it, rather than to be passed on.
+func (d *Deduper) Hold(sshInfo SSHInfo) bool {
+	if !isPasswordAttempt(sshInfo) || sshInfo.Accepted {
+		return false
+	}
+
+	key := dedupKey{sshInfo.RemoteHost, sshInfo.Protocol, sshInfo.Function, sshInfo.User, sshInfo.Password}
+	if held, ok := d.held[key]; ok {
+		held.sshInfo.AttemptCount++
+		metrics.RecordDedup()
+		return true
+	}
+	if len(d.held) >= d.maxHeld {
+		return false
+	}
+
+	sshInfo.AttemptCount = 1
+	d.held[key] = &heldAttempt{sshInfo: sshInfo, expires: time.Now().Add(d.window)}
+	return true
+}
+
+// Expired returns the held attempts whose window is over at now, oldest
+// first, forgetting them.
+func (d *Deduper) Expired(now time.Time) []SSHInfo {
+	var expired []SSHInfo
+	for key, held := range d.held {
+		if !now.Before(held.expires) {
+			expired = append(expired, held.sshInfo)
+			delete(d.held, key)
+		}
+	}
+	slices.SortFunc(expired, func(a, b SSHInfo) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	return expired
+}
+
+// Flush returns every held attempt, oldest first, as the pipeline closes.
+func (d *Deduper) Flush() []SSHInfo {
+	return d.Expired(time.Now().Add(d.window))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxDigestAlerts bounds how many individual alerts are listed in a digest;
+// the summary still counts every alert of the period.
+const maxDigestAlerts = 50
+
+// DigestNotifier collects alerts and hands them to the wrapped notifier as a
+// single digest alert once per interval. Immediate alerts are passed on
+// right away.
+type DigestNotifier struct {
+	inner    Notifier
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	pending []Alert
+	total   int
+}
+
+func NewDigestNotifier(inner Notifier, interval time.Duration) *DigestNotifier {
+	n := &DigestNotifier{
+		inner:    inner,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go n.run()
+
+	return n
+}
+
+func (n *DigestNotifier) Name() string {
+	return n.inner.Name() + "_digest"
+}
+
+func (n *DigestNotifier) Notify(ctx context.Context, alert Alert) error {
+	if alert.Immediate {
+		return n.inner.Notify(ctx, alert)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.total++
+	if len(n.pending) < maxDigestAlerts {
+		n.pending = append(n.pending, alert)
+	}
+
+	return nil
+}
+
+func (n *DigestNotifier) run() {
+	defer close(n.done)
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			if err := n.flush(); err != nil {
+				slog.Error("Failed to send digest", "notifier", n.Name(), "error", err)
+			}
+		}
+	}
+}
+
+// Close stops the periodic digests and sends the alerts still pending.
+func (n *DigestNotifier) Close() error {
+	close(n.stop)
+	<-n.done
+
+	return n.flush()
+}
+
+func (n *DigestNotifier) flush() error {
+	n.mu.Lock()
+	pending, total := n.pending, n.total
+	n.pending, n.total = nil, 0
+	n.mu.Unlock()
+
+	if total == 0 {
+		return nil
+	}
+
+	severity := SeverityInfo
+	for _, alert := range pending {
+		if severityRank(alert.Severity) > severityRank(severity) {
+			severity = alert.Severity
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return n.inner.Notify(ctx, Alert{
+		Rule:      "digest",
+		Severity:  severity,
+		Summary:   fmt.Sprintf("%d alerts in the last %s", total, n.interval),
+		Digest:    pending,
+		Timestamp: time.Now(),
+	})
+}
+
+func severityRank(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return 2
+	case SeverityWarning:
+		return 1
+	default:
+		return 0
+	}
+}
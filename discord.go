@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"text/template"
+)
+
+const defaultDiscordTemplate = `{{if .Digest}}:clipboard: **{{discord .Summary}}**
+{{range .Digest}}• {{discord .Summary}}
+{{end}}{{else}}:rotating_light: **{{discord .Summary}}** ({{.Rule}}, {{.Severity}})
+**IP:** {{discord .Event.SSHInfo.RemoteHost}}{{with .Event.IPInfo}}{{if .Country}} — {{discord .City}}, {{discord .Region}}, {{discord .Country}}{{end}}{{if .Org}} ({{discord .Org}}){{end}}{{end}}
+**Method:** {{.Event.SSHInfo.Function}}  **User:** ` + "`{{code .Event.SSHInfo.User}}`" + `{{if .Event.SSHInfo.Password}}  **Password:** ` + "`{{code .Event.SSHInfo.Password}}`" + `{{end}}{{if .Event.SSHInfo.KeyType}}  **Key:** {{.Event.SSHInfo.KeyType}}{{end}}
+**Client:** {{discord .Event.SSHInfo.ClientVersion}}{{if .DashboardURL}}
+<{{.DashboardURL}}>{{end}}{{end}}`
+
+// Discord rejects messages longer than this.
+const maxDiscordContent = 2000
+
+var discordEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`, ">", `\>`)
+
+type DiscordNotifier struct {
+	webhookURL string
+	username   string
+	template   *template.Template
+}
+
+func NewDiscordNotifier(webhookURL string, username string, templateText string) (*DiscordNotifier, error) {
+	tmpl, err := parseAlertTemplate("discord", templateText, template.FuncMap{
+		"discord": discordEscaper.Replace,
+		// Backticks can't be escaped within code spans
+		"code": func(s string) string { return strings.ReplaceAll(s, "`", "'") },
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiscordNotifier{
+		webhookURL: webhookURL,
+		username:   username,
+		template:   tmpl,
+	}, nil
+}
+
+func (n *DiscordNotifier) Name() string {
+	return "discord"
+}
+
+func (n *DiscordNotifier) Notify(ctx context.Context, alert Alert) error {
+	var text bytes.Buffer
+	if err := n.template.Execute(&text, alert); err != nil {
+		return err
+	}
+
+	content := []rune(text.String())
+	if len(content) > maxDiscordContent {
+		content = append(content[:maxDiscordContent-1], '…')
+	}
+	payload := map[string]any{
+		"content": string(content),
+		// Attackers pick usernames and passwords, they must not ping anyone
+		"allowed_mentions": map[string]any{"parse": []string{}},
+	}
+	if n.username != "" {
+		payload["username"] = n.username
+	}
+
+	return postJSON(ctx, n.webhookURL, payload, nil)
+}
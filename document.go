@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventDocument is the JSON representation of an enriched event used by the
+// document oriented sinks. Field names follow the InfluxDB tags and fields so
+// queries translate between sinks.
+type EventDocument struct {
+	ID              string            `json:"-"`
+	Timestamp       time.Time         `json:"@timestamp"`
+	Function        string            `json:"function"`
+	Protocol        string            `json:"protocol,omitempty"`
+	User            string            `json:"user,omitempty"`
+	Password        string            `json:"password,omitempty"`
+	Key             string            `json:"key,omitempty"`
+	KeyType         string            `json:"key_type,omitempty"`
+	KeyFingerprint  string            `json:"key_fingerprint,omitempty"`
+	KeyMD5          string            `json:"key_md5,omitempty"`
+	KeyBits         int               `json:"key_bits,omitempty"`
+	Command         string            `json:"command,omitempty"`
+	Subsystem       string            `json:"subsystem,omitempty"`
+	AgentForwarding bool              `json:"agent_forwarding,omitempty"`
+	Env             []string          `json:"env,omitempty"`
+	Term            string            `json:"term,omitempty"`
+	TermWidth       int               `json:"term_width,omitempty"`
+	TermHeight      int               `json:"term_height,omitempty"`
+	TermModes       string            `json:"term_modes,omitempty"`
+	Keystrokes      []float64         `json:"keystroke_intervals,omitempty"`
+	X11AuthProtocol string            `json:"x11_auth_protocol,omitempty"`
+	X11AuthCookie   string            `json:"x11_auth_cookie,omitempty"`
+	X11Screen       string            `json:"x11_screen,omitempty"`
+	FileOperation   string            `json:"file_operation,omitempty"`
+	Path            string            `json:"path,omitempty"`
+	FileSize        int64             `json:"file_size,omitempty"`
+	FileSHA256      string            `json:"file_sha256,omitempty"`
+	SampleDuplicate bool              `json:"sample_duplicate,omitempty"`
+	SampleDropped   bool              `json:"sample_dropped,omitempty"`
+	YaraMatches     []string          `json:"yara_matches,omitempty"`
+	URL             string            `json:"url,omitempty"`
+	HTTPMethod      string            `json:"http_method,omitempty"`
+	UserAgent       string            `json:"user_agent,omitempty"`
+	ForwardHost     string            `json:"forward_host,omitempty"`
+	ForwardPort     string            `json:"forward_port,omitempty"`
+	RemoteHost      string            `json:"remote_host"`
+	RemotePort      string            `json:"remote_port,omitempty"`
+	LocalHost       string            `json:"local_host,omitempty"`
+	LocalPort       string            `json:"local_port,omitempty"`
+	ClientVersion   string            `json:"client_version,omitempty"`
+	HASSH           string            `json:"hassh,omitempty"`
+	SessionID       string            `json:"session_id,omitempty"`
+	Anomaly         string            `json:"anomaly,omitempty"`
+	Policy          string            `json:"policy,omitempty"`
+	AnomalyDetail   string            `json:"anomaly_detail,omitempty"`
+	Attempt         int               `json:"attempt,omitempty"`
+	AttemptCount    int               `json:"attempt_count,omitempty"`
+	SprayUsernames  int               `json:"spray_usernames,omitempty"`
+	SprayPorts      int               `json:"spray_ports,omitempty"`
+	Canarytoken     string            `json:"canarytoken,omitempty"`
+	Accepted        bool              `json:"accepted,omitempty"`
+	NodeID          string            `json:"node_id,omitempty"`
+	NodeRegion      string            `json:"node_region,omitempty"`
+	NodeDeployment  string            `json:"node_deployment,omitempty"`
+	City            string            `json:"city,omitempty"`
+	Region          string            `json:"region,omitempty"`
+	Country         string            `json:"country,omitempty"`
+	Org             string            `json:"org,omitempty"`
+	Timezone        string            `json:"timezone,omitempty"`
+	Location        *DocumentLocation `json:"location,omitempty"`
+	Tool            string            `json:"tool,omitempty"`
+	ToolCategory    string            `json:"tool_category,omitempty"`
+	HumanLikelihood *float64          `json:"human_likelihood,omitempty"`
+	BannerDelay     *float64          `json:"banner_delay,omitempty"`
+	Duration        *float64          `json:"duration,omitempty"`
+	Channels        int               `json:"channels,omitempty"`
+	BytesIn         *int64            `json:"bytes_in,omitempty"`
+	BytesOut        *int64            `json:"bytes_out,omitempty"`
+	KeySourceIPs    int               `json:"key_source_ips,omitempty"`
+	KeyCampaign     string            `json:"key_campaign,omitempty"`
+	Campaign        string            `json:"campaign,omitempty"`
+	PasswordPattern string            `json:"password_pattern,omitempty"`
+	PasswordEntropy *float64          `json:"password_entropy,omitempty"`
+	Techniques      []string          `json:"techniques,omitempty"`
+	AttackPattern   string            `json:"attack_pattern,omitempty"`
+	SourceClass     string            `json:"source_class,omitempty"`
+	NewAttacker     bool              `json:"new_attacker,omitempty"`
+	Wordlist        string            `json:"wordlist,omitempty"`
+	AbuseConfidence *int              `json:"abuse_confidence,omitempty"`
+	AbuseReports    *int              `json:"abuse_reports,omitempty"`
+	AbuseLastReport *time.Time        `json:"abuse_last_reported,omitempty"`
+	GreyNoiseClass  string            `json:"greynoise_classification,omitempty"`
+	GreyNoiseActor  string            `json:"greynoise_actor,omitempty"`
+	VTMalicious     *int              `json:"vt_malicious,omitempty"`
+	VTSuspicious    *int              `json:"vt_suspicious,omitempty"`
+	VTHarmless      *int              `json:"vt_harmless,omitempty"`
+	VTUndetected    *int              `json:"vt_undetected,omitempty"`
+	VTVotesMal      *int              `json:"vt_votes_malicious,omitempty"`
+	VTVotesHarmless *int              `json:"vt_votes_harmless,omitempty"`
+	VTLastAnalysis  *time.Time        `json:"vt_last_analysis,omitempty"`
+	DNSBL           []string          `json:"dnsbl,omitempty"`
+}
+
+// DocumentLocation is laid out as an Elasticsearch geo_point.
+type DocumentLocation struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func newEventDocument(event Event) EventDocument {
+	sshInfo := event.SSHInfo
+	ipInfo := event.IPInfo
+	analysis := event.Analysis
+
+	document := EventDocument{
+		ID:              eventID(sshInfo),
+		Timestamp:       sshInfo.Timestamp.UTC(),
+		Function:        sshInfo.Function,
+		Protocol:        sshInfo.Protocol,
+		User:            sshInfo.User,
+		Password:        sshInfo.Password,
+		Key:             sshInfo.Key,
+		KeyType:         sshInfo.KeyType,
+		KeyFingerprint:  sshInfo.KeyFingerprint,
+		KeyMD5:          sshInfo.KeyMD5,
+		KeyBits:         sshInfo.KeyBits,
+		Command:         sshInfo.Command,
+		Subsystem:       sshInfo.Subsystem,
+		AgentForwarding: sshInfo.AgentForwarding,
+		Env:             sshInfo.Env,
+		Term:            sshInfo.Term,
+		TermWidth:       sshInfo.TermWidth,
+		TermHeight:      sshInfo.TermHeight,
+		TermModes:       sshInfo.TermModes,
+		X11AuthProtocol: sshInfo.X11AuthProtocol,
+		X11AuthCookie:   sshInfo.X11AuthCookie,
+		X11Screen:       sshInfo.X11Screen,
+		FileOperation:   sshInfo.FileOperation,
+		Path:            sshInfo.Path,
+		FileSize:        sshInfo.FileSize,
+		FileSHA256:      sshInfo.FileSHA256,
+		SampleDuplicate: sshInfo.SampleDuplicate,
+		SampleDropped:   sshInfo.SampleDropped,
+		YaraMatches:     sshInfo.YaraMatches,
+		URL:             sshInfo.URL,
+		HTTPMethod:      sshInfo.HTTPMethod,
+		UserAgent:       sshInfo.UserAgent,
+		ForwardHost:     sshInfo.ForwardHost,
+		ForwardPort:     sshInfo.ForwardPort,
+		RemoteHost:      sshInfo.RemoteHost,
+		RemotePort:      sshInfo.RemotePort,
+		LocalHost:       sshInfo.LocalHost,
+		LocalPort:       sshInfo.LocalPort,
+		ClientVersion:   sshInfo.ClientVersion,
+		HASSH:           sshInfo.HASSH,
+		SessionID:       sshInfo.SessionID,
+		Anomaly:         sshInfo.Anomaly,
+		Policy:          sshInfo.Policy,
+		AnomalyDetail:   sshInfo.AnomalyDetail,
+		Attempt:         sshInfo.Attempt,
+		AttemptCount:    sshInfo.AttemptCount,
+		SprayUsernames:  sshInfo.SprayUsernames,
+		SprayPorts:      sshInfo.SprayPorts,
+		Canarytoken:     sshInfo.Canarytoken,
+		Accepted:        sshInfo.Accepted,
+		NodeID:          sshInfo.Node.ID,
+		NodeRegion:      sshInfo.Node.Region,
+		NodeDeployment:  sshInfo.Node.Deployment,
+		City:            ipInfo.City,
+		Region:          ipInfo.Region,
+		Country:         ipInfo.Country,
+		Org:             ipInfo.Org,
+		Timezone:        ipInfo.Timezone,
+		Tool:            analysis.Tool,
+		ToolCategory:    analysis.ToolCategory,
+		HumanLikelihood: analysis.HumanLikelihood,
+		KeySourceIPs:    analysis.KeySourceIPs,
+		KeyCampaign:     analysis.KeyCampaign,
+		Campaign:        analysis.Campaign,
+		PasswordPattern: analysis.PasswordPattern,
+		PasswordEntropy: analysis.PasswordEntropy,
+		AttackPattern:   analysis.AttackPattern,
+		SourceClass:     analysis.SourceClass,
+		NewAttacker:     analysis.NewAttacker,
+		Wordlist:        analysis.Wordlist,
+	}
+	if ipInfo.Latitude != 0 || ipInfo.Longitude != 0 {
+		document.Location = &DocumentLocation{Lat: ipInfo.Latitude, Lon: ipInfo.Longitude}
+	}
+	if sshInfo.Duration > 0 {
+		seconds := sshInfo.Duration.Seconds()
+		document.Duration = &seconds
+	}
+	if sshInfo.Channels > 0 {
+		document.Channels = sshInfo.Channels
+		document.BytesIn, document.BytesOut = &sshInfo.BytesIn, &sshInfo.BytesOut
+	}
+	if delay := sshInfo.Signals.BannerDelay; delay > 0 {
+		seconds := delay.Seconds()
+		document.BannerDelay = &seconds
+	}
+	for _, interval := range sshInfo.KeystrokeIntervals {
+		document.Keystrokes = append(document.Keystrokes, interval.Seconds())
+	}
+	if analysis.Techniques != "" {
+		document.Techniques = strings.Split(analysis.Techniques, ",")
+	}
+	if analysis.DNSBL != "" {
+		document.DNSBL = strings.Split(analysis.DNSBL, ",")
+	}
+	if abuse := analysis.Abuse; abuse != nil {
+		document.AbuseConfidence = &abuse.AbuseConfidenceScore
+		document.AbuseReports = &abuse.TotalReports
+		document.AbuseLastReport = abuse.LastReportedAt
+	}
+	if greyNoise := analysis.GreyNoise; greyNoise != nil {
+		document.GreyNoiseClass = greyNoise.Classification
+		document.GreyNoiseActor = greyNoise.Actor
+	}
+	if virusTotal := analysis.VirusTotal; virusTotal != nil {
+		document.VTMalicious = &virusTotal.Malicious
+		document.VTSuspicious = &virusTotal.Suspicious
+		document.VTHarmless = &virusTotal.Harmless
+		document.VTUndetected = &virusTotal.Undetected
+		document.VTVotesMal = &virusTotal.VotesMalicious
+		document.VTVotesHarmless = &virusTotal.VotesHarmless
+		document.VTLastAnalysis = virusTotal.LastAnalysis
+	}
+
+	return document
+}
+
+// eventID identifies an event by when, where from and what it was, so
+// writing it again, as retries do, replaces it instead of duplicating it.
+func eventID(sshInfo SSHInfo) string {
+	hash := sha256.New()
+	for _, part := range []string{
+		strconv.FormatInt(sshInfo.Timestamp.UnixNano(), 10),
+		sshInfo.Node.ID,
+		sshInfo.RemoteHost,
+		sshInfo.RemotePort,
+		sshInfo.Function,
+		strconv.Itoa(sshInfo.Attempt),
+	} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errPayloadTooLarge is returned for payloads over the maximum size, which
+// aren't kept.
+var errPayloadTooLarge = errors.New("payload too large")
+
+// Payload is a file fetched on behalf of an attacker.
+type Payload struct {
+	Data   []byte
+	SHA256 string
+}
+
+// Downloader fetches the payloads attackers try to download from the shell,
+// e.g. with wget or curl, to be kept in the sample store. Without a proxy,
+// requests to private and loopback addresses are refused, so the honeypot
+// can't be used to reach the network it runs in.
+type Downloader struct {
+	maxSize int64
+	client  *http.Client
+	tracer  trace.Tracer
+}
+
+func NewDownloader(proxy *url.URL, maxSize int64, timeout time.Duration, tracer trace.Tracer) (*Downloader, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	} else {
+		transport.Proxy = nil
+		transport.DialContext = (&net.Dialer{Timeout: timeout, Control: publicAddressOnly}).DialContext
+	}
+
+	return &Downloader{
+		maxSize: maxSize,
+		client:  &http.Client{Timeout: timeout, Transport: transport},
+		tracer:  tracer,
+	}, nil
+}
+
+// downloaderFromEnv returns nil unless DOWNLOAD_FETCH is set, the URLs being
+// only recorded then.
+func downloaderFromEnv(tracer trace.Tracer) (*Downloader, error) {
+	if os.Getenv("DOWNLOAD_FETCH") != "true" {
+		return nil, nil
+	}
+
+	var proxy *url.URL
+	if value := os.Getenv("DOWNLOAD_PROXY"); value != "" {
+		var err error
+		if proxy, err = url.Parse(value); err != nil {
+			return nil, fmt.Errorf("invalid DOWNLOAD_PROXY: %v", err)
+		}
+	}
+
+	return NewDownloader(proxy, int64(getEnvInt("DOWNLOAD_MAX_SIZE", 10<<20)),
+		getEnvDuration("DOWNLOAD_TIMEOUT", 30*time.Second), tracer)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// net.IP.IsPrivate leaves out although it is just as internal to the
+// networks using it, e.g. cloud VPCs and overlay networks.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicAddressOnly refuses connections to addresses the honeypot could
+// reach but attackers shouldn't.
+func publicAddressOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("refusing to connect to %s", host)
+	}
+
+	return nil
+}
+
+// Fetch downloads rawURL with the User-Agent of the tool the attacker ran.
+func (d *Downloader) Fetch(ctx context.Context, rawURL string, userAgent string) (*Payload, error) {
+	ctx, span := d.tracer.Start(ctx, "fetchPayload", trace.WithAttributes(attribute.String("url", rawURL)))
+	defer span.End()
+
+	payload, err := d.fetch(ctx, rawURL, userAgent)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.String("sha256", payload.SHA256), attribute.Int("size", len(payload.Data)))
+	span.SetStatus(codes.Ok, "Payload fetched")
+	return payload, nil
+}
+
+func (d *Downloader) fetch(ctx context.Context, rawURL string, userAgent string) (*Payload, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, d.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > d.maxSize {
+		return nil, errPayloadTooLarge
+	}
+
+	sum := sha256.Sum256(data)
+	return &Payload{Data: data, SHA256: hex.EncodeToString(sum[:])}, nil
+}
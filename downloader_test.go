@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestPublicAddressOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		refused bool
+	}{
+		{"203.0.113.7:80", false},
+		{"100.63.255.255:80", false},
+		{"100.64.0.1:80", true},
+		{"100.127.255.254:80", true},
+		{"100.128.0.1:80", false},
+		{"10.0.0.1:80", true},
+		{"127.0.0.1:80", true},
+		{"169.254.169.254:80", true},
+		{"[::1]:80", true},
+		{"[fd00::1]:80", true},
+		{"[2001:db8::1]:80", false},
+	}
+	for _, test := range tests {
+		if err := publicAddressOnly("tcp", test.address, nil); (err != nil) != test.refused {
+			t.Errorf("publicAddressOnly(%s) = %v", test.address, err)
+		}
+	}
+}
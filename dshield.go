@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log lines held between two submissions, the rest being dropped until the
+// next one.
+const maxDShieldPending = 10000
+
+var dshieldChecksum = regexp.MustCompile(`<sha1checksum>([^<]+)</sha1checksum>`)
+
+// DShieldSubmitter contributes the authentication attempts seen by the
+// honeypot to the SANS Internet Storm Center DShield project, as kippo and
+// cowrie do: the attempts are collected and submitted on an interval, in the
+// DShield SSH log format, authenticated with the user ID and API key of a
+// DShield account.
+type DShieldSubmitter struct {
+	url        string
+	userID     string
+	apiKey     []byte
+	anonymizer *Anonymizer
+	client     *http.Client
+	tracer     trace.Tracer
+
+	mu      sync.Mutex
+	pending []string
+
+	submitMu sync.Mutex
+}
+
+// NewDShieldSubmitter builds a submitter for the account userID, apiKey being
+// its base64 encoded API key, as shown on the DShield account page.
+func NewDShieldSubmitter(url string, userID string, apiKey string, anonymizer *Anonymizer, tracer trace.Tracer) (*DShieldSubmitter, error) {
+	key, err := base64.StdEncoding.DecodeString(apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("DShield API key isn't base64 encoded: %v", err)
+	}
+
+	return &DShieldSubmitter{
+		url:        url,
+		userID:     userID,
+		apiKey:     key,
+		anonymizer: anonymizer,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		tracer:     tracer,
+	}, nil
+}
+
+// Observe collects the password attempts of the SSH listeners: date, time,
+// timezone, source IP, username and password, tab separated.
+func (d *DShieldSubmitter) Observe(ctx context.Context, event Event) {
+	sshInfo := d.anonymizer.Anonymize(event).SSHInfo
+	if sshInfo.Protocol != "ssh" || !isPasswordAttempt(sshInfo) {
+		return
+	}
+
+	timestamp := sshInfo.Timestamp.UTC()
+	line := strings.Join([]string{
+		timestamp.Format(time.DateOnly),
+		timestamp.Format(time.TimeOnly),
+		timestamp.Format("-0700"),
+		sshInfo.RemoteHost,
+		dshieldField(sshInfo.User),
+		dshieldField(sshInfo.Password),
+	}, "\t")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.pending) >= maxDShieldPending {
+		return
+	}
+	d.pending = append(d.pending, line)
+}
+
+// dshieldField keeps value on its column of the log line.
+func dshieldField(value string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(value)
+}
+
+// Run submits the collected attempts every interval.
+func (d *DShieldSubmitter) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.Submit(context.Background())
+	}
+}
+
+// Submit sends the collected attempts to DShield. Attempts that failed to be
+// submitted are retried next time.
+func (d *DShieldSubmitter) Submit(ctx context.Context) {
+	d.submitMu.Lock()
+	defer d.submitMu.Unlock()
+
+	d.mu.Lock()
+	lines := d.pending
+	d.pending = nil
+	d.mu.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	ctx, span := d.tracer.Start(
+		ctx,
+		"submitDShield",
+		trace.WithAttributes(attribute.Int("lines", len(lines))))
+	defer span.End()
+
+	err := d.submit(ctx, lines)
+	metrics.RecordDShieldSubmission(ctx, len(lines), err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Failed to submit to DShield", "lines", len(lines), "error", err)
+
+		d.mu.Lock()
+		d.pending = append(lines, d.pending...)
+		if len(d.pending) > maxDShieldPending {
+			d.pending = d.pending[:maxDShieldPending]
+		}
+		d.mu.Unlock()
+		return
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Submitted %d lines to DShield", len(lines)))
+	slog.DebugContext(ctx, "Submitted to DShield", "lines", len(lines))
+}
+
+func (d *DShieldSubmitter) submit(ctx context.Context, lines []string) error {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+
+	// The key itself isn't sent, only its HMAC of a nonce and the user ID
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, append(nonce, d.userID...))
+	mac.Write(d.apiKey)
+	authorization := fmt.Sprintf("credentials=%s nonce=%s userid=%s",
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)), base64.StdEncoding.EncodeToString(nonce), d.userID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-ISC-Authorization", authorization)
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	// DShield answers with the checksum of what it received
+	match := dshieldChecksum.FindSubmatch(respBody)
+	if match == nil {
+		return fmt.Errorf("unexpected response: %s", strings.TrimSpace(string(respBody)))
+	}
+	sum := sha1.Sum(body)
+	if string(match[1]) != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("checksum mismatch, DShield received %s instead of %x", match[1], sum)
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ElasticsearchSink bulk-indexes events into Elasticsearch or OpenSearch.
+// The index name may contain {date} or {month}, replaced by the day
+// (2006.01.02) or the month (2006.01) of each event, for daily or monthly
+// indices.
+type ElasticsearchSink struct {
+	url      string
+	index    string
+	username string
+	password string
+	apiKey   string
+	client   *http.Client
+	tracer   trace.Tracer
+}
+
+func NewElasticsearchSink(url string, index string, username string, password string, apiKey string, tracer trace.Tracer) *ElasticsearchSink {
+	return &ElasticsearchSink{
+		url:      strings.TrimSuffix(url, "/"),
+		index:    index,
+		username: username,
+		password: password,
+		apiKey:   apiKey,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		tracer:   tracer,
+	}
+}
+
+func elasticsearchSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	url := os.Getenv("ELASTICSEARCH_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	sink := NewElasticsearchSink(url, getEnv("ELASTICSEARCH_INDEX", "ssh-honeypot-{date}"),
+		os.Getenv("ELASTICSEARCH_USERNAME"), os.Getenv("ELASTICSEARCH_PASSWORD"), os.Getenv("ELASTICSEARCH_API_KEY"), tracer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := sink.EnsureTemplate(ctx, getEnv("ELASTICSEARCH_TEMPLATE", "ssh-honeypot")); err != nil {
+		slog.Warn("Failed to install the Elasticsearch index template", "error", err)
+	}
+
+	return sink, nil
+}
+
+func (s *ElasticsearchSink) Name() string {
+	return "elasticsearch"
+}
+
+func (s *ElasticsearchSink) indexFor(t time.Time) string {
+	t = t.UTC()
+	return strings.NewReplacer("{date}", t.Format("2006.01.02"), "{month}", t.Format("2006.01")).Replace(s.index)
+}
+
+// indexPattern matches every index the sink writes to.
+func (s *ElasticsearchSink) indexPattern() string {
+	return strings.NewReplacer("{date}", "*", "{month}", "*").Replace(s.index)
+}
+
+// EnsureTemplate installs an index template mapping the event fields, so
+// the location is a geo_point, addresses are IPs and strings are keywords
+// instead of analyzed text.
+func (s *ElasticsearchSink) EnsureTemplate(ctx context.Context, name string) error {
+	keyword := map[string]any{"type": "keyword", "ignore_above": 1024}
+	template := map[string]any{
+		"index_patterns": []string{s.indexPattern()},
+		"template": map[string]any{
+			"mappings": map[string]any{
+				"dynamic_templates": []any{
+					map[string]any{"strings": map[string]any{"match_mapping_type": "string", "mapping": keyword}},
+				},
+				"properties": map[string]any{
+					"@timestamp":  map[string]any{"type": "date"},
+					"remote_host": map[string]any{"type": "ip"},
+					"local_host":  map[string]any{"type": "ip"},
+					"location":    map[string]any{"type": "geo_point"},
+					"command":     map[string]any{"type": "text", "fields": map[string]any{"keyword": keyword}},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do(ctx, http.MethodPut, "/_index_template/"+name, "application/json", body)
+	return err
+}
+
+func (s *ElasticsearchSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToElasticsearch",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range batch.Events {
+		document := newEventDocument(event)
+		action := map[string]any{"index": map[string]string{"_index": s.indexFor(document.Timestamp), "_id": document.ID}}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+		if err := encoder.Encode(document); err != nil {
+			return err
+		}
+	}
+
+	response, err := s.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to decode bulk response: %v", err)
+	}
+
+	if result.Errors {
+		failed := 0
+		var first string
+		for _, item := range result.Items {
+			for _, status := range item {
+				if status.Error != nil {
+					failed++
+					if first == "" {
+						first = fmt.Sprintf("%s: %s", status.Error.Type, status.Error.Reason)
+					}
+				}
+			}
+		}
+		err := fmt.Errorf("%d of %d events failed to index, first: %s", failed, len(batch.Events), first)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Indexed %d events", len(batch.Events)))
+	return nil
+}
+
+// Enforce deletes the events older than before, making the sink a
+// RetentionTarget.
+func (s *ElasticsearchSink) Enforce(ctx context.Context, before time.Time) error {
+	query := map[string]any{
+		"query": map[string]any{
+			"range": map[string]any{"@timestamp": map[string]any{"lt": before.UTC().Format(time.RFC3339)}},
+		},
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do(ctx, http.MethodPost, "/"+s.indexPattern()+"/_delete_by_query?conflicts=proceed", "application/json", body)
+	return err
+}
+
+func (s *ElasticsearchSink) do(ctx context.Context, method string, path string, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case s.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	case s.username != "":
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s responded with status %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(response))
+	}
+
+	return response, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	SMTPSecurityNone     = "none"
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+)
+
+const defaultEmailSubjectTemplate = `[ssh-honeypot] {{.Summary}}`
+
+const defaultEmailTextTemplate = `{{.Summary}} ({{.Rule}}, {{.Severity}})
+{{if .Digest}}
+{{range .Digest}}- {{.Timestamp.Format "2006-01-02 15:04:05"}} {{.Summary}} ({{.Rule}}){{with .Event.SSHInfo}}{{if .RemoteHost}} from {{.RemoteHost}}{{end}}{{end}}
+{{end}}{{else}}
+IP:       {{.Event.SSHInfo.RemoteHost}}{{with .Event.IPInfo}}{{if .Country}} ({{.City}}, {{.Region}}, {{.Country}}){{end}}{{end}}
+Org:      {{.Event.IPInfo.Org}}
+Method:   {{.Event.SSHInfo.Function}}
+User:     {{.Event.SSHInfo.User}}{{if .Event.SSHInfo.Password}}
+Password: {{.Event.SSHInfo.Password}}{{end}}{{if .Event.SSHInfo.KeyType}}
+Key:      {{.Event.SSHInfo.KeyType}}{{end}}
+Client:   {{.Event.SSHInfo.ClientVersion}}
+Time:     {{.Event.SSHInfo.Timestamp.Format "2006-01-02 15:04:05 MST"}}
+{{end}}{{if .DashboardURL}}
+Dashboard: {{.DashboardURL}}
+{{end}}`
+
+const defaultEmailHTMLTemplate = `<html><body style="font-family: sans-serif">
+<h2>{{.Summary}}</h2>
+<p><i>{{.Rule}}, {{.Severity}}</i></p>
+{{if .Digest}}<ul>
+{{range .Digest}}<li>{{.Timestamp.Format "2006-01-02 15:04:05"}} {{.Summary}} <i>({{.Rule}})</i>{{with .Event.SSHInfo}}{{if .RemoteHost}} from <code>{{.RemoteHost}}</code>{{end}}{{end}}</li>
+{{end}}</ul>
+{{else}}<table cellpadding="4">
+<tr><th align="left">IP</th><td><code>{{.Event.SSHInfo.RemoteHost}}</code>{{with .Event.IPInfo}}{{if .Country}} ({{.City}}, {{.Region}}, {{.Country}}){{end}}{{end}}</td></tr>
+<tr><th align="left">Org</th><td>{{.Event.IPInfo.Org}}</td></tr>
+<tr><th align="left">Method</th><td>{{.Event.SSHInfo.Function}}</td></tr>
+<tr><th align="left">User</th><td><code>{{.Event.SSHInfo.User}}</code></td></tr>
+{{if .Event.SSHInfo.Password}}<tr><th align="left">Password</th><td><code>{{.Event.SSHInfo.Password}}</code></td></tr>
+{{end}}{{if .Event.SSHInfo.KeyType}}<tr><th align="left">Key</th><td>{{.Event.SSHInfo.KeyType}}</td></tr>
+{{end}}<tr><th align="left">Client</th><td>{{.Event.SSHInfo.ClientVersion}}</td></tr>
+<tr><th align="left">Time</th><td>{{.Event.SSHInfo.Timestamp.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+</table>
+{{end}}{{if .DashboardURL}}<p><a href="{{.DashboardURL}}">Open dashboard</a></p>{{end}}
+</body></html>`
+
+// SMTPServer is the server, and the account on it, mail is sent through.
+type SMTPServer struct {
+	Host     string
+	Port     string
+	Security string
+	Username string
+	Password string
+}
+
+type EmailNotifier struct {
+	server SMTPServer
+	from   string
+	to     []string
+
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// EmailTemplates holds the template texts used to render an email alert.
+type EmailTemplates struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+func NewEmailNotifier(host string, port string, security string, username string, password string, from string, to []string, templates EmailTemplates) (*EmailNotifier, error) {
+	switch security {
+	case SMTPSecurityNone, SMTPSecurityStartTLS, SMTPSecurityTLS:
+	default:
+		return nil, fmt.Errorf("unknown SMTP security mode '%s'", security)
+	}
+
+	if from == "" || len(to) == 0 {
+		return nil, fmt.Errorf("both a sender and at least one recipient are required")
+	}
+
+	subject, err := parseAlertTemplate("email subject", templates.Subject, nil)
+	if err != nil {
+		return nil, err
+	}
+	text, err := parseAlertTemplate("email text", templates.Text, nil)
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.New("email html").Funcs(htmltemplate.FuncMap(alertTemplateFuncs)).Parse(templates.HTML)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email html template: %v", err)
+	}
+
+	return &EmailNotifier{
+		server:  SMTPServer{Host: host, Port: port, Security: security, Username: username, Password: password},
+		from:    from,
+		to:      to,
+		subject: subject,
+		text:    text,
+		html:    html,
+	}, nil
+}
+
+func (n *EmailNotifier) Name() string {
+	return "email"
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, alert Alert) error {
+	message, err := n.render(alert)
+	if err != nil {
+		return err
+	}
+
+	return n.server.Send(ctx, n.from, n.to, message)
+}
+
+func (n *EmailNotifier) render(alert Alert) ([]byte, error) {
+	var subject, text, html bytes.Buffer
+	if err := n.subject.Execute(&subject, alert); err != nil {
+		return nil, err
+	}
+	if err := n.text.Execute(&text, alert); err != nil {
+		return nil, err
+	}
+	if err := n.html.Execute(&html, alert); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	body := multipart.NewWriter(&message)
+
+	headers := []string{
+		"From: " + n.from,
+		"To: " + strings.Join(n.to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + body.Boundary(),
+	}
+	message.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		writer, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+// Send sends message from the from address to the to addresses.
+func (s SMTPServer) Send(ctx context.Context, from string, to []string, message []byte) error {
+	address := net.JoinHostPort(s.Host, s.Port)
+	tlsConfig := &tls.Config{ServerName: s.Host}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if s.Security == SMTPSecurityTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if s.Security == SMTPSecurityStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,125 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// ErrAbuseIPDBQuota is returned by AbuseIPDB.Check once the daily quota is
+// used up.
+var ErrAbuseIPDBQuota = errors.New("daily AbuseIPDB quota used up")
+
+type AbuseIPDBReport struct {
+	AbuseConfidenceScore int        `json:"abuseConfidenceScore"`
+	TotalReports         int        `json:"totalReports"`
+	LastReportedAt       *time.Time `json:"lastReportedAt"`
+}
+
+// AbuseIPDB looks up the reputation of IPs. Results are cached and lookups
+// stop for the day once the daily quota of the API key is used up.
+type AbuseIPDB struct {
+	apiKey string
+	options
+
+	mu       sync.Mutex
+	day      time.Time
+	dayCount int
+}
+
+func NewAbuseIPDB(apiKey string, opts ...Option) *AbuseIPDB {
+	return &AbuseIPDB{
+		apiKey: apiKey,
+		options: newOptions(options{
+			baseURL:    "https://api.abuseipdb.com/api/v2",
+			cacheTTL:   24 * time.Hour,
+			dailyLimit: 1000,
+		}, opts),
+	}
+}
+
+// reserve reports whether a lookup fits in today's quota, counting it.
+func (a *AbuseIPDB) reserve() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if !a.day.Equal(today) {
+		a.day = today
+		a.dayCount = 0
+	}
+
+	if a.dailyLimit > 0 && a.dayCount >= a.dailyLimit {
+		return false
+	}
+	a.dayCount++
+
+	return true
+}
+
+// Check returns the AbuseIPDB report of ip over the last 90 days.
+func (a *AbuseIPDB) Check(ctx context.Context, ip string) (AbuseIPDBReport, error) {
+	childCtx, span := a.tracer.Start(
+		ctx,
+		"getAbuseIPDB")
+	defer span.End()
+
+	if cached, found := a.cache.Get("abuseipdb/" + ip); found {
+		span.AddEvent("AbuseIPDB report found on cache")
+		span.SetStatus(codes.Ok, fmt.Sprintf("Got AbuseIPDB report from cache for '%s'", ip))
+		return cached.(AbuseIPDBReport), nil
+	}
+
+	if !a.reserve() {
+		span.SetStatus(codes.Error, ErrAbuseIPDBQuota.Error())
+		return AbuseIPDBReport{}, ErrAbuseIPDBQuota
+	}
+
+	slog.DebugContext(childCtx, "Getting AbuseIPDB report", "remote_host", ip)
+	query := url.Values{"ipAddress": {ip}, "maxAgeInDays": {"90"}}
+	req, err := http.NewRequestWithContext(childCtx, "GET", a.baseURL+"/check?"+query.Encode(), nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return AbuseIPDBReport{}, err
+	}
+	req.Header.Set("Key", a.apiKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return AbuseIPDBReport{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("AbuseIPDB responded with status %d", resp.StatusCode)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return AbuseIPDBReport{}, err
+	}
+
+	var result struct {
+		Data AbuseIPDBReport `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return AbuseIPDBReport{}, err
+	}
+
+	a.cache.Set("abuseipdb/"+ip, result.Data, a.cacheTTL)
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Got AbuseIPDB report for '%s'", ip))
+	return result.Data, nil
+}
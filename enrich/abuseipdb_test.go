@@ -0,0 +1,42 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAbuseIPDBCheck(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Key") != "key" || r.URL.Query().Get("ipAddress") != "203.0.113.7" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"data": {"abuseConfidenceScore": 87, "totalReports": 12}}`))
+	}))
+	defer server.Close()
+
+	client := NewAbuseIPDB("key", WithBaseURL(server.URL), WithHTTPClient(server.Client()), WithDailyLimit(1))
+
+	for i := 0; i < 2; i++ {
+		report, err := client.Check(context.Background(), "203.0.113.7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.AbuseConfidenceScore != 87 || report.TotalReports != 12 {
+			t.Errorf("report = %+v", report)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("requests = %d, want 1, the second check being cached", got)
+	}
+
+	if _, err := client.Check(context.Background(), "203.0.113.8"); !errors.Is(err, ErrAbuseIPDBQuota) {
+		t.Errorf("error = %v, want the quota used up", err)
+	}
+}
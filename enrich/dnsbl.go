@@ -0,0 +1,141 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// DNSBL checks IPs against DNS blocklists, such as zen.spamhaus.org
+// or b.barracudacentral.org: an IP is listed on a zone when the reversed IP
+// under the zone resolves.
+type DNSBL struct {
+	zones []string
+	options
+}
+
+func NewDNSBL(zones []string, opts ...Option) *DNSBL {
+	return &DNSBL{
+		zones: zones,
+		options: newOptions(options{
+			cacheTTL: time.Hour,
+			timeout:  2 * time.Second,
+			resolver: net.DefaultResolver,
+		}, opts),
+	}
+}
+
+// dnsblName returns the name to look up for ip under zone: the octets of an
+// IPv4 address, or the nibbles of an IPv6 one, in reverse order.
+func dnsblName(ip net.IP, zone string) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(ip4[i]))
+		}
+	} else {
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", ip[i]&0x0f), fmt.Sprintf("%x", ip[i]>>4))
+		}
+	}
+
+	return strings.Join(append(labels, zone), ".")
+}
+
+// listed reports whether ip is listed on zone. Blocklists answer with
+// addresses in 127.0.0.0/8, 127.255.255.0/24 being reserved by Spamhaus for
+// refusing the query, e.g. when made through a public resolver.
+func (d *DNSBL) listed(ctx context.Context, ip net.IP, zone string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	addrs, err := d.resolver.LookupHost(ctx, dnsblName(ip, zone))
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "127.255.255.") {
+			return false, fmt.Errorf("%s refused the query with %s", zone, addr)
+		}
+	}
+
+	return len(addrs) > 0, nil
+}
+
+// Check returns the zones addr is listed on, querying them all at once.
+// Zones failing to answer are left out, the result only being cached when
+// every zone answered.
+func (d *DNSBL) Check(ctx context.Context, addr string) ([]string, error) {
+	childCtx, span := d.tracer.Start(
+		ctx,
+		"getDNSBL")
+	defer span.End()
+
+	if cached, found := d.cache.Get("dnsbl/" + addr); found {
+		span.AddEvent("DNSBL listings found on cache")
+		span.SetStatus(codes.Ok, fmt.Sprintf("Got DNSBL listings from cache for '%s'", addr))
+		return cached.([]string), nil
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		err := fmt.Errorf("'%s' is not an IP address", addr)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		zones  []string
+		errs   []error
+		listed = make([]bool, len(d.zones))
+	)
+	for i, zone := range d.zones {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			found, err := d.listed(childCtx, ip, zone)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", zone, err))
+				return
+			}
+			listed[i] = found
+		}(i, zone)
+	}
+	wg.Wait()
+
+	// Listings keep the order of the configured zones
+	for i, zone := range d.zones {
+		if listed[i] {
+			zones = append(zones, zone)
+		}
+	}
+	span.SetAttributes(attribute.StringSlice("dnsbl.listed", zones))
+
+	err := errors.Join(errs...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return zones, err
+	}
+
+	d.cache.Set("dnsbl/"+addr, zones, d.cacheTTL)
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Got DNSBL listings for '%s'", addr))
+	return zones, nil
+}
@@ -0,0 +1,135 @@
+// Package enrich looks up the reputation of IP addresses with third-party
+// services: AbuseIPDB, GreyNoise, VirusTotal and DNS blocklists.
+//
+// Every client caches its reports and backs off when the quota of its API is
+// used up. The cache, HTTP client, API base URL and tracer are set through
+// options, so the clients can be shared with other components, or pointed at
+// fakes in tests.
+package enrich
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Cache holds the reports looked up, and the rate limit state of the APIs.
+// It's implemented by *cache.Cache of github.com/patrickmn/go-cache.
+type Cache interface {
+	Get(key string) (any, bool)
+	Set(key string, value any, ttl time.Duration)
+}
+
+type options struct {
+	cache       Cache
+	cacheTTL    time.Duration
+	client      *http.Client
+	baseURL     string
+	tracer      trace.Tracer
+	minuteLimit int
+	dailyLimit  int
+	enterprise  bool
+	timeout     time.Duration
+	resolver    *net.Resolver
+}
+
+// Option configures a client. Options not applying to a client are ignored
+// by it.
+type Option func(*options)
+
+// WithCache shares cache between clients, rather than each keeping its own.
+func WithCache(cache Cache) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// WithCacheTTL sets how long reports are cached, 24h by default, or 168h for
+// VirusTotal and 1h for DNS blocklists.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.cacheTTL = ttl
+	}
+}
+
+// WithHTTPClient sets the client the APIs are queried with,
+// http.DefaultClient by default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithBaseURL replaces the base URL of the API, e.g. with the address of a
+// fake one.
+func WithBaseURL(url string) Option {
+	return func(o *options) {
+		o.baseURL = url
+	}
+}
+
+// WithTracer records the lookups as spans of tracer, no spans being
+// recorded by default.
+func WithTracer(tracer trace.Tracer) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+// WithMinuteLimit caps the lookups a minute, 0 lifting the cap. Applies to
+// VirusTotal, 4 by default.
+func WithMinuteLimit(limit int) Option {
+	return func(o *options) {
+		o.minuteLimit = limit
+	}
+}
+
+// WithDailyLimit caps the lookups a day, 0 lifting the cap. Applies to
+// AbuseIPDB, 1000 by default, and VirusTotal, 500 by default.
+func WithDailyLimit(limit int) Option {
+	return func(o *options) {
+		o.dailyLimit = limit
+	}
+}
+
+// WithEnterprise uses the GreyNoise Enterprise API rather than the
+// Community one.
+func WithEnterprise(enterprise bool) Option {
+	return func(o *options) {
+		o.enterprise = enterprise
+	}
+}
+
+// WithTimeout bounds every DNS blocklist query, 2s by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithResolver sets the resolver DNS blocklists are queried with,
+// net.DefaultResolver by default.
+func WithResolver(resolver *net.Resolver) Option {
+	return func(o *options) {
+		o.resolver = resolver
+	}
+}
+
+// newOptions applies opts over the defaults of a client.
+func newOptions(defaults options, opts []Option) options {
+	o := defaults
+	o.client = http.DefaultClient
+	o.tracer = noop.NewTracerProvider().Tracer("")
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.cache == nil {
+		o.cache = cache.New(o.cacheTTL, 10*time.Minute)
+	}
+
+	return o
+}
@@ -0,0 +1,137 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// GreyNoise classifications, besides the benign, malicious and unknown ones
+// GreyNoise assigns to the IPs it saw scanning.
+const GreyNoiseNotSeen = "not_seen"
+
+// ErrGreyNoiseRateLimited is returned by GreyNoise.Check for an hour after
+// GreyNoise rate limited a lookup.
+var ErrGreyNoiseRateLimited = errors.New("GreyNoise rate limit reached")
+
+type GreyNoiseReport struct {
+	Classification string `json:"classification"`
+	Actor          string `json:"actor"`
+}
+
+// GreyNoise tells mass scanners apart from targeted activity using the
+// GreyNoise Community API, or the Enterprise API WithEnterprise.
+type GreyNoise struct {
+	apiKey string
+	options
+}
+
+// NewGreyNoise returns a GreyNoise client, apiKey being optional with the
+// Community API.
+func NewGreyNoise(apiKey string, opts ...Option) *GreyNoise {
+	return &GreyNoise{
+		apiKey: apiKey,
+		options: newOptions(options{
+			baseURL:  "https://api.greynoise.io",
+			cacheTTL: 24 * time.Hour,
+		}, opts),
+	}
+}
+
+// Check returns the GreyNoise classification of ip.
+func (g *GreyNoise) Check(ctx context.Context, ip string) (GreyNoiseReport, error) {
+	childCtx, span := g.tracer.Start(
+		ctx,
+		"getGreyNoise")
+	defer span.End()
+
+	if cached, found := g.cache.Get("greynoise/" + ip); found {
+		span.AddEvent("GreyNoise report found on cache")
+		span.SetStatus(codes.Ok, fmt.Sprintf("Got GreyNoise report from cache for '%s'", ip))
+		return cached.(GreyNoiseReport), nil
+	}
+
+	if _, found := g.cache.Get("greynoiseRt"); found {
+		span.SetStatus(codes.Error, ErrGreyNoiseRateLimited.Error())
+		return GreyNoiseReport{}, ErrGreyNoiseRateLimited
+	}
+
+	url := g.baseURL + "/v3/community/" + ip
+	if g.enterprise {
+		url = g.baseURL + "/v2/noise/context/" + ip
+	}
+
+	slog.DebugContext(childCtx, "Getting GreyNoise report", "remote_host", ip)
+	req, err := http.NewRequestWithContext(childCtx, "GET", url, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return GreyNoiseReport{}, err
+	}
+	if g.apiKey != "" {
+		req.Header.Set("key", g.apiKey)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return GreyNoiseReport{}, err
+	}
+	defer resp.Body.Close()
+
+	var report GreyNoiseReport
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result struct {
+			Seen           bool   `json:"seen"`
+			Noise          bool   `json:"noise"`
+			Riot           bool   `json:"riot"`
+			Classification string `json:"classification"`
+			Name           string `json:"name"`
+			Actor          string `json:"actor"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return GreyNoiseReport{}, err
+		}
+
+		report.Classification = result.Classification
+		report.Actor = result.Name
+		if g.enterprise {
+			report.Actor = result.Actor
+			if !result.Seen {
+				report.Classification = GreyNoiseNotSeen
+			}
+		}
+		if report.Classification == "" {
+			report.Classification = GreyNoiseNotSeen
+		}
+	case http.StatusNotFound:
+		// The community API answers 404 for IPs it never saw.
+		report.Classification = GreyNoiseNotSeen
+	case http.StatusTooManyRequests:
+		g.cache.Set("greynoiseRt", true, time.Hour)
+		span.SetStatus(codes.Error, ErrGreyNoiseRateLimited.Error())
+		slog.WarnContext(childCtx, "GreyNoise rate limit reached, pausing lookups for an hour")
+		return GreyNoiseReport{}, ErrGreyNoiseRateLimited
+	default:
+		err := fmt.Errorf("GreyNoise responded with status %d", resp.StatusCode)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return GreyNoiseReport{}, err
+	}
+
+	g.cache.Set("greynoise/"+ip, report, g.cacheTTL)
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Got GreyNoise report for '%s'", ip))
+	return report, nil
+}
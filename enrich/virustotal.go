@@ -0,0 +1,180 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// ErrVirusTotalQuota is returned by VirusTotal.Check when a lookup doesn't
+// fit in the quotas, or for an hour after VirusTotal reported them exceeded.
+var ErrVirusTotalQuota = errors.New("VirusTotal quota used up")
+
+// VirusTotalReport is the verdict of the VirusTotal engines on an IP as of
+// its last analysis, along with the community votes.
+type VirusTotalReport struct {
+	Malicious      int        `json:"malicious"`
+	Suspicious     int        `json:"suspicious"`
+	Harmless       int        `json:"harmless"`
+	Undetected     int        `json:"undetected"`
+	VotesMalicious int        `json:"votes_malicious"`
+	VotesHarmless  int        `json:"votes_harmless"`
+	LastAnalysis   *time.Time `json:"last_analysis,omitempty"`
+}
+
+// VirusTotal looks up the reputation of source IPs. The free tier only
+// allows a handful of lookups a minute and a few hundred a day, so reports
+// are cached for long and lookups are skipped once either quota is used up.
+type VirusTotal struct {
+	apiKey string
+	options
+
+	mu          sync.Mutex
+	minute      time.Time
+	minuteCount int
+	day         time.Time
+	dayCount    int
+}
+
+func NewVirusTotal(apiKey string, opts ...Option) *VirusTotal {
+	return &VirusTotal{
+		apiKey: apiKey,
+		options: newOptions(options{
+			baseURL:     "https://www.virustotal.com/api/v3",
+			cacheTTL:    7 * 24 * time.Hour,
+			minuteLimit: 4,
+			dailyLimit:  500,
+		}, opts),
+	}
+}
+
+// reserve reports whether a lookup fits in the quotas of the current minute
+// and day, counting it.
+func (v *VirusTotal) reserve() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now().UTC()
+	if minute := now.Truncate(time.Minute); !v.minute.Equal(minute) {
+		v.minute = minute
+		v.minuteCount = 0
+	}
+	if today := now.Truncate(24 * time.Hour); !v.day.Equal(today) {
+		v.day = today
+		v.dayCount = 0
+	}
+
+	if v.minuteLimit > 0 && v.minuteCount >= v.minuteLimit {
+		return false
+	}
+	if v.dailyLimit > 0 && v.dayCount >= v.dailyLimit {
+		return false
+	}
+	v.minuteCount++
+	v.dayCount++
+
+	return true
+}
+
+// Check returns the VirusTotal report of ip.
+func (v *VirusTotal) Check(ctx context.Context, ip string) (VirusTotalReport, error) {
+	childCtx, span := v.tracer.Start(
+		ctx,
+		"getVirusTotal")
+	defer span.End()
+
+	if cached, found := v.cache.Get("virustotal/" + ip); found {
+		span.AddEvent("VirusTotal report found on cache")
+		span.SetStatus(codes.Ok, fmt.Sprintf("Got VirusTotal report from cache for '%s'", ip))
+		return cached.(VirusTotalReport), nil
+	}
+
+	if _, found := v.cache.Get("virustotalRt"); found || !v.reserve() {
+		span.SetStatus(codes.Error, ErrVirusTotalQuota.Error())
+		return VirusTotalReport{}, ErrVirusTotalQuota
+	}
+
+	slog.DebugContext(childCtx, "Getting VirusTotal report", "remote_host", ip)
+	req, err := http.NewRequestWithContext(childCtx, "GET", v.baseURL+"/ip_addresses/"+ip, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return VirusTotalReport{}, err
+	}
+	req.Header.Set("x-apikey", v.apiKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return VirusTotalReport{}, err
+	}
+	defer resp.Body.Close()
+
+	var report VirusTotalReport
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result struct {
+			Data struct {
+				Attributes struct {
+					LastAnalysisDate  int64 `json:"last_analysis_date"`
+					LastAnalysisStats struct {
+						Malicious  int `json:"malicious"`
+						Suspicious int `json:"suspicious"`
+						Harmless   int `json:"harmless"`
+						Undetected int `json:"undetected"`
+					} `json:"last_analysis_stats"`
+					TotalVotes struct {
+						Malicious int `json:"malicious"`
+						Harmless  int `json:"harmless"`
+					} `json:"total_votes"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return VirusTotalReport{}, err
+		}
+
+		attributes := result.Data.Attributes
+		report = VirusTotalReport{
+			Malicious:      attributes.LastAnalysisStats.Malicious,
+			Suspicious:     attributes.LastAnalysisStats.Suspicious,
+			Harmless:       attributes.LastAnalysisStats.Harmless,
+			Undetected:     attributes.LastAnalysisStats.Undetected,
+			VotesMalicious: attributes.TotalVotes.Malicious,
+			VotesHarmless:  attributes.TotalVotes.Harmless,
+		}
+		if attributes.LastAnalysisDate > 0 {
+			lastAnalysis := time.Unix(attributes.LastAnalysisDate, 0).UTC()
+			report.LastAnalysis = &lastAnalysis
+		}
+	case http.StatusNotFound:
+		// IPs VirusTotal knows nothing about are cached as clean reports, not
+		// to spend the quota on them again.
+	case http.StatusTooManyRequests:
+		v.cache.Set("virustotalRt", true, time.Hour)
+		span.SetStatus(codes.Error, ErrVirusTotalQuota.Error())
+		slog.WarnContext(childCtx, "VirusTotal quota exceeded, pausing lookups for an hour")
+		return VirusTotalReport{}, ErrVirusTotalQuota
+	default:
+		err := fmt.Errorf("VirusTotal responded with status %d", resp.StatusCode)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return VirusTotalReport{}, err
+	}
+
+	v.cache.Set("virustotal/"+ip, report, v.cacheTTL)
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Got VirusTotal report for '%s'", ip))
+	return report, nil
+}
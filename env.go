@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid duration, using fallback", "key", key, "value", value, "fallback", fallback)
+		return fallback
+	}
+
+	return duration
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid integer, using fallback", "key", key, "value", value, "fallback", fallback)
+		return fallback
+	}
+
+	return number
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Invalid number, using fallback", "key", key, "value", value, "fallback", fallback)
+		return fallback
+	}
+
+	return number
+}
+
+// splitList splits a comma separated value, trimming blanks and dropping
+// empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
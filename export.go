@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// triedCredential is a username and password pair and how many times it was
+// tried.
+type triedCredential struct {
+	User     string
+	Password string
+	Count    int
+}
+
+// exportCredentials runs the export-credentials subcommand: it reads the
+// credentials tried from the events stored by the SQLite or PostgreSQL sink
+// and writes the usernames, passwords or pairs, most tried first, for
+// building password blocklists.
+func exportCredentials(args []string) error {
+	flags := flag.NewFlagSet("export-credentials", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML configuration file (env CONFIG_FILE)")
+	list := flags.String("list", "passwords", "list to export, 'usernames', 'passwords' or 'pairs'")
+	format := flags.String("format", "plain", "output format, 'plain', 'csv' or 'hashcat'")
+	since := flags.Duration("since", 0, "only export the credentials tried within this duration, all of them when 0")
+	minCount := flags.Int("min-count", 1, "only export the values tried at least this many times")
+	limit := flags.Int("limit", 0, "export at most this many values, all of them when 0")
+	counts := flags.Bool("counts", false, "prefix the values with their count in the plain format")
+	output := flags.String("output", "", "file to write to, stdout when unset")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: ssh-honeypot export-credentials [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Exports the credentials tried, as stored by the SQLite sink (SQLITE_PATH)\nor the PostgreSQL sink (POSTGRES_DSN), most tried first.\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument '%s'", flags.Arg(0))
+	}
+	switch *list {
+	case "usernames", "passwords", "pairs":
+	default:
+		return fmt.Errorf("unknown list '%s'", *list)
+	}
+	switch *format {
+	case "plain", "csv", "hashcat":
+	default:
+		return fmt.Errorf("unknown format '%s'", *format)
+	}
+
+	// Picks up the sink settings from the configuration file and secrets
+	if _, err := NewReloader(*configPath); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var cutoff time.Time
+	if *since > 0 {
+		cutoff = time.Now().Add(-*since)
+	}
+	credentials, err := queryCredentials(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]int{}
+	for _, credential := range credentials {
+		switch *list {
+		case "usernames":
+			if credential.User != "" {
+				values[credential.User] += credential.Count
+			}
+		case "passwords":
+			if credential.Password != "" {
+				values[credential.Password] += credential.Count
+			}
+		case "pairs":
+			if credential.User != "" {
+				values[credential.User+":"+credential.Password] += credential.Count
+			}
+		}
+	}
+	top := topCounts(values, len(values))
+	for i, value := range top {
+		if value.Count < *minCount {
+			top = top[:i]
+			break
+		}
+	}
+	if *limit > 0 && len(top) > *limit {
+		top = top[:*limit]
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	w := bufio.NewWriter(out)
+	if err := writeCredentials(w, top, *list, *format, *counts); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// queryCredentials returns the username and password pairs tried since
+// cutoff, from the SQLite database if configured, PostgreSQL otherwise.
+func queryCredentials(ctx context.Context, cutoff time.Time) ([]triedCredential, error) {
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		return querySQLiteCredentials(ctx, path, cutoff)
+	}
+	if dsn := os.Getenv("POSTGRES_DSN"); dsn != "" {
+		return queryPostgresCredentials(ctx, dsn, cutoff)
+	}
+
+	return nil, errors.New("no event store to export from, set SQLITE_PATH or POSTGRES_DSN")
+}
+
+func querySQLiteCredentials(ctx context.Context, path string, cutoff time.Time) ([]triedCredential, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, `SELECT coalesce(user, ''), coalesce(password, ''), count(*) FROM events
+		WHERE function IN ('password', 'keyboard_interactive') AND time >= ?
+		GROUP BY user, password`, cutoff.UTC().Format(sqliteTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []triedCredential
+	for rows.Next() {
+		var credential triedCredential
+		if err := rows.Scan(&credential.User, &credential.Password, &credential.Count); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+func queryPostgresCredentials(ctx context.Context, dsn string, cutoff time.Time) ([]triedCredential, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+
+	rows, err := pool.Query(ctx, `SELECT username, coalesce(password, ''), count(*) FROM auth_attempts
+		WHERE method IN ('password', 'keyboard_interactive') AND time >= $1
+		GROUP BY username, password`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []triedCredential
+	for rows.Next() {
+		var credential triedCredential
+		if err := rows.Scan(&credential.User, &credential.Password, &credential.Count); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+// writeCredentials writes values in format: one value per line in the plain
+// format, skipping the values spanning several lines, with their count in
+// the CSV format, and one value per line in the hashcat format, the values
+// hashcat can't read as is encoded as $HEX[...].
+func writeCredentials(w io.Writer, values []CredentialCount, list string, format string, counts bool) error {
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		header := []string{"value", "count"}
+		if list == "pairs" {
+			header = []string{"username", "password", "count"}
+		}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		for _, value := range values {
+			record := []string{value.Value, strconv.Itoa(value.Count)}
+			if list == "pairs" {
+				user, password, _ := strings.Cut(value.Value, ":")
+				record = []string{user, password, strconv.Itoa(value.Count)}
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "hashcat":
+		for _, value := range values {
+			if _, err := fmt.Fprintln(w, hashcatWord(value.Value)); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, value := range values {
+			if strings.ContainsAny(value.Value, "\r\n") {
+				continue
+			}
+			var err error
+			if counts {
+				_, err = fmt.Fprintf(w, "%d\t%s\n", value.Count, value.Value)
+			} else {
+				_, err = fmt.Fprintln(w, value.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// hashcatWord encodes word as $HEX[...] when it holds bytes other than
+// printable ASCII, or could be mistaken for an encoded word.
+func hashcatWord(word string) string {
+	if strings.HasPrefix(word, "$HEX[") {
+		return "$HEX[" + hex.EncodeToString([]byte(word)) + "]"
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 0x20 || word[i] > 0x7e {
+			return "$HEX[" + hex.EncodeToString([]byte(word)) + "]"
+		}
+	}
+
+	return word
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// FileSink appends every event to a local file as a line of JSON, laid out as
+// an EventDocument or as cowrie does, see eventLineEncoder. The file is rotated once it would grow past maxSize bytes
+// or has been open for rotateInterval, being renamed with the time of the
+// rotation, e.g. events-20240102T150405.000Z.jsonl, and gzip compressed when
+// compress is set. Only the maxBackups latest rotated files are kept when
+// set, and the sink is a RetentionTarget for them.
+type FileSink struct {
+	path           string
+	maxSize        int64
+	rotateInterval time.Duration
+	compress       bool
+	maxBackups     int
+	encode         func(*json.Encoder, Event) error
+	tracer         trace.Tracer
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewFileSink(path string, maxSize int64, rotateInterval time.Duration, compress bool, maxBackups int, format string, tracer trace.Tracer) (*FileSink, error) {
+	encode, err := eventLineEncoder(format)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileSink{
+		path:           path,
+		maxSize:        maxSize,
+		rotateInterval: rotateInterval,
+		compress:       compress,
+		maxBackups:     maxBackups,
+		encode:         encode,
+		tracer:         tracer,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func fileSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	path := os.Getenv("EVENT_FILE_PATH")
+	if path == "" {
+		return nil, nil
+	}
+
+	return NewFileSink(path, int64(getEnvInt("EVENT_FILE_MAX_SIZE", 100<<20)), getEnvDuration("EVENT_FILE_ROTATE_INTERVAL", 24*time.Hour),
+		getEnv("EVENT_FILE_COMPRESS", "false") == "true", getEnvInt("EVENT_FILE_MAX_BACKUPS", 0),
+		getEnv("EVENT_FILE_FORMAT", "document"), tracer)
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o750); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file, s.size, s.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (s *FileSink) Write(ctx context.Context, batch Batch) error {
+	_, span := s.tracer.Start(
+		ctx,
+		"writeToFile",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, event := range batch.Events {
+		if err := s.encode(encoder, event); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.write(lines.Bytes())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Wrote %d events", len(batch.Events)))
+	return nil
+}
+
+func (s *FileSink) write(lines []byte) error {
+	// The file is missing when reopening it after a rotation failed
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.size > 0 && ((s.maxSize > 0 && s.size+int64(len(lines)) > s.maxSize) ||
+		(s.rotateInterval > 0 && time.Since(s.opened) >= s.rotateInterval)) {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate %s: %v", s.path, err)
+		}
+	}
+
+	n, err := s.file.Write(lines)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	// Events are evidence, don't lose them to a crash
+	return s.file.Sync()
+}
+
+// rotate renames the current file aside, compressing it when set, and opens a
+// new one.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	ext := filepath.Ext(s.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(s.path, ext), time.Now().UTC().Format("20060102T150405.000Z"), ext)
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if s.compress {
+		if err := compressFile(rotated); err != nil {
+			// The rotated file is left uncompressed, events are not lost
+			slog.Error("Failed to compress rotated event file", "path", rotated, "error", err)
+		}
+	}
+
+	if s.maxBackups > 0 {
+		backups, err := s.backups()
+		if err != nil {
+			return err
+		}
+		for len(backups) > s.maxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				return err
+			}
+			backups = backups[1:]
+		}
+	}
+
+	return nil
+}
+
+// backups lists the rotated files, oldest first.
+func (s *FileSink) backups() ([]string, error) {
+	ext := filepath.Ext(s.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(s.path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	// Names sort by rotation time
+	slices.Sort(backups)
+	return backups, nil
+}
+
+// compressFile replaces path with a gzip compressed path.gz.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(dst)
+	_, err = io.Copy(writer, src)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Enforce deletes the rotated files last written to before before, making
+// the sink a RetentionTarget.
+func (s *FileSink) Enforce(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backups, err := s.backups()
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		info, err := os.Stat(backup)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(before) {
+			if err := os.Remove(backup); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+)
+
+//go:embed fingerprints.json
+var defaultClientFingerprints []byte
+
+// ClientFingerprint describes how a known tool or malware family shows up on
+// the wire. Every non-empty criterion must match; entries are evaluated in
+// order and the first match wins, so specific entries go before generic ones.
+type ClientFingerprint struct {
+	Tool          string   `json:"tool"`
+	Category      string   `json:"category"`
+	ClientVersion string   `json:"client_version"`
+	HASSH         []string `json:"hassh,omitempty"`
+	Functions     []string `json:"functions,omitempty"`
+	Users         []string `json:"users,omitempty"`
+
+	clientVersion *regexp.Regexp
+	users         []*regexp.Regexp
+}
+
+func (f *ClientFingerprint) compile() error {
+	var err error
+	if f.ClientVersion != "" {
+		if f.clientVersion, err = regexp.Compile(f.ClientVersion); err != nil {
+			return fmt.Errorf("invalid client_version for '%s': %v", f.Tool, err)
+		}
+	}
+
+	for _, user := range f.Users {
+		pattern, err := regexp.Compile(user)
+		if err != nil {
+			return fmt.Errorf("invalid users pattern for '%s': %v", f.Tool, err)
+		}
+		f.users = append(f.users, pattern)
+	}
+
+	return nil
+}
+
+func (f *ClientFingerprint) matches(sshInfo SSHInfo) bool {
+	if f.clientVersion != nil && !f.clientVersion.MatchString(sshInfo.ClientVersion) {
+		return false
+	}
+
+	if len(f.HASSH) > 0 && !slices.Contains(f.HASSH, sshInfo.HASSH) {
+		return false
+	}
+
+	if len(f.Functions) > 0 && !slices.Contains(f.Functions, sshInfo.Function) {
+		return false
+	}
+
+	if len(f.users) > 0 && !slices.ContainsFunc(f.users, func(pattern *regexp.Regexp) bool {
+		return pattern.MatchString(sshInfo.User)
+	}) {
+		return false
+	}
+
+	return true
+}
+
+// FingerprintDB is the knowledge base of client fingerprints used to tag
+// events with the tool that most likely produced them.
+type FingerprintDB struct {
+	fingerprints []*ClientFingerprint
+}
+
+// LoadFingerprintDB loads the built-in fingerprints, preceded by the ones in
+// path if set so that local entries take precedence.
+func LoadFingerprintDB(path string) (*FingerprintDB, error) {
+	db := &FingerprintDB{}
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.load(content); err != nil {
+			return nil, fmt.Errorf("failed to load '%s': %v", path, err)
+		}
+	}
+
+	if err := db.load(defaultClientFingerprints); err != nil {
+		return nil, fmt.Errorf("failed to load built-in fingerprints: %v", err)
+	}
+
+	slog.Info("Loaded client fingerprints", "count", len(db.fingerprints))
+	return db, nil
+}
+
+func (db *FingerprintDB) load(content []byte) error {
+	var fingerprints []*ClientFingerprint
+	if err := json.Unmarshal(content, &fingerprints); err != nil {
+		return err
+	}
+
+	for _, fingerprint := range fingerprints {
+		if err := fingerprint.compile(); err != nil {
+			return err
+		}
+	}
+	db.fingerprints = append(db.fingerprints, fingerprints...)
+
+	return nil
+}
+
+// Identify returns the first fingerprint matching sshInfo.
+func (db *FingerprintDB) Identify(sshInfo SSHInfo) (*ClientFingerprint, bool) {
+	for _, fingerprint := range db.fingerprints {
+		if fingerprint.matches(sshInfo) {
+			return fingerprint, true
+		}
+	}
+
+	return nil, false
+}
+
+// Annotate tags event with the identified tool.
+func (db *FingerprintDB) Annotate(ctx context.Context, event *Event) {
+	fingerprint, found := db.Identify(event.SSHInfo)
+	if !found {
+		return
+	}
+
+	event.Analysis.Tool = fingerprint.Tool
+	event.Analysis.ToolCategory = fingerprint.Category
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// NodeIdentity labels every event with the sensor that captured it, so the
+// events of a fleet of honeypots can be told apart once aggregated.
+type NodeIdentity struct {
+	ID         string
+	Region     string
+	Deployment string
+}
+
+var node = nodeIdentityFromEnv()
+
+func nodeIdentityFromEnv() NodeIdentity {
+	id := os.Getenv("NODE_ID")
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+
+	return NodeIdentity{
+		ID:         id,
+		Region:     os.Getenv("NODE_REGION"),
+		Deployment: os.Getenv("NODE_DEPLOYMENT"),
+	}
+}
+
+const fleetForwardMethod = "/sshhoneypot.Fleet/Forward"
+
+// jsonCodec carries the events between fleet nodes as JSON, which spares
+// generated protobuf code for what is a single streaming call.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+type fleetAck struct {
+	Received int `json:"received"`
+}
+
+// FleetServer receives the events forwarded by edge honeypots and feeds them
+// to the local pipeline for enrichment and storage.
+type FleetServer struct {
+	server  *grpc.Server
+	capture func(SSHInfo) bool
+	token   string
+}
+
+var fleetServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sshhoneypot.Fleet",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Forward",
+			Handler:       fleetForwardHandler,
+			ClientStreams: true,
+		},
+	},
+}
+
+// NewFleetServer serves over TLS with certFile and keyFile when set, then
+// requiring edges to present a certificate signed by clientCAFile, when set
+// too.
+func NewFleetServer(capture func(SSHInfo) bool, token string, certFile string, keyFile string, clientCAFile string) (*FleetServer, error) {
+	options := []grpc.ServerOption{grpc.ForceServerCodec(jsonCodec{})}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+		if clientCAFile != "" {
+			if tlsConfig.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+				return nil, err
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if clientCAFile != "" {
+		return nil, errors.New("FLEET_TLS_CLIENT_CA requires FLEET_TLS_CERT and FLEET_TLS_KEY")
+	}
+
+	s := &FleetServer{
+		server:  grpc.NewServer(options...),
+		capture: capture,
+		token:   token,
+	}
+	s.server.RegisterService(&fleetServiceDesc, s)
+
+	return s, nil
+}
+
+// checkFleetExposure refuses to serve the fleet server on addr beyond the
+// loopback interface with neither a token nor client certificates required,
+// anyone reaching it being able to forge events otherwise.
+func checkFleetExposure(addr string, token string, clientCAFile string) error {
+	loopback, err := isLoopbackAddr(addr)
+	if err != nil || loopback || token != "" || clientCAFile != "" {
+		return err
+	}
+
+	return fmt.Errorf("FLEET_TOKEN or FLEET_TLS_CLIENT_CA must be set to serve the fleet server on '%s', beyond the loopback interface", addr)
+}
+
+func (s *FleetServer) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.server.Serve(listener)
+}
+
+// Shutdown stops accepting streams and waits for the open ones until ctx is
+// done, closing them then.
+func (s *FleetServer) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
+
+func fleetForwardHandler(srv any, stream grpc.ServerStream) error {
+	s := srv.(*FleetServer)
+
+	if s.token != "" {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if tokens := md.Get("authorization"); len(tokens) == 0 || subtle.ConstantTimeCompare([]byte(tokens[0]), []byte("Bearer "+s.token)) != 1 {
+			return status.Error(codes.Unauthenticated, "invalid fleet token")
+		}
+	}
+
+	// An edge authenticated by its certificate is the node it names, so it
+	// can't pass its events off as another's
+	certNode := ""
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			certNode = tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+
+	received := 0
+	for {
+		var sshInfo SSHInfo
+		err := stream.RecvMsg(&sshInfo)
+		if errors.Is(err, io.EOF) {
+			return stream.SendMsg(&fleetAck{Received: received})
+		}
+		if err != nil {
+			return err
+		}
+
+		received++
+		if certNode != "" {
+			sshInfo.Node.ID = certNode
+		}
+		s.capture(sshInfo)
+	}
+}
+
+// FleetForwarder ships captured events to a central honeypot instead of
+// processing them locally. Events are queued without blocking the SSH
+// handlers and the stream is reopened with backoff when it breaks.
+type FleetForwarder struct {
+	conn    *grpc.ClientConn
+	token   string
+	queue   chan SSHInfo
+	done    chan struct{}
+	closing chan struct{}
+	dropped atomic.Uint64
+}
+
+// NewFleetForwarder verifies the central instance with caFile when set, and
+// presents the certificate of certFile and keyFile when set, for mutual TLS.
+func NewFleetForwarder(addr string, token string, caFile string, certFile string, keyFile string, queueSize int) (*FleetForwarder, error) {
+	creds := insecure.NewCredentials()
+	if caFile != "" {
+		rootCAs, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: rootCAs}
+		if certFile != "" || keyFile != "" {
+			if certFile == "" || keyFile == "" {
+				return nil, errors.New("both FLEET_TLS_CERT and FLEET_TLS_KEY are required")
+			}
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	} else if certFile != "" {
+		return nil, errors.New("FLEET_TLS_CERT requires FLEET_TLS_CA to forward over TLS")
+	}
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds), grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to fleet server '%s': %v", addr, err)
+	}
+
+	return &FleetForwarder{
+		conn:    conn,
+		token:   token,
+		queue:   make(chan SSHInfo, queueSize),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}, nil
+}
+
+// Capture queues an event for forwarding, dropping it if the queue is full.
+func (f *FleetForwarder) Capture(sshInfo SSHInfo) bool {
+	select {
+	case f.queue <- sshInfo:
+		return true
+	default:
+		if dropped := f.dropped.Add(1); dropped%100 == 1 {
+			slog.Warn("Fleet forwarding queue full, dropping event", "dropped", dropped)
+		}
+		return false
+	}
+}
+
+func (f *FleetForwarder) Start() {
+	go func() {
+		defer close(f.done)
+
+		backoffSettings := backoff.NewExponentialBackOff()
+		backoffSettings.MaxInterval = time.Minute
+		backoffSettings.MaxElapsedTime = 0
+
+		var pending *SSHInfo
+		for {
+			closed, err := f.forward(&pending, backoffSettings)
+			if closed {
+				return
+			}
+			wait := backoffSettings.NextBackOff()
+			slog.Warn("Fleet forwarding failed, retrying", "wait", wait, "error", err)
+			select {
+			case <-time.After(wait):
+			case <-f.closing:
+				slog.Warn("Fleet forwarding stopped with events still queued", "error", err)
+				return
+			}
+		}
+	}()
+}
+
+// forward streams queued events until the queue is closed or the stream
+// fails. An event that could not be sent is left in pending for the next
+// stream.
+func (f *FleetForwarder) forward(pending **SSHInfo, backoffSettings backoff.BackOff) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if f.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+f.token)
+	}
+
+	stream, err := f.conn.NewStream(ctx, &fleetServiceDesc.Streams[0], fleetForwardMethod)
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		if *pending == nil {
+			sshInfo, ok := <-f.queue
+			if !ok {
+				if err := stream.CloseSend(); err != nil {
+					return true, err
+				}
+				var ack fleetAck
+				return true, stream.RecvMsg(&ack)
+			}
+			*pending = &sshInfo
+		}
+
+		if err := stream.SendMsg(*pending); err != nil {
+			return false, err
+		}
+		*pending = nil
+		backoffSettings.Reset()
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be sent.
+// A failing stream is not retried anymore once closing.
+func (f *FleetForwarder) Close() {
+	close(f.closing)
+	close(f.queue)
+	<-f.done
+	f.conn.Close()
+}
+
+// loadCertPool returns the certificates of the PEM file at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in '%s'", path)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckFleetExposure(t *testing.T) {
+	for _, test := range []struct {
+		addr     string
+		token    string
+		clientCA string
+		refused  bool
+	}{
+		{addr: "127.0.0.1:50051"},
+		{addr: "localhost:50051"},
+		{addr: ":50051", refused: true},
+		{addr: "0.0.0.0:50051", token: "secret"},
+		{addr: "0.0.0.0:50051", clientCA: "ca.pem"},
+	} {
+		err := checkFleetExposure(test.addr, test.token, test.clientCA)
+		if refused := err != nil; refused != test.refused {
+			t.Errorf("checkFleetExposure(%q, %q, %q) = %v", test.addr, test.token, test.clientCA, err)
+		}
+	}
+}
+
+func TestFleetForwarderCloseWhileRetrying(t *testing.T) {
+	// Nothing listens on the port, so forwarding fails and is retried
+	forwarder, err := NewFleetForwarder("127.0.0.1:1", "", "", "", "", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarder.Start()
+	forwarder.Capture(SSHInfo{Function: "password", RemoteHost: "203.0.113.7"})
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		forwarder.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the retry")
+	}
+}
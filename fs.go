@@ -0,0 +1,724 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed filesystem.json
+var defaultFileSystem []byte
+
+var (
+	errNotDir   = errors.New("Not a directory")
+	errIsDir    = errors.New("Is a directory")
+	errNotEmpty = errors.New("Directory not empty")
+	errNoSpace  = errors.New("No space left on device")
+)
+
+// fsNode is a file or directory of the fake filesystem. Nodes are never
+// changed once in a tree: changes copy the nodes from the root down to the
+// changed one, so trees share everything else.
+type fsNode struct {
+	mode    fs.FileMode
+	owner   string
+	group   string
+	modTime time.Time
+	content []byte
+	// size is shown for template files without content, e.g. binaries
+	size     int64
+	children map[string]*fsNode
+}
+
+func (n *fsNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *fsNode) Size() int64 {
+	if n.isDir() {
+		return 4096
+	}
+	if n.content == nil {
+		return n.size
+	}
+
+	return int64(len(n.content))
+}
+
+func (n *fsNode) clone() *fsNode {
+	c := *n
+	if n.children != nil {
+		c.children = make(map[string]*fsNode, len(n.children))
+		for name, child := range n.children {
+			c.children[name] = child
+		}
+	}
+
+	return &c
+}
+
+// fsTemplateEntry is an entry of a JSON filesystem template. Parent
+// directories are created as needed.
+type fsTemplateEntry struct {
+	Path     string    `json:"path"`
+	Type     string    `json:"type"`
+	Mode     string    `json:"mode"`
+	Owner    string    `json:"owner"`
+	Group    string    `json:"group"`
+	Content  string    `json:"content"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// templateModTime is the time of template entries without one.
+var templateModTime = time.Date(2023, time.January, 11, 10, 2, 0, 0, time.UTC)
+
+// FileSystem is the fake filesystem attackers get into, built from a
+// template. It is never changed: every connection gets its own view.
+type FileSystem struct {
+	root  *fsNode
+	quota int64
+}
+
+// LoadFileSystem reads the template at path, a JSON list of entries or a tar
+// archive, gzip compressed or not, the built-in template when empty. Views
+// refuse writes past quota bytes, keeping the memory held by a connection
+// bounded.
+func LoadFileSystem(templatePath string, quota int64) (*FileSystem, error) {
+	f := &FileSystem{root: newFSDir("root", "root", templateModTime), quota: quota}
+
+	if templatePath == "" {
+		return f, f.loadJSON(defaultFileSystem)
+	}
+
+	data, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(templatePath, ".tar"):
+		err = f.loadTar(data, false)
+	case strings.HasSuffix(templatePath, ".tar.gz"), strings.HasSuffix(templatePath, ".tgz"):
+		err = f.loadTar(data, true)
+	default:
+		err = f.loadJSON(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filesystem template %s: %v", templatePath, err)
+	}
+
+	return f, nil
+}
+
+func fileSystemFromEnv() (*FileSystem, error) {
+	return LoadFileSystem(os.Getenv("SHELL_FILESYSTEM"), int64(getEnvInt("SHELL_FILESYSTEM_QUOTA", 16<<20)))
+}
+
+func newFSDir(owner string, group string, modTime time.Time) *fsNode {
+	return &fsNode{mode: fs.ModeDir | 0o755, owner: owner, group: group, modTime: modTime, children: map[string]*fsNode{}}
+}
+
+func (f *FileSystem) loadJSON(data []byte) error {
+	var entries []fsTemplateEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		node := &fsNode{owner: entry.Owner, group: entry.Group, modTime: entry.Modified, size: entry.Size}
+		if node.owner == "" {
+			node.owner = "root"
+		}
+		if node.group == "" {
+			node.group = node.owner
+		}
+		if node.modTime.IsZero() {
+			node.modTime = templateModTime
+		}
+
+		perm := uint64(0o644)
+		switch entry.Type {
+		case "dir":
+			perm = 0o755
+			node.mode = fs.ModeDir
+			node.children = map[string]*fsNode{}
+		case "", "file":
+			if entry.Content != "" || entry.Size == 0 {
+				node.content = []byte(entry.Content)
+			}
+		default:
+			return fmt.Errorf("%s: unknown type '%s', expected 'file' or 'dir'", entry.Path, entry.Type)
+		}
+		if entry.Mode != "" {
+			var err error
+			if perm, err = strconv.ParseUint(entry.Mode, 8, 32); err != nil {
+				return fmt.Errorf("%s: invalid mode '%s'", entry.Path, entry.Mode)
+			}
+		}
+		node.mode |= fs.FileMode(perm) & fs.ModePerm
+		if perm&0o1000 != 0 {
+			node.mode |= fs.ModeSticky
+		}
+
+		if err := f.add(entry.Path, node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *FileSystem) loadTar(data []byte, compressed bool) error {
+	var reader io.Reader = bytes.NewReader(data)
+	if compressed {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		reader = gzipReader
+	}
+
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		node := &fsNode{
+			mode:    header.FileInfo().Mode() & (fs.ModePerm | fs.ModeSticky),
+			owner:   header.Uname,
+			group:   header.Gname,
+			modTime: header.ModTime,
+		}
+		if node.owner == "" {
+			node.owner = "root"
+		}
+		if node.group == "" {
+			node.group = node.owner
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			node.mode |= fs.ModeDir
+			node.children = map[string]*fsNode{}
+		case tar.TypeReg:
+			if node.content, err = io.ReadAll(archive); err != nil {
+				return err
+			}
+		default:
+			// Links and devices aren't emulated
+			continue
+		}
+
+		if err := f.add(header.Name, node); err != nil {
+			return err
+		}
+	}
+}
+
+// add places node at name in the template, creating the missing parent
+// directories. Directories added over existing ones keep their children.
+func (f *FileSystem) add(name string, node *fsNode) error {
+	parts := splitPath(path.Join("/", name))
+	if len(parts) == 0 {
+		if node.isDir() {
+			node.children = f.root.children
+			f.root = node
+		}
+		return nil
+	}
+
+	dir := f.root
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := dir.children[part]
+		if !ok {
+			child = newFSDir(dir.owner, dir.group, templateModTime)
+			dir.children[part] = child
+		}
+		if !child.isDir() {
+			return fmt.Errorf("%s: %s is not a directory", name, part)
+		}
+		dir = child
+	}
+
+	last := parts[len(parts)-1]
+	if existing, ok := dir.children[last]; ok && existing.isDir() && node.isDir() {
+		node.children = existing.children
+	}
+	dir.children[last] = node
+
+	return nil
+}
+
+// AddFile places a file owned by root at name, replacing the one of the
+// template if any.
+func (f *FileSystem) AddFile(name string, content string, perm fs.FileMode) error {
+	return f.add(name, &fsNode{mode: perm, owner: "root", group: "root", modTime: templateModTime, content: []byte(content)})
+}
+
+// Remove drops name from the template, if there.
+func (f *FileSystem) Remove(name string) {
+	parts := splitPath(path.Join("/", name))
+	if len(parts) == 0 {
+		return
+	}
+
+	dir := f.root
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := dir.children[part]
+		if !ok || !child.isDir() {
+			return
+		}
+		dir = child
+	}
+	delete(dir.children, parts[len(parts)-1])
+}
+
+// RenameUser renames the user from of the template to: its home directory,
+// the files it owns and its entries in /etc/passwd, /etc/group and
+// /etc/shadow.
+func (f *FileSystem) RenameUser(from string, to string) {
+	if from == to {
+		return
+	}
+
+	if home, ok := f.root.children["home"]; ok && home.isDir() {
+		if node, ok := home.children[from]; ok {
+			delete(home.children, from)
+			home.children[to] = node
+		}
+	}
+
+	var chown func(node *fsNode)
+	chown = func(node *fsNode) {
+		if node.owner == from {
+			node.owner = to
+		}
+		if node.group == from {
+			node.group = to
+		}
+		for _, child := range node.children {
+			chown(child)
+		}
+	}
+	chown(f.root)
+
+	etc, ok := f.root.children["etc"]
+	if !ok || !etc.isDir() {
+		return
+	}
+	for _, name := range []string{"passwd", "group", "shadow"} {
+		node, ok := etc.children[name]
+		if !ok || node.content == nil {
+			continue
+		}
+		// Fields, or the comma separated items of group members and GECOS
+		lines := strings.Split(string(node.content), "\n")
+		for i, line := range lines {
+			fields := strings.Split(line, ":")
+			for j, field := range fields {
+				items := strings.Split(field, ",")
+				for k, item := range items {
+					switch item {
+					case from:
+						items[k] = to
+					case "/home/" + from:
+						items[k] = "/home/" + to
+					}
+				}
+				fields[j] = strings.Join(items, ",")
+			}
+			lines[i] = strings.Join(fields, ":")
+		}
+		node.content = []byte(strings.Join(lines, "\n"))
+	}
+}
+
+// readable reports whether user may read node, or list it if a directory.
+func readable(node *fsNode, user string) bool {
+	return user == "root" || (node.owner == user && node.mode&0o400 != 0) || node.mode&0o004 != 0
+}
+
+// writable reports whether user may change the entries of dir.
+func writable(dir *fsNode, user string) bool {
+	return user == "root" || (dir.owner == user && dir.mode&0o200 != 0) || dir.mode&0o002 != 0
+}
+
+// fsErrorText words err as coreutils do.
+func fsErrorText(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "No such file or directory"
+	case errors.Is(err, fs.ErrExist):
+		return "File exists"
+	case errors.Is(err, fs.ErrPermission):
+		return "Permission denied"
+	}
+
+	return err.Error()
+}
+
+// splitPath returns the elements of the absolute, clean path p.
+func splitPath(p string) []string {
+	if p == "/" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+// FileChange is a change made to a view, reported to its owner.
+type FileChange struct {
+	Operation string
+	Path      string
+	Size      int64
+	SHA256    string
+	// Content is the content of the file written
+	Content []byte
+}
+
+// FSView is the filesystem as seen by a connection: the template with the
+// changes made over the connection, which no other connection sees. Every
+// change is reported to onChange.
+type FSView struct {
+	quota    int64
+	onChange func(FileChange)
+
+	mu      sync.Mutex
+	root    *fsNode
+	written int64
+}
+
+// View returns a new view of the filesystem, reporting its changes to
+// onChange.
+func (f *FileSystem) View(onChange func(FileChange)) *FSView {
+	return &FSView{root: f.root, quota: f.quota, onChange: onChange}
+}
+
+// Stat returns the node at the absolute path p.
+func (v *FSView) Stat(p string) (*fsNode, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.lookup(p)
+}
+
+func (v *FSView) lookup(p string) (*fsNode, error) {
+	node := v.root
+	for _, part := range splitPath(path.Clean(p)) {
+		if !node.isDir() {
+			return nil, errNotDir
+		}
+		child, ok := node.children[part]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		node = child
+	}
+
+	return node, nil
+}
+
+// fsEntry is a named node, as listed in a directory.
+type fsEntry struct {
+	name string
+	node *fsNode
+}
+
+// ReadDir lists the directory at p, sorted by name.
+func (v *FSView) ReadDir(p string) ([]fsEntry, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	dir, err := v.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, errNotDir
+	}
+
+	entries := make([]fsEntry, 0, len(dir.children))
+	for name, node := range dir.children {
+		entries = append(entries, fsEntry{name: name, node: node})
+	}
+	slices.SortFunc(entries, func(a, b fsEntry) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	return entries, nil
+}
+
+// modify replaces the tree with a copy where fn changed the directory
+// holding the last element of p, given with its name.
+func (v *FSView) modify(p string, fn func(dir *fsNode, name string) error) error {
+	parts := splitPath(path.Clean(p))
+	if len(parts) == 0 {
+		return fs.ErrPermission
+	}
+
+	root, err := modifyAt(v.root, parts, fn)
+	if err != nil {
+		return err
+	}
+	v.root = root
+
+	return nil
+}
+
+func modifyAt(node *fsNode, parts []string, fn func(dir *fsNode, name string) error) (*fsNode, error) {
+	if !node.isDir() {
+		return nil, errNotDir
+	}
+
+	dir := node.clone()
+	if len(parts) == 1 {
+		if err := fn(dir, parts[0]); err != nil {
+			return nil, err
+		}
+		return dir, nil
+	}
+
+	child, ok := dir.children[parts[0]]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	child, err := modifyAt(child, parts[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	dir.children[parts[0]] = child
+
+	return dir, nil
+}
+
+// WriteFile writes data to the file at p on behalf of user, created when
+// missing, appending to it or replacing its content.
+func (v *FSView) WriteFile(p string, data []byte, appending bool, user string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.quota > 0 && v.written+int64(len(data)) > v.quota {
+		return errNoSpace
+	}
+
+	var content []byte
+	err := v.modify(p, func(dir *fsNode, name string) error {
+		file, ok := dir.children[name]
+		if ok && file.isDir() {
+			return errIsDir
+		}
+		if !ok {
+			if !writable(dir, user) {
+				return fs.ErrPermission
+			}
+			file = &fsNode{mode: 0o644, owner: user, group: user}
+		} else if user != "root" && (file.owner != user || file.mode&0o200 == 0) && file.mode&0o002 == 0 {
+			return fs.ErrPermission
+		} else {
+			file = file.clone()
+		}
+
+		if appending {
+			file.content = append(slices.Clip(file.content), data...)
+		} else {
+			file.content = slices.Clone(data)
+		}
+		file.modTime = time.Now()
+		dir.children[name] = file
+		content = file.content
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	v.written += int64(len(data))
+
+	sum := sha256.Sum256(content)
+	v.report(FileChange{Operation: "write", Path: path.Clean(p), Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:]), Content: content})
+	return nil
+}
+
+// Touch creates an empty file at p on behalf of user, or updates its
+// modification time when it exists.
+func (v *FSView) Touch(p string, user string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	created := false
+	err := v.modify(p, func(dir *fsNode, name string) error {
+		node, ok := dir.children[name]
+		if !ok {
+			if !writable(dir, user) {
+				return fs.ErrPermission
+			}
+			node = &fsNode{mode: 0o644, owner: user, group: user, content: []byte{}}
+			created = true
+		} else {
+			node = node.clone()
+		}
+		node.modTime = time.Now()
+		dir.children[name] = node
+		return nil
+	})
+	if err == nil && created {
+		v.report(FileChange{Operation: "create", Path: path.Clean(p)})
+	}
+
+	return err
+}
+
+// Mkdir creates the directory p on behalf of user.
+func (v *FSView) Mkdir(p string, user string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	err := v.modify(p, func(dir *fsNode, name string) error {
+		if _, ok := dir.children[name]; ok {
+			return fs.ErrExist
+		}
+		if !writable(dir, user) {
+			return fs.ErrPermission
+		}
+		dir.children[name] = newFSDir(user, user, time.Now())
+		return nil
+	})
+	if err == nil {
+		v.report(FileChange{Operation: "mkdir", Path: path.Clean(p)})
+	}
+
+	return err
+}
+
+// Remove deletes the file or directory at p on behalf of user, directories
+// having to be empty unless recursive.
+func (v *FSView) Remove(p string, recursive bool, user string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	err := v.modify(p, func(dir *fsNode, name string) error {
+		node, ok := dir.children[name]
+		if !ok {
+			return fs.ErrNotExist
+		}
+		if node.isDir() && len(node.children) > 0 && !recursive {
+			return errNotEmpty
+		}
+		if !writable(dir, user) {
+			return fs.ErrPermission
+		}
+		delete(dir.children, name)
+		return nil
+	})
+	if err == nil {
+		v.report(FileChange{Operation: "remove", Path: path.Clean(p)})
+	}
+
+	return err
+}
+
+// Rename moves the node at from to to on behalf of user, replacing a file
+// there.
+func (v *FSView) Rename(from string, to string, user string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	node, err := v.lookup(from)
+	if err != nil {
+		return err
+	}
+	if target, err := v.lookup(to); err == nil && target.isDir() {
+		return errIsDir
+	}
+
+	// Both changes apply or neither does
+	root := v.root
+	err = v.modify(to, func(dir *fsNode, name string) error {
+		if !writable(dir, user) {
+			return fs.ErrPermission
+		}
+		dir.children[name] = node
+		return nil
+	})
+	if err == nil {
+		err = v.modify(from, func(dir *fsNode, name string) error {
+			if !writable(dir, user) {
+				return fs.ErrPermission
+			}
+			delete(dir.children, name)
+			return nil
+		})
+	}
+	if err != nil {
+		v.root = root
+		return err
+	}
+
+	v.report(FileChange{Operation: "rename", Path: path.Clean(from) + " -> " + path.Clean(to)})
+	return nil
+}
+
+// Chmod sets the permissions of the node at p on behalf of user.
+func (v *FSView) Chmod(p string, perm fs.FileMode, user string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	err := v.modify(p, func(dir *fsNode, name string) error {
+		node, ok := dir.children[name]
+		if !ok {
+			return fs.ErrNotExist
+		}
+		if user != "root" && node.owner != user {
+			return fs.ErrPermission
+		}
+		node = node.clone()
+		node.mode = node.mode&^(fs.ModePerm|fs.ModeSticky) | perm
+		dir.children[name] = node
+		return nil
+	})
+	if err == nil {
+		v.report(FileChange{Operation: "chmod", Path: path.Clean(p)})
+	}
+
+	return err
+}
+
+// MkdirHome creates the home directory of user if missing, as it would
+// exist on a real host, without reporting it as a change.
+func (v *FSView) MkdirHome(home string, user string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, err := v.lookup(home); err == nil {
+		return
+	}
+	v.modify(home, func(dir *fsNode, name string) error {
+		dir.children[name] = newFSDir(user, user, templateModTime)
+		return nil
+	})
+}
+
+func (v *FSView) report(change FileChange) {
+	if v.onChange != nil {
+		v.onChange(change)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestFSView(t *testing.T) {
+	fileSystem, err := LoadFileSystem("", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []FileChange
+	view := fileSystem.View(func(change FileChange) {
+		changes = append(changes, change)
+	})
+	if err := view.WriteFile("/tmp/x", []byte("abc"), false, "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.WriteFile("/tmp/x", []byte("def"), true, "root"); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := view.Stat("/tmp/x"); err != nil || string(node.content) != "abcdef" {
+		t.Errorf("Stat = %v, %v", node, err)
+	}
+	if len(changes) != 2 || changes[1].Operation != "write" || changes[1].Size != 6 {
+		t.Errorf("changes = %+v", changes)
+	}
+
+	if err := view.WriteFile("/tmp/y", []byte("ghi"), false, "root"); !errors.Is(err, errNoSpace) {
+		t.Errorf("write beyond the quota: %v", err)
+	}
+	if err := view.WriteFile("/etc/x", nil, false, "admin"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("write to /etc as a user: %v", err)
+	}
+
+	if err := view.Mkdir("/tmp/d", "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.Touch("/tmp/d/f", "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.Remove("/tmp/d", false, "root"); !errors.Is(err, errNotEmpty) {
+		t.Errorf("removed a directory not empty: %v", err)
+	}
+	if entries, err := view.ReadDir("/tmp/d"); err != nil || len(entries) != 1 || entries[0].name != "f" {
+		t.Errorf("ReadDir = %v, %v", entries, err)
+	}
+
+	// Changes stay in the view they were made in
+	if _, err := fileSystem.View(nil).Stat("/tmp/x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file written in another view: %v", err)
+	}
+}
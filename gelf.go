@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// gelfMaxChunks is the most chunks a GELF message may be split into.
+const gelfMaxChunks = 128
+
+// GELFSink sends every event to Graylog as a GELF 1.1 message, the event
+// fields being additional fields. Over UDP messages are gzip compressed and
+// split into chunks of up to chunkSize bytes when larger, over TCP and TLS
+// they are sent as is, null byte delimited.
+type GELFSink struct {
+	addr      string
+	network   string
+	chunkSize int
+	hostname  string
+	tlsConfig *tls.Config
+	tracer    trace.Tracer
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func NewGELFSink(addr string, network string, chunkSize int, tracer trace.Tracer) (*GELFSink, error) {
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown GELF protocol '%s', expected 'udp', 'tcp' or 'tls'", network)
+	}
+	// Leave room for the 12 bytes chunk header
+	if chunkSize <= 12 {
+		return nil, fmt.Errorf("invalid GELF chunk size %d", chunkSize)
+	}
+
+	s := &GELFSink{
+		addr:      addr,
+		network:   network,
+		chunkSize: chunkSize,
+		hostname:  node.ID,
+		tracer:    tracer,
+	}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(addr)
+		s.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+
+	return s, nil
+}
+
+func gelfSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	addr := os.Getenv("GELF_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+
+	return NewGELFSink(addr, getEnv("GELF_PROTOCOL", "udp"), getEnvInt("GELF_CHUNK_SIZE", 1420), tracer)
+}
+
+func (s *GELFSink) Name() string {
+	return "gelf"
+}
+
+func (s *GELFSink) Write(ctx context.Context, batch Batch) error {
+	_, span := s.tracer.Start(
+		ctx,
+		"writeToGELF",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, event := range batch.Events {
+		message, err := json.Marshal(s.message(event))
+		if err != nil {
+			return err
+		}
+
+		if err := s.send(message); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Sent %d events", len(batch.Events)))
+	return nil
+}
+
+// send writes message, dialing first when not connected. The connection is
+// dropped on errors so the next attempt reconnects.
+func (s *GELFSink) send(message []byte) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		var err error
+		if s.network == "tls" {
+			s.conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+		} else {
+			s.conn, err = dialer.Dial(s.network, s.addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var datagrams [][]byte
+	if s.network == "udp" {
+		var err error
+		if datagrams, err = s.chunks(message); err != nil {
+			// Sending it again won't make it smaller
+			slog.Warn("Dropping GELF message", "error", err)
+			return nil
+		}
+	} else {
+		datagrams = [][]byte{append(message, 0)}
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	for _, datagram := range datagrams {
+		if _, err := s.conn.Write(datagram); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chunks compresses message, splitting it into chunks sharing a random
+// message ID when it doesn't fit in a single datagram.
+func (s *GELFSink) chunks(message []byte) ([][]byte, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(message)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	data := compressed.Bytes()
+
+	if len(data) <= s.chunkSize {
+		return [][]byte{data}, nil
+	}
+
+	size := s.chunkSize - 12
+	count := (len(data) + size - 1) / size
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("message of %d bytes needs %d chunks, over the limit of %d", len(data), count, gelfMaxChunks)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := make([]byte, 0, s.chunkSize)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, data[i*size:min((i+1)*size, len(data))]...)
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, nil
+}
+
+func (s *GELFSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// message lays event out as a GELF message with a notice level. The fields
+// of its EventDocument become additional fields, which GELF only allows to
+// be strings or numbers: lists are joined, booleans and objects flattened.
+func (s *GELFSink) message(event Event) map[string]any {
+	document := newEventDocument(event)
+	kind, ok := syslogEvents[document.Function]
+	if !ok {
+		kind.name = document.Function
+	}
+
+	message := map[string]any{
+		"version":       "1.1",
+		"host":          s.hostname,
+		"short_message": fmt.Sprintf("%s from %s", kind.name, document.RemoteHost),
+		"timestamp":     float64(document.Timestamp.UnixMicro()) / 1e6,
+		"level":         5,
+		"_event_id":     document.ID,
+	}
+
+	encoded, _ := json.Marshal(document)
+	var fields map[string]any
+	json.Unmarshal(encoded, &fields)
+	for name, value := range fields {
+		switch value := value.(type) {
+		case string, float64:
+			message["_"+name] = value
+		case bool:
+			message["_"+name] = fmt.Sprint(value)
+		case []any:
+			values := make([]string, len(value))
+			for i, v := range value {
+				values[i] = fmt.Sprint(v)
+			}
+			message["_"+name] = strings.Join(values, ",")
+		}
+	}
+	// Set as the message timestamp
+	delete(message, "_@timestamp")
+	if document.Location != nil {
+		message["_latitude"] = document.Location.Lat
+		message["_longitude"] = document.Location.Lon
+	}
+
+	return message
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultGeoMemoryTTLs are how long the in-memory geolocation cache keeps the
+// IP info answered by each provider, and by the disk cache: local lookups
+// are cheap, online ones use up a quota.
+const defaultGeoMemoryTTLs = "geolite2=1h,ipinfo.io=24h,ip-api.com=24h,disk_cache=1h"
+
+// GeoMemoryCache keeps the IP info of recent lookups in memory, bounded in
+// entries and size so sustained scanning from ever new IPs doesn't grow it,
+// each for the TTL of the provider that answered.
+type GeoMemoryCache struct {
+	cache *LRUCache[string, IPInfo]
+	ttls  map[string]time.Duration
+}
+
+// geoMemory is the in-memory geolocation cache, the defaults until
+// startPipeline sets it up from the environment.
+var geoMemory = NewGeoMemoryCache(10000, 0, mustParseGeoMemoryTTLs(defaultGeoMemoryTTLs))
+
+func NewGeoMemoryCache(maxEntries int, maxBytes int, ttls map[string]time.Duration) *GeoMemoryCache {
+	return &GeoMemoryCache{
+		cache: NewLRUCache(maxEntries, maxBytes, ipInfoSize, metrics.RecordGeoCacheEviction),
+		ttls:  ttls,
+	}
+}
+
+// geoMemoryCacheFromEnv reads GEO_MEMORY_CACHE_TTLS over the defaults.
+func geoMemoryCacheFromEnv() (*GeoMemoryCache, error) {
+	ttls, err := parseGeoMemoryTTLs(splitList(defaultGeoMemoryTTLs + "," + os.Getenv("GEO_MEMORY_CACHE_TTLS")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GEO_MEMORY_CACHE_TTLS: %v", err)
+	}
+	size := getEnvInt("GEO_MEMORY_CACHE_SIZE", 10000)
+	if size < 1 {
+		return nil, fmt.Errorf("GEO_MEMORY_CACHE_SIZE must be positive")
+	}
+
+	return NewGeoMemoryCache(size, getEnvInt("GEO_MEMORY_CACHE_MAX_BYTES", 0), ttls), nil
+}
+
+// parseGeoMemoryTTLs parses provider=ttl entries, the providers being those
+// of GEO_PROVIDERS or disk_cache.
+func parseGeoMemoryTTLs(entries []string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration, len(entries))
+	for _, entry := range entries {
+		provider, value, found := strings.Cut(entry, "=")
+		if _, known := geoProviders[provider]; !found || (!known && provider != "disk_cache") {
+			return nil, fmt.Errorf("'%s' is not <provider>=<ttl>, the provider being 'geolite2', 'ipinfo.io', 'ip-api.com' or 'disk_cache'", entry)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("'%s' is not a valid duration", value)
+		}
+		ttls[provider] = ttl
+	}
+
+	return ttls, nil
+}
+
+func mustParseGeoMemoryTTLs(entries string) map[string]time.Duration {
+	ttls, err := parseGeoMemoryTTLs(splitList(entries))
+	if err != nil {
+		panic(err)
+	}
+
+	return ttls
+}
+
+// ipInfoSize estimates the memory an entry takes.
+func ipInfoSize(host string, ipInfo IPInfo) int {
+	// The list element, the map entry and the fixed fields
+	const overhead = 256
+	return overhead + len(host) + len(ipInfo.IP) + len(ipInfo.City) + len(ipInfo.Region) + len(ipInfo.Country) +
+		len(ipInfo.Org) + len(ipInfo.Timezone)
+}
+
+// Get returns the IP info cached for host, counting the hit or miss.
+func (g *GeoMemoryCache) Get(ctx context.Context, host string) (IPInfo, bool) {
+	ipInfo, found := g.cache.Get(host)
+	metrics.RecordGeoCache(ctx, found)
+
+	return ipInfo, found
+}
+
+// Set caches ipInfo for host for the TTL of provider, not at all when 0.
+func (g *GeoMemoryCache) Set(host string, ipInfo IPInfo, provider string) {
+	if ttl := g.ttls[provider]; ttl > 0 {
+		g.cache.Set(host, ipInfo, ttl)
+	}
+}
+
+// Len returns the number of entries.
+func (g *GeoMemoryCache) Len() int {
+	return g.cache.Len()
+}
+
+const geoCacheSchema = `
+CREATE TABLE IF NOT EXISTS ip_info (
+	ip         TEXT PRIMARY KEY,
+	info       TEXT NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS ip_info_expires_at ON ip_info (expires_at);
+`
+
+// GeoCache keeps the IP info of online lookups in a SQLite database for ttl,
+// so repeat attackers, most of them, don't use up the ipinfo.io or
+// ip-api.com quota again, even after a restart.
+type GeoCache struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+// NewGeoCache opens, or creates, the cache at path, dropping expired entries.
+func NewGeoCache(path string, ttl time.Duration) (*GeoCache, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(geoCacheSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %v", err)
+	}
+
+	g := &GeoCache{db: db, ttl: ttl}
+	if err := g.Purge(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Get returns the IP info cached for host, if it hasn't expired.
+func (g *GeoCache) Get(ctx context.Context, host string) (IPInfo, bool) {
+	var info string
+	err := g.db.QueryRowContext(ctx, `SELECT info FROM ip_info WHERE ip = ? AND expires_at > ?`, host, time.Now().Unix()).Scan(&info)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.WarnContext(ctx, "Failed to read geolocation cache", "remote_host", host, "error", err)
+		}
+		return IPInfo{}, false
+	}
+
+	var ipInfo IPInfo
+	if err := json.Unmarshal([]byte(info), &ipInfo); err != nil {
+		return IPInfo{}, false
+	}
+
+	return ipInfo, true
+}
+
+// Set caches ipInfo for host.
+func (g *GeoCache) Set(ctx context.Context, host string, ipInfo IPInfo) {
+	info, err := json.Marshal(ipInfo)
+	if err != nil {
+		return
+	}
+
+	_, err = g.db.ExecContext(ctx, `INSERT INTO ip_info (ip, info, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET info = excluded.info, expires_at = excluded.expires_at`,
+		host, string(info), time.Now().Add(g.ttl).Unix())
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to write geolocation cache", "remote_host", host, "error", err)
+	}
+}
+
+// Purge deletes the expired entries.
+func (g *GeoCache) Purge() error {
+	_, err := g.db.Exec(`DELETE FROM ip_info WHERE expires_at <= ?`, time.Now().Unix())
+	return err
+}
+
+func (g *GeoCache) Close() error {
+	return g.db.Close()
+}
+
+func purgeGeoCache(g *GeoCache, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := g.Purge(); err != nil {
+			slog.Error("Failed to purge geolocation cache", "error", err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errGeoUnavailable is returned when every geolocation provider is skipped,
+// their circuit breakers being open, so lookups aren't retried until one
+// closes.
+var errGeoUnavailable = errors.New("no geolocation provider available")
+
+// geoRateLimitError is returned by a provider over its rate limit, to be left
+// alone for Wait. The provider may have answered the lookup all the same,
+// when it warns ahead of the limit.
+type geoRateLimitError struct {
+	Wait time.Duration
+}
+
+func (e *geoRateLimitError) Error() string {
+	return fmt.Sprintf("rate limited for %s", e.Wait)
+}
+
+// geoProvider is a link of the geolocation chain.
+type geoProvider struct {
+	name string
+	// online is whether lookups reach a remote API, consuming its quota
+	online  bool
+	enabled func() bool
+	lookup  func(host string, ctx context.Context, tracer trace.Tracer) (IPInfo, error)
+	breaker *geoBreaker
+}
+
+// geoProviders are the providers GEO_PROVIDERS picks from, by name.
+var geoProviders = map[string]func() geoProvider{
+	"geolite2": func() geoProvider {
+		return geoProvider{
+			enabled: func() bool { return geoipCity != nil || geoipASN != nil },
+			lookup:  getGeoIP,
+		}
+	},
+	"ipinfo.io": func() geoProvider {
+		pool := newIPInfoTokenPool(getEnvInt("IPINFOIO_MONTHLY_QUOTA", 50000), getEnvInt("IPINFOIO_QUOTA_RESERVE", 500))
+		return geoProvider{
+			online:  true,
+			enabled: func() bool { return !geoipOffline && currentSettings().IPInfoToken != "" },
+			lookup: func(host string, ctx context.Context, tracer trace.Tracer) (IPInfo, error) {
+				tmp, err := pool.lookup(host, splitList(currentSettings().IPInfoToken), ctx, tracer)
+				return IPInfo{
+					IP:        host,
+					City:      tmp.City,
+					Region:    tmp.Region,
+					Country:   tmp.Country,
+					Latitude:  tmp.Latitude,
+					Longitude: tmp.Longitude,
+					Org:       tmp.Org,
+					Timezone:  tmp.Timezone,
+				}, err
+			},
+		}
+	},
+	"ip-api.com": func() geoProvider {
+		return geoProvider{
+			online:  true,
+			enabled: func() bool { return !geoipOffline },
+			lookup: func(host string, ctx context.Context, tracer trace.Tracer) (IPInfo, error) {
+				tmp, err := getIpApi(host, ctx, tracer)
+				return IPInfo{
+					IP:        host,
+					City:      tmp.City,
+					Region:    tmp.Region,
+					Country:   tmp.Country,
+					Latitude:  tmp.Lat,
+					Longitude: tmp.Lon,
+					Org:       tmp.Org,
+					Timezone:  tmp.Timezone,
+				}, err
+			},
+		}
+	},
+}
+
+// geoChain is the ordered list of geolocation providers, tried in turn until
+// one answers.
+var geoChain []geoProvider
+
+// setupGeoChain builds geoChain from the comma separated provider names,
+// each failing threshold times in a row being skipped for cooldown.
+func setupGeoChain(names []string, threshold int, cooldown time.Duration) error {
+	geoChain = nil
+	for _, name := range names {
+		newProvider, ok := geoProviders[name]
+		if !ok {
+			return fmt.Errorf("unknown geolocation provider '%s', expected 'geolite2', 'ipinfo.io' or 'ip-api.com'", name)
+		}
+		provider := newProvider()
+		provider.name = name
+		provider.breaker = newGeoBreaker(name, threshold, cooldown)
+		geoChain = append(geoChain, provider)
+	}
+
+	return nil
+}
+
+// lookupIpInfo asks the providers of the chain in turn, skipping those
+// unconfigured or whose breaker is open, and the online ones when offlineOnly
+// is set, and returns the first answer and the provider that gave it.
+func lookupIpInfo(host string, ctx context.Context, tracer trace.Tracer, offlineOnly bool) (IPInfo, string, error) {
+	childCtx, span := tracer.Start(
+		ctx,
+		"lookupIpInfo")
+	defer span.End()
+
+	var errs []error
+	for _, provider := range geoChain {
+		if !provider.enabled() || (offlineOnly && provider.online) {
+			continue
+		}
+		if !provider.breaker.Allow() {
+			span.AddEvent("Skipping provider with an open circuit breaker", trace.WithAttributes(attribute.String("provider", provider.name)))
+			continue
+		}
+
+		ipInfo, err := provider.lookup(host, childCtx, tracer)
+		var limited *geoRateLimitError
+		if errors.As(err, &limited) {
+			provider.breaker.Pause(limited.Wait)
+			if ipInfo.Country != "" || ipInfo.Org != "" {
+				err = nil
+			}
+		} else if err != nil {
+			provider.breaker.Failure()
+		} else {
+			provider.breaker.Success()
+		}
+		if err != nil {
+			slog.WarnContext(childCtx, "Geolocation provider failed, trying the next one", "provider", provider.name, "remote_host", host, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", provider.name, err))
+			continue
+		}
+
+		span.AddEvent("Got IP info from " + provider.name)
+		metrics.RecordGeoLookup(ctx, provider.name)
+		span.SetStatus(codes.Ok, fmt.Sprintf("Got IP info from %s for '%s'", provider.name, host))
+		return ipInfo, provider.name, nil
+	}
+
+	err := errGeoUnavailable
+	if len(errs) > 0 {
+		err = errors.Join(errs...)
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return IPInfo{}, "", err
+}
+
+// geoBreaker is the circuit breaker of a provider: once threshold lookups
+// failed in a row, or the provider reported being over its rate limit, it
+// opens and the provider is skipped. When the cooldown is over, a single
+// lookup is let through to probe the provider, closing the breaker again on
+// success or opening it for another cooldown on failure.
+type geoBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newGeoBreaker(name string, threshold int, cooldown time.Duration) *geoBreaker {
+	return &geoBreaker{name: name, threshold: max(threshold, 1), cooldown: cooldown}
+}
+
+// Allow reports whether a lookup may be made.
+func (b *geoBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+
+	return true
+}
+
+func (b *geoBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.openUntil.IsZero() {
+		slog.Info("Geolocation provider recovered, closing its circuit breaker", "provider", b.name)
+	}
+	b.failures, b.openUntil, b.probing = 0, time.Time{}, false
+}
+
+func (b *geoBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.open(b.cooldown)
+	}
+}
+
+// Pause opens the breaker for wait, the cooldown when not given.
+func (b *geoBreaker) Pause(wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if wait <= 0 {
+		wait = b.cooldown
+	}
+	b.open(wait)
+}
+
+func (b *geoBreaker) open(wait time.Duration) {
+	if b.openUntil.IsZero() {
+		slog.Warn("Opening the circuit breaker of geolocation provider", "provider", b.name, "failures", b.failures, "wait", wait)
+		metrics.RecordGeoBreakerOpen(b.name)
+	}
+	b.openUntil = time.Now().Add(wait)
+	b.probing = false
+}
+
+// geoProviderNames lists the providers of GEO_PROVIDERS for logging.
+func geoProviderNames() string {
+	names := make([]string, 0, len(geoChain))
+	for _, provider := range geoChain {
+		if provider.enabled() {
+			names = append(names, provider.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
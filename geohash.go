@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// encodeGeohash encodes a coordinate as a geohash of precision characters.
+func encodeGeohash(latitude float64, longitude float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+
+	var hash strings.Builder
+	even := true
+	bit, index := 0, 0
+	for hash.Len() < precision {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if longitude >= mid {
+				index = index<<1 | 1
+				lonRange[0] = mid
+			} else {
+				index <<= 1
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if latitude >= mid {
+				index = index<<1 | 1
+				latRange[0] = mid
+			} else {
+				index <<= 1
+				latRange[1] = mid
+			}
+		}
+		even = !even
+
+		if bit++; bit == 5 {
+			hash.WriteByte(geohashAlphabet[index])
+			bit, index = 0, 0
+		}
+	}
+
+	return hash.String()
+}
+
+// decodeGeohash returns the centre of the geohash cell.
+func decodeGeohash(hash string) (float64, float64) {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+
+	even := true
+	for _, c := range hash {
+		index := strings.IndexRune(geohashAlphabet, c)
+		for shift := 4; shift >= 0; shift-- {
+			r := &latRange
+			if even {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if index>>shift&1 == 1 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+
+	return (latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2
+}
+
+type GeohashCount struct {
+	Geohash   string  `json:"geohash"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int     `json:"count"`
+}
+
+// GeohashAggregator counts events per geohash cell, so map visualizations
+// can read one point per cell and interval instead of scanning raw events.
+type GeohashAggregator struct {
+	mu        sync.Mutex
+	precision int
+	pending   map[string]int
+	totals    map[string]int
+}
+
+func NewGeohashAggregator(precision int) *GeohashAggregator {
+	return &GeohashAggregator{
+		precision: precision,
+		pending:   map[string]int{},
+		totals:    map[string]int{},
+	}
+}
+
+func (g *GeohashAggregator) Observe(ctx context.Context, event Event) {
+	ipInfo := event.IPInfo
+	if ipInfo.Latitude == 0 && ipInfo.Longitude == 0 {
+		return
+	}
+
+	hash := encodeGeohash(ipInfo.Latitude, ipInfo.Longitude, g.precision)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.pending[hash]++
+}
+
+// Flush returns the counts since the previous flush as InfluxDB points and
+// adds them to the totals.
+func (g *GeohashAggregator) Flush(now time.Time) []*write.Point {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	points := make([]*write.Point, 0, len(g.pending))
+	for hash, count := range g.pending {
+		latitude, longitude := decodeGeohash(hash)
+		points = append(points, influxdb2.NewPointWithMeasurement("geohash").
+			AddTag("geohash", hash).
+			AddField("count", count).
+			AddField("latitude", latitude).
+			AddField("longitude", longitude).
+			SetTime(now))
+
+		g.totals[hash] += count
+	}
+	g.pending = map[string]int{}
+
+	return points
+}
+
+// Totals returns the counts per cell since startup, busiest first.
+func (g *GeohashAggregator) Totals() []GeohashCount {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	totals := make([]GeohashCount, 0, len(g.totals)+len(g.pending))
+	for hash, count := range g.totals {
+		latitude, longitude := decodeGeohash(hash)
+		totals = append(totals, GeohashCount{
+			Geohash:   hash,
+			Latitude:  latitude,
+			Longitude: longitude,
+			Count:     count + g.pending[hash],
+		})
+	}
+	for hash, count := range g.pending {
+		if _, found := g.totals[hash]; found {
+			continue
+		}
+		latitude, longitude := decodeGeohash(hash)
+		totals = append(totals, GeohashCount{
+			Geohash:   hash,
+			Latitude:  latitude,
+			Longitude: longitude,
+			Count:     count,
+		})
+	}
+
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Count != totals[j].Count {
+			return totals[i].Count > totals[j].Count
+		}
+		return totals[i].Geohash < totals[j].Geohash
+	})
+
+	return totals
+}
+
+// writeGeohashes periodically writes the geohash counts to InfluxDB.
+func writeGeohashes(aggregator *GeohashAggregator, writeAPI InfluxdbWriteAPI, interval time.Duration, tracer trace.Tracer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		points := aggregator.Flush(now)
+		if len(points) == 0 {
+			continue
+		}
+
+		ctx, span := tracer.Start(
+			context.Background(),
+			"writeGeohashes")
+
+		err := writeAPI.WriteAPIBlocking.WritePoint(ctx, points...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.ErrorContext(ctx, "Failed to write geohash counts", "error", err)
+		} else {
+			span.SetStatus(codes.Ok, "Wrote geohash counts")
+		}
+		span.End()
+	}
+}
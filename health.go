@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// HealthCheck returns an error when what it checks is unusable.
+type HealthCheck func(ctx context.Context) error
+
+type healthCheck struct {
+	name     string
+	check    HealthCheck
+	liveness bool
+}
+
+// CheckResult is the outcome of a HealthCheck.
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Ignored checks are reported without failing readiness
+	Ignored bool `json:"ignored,omitempty"`
+}
+
+// HealthReport is the body of the health probes.
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// Health runs the checks behind the liveness and readiness probes. Liveness
+// only runs the checks registered for it, readiness runs them all but the
+// ignored ones.
+type Health struct {
+	mu      sync.Mutex
+	checks  []healthCheck
+	ignored map[string]bool
+	timeout time.Duration
+}
+
+func NewHealth(ignored []string, timeout time.Duration) *Health {
+	h := &Health{ignored: map[string]bool{}, timeout: timeout}
+	for _, name := range ignored {
+		h.ignored[name] = true
+	}
+
+	return h
+}
+
+// Register adds a check, to the liveness probe as well as the readiness one
+// when liveness is set.
+func (h *Health) Register(name string, check HealthCheck, liveness bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks = append(h.checks, healthCheck{name: name, check: check, liveness: liveness})
+}
+
+// Run runs the checks of the liveness or readiness probe concurrently,
+// reporting whether they all passed.
+func (h *Health) Run(ctx context.Context, liveness bool) (HealthReport, bool) {
+	h.mu.Lock()
+	var checks []healthCheck
+	for _, check := range h.checks {
+		if !liveness || check.liveness {
+			checks = append(checks, check)
+		}
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+
+			results[i] = CheckResult{Name: check.name, Status: "ok", Ignored: !liveness && h.ignored[check.name]}
+			if err := check.check(ctx); err != nil {
+				results[i].Status = "failing"
+				results[i].Error = err.Error()
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	healthy := true
+	for _, result := range results {
+		if result.Status != "ok" && !result.Ignored {
+			healthy = false
+		}
+	}
+	report := HealthReport{Status: "ok", Checks: results}
+	if !healthy {
+		report.Status = "failing"
+	}
+
+	return report, healthy
+}
+
+// Handler serves the liveness or readiness probe, answering 503 Service
+// Unavailable when a check fails.
+func (h *Health) Handler(liveness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, healthy := h.Run(r.Context(), liveness)
+		if !healthy {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, report)
+	})
+}
+
+// listenerCheck passes while the supervised listener name is serving.
+func listenerCheck(supervisor *Supervisor, name string) HealthCheck {
+	return func(ctx context.Context) error {
+		for _, status := range supervisor.Statuses() {
+			if status.Name != name {
+				continue
+			}
+			if status.State != ListenerRunning {
+				if status.LastError != "" {
+					return fmt.Errorf("listener %s: %s", status.State, status.LastError)
+				}
+				return fmt.Errorf("listener %s", status.State)
+			}
+			return nil
+		}
+
+		return errors.New("listener not started")
+	}
+}
+
+// tcpCheck passes while addr accepts connections.
+func tcpCheck(addr string) HealthCheck {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// grpcConnCheck passes while conn is connected, or idle and able to
+// reconnect on use.
+func grpcConnCheck(conn *grpc.ClientConn) HealthCheck {
+	return func(ctx context.Context) error {
+		if conn == nil {
+			return errors.New("not connected")
+		}
+
+		switch state := conn.GetState(); state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Idle:
+			conn.Connect()
+			return nil
+		default:
+			return fmt.Errorf("connection %s", state)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// Honeytokens are the credentials planted as bait, e.g. in a leaked file,
+// given as "user:password", as a password alone matching any user, or as the
+// "SHA256:" or "MD5:" fingerprint of a public key.
+type Honeytokens struct {
+	credentials  map[string]struct{}
+	passwords    map[string]struct{}
+	fingerprints map[string]struct{}
+}
+
+func NewHoneytokens(honeytokens []string) *Honeytokens {
+	h := &Honeytokens{credentials: map[string]struct{}{}, passwords: map[string]struct{}{}, fingerprints: map[string]struct{}{}}
+	for _, honeytoken := range honeytokens {
+		switch {
+		case strings.HasPrefix(honeytoken, "SHA256:"), strings.HasPrefix(honeytoken, "MD5:"):
+			h.fingerprints[honeytoken] = struct{}{}
+		case strings.Contains(honeytoken, ":"):
+			h.credentials[honeytoken] = struct{}{}
+		default:
+			h.passwords[honeytoken] = struct{}{}
+		}
+	}
+
+	return h
+}
+
+// Enabled reports whether any honeytoken is configured.
+func (h *Honeytokens) Enabled() bool {
+	return len(h.credentials)+len(h.passwords)+len(h.fingerprints) > 0
+}
+
+// Match reports whether the authentication attempt of sshInfo used one of
+// the honeytokens.
+func (h *Honeytokens) Match(sshInfo SSHInfo) bool {
+	if isPasswordAttempt(sshInfo) {
+		_, credential := h.credentials[sshInfo.User+":"+sshInfo.Password]
+		_, password := h.passwords[sshInfo.Password]
+		return credential || password
+	}
+	if sshInfo.Function == "public_key" {
+		_, sha256 := h.fingerprints[sshInfo.KeyFingerprint]
+		_, md5 := h.fingerprints[sshInfo.KeyMD5]
+		return sha256 || md5
+	}
+
+	return false
+}
+
+// Capture wraps capture to follow every attempt using a honeytoken with a
+// "honeytoken" event of its own, a copy of the attempt.
+func (h *Honeytokens) Capture(capture func(SSHInfo) bool) func(SSHInfo) bool {
+	if !h.Enabled() {
+		return capture
+	}
+
+	return func(sshInfo SSHInfo) bool {
+		captured := capture(sshInfo)
+		if h.Match(sshInfo) {
+			slog.Warn("Honeytoken used", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "method", sshInfo.Function, "key_fingerprint", sshInfo.KeyFingerprint)
+			sshInfo.Function = "honeytoken"
+			capture(sshInfo)
+		}
+
+		return captured
+	}
+}
+
+// AlertRules adds the honeytoken rule to ruleNames when honeytokens are
+// configured, as their use is always alerted on.
+func (h *Honeytokens) AlertRules(ruleNames []string) []string {
+	if !h.Enabled() {
+		return ruleNames
+	}
+
+	return withAlertRule(ruleNames, "honeytoken")
+}
+
+// withAlertRule adds rule to ruleNames unless listed already.
+func withAlertRule(ruleNames []string, rule string) []string {
+	for _, name := range ruleNames {
+		if strings.TrimSpace(name) == rule {
+			return ruleNames
+		}
+	}
+
+	return append(ruleNames[:len(ruleNames):len(ruleNames)], rule)
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// hostKeyTypes maps the host key types GenerateKey supports to their SSH
+// algorithm. RSA is the one every client, including old bots, can negotiate,
+// while current OpenSSH servers present Ed25519 or ECDSA keys first.
+var hostKeyTypes = map[string]string{
+	"rsa":     gossh.KeyAlgoRSA,
+	"ecdsa":   gossh.KeyAlgoECDSA256,
+	"ed25519": gossh.KeyAlgoED25519,
+}
+
+// hostKeySlot is a served host key, next being the key replacing it while a
+// rotation is pending.
+type hostKeySlot struct {
+	path    string
+	keyType string
+	signer  gossh.Signer
+	next    gossh.Signer
+}
+
+// HostKeyRing holds the served host keys and rotates them. A rotation
+// generates a new key for every slot, saved as <path>.next, which is
+// announced to clients through OpenSSH's hostkeys-00@openssh.com extension
+// for the overlap window, the previous key staying active meanwhile, before
+// replacing it. Clients with UpdateHostKeys enabled so learn the new keys
+// before they are presented.
+type HostKeyRing struct {
+	overlap time.Duration
+	tracer  trace.Tracer
+
+	mu        sync.RWMutex
+	slots     []*hostKeySlot
+	promoteAt time.Time
+	timer     *time.Timer
+}
+
+// NewHostKeyRing loads a host key of each of keyTypes, generating the missing
+// ones. The key at path, of the first type when generated, is always served,
+// those of the other types are next to it, at path_<type>, like OpenSSH's
+// ssh_host_<type>_key. A rotation interrupted by a restart is resumed.
+func NewHostKeyRing(path string, keyTypes []string, overlap time.Duration, tracer trace.Tracer) (*HostKeyRing, error) {
+	for _, keyType := range keyTypes {
+		if _, ok := hostKeyTypes[keyType]; !ok {
+			return nil, fmt.Errorf("unknown host key type '%s'", keyType)
+		}
+	}
+	if len(keyTypes) == 0 {
+		return nil, errors.New("no host key type")
+	}
+
+	r := &HostKeyRing{overlap: overlap, tracer: tracer}
+	served := make(map[string]bool)
+	load := func(keyPath string, keyType string) error {
+		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+			slog.Info("Generating host key", "path", keyPath, "type", keyType)
+			if _, err := GenerateKey(keyPath, keyType); err != nil {
+				return fmt.Errorf("failed to generate %s: %v", keyPath, err)
+			}
+		}
+
+		signer, err := loadHostKey(keyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %v", keyPath, err)
+		}
+		slot := &hostKeySlot{path: keyPath, signer: signer}
+		for name, algorithm := range hostKeyTypes {
+			if algorithm == signer.PublicKey().Type() {
+				slot.keyType = name
+			}
+		}
+		r.slots = append(r.slots, slot)
+		served[signer.PublicKey().Type()] = true
+		return nil
+	}
+
+	if err := load(path, keyTypes[0]); err != nil {
+		return nil, err
+	}
+	for _, keyType := range keyTypes {
+		if !served[hostKeyTypes[keyType]] {
+			if err := load(path+"_"+keyType, keyType); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Resume the overlap from when the pending keys were generated
+	for _, slot := range r.slots {
+		info, err := os.Stat(slot.path + ".next")
+		if err != nil {
+			continue
+		}
+		if slot.next, err = loadHostKey(slot.path + ".next"); err != nil {
+			return nil, fmt.Errorf("failed to load %s.next: %v", slot.path, err)
+		}
+		if promoteAt := info.ModTime().Add(overlap); r.promoteAt.IsZero() || promoteAt.Before(r.promoteAt) {
+			r.promoteAt = promoteAt
+		}
+	}
+	if !r.promoteAt.IsZero() {
+		slog.Info("Resuming host key rotation", "promote_at", r.promoteAt)
+		r.timer = time.AfterFunc(time.Until(r.promoteAt), r.promote)
+	}
+
+	return r, nil
+}
+
+func loadHostKey(hostKeyPath string) (ssh.Signer, error) {
+	keyBytes, err := os.ReadFile(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := gossh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// Signers returns a signer for every slot, signing with whichever key is
+// active in it, so rotations apply to new connections without restarting the
+// server.
+func (r *HostKeyRing) Signers() []ssh.Signer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	signers := make([]ssh.Signer, len(r.slots))
+	for i := range r.slots {
+		signers[i] = hostKeySigner{ring: r, slot: i}
+	}
+	return signers
+}
+
+// Rotate generates a new key for every slot, promoted once the overlap
+// window is over.
+func (r *HostKeyRing) Rotate() error {
+	_, span := r.tracer.Start(
+		context.Background(),
+		"rotateHostKeys",
+		trace.WithAttributes(attribute.String("overlap", r.overlap.String())))
+	defer span.End()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.promoteAt.IsZero() {
+		err := fmt.Errorf("a rotation is already pending until %s", r.promoteAt.Format(time.RFC3339))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	for _, slot := range r.slots {
+		if slot.keyType == "" {
+			slog.Warn("Not rotating host key of a type that can't be generated", "path", slot.path, "type", slot.signer.PublicKey().Type())
+			continue
+		}
+		if _, err := GenerateKey(slot.path+".next", slot.keyType); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("failed to generate %s.next: %v", slot.path, err)
+		}
+		next, err := loadHostKey(slot.path + ".next")
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("failed to load %s.next: %v", slot.path, err)
+		}
+		slot.next = next
+		span.AddEvent("Generated host key", trace.WithAttributes(
+			attribute.String("path", slot.path),
+			attribute.String("fingerprint", gossh.FingerprintSHA256(next.PublicKey()))))
+		slog.Info("Rotating host key", "path", slot.path,
+			"fingerprint", gossh.FingerprintSHA256(slot.signer.PublicKey()), "next_fingerprint", gossh.FingerprintSHA256(next.PublicKey()))
+	}
+
+	r.promoteAt = time.Now().Add(r.overlap)
+	r.timer = time.AfterFunc(r.overlap, r.promote)
+	span.SetStatus(codes.Ok, fmt.Sprintf("Host keys promoted at %s", r.promoteAt.Format(time.RFC3339)))
+	return nil
+}
+
+// promote replaces the keys of every slot by the pending ones.
+func (r *HostKeyRing) promote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, slot := range r.slots {
+		if slot.next == nil {
+			continue
+		}
+		for _, suffix := range []string{"", ".pub"} {
+			if err := os.Rename(slot.path+".next"+suffix, slot.path+suffix); err != nil {
+				slog.Error("Failed to replace host key, the new one is only active until restart", "path", slot.path+suffix, "error", err)
+			}
+		}
+		slot.signer, slot.next = slot.next, nil
+		slog.Info("Host key rotated", "path", slot.path, "fingerprint", gossh.FingerprintSHA256(slot.signer.PublicKey()))
+	}
+
+	r.promoteAt, r.timer = time.Time{}, nil
+	metrics.RecordHostKeyRotation()
+}
+
+// Run rotates the keys every interval, when positive, and on SIGUSR1, until
+// ctx is done.
+func (r *HostKeyRing) Run(ctx context.Context, interval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			slog.Info("Received SIGUSR1, rotating host keys")
+		case <-ticks:
+		}
+		if err := r.Rotate(); err != nil {
+			slog.Error("Failed to rotate host keys", "error", err)
+		}
+	}
+}
+
+// HostKeyInfo describes a served host key for the API.
+type HostKeyInfo struct {
+	Path            string     `json:"path"`
+	Type            string     `json:"type"`
+	Fingerprint     string     `json:"fingerprint"`
+	NextFingerprint string     `json:"next_fingerprint,omitempty"`
+	PromoteAt       *time.Time `json:"promote_at,omitempty"`
+}
+
+func (r *HostKeyRing) Keys() []HostKeyInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]HostKeyInfo, 0, len(r.slots))
+	for _, slot := range r.slots {
+		key := HostKeyInfo{
+			Path:        slot.path,
+			Type:        slot.signer.PublicKey().Type(),
+			Fingerprint: gossh.FingerprintSHA256(slot.signer.PublicKey()),
+		}
+		if slot.next != nil {
+			promoteAt := r.promoteAt
+			key.NextFingerprint = gossh.FingerprintSHA256(slot.next.PublicKey())
+			key.PromoteAt = &promoteAt
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// pending returns the active and pending keys while a rotation is pending.
+func (r *HostKeyRing) pending() []gossh.Signer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.promoteAt.IsZero() {
+		return nil
+	}
+	var signers []gossh.Signer
+	for _, slot := range r.slots {
+		signers = append(signers, slot.signer)
+		if slot.next != nil {
+			signers = append(signers, slot.next)
+		}
+	}
+	return signers
+}
+
+// hostKeyRingKey holds the ring of the listener of a connection in its
+// ssh.Context.
+type hostKeyRingKey struct{}
+
+func connHostKeys(ctx ssh.Context) *HostKeyRing {
+	return ctx.Value(hostKeyRingKey{}).(*HostKeyRing)
+}
+
+// Announce sends the client of an authenticated connection every host key,
+// active and pending, while a rotation is pending, as OpenSSH does after
+// authentication.
+func (r *HostKeyRing) Announce(ctx ssh.Context) {
+	signers := r.pending()
+	if signers == nil {
+		return
+	}
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return
+	}
+
+	var payload []byte
+	for _, signer := range signers {
+		payload = append(payload, gossh.Marshal(struct{ Key []byte }{signer.PublicKey().Marshal()})...)
+	}
+	if _, _, err := conn.SendRequest("hostkeys-00@openssh.com", false, payload); err != nil {
+		slog.Debug("Failed to announce host keys", "remote_host", ctx.RemoteAddr().String(), "error", err)
+	}
+}
+
+// HandleProve answers the hostkeys-prove-00@openssh.com requests of clients
+// checking the announced keys, signing for each of them the request name,
+// the session ID and the key.
+func (r *HostKeyRing) HandleProve(ctx ssh.Context, _ *ssh.Server, req *gossh.Request) (bool, []byte) {
+	sessionID, err := hex.DecodeString(ctx.SessionID())
+	if err != nil {
+		return false, nil
+	}
+
+	signers := make(map[string]gossh.Signer)
+	for _, signer := range r.pending() {
+		signers[string(signer.PublicKey().Marshal())] = signer
+	}
+
+	var response []byte
+	rest := req.Payload
+	for len(rest) > 0 {
+		var key struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := gossh.Unmarshal(rest, &key); err != nil {
+			return false, nil
+		}
+		rest = key.Rest
+
+		signer, ok := signers[string(key.Key)]
+		if !ok {
+			return false, nil
+		}
+		data := gossh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{"hostkeys-prove-00@openssh.com", sessionID, key.Key})
+
+		var signature *gossh.Signature
+		if algorithmSigner, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+			signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, gossh.KeyAlgoRSASHA512)
+		} else {
+			signature, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return false, nil
+		}
+		response = append(response, gossh.Marshal(struct{ Signature []byte }{gossh.Marshal(signature)})...)
+	}
+
+	return true, response
+}
+
+// hostKeySigner signs with the active key of a slot of its ring. A rotation
+// promoted during a handshake, between the key being sent and used to sign,
+// fails that handshake, which clients retry.
+type hostKeySigner struct {
+	ring *HostKeyRing
+	slot int
+}
+
+func (s hostKeySigner) signer() gossh.Signer {
+	s.ring.mu.RLock()
+	defer s.ring.mu.RUnlock()
+	return s.ring.slots[s.slot].signer
+}
+
+func (s hostKeySigner) PublicKey() gossh.PublicKey {
+	return s.signer().PublicKey()
+}
+
+func (s hostKeySigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return s.signer().Sign(rand, data)
+}
+
+func (s hostKeySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	signer, ok := s.signer().(gossh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("host key doesn't support algorithm %s", algorithm)
+	}
+	return signer.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// GenerateKey generates a host key of keyType, saving its private key as PEM
+// to keyName and its public key to keyName.pub.
+func GenerateKey(keyName string, keyType string) (crypto.Signer, error) {
+	var privateKey crypto.Signer
+	var privateBlock *pem.Block
+	switch keyType {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+		privateBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+		privateBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+		privateBlock = &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}
+	default:
+		return nil, fmt.Errorf("unknown host key type '%s'", keyType)
+	}
+
+	// Save private key
+	if err := os.WriteFile(keyName, pem.EncodeToMemory(privateBlock), 0o600); err != nil {
+		return nil, err
+	}
+
+	// Save public key
+	publicBytes, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	publicBlock := &pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicBytes,
+	}
+
+	if err := os.WriteFile(keyName+".pub", pem.EncodeToMemory(publicBlock), 0o644); err != nil {
+		return nil, err
+	}
+
+	return privateKey, nil
+}
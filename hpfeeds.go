@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HPFeeds opcodes
+const (
+	hpfeedsOpError   = 0
+	hpfeedsOpInfo    = 1
+	hpfeedsOpAuth    = 2
+	hpfeedsOpPublish = 3
+)
+
+const (
+	// maxHPFeedsMessage bounds the messages read from the broker
+	maxHPFeedsMessage = 1024 * 1024
+	// maxHPFeedsSessions bounds the sessions followed in the cowrie format
+	maxHPFeedsSessions = 10000
+	// maxHPFeedsOutbox bounds the sessions waiting to be published
+	maxHPFeedsOutbox = 1000
+)
+
+// hpfeedsSession is a session as cowrie's hpfeeds output publishes it once
+// it is closed, the layout CHN and MHN expect on the cowrie.sessions channel.
+type hpfeedsSession struct {
+	Session         string      `json:"session"`
+	StartTime       string      `json:"startTime"`
+	EndTime         string      `json:"endTime"`
+	PeerIP          string      `json:"peerIP"`
+	PeerPort        int         `json:"peerPort"`
+	HostIP          string      `json:"hostIP"`
+	HostPort        int         `json:"hostPort"`
+	LoggedIn        []string    `json:"loggedin"`
+	Credentials     [][2]string `json:"credentials"`
+	Commands        []string    `json:"commands"`
+	UnknownCommands []string    `json:"unknownCommands"`
+	URLs            []string    `json:"urls"`
+	Version         *string     `json:"version"`
+	TTYLog          *string     `json:"ttylog"`
+	Hashes          []string    `json:"hashes"`
+	Protocol        string      `json:"protocol"`
+
+	// The events folded in, so retried batches aren't counted twice
+	events map[string]struct{}
+	last   time.Time
+	seen   time.Time
+}
+
+// HPFeedsSink publishes to an HPFeeds broker, as the honeynet project tools,
+// CHN and MHN among them, consume honeypot data. In the "cowrie" format, a
+// summary of every session is published once it ends, or has been idle for a
+// while, as cowrie does; in the "document" format, every event is published
+// as a JSON EventDocument.
+type HPFeedsSink struct {
+	addr    string
+	ident   string
+	secret  string
+	channel string
+	format  string
+	idle    time.Duration
+	tracer  trace.Tracer
+
+	mu       sync.Mutex
+	conn     net.Conn
+	sessions map[string]*hpfeedsSession
+	// published remembers the sessions already published, for a while, so
+	// their retried events don't open them again
+	published map[string]time.Time
+	outbox    [][]byte
+
+	done chan struct{}
+}
+
+func NewHPFeedsSink(addr string, ident string, secret string, channel string, format string, idle time.Duration, tracer trace.Tracer) (*HPFeedsSink, error) {
+	if format != "cowrie" && format != "document" {
+		return nil, fmt.Errorf("unknown HPFeeds format '%s', expected 'cowrie' or 'document'", format)
+	}
+	if len(ident) > 255 || len(channel) > 255 {
+		return nil, fmt.Errorf("the HPFeeds ident and channel are at most 255 bytes")
+	}
+
+	s := &HPFeedsSink{
+		addr:      addr,
+		ident:     ident,
+		secret:    secret,
+		channel:   channel,
+		format:    format,
+		idle:      idle,
+		tracer:    tracer,
+		sessions:  map[string]*hpfeedsSession{},
+		published: map[string]time.Time{},
+		done:      make(chan struct{}),
+	}
+	s.mu.Lock()
+	err := s.connect()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if format == "cowrie" {
+		go s.run()
+	}
+
+	return s, nil
+}
+
+func hpfeedsSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	addr := os.Getenv("HPFEEDS_HOST")
+	if addr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "10000")
+	}
+	ident := os.Getenv("HPFEEDS_IDENT")
+	if ident == "" {
+		return nil, fmt.Errorf("HPFEEDS_IDENT is required to publish to HPFeeds")
+	}
+	format := getEnv("HPFEEDS_FORMAT", "cowrie")
+	channel := "cowrie.sessions"
+	if format == "document" {
+		channel = "ssh-honeypot.events"
+	}
+
+	return NewHPFeedsSink(addr, ident, os.Getenv("HPFEEDS_SECRET"), getEnv("HPFEEDS_CHANNEL", channel), format,
+		getEnvDuration("HPFEEDS_SESSION_IDLE", 5*time.Minute), tracer)
+}
+
+func (s *HPFeedsSink) Name() string {
+	return "hpfeeds"
+}
+
+func (s *HPFeedsSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToHPFeeds",
+		trace.WithAttributes(
+			attribute.Int("batch_size", len(batch.Events)),
+			attribute.String("channel", s.channel)))
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.format == "document" {
+		for _, event := range batch.Events {
+			var payload []byte
+			if payload, err = json.Marshal(newEventDocument(event)); err != nil {
+				break
+			}
+			if err = s.publish(payload); err != nil {
+				break
+			}
+		}
+	} else {
+		for _, event := range batch.Events {
+			s.fold(event.SSHInfo)
+		}
+		err = s.flush()
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Published to %s", s.channel))
+	return nil
+}
+
+// fold adds the event to the summary of its session, moving the summary to
+// the outbox once the session ended.
+func (s *HPFeedsSink) fold(sshInfo SSHInfo) {
+	if sshInfo.SessionID == "" {
+		return
+	}
+	if _, found := s.published[sshInfo.SessionID]; found {
+		return
+	}
+
+	session, found := s.sessions[sshInfo.SessionID]
+	if !found {
+		if len(s.sessions) >= maxHPFeedsSessions {
+			return
+		}
+		remotePort, _ := strconv.Atoi(sshInfo.RemotePort)
+		localPort, _ := strconv.Atoi(sshInfo.LocalPort)
+		session = &hpfeedsSession{
+			Session:         sshInfo.SessionID,
+			StartTime:       sshInfo.Timestamp.UTC().Format(cowrieTimeFormat),
+			PeerIP:          sshInfo.RemoteHost,
+			PeerPort:        remotePort,
+			HostIP:          sshInfo.LocalHost,
+			HostPort:        localPort,
+			Credentials:     [][2]string{},
+			Commands:        []string{},
+			UnknownCommands: []string{},
+			URLs:            []string{},
+			Hashes:          []string{},
+			Protocol:        sshInfo.Protocol,
+			events:          map[string]struct{}{},
+		}
+		s.sessions[sshInfo.SessionID] = session
+	}
+	id := eventID(sshInfo)
+	if _, found := session.events[id]; found {
+		return
+	}
+	session.events[id] = struct{}{}
+	session.last, session.seen = sshInfo.Timestamp, time.Now()
+
+	if session.Version == nil && sshInfo.ClientVersion != "" {
+		version := sshInfo.ClientVersion
+		session.Version = &version
+	}
+	addHash := func(hash string) {
+		if hash != "" && !slices.Contains(session.Hashes, hash) {
+			session.Hashes = append(session.Hashes, hash)
+		}
+	}
+	switch sshInfo.Function {
+	case "password", "keyboard_interactive":
+		if sshInfo.Accepted {
+			session.LoggedIn = []string{sshInfo.User, sshInfo.Password}
+		} else {
+			session.Credentials = append(session.Credentials, [2]string{sshInfo.User, sshInfo.Password})
+		}
+	case "session", "command":
+		if sshInfo.Command != "" {
+			session.Commands = append(session.Commands, sshInfo.Command)
+		}
+	case "download":
+		if sshInfo.URL != "" {
+			session.URLs = append(session.URLs, sshInfo.URL)
+		}
+		addHash(sshInfo.FileSHA256)
+	case "file":
+		if sshInfo.FileOperation == "write" {
+			addHash(sshInfo.FileSHA256)
+		}
+	case "session_end":
+		s.close(session)
+	}
+}
+
+// close moves the summary of session to the outbox.
+func (s *HPFeedsSink) close(session *hpfeedsSession) {
+	session.EndTime = session.last.UTC().Format(cowrieTimeFormat)
+	delete(s.sessions, session.Session)
+	s.published[session.Session] = time.Now()
+
+	payload, err := json.Marshal(session)
+	if err != nil {
+		slog.Error("Failed to encode HPFeeds session", "session", session.Session, "error", err)
+		return
+	}
+	if len(s.outbox) >= maxHPFeedsOutbox {
+		slog.Warn("HPFeeds outbox full, dropping session", "session", session.Session)
+		return
+	}
+	s.outbox = append(s.outbox, payload)
+}
+
+// flush publishes the summaries in the outbox, keeping those that failed
+// for the next time.
+func (s *HPFeedsSink) flush() error {
+	for len(s.outbox) > 0 {
+		if err := s.publish(s.outbox[0]); err != nil {
+			return err
+		}
+		s.outbox = s.outbox[1:]
+	}
+
+	return nil
+}
+
+// run publishes the sessions that have been idle for a while, those of
+// connections closed without a session_end event, until Close.
+func (s *HPFeedsSink) run() {
+	ticker := time.NewTicker(min(s.idle, 10*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		now := time.Now()
+		for _, session := range s.sessions {
+			if now.Sub(session.seen) > s.idle {
+				s.close(session)
+			}
+		}
+		for id, published := range s.published {
+			if now.Sub(published) > time.Hour {
+				delete(s.published, id)
+			}
+		}
+		if err := s.flush(); err != nil {
+			slog.Warn("Failed to publish to HPFeeds", "error", err)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// connect connects and authenticates to the broker: it sends a nonce along
+// with its name, answered with the SHA-1 of the nonce and the secret.
+func (s *HPFeedsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	op, payload, err := readHPFeedsMessage(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if op == hpfeedsOpError {
+		conn.Close()
+		return fmt.Errorf("broker error: %s", payload)
+	}
+	if op != hpfeedsOpInfo || len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+		conn.Close()
+		return fmt.Errorf("unexpected message %d from the broker", op)
+	}
+	nonce := payload[1+int(payload[0]):]
+
+	hash := sha1.Sum(append(slices.Clone(nonce), s.secret...))
+	if _, err := conn.Write(hpfeedsMessage(hpfeedsOpAuth, hpfeedsString(s.ident), hash[:])); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.conn = conn
+	go s.watch(conn)
+	return nil
+}
+
+// watch reads what the broker sends on conn, only errors, such as failed
+// authentications, until the connection is closed.
+func (s *HPFeedsSink) watch(conn net.Conn) {
+	for {
+		op, payload, err := readHPFeedsMessage(conn)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Disconnected from HPFeeds broker", "error", err)
+			}
+			break
+		}
+		if op == hpfeedsOpError {
+			slog.Error("HPFeeds broker error", "error", string(payload))
+		}
+	}
+
+	conn.Close()
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.mu.Unlock()
+}
+
+// publish sends payload to the channel, connecting first if needed.
+func (s *HPFeedsSink) publish(payload []byte) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	message := hpfeedsMessage(hpfeedsOpPublish, hpfeedsString(s.ident), hpfeedsString(s.channel), payload)
+	if _, err := s.conn.Write(message); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// Close publishes the sessions in progress and disconnects.
+func (s *HPFeedsSink) Close() error {
+	if s.format == "cowrie" {
+		close(s.done)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, session := range s.sessions {
+		s.close(session)
+	}
+	err := s.flush()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+// hpfeedsMessage frames the parts of a message: its length, header included,
+// and opcode come first.
+func hpfeedsMessage(op byte, parts ...[]byte) []byte {
+	length := 5
+	for _, part := range parts {
+		length += len(part)
+	}
+
+	message := make([]byte, 5, length)
+	binary.BigEndian.PutUint32(message, uint32(length))
+	message[4] = op
+	for _, part := range parts {
+		message = append(message, part...)
+	}
+
+	return message
+}
+
+// hpfeedsString prefixes s with its length.
+func hpfeedsString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func readHPFeedsMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 5 || length > maxHPFeedsMessage {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+
+	payload := make([]byte, length-5)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[4], payload, nil
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	influxdb2api "github.com/influxdata/influxdb-client-go/v2/api"
+	influxdb2http "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -16,55 +27,242 @@ type InfluxdbWriteAPI struct {
 	WriteAPI         influxdb2api.WriteAPI
 }
 
-func writeToInfluxDB(writeAPI InfluxdbWriteAPI, ipInfo IPInfo, sshInfo SSHInfo, ctx context.Context, tracer trace.Tracer) error {
+// InfluxTarget is where events are written to, in terms of the InfluxDB 2.x
+// API: InfluxDB 1.8 takes its credentials as the token and its database and
+// retention policy as the bucket, and InfluxDB 3 its database as the bucket.
+type InfluxTarget struct {
+	Version int
+	Token   string
+	Org     string
+	Bucket  string
+}
+
+// influxTargetFromEnv returns the target for INFLUXDB_VERSION, 2 by default.
+func influxTargetFromEnv() (InfluxTarget, error) {
+	target := InfluxTarget{Version: getEnvInt("INFLUXDB_VERSION", 2)}
+	target.Token = influxTokenFromEnv(target.Version)
+	database := os.Getenv("INFLUXDB_DATABASE")
+
+	switch target.Version {
+	case 1:
+		if database == "" {
+			return target, errors.New("INFLUXDB_DATABASE is not set")
+		}
+		target.Bucket = database
+		if retentionPolicy := os.Getenv("INFLUXDB_RETENTION_POLICY"); retentionPolicy != "" {
+			target.Bucket += "/" + retentionPolicy
+		}
+	case 2:
+		target.Org, target.Bucket = os.Getenv("INFLUXDB_ORG"), os.Getenv("INFLUXDB_BUCKET")
+		if target.Token == "" {
+			return target, errors.New("INFLUXDB_TOKEN is not set")
+		}
+		if target.Org == "" {
+			return target, errors.New("INFLUXDB_ORG is not set")
+		}
+		if target.Bucket == "" {
+			return target, errors.New("INFLUXDB_BUCKET is not set")
+		}
+	case 3:
+		target.Bucket = database
+		if target.Token == "" {
+			return target, errors.New("INFLUXDB_TOKEN is not set")
+		}
+		if database == "" {
+			return target, errors.New("INFLUXDB_DATABASE is not set")
+		}
+		if os.Getenv("INFLUXDB_NON_BLOCKING_WRITES") == "true" {
+			return target, errors.New("non-blocking writes are not supported by InfluxDB 3")
+		}
+	default:
+		return target, fmt.Errorf("unsupported InfluxDB version %d", target.Version)
+	}
+
+	return target, nil
+}
+
+// influxTokenFromEnv returns the token to authenticate to InfluxDB version
+// with, its credentials for InfluxDB 1.8.
+func influxTokenFromEnv(version int) string {
+	if version != 1 {
+		return os.Getenv("INFLUXDB_TOKEN")
+	}
+
+	if username := os.Getenv("INFLUXDB_USERNAME"); username != "" {
+		return username + ":" + os.Getenv("INFLUXDB_PASSWORD")
+	}
+	return ""
+}
+
+// newInfluxDBClient returns a client batching non-blocking writes as
+// configured, rather than with the client defaults, and measuring its write
+// requests, each a flushed batch or a retry. Requests are authenticated with
+// the token currently in the environment, which secret files rotate.
+func newInfluxDBClient(url string, target InfluxTarget) influxdb2.Client {
+	maxRetries := uint(getEnvInt("INFLUXDB_MAX_RETRIES", 5))
+	options := influxdb2.DefaultOptions().
+		SetBatchSize(uint(getEnvInt("INFLUXDB_BATCH_SIZE", 5000))).
+		SetFlushInterval(uint(getEnvDuration("INFLUXDB_FLUSH_INTERVAL", time.Second).Milliseconds())).
+		SetMaxRetries(maxRetries).
+		SetRetryBufferLimit(uint(getEnvInt("INFLUXDB_RETRY_BUFFER_LIMIT", 50000))).
+		SetHTTPClient(&http.Client{
+			Timeout: 20 * time.Second,
+			Transport: influxTransport{
+				RoundTripper: http.DefaultTransport.(*http.Transport).Clone(),
+				version:      target.Version,
+			},
+		})
+
+	return influxdb2.NewClientWithOptions(url, target.Token, options)
+}
+
+// newInfluxdbWriteAPI returns the write APIs for target, counting the failed
+// batches of the non-blocking one. InfluxDB 3 is written to through its own
+// API, in blocking mode only.
+func newInfluxdbWriteAPI(client influxdb2.Client, target InfluxTarget) InfluxdbWriteAPI {
+	maxRetries := client.Options().MaxRetries()
+	writeAPI := client.WriteAPI(target.Org, target.Bucket)
+	writeAPI.SetWriteFailedCallback(func(batch string, err influxdb2http.Error, retryAttempts uint) bool {
+		retrying := retryAttempts < maxRetries
+		metrics.RecordInfluxFailure(retrying)
+		slog.Error("Failed to write to InfluxDB", "retry_attempts", retryAttempts, "retrying", retrying, "error", err.Error())
+		return true
+	})
+
+	writeAPIBlocking := client.WriteAPIBlocking(target.Org, target.Bucket)
+	if target.Version == 3 {
+		writeAPIBlocking = influx3WriteAPI{
+			url:      strings.TrimSuffix(client.ServerURL(), "/") + "/api/v3/write_lp?" + url.Values{"db": {target.Bucket}, "precision": {"nanosecond"}}.Encode(),
+			token:    target.Token,
+			client:   client.Options().HTTPClient(),
+			database: target.Bucket,
+		}
+	}
+
+	return InfluxdbWriteAPI{
+		WriteAPIBlocking: writeAPIBlocking,
+		WriteAPI:         writeAPI,
+	}
+}
+
+// influx3WriteAPI writes line protocol with the InfluxDB 3 write API.
+type influx3WriteAPI struct {
+	url      string
+	token    string
+	client   *http.Client
+	database string
+}
+
+func (w influx3WriteAPI) WriteRecord(ctx context.Context, line ...string) error {
+	var body bytes.Buffer
+	for _, record := range line {
+		body.WriteString(strings.TrimSuffix(record, "\n"))
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to write to database '%s': %s: %s", w.database, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+func (w influx3WriteAPI) WritePoint(ctx context.Context, point ...*write.Point) error {
+	lines := make([]string, len(point))
+	for i, p := range point {
+		lines[i] = write.PointToLineProtocol(p, time.Nanosecond)
+	}
+
+	return w.WriteRecord(ctx, lines...)
+}
+
+// EnableBatching is a no-op, batches are written as they come.
+func (w influx3WriteAPI) EnableBatching() {}
+
+func (w influx3WriteAPI) Flush(ctx context.Context) error {
+	return nil
+}
+
+// influxTransport authenticates requests to InfluxDB with the current token
+// and records the outcome of every write.
+type influxTransport struct {
+	http.RoundTripper
+	version int
+}
+
+func (t influxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if scheme, _, ok := strings.Cut(req.Header.Get("Authorization"), " "); ok {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", scheme+" "+influxTokenFromEnv(t.version))
+	}
+
+	started := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if req.Method == http.MethodPost && (strings.HasSuffix(req.URL.Path, "/write") || strings.HasSuffix(req.URL.Path, "/write_lp")) {
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode/100) + "xx"
+		}
+		metrics.RecordInfluxRequest(req.Context(), started, status)
+	}
+
+	return resp, err
+}
+
+// influxSink writes the line protocol encoded by the pipeline to InfluxDB.
+type influxSink struct {
+	writeAPI InfluxdbWriteAPI
+	tracer   trace.Tracer
+}
+
+func (s influxSink) Name() string {
+	return "influxdb"
+}
+
+func (s influxSink) Write(ctx context.Context, batch Batch) error {
+	return writeToInfluxDB(s.writeAPI, batch, ctx, s.tracer)
+}
+
+func writeToInfluxDB(writeAPI InfluxdbWriteAPI, batch Batch, ctx context.Context, tracer trace.Tracer) error {
 	_, span := tracer.Start(
 		ctx,
 		"writeToInfluxDB")
 	defer span.End()
 
-	point := influxdb2.NewPointWithMeasurement("request").
-		AddField("latitude", ipInfo.Latitude).
-		AddField("longitude", ipInfo.Longitude).
-		AddTag("ip", ipInfo.IP).
-		AddTag("country", ipInfo.Country).
-		AddTag("city", ipInfo.City).
-		AddTag("region", ipInfo.Region).
-		AddTag("org", ipInfo.Org).
-		AddTag("timezone", ipInfo.Timezone).
-		AddTag("user", sshInfo.User).
-		AddTag("remote_host", sshInfo.RemoteHost).
-		AddTag("remote_port", sshInfo.RemotePort).
-		AddTag("local_host", sshInfo.LocalHost).
-		AddTag("local_port", sshInfo.LocalPort).
-		AddTag("client_version", sshInfo.ClientVersion).
-		AddTag("function", sshInfo.Function).
-		AddTag("password", sshInfo.Password).
-		AddTag("key", sshInfo.Key).
-		SetTime(sshInfo.Timestamp)
+	// The batch is already encoded to line protocol by the pipeline, so it is
+	// handed to the client as a single multi-line record.
+	records := batch.Encoded.String()
 
 	if os.Getenv("INFLUXDB_NON_BLOCKING_WRITES") == "true" {
 		span.AddEvent("Writing to InfluxDB in non-blocking mode")
-		log.Printf("Writing to InfluxDB in non-blocking mode")
-		errorsCh := writeAPI.WriteAPI.Errors()
-		go func() error {
-			for err := range errorsCh {
-				span.RecordError(err)
-				span.SetStatus(codes.Error, err.Error())
-				log.Printf("write error: %s\n", err.Error())
-				return err
-			}
-
-			return nil
-		}()
-		writeAPI.WriteAPI.WritePoint(point)
+		slog.DebugContext(ctx, "Writing to InfluxDB in non-blocking mode", "events", len(batch.Events))
+		// One record per line, so the client batches points rather than
+		// pipeline batches; failures are reported by the write failed callback
+		for _, record := range strings.Split(strings.TrimSuffix(records, "\n"), "\n") {
+			writeAPI.WriteAPI.WriteRecord(record)
+		}
 	} else {
 		span.AddEvent("Writing to InfluxDB in blocking mode")
-		log.Printf("Writing to InfluxDB in blocking mode")
-		err := writeAPI.WriteAPIBlocking.WritePoint(context.Background(), point)
+		slog.DebugContext(ctx, "Writing to InfluxDB in blocking mode", "events", len(batch.Events))
+		err := writeAPI.WriteAPIBlocking.WriteRecord(ctx, records)
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			log.Printf("failed to write to InfluxDB: %v", err)
+			slog.ErrorContext(ctx, "Failed to write to InfluxDB", "error", err)
 			return err
 		}
 	}
@@ -5,14 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	cache "github.com/patrickmn/go-cache"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -46,24 +46,90 @@ type IpApi struct {
 }
 
 var (
-	c = cache.New(5*time.Minute, 10*time.Minute)
+	// ipApiLimit is shared by every lookup, so the enrichment workers
+	// together stay within the requests ip-api.com allows per minute
+	ipApiLimit = newWindowLimiter(ipApiRequestsPerMinute, ipApiReserve, time.Minute)
 )
 
+const (
+	// ipApiRequestsPerMinute is ip-api.com's free limit, assumed until a
+	// response tells how many requests are left
+	ipApiRequestsPerMinute = 45
+	// ipApiReserve requests are left unused, ip-api.com banning clients
+	// going over the limit and being shared with other clients of the IP
+	ipApiReserve = 16
+)
+
+// windowLimiter hands out the requests an API allows per window among
+// concurrent callers, making them wait for the next window once the
+// requests left are down to the reserve. The API responses tell how many
+// are left and when the window resets, which Update takes on.
+type windowLimiter struct {
+	limit   int
+	reserve int
+	window  time.Duration
+
+	mu        sync.Mutex
+	remaining int
+	reset     time.Time
+}
+
+func newWindowLimiter(limit int, reserve int, window time.Duration) *windowLimiter {
+	return &windowLimiter{limit: limit, reserve: reserve, window: window}
+}
+
+// Wait takes a request of the current window, waiting for the next one when
+// none are left, until ctx is done.
+func (l *windowLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		if !now.Before(l.reset) {
+			l.remaining, l.reset = l.limit, now.Add(l.window)
+		}
+		if l.remaining > l.reserve {
+			l.remaining--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := l.reset.Sub(now)
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Update sets the requests left and the time until the window resets, as
+// reported by a response. Within the same window, the requests taken since
+// are still counted.
+func (l *windowLimiter) Update(remaining int, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reset := time.Now().Add(ttl)
+	if reset.Sub(l.reset) > time.Second {
+		// A new window
+		l.remaining = remaining
+	} else {
+		l.remaining = min(l.remaining, remaining)
+	}
+	l.reset = reset
+}
+
 func getIpApi(host string, ctx context.Context, tracer trace.Tracer) (IpApi, error) {
 	childCtx, span := tracer.Start(
 		ctx,
 		"getIpApi")
 	defer span.End()
 
-	wait, found := c.Get("getIpApiRt")
-	if found && wait.(time.Duration) > 0*time.Second {
-		span.AddEvent("Rate limit key found on cache, sleeping")
-		log.Printf("Rate limit key found on cache, sleeping for %s", wait)
-		time.Sleep(wait.(time.Duration))
-	}
-
 	span.AddEvent("Getting IP info from ip-api.com")
-	log.Printf("Getting IP info for '%s' from ip-api.com", host)
+	slog.DebugContext(childCtx, "Getting IP info", "remote_host", host, "provider", "ip-api.com")
 
 	fields := []string{
 		"status",
@@ -93,18 +159,15 @@ func getIpApi(host string, ctx context.Context, tracer trace.Tracer) (IpApi, err
 		"query",
 	}
 
+	if err := ipApiLimit.Wait(childCtx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return IpApi{}, err
+	}
+
 	url := fmt.Sprintf("http://ip-api.com/json/%s?fields=%s", host, strings.Join(fields, ","))
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(childCtx, "GET", url, nil)
 	if err != nil {
-		span.AddEvent("Error creating request for ip-api.com, re-invoking request after sleeping")
-		if found {
-			log.Printf("Error creating request for ip-api.com, re-invoking request after sleeping for %s", wait)
-			c.Set("getIpApiRt", wait.(time.Duration)+1*time.Second, wait.(time.Duration)+1*time.Second)
-		} else {
-			log.Printf("Error creating request for ip-api.com, re-invoking request after sleeping for 1 second")
-			c.Set("getIpApiRt", 1*time.Second, 1*time.Second)
-		}
-
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		return IpApi{}, err
@@ -125,23 +188,27 @@ func getIpApi(host string, ctx context.Context, tracer trace.Tracer) (IpApi, err
 		span.SetStatus(codes.Error, err.Error())
 		return IpApi{}, err
 	}
+	xTtl, err := parseTime(resp.Header.Get("X-Ttl"))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return IpApi{}, err
+	}
+	ipApiLimit.Update(int(respHeaderXRl), xTtl)
 
-	if resp.StatusCode == http.StatusTooManyRequests || respHeaderXRl <= 16 {
-		xTtl, err := parseTime(resp.Header.Get("X-Ttl"))
+	// Nearing the limit, the provider is left alone until the window resets,
+	// so the next ones answer rather than lookups waiting for ipApiLimit
+	var limited error
+	if resp.StatusCode == http.StatusTooManyRequests || respHeaderXRl <= ipApiReserve {
 		xTtl += time.Duration(1+rand.Int63n(respHeaderXRl+1)) * time.Second
-		if err != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			return IpApi{}, err
-		}
-
-		span.AddEvent("Rate limited, re-invoking request after sleeping")
-		span.SetStatus(codes.Error, fmt.Sprintf("Rate limited, re-invoking request after sleeping for %s. X-Rl: %d", xTtl, respHeaderXRl))
-		log.Printf("Rate limited, re-invoking request after sleeping for %s. X-Rl: %d", xTtl, respHeaderXRl)
 
-		c.Set("getIpApiRt", xTtl, xTtl)
-
-		return IpApi{}, fmt.Errorf("rate limited")
+		span.AddEvent("Rate limited, pausing the provider")
+		slog.WarnContext(childCtx, "Rate limited, pausing the provider", "provider", "ip-api.com", "wait", xTtl, "remaining", respHeaderXRl)
+		limited = &geoRateLimitError{Wait: xTtl}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			span.SetStatus(codes.Error, limited.Error())
+			return IpApi{}, limited
+		}
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -162,7 +229,7 @@ func getIpApi(host string, ctx context.Context, tracer trace.Tracer) (IpApi, err
 
 	span.AddEvent("Successfully got IP info from ip-api.com")
 	span.SetStatus(codes.Ok, fmt.Sprintf("Successfully got IP info for '%s' from ip-api.com", host))
-	return result, nil
+	return result, limited
 }
 
 func unmarshallgetIpApi(body []byte, ctx context.Context, tracer trace.Tracer) (IpApi, error) {
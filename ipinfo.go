@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
@@ -26,50 +30,223 @@ type IPInfoIo struct {
 	Longitude float64 `json:"longitude"`
 }
 
-func getIpInfoIo(host string, ctx context.Context, tracer trace.Tracer) (IPInfoIo, error) {
+// ipInfoTokenPool spreads lookups over several ipinfo.io tokens, tracking
+// the monthly quota left on each: the first token of the list is used until
+// its quota is down to the reserve, then the next one, and tokens answering
+// 429 are set aside until the end of the month. Only once every token is
+// over its quota is the provider reported rate limited.
+type ipInfoTokenPool struct {
+	quota   int
+	reserve int
+
+	mu     sync.Mutex
+	tokens map[string]*ipInfoQuota
+}
+
+// ipInfoQuota is what is left of the quota of a token over a month.
+type ipInfoQuota struct {
+	month     string
+	remaining int
+	blocked   time.Time
+}
+
+func newIPInfoTokenPool(quota int, reserve int) *ipInfoTokenPool {
+	return &ipInfoTokenPool{quota: quota, reserve: reserve, tokens: map[string]*ipInfoQuota{}}
+}
+
+// ipInfoTokenLabel identifies a token in logs and metrics without giving it
+// away.
+func ipInfoTokenLabel(token string) string {
+	if len(token) <= 4 {
+		return "..."
+	}
+
+	return "..." + token[len(token)-4:]
+}
+
+// quotaOf returns the quota of token for the current month, reset when the
+// month changed. p.mu must be held.
+func (p *ipInfoTokenPool) quotaOf(token string, now time.Time) *ipInfoQuota {
+	month := now.UTC().Format("2006-01")
+	quota, ok := p.tokens[token]
+	if !ok {
+		quota = &ipInfoQuota{month: month}
+		p.tokens[token] = quota
+		p.setRemaining(token, quota, p.quota)
+	} else if quota.month != month {
+		quota.month, quota.blocked = month, time.Time{}
+		p.setRemaining(token, quota, p.quota)
+	}
+
+	return quota
+}
+
+// setRemaining updates the quota left on token. p.mu must be held.
+func (p *ipInfoTokenPool) setRemaining(token string, quota *ipInfoQuota, remaining int) {
+	if remaining <= p.reserve && quota.remaining > p.reserve {
+		slog.Warn("ipinfo.io token nearing its monthly quota, rotating to the next one", "token", ipInfoTokenLabel(token), "remaining", remaining)
+	}
+	metrics.RecordIPInfoQuota(ipInfoTokenLabel(token), int64(remaining-quota.remaining))
+	quota.remaining = remaining
+}
+
+// pick returns the token to use among tokens, preferring those above the
+// reserve, or how long until one can be used again when none can.
+func (p *ipInfoTokenPool) pick(tokens []string) (string, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var fallback string
+	for _, token := range tokens {
+		quota := p.quotaOf(token, now)
+		if now.Before(quota.blocked) || quota.remaining <= 0 {
+			continue
+		}
+		if quota.remaining > p.reserve {
+			return token, 0
+		}
+		if fallback == "" {
+			fallback = token
+		}
+	}
+	if fallback != "" {
+		return fallback, 0
+	}
+
+	wait := time.Until(ipInfoNextMonth(now))
+	for _, token := range tokens {
+		if blocked := p.tokens[token].blocked; blocked.After(now) && blocked.Sub(now) < wait {
+			wait = blocked.Sub(now)
+		}
+	}
+
+	return "", wait
+}
+
+// used records a lookup made with token, and the quota left reported by
+// ipinfo.io, if any.
+func (p *ipInfoTokenPool) used(token string, remaining int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	quota := p.quotaOf(token, time.Now())
+	if remaining < 0 {
+		remaining = quota.remaining - 1
+	}
+	p.setRemaining(token, quota, max(remaining, 0))
+}
+
+// block sets token aside for wait, or until the end of the month when
+// ipinfo.io didn't say.
+func (p *ipInfoTokenPool) block(token string, wait time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	quota := p.quotaOf(token, now)
+	if wait <= 0 {
+		quota.blocked = ipInfoNextMonth(now)
+		p.setRemaining(token, quota, 0)
+	} else {
+		quota.blocked = now.Add(wait)
+	}
+	slog.Warn("ipinfo.io token rate limited, rotating to the next one", "token", ipInfoTokenLabel(token), "until", quota.blocked)
+}
+
+func ipInfoNextMonth(now time.Time) time.Time {
+	year, month, _ := now.UTC().Date()
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// lookup looks host up with the tokens of the pool in turn, until one
+// answers or every token is over its quota.
+func (p *ipInfoTokenPool) lookup(host string, tokens []string, ctx context.Context, tracer trace.Tracer) (IPInfoIo, error) {
+	for {
+		token, wait := p.pick(tokens)
+		if token == "" {
+			return IPInfoIo{}, &geoRateLimitError{Wait: wait}
+		}
+
+		result, remaining, err := getIpInfoIo(host, token, ctx, tracer)
+		var limited *geoRateLimitError
+		if errors.As(err, &limited) {
+			p.block(token, limited.Wait)
+			continue
+		}
+		if err == nil {
+			p.used(token, remaining)
+		}
+
+		return result, err
+	}
+}
+
+// getIpInfoIo looks host up with token, returning the monthly quota left on
+// it, or -1 when ipinfo.io doesn't tell.
+func getIpInfoIo(host string, token string, ctx context.Context, tracer trace.Tracer) (IPInfoIo, int, error) {
 	childCtx, span := tracer.Start(
 		ctx,
 		"getIpInfoIo")
 	defer span.End()
 
-	log.Printf("Getting IP info for '%s' from ipinfo.io", host)
+	slog.DebugContext(childCtx, "Getting IP info", "remote_host", host, "provider", "ipinfo.io")
 	url := fmt.Sprintf("https://ipinfo.io/%s", host)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(childCtx, "GET", url, nil)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return IPInfoIo{}, err
+		return IPInfoIo{}, -1, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ipinfoIoToken))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return IPInfoIo{}, err
+		return IPInfoIo{}, -1, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait, _ := parseTime(resp.Header.Get("Retry-After"))
+		err := &geoRateLimitError{Wait: wait}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return IPInfoIo{}, -1, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return IPInfoIo{}, -1, err
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return IPInfoIo{}, err
+		return IPInfoIo{}, -1, err
 	}
 
 	result, err := unmarshallgetIpInfoIo(body, childCtx, tracer)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return IPInfoIo{}, err
+		return IPInfoIo{}, -1, err
+	}
+
+	remaining := -1
+	if value, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		remaining = value
 	}
 
 	span.AddEvent("Successfully got IP info from ipinfo.io")
 	span.SetStatus(codes.Ok, fmt.Sprintf("Successfully got IP info for '%s' from ipinfo.io", host))
 
-	return result, nil
+	return result, remaining, nil
 }
 
 func parseLoc(loc string, ctx context.Context, tracer trace.Tracer) (float64, float64) {
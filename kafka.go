@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// KafkaSink publishes every event as a JSON EventDocument, keyed by the
+// attacker IP so the events of an attacker land on the same partition, in
+// order. Kafka does not deduplicate retried batches, so the event ID is
+// carried in the event_id header for consumers to do so.
+type KafkaSink struct {
+	writer *kafka.Writer
+	tracer trace.Tracer
+}
+
+// NewKafkaSink creates a sink producing to topic on brokers, authenticating
+// with SASL/PLAIN when username is set.
+func NewKafkaSink(brokers []string, topic string, useTLS bool, username string, password string, tracer trace.Tracer) *KafkaSink {
+	transport := &kafka.Transport{}
+	if useTLS {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if username != "" {
+		transport.SASL = plain.Mechanism{Username: username, Password: password}
+	}
+
+	return &KafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+			Transport:    transport,
+		},
+		tracer: tracer,
+	}
+}
+
+func kafkaSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	brokers := splitList(os.Getenv("KAFKA_BROKERS"))
+	if len(brokers) == 0 {
+		return nil, nil
+	}
+
+	return NewKafkaSink(brokers, getEnv("KAFKA_TOPIC", "ssh-honeypot"), os.Getenv("KAFKA_TLS") == "true",
+		os.Getenv("KAFKA_USERNAME"), os.Getenv("KAFKA_PASSWORD"), tracer), nil
+}
+
+func (s *KafkaSink) Name() string {
+	return "kafka"
+}
+
+func (s *KafkaSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToKafka",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	messages := make([]kafka.Message, 0, len(batch.Events))
+	for _, event := range batch.Events {
+		document := newEventDocument(event)
+		value, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+
+		messages = append(messages, kafka.Message{
+			Key:     []byte(document.RemoteHost),
+			Value:   value,
+			Time:    document.Timestamp,
+			Headers: []kafka.Header{{Key: "event_id", Value: []byte(document.ID)}},
+		})
+	}
+
+	if err := s.writer.WriteMessages(ctx, messages...); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Published %d events", len(messages)))
+	return nil
+}
+
+// Close flushes and closes the producer.
+func (s *KafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// maxIndexedKeys bounds the keys indexed, those offered past it being
+	// left out, so random keys don't grow the index forever
+	maxIndexedKeys = 100000
+	// maxKeySourceIPs bounds the distinct source IPs remembered per key
+	maxKeySourceIPs = 1000
+)
+
+type keyRecord struct {
+	fingerprint string
+	keyType     string
+	firstSeen   time.Time
+	lastSeen    time.Time
+	attempts    int
+	sourceIPs   map[string]struct{}
+}
+
+type KeyReuse struct {
+	Fingerprint string    `json:"fingerprint"`
+	KeyType     string    `json:"key_type"`
+	Campaign    string    `json:"campaign,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Attempts    int       `json:"attempts"`
+	SourceIPs   []string  `json:"source_ips"`
+}
+
+// KeyIndex indexes the public keys offered by attackers by their SHA256
+// fingerprint, to surface the same key being used from several source IPs
+// or belonging to a known campaign.
+type KeyIndex struct {
+	mu        sync.Mutex
+	keys      map[string]*keyRecord
+	campaigns map[string]string
+}
+
+// NewKeyIndex creates an index, loading known campaign keys from path if
+// set. The file is a JSON object mapping SHA256 fingerprints to campaign
+// names.
+func NewKeyIndex(path string) (*KeyIndex, error) {
+	index := &KeyIndex{
+		keys:      map[string]*keyRecord{},
+		campaigns: map[string]string{},
+	}
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &index.campaigns); err != nil {
+			return nil, fmt.Errorf("failed to parse '%s': %v", path, err)
+		}
+	}
+
+	return index, nil
+}
+
+// Annotate records the key offered in a public key event and tags the event
+// with its campaign and the number of source IPs seen using it, flagging
+// the event bringing it to two.
+func (i *KeyIndex) Annotate(ctx context.Context, event *Event) {
+	sshInfo := event.SSHInfo
+	if sshInfo.Function != "public_key" || sshInfo.Key == "" {
+		return
+	}
+
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(sshInfo.Key))
+	if err != nil {
+		return
+	}
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	event.Analysis.KeyCampaign = i.campaigns[fingerprint]
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	record, found := i.keys[fingerprint]
+	if !found {
+		if len(i.keys) >= maxIndexedKeys {
+			return
+		}
+		record = &keyRecord{
+			fingerprint: fingerprint,
+			keyType:     key.Type(),
+			firstSeen:   sshInfo.Timestamp,
+			sourceIPs:   map[string]struct{}{},
+		}
+		i.keys[fingerprint] = record
+	}
+
+	record.attempts++
+	record.lastSeen = sshInfo.Timestamp
+	sourceIPs := len(record.sourceIPs)
+	if sourceIPs < maxKeySourceIPs {
+		record.sourceIPs[sshInfo.RemoteHost] = struct{}{}
+	}
+
+	event.Analysis.KeySourceIPs = len(record.sourceIPs)
+	event.Analysis.KeyReused = sourceIPs == 1 && len(record.sourceIPs) == 2
+}
+
+// Reused returns the keys seen from more than one source IP or matching a
+// known campaign, most widespread first.
+func (i *KeyIndex) Reused() []KeyReuse {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	reused := []KeyReuse{}
+	for _, record := range i.keys {
+		campaign := i.campaigns[record.fingerprint]
+		if len(record.sourceIPs) < 2 && campaign == "" {
+			continue
+		}
+
+		sourceIPs := make([]string, 0, len(record.sourceIPs))
+		for ip := range record.sourceIPs {
+			sourceIPs = append(sourceIPs, ip)
+		}
+		sort.Strings(sourceIPs)
+
+		reused = append(reused, KeyReuse{
+			Fingerprint: record.fingerprint,
+			KeyType:     record.keyType,
+			Campaign:    campaign,
+			FirstSeen:   record.firstSeen,
+			LastSeen:    record.lastSeen,
+			Attempts:    record.attempts,
+			SourceIPs:   sourceIPs,
+		})
+	}
+
+	sort.Slice(reused, func(a, b int) bool {
+		return len(reused[a].SourceIPs) > len(reused[b].SourceIPs)
+	})
+
+	return reused
+}
+
+// keyBits returns the size of key in bits, as ssh-keygen -l shows it, or 0
+// for key types it can't tell, such as security keys. Certificates have the
+// size of their key.
+func keyBits(key gossh.PublicKey) int {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		key = cert.Key
+	}
+	cryptoKey, ok := key.(gossh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+
+	switch public := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return public.N.BitLen()
+	case *ecdsa.PublicKey:
+		return public.Curve.Params().BitSize
+	case *dsa.PublicKey:
+		return public.P.BitLen()
+	case ed25519.PublicKey:
+		return 256
+	default:
+		return 0
+	}
+}
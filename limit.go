@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnLimiter caps the connections open at once across every listener it
+// wraps, bounding the goroutines and memory a wave of clients can take up.
+// Once all slots are taken, the "wait" policy stops accepting until one
+// frees up, leaving new clients in the kernel backlog, while the "reject"
+// policy closes them as soon as accepted.
+type ConnLimiter struct {
+	slots    chan struct{}
+	policy   string
+	rejected atomic.Int64
+}
+
+func NewConnLimiter(maxConns int, policy string) (*ConnLimiter, error) {
+	switch policy {
+	case "wait", "reject":
+	default:
+		return nil, fmt.Errorf("unknown connection overflow policy '%s', expected 'wait' or 'reject'", policy)
+	}
+	if maxConns <= 0 {
+		return nil, fmt.Errorf("invalid connection limit %d", maxConns)
+	}
+
+	return &ConnLimiter{slots: make(chan struct{}, maxConns), policy: policy}, nil
+}
+
+// connLimiterFromEnv returns a nil limiter, which doesn't limit, when
+// MAX_CONNECTIONS is 0.
+func connLimiterFromEnv() (*ConnLimiter, error) {
+	maxConns := getEnvInt("MAX_CONNECTIONS", 1024)
+	if maxConns == 0 {
+		return nil, nil
+	}
+
+	return NewConnLimiter(maxConns, getEnv("CONNECTION_OVERFLOW", "wait"))
+}
+
+// Listen announces on addrs, the connections accepted counting against the
+// limit until closed.
+func (l *ConnLimiter) Listen(network string, addrs []string) (net.Listener, error) {
+	listener, err := listen(network, addrs)
+	if err != nil || l == nil {
+		return listener, err
+	}
+
+	return &limitListener{Listener: listener, limiter: l, done: make(chan struct{})}, nil
+}
+
+type limitListener struct {
+	net.Listener
+	limiter   *ConnLimiter
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.limiter.policy == "wait" {
+		select {
+		case l.limiter.slots <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			<-l.limiter.slots
+			return nil, err
+		}
+		return &limitConn{Conn: conn, slots: l.limiter.slots}, nil
+	}
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.limiter.slots <- struct{}{}:
+			return &limitConn{Conn: conn, slots: l.limiter.slots}, nil
+		default:
+			conn.Close()
+			metrics.RecordConnectionRejected()
+			if rejected := l.limiter.rejected.Add(1); rejected%100 == 1 {
+				slog.Warn("Connection limit reached, rejecting connections", "limit", cap(l.limiter.slots), "rejected", rejected)
+			}
+		}
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+
+	return l.Listener.Close()
+}
+
+// limitConn gives its slot back once closed.
+type limitConn struct {
+	net.Conn
+	slots     chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		<-c.slots
+	})
+
+	return err
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marceloalmeida/ssh-honeypot/enrich"
+)
+
+// The escaping of influxdata/line-protocol, whose whitespace escapes keep a
+// line from being split or truncated.
+var (
+	measurementEscaper = strings.NewReplacer("\t", `\t`, "\n", `\n`, "\f", `\f`, "\r", `\r`, ",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer("\t", `\t`, "\n", `\n`, "\f", `\f`, "\r", `\r`, ",", `\,`, "=", `\=`, " ", `\ `)
+	fieldEscaper       = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// tagValue returns value stripped of its trailing backslashes, which would
+// escape the separator following it.
+func tagValue(value string) string {
+	return strings.TrimRight(value, `\`)
+}
+
+// LineProtocolEncoder encodes events straight into InfluxDB line protocol,
+// appending to a caller-provided buffer so the batching stage can reuse its
+// buffers instead of allocating a client Point per event.
+type LineProtocolEncoder struct {
+	Measurement string
+	// SessionMeasurement, when set, takes the session_end events instead of
+	// Measurement
+	SessionMeasurement string
+	// Tags are the attributes written as tags, the others being written as
+	// string fields, or nil to write them all as tags
+	Tags map[string]bool
+}
+
+// lineProtocolAttributes are the string attributes of events, written as
+// tags or fields.
+var lineProtocolAttributes = []string{
+	"anomaly", "attack_pattern", "campaign", "canarytoken", "city", "client_version", "command", "country",
+	"dnsbl", "file_operation", "forward_host", "forward_port", "function", "greynoise_actor",
+	"greynoise_classification", "hassh", "ip", "key", "key_campaign", "key_fingerprint", "key_type",
+	"local_host", "local_port", "node_deployment", "node_id", "node_region", "org", "password",
+	"password_pattern", "policy", "protocol", "region", "remote_host", "remote_port", "source_class",
+	"subsystem", "techniques", "term", "timezone", "tool", "tool_category", "user", "wordlist",
+}
+
+// defaultInfluxTags are the attributes written as tags by default, those of
+// few enough values to keep the series cardinality low. Source IPs and ports,
+// credentials, keys, commands, client versions and whatever else clients
+// choose freely, like terminals and subsystems, are written as fields.
+var defaultInfluxTags = []string{
+	"anomaly", "attack_pattern", "campaign", "canarytoken", "city", "country", "dnsbl", "file_operation",
+	"function", "greynoise_actor", "greynoise_classification", "key_campaign", "key_type", "local_host",
+	"local_port", "node_deployment", "node_id", "node_region", "password_pattern", "policy", "protocol",
+	"region", "source_class", "techniques", "timezone", "tool", "tool_category", "wordlist",
+}
+
+// influxTagsFromEnv returns the attributes to write as tags, from
+// INFLUXDB_TAGS, all of them for "all".
+func influxTagsFromEnv() (map[string]bool, error) {
+	names := splitList(getEnv("INFLUXDB_TAGS", strings.Join(defaultInfluxTags, ",")))
+	if len(names) == 1 && names[0] == "all" {
+		return nil, nil
+	}
+
+	tags := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !slices.Contains(lineProtocolAttributes, name) {
+			return nil, fmt.Errorf("unknown attribute '%s' in INFLUXDB_TAGS", name)
+		}
+		tags[name] = true
+	}
+
+	return tags, nil
+}
+
+// tag reports whether the attribute key is written as a tag.
+func (e LineProtocolEncoder) tag(key string) bool {
+	return e.Tags == nil || e.Tags[key]
+}
+
+type lineProtocolTag struct {
+	key   string
+	value string
+}
+
+// Encode appends one line for event to buf. Tags are written in key order,
+// which is what InfluxDB expects for the cheapest series lookup, and empty
+// attributes are omitted since line protocol does not allow empty tags, as
+// are the trailing backslashes of tags.
+func (e LineProtocolEncoder) Encode(buf *bytes.Buffer, event Event) {
+	ipInfo := event.IPInfo
+	sshInfo := event.SSHInfo
+	analysis := event.Analysis
+
+	var greyNoise enrich.GreyNoiseReport
+	if analysis.GreyNoise != nil {
+		greyNoise = *analysis.GreyNoise
+	}
+
+	tags := [...]lineProtocolTag{
+		{"anomaly", sshInfo.Anomaly},
+		{"attack_pattern", analysis.AttackPattern},
+		{"campaign", analysis.Campaign},
+		{"canarytoken", sshInfo.Canarytoken},
+		{"city", ipInfo.City},
+		{"client_version", sshInfo.ClientVersion},
+		{"command", sshInfo.Command},
+		{"country", ipInfo.Country},
+		{"dnsbl", analysis.DNSBL},
+		{"file_operation", sshInfo.FileOperation},
+		{"forward_host", sshInfo.ForwardHost},
+		{"forward_port", sshInfo.ForwardPort},
+		{"function", sshInfo.Function},
+		{"greynoise_actor", greyNoise.Actor},
+		{"greynoise_classification", greyNoise.Classification},
+		{"hassh", sshInfo.HASSH},
+		{"ip", ipInfo.IP},
+		{"key", sshInfo.Key},
+		{"key_campaign", analysis.KeyCampaign},
+		{"key_fingerprint", sshInfo.KeyFingerprint},
+		{"key_type", sshInfo.KeyType},
+		{"local_host", sshInfo.LocalHost},
+		{"local_port", sshInfo.LocalPort},
+		{"node_deployment", sshInfo.Node.Deployment},
+		{"node_id", sshInfo.Node.ID},
+		{"node_region", sshInfo.Node.Region},
+		{"org", ipInfo.Org},
+		{"password", sshInfo.Password},
+		{"password_pattern", analysis.PasswordPattern},
+		{"policy", sshInfo.Policy},
+		{"protocol", sshInfo.Protocol},
+		{"region", ipInfo.Region},
+		{"remote_host", sshInfo.RemoteHost},
+		{"remote_port", sshInfo.RemotePort},
+		{"source_class", analysis.SourceClass},
+		{"subsystem", sshInfo.Subsystem},
+		{"techniques", analysis.Techniques},
+		{"term", sshInfo.Term},
+		{"timezone", ipInfo.Timezone},
+		{"tool", analysis.Tool},
+		{"tool_category", analysis.ToolCategory},
+		{"user", sshInfo.User},
+		{"wordlist", analysis.Wordlist},
+	}
+
+	measurement := e.Measurement
+	if sshInfo.Function == "session_end" && e.SessionMeasurement != "" {
+		measurement = e.SessionMeasurement
+	}
+	measurementEscaper.WriteString(buf, tagValue(measurement))
+	for _, tag := range tags {
+		if !e.tag(tag.key) {
+			continue
+		}
+		value := tagValue(tag.value)
+		if value == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		tagEscaper.WriteString(buf, tag.key)
+		buf.WriteByte('=')
+		tagEscaper.WriteString(buf, value)
+	}
+
+	var scratch [32]byte
+	buf.WriteString(" attempt=")
+	buf.Write(strconv.AppendInt(scratch[:0], int64(sshInfo.Attempt), 10))
+	buf.WriteString("i,latitude=")
+	buf.Write(strconv.AppendFloat(scratch[:0], ipInfo.Latitude, 'f', -1, 64))
+	buf.WriteString(",longitude=")
+	buf.Write(strconv.AppendFloat(scratch[:0], ipInfo.Longitude, 'f', -1, 64))
+	if sshInfo.AttemptCount > 0 {
+		buf.WriteString(",attempt_count=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(sshInfo.AttemptCount), 10))
+		buf.WriteByte('i')
+	}
+	if sshInfo.Function == "spray" {
+		buf.WriteString(",spray_usernames=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(sshInfo.SprayUsernames), 10))
+		buf.WriteString("i,spray_ports=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(sshInfo.SprayPorts), 10))
+		buf.WriteByte('i')
+	}
+	if sshInfo.Accepted {
+		buf.WriteString(",accepted=true")
+	}
+	if sshInfo.KeyBits > 0 {
+		buf.WriteString(",key_bits=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(sshInfo.KeyBits), 10))
+		buf.WriteByte('i')
+	}
+	if analysis.KeySourceIPs > 0 {
+		buf.WriteString(",key_source_ips=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(analysis.KeySourceIPs), 10))
+		buf.WriteByte('i')
+	}
+	if abuse := analysis.Abuse; abuse != nil {
+		buf.WriteString(",abuse_confidence=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(abuse.AbuseConfidenceScore), 10))
+		buf.WriteString("i,abuse_reports=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(abuse.TotalReports), 10))
+		buf.WriteByte('i')
+		if abuse.LastReportedAt != nil {
+			buf.WriteString(`,abuse_last_reported="`)
+			buf.Write(abuse.LastReportedAt.UTC().AppendFormat(scratch[:0], time.RFC3339))
+			buf.WriteByte('"')
+		}
+	}
+	if virusTotal := analysis.VirusTotal; virusTotal != nil {
+		for _, field := range [...]struct {
+			key   string
+			value int
+		}{
+			{",vt_malicious=", virusTotal.Malicious},
+			{",vt_suspicious=", virusTotal.Suspicious},
+			{",vt_harmless=", virusTotal.Harmless},
+			{",vt_undetected=", virusTotal.Undetected},
+			{",vt_votes_malicious=", virusTotal.VotesMalicious},
+			{",vt_votes_harmless=", virusTotal.VotesHarmless},
+		} {
+			buf.WriteString(field.key)
+			buf.Write(strconv.AppendInt(scratch[:0], int64(field.value), 10))
+			buf.WriteByte('i')
+		}
+		if virusTotal.LastAnalysis != nil {
+			buf.WriteString(`,vt_last_analysis="`)
+			buf.Write(virusTotal.LastAnalysis.UTC().AppendFormat(scratch[:0], time.RFC3339))
+			buf.WriteByte('"')
+		}
+	}
+	if sshInfo.Path != "" {
+		buf.WriteString(`,path="`)
+		fieldEscaper.WriteString(buf, sshInfo.Path)
+		buf.WriteByte('"')
+	}
+	if sshInfo.URL != "" {
+		buf.WriteString(`,url="`)
+		fieldEscaper.WriteString(buf, sshInfo.URL)
+		buf.WriteByte('"')
+	}
+	if sshInfo.HTTPMethod != "" {
+		buf.WriteString(`,http_method="`)
+		fieldEscaper.WriteString(buf, sshInfo.HTTPMethod)
+		buf.WriteByte('"')
+	}
+	if sshInfo.UserAgent != "" {
+		buf.WriteString(`,user_agent="`)
+		fieldEscaper.WriteString(buf, sshInfo.UserAgent)
+		buf.WriteByte('"')
+	}
+	if sshInfo.FileSHA256 != "" {
+		buf.WriteString(`,file_sha256="`)
+		buf.WriteString(sshInfo.FileSHA256)
+		buf.WriteString(`",file_size=`)
+		buf.Write(strconv.AppendInt(scratch[:0], sshInfo.FileSize, 10))
+		buf.WriteByte('i')
+	}
+	if sshInfo.SampleDuplicate {
+		buf.WriteString(",sample_duplicate=true")
+	}
+	if sshInfo.SampleDropped {
+		buf.WriteString(",sample_dropped=true")
+	}
+	if len(sshInfo.YaraMatches) > 0 {
+		buf.WriteString(`,yara_matches="`)
+		fieldEscaper.WriteString(buf, strings.Join(sshInfo.YaraMatches, ","))
+		buf.WriteByte('"')
+	}
+	if sshInfo.AnomalyDetail != "" {
+		buf.WriteString(`,anomaly_detail="`)
+		fieldEscaper.WriteString(buf, sshInfo.AnomalyDetail)
+		buf.WriteByte('"')
+	}
+	if len(sshInfo.Env) > 0 {
+		buf.WriteString(`,env="`)
+		fieldEscaper.WriteString(buf, strings.Join(sshInfo.Env, "\n"))
+		buf.WriteByte('"')
+	}
+	if sshInfo.TermWidth > 0 {
+		buf.WriteString(",term_width=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(sshInfo.TermWidth), 10))
+		buf.WriteString("i,term_height=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(sshInfo.TermHeight), 10))
+		buf.WriteByte('i')
+	}
+	if sshInfo.TermModes != "" {
+		buf.WriteString(`,term_modes="`)
+		fieldEscaper.WriteString(buf, sshInfo.TermModes)
+		buf.WriteByte('"')
+	}
+	if sshInfo.AgentForwarding {
+		buf.WriteString(",agent_forwarding=true")
+	}
+	if sshInfo.X11AuthProtocol != "" {
+		buf.WriteString(`,x11_auth_protocol="`)
+		fieldEscaper.WriteString(buf, sshInfo.X11AuthProtocol)
+		buf.WriteString(`",x11_auth_cookie="`)
+		fieldEscaper.WriteString(buf, sshInfo.X11AuthCookie)
+		buf.WriteString(`",x11_screen="`)
+		buf.WriteString(sshInfo.X11Screen)
+		buf.WriteByte('"')
+	}
+	if analysis.NewAttacker {
+		buf.WriteString(",new_attacker=true")
+	}
+	if analysis.PasswordEntropy != nil {
+		buf.WriteString(",password_entropy=")
+		buf.Write(strconv.AppendFloat(scratch[:0], *analysis.PasswordEntropy, 'f', -1, 64))
+	}
+	if analysis.HumanLikelihood != nil {
+		buf.WriteString(",human_likelihood=")
+		buf.Write(strconv.AppendFloat(scratch[:0], *analysis.HumanLikelihood, 'f', -1, 64))
+	}
+	if sshInfo.Duration > 0 {
+		buf.WriteString(",duration=")
+		buf.Write(strconv.AppendFloat(scratch[:0], sshInfo.Duration.Seconds(), 'f', -1, 64))
+	}
+	if sshInfo.Channels > 0 {
+		buf.WriteString(",channels=")
+		buf.Write(strconv.AppendInt(scratch[:0], int64(sshInfo.Channels), 10))
+		buf.WriteString("i,bytes_in=")
+		buf.Write(strconv.AppendInt(scratch[:0], sshInfo.BytesIn, 10))
+		buf.WriteString("i,bytes_out=")
+		buf.Write(strconv.AppendInt(scratch[:0], sshInfo.BytesOut, 10))
+		buf.WriteByte('i')
+	}
+	if delay := sshInfo.Signals.BannerDelay; delay > 0 {
+		buf.WriteString(",banner_delay=")
+		buf.Write(strconv.AppendFloat(scratch[:0], delay.Seconds(), 'f', -1, 64))
+	}
+	if len(sshInfo.KeystrokeIntervals) > 0 {
+		buf.WriteString(`,keystroke_intervals="`)
+		for i, interval := range sshInfo.KeystrokeIntervals {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(strconv.AppendFloat(scratch[:0], interval.Seconds(), 'f', -1, 64))
+		}
+		buf.WriteByte('"')
+	}
+	for _, field := range tags {
+		if field.value == "" || e.tag(field.key) {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(field.key)
+		buf.WriteString(`="`)
+		fieldEscaper.WriteString(buf, field.value)
+		buf.WriteByte('"')
+	}
+
+	buf.WriteByte(' ')
+	buf.Write(strconv.AppendInt(scratch[:0], sshInfo.Timestamp.UnixNano(), 10))
+	buf.WriteByte('\n')
+}
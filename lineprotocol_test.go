@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+func benchmarkEvent() Event {
+	return Event{
+		SSHInfo: SSHInfo{
+			User:          "root",
+			RemoteHost:    "203.0.113.7",
+			RemotePort:    "51234",
+			LocalHost:     "192.0.2.1",
+			LocalPort:     "22",
+			ClientVersion: "SSH-2.0-Go",
+			Function:      "password",
+			Protocol:      "ssh",
+			Password:      "123456",
+			Attempt:       3,
+			Timestamp:     time.Unix(1760000000, 0),
+		},
+		IPInfo: IPInfo{
+			IP:        "203.0.113.7",
+			City:      "Lisbon",
+			Region:    "Lisbon",
+			Country:   "PT",
+			Latitude:  38.7167,
+			Longitude: -9.1333,
+			Org:       "AS64496 Example",
+			Timezone:  "Europe/Lisbon",
+		},
+	}
+}
+
+// clientPoint builds the event as the per-point path did before the
+// encoder, through the InfluxDB client.
+func clientPoint(event Event) *write.Point {
+	ipInfo := event.IPInfo
+	sshInfo := event.SSHInfo
+
+	return influxdb2.NewPointWithMeasurement("request").
+		AddField("latitude", ipInfo.Latitude).
+		AddField("longitude", ipInfo.Longitude).
+		AddField("attempt", sshInfo.Attempt).
+		AddTag("ip", ipInfo.IP).
+		AddTag("country", ipInfo.Country).
+		AddTag("city", ipInfo.City).
+		AddTag("region", ipInfo.Region).
+		AddTag("org", ipInfo.Org).
+		AddTag("timezone", ipInfo.Timezone).
+		AddTag("user", sshInfo.User).
+		AddTag("remote_host", sshInfo.RemoteHost).
+		AddTag("remote_port", sshInfo.RemotePort).
+		AddTag("local_host", sshInfo.LocalHost).
+		AddTag("local_port", sshInfo.LocalPort).
+		AddTag("client_version", sshInfo.ClientVersion).
+		AddTag("function", sshInfo.Function).
+		AddTag("password", sshInfo.Password).
+		AddTag("protocol", sshInfo.Protocol).
+		SetTime(sshInfo.Timestamp)
+}
+
+func TestLineProtocolEncoderEscapesTags(t *testing.T) {
+	event := benchmarkEvent()
+	event.SSHInfo.User = "a b,c=d\te\r\nf\\"
+	event.SSHInfo.Password = `\\`
+
+	var buf bytes.Buffer
+	LineProtocolEncoder{Measurement: "request"}.Encode(&buf, event)
+	line := strings.TrimSuffix(buf.String(), "\n")
+
+	if strings.ContainsAny(line, "\t\r\n") {
+		t.Fatalf("unescaped whitespace in %q", line)
+	}
+	if want := `,user=a\ b\,c\=d\te\r\nf `; !strings.Contains(line, want) {
+		t.Errorf("line %q lacks %q", line, want)
+	}
+	if strings.Contains(line, "password=") {
+		t.Errorf("line %q has a tag of backslashes only", line)
+	}
+}
+
+func TestLineProtocolEncoderFields(t *testing.T) {
+	var buf bytes.Buffer
+	LineProtocolEncoder{Measurement: "request", Tags: map[string]bool{"country": true}}.Encode(&buf, benchmarkEvent())
+	line := buf.String()
+
+	if !strings.HasPrefix(line, "request,country=PT attempt=3i,") {
+		t.Errorf("unexpected tags in %q", line)
+	}
+	if !strings.Contains(line, `,user="root"`) {
+		t.Errorf("user isn't a field in %q", line)
+	}
+}
+
+func BenchmarkLineProtocolEncoder(b *testing.B) {
+	event := benchmarkEvent()
+	encoder := LineProtocolEncoder{Measurement: "request"}
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		encoder.Encode(&buf, event)
+	}
+}
+
+func BenchmarkClientPoint(b *testing.B) {
+	event := benchmarkEvent()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = write.PointToLineProtocol(clientPoint(event), time.Nanosecond)
+	}
+}
+
+func TestDefaultInfluxTagsKeepClientValuesAsFields(t *testing.T) {
+	t.Setenv("INFLUXDB_TAGS", "")
+	tags, err := influxTagsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := benchmarkEvent()
+	event.SSHInfo.Term = "xterm-256color"
+	event.SSHInfo.Subsystem = "sftp"
+
+	var buf bytes.Buffer
+	LineProtocolEncoder{Measurement: "request", Tags: tags}.Encode(&buf, event)
+	line := buf.String()
+
+	for _, field := range []string{`term="xterm-256color"`, `subsystem="sftp"`} {
+		if !strings.Contains(line, field) {
+			t.Errorf("line %q lacks field %s", line, field)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/marceloalmeida/ssh-honeypot/telemetry"
+)
+
+// liveMinutes is how many minutes of attempt counts LiveStats keeps.
+const liveMinutes = 60
+
+// LiveWindow is what happened over a window, for /api/stats.
+type LiveWindow struct {
+	Window    string            `json:"window"`
+	Attempts  int               `json:"attempts"`
+	UniqueIPs int               `json:"unique_ips"`
+	Usernames []CredentialCount `json:"top_usernames"`
+	Passwords []CredentialCount `json:"top_passwords"`
+	Countries []TopSource       `json:"top_countries"`
+}
+
+// LiveSnapshot is the state of the honeypot at a glance.
+type LiveSnapshot struct {
+	// AttemptsPerMinute counts the attempts of the last whole minute, and
+	// Minutes those of each of the last hour's, oldest first
+	AttemptsPerMinute int          `json:"attempts_per_minute"`
+	Minutes           []int        `json:"minutes"`
+	Windows           []LiveWindow `json:"windows"`
+}
+
+// LiveStats counts the authentication attempts of every minute of the last
+// hour, and puts them together with the rolling credential and source
+// statistics into a snapshot for the API and the metrics, without querying
+// the sinks.
+type LiveStats struct {
+	credentials *CredentialStats
+	sources     *SourceStats
+	topN        int
+
+	mu      sync.Mutex
+	minutes [liveMinutes]int
+	starts  [liveMinutes]time.Time
+}
+
+func NewLiveStats(credentials *CredentialStats, sources *SourceStats, topN int) *LiveStats {
+	return &LiveStats{credentials: credentials, sources: sources, topN: topN}
+}
+
+// Observe counts the authentication attempts, those collapsed by the Deduper
+// included.
+func (s *LiveStats) Observe(ctx context.Context, event Event) {
+	sshInfo := event.SSHInfo
+	if !isPasswordAttempt(sshInfo) && sshInfo.Function != "public_key" {
+		return
+	}
+
+	start := sshInfo.Timestamp.Truncate(time.Minute)
+	if time.Since(start) >= liveMinutes*time.Minute {
+		return
+	}
+	slot := int(start.Unix()/60) % liveMinutes
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.starts[slot].Equal(start) {
+		s.starts[slot], s.minutes[slot] = start, 0
+	}
+	s.minutes[slot] += max(sshInfo.AttemptCount, 1)
+}
+
+// Minutes returns the attempts of each of the last hour's whole minutes,
+// oldest first.
+func (s *LiveStats) Minutes(now time.Time) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	minutes := make([]int, liveMinutes)
+	current := now.Truncate(time.Minute)
+	for i := range minutes {
+		start := current.Add(time.Duration(i-liveMinutes) * time.Minute)
+		if slot := int(start.Unix()/60) % liveMinutes; s.starts[slot].Equal(start) {
+			minutes[i] = s.minutes[slot]
+		}
+	}
+
+	return minutes
+}
+
+// Window returns what happened over the last window.
+func (s *LiveStats) Window(name string, window time.Duration) LiveWindow {
+	credentials := s.credentials.Summary(name, window)
+	top, _ := s.sources.Top(window, s.topN, []string{"country"})
+
+	return LiveWindow{
+		Window:    name,
+		Attempts:  top.Attempts,
+		UniqueIPs: s.sources.UniqueIPs(window),
+		Usernames: credentials.Usernames,
+		Passwords: credentials.Passwords,
+		Countries: top.Countries,
+	}
+}
+
+// Snapshot returns the live statistics over the last hour and day.
+func (s *LiveStats) Snapshot() LiveSnapshot {
+	minutes := s.Minutes(time.Now())
+
+	return LiveSnapshot{
+		AttemptsPerMinute: minutes[len(minutes)-1],
+		Minutes:           minutes,
+		Windows: []LiveWindow{
+			s.Window("1h", time.Hour),
+			s.Window("24h", 24*time.Hour),
+		},
+	}
+}
+
+// Gauges returns the figures reported as metrics.
+func (s *LiveStats) Gauges() telemetry.LiveGauges {
+	minutes := s.Minutes(time.Now())
+
+	return telemetry.LiveGauges{
+		AttemptsPerMinute: int64(minutes[len(minutes)-1]),
+		UniqueIPs: map[string]int64{
+			"1h":  int64(s.sources.UniqueIPs(time.Hour)),
+			"24h": int64(s.sources.UniqueIPs(24 * time.Hour)),
+		},
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// initLogger makes a structured logger writing to w the default one, in
+// "text" or "json" format, dropping records below level. Records logged with
+// a context carrying a span get its trace_id and span_id, so log lines can be
+// correlated with traces.
+func initLogger(w io.Writer, format string, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level '%s'", level)
+	}
+	options := &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			// Durations read better as "1m30s" than as nanoseconds in JSON.
+			if attr.Value.Kind() == slog.KindDuration {
+				return slog.String(attr.Key, attr.Value.Duration().String())
+			}
+			return attr
+		},
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("invalid log format '%s', must be 'text' or 'json'", format)
+	}
+
+	slog.SetDefault(slog.New(traceHandler{handler}))
+	return nil
+}
+
+// traceHandler adds the IDs of the span in the record context, if any.
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", spanContext.TraceID().String()),
+			slog.String("span_id", spanContext.SpanID().String()))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
+
+// teeLogs has the records logged by the default logger handled by handler
+// too, as long as the default handler is enabled for their level.
+func teeLogs(handler slog.Handler) {
+	slog.SetDefault(slog.New(teeHandler{slog.Default().Handler(), handler}))
+}
+
+// teeHandler hands the records enabled for primary to secondary as well.
+type teeHandler struct {
+	primary   slog.Handler
+	secondary slog.Handler
+}
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.primary.Enabled(ctx, level)
+}
+
+func (h teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	err := h.primary.Handle(ctx, record.Clone())
+	if h.secondary.Enabled(ctx, record.Level) {
+		return errors.Join(err, h.secondary.Handle(ctx, record))
+	}
+
+	return err
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{h.primary.WithAttrs(attrs), h.secondary.WithAttrs(attrs)}
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{h.primary.WithGroup(name), h.secondary.WithGroup(name)}
+}
+
+// fatal logs msg as an error and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LokiSink pushes every event to Grafana Loki as a JSON EventDocument log
+// line. Streams are labeled with the low cardinality country, function and
+// local_port, everything else staying in the line for LogQL json parsing.
+type LokiSink struct {
+	url      string
+	tenantID string
+	username string
+	password string
+	client   *http.Client
+	tracer   trace.Tracer
+}
+
+func NewLokiSink(url string, tenantID string, username string, password string, tracer trace.Tracer) *LokiSink {
+	return &LokiSink{
+		url:      strings.TrimSuffix(url, "/") + "/loki/api/v1/push",
+		tenantID: tenantID,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		tracer:   tracer,
+	}
+}
+
+func lokiSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	url := os.Getenv("LOKI_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	return NewLokiSink(url, os.Getenv("LOKI_TENANT_ID"), os.Getenv("LOKI_USERNAME"), os.Getenv("LOKI_PASSWORD"), tracer), nil
+}
+
+func (s *LokiSink) Name() string {
+	return "loki"
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestamp int64
+	line      string
+}
+
+func (s *LokiSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToLoki",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	streams := map[string]*lokiStream{}
+	var keys []string
+	for _, event := range batch.Events {
+		document := newEventDocument(event)
+		labels := map[string]string{
+			"job":        "ssh-honeypot",
+			"node_id":    document.NodeID,
+			"function":   document.Function,
+			"country":    document.Country,
+			"local_port": document.LocalPort,
+		}
+		for name, value := range labels {
+			if value == "" {
+				delete(labels, name)
+			}
+		}
+		key := fmt.Sprint(labels)
+
+		line, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			keys = append(keys, key)
+		}
+		stream.entries = append(stream.entries, lokiEntry{timestamp: document.Timestamp.UnixNano(), line: string(line)})
+	}
+
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, key := range keys {
+		stream := streams[key]
+		// Loki rejects entries older than the latest of their stream
+		slices.SortStableFunc(stream.entries, func(a, b lokiEntry) int {
+			return cmp.Compare(a.timestamp, b.timestamp)
+		})
+		for _, entry := range stream.entries {
+			stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.timestamp, 10), entry.line})
+		}
+		push.Streams = append(push.Streams, stream)
+	}
+
+	if err := s.push(ctx, push); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Pushed %d events in %d streams", len(batch.Events), len(push.Streams)))
+	return nil
+}
+
+func (s *LokiSink) push(ctx context.Context, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.tenantID)
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Reasons an LRUCache evicts an entry for.
+const (
+	evictCapacity = "capacity"
+	evictExpired  = "expired"
+)
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	size    int
+	expires time.Time
+}
+
+// LRUCache is a cache bounded by its number of entries and, when sizeOf is
+// set, by their total size, evicting the least recently used ones first.
+// Entries expire after the TTL they were set with.
+type LRUCache[K comparable, V any] struct {
+	maxEntries int
+	maxBytes   int
+	sizeOf     func(key K, value V) int
+	// onEvict is called with the reason of every eviction, under the lock
+	onEvict func(reason string)
+
+	mu      sync.Mutex
+	entries map[K]*list.Element
+	order   *list.List
+	bytes   int
+}
+
+// NewLRUCache returns a cache of at most maxEntries entries and, unless 0,
+// maxBytes bytes as measured by sizeOf.
+func NewLRUCache[K comparable, V any](maxEntries int, maxBytes int, sizeOf func(key K, value V) int, onEvict func(reason string)) *LRUCache[K, V] {
+	if sizeOf == nil {
+		maxBytes = 0
+	}
+
+	return &LRUCache[K, V]{
+		maxEntries: max(maxEntries, 1),
+		maxBytes:   maxBytes,
+		sizeOf:     sizeOf,
+		onEvict:    onEvict,
+		entries:    map[K]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// Get returns the value of key, unless missing or expired.
+func (c *LRUCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		var zero V
+		return zero, false
+	}
+	entry := element.Value.(*lruEntry[K, V])
+	if !time.Now().Before(entry.expires) {
+		c.remove(element, evictExpired)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+
+	return entry.value, true
+}
+
+// Set stores value for key for ttl, evicting the least recently used entries
+// over the bounds.
+func (c *LRUCache[K, V]) Set(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := 0
+	if c.sizeOf != nil {
+		size = c.sizeOf(key, value)
+	}
+	entry := &lruEntry[K, V]{key: key, value: value, size: size, expires: time.Now().Add(ttl)}
+	if element, found := c.entries[key]; found {
+		c.bytes += size - element.Value.(*lruEntry[K, V]).size
+		element.Value = entry
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[key] = c.order.PushFront(entry)
+		c.bytes += size
+	}
+
+	for c.order.Len() > c.maxEntries || (c.maxBytes > 0 && c.bytes > c.maxBytes && c.order.Len() > 1) {
+		oldest := c.order.Back()
+		reason := evictCapacity
+		if !time.Now().Before(oldest.Value.(*lruEntry[K, V]).expires) {
+			reason = evictExpired
+		}
+		c.remove(oldest, reason)
+	}
+}
+
+func (c *LRUCache[K, V]) remove(element *list.Element, reason string) {
+	entry := element.Value.(*lruEntry[K, V])
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+	if c.onEvict != nil {
+		c.onEvict(reason)
+	}
+}
+
+// Len returns the number of entries, expired ones not evicted yet included.
+func (c *LRUCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	geoipCity *geoip2.Reader
+	geoipASN  *geoip2.Reader
+)
+
+// openGeoIP opens the local GeoLite2 City and ASN databases, either of which
+// may be left unset.
+func openGeoIP(cityPath string, asnPath string) error {
+	var err error
+	if cityPath != "" {
+		if geoipCity, err = geoip2.Open(cityPath); err != nil {
+			return fmt.Errorf("failed to open '%s': %v", cityPath, err)
+		}
+		slog.Info("Using GeoLite2 City database", "path", cityPath)
+	}
+
+	if asnPath != "" {
+		if geoipASN, err = geoip2.Open(asnPath); err != nil {
+			return fmt.Errorf("failed to open '%s': %v", asnPath, err)
+		}
+		slog.Info("Using GeoLite2 ASN database", "path", asnPath)
+	}
+
+	return nil
+}
+
+func getGeoIP(host string, ctx context.Context, tracer trace.Tracer) (IPInfo, error) {
+	_, span := tracer.Start(
+		ctx,
+		"getGeoIP")
+	defer span.End()
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		err := fmt.Errorf("invalid IP '%s'", host)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return IPInfo{}, err
+	}
+
+	ipInfo := IPInfo{IP: host}
+
+	if geoipCity != nil {
+		city, err := geoipCity.City(ip)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return IPInfo{}, err
+		}
+
+		ipInfo.City = city.City.Names["en"]
+		if len(city.Subdivisions) > 0 {
+			ipInfo.Region = city.Subdivisions[0].Names["en"]
+		}
+		ipInfo.Country = city.Country.IsoCode
+		ipInfo.Latitude = city.Location.Latitude
+		ipInfo.Longitude = city.Location.Longitude
+		ipInfo.Timezone = city.Location.TimeZone
+	}
+
+	if geoipASN != nil {
+		asn, err := geoipASN.ASN(ip)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return IPInfo{}, err
+		}
+
+		if asn.AutonomousSystemNumber != 0 {
+			ipInfo.Org = fmt.Sprintf("AS%d %s", asn.AutonomousSystemNumber, asn.AutonomousSystemOrganization)
+		}
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Got IP info from GeoLite2 for '%s'", host))
+	return ipInfo, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Attributes held between two publications, the rest being dropped until the
+// next one.
+const maxMISPPending = 10000
+
+type mispAttribute struct {
+	Type     string `json:"type"`
+	Category string `json:"category"`
+	Value    string `json:"value"`
+	ToIDS    bool   `json:"to_ids"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type mispTag struct {
+	Name string `json:"name"`
+}
+
+type mispEvent struct {
+	ID            string          `json:"id,omitempty"`
+	Info          string          `json:"info"`
+	Date          string          `json:"date"`
+	Distribution  string          `json:"distribution"`
+	ThreatLevelID string          `json:"threat_level_id"`
+	Analysis      string          `json:"analysis"`
+	Attribute     []mispAttribute `json:"Attribute,omitempty"`
+	Tag           []mispTag       `json:"Tag,omitempty"`
+}
+
+// MISPPublisher publishes the indicators seen by the honeypot to a MISP
+// instance: source IPs, credentials, public key fingerprints and the hashes
+// of the uploaded or downloaded files. Indicators are collected and published
+// on an interval to a single MISP event per day, created with the first
+// publication of the day and updated with the new indicators afterwards.
+type MISPPublisher struct {
+	url          string
+	apiKey       string
+	distribution int
+	threatLevel  int
+	tags         []string
+	anonymizer   *Anonymizer
+	client       *http.Client
+	tracer       trace.Tracer
+
+	mu        sync.Mutex
+	pending   []mispAttribute
+	published map[string]struct{}
+
+	// The day and its event, only changed while publishing
+	publishMu sync.Mutex
+	day       string
+	eventID   string
+}
+
+func NewMISPPublisher(url string, apiKey string, distribution int, threatLevel int, tags []string, anonymizer *Anonymizer, tracer trace.Tracer) *MISPPublisher {
+	return &MISPPublisher{
+		url:          strings.TrimRight(url, "/"),
+		apiKey:       apiKey,
+		distribution: distribution,
+		threatLevel:  threatLevel,
+		tags:         tags,
+		anonymizer:   anonymizer,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		tracer:       tracer,
+		published:    map[string]struct{}{},
+	}
+}
+
+// Observe collects the indicators of event not yet published today.
+func (m *MISPPublisher) Observe(ctx context.Context, event Event) {
+	sshInfo := m.anonymizer.Anonymize(event).SSHInfo
+
+	attributes := []mispAttribute{{
+		Type:     "ip-src",
+		Category: "Network activity",
+		Value:    sshInfo.RemoteHost,
+		ToIDS:    true,
+	}}
+	if isPasswordAttempt(sshInfo) && sshInfo.User != "" {
+		attributes = append(attributes, mispAttribute{
+			Type:     "text",
+			Category: "Other",
+			Value:    sshInfo.User + ":" + sshInfo.Password,
+			Comment:  "Credentials tried",
+		})
+	}
+	if sshInfo.Function == "public_key" {
+		if key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(sshInfo.Key)); err == nil {
+			attributes = append(attributes, mispAttribute{
+				Type:     "ssh-fingerprint",
+				Category: "Network activity",
+				Value:    gossh.FingerprintSHA256(key),
+				ToIDS:    true,
+				Comment:  "Public key offered",
+			})
+		}
+	}
+	if sshInfo.FileSHA256 != "" {
+		attributes = append(attributes, mispAttribute{
+			Type:     "sha256",
+			Category: "Payload delivery",
+			Value:    sshInfo.FileSHA256,
+			ToIDS:    true,
+			Comment:  "File " + sshInfo.FileOperation,
+		})
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, indicator := range attributes {
+		if indicator.Value == "" {
+			continue
+		}
+		key := indicator.Type + "|" + indicator.Value
+		if _, found := m.published[key]; found {
+			continue
+		}
+		if len(m.pending) >= maxMISPPending {
+			return
+		}
+		m.published[key] = struct{}{}
+		m.pending = append(m.pending, indicator)
+	}
+}
+
+// Run publishes the collected indicators every interval.
+func (m *MISPPublisher) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.Publish(context.Background())
+	}
+}
+
+// Publish adds the collected indicators to the event of the day, creating it
+// if needed. Indicators that failed to be published are retried next time.
+func (m *MISPPublisher) Publish(ctx context.Context) {
+	m.publishMu.Lock()
+	defer m.publishMu.Unlock()
+
+	day := time.Now().UTC().Format(time.DateOnly)
+	m.mu.Lock()
+	attributes := m.pending
+	m.pending = nil
+	if day != m.day {
+		// Indicators are published again in the event of the new day
+		m.day = day
+		m.eventID = ""
+		m.published = map[string]struct{}{}
+		for _, indicator := range attributes {
+			m.published[indicator.Type+"|"+indicator.Value] = struct{}{}
+		}
+	}
+	m.mu.Unlock()
+
+	if len(attributes) == 0 {
+		return
+	}
+
+	ctx, span := m.tracer.Start(
+		ctx,
+		"publishMISP",
+		trace.WithAttributes(attribute.Int("attributes", len(attributes))))
+	defer span.End()
+
+	if err := m.publish(ctx, attributes); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Failed to publish to MISP", "attributes", len(attributes), "error", err)
+
+		m.mu.Lock()
+		m.pending = append(attributes, m.pending...)
+		m.mu.Unlock()
+		return
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Published %d attributes to MISP event %s", len(attributes), m.eventID))
+	slog.DebugContext(ctx, "Published to MISP", "event_id", m.eventID, "attributes", len(attributes))
+}
+
+func (m *MISPPublisher) publish(ctx context.Context, attributes []mispAttribute) error {
+	info := "SSH honeypot activity " + m.day
+	if m.eventID == "" {
+		// The event may have been created before a restart
+		id, err := m.findEvent(ctx, info)
+		if err != nil {
+			return err
+		}
+		m.eventID = id
+	}
+
+	if m.eventID == "" {
+		event := mispEvent{
+			Info:          info,
+			Date:          m.day,
+			Distribution:  fmt.Sprint(m.distribution),
+			ThreatLevelID: fmt.Sprint(m.threatLevel),
+			Analysis:      "1",
+			Attribute:     attributes,
+		}
+		for _, tag := range m.tags {
+			event.Tag = append(event.Tag, mispTag{Name: tag})
+		}
+
+		var created struct {
+			Event mispEvent `json:"Event"`
+		}
+		if err := m.request(ctx, "/events/add", map[string]any{"Event": event}, &created); err != nil {
+			return err
+		}
+		m.eventID = created.Event.ID
+		return nil
+	}
+
+	return m.request(ctx, "/attributes/add/"+m.eventID, attributes, nil)
+}
+
+// findEvent returns the ID of the event described by info, if any.
+func (m *MISPPublisher) findEvent(ctx context.Context, info string) (string, error) {
+	var found struct {
+		Response []struct {
+			Event mispEvent `json:"Event"`
+		} `json:"response"`
+	}
+	query := map[string]any{"eventinfo": info, "metadata": true, "limit": 1}
+	if err := m.request(ctx, "/events/restSearch", query, &found); err != nil {
+		return "", err
+	}
+	if len(found.Response) == 0 {
+		return "", nil
+	}
+
+	return found.Response[0].Event.ID, nil
+}
+
+// request posts payload to the MISP API at path, decoding the response into
+// result unless it's nil.
+func (m *MISPPublisher) request(ctx context.Context, path string, payload any, result any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", m.apiKey)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: unexpected status %s: %s", path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MQTTSink publishes every event as a JSON EventDocument to an MQTT broker,
+// under a topic per event type, e.g. ssh-honeypot/login. The retained
+// prefix/status topic holds "online" while connected and, through the last
+// will, "offline" once the honeypot is gone.
+type MQTTSink struct {
+	client mqtt.Client
+	prefix string
+	qos    byte
+	tracer trace.Tracer
+}
+
+func NewMQTTSink(broker string, prefix string, qos byte, clientID string, username string, password string, tracer trace.Tracer) (*MQTTSink, error) {
+	if qos > 2 {
+		return nil, fmt.Errorf("invalid QoS %d, expected 0, 1 or 2", qos)
+	}
+
+	status := prefix + "/status"
+	options := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetWill(status, "offline", 1, true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			client.Publish(status, 1, true, "online")
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("Disconnected from MQTT broker", "error", err)
+		})
+
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(30 * time.Second) {
+		return nil, fmt.Errorf("timed out connecting to %s", broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	return &MQTTSink{client: client, prefix: prefix, qos: qos, tracer: tracer}, nil
+}
+
+func mqttSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		return nil, nil
+	}
+
+	return NewMQTTSink(broker, getEnv("MQTT_TOPIC_PREFIX", "ssh-honeypot"), byte(getEnvInt("MQTT_QOS", 1)),
+		getEnv("MQTT_CLIENT_ID", "ssh-honeypot-"+node.ID), os.Getenv("MQTT_USERNAME"), os.Getenv("MQTT_PASSWORD"), tracer)
+}
+
+func (s *MQTTSink) Name() string {
+	return "mqtt"
+}
+
+func (s *MQTTSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToMQTT",
+		trace.WithAttributes(
+			attribute.Int("batch_size", len(batch.Events)),
+			attribute.Int("qos", int(s.qos))))
+	defer span.End()
+
+	tokens := make([]mqtt.Token, 0, len(batch.Events))
+	for _, event := range batch.Events {
+		document := newEventDocument(event)
+		payload, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+
+		tokens = append(tokens, s.client.Publish(s.prefix+"/"+document.Function, s.qos, false, payload))
+	}
+
+	// Above QoS 0 tokens complete once the broker acknowledged the message
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for _, token := range tokens {
+		select {
+		case <-token.Done():
+			if err := token.Error(); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return err
+			}
+		case <-ctx.Done():
+			span.RecordError(ctx.Err())
+			span.SetStatus(codes.Error, ctx.Err().Error())
+			return fmt.Errorf("waiting for acknowledgements: %w", ctx.Err())
+		}
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Published %d events", len(tokens)))
+	return nil
+}
+
+// Close marks the honeypot offline and disconnects.
+func (s *MQTTSink) Close() error {
+	s.client.Publish(s.prefix+"/status", 1, true, "offline").WaitTimeout(5 * time.Second)
+	s.client.Disconnect(1000)
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NATSSink publishes every event as a JSON EventDocument to a JetStream
+// subject. A batch is written once JetStream acknowledged every event, and
+// retried otherwise. The event ID is sent as the message ID, so JetStream
+// drops the duplicates of retried batches within its duplicate window.
+type NATSSink struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	subject string
+	tracer  trace.Tracer
+}
+
+// NewNATSSink connects to the servers at url, and creates the stream named
+// stream capturing subject when it doesn't exist.
+func NewNATSSink(url string, subject string, stream string, credsPath string, tracer trace.Tracer) (*NATSSink, error) {
+	options := []nats.Option{
+		nats.Name("ssh-honeypot"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			// err is nil when the connection is closed on purpose
+			if err != nil {
+				slog.Warn("Disconnected from NATS", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			slog.Info("Reconnected to NATS", "server", conn.ConnectedUrl())
+		}),
+	}
+	if credsPath != "" {
+		options = append(options, nats.UserCredentials(credsPath))
+	}
+
+	conn, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := js.StreamInfo(stream); errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{Name: stream, Subjects: []string{subject}})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create stream %s: %v", stream, err)
+		}
+		slog.Info("Created JetStream stream", "stream", stream, "subject", subject)
+	} else if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &NATSSink{conn: conn, js: js, subject: subject, tracer: tracer}, nil
+}
+
+func natsSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	return NewNATSSink(url, getEnv("NATS_SUBJECT", "ssh-honeypot.events"), getEnv("NATS_STREAM", "SSH_HONEYPOT"), os.Getenv("NATS_CREDS"), tracer)
+}
+
+func (s *NATSSink) Name() string {
+	return "nats"
+}
+
+func (s *NATSSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToNATS",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	futures := make([]nats.PubAckFuture, 0, len(batch.Events))
+	for _, event := range batch.Events {
+		document := newEventDocument(event)
+		data, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+
+		future, err := s.js.PublishAsync(s.subject, data, nats.MsgId(document.ID))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		futures = append(futures, future)
+	}
+
+	// Acknowledgements never come for messages lost while disconnected
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for _, future := range futures {
+		select {
+		case <-future.Ok():
+		case err := <-future.Err():
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		case <-ctx.Done():
+			span.RecordError(ctx.Err())
+			span.SetStatus(codes.Error, ctx.Err().Error())
+			return fmt.Errorf("waiting for acknowledgements: %w", ctx.Err())
+		}
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Published %d events", len(futures)))
+	return nil
+}
+
+// Close flushes what is buffered and closes the connection.
+func (s *NATSSink) Close() error {
+	return s.conn.Drain()
+}
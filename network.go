@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenNetworks maps the LISTEN_NETWORK values onto the networks of
+// net.Listen. "dual" listens on IPv4 and IPv6 through a single socket, the
+// IPv4 clients showing up as IPv4-mapped IPv6 addresses that addrHostPort
+// turns back into IPv4 ones.
+var listenNetworks = map[string]string{
+	"dual": "tcp",
+	"tcp4": "tcp4",
+	"tcp6": "tcp6",
+}
+
+// listenAddrs returns the network and addresses the listeners of port bind,
+// from LISTEN_NETWORK (dual, tcp4 or tcp6) and LISTEN_ADDRESS, a comma
+// separated list of IPs and interface names (every address of the network
+// when unset).
+func listenAddrs(port string) (string, []string, error) {
+	name := getEnv("LISTEN_NETWORK", "dual")
+	network, found := listenNetworks[name]
+	if !found {
+		return "", nil, fmt.Errorf("unknown listen network '%s', expected 'dual', 'tcp4' or 'tcp6'", name)
+	}
+
+	hosts := splitList(os.Getenv("LISTEN_ADDRESS"))
+	if len(hosts) == 0 {
+		return network, []string{net.JoinHostPort("", port)}, nil
+	}
+
+	var addrs []string
+	for _, host := range hosts {
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		if ip == nil {
+			ips, err := interfaceIPs(host, network)
+			if err != nil {
+				return "", nil, err
+			}
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			}
+			continue
+		}
+		if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+			return "", nil, fmt.Errorf("listen address '%s' isn't a %s address", host, network)
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+
+	return network, addrs, nil
+}
+
+// interfaceIPs returns the addresses of the network interface name usable
+// on network, leaving out the IPv6 link-local ones, which need a zone.
+func interfaceIPs(name string, network string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("listen address '%s' is neither an IP nor an interface: %v", name, err)
+	}
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, addr := range ifaceAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface '%s' has no %s address", name, network)
+	}
+
+	return ips, nil
+}
+
+// listen announces on addrs, all of the same port, or takes over the socket
+// of their port passed by systemd socket activation, whatever its network
+// and address. Several addresses are accepted from as a single listener.
+func listen(network string, addrs []string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(addrs[0])
+	if err != nil {
+		return nil, err
+	}
+	if listener := systemdSockets.take(port); listener != nil {
+		return listener, nil
+	}
+
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+
+	return newMultiListener(listeners), nil
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts the connections of several listeners as one, for
+// servers serving a single listener.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, listener := range listeners {
+		go m.accept(listener)
+	}
+	return m
+}
+
+// accept hands the connections and errors of listener over to Accept, until
+// it's closed.
+func (m *multiListener) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-m.accepted:
+		return result.conn, result.err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, listener := range m.listeners {
+			errs = append(errs, listener.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener.
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// addrHostPort splits addr into its host and port, the host being the
+// canonical form of the IP: IPv4-mapped IPv6 addresses become IPv4 ones, and
+// the zone of link-local IPv6 addresses, the local interface they came in
+// through, is dropped so the host stays a plain IP.
+func addrHostPort(addr net.Addr) (string, string) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String(), strconv.Itoa(tcpAddr.Port)
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), ""
+	}
+	host, _, _ = strings.Cut(host, "%")
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+
+	return host, port
+}
+
+// isPrivateIP reports whether ip isn't routable on the internet: loopback,
+// RFC 1918 and IPv6 unique local addresses, and IPv4 and IPv6 link-local
+// addresses.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// isLoopbackAddr reports whether addr, a "host:port" listen address, only
+// binds the loopback interface.
+func isLoopbackAddr(addr string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+	ip := net.ParseIP(host)
+
+	return host == "localhost" || (ip != nil && ip.IsLoopback()), nil
+}
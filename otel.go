@@ -2,63 +2,281 @@ package main
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/marceloalmeida/ssh-honeypot/telemetry"
+	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
-func initTracer() func() {
+// initTracer sets up the trace and metric exporters, over the protocol set
+// by OTEL_EXPORTER_OTLP_PROTOCOL, returning a function flushing and stopping
+// them, and the check of the collector being reachable.
+func initTracer() (func(), HealthCheck) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
 	res, err := newResource(ctx)
 	reportErr(err, "failed to create res")
 
-	otelExporterOtlpEndpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
-	if otelExporterOtlpEndpoint == "" {
-		otelExporterOtlpEndpoint = "localhost:4317"
+	collector, err := newCollectorEndpoint(getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc"), os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	if err != nil {
+		fatal("Failed to configure OTLP exporter", "error", err)
+	}
+	headers, err := otlpHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		fatal("Failed to parse OTEL_EXPORTER_OTLP_HEADERS", "error", err)
+	}
+
+	exportLogs := false
+	switch logsExporter := getEnv("OTEL_LOGS_EXPORTER", "none"); logsExporter {
+	case "none":
+	case "otlp":
+		exportLogs = true
+	default:
+		fatal("Unsupported OTEL_LOGS_EXPORTER, expected 'otlp' or 'none'", "exporter", logsExporter)
 	}
-	conn, err := grpc.DialContext(ctx, otelExporterOtlpEndpoint, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-	reportErr(err, "failed to create gRPC connection to collector")
 
-	// Set up a trace exporter
-	traceExporter, err := newExporter(ctx, conn)
-	reportErr(err, "failed to create trace exporter")
+	var traceExporter *otlptrace.Exporter
+	var metricExporter sdkmetric.Exporter
+	var logExporter sdklog.Exporter
+	var check HealthCheck
+	if collector.protocol == "grpc" {
+		creds := insecure.NewCredentials()
+		if collector.tls != nil {
+			creds = credentials.NewTLS(collector.tls)
+		}
+		conn, err := grpc.DialContext(ctx, collector.addr, grpc.WithTransportCredentials(creds), grpc.WithBlock())
+		reportErr(err, "failed to create gRPC connection to collector")
+
+		traceExporter, err = newExporter(ctx, conn, headers)
+		reportErr(err, "failed to create trace exporter")
+		metricExporter, err = otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithGRPCConn(conn), otlpmetricgrpc.WithHeaders(headers))
+		reportErr(err, "failed to create metric exporter")
+		if exportLogs {
+			logExporter, err = otlploggrpc.New(ctx, otlploggrpc.WithGRPCConn(conn), otlploggrpc.WithHeaders(headers))
+			reportErr(err, "failed to create log exporter")
+		}
+		check = grpcConnCheck(conn)
+	} else {
+		// Nothing is sent until the first export, the exporters don't
+		// connect before
+		traceOptions := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(collector.addr),
+			otlptracehttp.WithURLPath(collector.path + "/v1/traces"),
+			otlptracehttp.WithHeaders(headers),
+		}
+		metricOptions := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(collector.addr),
+			otlpmetrichttp.WithURLPath(collector.path + "/v1/metrics"),
+			otlpmetrichttp.WithHeaders(headers),
+		}
+		logOptions := []otlploghttp.Option{
+			otlploghttp.WithEndpoint(collector.addr),
+			otlploghttp.WithURLPath(collector.path + "/v1/logs"),
+			otlploghttp.WithHeaders(headers),
+		}
+		if collector.tls != nil {
+			traceOptions = append(traceOptions, otlptracehttp.WithTLSClientConfig(collector.tls))
+			metricOptions = append(metricOptions, otlpmetrichttp.WithTLSClientConfig(collector.tls))
+			logOptions = append(logOptions, otlploghttp.WithTLSClientConfig(collector.tls))
+		} else {
+			traceOptions = append(traceOptions, otlptracehttp.WithInsecure())
+			metricOptions = append(metricOptions, otlpmetrichttp.WithInsecure())
+			logOptions = append(logOptions, otlploghttp.WithInsecure())
+		}
+
+		traceExporter, err = otlptracehttp.New(ctx, traceOptions...)
+		reportErr(err, "failed to create trace exporter")
+		metricExporter, err = otlpmetrichttp.New(ctx, metricOptions...)
+		reportErr(err, "failed to create metric exporter")
+		if exportLogs {
+			logExporter, err = otlploghttp.New(ctx, logOptions...)
+			reportErr(err, "failed to create log exporter")
+		}
+		check = tcpCheck(collector.addr)
+	}
 
 	// Register the trace exporter with a TracerProvider, using a batch
 	// span processor to aggregate spans before export.
 	batchSpanProcessor := sdktrace.NewBatchSpanProcessor(traceExporter)
-	tracerProvider := newTraceProvider(res, batchSpanProcessor)
+	sampler, err := newSampler(getEnv("OTEL_TRACES_SAMPLER", "parentbased_always_on"), os.Getenv("OTEL_TRACES_SAMPLER_ARG"), getEnvInt("TRACE_RATE_LIMIT", 0))
+	if err != nil {
+		fatal("Failed to configure trace sampling", "error", err)
+	}
+	tracerProvider := newTraceProvider(res, sampler, batchSpanProcessor)
 	otel.SetTracerProvider(tracerProvider)
 
+	// Metrics share the resource and the collector with traces, and are
+	// exported periodically (OTEL_METRIC_EXPORT_INTERVAL, 60s by default).
+	meterProvider := newMeterProvider(res, sdkmetric.NewPeriodicReader(metricExporter))
+	otel.SetMeterProvider(meterProvider)
+
+	// Logs are exported on top of being written out, with the trace and span
+	// of the context they're logged with.
+	var loggerProvider *sdklog.LoggerProvider
+	if logExporter != nil {
+		loggerProvider = sdklog.NewLoggerProvider(
+			sdklog.WithResource(res),
+			sdklog.WithProcessor(sdklog.NewBatchProcessor(logExporter)),
+		)
+		teeLogs(otelslog.NewHandler("ssh-honeypot", otelslog.WithLoggerProvider(loggerProvider)))
+	}
+
+	cancel()
+
 	return func() {
 		// Shutdown will flush any remaining spans and shut down the exporter.
+		// The setup context has long expired by then, so it gets its own.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 		reportErr(tracerProvider.Shutdown(ctx), "failed to shutdown TracerProvider")
-		cancel()
-	}
+		reportErr(meterProvider.Shutdown(ctx), "failed to shutdown MeterProvider")
+		if loggerProvider != nil {
+			reportErr(loggerProvider.Shutdown(ctx), "failed to shutdown LoggerProvider")
+		}
+	}, check
+}
+
+func newMeterProvider(res *resource.Resource, reader sdkmetric.Reader) *sdkmetric.MeterProvider {
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(reader),
+	)
+	return meterProvider
 }
 
-func newTraceProvider(res *resource.Resource, bsp sdktrace.SpanProcessor) *sdktrace.TracerProvider {
+func newTraceProvider(res *resource.Resource, sampler sdktrace.Sampler, bsp sdktrace.SpanProcessor) *sdktrace.TracerProvider {
 	tracerProvider := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSampler(sampler),
 		sdktrace.WithResource(res),
 		sdktrace.WithSpanProcessor(bsp),
 	)
 	return tracerProvider
 }
 
-func newExporter(ctx context.Context, conn *grpc.ClientConn) (*otlptrace.Exporter, error) {
-	return otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+func newExporter(ctx context.Context, conn *grpc.ClientConn, headers map[string]string) (*otlptrace.Exporter, error) {
+	return otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn), otlptracegrpc.WithHeaders(headers))
+}
+
+// collectorEndpoint is where the OTLP exporters send to.
+type collectorEndpoint struct {
+	// protocol is "grpc" or "http/protobuf"
+	protocol string
+	addr     string
+	// path prefixes the signal paths of OTLP/HTTP, /v1/traces and
+	// /v1/metrics
+	path string
+	// tls is nil for plain text connections
+	tls *tls.Config
+}
+
+// newCollectorEndpoint parses endpoint, a host:port or a URL, defaulting to
+// the local collector port of protocol. The connection is in plain text
+// unless the endpoint is an https URL, OTEL_EXPORTER_OTLP_INSECURE is false
+// or a certificate is set, the CA bundle verifying the collector and the
+// client certificate and key authenticating the honeypot to it.
+func newCollectorEndpoint(protocol string, endpoint string) (collectorEndpoint, error) {
+	collector := collectorEndpoint{protocol: protocol, addr: endpoint}
+	switch protocol {
+	case "grpc":
+		if endpoint == "" {
+			collector.addr = "localhost:4317"
+		}
+	case "http/protobuf":
+		if endpoint == "" {
+			collector.addr = "localhost:4318"
+		}
+	default:
+		return collector, fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL '%s', expected 'grpc' or 'http/protobuf'", protocol)
+	}
+
+	useTLS := os.Getenv("OTEL_EXPORTER_OTLP_INSECURE") == "false"
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" && (u.Scheme == "http" || u.Scheme == "https") {
+		useTLS = useTLS || u.Scheme == "https"
+		collector.addr = u.Host
+		collector.path = strings.TrimSuffix(u.Path, "/")
+		if u.Port() == "" && u.Scheme == "https" {
+			collector.addr += ":443"
+		} else if u.Port() == "" {
+			collector.addr += ":80"
+		}
+	}
+
+	caFile := os.Getenv("OTEL_EXPORTER_OTLP_CERTIFICATE")
+	certFile := os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE")
+	keyFile := os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_KEY")
+	if !useTLS && caFile == "" && certFile == "" {
+		return collector, nil
+	}
+
+	collector.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return collector, err
+		}
+		collector.tls.RootCAs = x509.NewCertPool()
+		if !collector.tls.RootCAs.AppendCertsFromPEM(pem) {
+			return collector, fmt.Errorf("no certificate found in '%s'", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return collector, errors.New("both OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE and OTEL_EXPORTER_OTLP_CLIENT_KEY are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return collector, err
+		}
+		collector.tls.Certificates = []tls.Certificate{cert}
+	}
+
+	return collector, nil
+}
+
+// otlpHeaders parses the headers sent with every export, as comma separated
+// key=value pairs whose values are URL encoded, e.g.
+// "authorization=Bearer%20token".
+func otlpHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range splitList(value) {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid header '%s', expected key=value", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(val))
+		if err != nil {
+			return nil, fmt.Errorf("invalid header '%s': %v", key, err)
+		}
+		headers[strings.ToLower(strings.TrimSpace(key))] = decoded
+	}
+
+	return headers, nil
 }
 
 func newResource(ctx context.Context) (*resource.Resource, error) {
@@ -74,8 +292,13 @@ func newResource(ctx context.Context) (*resource.Resource, error) {
 	)
 }
 
+// metrics holds the instruments recorded across the honeypot. They are
+// created from the global MeterProvider, which forwards to the OTLP one once
+// initTracer has registered it.
+var metrics = telemetry.NewMetrics(otel.Meter("ssh-honeypot"))
+
 func reportErr(err error, message string) {
 	if err != nil {
-		log.Printf("%s: %v", message, err)
+		slog.Error(message, "error", err)
 	}
 }
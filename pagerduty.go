@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"text/template"
+	"time"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+const defaultPagerDutySummaryTemplate = `{{.Summary}}`
+
+const defaultOpsgenieMessageTemplate = `{{truncate 127 .Summary}}`
+
+const defaultOpsgenieDescriptionTemplate = `{{.Summary}}
+{{range $key, $value := details .}}
+{{$key}}: {{$value}}{{end}}
+{{if .DashboardURL}}
+{{.DashboardURL}}{{end}}`
+
+type PagerDutyNotifier struct {
+	routingKey string
+	summary    *template.Template
+}
+
+func NewPagerDutyNotifier(routingKey string, summaryTemplate string) (*PagerDutyNotifier, error) {
+	summary, err := parseAlertTemplate("pagerduty summary", summaryTemplate, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PagerDutyNotifier{
+		routingKey: routingKey,
+		summary:    summary,
+	}, nil
+}
+
+func (n *PagerDutyNotifier) Name() string {
+	return "pagerduty"
+}
+
+func (n *PagerDutyNotifier) Notify(ctx context.Context, alert Alert) error {
+	severity := "info"
+	switch alert.Severity {
+	case SeverityCritical:
+		severity = "critical"
+	case SeverityWarning:
+		severity = "warning"
+	}
+
+	var summary bytes.Buffer
+	if err := n.summary.Execute(&summary, alert); err != nil {
+		return err
+	}
+
+	event := map[string]any{
+		"routing_key":  n.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    alertDedupKey(alert),
+		"payload": map[string]any{
+			"summary":        summary.String(),
+			"source":         alert.Event.SSHInfo.LocalHost,
+			"severity":       severity,
+			"timestamp":      alert.Timestamp.Format(time.RFC3339),
+			"component":      "ssh-honeypot",
+			"class":          alert.Rule,
+			"custom_details": alertDetails(alert),
+		},
+	}
+	if alert.DashboardURL != "" {
+		event["links"] = []map[string]string{
+			{"href": alert.DashboardURL, "text": "Dashboard"},
+		}
+	}
+
+	return postJSON(ctx, pagerDutyEventsURL, event, nil)
+}
+
+type OpsgenieNotifier struct {
+	apiURL      string
+	apiKey      string
+	message     *template.Template
+	description *template.Template
+}
+
+func NewOpsgenieNotifier(apiURL string, apiKey string, messageTemplate string, descriptionTemplate string) (*OpsgenieNotifier, error) {
+	funcs := template.FuncMap{"details": alertDetails}
+
+	message, err := parseAlertTemplate("opsgenie message", messageTemplate, funcs)
+	if err != nil {
+		return nil, err
+	}
+	description, err := parseAlertTemplate("opsgenie description", descriptionTemplate, funcs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OpsgenieNotifier{
+		apiURL:      apiURL,
+		apiKey:      apiKey,
+		message:     message,
+		description: description,
+	}, nil
+}
+
+func (n *OpsgenieNotifier) Name() string {
+	return "opsgenie"
+}
+
+func (n *OpsgenieNotifier) Notify(ctx context.Context, alert Alert) error {
+	priority := "P5"
+	switch alert.Severity {
+	case SeverityCritical:
+		priority = "P1"
+	case SeverityWarning:
+		priority = "P3"
+	}
+
+	var message, description bytes.Buffer
+	if err := n.message.Execute(&message, alert); err != nil {
+		return err
+	}
+	if err := n.description.Execute(&description, alert); err != nil {
+		return err
+	}
+
+	body := map[string]any{
+		"message":     message.String(),
+		"alias":       alertDedupKey(alert),
+		"description": description.String(),
+		"priority":    priority,
+		"source":      "ssh-honeypot",
+		"tags":        []string{"ssh-honeypot", alert.Rule},
+		"details":     alertDetails(alert),
+	}
+
+	return postJSON(ctx, n.apiURL+"/v2/alerts", body, map[string]string{
+		"Authorization": "GenieKey " + n.apiKey,
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Password patterns, in the order they are checked. An event is tagged with
+// the first pattern its password matches.
+const (
+	PasswordEmpty        = "empty"
+	PasswordDefault      = "default"
+	PasswordUsername     = "username"
+	PasswordKeyboardWalk = "keyboard_walk"
+	PasswordRepeated     = "repeated"
+	PasswordDate         = "date"
+)
+
+// Vendor defaults and the credentials every brute forcing list starts with.
+var defaultCredentials = map[string]struct{}{
+	"admin\x00admin": {}, "admin\x00admin123": {}, "admin\x001234": {}, "admin\x0012345": {},
+	"admin\x00password": {}, "default\x00default": {}, "ftp\x00ftp": {}, "git\x00git": {},
+	"guest\x00guest": {}, "oracle\x00oracle": {}, "pi\x00raspberry": {}, "postgres\x00postgres": {},
+	"root\x00123456": {}, "root\x001234": {}, "root\x00admin": {}, "root\x00password": {},
+	"root\x00root": {}, "root\x00toor": {}, "root\x00vizxv": {}, "root\x00xc3511": {},
+	"support\x00support": {}, "test\x00test": {}, "ubnt\x00ubnt": {}, "user\x00user": {},
+	"vagrant\x00vagrant": {},
+}
+
+var commonPasswords = map[string]struct{}{
+	"123456": {}, "123456789": {}, "12345678": {}, "12345": {}, "1234": {}, "1234567": {},
+	"111111": {}, "123123": {}, "abc123": {}, "admin": {}, "changeme": {}, "default": {},
+	"dragon": {}, "letmein": {}, "pass": {}, "passw0rd": {}, "password": {}, "p@ssw0rd": {},
+	"qwerty": {}, "root": {}, "test": {},
+}
+
+var keyboardWalks = []string{
+	"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p", "zaq1xsw2cde3vfr4bgt5nhy6mju7",
+	"qazwsxedcrfvtgbyhnujmikolp",
+}
+
+var (
+	yearPattern  = regexp.MustCompile(`(19[5-9]\d|20[0-3]\d)`)
+	leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+)
+
+// passwordPattern returns the first pattern password matches, or an empty
+// string for passwords without a recognizable pattern.
+func passwordPattern(user string, password string) string {
+	lower := strings.ToLower(password)
+
+	if password == "" {
+		return PasswordEmpty
+	}
+	if _, ok := defaultCredentials[strings.ToLower(user)+"\x00"+lower]; ok {
+		return PasswordDefault
+	}
+	if _, ok := commonPasswords[lower]; ok {
+		return PasswordDefault
+	}
+	if isUsernameVariant(user, lower) {
+		return PasswordUsername
+	}
+	if isKeyboardWalk(lower) {
+		return PasswordKeyboardWalk
+	}
+	if strings.Count(lower, lower[:1]) == len(lower) {
+		return PasswordRepeated
+	}
+	if yearPattern.MatchString(lower) {
+		return PasswordDate
+	}
+
+	return ""
+}
+
+// isUsernameVariant reports whether password is the username, reversed,
+// written in leetspeak or followed by digits and symbols, like "r00t" or
+// "admin123!".
+func isUsernameVariant(user string, password string) bool {
+	user = strings.ToLower(user)
+	if len(user) < 3 {
+		return false
+	}
+
+	base := strings.TrimRightFunc(password, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	candidates := []string{password, base, leetReplacer.Replace(password), leetReplacer.Replace(base)}
+
+	for _, candidate := range candidates {
+		if candidate == user || candidate == reverseString(user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isKeyboardWalk reports whether password, of at least 4 characters, is a
+// run of adjacent keys in either direction.
+func isKeyboardWalk(password string) bool {
+	if len(password) < 4 {
+		return false
+	}
+
+	for _, walk := range keyboardWalks {
+		if strings.Contains(walk, password) || strings.Contains(reverseString(walk), password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// passwordEntropy estimates the bits of entropy of password from its length
+// and the character classes it draws from. It overestimates patterned
+// passwords, which is what the pattern tag is for.
+func passwordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	length := 0
+	for _, r := range password {
+		length++
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	return math.Round(float64(length)*math.Log2(float64(pool))*100) / 100
+}
+
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+
+	return string(runes)
+}
+
+// annotatePassword tags password attempts with the pattern and estimated
+// entropy of the password.
+func annotatePassword(ctx context.Context, event *Event) {
+	sshInfo := event.SSHInfo
+	if !isPasswordAttempt(sshInfo) {
+		return
+	}
+
+	entropy := passwordEntropy(sshInfo.Password)
+	event.Analysis.PasswordPattern = passwordPattern(sshInfo.User, sshInfo.Password)
+	event.Analysis.PasswordEntropy = &entropy
+}
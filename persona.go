@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// debianMotd is the message of the day of Debian and its derivatives.
+const debianMotd = `Linux {{.Hostname}} {{.KernelRelease}} {{.KernelVersion}} {{.Machine}}
+
+The programs included with the {{.OSName}} system are free software;
+the exact distribution terms for each program are described in the
+individual files in /usr/share/doc/*/copyright.
+
+{{.OSName}} comes with ABSOLUTELY NO WARRANTY, to the extent
+permitted by applicable law.
+`
+
+// Persona describes the host the shell pretends to be. The emulated commands,
+// the files describing the host, the SSH version and the prompt take their
+// details from it, so they agree with each other: nproc with lscpu and
+// /proc/cpuinfo, free with /proc/meminfo, uname with /proc/version and the
+// login banner, the SSH version with the distribution.
+type Persona struct {
+	// Profile names the built-in persona a JSON one starts from
+	Profile       string  `json:"profile"`
+	Hostname      string  `json:"hostname"`
+	OSName        string  `json:"os_name"`
+	OSID          string  `json:"os_id"`
+	OSVersion     string  `json:"os_version"`
+	OSVersionID   string  `json:"os_version_id"`
+	KernelRelease string  `json:"kernel_release"`
+	KernelVersion string  `json:"kernel_version"`
+	KernelBuild   string  `json:"kernel_build"`
+	Machine       string  `json:"machine"`
+	CPUVendor     string  `json:"cpu_vendor"`
+	CPUModel      string  `json:"cpu_model"`
+	CPUFamily     int     `json:"cpu_family"`
+	CPUModelID    int     `json:"cpu_model_id"`
+	CPUStepping   int     `json:"cpu_stepping"`
+	CPUMHz        float64 `json:"cpu_mhz"`
+	CPUCacheKB    int     `json:"cpu_cache_kb"`
+	CPUFlags      string  `json:"cpu_flags"`
+	CPUs          int     `json:"cpus"`
+	MemoryMB      int     `json:"memory_mb"`
+	SwapMB        int     `json:"swap_mb"`
+	// Uptime is how long the host had been up when the honeypot started
+	Uptime      string `json:"uptime"`
+	LoadAverage string `json:"load_average"`
+	// HardwareModel is the board of ARM hosts, e.g. a Raspberry Pi
+	HardwareModel string `json:"hardware_model"`
+	// SSHVersion is the version the SSH listeners show by default, and
+	// SSHVersions those picked from in the random version modes
+	SSHVersion  string   `json:"ssh_version"`
+	SSHVersions []string `json:"ssh_versions"`
+	// PromptStyle is "debian", user@host:~/dir$, or "redhat", [user@host dir]$
+	PromptStyle string `json:"prompt_style"`
+	// Motd is the template of the message shown on login, given the persona
+	Motd string `json:"motd"`
+	// User is the regular user of the host, and AdminGroup the group letting
+	// it use sudo, as id shows it
+	User       string `json:"user"`
+	AdminGroup string `json:"admin_group"`
+	// Files replace those of the filesystem template, and RemoveFiles are
+	// dropped from it, those of other distributions
+	Files       map[string]string `json:"files"`
+	RemoveFiles []string          `json:"remove_files"`
+
+	booted time.Time
+	motd   *template.Template
+}
+
+// defaultPersona is a small Debian 9 VPS, the host the shell always
+// emulated.
+var defaultPersona = Persona{
+	Hostname:      "debian",
+	OSName:        "Debian GNU/Linux",
+	OSID:          "debian",
+	OSVersion:     "9 (stretch)",
+	OSVersionID:   "9",
+	KernelRelease: "4.9.0-19-amd64",
+	KernelVersion: "#1 SMP Debian 4.9.320-2 (2022-06-30)",
+	KernelBuild:   "(debian-kernel@lists.debian.org) (gcc version 6.3.0 20170516 (Debian 6.3.0-18+deb9u1) )",
+	Machine:       "x86_64",
+	CPUVendor:     "GenuineIntel",
+	CPUModel:      "Intel(R) Xeon(R) CPU E5-2680 v4 @ 2.40GHz",
+	CPUFamily:     6,
+	CPUModelID:    79,
+	CPUStepping:   1,
+	CPUMHz:        2399.998,
+	CPUCacheKB:    35840,
+	CPUFlags: "fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ss syscall nx " +
+		"pdpe1gb rdtscp lm constant_tsc rep_good nopl xtopology cpuid pni pclmulqdq ssse3 fma cx16 pcid sse4_1 sse4_2 x2apic " +
+		"movbe popcnt tsc_deadline_timer aes xsave avx f16c rdrand hypervisor lahf_lm abm 3dnowprefetch invpcid_single pti " +
+		"fsgsbase bmi1 hle avx2 smep bmi2 erms invpcid rtm rdseed adx smap xsaveopt arat",
+	CPUs:        2,
+	MemoryMB:    3951,
+	SwapMB:      1022,
+	Uptime:      "986h13m",
+	LoadAverage: "0.08, 0.03, 0.01",
+	SSHVersion:  defaultServerVersion,
+	SSHVersions: defaultServerVersions,
+	PromptStyle: "debian",
+	Motd:        debianMotd,
+	User:        "admin",
+	AdminGroup:  "27(sudo)",
+}
+
+// LoadPersona returns the built-in persona named name, or reads the JSON
+// persona at the path name over the built-in one it names as its profile,
+// the default one otherwise, the fields it leaves out keeping their value.
+// The default persona is returned when name is empty.
+func LoadPersona(name string) (*Persona, error) {
+	persona := defaultPersona
+	if profile, found := personaProfiles[name]; found {
+		persona = profile
+	} else if name != "" {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var base struct {
+			Profile string `json:"profile"`
+		}
+		if err := json.Unmarshal(data, &base); err != nil {
+			return nil, fmt.Errorf("invalid persona %s: %v", name, err)
+		}
+		if base.Profile != "" {
+			if persona, found = personaProfiles[base.Profile]; !found {
+				return nil, fmt.Errorf("unknown persona profile '%s', expected one of %s", base.Profile, strings.Join(personaProfileNames(), ", "))
+			}
+		}
+		// The profile's own are left alone
+		persona.Files, persona.RemoveFiles = maps.Clone(persona.Files), slices.Clone(persona.RemoveFiles)
+		persona.SSHVersions = slices.Clone(persona.SSHVersions)
+		if err := json.Unmarshal(data, &persona); err != nil {
+			return nil, fmt.Errorf("invalid persona %s: %v", name, err)
+		}
+	}
+
+	uptime, err := time.ParseDuration(persona.Uptime)
+	if err != nil || uptime < 0 {
+		return nil, fmt.Errorf("invalid persona uptime '%s'", persona.Uptime)
+	}
+	if persona.CPUs < 1 || persona.MemoryMB < 1 {
+		return nil, fmt.Errorf("invalid persona, cpus and memory_mb must be positive")
+	}
+	if persona.PromptStyle != "debian" && persona.PromptStyle != "redhat" {
+		return nil, fmt.Errorf("invalid persona prompt_style '%s', expected 'debian' or 'redhat'", persona.PromptStyle)
+	}
+	if persona.SSHVersion == "" {
+		return nil, fmt.Errorf("invalid persona, ssh_version is required")
+	}
+	if len(persona.SSHVersions) == 0 {
+		persona.SSHVersions = []string{persona.SSHVersion}
+	}
+	if persona.motd, err = template.New("motd").Parse(persona.Motd); err != nil {
+		return nil, fmt.Errorf("invalid persona motd: %v", err)
+	}
+	persona.booted = time.Now().Add(-uptime)
+
+	return &persona, nil
+}
+
+// personaFromEnv lets SHELL_HOSTNAME override the hostname of the persona.
+func personaFromEnv() (*Persona, error) {
+	persona, err := LoadPersona(os.Getenv("SHELL_PERSONA"))
+	if err != nil {
+		return nil, err
+	}
+	if hostname := os.Getenv("SHELL_HOSTNAME"); hostname != "" {
+		persona.Hostname = hostname
+	}
+
+	return persona, nil
+}
+
+// personaProfileNames returns the names of the built-in personas, sorted.
+func personaProfileNames() []string {
+	names := make([]string, 0, len(personaProfiles))
+	for name := range personaProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// apply makes the filesystem template that of the host: the regular user of
+// the template renamed, the files of other hosts removed and those
+// describing the host added.
+func (p *Persona) apply(fileSystem *FileSystem) error {
+	fileSystem.RenameUser(defaultPersona.User, p.User)
+	for _, name := range p.RemoveFiles {
+		fileSystem.Remove(name)
+	}
+	for name, content := range p.files() {
+		perm := fs.FileMode(0o644)
+		switch path.Dir(name) {
+		case "/bin", "/sbin", "/usr/bin", "/usr/sbin":
+			perm = 0o755
+		}
+		if strings.HasPrefix(name, "/proc/") {
+			perm = 0o444
+		}
+		if err := fileSystem.AddFile(name, content, perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// motdText renders the message shown on login.
+func (p *Persona) motdText() string {
+	var b strings.Builder
+	if err := p.motd.Execute(&b, p); err != nil {
+		return ""
+	}
+
+	return b.String()
+}
+
+// files returns the files describing the host, which replace those of the
+// filesystem template.
+func (p *Persona) files() map[string]string {
+	files := map[string]string{
+		"/etc/hostname": p.Hostname + "\n",
+		"/etc/hosts": fmt.Sprintf("127.0.0.1\tlocalhost\n127.0.1.1\t%s\n\n"+
+			"# The following lines are desirable for IPv6 capable hosts\n"+
+			"::1     localhost ip6-localhost ip6-loopback\nff02::1 ip6-allnodes\nff02::2 ip6-allrouters\n", p.Hostname),
+		"/etc/issue": fmt.Sprintf("%s %s \\n \\l\n\n", p.OSName, p.OSVersionID),
+		"/etc/os-release": fmt.Sprintf("PRETTY_NAME=\"%[1]s %[2]s\"\nNAME=\"%[1]s\"\nVERSION_ID=\"%[3]s\"\nVERSION=\"%[2]s\"\nID=%[4]s\n",
+			p.OSName, p.OSVersion, p.OSVersionID, p.OSID),
+		"/proc/cpuinfo": p.cpuinfo(),
+		"/proc/meminfo": p.meminfo(),
+		"/proc/version": fmt.Sprintf("Linux version %s %s %s\n", p.KernelRelease, p.KernelBuild, p.KernelVersion),
+	}
+	if p.HardwareModel != "" {
+		files["/proc/device-tree/model"] = p.HardwareModel + "\x00"
+	}
+	for name, content := range p.Files {
+		files[name] = content
+	}
+
+	return files
+}
+
+// arm reports whether the host is an ARM one, whose CPUs are described
+// differently.
+func (p *Persona) arm() bool {
+	return strings.HasPrefix(p.Machine, "aarch64") || strings.HasPrefix(p.Machine, "arm")
+}
+
+func (p *Persona) cpuinfo() string {
+	var b strings.Builder
+	if p.arm() {
+		for i := 0; i < p.CPUs; i++ {
+			fmt.Fprintf(&b, "processor\t: %d\nBogoMIPS\t: 108.00\nFeatures\t: %s\nCPU implementer\t: 0x41\nCPU architecture: 8\n"+
+				"CPU variant\t: 0x0\nCPU part\t: %#x\nCPU revision\t: %d\n\n", i, p.CPUFlags, p.CPUModelID, p.CPUStepping)
+		}
+		fmt.Fprintf(&b, "Revision\t: c03114\nSerial\t\t: 10000000%08x\nModel\t\t: %s\n", len(p.Hostname)*0x1f3a5b, p.HardwareModel)
+		return b.String()
+	}
+	for i := 0; i < p.CPUs; i++ {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "processor\t: %d\nvendor_id\t: %s\ncpu family\t: %d\nmodel\t\t: %d\nmodel name\t: %s\nstepping\t: %d\n",
+			i, p.CPUVendor, p.CPUFamily, p.CPUModelID, p.CPUModel, p.CPUStepping)
+		fmt.Fprintf(&b, "cpu MHz\t\t: %.3f\ncache size\t: %d KB\nphysical id\t: 0\nsiblings\t: %d\ncore id\t\t: %d\ncpu cores\t: %d\n",
+			p.CPUMHz, p.CPUCacheKB, p.CPUs, i, p.CPUs)
+		fmt.Fprintf(&b, "apicid\t\t: %d\nfpu\t\t: yes\nfpu_exception\t: yes\ncpuid level\t: 13\nwp\t\t: yes\nflags\t\t: %s\n",
+			i, p.CPUFlags)
+		fmt.Fprintf(&b, "bogomips\t: %.2f\nclflush size\t: 64\ncache_alignment\t: 64\naddress sizes\t: 40 bits physical, 48 bits virtual\npower management:\n",
+			p.CPUMHz*2)
+	}
+
+	return b.String()
+}
+
+// memory returns the memory figures in MiB shown by free, in its column
+// order, made up from the total as on a host with little running.
+func (p *Persona) memory() (total, used, free, shared, cache, available int) {
+	total = p.MemoryMB
+	used = total * 104 / 1000
+	shared = min(10, total/100)
+	cache = total * 182 / 1000
+	free = total - used - cache
+	available = free + cache*2/3
+
+	return
+}
+
+func (p *Persona) meminfo() string {
+	total, _, free, shared, cache, available := p.memory()
+	return fmt.Sprintf("MemTotal:       %8d kB\nMemFree:        %8d kB\nMemAvailable:   %8d kB\nBuffers:        %8d kB\n"+
+		"Cached:         %8d kB\nSwapCached:     %8d kB\nShmem:          %8d kB\nSwapTotal:      %8d kB\nSwapFree:       %8d kB\n",
+		total*1024, free*1024, available*1024, cache*1024/10, cache*1024*9/10, 0, shared*1024, p.SwapMB*1024, p.SwapMB*1024)
+}
+
+// cpuList formats the list of the CPUs as lscpu does, e.g. "0-3".
+func (p *Persona) cpuList() string {
+	switch p.CPUs {
+	case 1:
+		return "0"
+	case 2:
+		return "0,1"
+	}
+
+	return fmt.Sprintf("0-%d", p.CPUs-1)
+}
+
+func (p *Persona) lscpu() string {
+	rows := [][2]string{
+		{"Architecture", p.Machine},
+		{"CPU op-mode(s)", "32-bit, 64-bit"},
+		{"Byte Order", "Little Endian"},
+		{"CPU(s)", fmt.Sprint(p.CPUs)},
+		{"On-line CPU(s) list", p.cpuList()},
+		{"Vendor ID", p.CPUVendor},
+		{"Model name", p.CPUModel},
+		{"Model", fmt.Sprint(p.CPUStepping)},
+		{"Thread(s) per core", "1"},
+		{"Core(s) per cluster", fmt.Sprint(p.CPUs)},
+		{"Socket(s)", "-"},
+		{"Cluster(s)", "1"},
+		{"Stepping", fmt.Sprintf("r0p%d", p.CPUStepping)},
+		{"CPU max MHz", fmt.Sprintf("%.4f", p.CPUMHz)},
+		{"CPU min MHz", "600.0000"},
+		{"BogoMIPS", "108.00"},
+		{"Flags", p.CPUFlags},
+	}
+	if !p.arm() {
+		rows = p.x86CPU()
+	}
+
+	var b strings.Builder
+	for _, row := range rows {
+		fmt.Fprintf(&b, "%-23s%s\n", row[0]+":", row[1])
+	}
+
+	return b.String()
+}
+
+// x86CPU returns the rows lscpu shows for an x86 host.
+func (p *Persona) x86CPU() [][2]string {
+	return [][2]string{
+		{"Architecture", p.Machine},
+		{"CPU op-mode(s)", "32-bit, 64-bit"},
+		{"Byte Order", "Little Endian"},
+		{"CPU(s)", fmt.Sprint(p.CPUs)},
+		{"On-line CPU(s) list", p.cpuList()},
+		{"Thread(s) per core", "1"},
+		{"Core(s) per socket", fmt.Sprint(p.CPUs)},
+		{"Socket(s)", "1"},
+		{"NUMA node(s)", "1"},
+		{"Vendor ID", p.CPUVendor},
+		{"CPU family", fmt.Sprint(p.CPUFamily)},
+		{"Model", fmt.Sprint(p.CPUModelID)},
+		{"Model name", p.CPUModel},
+		{"Stepping", fmt.Sprint(p.CPUStepping)},
+		{"CPU MHz", fmt.Sprintf("%.3f", p.CPUMHz)},
+		{"BogoMIPS", fmt.Sprintf("%.2f", p.CPUMHz*2)},
+		{"Hypervisor vendor", "KVM"},
+		{"Virtualization type", "full"},
+		{"L1d cache", "32K"},
+		{"L1i cache", "32K"},
+		{"L2 cache", "256K"},
+		{"L3 cache", fmt.Sprintf("%dK", p.CPUCacheKB)},
+		{"NUMA node0 CPU(s)", p.cpuList()},
+		{"Flags", p.CPUFlags},
+	}
+}
+
+// uptime formats the first line of uptime and w at now.
+func (p *Persona) uptime(now time.Time) string {
+	up := now.Sub(p.booted)
+	days := int(up.Hours()) / 24
+	hours := int(up.Hours()) % 24
+	minutes := int(up.Minutes()) % 60
+
+	var since string
+	switch {
+	case days > 0:
+		since = fmt.Sprintf("%d day", days)
+		if days > 1 {
+			since += "s"
+		}
+		since += fmt.Sprintf(", %2d:%02d", hours, minutes)
+	case hours > 0:
+		since = fmt.Sprintf("%2d:%02d", hours, minutes)
+	default:
+		since = fmt.Sprintf("%d min", minutes)
+	}
+
+	return fmt.Sprintf(" %s up %s,  1 user,  load average: %s\n", now.Format("15:04:05"), since, p.LoadAverage)
+}
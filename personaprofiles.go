@@ -0,0 +1,221 @@
+package main
+
+// debianFiles are the files of the filesystem template only a Debian 9 host
+// has.
+var debianFiles = []string{
+	"/boot/vmlinuz-4.9.0-19-amd64",
+	"/boot/initrd.img-4.9.0-19-amd64",
+	"/usr/bin/python3.5",
+}
+
+const ubuntuMotd = `Welcome to {{.OSName}} {{.OSVersion}} (GNU/Linux {{.KernelRelease}} {{.Machine}})
+
+ * Documentation:  https://help.ubuntu.com
+ * Management:     https://landscape.canonical.com
+ * Support:        https://ubuntu.com/pro
+
+  System load:  0.0               Processes:             112
+  Usage of /:   23.4% of 48.27GB   Users logged in:       0
+  Memory usage: 17%                IPv4 address for eth0: 10.0.2.15
+  Swap usage:   0%
+
+Expanded Security Maintenance for Applications is not enabled.
+
+0 updates can be applied immediately.
+
+Enable ESM Apps to receive additional future security updates.
+See https://ubuntu.com/esm or run: sudo pro status
+
+`
+
+const centOSPasswd = `root:x:0:0:root:/root:/bin/bash
+bin:x:1:1:bin:/bin:/sbin/nologin
+daemon:x:2:2:daemon:/sbin:/sbin/nologin
+adm:x:3:4:adm:/var/adm:/sbin/nologin
+lp:x:4:7:lp:/var/spool/lpd:/sbin/nologin
+sync:x:5:0:sync:/sbin:/bin/sync
+shutdown:x:6:0:shutdown:/sbin:/sbin/shutdown
+halt:x:7:0:halt:/sbin:/sbin/halt
+mail:x:8:12:mail:/var/spool/mail:/sbin/nologin
+operator:x:11:0:operator:/root:/sbin/nologin
+games:x:12:100:games:/usr/games:/sbin/nologin
+ftp:x:14:50:FTP User:/var/ftp:/sbin/nologin
+nobody:x:99:99:Nobody:/:/sbin/nologin
+systemd-network:x:192:192:systemd Network Management:/:/sbin/nologin
+dbus:x:81:81:System message bus:/:/sbin/nologin
+polkitd:x:999:998:User for polkitd:/:/sbin/nologin
+sshd:x:74:74:Privilege-separated SSH:/var/empty/sshd:/sbin/nologin
+postfix:x:89:89::/var/spool/postfix:/sbin/nologin
+chrony:x:998:996::/var/lib/chrony:/sbin/nologin
+nginx:x:997:995:Nginx web server:/var/lib/nginx:/sbin/nologin
+centos:x:1000:1000:Cloud User:/home/centos:/bin/bash
+`
+
+const centOSGroup = `root:x:0:
+bin:x:1:
+daemon:x:2:
+sys:x:3:
+adm:x:4:
+tty:x:5:
+disk:x:6:
+lp:x:7:
+mail:x:12:postfix
+wheel:x:10:centos
+users:x:100:
+nobody:x:99:
+sshd:x:74:
+nginx:x:995:
+centos:x:1000:
+`
+
+// personaProfiles are the built-in personas SHELL_PERSONA may name, and JSON
+// personas start from.
+var personaProfiles = map[string]Persona{
+	"debian-9": defaultPersona,
+	"ubuntu-22.04": {
+		Hostname:      "ubuntu",
+		OSName:        "Ubuntu",
+		OSID:          "ubuntu",
+		OSVersion:     "22.04.3 LTS (Jammy Jellyfish)",
+		OSVersionID:   "22.04",
+		KernelRelease: "5.15.0-91-generic",
+		KernelVersion: "#101-Ubuntu SMP Tue Nov 14 13:30:08 UTC 2023",
+		KernelBuild:   "(buildd@lcy02-amd64-045) (gcc (Ubuntu 11.4.0-1ubuntu1~22.04) 11.4.0, GNU ld (GNU Binutils for Ubuntu) 2.38)",
+		Machine:       "x86_64",
+		CPUVendor:     "AuthenticAMD",
+		CPUModel:      "AMD EPYC 7543 32-Core Processor",
+		CPUFamily:     25,
+		CPUModelID:    1,
+		CPUStepping:   1,
+		CPUMHz:        2794.748,
+		CPUCacheKB:    512,
+		CPUFlags: "fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 syscall nx " +
+			"mmxext fxsr_opt pdpe1gb rdtscp lm rep_good nopl cpuid extd_apicid tsc_known_freq pni pclmulqdq ssse3 fma cx16 pcid " +
+			"sse4_1 sse4_2 x2apic movbe popcnt aes xsave avx f16c rdrand hypervisor lahf_lm cmp_legacy cr8_legacy abm sse4a " +
+			"misalignsse 3dnowprefetch osvw topoext invpcid_single ssbd ibrs ibpb stibp vmmcall fsgsbase bmi1 avx2 smep bmi2 erms " +
+			"invpcid rdseed adx smap clflushopt clwb sha_ni xsaveopt xsavec xgetbv1 xsaves clzero xsaveerptr wbnoinvd arat umip " +
+			"vaes vpclmulqdq rdpid fsrm arch_capabilities",
+		CPUs:        2,
+		MemoryMB:    3915,
+		SwapMB:      0,
+		Uptime:      "412h47m",
+		LoadAverage: "0.00, 0.02, 0.00",
+		SSHVersion:  "OpenSSH_8.9p1 Ubuntu-3ubuntu0.6",
+		SSHVersions: []string{
+			"OpenSSH_8.9p1 Ubuntu-3ubuntu0.6",
+			"OpenSSH_8.9p1 Ubuntu-3ubuntu0.4",
+			"OpenSSH_8.9p1 Ubuntu-3ubuntu0.1",
+		},
+		PromptStyle: "debian",
+		Motd:        ubuntuMotd,
+		User:        "ubuntu",
+		AdminGroup:  "27(sudo)",
+		Files: map[string]string{
+			"/etc/debian_version":                "bookworm/sid\n",
+			"/etc/lsb-release":                   "DISTRIB_ID=Ubuntu\nDISTRIB_RELEASE=22.04\nDISTRIB_CODENAME=jammy\nDISTRIB_DESCRIPTION=\"Ubuntu 22.04.3 LTS\"\n",
+			"/etc/issue":                         "Ubuntu 22.04.3 LTS \\n \\l\n\n",
+			"/boot/vmlinuz-5.15.0-91-generic":    "",
+			"/boot/initrd.img-5.15.0-91-generic": "",
+			"/usr/bin/python3.10":                "",
+		},
+		RemoveFiles: debianFiles,
+	},
+	"centos-7": {
+		Hostname:      "localhost",
+		OSName:        "CentOS Linux",
+		OSID:          "centos",
+		OSVersion:     "7 (Core)",
+		OSVersionID:   "7",
+		KernelRelease: "3.10.0-1160.108.1.el7.x86_64",
+		KernelVersion: "#1 SMP Thu Jan 25 16:17:31 UTC 2024",
+		KernelBuild:   "(mockbuild@kbuilder.bsys.centos.org) (gcc version 4.8.5 20150623 (Red Hat 4.8.5-44) (GCC) )",
+		Machine:       "x86_64",
+		CPUVendor:     "GenuineIntel",
+		CPUModel:      "Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz",
+		CPUFamily:     6,
+		CPUModelID:    85,
+		CPUStepping:   4,
+		CPUMHz:        2394.374,
+		CPUCacheKB:    28160,
+		CPUFlags: "fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ss syscall nx " +
+			"pdpe1gb rdtscp lm constant_tsc rep_good nopl xtopology eagerfpu pni pclmulqdq ssse3 fma cx16 pcid sse4_1 sse4_2 " +
+			"x2apic movbe popcnt tsc_deadline_timer aes xsave avx f16c rdrand hypervisor lahf_lm abm 3dnowprefetch invpcid_single " +
+			"ssbd ibrs ibpb stibp fsgsbase tsc_adjust bmi1 hle avx2 smep bmi2 erms invpcid rtm mpx avx512f avx512dq rdseed adx smap " +
+			"clflushopt clwb avx512cd avx512bw avx512vl xsaveopt xsavec xgetbv1 arat pku ospke md_clear spec_ctrl intel_stibp",
+		CPUs:        4,
+		MemoryMB:    7821,
+		SwapMB:      2047,
+		Uptime:      "2231h05m",
+		LoadAverage: "0.12, 0.09, 0.06",
+		SSHVersion:  "OpenSSH_7.4",
+		PromptStyle: "redhat",
+		User:        "centos",
+		AdminGroup:  "10(wheel)",
+		Files: map[string]string{
+			"/etc/passwd":         centOSPasswd,
+			"/etc/group":          centOSGroup,
+			"/etc/issue":          "\\S\nKernel \\r on an \\m\n\n",
+			"/etc/redhat-release": "CentOS Linux release 7.9.2009 (Core)\n",
+			"/etc/centos-release": "CentOS Linux release 7.9.2009 (Core)\n",
+			"/etc/system-release": "CentOS Linux release 7.9.2009 (Core)\n",
+			"/boot/vmlinuz-3.10.0-1160.108.1.el7.x86_64":       "",
+			"/boot/initramfs-3.10.0-1160.108.1.el7.x86_64.img": "",
+			"/usr/bin/python2.7":                               "",
+			"/usr/bin/yum":                                     "",
+			"/var/log/messages":                                "",
+			"/var/log/secure":                                  "",
+			"/var/log/yum.log":                                 "",
+			"/usr/share/nginx/html/index.html":                 "<!DOCTYPE html>\n<html>\n<head>\n<title>Welcome to nginx!</title>\n</head>\n<body>\n<h1>Welcome to nginx!</h1>\n</body>\n</html>\n",
+		},
+		RemoveFiles: append([]string{
+			"/etc/debian_version",
+			"/var/log/auth.log",
+			"/var/log/syslog",
+			"/var/log/dpkg.log",
+			"/var/www",
+		}, debianFiles...),
+	},
+	"raspberry-pi": {
+		Hostname:      "raspberrypi",
+		OSName:        "Debian GNU/Linux",
+		OSID:          "debian",
+		OSVersion:     "12 (bookworm)",
+		OSVersionID:   "12",
+		KernelRelease: "6.1.0-rpi7-rpi-v8",
+		KernelVersion: "#1 SMP PREEMPT Debian 1:6.1.63-1+rpt1 (2023-11-24)",
+		KernelBuild:   "(debian-kernel@lists.debian.org) (gcc-12 (Debian 12.2.0-14) 12.2.0, GNU ld (GNU Binutils for Debian) 2.40)",
+		Machine:       "aarch64",
+		CPUVendor:     "ARM",
+		CPUModel:      "Cortex-A72",
+		CPUModelID:    0xd08,
+		CPUStepping:   3,
+		CPUMHz:        1800,
+		CPUFlags:      "fp asimd evtstrm crc32 cpuid",
+		CPUs:          4,
+		MemoryMB:      3794,
+		SwapMB:        99,
+		Uptime:        "173h22m",
+		LoadAverage:   "0.31, 0.18, 0.11",
+		HardwareModel: "Raspberry Pi 4 Model B Rev 1.4",
+		SSHVersion:    "OpenSSH_9.2p1 Debian-2+deb12u2",
+		SSHVersions: []string{
+			"OpenSSH_9.2p1 Debian-2+deb12u2",
+			"OpenSSH_9.2p1 Debian-2+deb12u1",
+			"OpenSSH_9.2p1 Debian-2",
+		},
+		PromptStyle: "debian",
+		Motd:        debianMotd,
+		User:        "pi",
+		AdminGroup:  "27(sudo)",
+		Files: map[string]string{
+			"/etc/debian_version":        "12.4\n",
+			"/etc/rpi-issue":             "Raspberry Pi reference 2023-12-05\nGenerated using pi-gen, https://github.com/RPi-Distro/pi-gen, 2acf7afcba7d11500313a7b93bb55a2aae20b2d6, stage2\n",
+			"/boot/firmware/config.txt":  "# For more options and information see\n# http://rptl.io/configtxt\n\ndtparam=audio=on\ncamera_auto_detect=1\ndisplay_auto_detect=1\nauto_initramfs=1\ndtoverlay=vc4-kms-v3d\nmax_framebuffers=2\narm_64bit=1\n\n[all]\nenable_uart=0\n",
+			"/boot/firmware/cmdline.txt": "console=serial0,115200 console=tty1 root=PARTUUID=4e639091-02 rootfstype=ext4 fsck.repair=yes rootwait\n",
+			"/usr/bin/python3.11":        "",
+			"/usr/bin/raspi-config":      "",
+			"/usr/bin/vcgencmd":          "",
+		},
+		RemoveFiles: debianFiles,
+	},
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/marceloalmeida/ssh-honeypot/enrich"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	StageCapture   = "capture"
+	StageNormalize = "normalize"
+	StageEnrich    = "enrich"
+	StageBatch     = "batch"
+	StageWrite     = "write"
+)
+
+var pipelineStages = []string{StageCapture, StageNormalize, StageEnrich, StageBatch, StageWrite}
+
+// Event is a captured SSHInfo together with everything the pipeline learned
+// about it along the way.
+type Event struct {
+	SSHInfo  SSHInfo
+	IPInfo   IPInfo
+	Analysis Analysis
+}
+
+// Analysis holds what the analysis annotators derived from an event.
+type Analysis struct {
+	Tool            string
+	ToolCategory    string
+	HumanLikelihood *float64
+	KeySourceIPs    int
+	// KeyReused is whether the event is the first of its key from a second
+	// source IP
+	KeyReused       bool
+	KeyCampaign     string
+	Campaign        string
+	PasswordPattern string
+	PasswordEntropy *float64
+	Techniques      string
+	AttackPattern   string
+	SourceClass     string
+	NewAttacker     bool
+	Wordlist        string
+	Abuse           *enrich.AbuseIPDBReport
+	GreyNoise       *enrich.GreyNoiseReport
+	VirusTotal      *enrich.VirusTotalReport
+	DNSBL           string
+}
+
+// Batch is a group of enriched events together with their pre-encoded
+// representation, produced by the batching stage.
+type Batch struct {
+	Events  []Event
+	Encoded *bytes.Buffer
+}
+
+// BatchEncoder appends the wire representation of event to buf.
+type BatchEncoder interface {
+	Encode(buf *bytes.Buffer, event Event)
+}
+
+// EventAnnotator adds derived information to an event once it has been
+// enriched, before it is observed and batched.
+type EventAnnotator func(ctx context.Context, event *Event)
+
+// EventObserver is notified of every event once it has been enriched.
+type EventObserver func(ctx context.Context, event Event)
+
+// BatchWriter persists a batch of fully enriched events.
+type BatchWriter func(ctx context.Context, batch Batch) error
+
+type PipelineConfig struct {
+	QueueSize        int
+	EnrichWorkers    int
+	WriteWorkers     int
+	BatchSize        int
+	FlushInterval    time.Duration
+	EnrichMaxElapsed time.Duration
+	WriteMaxElapsed  time.Duration
+	WritePrivateIPs  bool
+	// DedupWindow is how long identical failed attempts are collapsed
+	// over, 0 to keep them all
+	DedupWindow time.Duration
+	// Overflow is what to drop when the capture queue is full, "new" for the
+	// event being captured or "oldest" for the one waiting the longest.
+	Overflow string
+}
+
+func pipelineConfigFromEnv() PipelineConfig {
+	return PipelineConfig{
+		QueueSize:        getEnvInt("PIPELINE_QUEUE_SIZE", 1024),
+		EnrichWorkers:    getEnvInt("PIPELINE_ENRICH_WORKERS", 4),
+		WriteWorkers:     getEnvInt("PIPELINE_WRITE_WORKERS", 2),
+		BatchSize:        getEnvInt("PIPELINE_BATCH_SIZE", 100),
+		FlushInterval:    getEnvDuration("PIPELINE_FLUSH_INTERVAL", time.Second),
+		EnrichMaxElapsed: getEnvDuration("PIPELINE_ENRICH_MAX_ELAPSED", time.Minute),
+		WriteMaxElapsed:  getEnvDuration("PIPELINE_WRITE_MAX_ELAPSED", 5*time.Minute),
+		WritePrivateIPs:  getEnv("INFLUXDB_WRITE_PRIVATE_IPS", "false") == "true",
+		Overflow:         getEnv("PIPELINE_OVERFLOW", "new"),
+		DedupWindow:      getEnvDuration("PIPELINE_DEDUP_WINDOW", 0),
+	}
+}
+
+type StageStats struct {
+	In       atomic.Int64
+	Out      atomic.Int64
+	Dropped  atomic.Int64
+	Errors   atomic.Int64
+	Duration atomic.Int64
+}
+
+type StageSnapshot struct {
+	Stage      string        `json:"stage"`
+	In         int64         `json:"in"`
+	Out        int64         `json:"out"`
+	Dropped    int64         `json:"dropped"`
+	Errors     int64         `json:"errors"`
+	QueueDepth int           `json:"queue_depth"`
+	AvgLatency time.Duration `json:"avg_latency"`
+}
+
+// Pipeline moves captured events through explicit stages connected by
+// bounded channels:
+//
+//	capture -> normalize -> enrich -> batch -> write
+//
+// Capture never blocks the connection handlers: when the first queue is full
+// an event is dropped and counted instead, the captured one or, with the
+// "oldest" overflow policy, the one at the head of the queue.
+type Pipeline struct {
+	config  PipelineConfig
+	tracer  trace.Tracer
+	encoder BatchEncoder
+	writer  BatchWriter
+	buffers sync.Pool
+
+	annotators []EventAnnotator
+	observers  []EventObserver
+	dedup      *Deduper
+
+	// closed is set by Close under closeMu, Capture holding it for reading
+	// so no event is sent on the closed captured channel
+	closeMu    sync.RWMutex
+	closed     bool
+	captured   chan SSHInfo
+	normalized chan Event
+	enriched   chan Event
+	batches    chan Batch
+
+	stats map[string]*StageStats
+
+	// Retries are given up once retryCtx is cancelled, to finish draining
+	// in time on shutdown.
+	retryCtx    context.Context
+	stopRetries context.CancelFunc
+
+	normalizeDone sync.WaitGroup
+	enrichDone    sync.WaitGroup
+	batchDone     sync.WaitGroup
+	writeDone     sync.WaitGroup
+}
+
+func NewPipeline(config PipelineConfig, encoder BatchEncoder, writer BatchWriter, tracer trace.Tracer) *Pipeline {
+	config.QueueSize = max(config.QueueSize, 1)
+	config.EnrichWorkers = max(config.EnrichWorkers, 1)
+	config.WriteWorkers = max(config.WriteWorkers, 1)
+	config.BatchSize = max(config.BatchSize, 1)
+	switch config.Overflow {
+	case "new", "oldest":
+	default:
+		slog.Warn("Unknown pipeline overflow policy, dropping new events", "overflow", config.Overflow)
+		config.Overflow = "new"
+	}
+
+	p := &Pipeline{
+		config:     config,
+		tracer:     tracer,
+		encoder:    encoder,
+		writer:     writer,
+		captured:   make(chan SSHInfo, config.QueueSize),
+		normalized: make(chan Event, config.QueueSize),
+		enriched:   make(chan Event, config.QueueSize),
+		batches:    make(chan Batch, config.WriteWorkers),
+		stats:      map[string]*StageStats{},
+		dedup:      NewDeduper(config.DedupWindow, config.QueueSize),
+	}
+	p.buffers.New = func() any {
+		return new(bytes.Buffer)
+	}
+	for _, stage := range pipelineStages {
+		p.stats[stage] = &StageStats{}
+	}
+	p.retryCtx, p.stopRetries = context.WithCancel(context.Background())
+
+	return p
+}
+
+// Annotate registers fn to be called with every enriched event, in
+// registration order. Annotators run on the enrich workers.
+func (p *Pipeline) Annotate(fn EventAnnotator) {
+	p.annotators = append(p.annotators, fn)
+}
+
+// Observe registers fn to be called with every enriched event. Observers run
+// on the enrich workers and must not block.
+func (p *Pipeline) Observe(fn EventObserver) {
+	p.observers = append(p.observers, fn)
+}
+
+// Start launches the stage workers.
+func (p *Pipeline) Start() {
+	p.normalizeDone.Add(1)
+	go func() {
+		defer p.normalizeDone.Done()
+		p.normalize()
+	}()
+
+	for i := 0; i < p.config.EnrichWorkers; i++ {
+		p.enrichDone.Add(1)
+		go func() {
+			defer p.enrichDone.Done()
+			p.enrich()
+		}()
+	}
+
+	p.batchDone.Add(1)
+	go func() {
+		defer p.batchDone.Done()
+		p.batch()
+	}()
+
+	for i := 0; i < p.config.WriteWorkers; i++ {
+		p.writeDone.Add(1)
+		go func() {
+			defer p.writeDone.Done()
+			p.write()
+		}()
+	}
+
+	slog.Info("Pipeline started",
+		"queue_size", p.config.QueueSize,
+		"overflow", p.config.Overflow,
+		"enrich_workers", p.config.EnrichWorkers,
+		"write_workers", p.config.WriteWorkers,
+		"batch_size", p.config.BatchSize,
+		"flush_interval", p.config.FlushInterval,
+		"dedup_window", p.config.DedupWindow)
+}
+
+// Close stops accepting events, those captured afterwards being dropped,
+// and drains every stage in order.
+func (p *Pipeline) Close() {
+	p.closeMu.Lock()
+	p.closed = true
+	close(p.captured)
+	p.closeMu.Unlock()
+	p.normalizeDone.Wait()
+	close(p.normalized)
+	p.enrichDone.Wait()
+	close(p.enriched)
+	p.batchDone.Wait()
+	close(p.batches)
+	p.writeDone.Wait()
+}
+
+// Shutdown closes the pipeline, draining it until ctx is done. Past that,
+// enrichment and writes are attempted once more instead of being retried.
+func (p *Pipeline) Shutdown(ctx context.Context) {
+	drained := make(chan struct{})
+	go func() {
+		p.Close()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		slog.Warn("Pipeline not drained in time, giving up on retries")
+		p.stopRetries()
+		<-drained
+	}
+	p.stopRetries()
+}
+
+// Capture hands an event to the pipeline without blocking.
+func (p *Pipeline) Capture(sshInfo SSHInfo) bool {
+	stats := p.stats[StageCapture]
+	stats.In.Add(1)
+	metrics.RecordEvent(sshInfo.Function, sshInfo.Protocol)
+
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		stats.Dropped.Add(1)
+		slog.Warn("Pipeline closed, dropping event", "function", sshInfo.Function, "remote_host", sshInfo.RemoteHost)
+		return false
+	}
+
+	select {
+	case p.captured <- sshInfo:
+		stats.Out.Add(1)
+		return true
+	default:
+	}
+
+	if p.config.Overflow == "oldest" {
+		select {
+		case oldest := <-p.captured:
+			stats.Dropped.Add(1)
+			slog.Warn("Pipeline capture queue full, dropping oldest event", "function", oldest.Function, "remote_host", oldest.RemoteHost)
+		default:
+		}
+
+		// Other handlers may take the freed spot first
+		select {
+		case p.captured <- sshInfo:
+			stats.Out.Add(1)
+			return true
+		default:
+		}
+	}
+
+	stats.Dropped.Add(1)
+	slog.Warn("Pipeline capture queue full, dropping event", "function", sshInfo.Function, "remote_host", sshInfo.RemoteHost)
+	return false
+}
+
+func (p *Pipeline) normalize() {
+	stats := p.stats[StageNormalize]
+
+	// Held attempts are passed on once their dedup window is over
+	var expiries <-chan time.Time
+	if p.dedup != nil {
+		ticker := time.NewTicker(min(p.dedup.window, time.Second))
+		defer ticker.Stop()
+		expiries = ticker.C
+	}
+
+	for {
+		select {
+		case sshInfo, ok := <-p.captured:
+			if !ok {
+				if p.dedup != nil {
+					for _, held := range p.dedup.Flush() {
+						p.forward(stats, p.normalized, Event{SSHInfo: held})
+					}
+				}
+				return
+			}
+			p.normalizeEvent(stats, sshInfo)
+		case now := <-expiries:
+			for _, held := range p.dedup.Expired(now) {
+				p.forward(stats, p.normalized, Event{SSHInfo: held})
+			}
+		}
+	}
+}
+
+func (p *Pipeline) normalizeEvent(stats *StageStats, sshInfo SSHInfo) {
+	stats.In.Add(1)
+
+	sshInfo.User = strings.ToValidUTF8(sshInfo.User, "�")
+	sshInfo.Password = strings.ToValidUTF8(sshInfo.Password, "�")
+	sshInfo.Command = strings.ToValidUTF8(sshInfo.Command, "�")
+	sshInfo.ClientVersion = strings.TrimSpace(sshInfo.ClientVersion)
+	sshInfo.Key = strings.TrimSpace(sshInfo.Key)
+
+	ip := net.ParseIP(sshInfo.RemoteHost)
+	if ip == nil {
+		stats.Errors.Add(1)
+		slog.Warn("Dropping event with unparseable remote host", "function", sshInfo.Function, "remote_host", sshInfo.RemoteHost)
+		return
+	}
+
+	if currentSettings().Allowed(ip) {
+		stats.Dropped.Add(1)
+		slog.Debug("Skipping event from allowlisted IP", "function", sshInfo.Function, "remote_host", sshInfo.RemoteHost)
+		return
+	}
+
+	if isPrivateIP(ip) && !p.config.WritePrivateIPs {
+		stats.Dropped.Add(1)
+		slog.Debug("Skipping event from private, link-local or loopback IP, INFLUXDB_WRITE_PRIVATE_IPS is not set", "function", sshInfo.Function, "remote_host", sshInfo.RemoteHost)
+		return
+	}
+
+	if p.dedup != nil && p.dedup.Hold(sshInfo) {
+		return
+	}
+
+	p.forward(stats, p.normalized, Event{SSHInfo: sshInfo})
+}
+
+func (p *Pipeline) enrich() {
+	stats := p.stats[StageEnrich]
+
+	for event := range p.normalized {
+		stats.In.Add(1)
+		started := time.Now()
+
+		ctx, span := p.tracer.Start(
+			context.Background(),
+			"enrichEvent",
+			trace.WithAttributes(
+				attribute.String("function", event.SSHInfo.Function),
+				attribute.String("remote_host", event.SSHInfo.RemoteHost)))
+
+		backoffSettings := backoff.NewExponentialBackOff()
+		backoffSettings.MaxElapsedTime = p.config.EnrichMaxElapsed
+
+		// Lookups waiting for a rate limit are given up with the retries
+		lookupCtx := trace.ContextWithSpan(p.retryCtx, span)
+		err := backoff.Retry(func() error {
+			ipInfo, err := getIpInfo(event.SSHInfo.RemoteHost, lookupCtx, p.tracer)
+			if errors.Is(err, errGeoUnavailable) {
+				// Retrying won't help until a circuit breaker closes
+				return backoff.Permanent(err)
+			}
+			if err != nil {
+				return err
+			}
+
+			event.IPInfo = ipInfo
+			return nil
+		}, backoff.WithContext(backoffSettings, p.retryCtx))
+		if err != nil {
+			// Keep the event, only without geo information
+			stats.Errors.Add(1)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.WarnContext(ctx, "Failed to enrich, writing without IP info", "remote_host", event.SSHInfo.RemoteHost, "error", err)
+			event.IPInfo = IPInfo{IP: event.SSHInfo.RemoteHost}
+		} else {
+			span.SetStatus(codes.Ok, fmt.Sprintf("Enriched '%s'", event.SSHInfo.RemoteHost))
+		}
+
+		for _, annotate := range p.annotators {
+			annotate(ctx, &event)
+		}
+		for _, observe := range p.observers {
+			observe(ctx, event)
+		}
+		metrics.RecordEnrichment(ctx, started, err)
+		span.End()
+
+		stats.Duration.Add(int64(time.Since(started)))
+		p.forward(stats, p.enriched, event)
+	}
+}
+
+func (p *Pipeline) batch() {
+	stats := p.stats[StageBatch]
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+
+	newBatch := func() Batch {
+		buf := p.buffers.Get().(*bytes.Buffer)
+		buf.Reset()
+
+		return Batch{
+			Events:  make([]Event, 0, p.config.BatchSize),
+			Encoded: buf,
+		}
+	}
+
+	batch := newBatch()
+	flush := func() {
+		if len(batch.Events) == 0 {
+			return
+		}
+
+		p.batches <- batch
+		stats.Out.Add(int64(len(batch.Events)))
+		batch = newBatch()
+	}
+
+	for {
+		select {
+		case event, ok := <-p.enriched:
+			if !ok {
+				flush()
+				p.buffers.Put(batch.Encoded)
+				return
+			}
+
+			stats.In.Add(1)
+			batch.Events = append(batch.Events, event)
+			if p.encoder != nil {
+				p.encoder.Encode(batch.Encoded, event)
+			}
+			if len(batch.Events) >= p.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (p *Pipeline) write() {
+	stats := p.stats[StageWrite]
+
+	for batch := range p.batches {
+		stats.In.Add(int64(len(batch.Events)))
+		started := time.Now()
+
+		// Writes in flight are abandoned along with the retries
+		ctx, span := p.tracer.Start(
+			p.retryCtx,
+			"writeBatch",
+			trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+
+		backoffSettings := backoff.NewExponentialBackOff()
+		backoffSettings.MaxElapsedTime = p.config.WriteMaxElapsed
+
+		err := backoff.Retry(func() error {
+			return p.writer(ctx, batch)
+		}, backoff.WithContext(backoffSettings, p.retryCtx))
+		if err != nil {
+			stats.Errors.Add(1)
+			stats.Dropped.Add(int64(len(batch.Events)))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.ErrorContext(ctx, "Failed to write batch, dropping", "events", len(batch.Events), "error", err)
+		} else {
+			stats.Out.Add(int64(len(batch.Events)))
+			span.SetStatus(codes.Ok, fmt.Sprintf("Wrote batch of %d events", len(batch.Events)))
+		}
+		metrics.RecordWrite(ctx, started, len(batch.Events), err)
+		span.End()
+
+		stats.Duration.Add(int64(time.Since(started)))
+		p.buffers.Put(batch.Encoded)
+	}
+}
+
+// forward blocks until the next stage accepts the event, applying
+// backpressure to the stages before it.
+func (p *Pipeline) forward(stats *StageStats, next chan<- Event, event Event) {
+	next <- event
+	stats.Out.Add(1)
+}
+
+// Stats returns a snapshot of the counters and queue depth of every stage.
+func (p *Pipeline) Stats() []StageSnapshot {
+	depths := map[string]int{
+		StageCapture:   len(p.captured),
+		StageNormalize: len(p.normalized),
+		StageEnrich:    len(p.enriched),
+		StageBatch:     len(p.batches),
+	}
+
+	snapshots := make([]StageSnapshot, 0, len(pipelineStages))
+	for _, stage := range pipelineStages {
+		stats := p.stats[stage]
+		snapshot := StageSnapshot{
+			Stage:      stage,
+			In:         stats.In.Load(),
+			Out:        stats.Out.Load(),
+			Dropped:    stats.Dropped.Load(),
+			Errors:     stats.Errors.Load(),
+			QueueDepth: depths[stage],
+		}
+		if snapshot.In > 0 {
+			snapshot.AvgLatency = time.Duration(stats.Duration.Load() / snapshot.In)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots
+}
+
+// logPipelineStats periodically logs the pipeline counters.
+func logPipelineStats(p *Pipeline, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, s := range p.Stats() {
+			slog.Info("Pipeline stage stats",
+				"stage", s.Stage,
+				"in", s.In,
+				"out", s.Out,
+				"dropped", s.Dropped,
+				"errors", s.Errors,
+				"queue_depth", s.QueueDepth,
+				"avg_latency", s.AvgLatency)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// loadTestSettings loads the reloadable settings from the environment, as
+// main does, restoring the previous ones after the test.
+func loadTestSettings(t *testing.T) {
+	t.Helper()
+
+	previous := currentSettings()
+	loaded, err := settingsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Store(loaded)
+	t.Cleanup(func() {
+		settings.Store(previous)
+	})
+}
+
+// batchRecorder is a BatchWriter keeping the events written.
+type batchRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *batchRecorder) Write(ctx context.Context, batch Batch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, batch.Events...)
+	return nil
+}
+
+func TestPipeline(t *testing.T) {
+	loadTestSettings(t)
+	geoMemory.Set("203.0.113.7", IPInfo{IP: "203.0.113.7", Country: "PT"}, "geolite2")
+
+	var recorder batchRecorder
+	pipeline := NewPipeline(PipelineConfig{QueueSize: 16, BatchSize: 10, FlushInterval: 10 * time.Millisecond, DedupWindow: time.Hour},
+		nil, recorder.Write, noop.NewTracerProvider().Tracer("test"))
+	pipeline.Annotate(func(ctx context.Context, event *Event) {
+		event.Analysis.PasswordPattern = "annotated"
+	})
+	pipeline.Start()
+
+	attempt := SSHInfo{Function: "password", Protocol: "ssh", RemoteHost: "203.0.113.7", User: "root", Password: "123456", Timestamp: time.Now()}
+	for i := 0; i < 3; i++ {
+		pipeline.Capture(attempt)
+	}
+	// Not written without INFLUXDB_WRITE_PRIVATE_IPS
+	pipeline.Capture(SSHInfo{Function: "password", Protocol: "ssh", RemoteHost: "192.168.1.1", User: "root", Password: "admin"})
+	// Nor with an unparseable host
+	pipeline.Capture(SSHInfo{Function: "password", Protocol: "ssh", RemoteHost: "nowhere"})
+	pipeline.Close()
+
+	if pipeline.Capture(attempt) {
+		t.Error("event captured once closed")
+	}
+	if len(recorder.events) != 1 {
+		t.Fatalf("%d events written, want the attempts collapsed into 1", len(recorder.events))
+	}
+	event := recorder.events[0]
+	if event.SSHInfo.AttemptCount != 3 {
+		t.Errorf("attempt count = %d, want 3", event.SSHInfo.AttemptCount)
+	}
+	if event.IPInfo.Country != "PT" {
+		t.Errorf("country = %q, want it enriched from the cache", event.IPInfo.Country)
+	}
+	if event.Analysis.PasswordPattern != "annotated" {
+		t.Error("event not annotated")
+	}
+}
+
+func TestDeduper(t *testing.T) {
+	dedup := NewDeduper(time.Minute, 2)
+	root := SSHInfo{Function: "password", RemoteHost: "203.0.113.7", User: "root", Password: "123456", Timestamp: time.Unix(1, 0)}
+	admin := SSHInfo{Function: "password", RemoteHost: "203.0.113.7", User: "admin", Password: "123456", Timestamp: time.Unix(2, 0)}
+	oracle := SSHInfo{Function: "password", RemoteHost: "203.0.113.7", User: "oracle", Password: "123456", Timestamp: time.Unix(3, 0)}
+
+	for _, sshInfo := range []SSHInfo{root, admin, root} {
+		if !dedup.Hold(sshInfo) {
+			t.Fatalf("attempt of %s not held", sshInfo.User)
+		}
+	}
+	if dedup.Hold(oracle) {
+		t.Error("attempt held past the maximum")
+	}
+	if dedup.Hold(SSHInfo{Function: "session", RemoteHost: "203.0.113.7"}) {
+		t.Error("session held")
+	}
+	accepted := root
+	accepted.Accepted = true
+	if dedup.Hold(accepted) {
+		t.Error("accepted attempt held")
+	}
+
+	if expired := dedup.Expired(time.Now()); len(expired) != 0 {
+		t.Errorf("%d attempts expired within the window", len(expired))
+	}
+	flushed := dedup.Flush()
+	users := make([]string, len(flushed))
+	for i, sshInfo := range flushed {
+		users[i] = sshInfo.User
+	}
+	if !slices.Equal(users, []string{"root", "admin"}) || flushed[0].AttemptCount != 2 || flushed[1].AttemptCount != 1 {
+		t.Errorf("flushed %v, counts %d and %d", users, flushed[0].AttemptCount, flushed[1].AttemptCount)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Policy actions, what happens to the connections of the source IPs a
+// PolicyRule matches.
+const (
+	// PolicyDefault leaves the connection to the usual behavior, to make
+	// exceptions to the rules after it
+	PolicyDefault = "default"
+	// PolicyTarpit traps the connection in the tarpit before the SSH
+	// handshake
+	PolicyTarpit = "tarpit"
+	// PolicyDrop closes the connection as soon as it is accepted
+	PolicyDrop = "drop"
+	// PolicyAccept lets the client into the shell on its first password
+	PolicyAccept = "accept"
+	// PolicyReject never lets the client in, whatever SHELL_CREDENTIALS and
+	// SHELL_ACCEPT_AFTER say
+	PolicyReject = "reject"
+)
+
+var policyActions = map[string]struct{}{
+	PolicyDefault: {},
+	PolicyTarpit:  {},
+	PolicyDrop:    {},
+	PolicyAccept:  {},
+	PolicyReject:  {},
+}
+
+// PolicyRule applies its action to the source IPs located in one of its
+// countries or announced by one of its ASes, or to every IP when Any is set.
+type PolicyRule struct {
+	Rule      string
+	Action    string
+	Countries map[string]struct{}
+	ASNs      map[string]struct{}
+	Any       bool
+}
+
+// parsePolicyRule parses a rule written as its action followed by space
+// separated matches, "country:<ISO code>", "asn:<AS number>" or "*", e.g.
+// "tarpit asn:AS4134 asn:AS4837" or "drop *".
+func parsePolicyRule(rule string) (PolicyRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 {
+		return PolicyRule{}, fmt.Errorf("policy '%s' must be an action followed by what it matches", rule)
+	}
+
+	p := PolicyRule{Rule: rule, Action: fields[0], Countries: map[string]struct{}{}, ASNs: map[string]struct{}{}}
+	if _, ok := policyActions[p.Action]; !ok {
+		return PolicyRule{}, fmt.Errorf("policy '%s': unknown action '%s', expected 'default', 'tarpit', 'drop', 'accept' or 'reject'", rule, p.Action)
+	}
+	for _, match := range fields[1:] {
+		kind, value, _ := strings.Cut(match, ":")
+		switch {
+		case match == "*":
+			p.Any = true
+		case kind == "country" && len(value) == 2:
+			p.Countries[strings.ToUpper(value)] = struct{}{}
+		case kind == "asn":
+			number := strings.TrimPrefix(strings.ToUpper(value), "AS")
+			if _, err := strconv.ParseUint(number, 10, 32); err != nil {
+				return PolicyRule{}, fmt.Errorf("policy '%s': invalid AS number '%s'", rule, value)
+			}
+			p.ASNs["AS"+number] = struct{}{}
+		default:
+			return PolicyRule{}, fmt.Errorf("policy '%s': invalid match '%s', expected 'country:<code>', 'asn:<number>' or '*'", rule, match)
+		}
+	}
+
+	return p, nil
+}
+
+// Match reports whether the rule applies to the source IP of ipInfo.
+func (p PolicyRule) Match(ipInfo IPInfo) bool {
+	if p.Any {
+		return true
+	}
+	if _, found := p.Countries[ipInfo.Country]; found {
+		return true
+	}
+	// Org is "AS<number> <name>" whichever provider it comes from
+	asn, _, _ := strings.Cut(ipInfo.Org, " ")
+	_, found := p.ASNs[asn]
+	return found
+}
+
+// Policy returns the action of the first of the policies matching ipInfo,
+// PolicyDefault when none does.
+func (s *Settings) Policy(ipInfo IPInfo) string {
+	for _, rule := range s.Policies {
+		if rule.Match(ipInfo) {
+			return rule.Action
+		}
+	}
+
+	return PolicyDefault
+}
+
+// policyKey holds the policy action of a connection in its ssh.Context.
+type policyKey struct{}
+
+// connPolicy returns the policy action of the connection of sshContext.
+func connPolicy(sshContext ssh.Context) string {
+	if action, ok := sshContext.Value(policyKey{}).(string); ok {
+		return action
+	}
+
+	return PolicyDefault
+}
+
+// evaluatePolicy picks the policy action for the connection from remoteHost,
+// once the IP is geolocated. The lookup is given up on after timeout, the
+// connection getting the rules matching any IP then, but goes on in the
+// background to be cached for the next connections and the pipeline.
+func evaluatePolicy(settings *Settings, remoteHost string, timeout time.Duration, tracer trace.Tracer) string {
+	if len(settings.Policies) == 0 || settings.Allowed(net.ParseIP(remoteHost)) {
+		return PolicyDefault
+	}
+
+	lookup := make(chan IPInfo, 1)
+	go func() {
+		ipInfo, err := getIpInfo(remoteHost, context.Background(), tracer)
+		if err != nil {
+			slog.Debug("Failed to geolocate for policies", "remote_host", remoteHost, "error", err)
+		}
+		lookup <- ipInfo
+	}()
+
+	ipInfo := IPInfo{IP: remoteHost}
+	select {
+	case ipInfo = <-lookup:
+	case <-time.After(timeout):
+		slog.Debug("Geolocation for policies timed out", "remote_host", remoteHost, "timeout", timeout)
+	}
+
+	action := settings.Policy(ipInfo)
+	if action != PolicyDefault {
+		slog.Debug("Applying policy", "remote_host", remoteHost, "country", ipInfo.Country, "org", ipInfo.Org, "policy", action)
+	}
+	metrics.RecordPolicy(action)
+
+	return action
+}
+
+// policyAccepts reports whether the password authentication of the
+// connection of sshContext succeeds, as decided by its policy, or by shell
+// for the default one.
+func policyAccepts(sshContext ssh.Context, shell *Shell, remoteHost string, password string) bool {
+	if shell == nil {
+		return false
+	}
+
+	switch connPolicy(sshContext) {
+	case PolicyAccept:
+		return true
+	case PolicyReject:
+		return false
+	default:
+		return shell.Accepts(remoteHost, sshContext.User(), password)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestParsePolicyRule(t *testing.T) {
+	for _, rule := range []string{"tarpit", "ban *", "drop country:CHN", "drop asn:ASX", "drop city:Lisbon"} {
+		if _, err := parsePolicyRule(rule); err == nil {
+			t.Errorf("policy '%s' accepted", rule)
+		}
+	}
+
+	tests := []struct {
+		rule   string
+		ipInfo IPInfo
+		match  bool
+	}{
+		{"tarpit country:cn", IPInfo{Country: "CN"}, true},
+		{"tarpit country:cn", IPInfo{Country: "PT"}, false},
+		{"drop asn:4134 asn:AS4837", IPInfo{Org: "AS4134 CHINANET-BACKBONE"}, true},
+		{"drop asn:4134", IPInfo{Org: "AS41341 Other"}, false},
+		{"reject *", IPInfo{}, true},
+	}
+	for _, test := range tests {
+		rule, err := parsePolicyRule(test.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := rule.Match(test.ipInfo); match != test.match {
+			t.Errorf("policy '%s' matched %+v = %t, want %t", test.rule, test.ipInfo, match, test.match)
+		}
+	}
+}
+
+func TestSettingsPolicy(t *testing.T) {
+	var settings Settings
+	for _, rule := range []string{"default country:PT", "drop *"} {
+		policy, err := parsePolicyRule(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings.Policies = append(settings.Policies, policy)
+	}
+
+	if action := settings.Policy(IPInfo{Country: "PT"}); action != PolicyDefault {
+		t.Errorf("exception: %s", action)
+	}
+	if action := settings.Policy(IPInfo{Country: "CN"}); action != PolicyDrop {
+		t.Errorf("catch-all: %s", action)
+	}
+}
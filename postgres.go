@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// postgresMigrations are applied in order, once each, their index plus one
+// being the schema version recorded in schema_migrations. Released
+// migrations must never change, new ones are appended.
+var postgresMigrations = []string{
+	`CREATE TABLE auth_attempts (
+		id              text        NOT NULL,
+		time            timestamptz NOT NULL,
+		node_id         text        NOT NULL,
+		protocol        text        NOT NULL,
+		session_id      text,
+		remote_host     inet        NOT NULL,
+		remote_port     integer,
+		local_port      integer,
+		method          text        NOT NULL,
+		username        text        NOT NULL,
+		password        text,
+		key             text,
+		key_type        text,
+		attempt         integer,
+		client_version  text,
+		hassh           text,
+		tool            text,
+		campaign        text,
+		password_pattern text,
+		wordlist        text,
+		PRIMARY KEY (id, time)
+	);
+	CREATE INDEX auth_attempts_remote_host ON auth_attempts (remote_host, time DESC);
+	CREATE INDEX auth_attempts_credentials ON auth_attempts (username, password);
+
+	CREATE TABLE sessions (
+		session_id      text        PRIMARY KEY,
+		node_id         text        NOT NULL,
+		protocol        text        NOT NULL,
+		remote_host     inet        NOT NULL,
+		remote_port     integer,
+		local_port      integer,
+		client_version  text,
+		hassh           text,
+		started_at      timestamptz NOT NULL,
+		last_seen_at    timestamptz NOT NULL
+	);
+	CREATE INDEX sessions_remote_host ON sessions (remote_host, started_at DESC);
+
+	CREATE TABLE commands (
+		id              text        NOT NULL,
+		time            timestamptz NOT NULL,
+		session_id      text        NOT NULL,
+		command         text,
+		subsystem       text,
+		PRIMARY KEY (id, time)
+	);
+	CREATE INDEX commands_session_id ON commands (session_id);
+
+	CREATE TABLE geo_info (
+		ip              inet        PRIMARY KEY,
+		city            text,
+		region          text,
+		country         text,
+		org             text,
+		timezone        text,
+		latitude        double precision,
+		longitude       double precision,
+		updated_at      timestamptz NOT NULL
+	);`,
+	`ALTER TABLE auth_attempts
+		ADD COLUMN key_fingerprint text,
+		ADD COLUMN key_md5 text,
+		ADD COLUMN key_bits integer;
+	CREATE INDEX auth_attempts_key_fingerprint ON auth_attempts (key_fingerprint) WHERE key_fingerprint IS NOT NULL;`,
+	`ALTER TABLE sessions
+		ADD COLUMN ended_at timestamptz,
+		ADD COLUMN duration double precision,
+		ADD COLUMN channels integer,
+		ADD COLUMN bytes_in bigint,
+		ADD COLUMN bytes_out bigint;`,
+}
+
+// postgresHypertables are turned into TimescaleDB hypertables, partitioned
+// on their time column, when TimescaleDB is enabled.
+var postgresHypertables = []string{"auth_attempts", "commands"}
+
+// PostgresSink stores events in relational tables: authentication attempts,
+// the sessions they belong to, the commands run in them, and the latest
+// geolocation of every attacker IP. Rows are keyed by event, so rewriting a
+// batch leaves them unchanged.
+type PostgresSink struct {
+	pool   *pgxpool.Pool
+	tracer trace.Tracer
+}
+
+// NewPostgresSink connects to the database at dsn and migrates its schema,
+// converting the time series tables to hypertables when timescale is set.
+func NewPostgresSink(ctx context.Context, dsn string, timescale bool, tracer trace.Tracer) (*PostgresSink, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &PostgresSink{pool: pool, tracer: tracer}
+	if err := s.migrate(ctx, timescale); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func postgresSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return NewPostgresSink(ctx, dsn, os.Getenv("POSTGRES_TIMESCALEDB") == "true", tracer)
+}
+
+func (s *PostgresSink) Name() string {
+	return "postgres"
+}
+
+// migrate applies the pending migrations, holding an advisory lock so that
+// honeypots sharing the database don't race each other.
+func (s *PostgresSink) migrate(ctx context.Context, timescale bool) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	const lock = 0x55485054 // "UHPT"
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", lock); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", lock)
+
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer     PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := conn.QueryRow(ctx, "SELECT coalesce(max(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(postgresMigrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported %d", version, len(postgresMigrations))
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, postgresMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", i+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %v", i+1, err)
+		}
+		slog.Info("Applied database migration", "version", i+1)
+	}
+
+	if !timescale {
+		return nil
+	}
+
+	if _, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		return fmt.Errorf("failed to enable TimescaleDB: %v", err)
+	}
+	for _, table := range postgresHypertables {
+		if _, err := conn.Exec(ctx, "SELECT create_hypertable($1, 'time', if_not_exists => TRUE, migrate_data => TRUE)", table); err != nil {
+			return fmt.Errorf("failed to create hypertable %s: %v", table, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToPostgres",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	queries := &pgx.Batch{}
+	for _, event := range batch.Events {
+		queuePostgresEvent(queries, event)
+	}
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, queries).Close()
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Stored %d events", len(batch.Events)))
+	return nil
+}
+
+func queuePostgresEvent(queries *pgx.Batch, event Event) {
+	sshInfo := event.SSHInfo
+	analysis := event.Analysis
+	id := eventID(sshInfo)
+	timestamp := sshInfo.Timestamp.UTC()
+	remotePort := nullPort(sshInfo.RemotePort)
+	localPort := nullPort(sshInfo.LocalPort)
+
+	if sshInfo.SessionID != "" {
+		queries.Queue(`INSERT INTO sessions (session_id, node_id, protocol, remote_host, remote_port, local_port, client_version, hassh, started_at, last_seen_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9)
+			ON CONFLICT (session_id) DO UPDATE SET
+				started_at = least(sessions.started_at, excluded.started_at),
+				last_seen_at = greatest(sessions.last_seen_at, excluded.last_seen_at)`,
+			sshInfo.SessionID, sshInfo.Node.ID, sshInfo.Protocol, sshInfo.RemoteHost, remotePort, localPort,
+			nullString(sshInfo.ClientVersion), nullString(sshInfo.HASSH), timestamp)
+	}
+
+	switch sshInfo.Function {
+	case "password", "keyboard_interactive", "public_key":
+		var keyBits *int
+		if sshInfo.KeyBits > 0 {
+			keyBits = &sshInfo.KeyBits
+		}
+		queries.Queue(`INSERT INTO auth_attempts (id, time, node_id, protocol, session_id, remote_host, remote_port, local_port, method, username, password, key, key_type, key_fingerprint, key_md5, key_bits, attempt, client_version, hassh, tool, campaign, password_pattern, wordlist)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)
+			ON CONFLICT DO NOTHING`,
+			id, timestamp, sshInfo.Node.ID, sshInfo.Protocol, nullString(sshInfo.SessionID), sshInfo.RemoteHost, remotePort, localPort,
+			sshInfo.Function, sshInfo.User, nullString(sshInfo.Password), nullString(sshInfo.Key), nullString(sshInfo.KeyType),
+			nullString(sshInfo.KeyFingerprint), nullString(sshInfo.KeyMD5), keyBits, sshInfo.Attempt,
+			nullString(sshInfo.ClientVersion), nullString(sshInfo.HASSH), nullString(analysis.Tool), nullString(analysis.Campaign),
+			nullString(analysis.PasswordPattern), nullString(analysis.Wordlist))
+	case "session_end":
+		queries.Queue(`UPDATE sessions SET ended_at = $2, duration = $3, channels = $4, bytes_in = $5, bytes_out = $6
+			WHERE session_id = $1`,
+			sshInfo.SessionID, timestamp, sshInfo.Duration.Seconds(), sshInfo.Channels, sshInfo.BytesIn, sshInfo.BytesOut)
+	case "command":
+		queries.Queue(`INSERT INTO commands (id, time, session_id, command, subsystem)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`,
+			id, timestamp, sshInfo.SessionID, nullString(sshInfo.Command), nullString(sshInfo.Subsystem))
+	}
+
+	if ipInfo := event.IPInfo; ipInfo.Country != "" || ipInfo.Org != "" {
+		queries.Queue(`INSERT INTO geo_info (ip, city, region, country, org, timezone, latitude, longitude, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (ip) DO UPDATE SET
+				city = excluded.city, region = excluded.region, country = excluded.country, org = excluded.org,
+				timezone = excluded.timezone, latitude = excluded.latitude, longitude = excluded.longitude,
+				updated_at = excluded.updated_at
+			WHERE geo_info.updated_at <= excluded.updated_at`,
+			sshInfo.RemoteHost, nullString(ipInfo.City), nullString(ipInfo.Region), nullString(ipInfo.Country), nullString(ipInfo.Org),
+			nullString(ipInfo.Timezone), ipInfo.Latitude, ipInfo.Longitude, timestamp)
+	}
+}
+
+// Enforce deletes the attempts, commands and sessions older than before,
+// making the sink a RetentionTarget. Geolocations are kept.
+func (s *PostgresSink) Enforce(ctx context.Context, before time.Time) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM auth_attempts WHERE time < $1",
+			"DELETE FROM commands WHERE time < $1",
+			"DELETE FROM sessions WHERE last_seen_at < $1",
+		} {
+			if _, err := tx.Exec(ctx, query, before); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresSink) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+func nullString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+func nullPort(value string) *int {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return nil
+	}
+	return &port
+}
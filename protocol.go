@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol anomalies.
+const (
+	AnomalyMalformedIdent    = "malformed_ident"
+	AnomalyKexOrder          = "kex_order"
+	AnomalyOversizedPacket   = "oversized_packet"
+	AnomalyPreauthDisconnect = "preauth_disconnect"
+	AnomalyBannerDisconnect  = "auth_banner_disconnect"
+)
+
+const (
+	// RFC 4253 only requires implementations to handle packets up to this
+	// size, clients sending bigger ones are probing for overflows.
+	maxPacketLength = 35000
+	maxIdentLength  = 255
+
+	// Bytes inspected per connection before giving up.
+	maxSniffedBytes = 256 * 1024
+
+	msgDisconnect     = 1
+	msgIgnore         = 2
+	msgUnimplemented  = 3
+	msgDebug          = 4
+	msgKexInit        = 20
+	msgNewKeys        = 21
+	msgKexMethodFirst = 30
+	msgKexMethodLast  = 49
+)
+
+// Stages a client goes through before authenticating.
+const (
+	stageBanner = "banner"
+	stageKex    = "kex"
+	stageAuth   = "auth"
+)
+
+type ProtocolAnomaly struct {
+	Kind   string
+	Detail string
+}
+
+// protocolSniffer follows the cleartext part of the client side of an SSH
+// connection, the identification string and the key exchange packets up to
+// NEWKEYS, and records what deviates from RFC 4253.
+type protocolSniffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	sniffed   int
+	stage     string
+	done      bool
+	ident     string
+	kexInit   []byte
+	kexMethod bool
+	anomalies []ProtocolAnomaly
+}
+
+func (p *protocolSniffer) feed(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		return
+	}
+
+	p.sniffed += len(data)
+	if p.sniffed > maxSniffedBytes {
+		p.done = true
+		return
+	}
+
+	p.buf.Write(data)
+	for !p.done && p.step() {
+	}
+}
+
+// step consumes one identification line or packet from the buffer, reporting
+// false when more data is needed.
+func (p *protocolSniffer) step() bool {
+	if p.stage == stageBanner {
+		line, err := p.buf.ReadBytes('\n')
+		if err != nil {
+			// Put the partial line back and wait for the rest.
+			rest := append(line, p.buf.Bytes()...)
+			p.buf.Reset()
+			p.buf.Write(rest)
+
+			if len(rest) > maxIdentLength {
+				p.anomaly(AnomalyMalformedIdent, fmt.Sprintf("identification longer than %d bytes", maxIdentLength))
+				p.done = true
+			}
+			return false
+		}
+
+		p.ident = strings.TrimRight(string(line), "\r\n")
+		if problem := identProblem(p.ident); problem != "" {
+			p.anomaly(AnomalyMalformedIdent, problem)
+			p.done = true
+			return false
+		}
+
+		p.stage = stageKex
+		return true
+	}
+
+	if p.buf.Len() < 4 {
+		return false
+	}
+
+	length := binary.BigEndian.Uint32(p.buf.Bytes())
+	if length > maxPacketLength {
+		p.anomaly(AnomalyOversizedPacket, fmt.Sprintf("packet of %d bytes", length))
+		p.done = true
+		return false
+	}
+	if length < 2 {
+		p.anomaly(AnomalyKexOrder, "packet without message")
+		p.done = true
+		return false
+	}
+	if p.buf.Len() < 4+int(length) {
+		return false
+	}
+
+	packet := p.buf.Next(4 + int(length))
+	padding := int(packet[4])
+	if padding+1 > int(length) {
+		p.anomaly(AnomalyKexOrder, "packet padding longer than packet")
+		p.done = true
+		return false
+	}
+	p.message(packet[5 : 4+int(length)-padding])
+
+	return true
+}
+
+// message checks that a cleartext message comes in the order of a key
+// exchange: KEXINIT, the messages of the key exchange method, then NEWKEYS.
+func (p *protocolSniffer) message(payload []byte) {
+	if len(payload) == 0 {
+		p.anomaly(AnomalyKexOrder, "empty message")
+		p.done = true
+		return
+	}
+
+	msgType := payload[0]
+	switch {
+	case msgType == msgDisconnect || msgType == msgIgnore || msgType == msgUnimplemented || msgType == msgDebug:
+	case msgType == msgKexInit && p.kexInit == nil:
+		if len(payload) < 17 {
+			p.anomaly(AnomalyKexOrder, "truncated KEXINIT")
+			p.done = true
+			return
+		}
+		p.kexInit = bytes.Clone(payload)
+	case p.kexInit == nil:
+		p.anomaly(AnomalyKexOrder, fmt.Sprintf("message %d before KEXINIT", msgType))
+		p.done = true
+	case msgType >= msgKexMethodFirst && msgType <= msgKexMethodLast:
+		p.kexMethod = true
+	case msgType == msgNewKeys && p.kexMethod:
+		// Everything that follows is encrypted.
+		p.stage = stageAuth
+		p.done = true
+	default:
+		p.anomaly(AnomalyKexOrder, fmt.Sprintf("message %d during key exchange", msgType))
+		p.done = true
+	}
+}
+
+// hassh returns the HASSH fingerprint of the client, the MD5 of its key
+// exchange, encryption, MAC and compression algorithm lists, once its KEXINIT
+// was seen. Unlike the identification string these lists are rarely spoofed,
+// so they tell the underlying SSH library apart.
+func (p *protocolSniffer) hassh() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.kexInit == nil {
+		return "", false
+	}
+
+	lists, err := parseNameLists(p.kexInit[17:], 8)
+	if err != nil {
+		return "", false
+	}
+
+	sum := md5.Sum([]byte(strings.Join([]string{lists[0], lists[2], lists[4], lists[6]}, ";")))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// parseNameLists reads count SSH name-lists from data.
+func parseNameLists(data []byte, count int) ([]string, error) {
+	lists := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("truncated name-list")
+		}
+		length := binary.BigEndian.Uint32(data)
+		if uint32(len(data)-4) < length {
+			return nil, errors.New("truncated name-list")
+		}
+		lists = append(lists, string(data[4:4+length]))
+		data = data[4+length:]
+	}
+
+	return lists, nil
+}
+
+func (p *protocolSniffer) anomaly(kind string, detail string) {
+	p.anomalies = append(p.anomalies, ProtocolAnomaly{Kind: kind, Detail: detail})
+}
+
+// identProblem describes what is wrong with a client identification string,
+// if anything.
+func identProblem(ident string) string {
+	if len(ident) > maxIdentLength {
+		return fmt.Sprintf("identification longer than %d bytes", maxIdentLength)
+	}
+	if !strings.HasPrefix(ident, "SSH-") {
+		return "identification without SSH- prefix"
+	}
+	if !strings.HasPrefix(ident, "SSH-2.0-") && !strings.HasPrefix(ident, "SSH-1.99-") {
+		return "unsupported protocol version"
+	}
+	for _, r := range ident {
+		if r < 0x20 || r > 0x7e {
+			return "non printable character in identification"
+		}
+	}
+
+	return ""
+}
+
+// sniffConn feeds everything the client sends to a protocolSniffer and
+// captures the anomalies found once the connection is closed.
+type sniffConn struct {
+	net.Conn
+	sniffer   protocolSniffer
+	record    *ConnRecord
+	capture   func(SSHInfo) bool
+	hasHASSH  bool
+	closeOnce sync.Once
+}
+
+func newSniffConn(conn net.Conn, record *ConnRecord, capture func(SSHInfo) bool) *sniffConn {
+	return &sniffConn{
+		Conn:    conn,
+		sniffer: protocolSniffer{stage: stageBanner},
+		record:  record,
+		capture: capture,
+	}
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.sniffer.feed(b[:n])
+		if !c.hasHASSH {
+			if hassh, ok := c.sniffer.hassh(); ok {
+				c.record.setHASSH(hassh)
+				c.hasHASSH = true
+			}
+		}
+	}
+
+	return n, err
+}
+
+func (c *sniffConn) Close() error {
+	c.closeOnce.Do(c.report)
+
+	return c.Conn.Close()
+}
+
+func (c *sniffConn) report() {
+	c.sniffer.mu.Lock()
+	anomalies := c.sniffer.anomalies
+	ident := c.sniffer.ident
+	stage := c.sniffer.stage
+	c.sniffer.mu.Unlock()
+
+	// Leaving at the pre-authentication banner tells more than leaving before
+	// any attempt, which it usually also is
+	if shown, ok := c.record.leftAtBanner(); ok {
+		anomalies = append(anomalies, ProtocolAnomaly{Kind: AnomalyBannerDisconnect, Detail: shown.Round(time.Millisecond).String()})
+	} else if !c.record.hasAttempts() {
+		anomalies = append(anomalies, ProtocolAnomaly{Kind: AnomalyPreauthDisconnect, Detail: stage})
+	}
+
+	remoteHost, remotePort := addrHostPort(c.RemoteAddr())
+	localHost, localPort := addrHostPort(c.LocalAddr())
+	for _, anomaly := range anomalies {
+		if anomaly.Kind != AnomalyPreauthDisconnect && anomaly.Kind != AnomalyBannerDisconnect {
+			slog.Info("Protocol anomaly", "remote_host", remoteHost, "anomaly", anomaly.Kind, "detail", anomaly.Detail)
+		}
+
+		c.capture(SSHInfo{
+			RemoteHost:    remoteHost,
+			RemotePort:    remotePort,
+			LocalHost:     localHost,
+			LocalPort:     localPort,
+			ClientVersion: ident,
+			HASSH:         c.record.HASSH(),
+			Function:      "anomaly",
+			Protocol:      "ssh",
+			Anomaly:       anomaly.Kind,
+			AnomalyDetail: anomaly.Detail,
+			Node:          node,
+			Timestamp:     time.Now(),
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+)
+
+// Service is a honeypot protocol served alongside SSH. It captures what
+// clients do as events of its own protocol, which go through the same
+// pipeline as SSH ones.
+type Service interface {
+	// Serve handles the connections accepted on listener until the service
+	// is shut down or the listener fails
+	Serve(listener net.Listener) error
+	// Shutdown stops accepting connections and waits for the open ones
+	// until ctx is done
+	Shutdown(ctx context.Context) error
+}
+
+// ServiceEnv is what services are built with.
+type ServiceEnv struct {
+	// Hostname is that of the persona, for the services to present
+	Hostname string
+	// OS is the name and version of its distribution
+	OS      string
+	Capture func(SSHInfo) bool
+}
+
+// ServicePort is a port a service listens on, under its own listener name.
+type ServicePort struct {
+	Name string
+	Port string
+	// TLS, when set, wraps the connections accepted on the port
+	TLS *tls.Config
+}
+
+// protocols are the services served alongside SSH, by name. Each returns its
+// service and ports, or no ports when not enabled by its settings.
+var protocols = map[string]func(env ServiceEnv) (Service, []ServicePort, error){
+	"telnet": func(env ServiceEnv) (Service, []ServicePort, error) {
+		port := os.Getenv("TELNET_PORT")
+		if port == "" {
+			return nil, nil, nil
+		}
+		return NewTelnetServer(env.Hostname, env.OS, env.Capture), []ServicePort{{Name: "telnet", Port: port}}, nil
+	},
+	"http": func(env ServiceEnv) (Service, []ServicePort, error) {
+		web := webServerFromEnv(env.Hostname, env.Capture)
+		if web == nil {
+			return nil, nil, nil
+		}
+		var ports []ServicePort
+		if port := os.Getenv("HTTP_PORT"); port != "" {
+			ports = append(ports, ServicePort{Name: "http", Port: port})
+		}
+		if port := os.Getenv("HTTPS_PORT"); port != "" {
+			tlsConfig, err := webTLSConfig(env.Hostname)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to load the HTTPS certificate: %w", err)
+			}
+			ports = append(ports, ServicePort{Name: "https", Port: port, TLS: tlsConfig})
+		}
+		return web, ports, nil
+	},
+}
+
+// protocolListeners returns the listeners of the enabled protocols, by name,
+// accepting connections through connLimiter.
+func protocolListeners(env ServiceEnv, network string, connLimiter *ConnLimiter) (map[string]Listener, error) {
+	names := make([]string, 0, len(protocols))
+	for name := range protocols {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	listeners := map[string]Listener{}
+	for _, name := range names {
+		service, ports, err := protocols[name](env)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, port := range ports {
+			_, addrs, err := listenAddrs(port.Port)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			tlsConfig := port.TLS
+			listeners[port.Name] = Listener{
+				Serve: func() error {
+					listener, err := connLimiter.Listen(network, addrs)
+					if err != nil {
+						return err
+					}
+					if tlsConfig != nil {
+						listener = tls.NewListener(listener, tlsConfig)
+					}
+					return service.Serve(listener)
+				},
+				Shutdown: service.Shutdown,
+			}
+			slog.Info("Starting protocol listener", "protocol", name, "listener", port.Name, "port", port.Port)
+		}
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"text/template"
+)
+
+const defaultPushTemplate = `{{if .Digest}}{{range .Digest}}• {{.Summary}}{{with .Event.SSHInfo}}{{if .RemoteHost}} ({{.RemoteHost}}){{end}}{{end}}
+{{end}}{{else}}{{.Event.SSHInfo.Function}} from {{.Event.SSHInfo.RemoteHost}}{{with .Event.IPInfo}}{{if .Country}} ({{.City}}, {{.Country}}){{end}}{{end}}
+user: {{.Event.SSHInfo.User}}{{if .Event.SSHInfo.Password}} / password: {{.Event.SSHInfo.Password}}{{end}}{{end}}`
+
+// NtfyNotifier publishes alerts to an ntfy topic, on ntfy.sh or a self
+// hosted server.
+type NtfyNotifier struct {
+	serverURL string
+	topic     string
+	token     string
+	template  *template.Template
+}
+
+func NewNtfyNotifier(serverURL string, topic string, token string, templateText string) (*NtfyNotifier, error) {
+	tmpl, err := parseAlertTemplate("ntfy", templateText, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NtfyNotifier{
+		serverURL: strings.TrimSuffix(serverURL, "/"),
+		topic:     topic,
+		token:     token,
+		template:  tmpl,
+	}, nil
+}
+
+func (n *NtfyNotifier) Name() string {
+	return "ntfy"
+}
+
+func (n *NtfyNotifier) Notify(ctx context.Context, alert Alert) error {
+	var message bytes.Buffer
+	if err := n.template.Execute(&message, alert); err != nil {
+		return err
+	}
+
+	priority := 3
+	tags := []string{"ssh-honeypot", alert.Rule}
+	switch alert.Severity {
+	case SeverityCritical:
+		priority = 5
+		tags = append(tags, "rotating_light")
+	case SeverityWarning:
+		priority = 4
+		tags = append(tags, "warning")
+	}
+
+	payload := map[string]any{
+		"topic":    n.topic,
+		"title":    alert.Summary,
+		"message":  message.String(),
+		"priority": priority,
+		"tags":     tags,
+	}
+	if alert.DashboardURL != "" {
+		payload["click"] = alert.DashboardURL
+	}
+
+	var headers map[string]string
+	if n.token != "" {
+		headers = map[string]string{"Authorization": "Bearer " + n.token}
+	}
+
+	return postJSON(ctx, n.serverURL, payload, headers)
+}
+
+const pushoverMessagesURL = "https://api.pushover.net/1/messages.json"
+
+type PushoverNotifier struct {
+	appToken string
+	userKey  string
+	template *template.Template
+}
+
+func NewPushoverNotifier(appToken string, userKey string, templateText string) (*PushoverNotifier, error) {
+	tmpl, err := parseAlertTemplate("pushover", templateText, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PushoverNotifier{
+		appToken: appToken,
+		userKey:  userKey,
+		template: tmpl,
+	}, nil
+}
+
+func (n *PushoverNotifier) Name() string {
+	return "pushover"
+}
+
+func (n *PushoverNotifier) Notify(ctx context.Context, alert Alert) error {
+	var message bytes.Buffer
+	if err := n.template.Execute(&message, alert); err != nil {
+		return err
+	}
+
+	priority := 0
+	switch alert.Severity {
+	case SeverityCritical:
+		priority = 1
+	case SeverityInfo:
+		priority = -1
+	}
+
+	payload := map[string]any{
+		"token":     n.appToken,
+		"user":      n.userKey,
+		"title":     alert.Summary,
+		"message":   message.String(),
+		"priority":  priority,
+		"timestamp": alert.Timestamp.Unix(),
+	}
+	if alert.DashboardURL != "" {
+		payload["url"] = alert.DashboardURL
+		payload["url_title"] = "Open dashboard"
+	}
+
+	return postJSON(ctx, pushoverMessagesURL, payload, nil)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RedisStreamSink appends every event to a Redis stream, trimmed to about
+// maxLen entries. Entries hold the event JSON EventDocument in the event
+// field, next to its id, function and remote_host for consumers to filter
+// on without decoding it.
+type RedisStreamSink struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+	tracer trace.Tracer
+}
+
+func NewRedisStreamSink(url string, stream string, maxLen int64, tracer trace.Tracer) (*RedisStreamSink, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisStreamSink{
+		client: redis.NewClient(options),
+		stream: stream,
+		maxLen: maxLen,
+		tracer: tracer,
+	}, nil
+}
+
+func redisStreamSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	return NewRedisStreamSink(url, getEnv("REDIS_STREAM", "ssh-honeypot:events"), int64(getEnvInt("REDIS_STREAM_MAXLEN", 100000)), tracer)
+}
+
+func (s *RedisStreamSink) Name() string {
+	return "redis"
+}
+
+func (s *RedisStreamSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToRedis",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	pipe := s.client.Pipeline()
+	for _, event := range batch.Events {
+		document := newEventDocument(event)
+		encoded, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.stream,
+			MaxLen: s.maxLen,
+			Approx: true,
+			Values: []any{
+				"id", document.ID,
+				"function", document.Function,
+				"remote_host", document.RemoteHost,
+				"event", encoded,
+			},
+		})
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Added %d events", len(batch.Events)))
+	return nil
+}
+
+func (s *RedisStreamSink) Close() error {
+	return s.client.Close()
+}
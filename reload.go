@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultServerVersion = "OpenSSH_7.4p1 Debian-10+deb9u7"
+
+// defaultServerVersions are the banners the default persona picks from in the
+// random version modes: stock OpenSSH of the Debian releases.
+var defaultServerVersions = []string{
+	"OpenSSH_7.4p1 Debian-10+deb9u7",
+	"OpenSSH_7.9p1 Debian-10+deb10u2",
+	"OpenSSH_7.9p1 Debian-10+deb10u4",
+	"OpenSSH_8.4p1 Debian-5+deb11u1",
+	"OpenSSH_8.4p1 Debian-5+deb11u3",
+	"OpenSSH_9.2p1 Debian-2+deb12u2",
+	"OpenSSH_9.2p1 Debian-2+deb12u3",
+}
+
+// Settings are the tunables that can change while running, reloaded on
+// SIGHUP or when the configuration file changes. Connections pick them up
+// when they are accepted, so open ones keep the settings they started with.
+type Settings struct {
+	MaxTimeout    time.Duration
+	IdleTimeout   time.Duration
+	ServerVersion string
+	// VersionMode is "fixed" for ServerVersion, "listener" for one of
+	// ServerVersions picked on every (re)load and kept in ServerVersion, or
+	// "connection" for one picked per client.
+	VersionMode    string
+	ServerVersions []string
+	Banner         string
+	// Listeners override the version and banner for the SSH listener of a
+	// port
+	Listeners   map[string]ListenerSettings
+	AlertRules  []string
+	IPInfoToken string
+	APIToken    string
+	Allowlist   []*net.IPNet
+	// Policies decide what happens to connections by where they come from,
+	// the first matching one applying
+	Policies []PolicyRule
+}
+
+// ListenerSettings are the settings of an SSH listener that differ from the
+// defaults, from SSH_VERSION_<port> and SSH_BANNER_<port>.
+type ListenerSettings struct {
+	ServerVersion string
+	Banner        string
+}
+
+var settings atomic.Pointer[Settings]
+
+func currentSettings() *Settings {
+	return settings.Load()
+}
+
+func settingsFromEnv() (*Settings, error) {
+	// The versions default to those of the distribution of the persona
+	persona, err := LoadPersona(os.Getenv("SHELL_PERSONA"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SHELL_PERSONA: %v", err)
+	}
+	s := &Settings{
+		MaxTimeout:     getEnvDuration("CONNECTION_MAX_TIMEOUT", DeadlineTimeout),
+		IdleTimeout:    getEnvDuration("CONNECTION_IDLE_TIMEOUT", IdleTimeout),
+		ServerVersion:  getEnv("SSH_VERSION", persona.SSHVersion),
+		VersionMode:    getEnv("SSH_VERSION_MODE", "fixed"),
+		ServerVersions: splitList(os.Getenv("SSH_VERSIONS")),
+		Banner:         os.Getenv("SSH_BANNER"),
+		AlertRules:     splitList(getEnv("ALERT_RULES", "first_seen_country")),
+		IPInfoToken:    os.Getenv("IPINFOIO_TOKEN"),
+		APIToken:       os.Getenv("API_TOKEN"),
+	}
+
+	s.Banner = bannerLines(s.Banner)
+	if len(s.ServerVersions) == 0 {
+		s.ServerVersions = persona.SSHVersions
+	}
+	switch s.VersionMode {
+	case "fixed", "connection":
+	case "listener":
+		s.ServerVersion = s.ServerVersions[rand.Intn(len(s.ServerVersions))]
+	default:
+		return nil, fmt.Errorf("invalid SSH_VERSION_MODE '%s', expected 'fixed', 'listener' or 'connection'", s.VersionMode)
+	}
+
+	ports := splitList(getEnv("SSH_PORT", "2222"))
+	s.Listeners = make(map[string]ListenerSettings, len(ports))
+	for _, port := range ports {
+		listener := ListenerSettings{
+			ServerVersion: os.Getenv("SSH_VERSION_" + port),
+			Banner:        bannerLines(getEnv("SSH_BANNER_"+port, s.Banner)),
+		}
+		// Every listener shows a version of its own, as separate hosts would
+		if listener.ServerVersion == "" && s.VersionMode == "listener" && len(ports) > 1 {
+			listener.ServerVersion = s.ServerVersions[rand.Intn(len(s.ServerVersions))]
+		}
+		s.Listeners[port] = listener
+	}
+
+	for _, entry := range splitList(os.Getenv("ALLOWLIST")) {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ALLOWLIST entry '%s': %v", entry, err)
+		}
+		s.Allowlist = append(s.Allowlist, network)
+	}
+
+	for _, entry := range splitList(os.Getenv("POLICIES")) {
+		rule, err := parsePolicyRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid POLICIES entry: %v", err)
+		}
+		s.Policies = append(s.Policies, rule)
+	}
+
+	return s, nil
+}
+
+// serverVersionKey holds the version picked for a connection in its
+// ssh.Context.
+type serverVersionKey struct{}
+
+// bannerLines ends banner like a banner file would be, clients printing it
+// as is.
+func bannerLines(banner string) string {
+	if banner != "" && !strings.HasSuffix(banner, "\n") {
+		banner += "\n"
+	}
+	return banner
+}
+
+// Version returns the version presented by the listener of port to the
+// client at remoteAddr: the listener's own when set, otherwise one picked
+// from the client's IP in the connection mode, so a client reconnecting isn't
+// given away by the version changing.
+func (s *Settings) Version(port string, remoteAddr net.Addr) string {
+	if version := s.Listeners[port].ServerVersion; version != "" {
+		return version
+	}
+	if s.VersionMode != "connection" {
+		return s.ServerVersion
+	}
+
+	host, _ := addrHostPort(remoteAddr)
+	hash := fnv.New32a()
+	hash.Write([]byte(host))
+	return s.ServerVersions[hash.Sum32()%uint32(len(s.ServerVersions))]
+}
+
+// ListenerBanner returns the banner of the listener of port, none when empty.
+func (s *Settings) ListenerBanner(port string) string {
+	if listener, found := s.Listeners[port]; found {
+		return listener.Banner
+	}
+	return s.Banner
+}
+
+// Allowed reports whether ip is in the allowlist, whose connections are
+// never recorded.
+func (s *Settings) Allowed(ip net.IP) bool {
+	for _, network := range s.Allowlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SettingsView is Settings as the API shows them, without secrets.
+type SettingsView struct {
+	MaxTimeout     string   `json:"max_timeout"`
+	IdleTimeout    string   `json:"idle_timeout"`
+	ServerVersion  string   `json:"server_version"`
+	VersionMode    string   `json:"version_mode"`
+	ServerVersions []string `json:"server_versions"`
+	Banner         string   `json:"banner"`
+	AlertRules     []string `json:"alert_rules"`
+	IPInfo         bool     `json:"ipinfo"`
+	Allowlist      []string `json:"allowlist"`
+	Policies       []string `json:"policies"`
+}
+
+func (s *Settings) View() SettingsView {
+	allowlist := make([]string, len(s.Allowlist))
+	for i, network := range s.Allowlist {
+		allowlist[i] = network.String()
+	}
+	policies := make([]string, len(s.Policies))
+	for i, rule := range s.Policies {
+		policies[i] = rule.Rule
+	}
+
+	return SettingsView{
+		MaxTimeout:     s.MaxTimeout.String(),
+		IdleTimeout:    s.IdleTimeout.String(),
+		ServerVersion:  s.ServerVersion,
+		VersionMode:    s.VersionMode,
+		ServerVersions: s.ServerVersions,
+		Banner:         s.Banner,
+		AlertRules:     s.AlertRules,
+		IPInfo:         s.IPInfoToken != "",
+		Allowlist:      allowlist,
+		Policies:       policies,
+	}
+}
+
+// Reloader re-reads the configuration file, the secret files and the
+// environment into the current Settings, then hands them to the registered
+// hooks.
+type Reloader struct {
+	configPath string
+	configEnv  []string
+	modTime    time.Time
+	secrets    *SecretFiles
+	hooks      []func(*Settings) error
+}
+
+// NewReloader loads the configuration file at configPath, if any, the secret
+// files and the initial Settings.
+func NewReloader(configPath string) (*Reloader, error) {
+	r := &Reloader{configPath: configPath, secrets: NewSecretFiles()}
+	if err := r.applyConfig(); err != nil {
+		return nil, err
+	}
+	if err := r.secrets.Load(); err != nil {
+		return nil, err
+	}
+
+	s, err := settingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	settings.Store(s)
+
+	return r, nil
+}
+
+// OnReload registers fn to be applied with the new settings on every reload.
+// A reload is rejected as a whole when any hook fails.
+func (r *Reloader) OnReload(fn func(*Settings) error) {
+	r.hooks = append(r.hooks, fn)
+}
+
+func (r *Reloader) applyConfig() error {
+	if r.configPath == "" {
+		return nil
+	}
+
+	info, err := os.Stat(r.configPath)
+	if err != nil {
+		return err
+	}
+	r.modTime = info.ModTime()
+
+	config, err := LoadConfig(r.configPath)
+	if err != nil {
+		return err
+	}
+
+	// Drop what the previous version of the file set, so removed settings
+	// fall back to their defaults, without touching the real environment.
+	for _, key := range r.configEnv {
+		os.Unsetenv(key)
+	}
+	r.configEnv, err = config.Apply()
+	return err
+}
+
+func (r *Reloader) Reload() error {
+	if err := r.applyConfig(); err != nil {
+		return err
+	}
+	if err := r.secrets.Load(); err != nil {
+		return err
+	}
+
+	s, err := settingsFromEnv()
+	if err != nil {
+		return err
+	}
+	for _, hook := range r.hooks {
+		if err := hook(s); err != nil {
+			return err
+		}
+	}
+	settings.Store(s)
+
+	return nil
+}
+
+// Run reloads on SIGHUP, and when the modification time of the configuration
+// file or of a secret file changes, until ctx is done.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			slog.Info("Received SIGHUP, reloading settings")
+		case <-ticker.C:
+			if r.secrets.Changed() {
+				slog.Info("Secret file changed, reloading settings")
+				break
+			}
+			if r.configPath == "" {
+				continue
+			}
+			info, err := os.Stat(r.configPath)
+			if err != nil || info.ModTime().Equal(r.modTime) {
+				continue
+			}
+			slog.Info("Configuration file changed, reloading settings", "path", r.configPath)
+		}
+
+		if err := r.Reload(); err != nil {
+			slog.Error("Failed to reload settings, keeping the current ones", "error", err)
+			continue
+		}
+		slog.Info("Reloaded settings")
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	reportTopN = 10
+
+	// Notable sessions listed per report.
+	maxReportSessions = 20
+)
+
+const reportMarkdownTemplate = `# SSH honeypot report
+
+{{.Start.Format "2006-01-02 15:04"}} to {{.End.Format "2006-01-02 15:04 MST"}}
+
+| | |
+|---|---|
+| Password attempts | {{.PasswordAttempts}} |
+| Public key attempts | {{.PublicKeys}} |
+| Sessions | {{.Sessions}} |
+| Source IPs | {{.SourceIPs}} |
+| New attackers | {{.NewAttackers}} |
+| Returning attackers | {{.ReturningAttackers}} |
+
+## New countries
+{{range .NewCountries}}
+- {{.}}{{else}}
+None{{end}}
+
+## New source ASNs
+{{range .NewASNs}}
+- {{.}}{{else}}
+None{{end}}
+
+## Top countries
+{{range .Countries}}
+- {{.Value}}: {{.Count}}{{end}}
+
+## Top ASNs
+{{range .ASNs}}
+- {{.Value}}: {{.Count}}{{end}}
+
+## Top usernames
+{{range .Usernames}}
+- ` + "`{{.Value}}`" + `: {{.Count}}{{end}}
+
+## Top passwords
+{{range .Passwords}}
+- ` + "`{{.Value}}`" + `: {{.Count}}{{end}}
+
+## Notable sessions
+{{range .NotableSessions}}
+- {{.Timestamp.Format "2006-01-02 15:04:05"}} {{.RemoteHost}} as ` + "`{{.User}}`" + `{{if .Command}}: ` + "`{{.Command}}`" + `{{end}}{{if .Techniques}} ({{.Techniques}}){{end}}{{else}}
+None{{end}}
+`
+
+const reportHTMLTemplate = `<html><body style="font-family: sans-serif">
+<h1>SSH honeypot report</h1>
+<p>{{.Start.Format "2006-01-02 15:04"}} to {{.End.Format "2006-01-02 15:04 MST"}}</p>
+<table>
+<tr><td>Password attempts</td><td>{{.PasswordAttempts}}</td></tr>
+<tr><td>Public key attempts</td><td>{{.PublicKeys}}</td></tr>
+<tr><td>Sessions</td><td>{{.Sessions}}</td></tr>
+<tr><td>Source IPs</td><td>{{.SourceIPs}}</td></tr>
+<tr><td>New attackers</td><td>{{.NewAttackers}}</td></tr>
+<tr><td>Returning attackers</td><td>{{.ReturningAttackers}}</td></tr>
+</table>
+<h2>New countries</h2>
+{{if .NewCountries}}<ul>{{range .NewCountries}}<li>{{.}}</li>{{end}}</ul>{{else}}<p>None</p>{{end}}
+<h2>New source ASNs</h2>
+{{if .NewASNs}}<ul>{{range .NewASNs}}<li>{{.}}</li>{{end}}</ul>{{else}}<p>None</p>{{end}}
+<h2>Top countries</h2>
+<ul>{{range .Countries}}<li>{{.Value}}: {{.Count}}</li>{{end}}</ul>
+<h2>Top ASNs</h2>
+<ul>{{range .ASNs}}<li>{{.Value}}: {{.Count}}</li>{{end}}</ul>
+<h2>Top usernames</h2>
+<ul>{{range .Usernames}}<li><code>{{.Value}}</code>: {{.Count}}</li>{{end}}</ul>
+<h2>Top passwords</h2>
+<ul>{{range .Passwords}}<li><code>{{.Value}}</code>: {{.Count}}</li>{{end}}</ul>
+<h2>Notable sessions</h2>
+{{if .NotableSessions}}<ul>{{range .NotableSessions}}<li>{{.Timestamp.Format "2006-01-02 15:04:05"}} {{.RemoteHost}} as <code>{{.User}}</code>{{if .Command}}: <code>{{.Command}}</code>{{end}}{{if .Techniques}} ({{.Techniques}}){{end}}</li>{{end}}</ul>{{else}}<p>None</p>{{end}}
+</body></html>
+`
+
+var (
+	reportMarkdown = template.Must(template.New("report").Parse(reportMarkdownTemplate))
+	reportHTML     = htmltemplate.Must(htmltemplate.New("report").Parse(reportHTMLTemplate))
+)
+
+type NotableSession struct {
+	Timestamp  time.Time `json:"timestamp"`
+	RemoteHost string    `json:"remote_host"`
+	User       string    `json:"user"`
+	Command    string    `json:"command,omitempty"`
+	Techniques string    `json:"techniques,omitempty"`
+}
+
+type Report struct {
+	Start              time.Time         `json:"start"`
+	End                time.Time         `json:"end"`
+	PasswordAttempts   int               `json:"password_attempts"`
+	PublicKeys         int               `json:"public_key_attempts"`
+	Sessions           int               `json:"sessions"`
+	SourceIPs          int               `json:"source_ips"`
+	NewAttackers       int               `json:"new_attackers"`
+	ReturningAttackers int               `json:"returning_attackers"`
+	NewCountries       []string          `json:"new_countries"`
+	NewASNs            []string          `json:"new_asns"`
+	Countries          []CredentialCount `json:"countries"`
+	ASNs               []CredentialCount `json:"asns"`
+	Usernames          []CredentialCount `json:"usernames"`
+	Passwords          []CredentialCount `json:"passwords"`
+	NotableSessions    []NotableSession  `json:"notable_sessions"`
+}
+
+// ReportCollector accumulates the events of the current report period.
+type ReportCollector struct {
+	mu             sync.Mutex
+	start          time.Time
+	functions      map[string]int
+	sourceIPs      map[string]struct{}
+	countries      map[string]int
+	knownCountries map[string]struct{}
+	asns           map[string]int
+	newAttackers   map[string]struct{}
+	knownASNs      map[string]struct{}
+	usernames      map[string]int
+	passwords      map[string]int
+	sessions       []NotableSession
+}
+
+func NewReportCollector() *ReportCollector {
+	collector := &ReportCollector{
+		knownCountries: map[string]struct{}{},
+		knownASNs:      map[string]struct{}{},
+	}
+	collector.reset(time.Now())
+
+	return collector
+}
+
+func (r *ReportCollector) reset(start time.Time) {
+	r.start = start
+	r.functions = map[string]int{}
+	r.sourceIPs = map[string]struct{}{}
+	r.countries = map[string]int{}
+	r.asns = map[string]int{}
+	r.newAttackers = map[string]struct{}{}
+	r.usernames = map[string]int{}
+	r.passwords = map[string]int{}
+	r.sessions = nil
+}
+
+func (r *ReportCollector) Observe(ctx context.Context, event Event) {
+	sshInfo := event.SSHInfo
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Attempts collapsed by the Deduper count as many times as they were made
+	attempts := max(sshInfo.AttemptCount, 1)
+	r.functions[sshInfo.Function] += attempts
+	if len(r.sourceIPs) < maxCredentialKeysPerBucket {
+		r.sourceIPs[sshInfo.RemoteHost] = struct{}{}
+	}
+	if event.IPInfo.Country != "" {
+		countCredential(r.countries, event.IPInfo.Country, attempts)
+	}
+	if event.IPInfo.Org != "" {
+		countCredential(r.asns, event.IPInfo.Org, attempts)
+	}
+	if event.Analysis.NewAttacker && len(r.newAttackers) < maxCredentialKeysPerBucket {
+		r.newAttackers[sshInfo.RemoteHost] = struct{}{}
+	}
+
+	switch sshInfo.Function {
+	case "password", "keyboard_interactive":
+		countCredential(r.usernames, sshInfo.User, attempts)
+		countCredential(r.passwords, sshInfo.Password, attempts)
+	case "public_key":
+		countCredential(r.usernames, sshInfo.User, attempts)
+	case "session":
+		if isNotableSession(event) && len(r.sessions) < maxReportSessions {
+			r.sessions = append(r.sessions, NotableSession{
+				Timestamp:  sshInfo.Timestamp,
+				RemoteHost: sshInfo.RemoteHost,
+				User:       sshInfo.User,
+				Command:    sshInfo.Command,
+				Techniques: event.Analysis.Techniques,
+			})
+		}
+	}
+}
+
+// isNotableSession: sessions that ran a command or were likely driven by a
+// person are worth a look, bare logins are not.
+func isNotableSession(event Event) bool {
+	if event.SSHInfo.Command != "" {
+		return true
+	}
+
+	likelihood := event.Analysis.HumanLikelihood
+	return likelihood != nil && *likelihood >= 0.5
+}
+
+// Rotate returns the report of the period ending at end and starts a new
+// period.
+func (r *ReportCollector) Rotate(end time.Time) Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := Report{
+		Start:              r.start,
+		End:                end,
+		PasswordAttempts:   r.functions["password"] + r.functions["keyboard_interactive"],
+		PublicKeys:         r.functions["public_key"],
+		Sessions:           r.functions["session"],
+		SourceIPs:          len(r.sourceIPs),
+		NewAttackers:       len(r.newAttackers),
+		ReturningAttackers: max(len(r.sourceIPs)-len(r.newAttackers), 0),
+		NewCountries:       []string{},
+		NewASNs:            []string{},
+		Countries:          topCounts(r.countries, reportTopN),
+		ASNs:               topCounts(r.asns, reportTopN),
+		Usernames:          topCounts(r.usernames, reportTopN),
+		Passwords:          topCounts(r.passwords, reportTopN),
+		NotableSessions:    r.sessions,
+	}
+
+	for country := range r.countries {
+		if _, known := r.knownCountries[country]; !known {
+			report.NewCountries = append(report.NewCountries, country)
+			r.knownCountries[country] = struct{}{}
+		}
+	}
+	sort.Strings(report.NewCountries)
+	for asn := range r.asns {
+		if _, known := r.knownASNs[asn]; !known {
+			report.NewASNs = append(report.NewASNs, asn)
+			r.knownASNs[asn] = struct{}{}
+		}
+	}
+	sort.Strings(report.NewASNs)
+
+	r.reset(end)
+
+	return report
+}
+
+// Alert renders report as an informational alert, one digest line per
+// highlight, for delivery through the notifiers.
+func (report Report) Alert() Alert {
+	alert := Alert{
+		Rule:      "report",
+		Severity:  SeverityInfo,
+		Summary:   fmt.Sprintf("Honeypot report for %s to %s", report.Start.Format("2006-01-02 15:04"), report.End.Format("2006-01-02 15:04")),
+		Timestamp: report.End,
+	}
+
+	lines := []string{
+		fmt.Sprintf("%d password attempts, %d public key attempts and %d sessions from %d source IPs",
+			report.PasswordAttempts, report.PublicKeys, report.Sessions, report.SourceIPs),
+		fmt.Sprintf("%d new and %d returning attackers", report.NewAttackers, report.ReturningAttackers),
+	}
+	if len(report.NewCountries) > 0 {
+		lines = append(lines, "New countries: "+strings.Join(report.NewCountries, ", "))
+	}
+	if len(report.NewASNs) > 0 {
+		lines = append(lines, "New source ASNs: "+strings.Join(report.NewASNs, ", "))
+	}
+	if len(report.ASNs) > 0 {
+		lines = append(lines, "Top ASNs: "+formatCounts(report.ASNs))
+	}
+	if len(report.Usernames) > 0 {
+		lines = append(lines, "Top usernames: "+formatCounts(report.Usernames))
+	}
+	if len(report.Passwords) > 0 {
+		lines = append(lines, "Top passwords: "+formatCounts(report.Passwords))
+	}
+	for _, session := range report.NotableSessions {
+		line := fmt.Sprintf("Session from %s as %s", session.RemoteHost, session.User)
+		if session.Command != "" {
+			line += ": " + session.Command
+		}
+		lines = append(lines, line)
+	}
+
+	for _, line := range lines {
+		alert.Digest = append(alert.Digest, Alert{
+			Rule:      alert.Rule,
+			Severity:  alert.Severity,
+			Summary:   line,
+			Timestamp: alert.Timestamp,
+		})
+	}
+
+	return alert
+}
+
+func formatCounts(counts []CredentialCount) string {
+	formatted := make([]string, 0, len(counts))
+	for _, count := range counts {
+		formatted = append(formatted, fmt.Sprintf("%s (%d)", count.Value, count.Count))
+	}
+
+	return strings.Join(formatted, ", ")
+}
+
+// writeReport writes report to dir as Markdown and HTML.
+func writeReport(dir string, report Report) error {
+	name := "report-" + report.End.UTC().Format("20060102-1504")
+
+	var markdown bytes.Buffer
+	if err := reportMarkdown.Execute(&markdown, report); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".md"), markdown.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	var html bytes.Buffer
+	if err := reportHTML.Execute(&html, report); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, name+".html"), html.Bytes(), 0o644)
+}
+
+// ReportWebhook posts every report as JSON to a URL.
+type ReportWebhook struct {
+	url     string
+	headers map[string]string
+}
+
+func NewReportWebhook(url string, headers map[string]string) *ReportWebhook {
+	return &ReportWebhook{url: url, headers: headers}
+}
+
+func (w *ReportWebhook) Send(ctx context.Context, report Report) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	return postJSON(ctx, w.url, report, w.headers)
+}
+
+// runReports produces a report at every interval boundary, e.g. midnight UTC
+// for a 24h interval, writing it to dir if set, posting it to webhook if set
+// and sending it through notifiers.
+func runReports(collector *ReportCollector, interval time.Duration, dir string, webhook *ReportWebhook, notifiers []Notifier, tracer trace.Tracer) {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(interval).Add(interval).Sub(now))
+
+		report := collector.Rotate(time.Now())
+
+		ctx, span := tracer.Start(
+			context.Background(),
+			"report",
+			trace.WithAttributes(attribute.Int("source_ips", report.SourceIPs)))
+
+		if dir != "" {
+			if err := writeReport(dir, report); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				slog.ErrorContext(ctx, "Failed to write report", "error", err)
+			}
+		}
+		if webhook != nil {
+			if err := webhook.Send(ctx, report); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				slog.ErrorContext(ctx, "Failed to post report", "error", err)
+			}
+		}
+
+		alert := report.Alert()
+		for _, notifier := range notifiers {
+			notifyCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := notifier.Notify(notifyCtx, alert); err != nil {
+				span.RecordError(err)
+				slog.ErrorContext(ctx, "Failed to send report", "notifier", notifier.Name(), "error", err)
+			}
+			cancel()
+		}
+
+		span.End()
+	}
+}
+
+// reportNotifiers picks the notifiers named in names. Reports are sent
+// whatever the minimum severity of their alerts.
+func reportNotifiers(notifiers []Notifier, names []string) []Notifier {
+	var selected []Notifier
+	for _, notifier := range notifiers {
+		for _, name := range names {
+			if notifier.Name() != name {
+				continue
+			}
+			if filter, ok := notifier.(severityFilter); ok {
+				notifier = filter.Notifier
+			}
+			selected = append(selected, notifier)
+		}
+	}
+
+	return selected
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/marceloalmeida/ssh-honeypot/enrich"
+)
+
+// annotateAbuseIPDB attaches the AbuseIPDB report of the source IP to
+// events. Events are stored without it when the lookup fails.
+func annotateAbuseIPDB(abuseIPDB *enrich.AbuseIPDB) EventAnnotator {
+	return func(ctx context.Context, event *Event) {
+		report, err := abuseIPDB.Check(ctx, event.SSHInfo.RemoteHost)
+		if errors.Is(err, enrich.ErrAbuseIPDBQuota) {
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to get AbuseIPDB report", "remote_host", event.SSHInfo.RemoteHost, "error", err)
+			return
+		}
+
+		event.Analysis.Abuse = &report
+	}
+}
+
+// annotateGreyNoise tags events with the GreyNoise classification and actor
+// of the source IP. Events are stored without them when the lookup fails.
+func annotateGreyNoise(greyNoise *enrich.GreyNoise) EventAnnotator {
+	return func(ctx context.Context, event *Event) {
+		report, err := greyNoise.Check(ctx, event.SSHInfo.RemoteHost)
+		if errors.Is(err, enrich.ErrGreyNoiseRateLimited) {
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to get GreyNoise report", "remote_host", event.SSHInfo.RemoteHost, "error", err)
+			return
+		}
+
+		event.Analysis.GreyNoise = &report
+	}
+}
+
+// annotateVirusTotal attaches the VirusTotal report of the source IP to
+// events. Events are stored without it when the lookup fails or is over
+// quota.
+func annotateVirusTotal(virusTotal *enrich.VirusTotal) EventAnnotator {
+	return func(ctx context.Context, event *Event) {
+		report, err := virusTotal.Check(ctx, event.SSHInfo.RemoteHost)
+		if errors.Is(err, enrich.ErrVirusTotalQuota) {
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to get VirusTotal report", "remote_host", event.SSHInfo.RemoteHost, "error", err)
+			return
+		}
+
+		event.Analysis.VirusTotal = &report
+	}
+}
+
+// annotateDNSBL records the blocklists the source IP is listed on in events.
+// The listings of the zones that answered are kept when others fail.
+func annotateDNSBL(dnsbl *enrich.DNSBL) EventAnnotator {
+	return func(ctx context.Context, event *Event) {
+		zones, err := dnsbl.Check(ctx, event.SSHInfo.RemoteHost)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to check DNS blocklists", "remote_host", event.SSHInfo.RemoteHost, "error", err)
+		}
+
+		event.Analysis.DNSBL = strings.Join(zones, ",")
+	}
+}
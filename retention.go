@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetentionTarget is a store the retention manager deletes old data from.
+type RetentionTarget interface {
+	Name() string
+	Enforce(ctx context.Context, before time.Time) error
+}
+
+// influxRetention deletes the points of the honeypot's measurements through
+// the InfluxDB delete API.
+type influxRetention struct {
+	deleteAPI    api.DeleteAPI
+	org          string
+	bucket       string
+	measurements []string
+}
+
+func (r influxRetention) Name() string {
+	return "influxdb"
+}
+
+func (r influxRetention) Enforce(ctx context.Context, before time.Time) error {
+	for _, measurement := range r.measurements {
+		predicate := fmt.Sprintf(`_measurement="%s"`, measurement)
+		if err := r.deleteAPI.DeleteWithName(ctx, r.org, r.bucket, time.Unix(0, 0), before, predicate); err != nil {
+			return fmt.Errorf("failed to delete '%s' points: %v", measurement, err)
+		}
+	}
+
+	return nil
+}
+
+// fileRetention deletes the files of a directory last modified before the
+// cutoff.
+type fileRetention struct {
+	dir string
+}
+
+func (r fileRetention) Name() string {
+	return "files:" + r.dir
+}
+
+func (r fileRetention) Enforce(ctx context.Context, before time.Time) error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(before) {
+			if err := os.Remove(filepath.Join(r.dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RetentionManager periodically deletes data older than maxAge from every
+// target.
+type RetentionManager struct {
+	maxAge  time.Duration
+	targets []RetentionTarget
+	tracer  trace.Tracer
+}
+
+func NewRetentionManager(maxAge time.Duration, tracer trace.Tracer) *RetentionManager {
+	return &RetentionManager{
+		maxAge: maxAge,
+		tracer: tracer,
+	}
+}
+
+func (m *RetentionManager) Manage(target RetentionTarget) {
+	m.targets = append(m.targets, target)
+}
+
+// Enforce deletes the data older than maxAge from every target, carrying on
+// with the remaining targets when one fails.
+func (m *RetentionManager) Enforce() {
+	before := time.Now().Add(-m.maxAge)
+
+	for _, target := range m.targets {
+		ctx, span := m.tracer.Start(
+			context.Background(),
+			"enforceRetention",
+			trace.WithAttributes(attribute.String("target", target.Name())))
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		err := target.Enforce(ctx, before)
+		cancel()
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.ErrorContext(ctx, "Failed to enforce retention", "target", target.Name(), "error", err)
+		} else {
+			span.SetStatus(codes.Ok, fmt.Sprintf("Deleted data older than %s from '%s'", before.Format(time.RFC3339), target.Name()))
+		}
+		span.End()
+	}
+}
+
+func (m *RetentionManager) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.Enforce()
+		<-ticker.C
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"go.uber.org/automaxprocs/maxprocs"
+)
+
+const (
+	cgroupV2MemoryMax   = "/sys/fs/cgroup/memory.max"
+	cgroupV1MemoryLimit = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+)
+
+// tuneRuntime adjusts GOMAXPROCS to the container CPU quota and derives a
+// soft memory limit from the cgroup memory limit, so the process neither
+// over-schedules nor gets OOM-killed under sustained brute-force load.
+//
+// GOGC and GOMEMLIMIT are honoured by the Go runtime itself and always take
+// precedence. When GOMEMLIMIT is not set, MEMORY_LIMIT_RATIO (default 0.9)
+// of the cgroup memory limit is used as the soft limit.
+func tuneRuntime() func() {
+	undo, err := maxprocs.Set(maxprocs.Logger(func(format string, args ...any) {
+		slog.Info(fmt.Sprintf(format, args...))
+	}))
+	if err != nil {
+		slog.Warn("Failed to set GOMAXPROCS", "error", err)
+	}
+
+	if os.Getenv("GOMEMLIMIT") == "" {
+		ratio := 0.9
+		if value := os.Getenv("MEMORY_LIMIT_RATIO"); value != "" {
+			ratio, err = strconv.ParseFloat(value, 64)
+			if err != nil || ratio <= 0 || ratio > 1 {
+				slog.Warn("Invalid MEMORY_LIMIT_RATIO, must be in (0, 1], using 0.9", "value", value)
+				ratio = 0.9
+			}
+		}
+
+		limit, err := cgroupMemoryLimit()
+		if err != nil {
+			slog.Info("No cgroup memory limit detected, leaving memory limit unset", "error", err)
+		} else {
+			debug.SetMemoryLimit(int64(float64(limit) * ratio))
+		}
+	}
+
+	slog.Info("Runtime settings", "gomaxprocs", runtime.GOMAXPROCS(0), "gogc", gcPercent(), "gomemlimit", memoryLimit())
+
+	return undo
+}
+
+func cgroupMemoryLimit() (uint64, error) {
+	for _, path := range []string{cgroupV2MemoryMax, cgroupV1MemoryLimit} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		value := strings.TrimSpace(string(content))
+		if value == "max" {
+			return 0, fmt.Errorf("%s is unlimited", path)
+		}
+
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse %s: %v", path, err)
+		}
+
+		// cgroup v1 reports a huge page-aligned number when unlimited
+		if limit >= math.MaxInt64/2 {
+			return 0, fmt.Errorf("%s is unlimited", path)
+		}
+
+		return limit, nil
+	}
+
+	return 0, fmt.Errorf("no cgroup memory limit file found")
+}
+
+func gcPercent() string {
+	if value := os.Getenv("GOGC"); value != "" {
+		return value
+	}
+
+	return "100"
+}
+
+func memoryLimit() string {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return "unlimited"
+	}
+
+	return fmt.Sprintf("%dMiB", limit/1024/1024)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// s3Object is a finished archive waiting to be uploaded.
+type s3Object struct {
+	key  string
+	data []byte
+}
+
+// S3ArchiveSink archives events to an S3 compatible bucket as gzip
+// compressed JSON Lines objects. Events are buffered until the object
+// reaches maxSize or is flushInterval old, then uploaded under a key
+// partitioned by the date of its first event, e.g.
+// prefix/year=2024/month=01/day=02/node-20240102T150405Z-1.jsonl.gz.
+// Writes only buffer, uploads failing are retried on the next flush.
+type S3ArchiveSink struct {
+	client        *minio.Client
+	bucket        string
+	prefix        string
+	maxSize       int
+	flushInterval time.Duration
+	tracer        trace.Tracer
+
+	mu       sync.Mutex
+	buffer   *bytes.Buffer
+	gzip     *gzip.Writer
+	first    time.Time
+	events   int
+	sequence int
+	pending  []s3Object
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewS3ArchiveSink(endpoint string, bucket string, prefix string, region string, accessKey string, secretKey string, useSSL bool, maxSize int, flushInterval time.Duration, tracer trace.Tracer) (*S3ArchiveSink, error) {
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("invalid flush interval %s", flushInterval)
+	}
+
+	creds := credentials.NewStaticV4(accessKey, secretKey, "")
+	if accessKey == "" {
+		// The AWS environment, shared credentials file or instance role
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{Creds: creds, Secure: useSSL, Region: region})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &S3ArchiveSink{
+		client:        client,
+		bucket:        bucket,
+		prefix:        prefix,
+		maxSize:       maxSize,
+		flushInterval: flushInterval,
+		tracer:        tracer,
+		flush:         make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+func s3ArchiveSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	return NewS3ArchiveSink(getEnv("S3_ENDPOINT", "s3.amazonaws.com"), bucket, getEnv("S3_PREFIX", "ssh-honeypot"), os.Getenv("S3_REGION"),
+		os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), getEnv("S3_USE_SSL", "true") == "true",
+		getEnvInt("S3_MAX_OBJECT_SIZE", 10<<20), getEnvDuration("S3_FLUSH_INTERVAL", time.Hour), tracer)
+}
+
+func (s *S3ArchiveSink) Name() string {
+	return "s3"
+}
+
+func (s *S3ArchiveSink) Write(ctx context.Context, batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.gzip == nil {
+		s.buffer = &bytes.Buffer{}
+		s.gzip = gzip.NewWriter(s.buffer)
+	}
+
+	encoder := json.NewEncoder(s.gzip)
+	for _, event := range batch.Events {
+		document := newEventDocument(event)
+		if s.events == 0 {
+			s.first = document.Timestamp
+		}
+		if err := encoder.Encode(document); err != nil {
+			return err
+		}
+		s.events++
+	}
+
+	if s.buffer.Len() >= s.maxSize {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (s *S3ArchiveSink) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			s.upload()
+			return
+		case <-ticker.C:
+		case <-s.flush:
+		}
+		s.upload()
+	}
+}
+
+// finish closes the object being written, queuing it for upload.
+func (s *S3ArchiveSink) finish() {
+	if s.events == 0 {
+		return
+	}
+
+	if err := s.gzip.Close(); err != nil {
+		slog.Error("Failed to compress archive, dropping it", "events", s.events, "error", err)
+	} else {
+		s.sequence++
+		key := fmt.Sprintf("%s/year=%s/month=%s/day=%s/%s-%s-%d.jsonl.gz", s.prefix,
+			s.first.Format("2006"), s.first.Format("01"), s.first.Format("02"),
+			node.ID, time.Now().UTC().Format("20060102T150405Z"), s.sequence)
+		s.pending = append(s.pending, s3Object{key: key, data: s.buffer.Bytes()})
+	}
+
+	s.buffer, s.gzip, s.events = nil, nil, 0
+}
+
+func (s *S3ArchiveSink) upload() {
+	s.mu.Lock()
+	s.finish()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	for i, object := range pending {
+		if err := s.put(object); err != nil {
+			slog.Error("Failed to upload archive, retrying on next flush", "key", object.key, "error", err)
+			s.mu.Lock()
+			s.pending = append(pending[i:], s.pending...)
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *S3ArchiveSink) put(object s3Object) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	ctx, span := s.tracer.Start(
+		ctx,
+		"uploadArchive",
+		trace.WithAttributes(
+			attribute.String("key", object.key),
+			attribute.Int("size", len(object.data))))
+	defer span.End()
+
+	_, err := s.client.PutObject(ctx, s.bucket, object.key, bytes.NewReader(object.data), int64(len(object.data)), minio.PutObjectOptions{
+		ContentType: "application/gzip",
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, "Uploaded archive")
+	return nil
+}
+
+// Close uploads what is buffered.
+func (s *S3ArchiveSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) > 0 {
+		return fmt.Errorf("%d archives could not be uploaded", len(s.pending))
+	}
+
+	return nil
+}
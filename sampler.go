@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newSampler returns the sampler named as by OTEL_TRACES_SAMPLER, with arg
+// the OTEL_TRACES_SAMPLER_ARG, the ratio of traces sampled by the
+// traceidratio samplers, 1 by default. The parentbased samplers follow the
+// decision of the parent span, only sampling root spans themselves, and
+// those are capped to perSecond traces a second unless it's 0.
+func newSampler(name string, arg string, perSecond int) (sdktrace.Sampler, error) {
+	var root sdktrace.Sampler
+	base, parentBased := strings.CutPrefix(name, "parentbased_")
+	switch base {
+	case "always_on":
+		root = sdktrace.AlwaysSample()
+	case "always_off":
+		root = sdktrace.NeverSample()
+	case "traceidratio":
+		ratio := 1.0
+		if arg != "" {
+			var err error
+			if ratio, err = strconv.ParseFloat(arg, 64); err != nil || ratio < 0 || ratio > 1 {
+				return nil, fmt.Errorf("invalid sampling ratio '%s', expected a number between 0 and 1", arg)
+			}
+		}
+		root = sdktrace.TraceIDRatioBased(ratio)
+	default:
+		return nil, fmt.Errorf("unknown sampler '%s'", name)
+	}
+
+	if perSecond > 0 {
+		root = &rateLimitSampler{sampler: root, perSecond: perSecond}
+	}
+	if parentBased {
+		return sdktrace.ParentBased(root), nil
+	}
+	return root, nil
+}
+
+// rateLimitSampler samples up to perSecond of the traces sampler samples
+// every second, so the trace volume stays bounded however busy the honeypot
+// gets.
+type rateLimitSampler struct {
+	sampler   sdktrace.Sampler
+	perSecond int
+
+	mu      sync.Mutex
+	second  time.Time
+	sampled int
+}
+
+func (s *rateLimitSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	result := s.sampler.ShouldSample(p)
+	if result.Decision == sdktrace.RecordAndSample && !s.allow() {
+		return sdktrace.SamplingResult{
+			Decision:   sdktrace.Drop,
+			Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+		}
+	}
+
+	return result
+}
+
+func (s *rateLimitSampler) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.second) >= time.Second {
+		s.second = now
+		s.sampled = 0
+	}
+	if s.sampled >= s.perSecond {
+		return false
+	}
+	s.sampled++
+	return true
+}
+
+func (s *rateLimitSampler) Description() string {
+	return fmt.Sprintf("RateLimitSampler{%s,%d/s}", s.sampler.Description(), s.perSecond)
+}
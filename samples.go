@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// errSampleStoreFull is returned when a sample would take the store past its
+// maximum size.
+var errSampleStoreFull = errors.New("sample store full")
+
+// SampleStore keeps the files attackers upload over SFTP or scp, write from
+// the shell or download, in dir, each named by its SHA256 so a sample dropped
+// by many attackers is kept once. New samples are refused once they would
+// take it past maxSize bytes, if set, the ones kept being left in place.
+type SampleStore struct {
+	dir     string
+	maxSize int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+func NewSampleStore(dir string, maxSize int64) (*SampleStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	// Counting the samples kept by previous runs
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		size += info.Size()
+	}
+	if maxSize > 0 && size >= maxSize {
+		slog.Warn("Sample store full, new samples won't be kept", "dir", dir, "size", size, "max_size", maxSize)
+	}
+
+	return &SampleStore{dir: dir, maxSize: maxSize, size: size}, nil
+}
+
+// sampleStoreFromEnv returns nil unless SAMPLE_DIR is set, or DOWNLOAD_DIR,
+// its former name, or DOWNLOAD_FETCH, fetched payloads being quarantined in
+// ./quarantine then.
+func sampleStoreFromEnv() (*SampleStore, error) {
+	dir := getEnv("SAMPLE_DIR", os.Getenv("DOWNLOAD_DIR"))
+	if dir == "" && os.Getenv("DOWNLOAD_FETCH") == "true" {
+		dir = "quarantine"
+	}
+	if dir == "" {
+		return nil, nil
+	}
+
+	return NewSampleStore(dir, int64(getEnvInt("SAMPLE_DIR_MAX_SIZE", 1<<30)))
+}
+
+// Path returns the path of the sample of the given SHA256.
+func (s *SampleStore) Path(hash string) string {
+	return filepath.Join(s.dir, hash)
+}
+
+// Save stores data unless already in the store, returning its SHA256 and
+// whether it was, or errSampleStoreFull when there's no room left for it.
+func (s *SampleStore) Save(data []byte) (string, bool, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := s.Path(hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return hash, true, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return hash, false, err
+	}
+	if s.maxSize > 0 && s.size+int64(len(data)) > s.maxSize {
+		return hash, false, errSampleStoreFull
+	}
+
+	// Written aside first, so the store never holds partial samples
+	tmp, err := os.CreateTemp(s.dir, ".sample-*")
+	if err != nil {
+		return hash, false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return hash, false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return hash, false, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return hash, false, err
+	}
+	s.size += int64(len(data))
+
+	return hash, false, nil
+}
+
+// keepSample saves data to the sample store, and captures a "sample" event
+// the first time it is captured over the connection of ctx, with the path it
+// was saved to and the URL it was downloaded from, if any. With a YARA
+// scanner, the event is captured once the sample is scanned, see
+// YaraScanner.ScanSample. A sample the store is too full for is reported
+// all the same, as dropped.
+func (sh *Shell) keepSample(ctx ssh.Context, record *ConnRecord, capture func(SSHInfo) bool, data []byte, path string, url string) {
+	if sh.samples == nil || len(data) == 0 {
+		return
+	}
+
+	hash, duplicate, err := sh.samples.Save(data)
+	dropped := errors.Is(err, errSampleStoreFull)
+	if dropped {
+		slog.Warn("Dropping sample", "sha256", hash, "size", len(data), "error", err)
+	} else if err != nil {
+		slog.Error("Failed to save sample", "sha256", hash, "error", err)
+		return
+	}
+	if !record.newSample(hash) {
+		return
+	}
+
+	sshInfo := newSSHInfo(ctx, "sample")
+	sshInfo.Path = path
+	sshInfo.URL = url
+	sshInfo.FileSize = int64(len(data))
+	sshInfo.FileSHA256 = hash
+	sshInfo.SampleDuplicate = duplicate
+	sshInfo.SampleDropped = dropped
+	metrics.RecordSample(duplicate)
+	if sh.yara == nil || dropped {
+		capture(sshInfo)
+		slog.Info("Sample captured", "remote_host", sshInfo.RemoteHost, "session_id", sshInfo.SessionID, "path", path, "sha256", hash, "size", len(data), "duplicate", duplicate, "dropped", dropped)
+		return
+	}
+
+	sh.yara.ScanSample(hash, sh.samples.Path(hash), func(matches []string, err error) {
+		if errors.Is(err, errYaraBusy) {
+			slog.Warn("Skipping scan of sample", "sha256", hash, "error", err)
+		} else if err != nil {
+			slog.Error("Failed to scan sample", "sha256", hash, "error", err)
+		}
+		for _, rule := range matches {
+			metrics.RecordYaraMatch(rule)
+		}
+		sshInfo.YaraMatches = matches
+		capture(sshInfo)
+		slog.Info("Sample captured", "remote_host", sshInfo.RemoteHost, "session_id", sshInfo.SessionID, "path", path, "sha256", hash, "size", len(data), "duplicate", duplicate, "yara_matches", matches)
+	})
+}
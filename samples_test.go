@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSampleStoreMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSampleStore(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, duplicate, err := store.Save([]byte("123456"))
+	if err != nil || duplicate {
+		t.Fatalf("Save = %t, %v", duplicate, err)
+	}
+	if _, duplicate, err := store.Save([]byte("123456")); err != nil || !duplicate {
+		t.Errorf("Save of a duplicate = %t, %v", duplicate, err)
+	}
+	if _, _, err := store.Save([]byte("abcdef")); !errors.Is(err, errSampleStoreFull) {
+		t.Errorf("Save past the maximum size = %v", err)
+	}
+	if _, err := os.Stat(store.Path(hash)); err != nil {
+		t.Error(err)
+	}
+
+	// The samples kept are counted again
+	store, err = NewSampleStore(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Save([]byte("abcde")); !errors.Is(err, errSampleStoreFull) {
+		t.Errorf("Save past the maximum size after a restart = %v", err)
+	}
+	if _, _, err := store.Save([]byte("abcd")); err != nil {
+		t.Error(err)
+	}
+}
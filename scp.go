@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// isSCPSink reports whether args run scp receiving files, as the legacy scp
+// protocol does on the remote side of an upload.
+func isSCPSink(args []string) bool {
+	return len(args) > 1 && args[0] == "scp" && slices.ContainsFunc(args[1:], func(arg string) bool {
+		return strings.HasPrefix(arg, "-") && strings.Contains(arg, "t")
+	})
+}
+
+// serveSCP acts as "scp -t" on s, saving the files uploaded with the legacy
+// scp protocol to the filesystem of the connection, so they are captured
+// like those uploaded over SFTP.
+func (sh *Shell) serveSCP(s ssh.Session, state *shellState, args []string) {
+	err := sh.receiveSCP(state, bufio.NewReader(s), s, state.resolve(args[len(args)-1]))
+	if err != nil && !errors.Is(err, io.EOF) {
+		slog.Debug("SCP upload failed", "remote_host", state.from, "error", err)
+		fmt.Fprintf(s, "\x01scp: %v\n", err)
+		s.Exit(1)
+		return
+	}
+	s.Exit(0)
+}
+
+// receiveSCP answers the control lines of the client until it is done,
+// creating the directories it sends with -r and writing its files in them.
+func (sh *Shell) receiveSCP(state *shellState, r *bufio.Reader, w io.Writer, target string) error {
+	// A target that is a directory gets the files in it, as do directories
+	// sent by the client
+	dirs := []string{}
+	if node, err := state.fs.Stat(target); err == nil && node.isDir() {
+		dirs = append(dirs, target)
+	}
+
+	if _, err := w.Write([]byte{0}); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("protocol error: empty control line")
+		}
+
+		switch line[0] {
+		case 'T':
+			// Times are ignored
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("protocol error: unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+		case 'C', 'D':
+			fields := strings.SplitN(line[1:], " ", 3)
+			if len(fields) != 3 || strings.Contains(fields[2], "/") {
+				return fmt.Errorf("protocol error: bad control line")
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || size < 0 {
+				return fmt.Errorf("protocol error: bad size")
+			}
+
+			name := target
+			if len(dirs) > 0 {
+				name = path.Join(dirs[len(dirs)-1], fields[2])
+			}
+			if line[0] == 'D' {
+				if err := state.fs.Mkdir(name, state.user); err != nil && !errors.Is(err, fs.ErrExist) {
+					return fmt.Errorf("%s: %s", name, fsErrorText(err))
+				}
+				dirs = append(dirs, name)
+				break
+			}
+
+			if quota := state.fs.quota; quota > 0 && size > quota {
+				return fmt.Errorf("%s: %v", name, errNoSpace)
+			}
+			if _, err := w.Write([]byte{0}); err != nil {
+				return err
+			}
+			// The content is followed by a null byte
+			data := make([]byte, size+1)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if err := state.fs.WriteFile(name, data[:size], false, state.user); err != nil {
+				return fmt.Errorf("%s: %s", name, fsErrorText(err))
+			}
+		default:
+			return fmt.Errorf("protocol error: unknown control line")
+		}
+
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+}
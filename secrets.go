@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// secretEnvs are the settings that can be read from a file named by the same
+// variable suffixed with _FILE, as Docker and Kubernetes mount secrets.
+var secretEnvs = []string{
+	"ABUSEIPDB_API_KEY",
+	"ALERT_HONEYTOKENS",
+	"ANONYMIZE_SALT",
+	"API_TOKEN",
+	"CLICKHOUSE_PASSWORD",
+	"DISCORD_WEBHOOK_URL",
+	"DSHIELD_API_KEY",
+	"ELASTICSEARCH_API_KEY",
+	"ELASTICSEARCH_PASSWORD",
+	"FLEET_TOKEN",
+	"GRAFANA_API_KEY",
+	"GREYNOISE_API_KEY",
+	"HPFEEDS_SECRET",
+	"INFLUXDB_PASSWORD",
+	"INFLUXDB_TOKEN",
+	"IPINFOIO_TOKEN",
+	"KAFKA_PASSWORD",
+	"LOKI_PASSWORD",
+	"MISP_API_KEY",
+	"MQTT_PASSWORD",
+	"NTFY_TOKEN",
+	"OPSGENIE_API_KEY",
+	"OTEL_EXPORTER_OTLP_HEADERS",
+	"PAGERDUTY_ROUTING_KEY",
+	"POSTGRES_DSN",
+	"PUSHOVER_APP_TOKEN",
+	"PUSHOVER_USER_KEY",
+	"S3_ACCESS_KEY",
+	"S3_SECRET_KEY",
+	"SLACK_WEBHOOK_URL",
+	"SMTP_PASSWORD",
+	"TEAMS_WEBHOOK_URL",
+	"TAXII_PASSWORD",
+	"TELEGRAM_BOT_TOKEN",
+	"VIRUSTOTAL_API_KEY",
+	"WEBHOOK_SECRET",
+}
+
+// SecretFiles reads the secrets given as files into the environment,
+// remembering when the files were modified to tell when they're rotated.
+type SecretFiles struct {
+	modTimes map[string]time.Time
+}
+
+func NewSecretFiles() *SecretFiles {
+	return &SecretFiles{modTimes: map[string]time.Time{}}
+}
+
+// Load sets every secret with a _FILE variable to the content of the file,
+// without its trailing newline.
+func (s *SecretFiles) Load() error {
+	for _, key := range secretEnvs {
+		path := os.Getenv(key + "_FILE")
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %v", key, err)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %v", key, err)
+		}
+		os.Setenv(key, strings.TrimRight(string(content), "\r\n"))
+		s.modTimes[path] = info.ModTime()
+	}
+
+	return nil
+}
+
+// Changed reports whether any secret file was modified since it was loaded.
+func (s *SecretFiles) Changed() bool {
+	for path, modTime := range s.modTimes {
+		info, err := os.Stat(path)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+
+	return false
+}
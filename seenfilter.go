@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const seenFilterMagic = uint32(0x53454e31) // "SEN1"
+
+// SeenFilter is a persistent, time-windowed bloom filter of IPs that were
+// already fully enriched. It is made of two generations: lookups consult
+// both, insertions go to the current one, and every window the current
+// generation becomes the previous one. An IP is therefore remembered for
+// between one and two windows.
+type SeenFilter struct {
+	mu       sync.RWMutex
+	path     string
+	window   time.Duration
+	m        uint64
+	k        uint64
+	current  []uint64
+	previous []uint64
+	rotated  time.Time
+	dirty    bool
+}
+
+// NewSeenFilter sizes the filter for capacity entries per window at the given
+// false positive rate, and loads any previous state found at path.
+func NewSeenFilter(path string, window time.Duration, capacity uint64, fpRate float64) (*SeenFilter, error) {
+	if capacity == 0 || fpRate <= 0 || fpRate >= 1 {
+		return nil, fmt.Errorf("invalid seen filter sizing: capacity=%d fp_rate=%f", capacity, fpRate)
+	}
+
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(capacity)*math.Ln2)))
+
+	f := &SeenFilter{
+		path:     path,
+		window:   window,
+		m:        m,
+		k:        k,
+		current:  make([]uint64, m/64),
+		previous: make([]uint64, m/64),
+		rotated:  time.Now(),
+	}
+
+	if path == "" {
+		return f, nil
+	}
+
+	err := f.load()
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		slog.Warn("Discarding seen IP filter state", "path", path, "error", err)
+	}
+
+	return f, nil
+}
+
+func (f *SeenFilter) Contains(ip string) bool {
+	f.rotateIfDue()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.test(f.current, ip) || f.test(f.previous, ip)
+}
+
+func (f *SeenFilter) Add(ip string) {
+	f.rotateIfDue()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	h1, h2 := f.hashes(ip)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.current[bit/64] |= 1 << (bit % 64)
+	}
+	f.dirty = true
+}
+
+func (f *SeenFilter) test(bits []uint64, ip string) bool {
+	h1, h2 := f.hashes(ip)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *SeenFilter) hashes(ip string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(ip))
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	h2 := h.Sum64() | 1
+
+	return h1, h2
+}
+
+func (f *SeenFilter) rotateIfDue() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.rotated) < f.window {
+		return
+	}
+
+	// More than two windows elapsed, e.g. while the process was down
+	if time.Since(f.rotated) >= 2*f.window {
+		clear(f.current)
+	}
+
+	f.previous, f.current = f.current, f.previous
+	clear(f.current)
+	f.rotated = time.Now()
+	f.dirty = true
+}
+
+// Save atomically writes the filter state to disk if it changed since the
+// last save.
+func (f *SeenFilter) Save() error {
+	if f.path == "" {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.dirty {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	header := []uint64{uint64(seenFilterMagic), f.m, f.k, uint64(f.rotated.Unix())}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		tmp.Close()
+		return err
+	}
+	for _, bits := range [][]uint64{f.current, f.previous} {
+		if err := binary.Write(w, binary.LittleEndian, bits); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+
+	f.dirty = false
+	return nil
+}
+
+func (f *SeenFilter) load() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]uint64, 4)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	if header[0] != uint64(seenFilterMagic) {
+		return fmt.Errorf("not a seen IP filter file")
+	}
+	if header[1] != f.m || header[2] != f.k {
+		return fmt.Errorf("filter sizing changed (m=%d k=%d, want m=%d k=%d)", header[1], header[2], f.m, f.k)
+	}
+
+	current := make([]uint64, f.m/64)
+	previous := make([]uint64, f.m/64)
+	if err := binary.Read(r, binary.LittleEndian, current); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, previous); err != nil {
+		return err
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("trailing data in filter file")
+	}
+
+	f.current = current
+	f.previous = previous
+	f.rotated = time.Unix(int64(header[3]), 0)
+
+	slog.Info("Loaded seen IP filter", "path", f.path)
+	return nil
+}
+
+// persistSeenFilter saves the filter every interval for the lifetime of the
+// process.
+func persistSeenFilter(f *SeenFilter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := f.Save(); err != nil {
+			slog.Error("Failed to save seen IP filter", "error", err)
+		}
+	}
+}
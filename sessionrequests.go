@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Bounds the environment variables recorded per session.
+const maxSessionEnv = 64
+
+// observedChannel hands the requests of a channel to observe before whoever
+// accepted it handles them, to record the requests gliderlabs/ssh denies or
+// keeps to itself, and counts its traffic in record.
+type observedChannel struct {
+	gossh.NewChannel
+	observe func(*gossh.Request)
+	record  *ConnRecord
+}
+
+func (c observedChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	channel, requests, err := c.NewChannel.Accept()
+	if err != nil {
+		return channel, requests, err
+	}
+	channel = countedChannel{Channel: channel, record: c.record}
+
+	observed := make(chan *gossh.Request)
+	go func() {
+		defer close(observed)
+		for req := range requests {
+			c.observe(req)
+			observed <- req
+		}
+	}()
+
+	return channel, observed, nil
+}
+
+// sessionChannelHandler serves session channels as gliderlabs/ssh does,
+// recording their requests along the way.
+func sessionChannelHandler(capture func(SSHInfo) bool) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		observer := &sessionObserver{ctx: ctx, srv: srv, capture: capture}
+		record := getConnRecord(ctx)
+		if record.openChannel() {
+			go captureSessionEnd(ctx, record, capture)
+		}
+		ssh.DefaultSessionHandler(srv, conn, observedChannel{NewChannel: newChan, observe: observer.observe, record: record}, ctx)
+	}
+}
+
+// captureSessionEnd captures a session_end event once the connection of ctx
+// is closed, with how long it lasted and the traffic of its session
+// channels.
+func captureSessionEnd(ctx ssh.Context, record *ConnRecord, capture func(SSHInfo) bool) {
+	<-ctx.Done()
+
+	sshInfo := newSSHInfo(ctx, "session_end")
+	sshInfo.Duration = time.Since(record.createdAt)
+	sshInfo.Channels, sshInfo.BytesIn, sshInfo.BytesOut = record.SessionTraffic()
+	capture(sshInfo)
+	metrics.RecordSessionEnd(sshInfo.Duration, sshInfo.BytesIn, sshInfo.BytesOut)
+	slog.Info("Session ended", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "duration", sshInfo.Duration,
+		"channels", sshInfo.Channels, "bytes_in", sshInfo.BytesIn, "bytes_out", sshInfo.BytesOut)
+}
+
+// countedChannel counts the bytes read from and written to a session
+// channel, its standard error included.
+type countedChannel struct {
+	gossh.Channel
+	record *ConnRecord
+}
+
+func (c countedChannel) Read(data []byte) (int, error) {
+	n, err := c.Channel.Read(data)
+	c.record.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c countedChannel) Write(data []byte) (int, error) {
+	n, err := c.Channel.Write(data)
+	c.record.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c countedChannel) Stderr() io.ReadWriter {
+	return countedStderr{ReadWriter: c.Channel.Stderr(), record: c.record}
+}
+
+type countedStderr struct {
+	io.ReadWriter
+	record *ConnRecord
+}
+
+func (s countedStderr) Write(data []byte) (int, error) {
+	n, err := s.ReadWriter.Write(data)
+	s.record.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// sessionObserver records the requests of a session channel.
+type sessionObserver struct {
+	ctx     ssh.Context
+	srv     *ssh.Server
+	capture func(SSHInfo) bool
+
+	// env are the variables set so far, which the session handler gets
+	// too, but only once it runs
+	env []string
+}
+
+func (o *sessionObserver) observe(req *gossh.Request) {
+	ctx, capture := o.ctx, o.capture
+
+	switch req.Type {
+	case "env":
+		var payload struct{ Key, Value string }
+		if err := gossh.Unmarshal(req.Payload, &payload); err == nil && len(o.env) < maxSessionEnv {
+			o.env = append(o.env, payload.Key+"="+payload.Value)
+		}
+	case "subsystem":
+		var payload struct{ Value string }
+		if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+			return
+		}
+		// Those served get a session event from the handler
+		if o.srv.SubsystemHandlers[payload.Value] != nil || o.srv.SubsystemHandlers["default"] != nil {
+			return
+		}
+
+		sshInfo := newSSHInfo(ctx, "session")
+		sshInfo.Subsystem = payload.Value
+		sshInfo.Env = o.env
+		sshInfo.Signals = getConnRecord(ctx).TimingSignals()
+		capture(sshInfo)
+		slog.Info("Refused subsystem", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "subsystem", payload.Value)
+	case "pty-req":
+		var payload struct {
+			Term                      string
+			Columns, Rows             uint32
+			WidthPixels, HeightPixels uint32
+			Modes                     string
+		}
+		if err := gossh.Unmarshal(req.Payload, &payload); err == nil {
+			getConnRecord(ctx).setPtyModes(terminalModes([]byte(payload.Modes)))
+		}
+	case "x11-req":
+		// Denied, as the session doesn't handle it
+		var payload struct {
+			SingleConnection bool
+			AuthProtocol     string
+			AuthCookie       string
+			Screen           uint32
+		}
+		if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+			return
+		}
+
+		record := getConnRecord(ctx)
+		record.recordX11Request()
+		sshInfo := newSSHInfo(ctx, "x11")
+		sshInfo.X11AuthProtocol = payload.AuthProtocol
+		sshInfo.X11AuthCookie = payload.AuthCookie
+		sshInfo.X11Screen = strconv.FormatUint(uint64(payload.Screen), 10)
+		sshInfo.Signals = record.TimingSignals()
+		capture(sshInfo)
+		slog.Info("Denied X11 forwarding", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "auth_protocol", payload.AuthProtocol)
+	}
+}
+
+// terminalModeNames are the names of the encoded terminal modes of RFC 4254.
+var terminalModeNames = map[byte]string{
+	1: "VINTR", 2: "VQUIT", 3: "VERASE", 4: "VKILL", 5: "VEOF", 6: "VEOL", 7: "VEOL2", 8: "VSTART", 9: "VSTOP",
+	10: "VSUSP", 11: "VDSUSP", 12: "VREPRINT", 13: "VWERASE", 14: "VLNEXT", 15: "VFLUSH", 16: "VSWTCH", 17: "VSTATUS",
+	18: "VDISCARD", 30: "IGNPAR", 31: "PARMRK", 32: "INPCK", 33: "ISTRIP", 34: "INLCR", 35: "IGNCR", 36: "ICRNL",
+	37: "IUCLC", 38: "IXON", 39: "IXANY", 40: "IXOFF", 41: "IMAXBEL", 42: "IUTF8", 50: "ISIG", 51: "ICANON",
+	52: "XCASE", 53: "ECHO", 54: "ECHOE", 55: "ECHOK", 56: "ECHONL", 57: "NOFLSH", 58: "TOSTOP", 59: "IEXTEN",
+	60: "ECHOCTL", 61: "ECHOKE", 62: "PENDIN", 70: "OPOST", 71: "OLCUC", 72: "ONLCR", 73: "OCRNL", 74: "ONOCR",
+	75: "ONLRET", 90: "CS7", 91: "CS8", 92: "PARENB", 93: "PARODD", 128: "TTY_OP_ISPEED", 129: "TTY_OP_OSPEED",
+}
+
+// terminalModes formats encoded terminal modes as "NAME=value" pairs in the
+// order the client sent them, unknown opcodes by their number.
+func terminalModes(encoded []byte) string {
+	var modes []string
+	for len(encoded) >= 5 && encoded[0] != 0 && encoded[0] < 160 {
+		name, ok := terminalModeNames[encoded[0]]
+		if !ok {
+			name = strconv.Itoa(int(encoded[0]))
+		}
+		modes = append(modes, name+"="+strconv.FormatUint(uint64(binary.BigEndian.Uint32(encoded[1:5])), 10))
+		encoded = encoded[5:]
+	}
+
+	return strings.Join(modes, " ")
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// ServeSFTP serves the SFTP subsystem on s over the filesystem of the
+// connection, which its shell sessions share, so uploads are captured as
+// "file" events like the changes made from the shell.
+func (sh *Shell) ServeSFTP(s ssh.Session, record *ConnRecord, capture func(SSHInfo) bool) {
+	state := sh.newState(s, record, capture)
+	handler := &sftpHandler{state: state, ids: map[string]uint32{"root": 0}}
+	if state.user != "root" {
+		handler.ids[state.user] = 1000
+	}
+
+	server := sftp.NewRequestServer(s, sftp.Handlers{FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler},
+		sftp.WithStartDirectory(state.home))
+	if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+		slog.Debug("SFTP session failed", "remote_host", s.RemoteAddr().String(), "error", err)
+	}
+	server.Close()
+}
+
+// sftpHandler answers SFTP requests from the filesystem view of state, made
+// on behalf of its user. Owners get made-up ids, the user logged in being
+// 1000 as the first user of a Debian host.
+type sftpHandler struct {
+	state *shellState
+
+	mu  sync.Mutex
+	ids map[string]uint32
+}
+
+func (h *sftpHandler) id(name string) uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id, ok := h.ids[name]
+	if !ok {
+		id = uint32(1000 + len(h.ids))
+		h.ids[name] = id
+	}
+
+	return id
+}
+
+func (h *sftpHandler) name(id string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for name, known := range h.ids {
+		if strconv.FormatUint(uint64(known), 10) == id {
+			return name
+		}
+	}
+
+	return id
+}
+
+func (h *sftpHandler) LookupUserName(id string) string {
+	return h.name(id)
+}
+
+func (h *sftpHandler) LookupGroupName(id string) string {
+	return h.name(id)
+}
+
+func (h *sftpHandler) fileInfo(name string, node *fsNode) os.FileInfo {
+	return &sftpFileInfo{name: name, node: node, uid: h.id(node.owner), gid: h.id(node.group)}
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	node, err := h.state.fs.Stat(r.Filepath)
+	switch {
+	case err != nil:
+		return nil, err
+	case node.isDir():
+		return nil, errIsDir
+	case !readable(node, h.state.user):
+		return nil, fs.ErrPermission
+	}
+
+	return bytes.NewReader(node.content), nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	flags := r.Pflags()
+	writer := &sftpWriter{handler: h, path: r.Filepath, appending: flags.Append}
+
+	node, err := h.state.fs.Stat(r.Filepath)
+	switch {
+	case err == nil && node.isDir():
+		return nil, errIsDir
+	case err == nil && !flags.Trunc && !flags.Append:
+		// Written in place, what isn't overwritten is kept
+		writer.data = append([]byte(nil), node.content...)
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	files, user := h.state.fs, h.state.user
+
+	switch r.Method {
+	case "Setstat":
+		if !r.AttrFlags().Permissions {
+			return nil
+		}
+		mode := r.Attributes().Mode
+		perm := fs.FileMode(mode) & fs.ModePerm
+		if mode&0o1000 != 0 {
+			perm |= fs.ModeSticky
+		}
+		return files.Chmod(r.Filepath, perm, user)
+	case "Rename", "PosixRename":
+		return files.Rename(r.Filepath, r.Target, user)
+	case "Mkdir":
+		return files.Mkdir(r.Filepath, user)
+	case "Rmdir", "Remove":
+		node, err := files.Stat(r.Filepath)
+		switch {
+		case err != nil:
+			return err
+		case r.Method == "Rmdir" && !node.isDir():
+			return errNotDir
+		case r.Method == "Remove" && node.isDir():
+			return errIsDir
+		}
+		return files.Remove(r.Filepath, false, user)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	node, err := h.state.fs.Stat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		if !node.isDir() {
+			return nil, errNotDir
+		}
+		if !readable(node, h.state.user) {
+			return nil, fs.ErrPermission
+		}
+		entries, err := h.state.fs.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		infos := make(sftpLister, len(entries))
+		for i, entry := range entries {
+			infos[i] = h.fileInfo(entry.name, entry.node)
+		}
+		return infos, nil
+	case "Stat":
+		return sftpLister{h.fileInfo(path.Base(r.Filepath), node)}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpWriter collects an upload, written to the filesystem once the client
+// closes the file.
+type sftpWriter struct {
+	handler   *sftpHandler
+	path      string
+	appending bool
+
+	mu   sync.Mutex
+	data []byte
+}
+
+func (w *sftpWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	end := off + int64(len(p))
+	if quota := w.handler.state.fs.quota; quota > 0 && end > quota {
+		return 0, errNoSpace
+	}
+	if end > int64(len(w.data)) {
+		w.data = append(w.data, make([]byte, end-int64(len(w.data)))...)
+	}
+
+	return copy(w.data[off:], p), nil
+}
+
+func (w *sftpWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.handler.state.fs.WriteFile(w.path, w.data, w.appending, w.handler.state.user)
+}
+
+// sftpFileInfo describes a node to SFTP clients.
+type sftpFileInfo struct {
+	name     string
+	node     *fsNode
+	uid, gid uint32
+}
+
+func (i *sftpFileInfo) Name() string       { return i.name }
+func (i *sftpFileInfo) Size() int64        { return i.node.Size() }
+func (i *sftpFileInfo) Mode() fs.FileMode  { return i.node.mode }
+func (i *sftpFileInfo) ModTime() time.Time { return i.node.modTime }
+func (i *sftpFileInfo) IsDir() bool        { return i.node.isDir() }
+func (i *sftpFileInfo) Sys() any           { return nil }
+func (i *sftpFileInfo) Uid() uint32        { return i.uid }
+func (i *sftpFileInfo) Gid() uint32        { return i.gid }
+
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gliderlabs/ssh"
+	cache "github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/term"
+)
+
+// Shell emulates an interactive shell for attackers that got in, recording
+// every command line they enter, over a fake filesystem of the host
+// described by persona.
+type Shell struct {
+	persona     *Persona
+	credentials [][2]string
+	fileSystem  *FileSystem
+	// downloader fetches the payloads of download commands, which are only
+	// recorded when nil
+	downloader *Downloader
+	// samples keeps the files written or downloaded, which are only hashed
+	// when nil
+	samples *SampleStore
+	// yara scans the samples, attaching the rules they match to their
+	// events, unless nil
+	yara *YaraScanner
+
+	// With acceptAfter set, the acceptAfter-th password attempt of a source
+	// IP is accepted whatever the credential, which is the only one
+	// accepted from it afterwards, until window passes without attempts.
+	acceptAfter int
+	mu          sync.Mutex
+	logins      *cache.Cache
+}
+
+// shellLogin tracks the password attempts of a source IP.
+type shellLogin struct {
+	attempts int
+	user     string
+	password string
+}
+
+// NewShell creates a shell for the host of persona accepting the given "user:password"
+// credentials, either side being a glob pattern, e.g. "admin*:*". Unless
+// acceptAfter is 0, the acceptAfter-th attempt of a source IP is also
+// accepted, see Accepts.
+func NewShell(persona *Persona, credentials []string, acceptAfter int, window time.Duration, fileSystem *FileSystem, downloader *Downloader, samples *SampleStore, yara *YaraScanner) *Shell {
+	sh := &Shell{
+		persona:     persona,
+		fileSystem:  fileSystem,
+		downloader:  downloader,
+		samples:     samples,
+		yara:        yara,
+		acceptAfter: acceptAfter,
+		logins:      cache.New(window, window),
+	}
+	for _, credential := range credentials {
+		user, password, _ := strings.Cut(credential, ":")
+		sh.credentials = append(sh.credentials, [2]string{user, password})
+	}
+
+	return sh
+}
+
+func shellFromEnv(persona *Persona, tracer trace.Tracer) (*Shell, error) {
+	fileSystem, err := fileSystemFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	downloader, err := downloaderFromEnv(tracer)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := sampleStoreFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	yara, err := yaraScannerFromEnv(tracer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure YARA scanning: %v", err)
+	}
+	if yara != nil && samples == nil {
+		return nil, fmt.Errorf("YARA_RULES_DIR is set without SAMPLE_DIR")
+	}
+	if err := persona.apply(fileSystem); err != nil {
+		return nil, err
+	}
+
+	acceptAfter := getEnvInt("SHELL_ACCEPT_AFTER", 0)
+	// Everything would be accepted before reaching the threshold otherwise
+	defaultCredentials := "*:*"
+	if acceptAfter > 0 {
+		defaultCredentials = ""
+	}
+
+	return NewShell(persona, splitList(getEnv("SHELL_CREDENTIALS", defaultCredentials)),
+		acceptAfter, getEnvDuration("SHELL_ACCEPT_WINDOW", time.Hour), fileSystem, downloader, samples, yara), nil
+}
+
+// Accepts reports whether the password authentication of user from
+// remoteHost should succeed to let the attacker into the shell. Besides the
+// configured credentials, after acceptAfter attempts the credential being
+// tried is accepted, as if it had finally been guessed, and then sticks:
+// like on a real host, the same credential keeps working and others don't.
+func (sh *Shell) Accepts(remoteHost string, user string, password string) bool {
+	for _, credential := range sh.credentials {
+		if credentialMatch(credential[0], user) && credentialMatch(credential[1], password) {
+			return true
+		}
+	}
+
+	if sh.acceptAfter <= 0 {
+		return false
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	login, ok := sh.logins.Get(remoteHost)
+	if !ok {
+		login = &shellLogin{}
+	}
+	// Set again to extend the window
+	sh.logins.SetDefault(remoteHost, login)
+
+	l := login.(*shellLogin)
+	if l.user != "" {
+		return l.user == user && l.password == password
+	}
+	l.attempts++
+	if l.attempts < sh.acceptAfter {
+		return false
+	}
+	l.user, l.password = user, password
+	slog.Info("Letting attacker in after repeated attempts", "remote_host", remoteHost, "user", user, "attempts", l.attempts)
+
+	return true
+}
+
+// credentialMatch reports whether value matches the glob pattern, "*"
+// matching anything, slashes included.
+func credentialMatch(pattern string, value string) bool {
+	if pattern == "*" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// shellState is what a command can change in a shell session, and what the
+// running command reports besides its output.
+type shellState struct {
+	user string
+	home string
+	cwd  string
+	fs   *FSView
+	// from is where the user logged in from, at login
+	from  string
+	login time.Time
+	// ctx is the context of the session, and capture how its events are
+	// captured
+	ctx     ssh.Context
+	record  *ConnRecord
+	capture func(SSHInfo) bool
+
+	stderr strings.Builder
+	status int
+}
+
+func newShellState(user string, files *FSView) *shellState {
+	state := &shellState{user: user, home: "/home/" + user, fs: files, login: time.Now()}
+	if user == "root" {
+		state.home = "/root"
+	}
+	state.cwd = state.home
+	files.MkdirHome(state.home, user)
+
+	return state
+}
+
+// newState starts the state of the session s of the connection of record.
+func (sh *Shell) newState(s ssh.Session, record *ConnRecord, capture func(SSHInfo) bool) *shellState {
+	state := newShellState(s.User(), sh.view(s.Context(), record, capture))
+	state.from, _ = addrHostPort(s.RemoteAddr())
+	state.ctx, state.record, state.capture = s.Context(), record, capture
+
+	return state
+}
+
+// resolve returns the absolute path of p, relative to the working directory.
+func (state *shellState) resolve(p string) string {
+	switch {
+	case p == "~":
+		return state.home
+	case strings.HasPrefix(p, "~/"):
+		p = state.home + p[1:]
+	case !path.IsAbs(p):
+		p = path.Join(state.cwd, p)
+	}
+
+	return path.Clean(p)
+}
+
+// fail writes an error of the running command to its standard error, and
+// sets the status it exits with.
+func (state *shellState) fail(status int, format string, args ...any) {
+	fmt.Fprintf(&state.stderr, format, args...)
+	state.status = status
+}
+
+// view returns the filesystem of the connection of ctx, capturing a "file"
+// event for each change made to it, and keeping the files written as
+// samples.
+func (sh *Shell) view(ctx ssh.Context, record *ConnRecord, capture func(SSHInfo) bool) *FSView {
+	return record.fileSystem(func() *FSView {
+		return sh.fileSystem.View(func(change FileChange) {
+			sshInfo := newSSHInfo(ctx, "file")
+			sshInfo.FileOperation = change.Operation
+			sshInfo.Path = change.Path
+			sshInfo.FileSize = change.Size
+			sshInfo.FileSHA256 = change.SHA256
+			capture(sshInfo)
+			slog.Info("File changed", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "operation", change.Operation, "path", change.Path)
+			sh.keepSample(ctx, record, capture, change.Content, change.Path, "")
+		})
+	})
+}
+
+// recordingReader registers session input in the connection timing signals
+// as it is read, keeping the keystroke intervals of the line being entered.
+type recordingReader struct {
+	ssh.Session
+	record *ConnRecord
+	line   []time.Duration
+}
+
+func (r *recordingReader) Read(b []byte) (int, error) {
+	n, err := r.Session.Read(b)
+	if n > 0 {
+		intervals := r.record.recordInput(n)
+		r.line = append(r.line, intervals[:min(len(intervals), maxTimingSamples-len(r.line))]...)
+	}
+
+	return n, err
+}
+
+// takeLine returns the keystroke intervals since the last call.
+func (r *recordingReader) takeLine() []time.Duration {
+	line := r.line
+	r.line = nil
+
+	return line
+}
+
+// Run serves the shell on s until the attacker exits or disconnects,
+// capturing each command line as a "command" event.
+func (sh *Shell) Run(s ssh.Session, record *ConnRecord, capture func(SSHInfo) bool) {
+	state := sh.newState(s, record, capture)
+	input := &recordingReader{Session: s, record: record}
+	persona := sh.persona
+	motd := persona.motdText() + fmt.Sprintf("Last login: %s from 10.0.2.2\n", time.Now().Add(-26*time.Hour).Format("Mon Jan _2 15:04:05 2006"))
+	io.WriteString(s, strings.ReplaceAll(motd, "\n", "\r\n"))
+
+	var readLine func() (string, error)
+	var newline string
+	if _, _, isPty := s.Pty(); isPty {
+		terminal := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{input, s}, sh.prompt(state))
+		readLine = func() (string, error) {
+			terminal.SetPrompt(sh.prompt(state))
+			return terminal.ReadLine()
+		}
+		newline = "\r\n"
+	} else {
+		scanner := bufio.NewScanner(input)
+		readLine = func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+		newline = "\n"
+	}
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		sshInfo := newSSHInfo(s.Context(), "command")
+		sshInfo.Command = line
+		sshInfo.Signals = record.TimingSignals()
+		sshInfo.KeystrokeIntervals = input.takeLine()
+		capture(sshInfo)
+		slog.Info("Command", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "command", line)
+
+		output, _, exit := sh.execute(state, line)
+		if output != "" {
+			io.WriteString(s, strings.ReplaceAll(output, "\n", newline))
+		}
+		if exit {
+			return
+		}
+	}
+}
+
+func (sh *Shell) prompt(state *shellState) string {
+	cwd := state.cwd
+	if cwd == state.home {
+		cwd = "~"
+	} else if strings.HasPrefix(cwd, state.home+"/") {
+		cwd = "~" + strings.TrimPrefix(cwd, state.home)
+	}
+
+	sign := "$"
+	if state.user == "root" {
+		sign = "#"
+	}
+
+	if sh.persona.PromptStyle == "redhat" {
+		// The base name of the directory only
+		if cwd != "/" && cwd != "~" {
+			cwd = path.Base(cwd)
+		}
+		return fmt.Sprintf("[%s@%s %s]%s ", state.user, sh.persona.Hostname, cwd, sign)
+	}
+
+	return fmt.Sprintf("%s@%s:%s%s ", state.user, sh.persona.Hostname, cwd, sign)
+}
+
+// stderrRedirect matches the redirections of standard error, which is
+// written to the terminal unless discarded.
+var (
+	stderrDuplicate = regexp.MustCompile(`\s*\d?>&\d-?`)
+	stderrRedirect  = regexp.MustCompile(`\s*2>>?\s*[^\s;&|]+`)
+	stderrDiscard   = regexp.MustCompile(`2>\s*/dev/null`)
+)
+
+// execute returns the output and exit status of a command line, and whether
+// it ends the session. Lists of commands are run one after the other, and
+// the output of a pipeline, which can be redirected to a file, is that of
+// its first command through the text filters that follow, other commands
+// taking it in silently.
+func (sh *Shell) execute(state *shellState, line string) (string, int, bool) {
+	line = stderrDuplicate.ReplaceAllString(strings.ReplaceAll(line, "&>", "2>/dev/null >"), "")
+
+	var output strings.Builder
+	for _, list := range splitUnquoted(line, ";&") {
+		if strings.TrimSpace(list) == "" {
+			continue
+		}
+		discardErrors := stderrDiscard.MatchString(list)
+		list = strings.ReplaceAll(stderrRedirect.ReplaceAllString(list, ""), "$?", strconv.Itoa(state.status))
+		// Only the left side of "||" runs, as if it succeeded
+		pipeline := splitUnquoted(list, "|")
+		if i := slices.Index(pipeline, ""); i > 0 {
+			pipeline = pipeline[:i]
+		}
+		last, target, appending := splitRedirect(pipeline[len(pipeline)-1])
+		pipeline[len(pipeline)-1] = last
+
+		state.stderr.Reset()
+		state.status = 0
+		var result string
+		var exit bool
+		for i, command := range pipeline {
+			switch args := splitWords(command); {
+			case len(args) == 0:
+			case i == 0:
+				result, exit = sh.command(state, args)
+			case textFilters[args[0]]:
+				result = sh.filter(state, args, result)
+			default:
+				result = ""
+			}
+		}
+		if target != "" && target != "/dev/null" {
+			if err := state.fs.WriteFile(state.resolve(target), []byte(result), appending, state.user); err != nil {
+				state.fail(1, "-bash: %s: %s\n", target, fsErrorText(err))
+			}
+		}
+		if target != "" {
+			result = ""
+		}
+
+		if !discardErrors {
+			output.WriteString(state.stderr.String())
+		}
+		output.WriteString(result)
+		if exit {
+			return output.String(), state.status, true
+		}
+	}
+
+	return output.String(), state.status, false
+}
+
+// splitUnquoted splits s around each of the separators found outside of
+// quotes.
+func splitUnquoted(s string, separators string) []string {
+	var parts []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case strings.ContainsRune(separators, r):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// splitRedirect separates a command from the file its output is redirected
+// to, and whether it is appended to the file.
+func splitRedirect(command string) (string, string, bool) {
+	parts := splitUnquoted(command, ">")
+	if len(parts) == 1 {
+		return command, "", false
+	}
+	i := len(parts[0])
+
+	target := command[i+1:]
+	appending := strings.HasPrefix(target, ">")
+	fields := strings.Fields(strings.TrimPrefix(target, ">"))
+	if len(fields) == 0 {
+		return command, "", false
+	}
+
+	return strings.TrimSpace(command[:i]), strings.Trim(fields[0], `"'`), appending
+}
+
+// Exec answers a non-interactive command request with the output the shell
+// would have produced.
+func (sh *Shell) Exec(s ssh.Session, record *ConnRecord, capture func(SSHInfo) bool) {
+	state := sh.newState(s, record, capture)
+	if args := splitWords(s.RawCommand()); isSCPSink(args) {
+		sh.serveSCP(s, state, args)
+		return
+	}
+	output, status, _ := sh.execute(state, s.RawCommand())
+
+	io.WriteString(s, output)
+	s.Exit(status)
+}
+
+// splitWords splits command into words as the shell does, removing the
+// quotes and the backslashes escaping characters outside of them.
+func splitWords(command string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if quote == '"' && r == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words
+}
+
+func (sh *Shell) command(state *shellState, args []string) (string, bool) {
+	persona := sh.persona
+
+	switch args[0] {
+	case "exit", "logout":
+		return "", true
+	case "whoami":
+		return state.user + "\n", false
+	case "id":
+		if state.user == "root" {
+			return "uid=0(root) gid=0(root) groups=0(root)\n", false
+		}
+		return fmt.Sprintf("uid=1000(%[1]s) gid=1000(%[1]s) groups=1000(%[1]s),%[2]s\n", state.user, persona.AdminGroup), false
+	case "hostname":
+		return persona.Hostname + "\n", false
+	case "nproc":
+		return fmt.Sprintf("%d\n", persona.CPUs), false
+	case "lscpu":
+		return persona.lscpu(), false
+	case "free":
+		return sh.free(state, args), false
+	case "uptime":
+		return persona.uptime(time.Now()), false
+	case "w":
+		return sh.w(state, args), false
+	case "pwd":
+		return state.cwd + "\n", false
+	case "cd":
+		sh.cd(state, args)
+		return "", false
+	case "ls", "dir":
+		return sh.ls(state, args), false
+	case "cat":
+		return sh.cat(state, args), false
+	case "touch":
+		sh.touch(state, args)
+		return "", false
+	case "mkdir":
+		sh.mkdir(state, args)
+		return "", false
+	case "rm":
+		sh.rm(state, args)
+		return "", false
+	case "chmod":
+		sh.chmod(state, args)
+		return "", false
+	case "cp", "mv":
+		sh.copyOrMove(state, args)
+		return "", false
+	case "grep", "egrep", "head", "tail", "wc", "sort", "uniq", "cut", "awk":
+		return sh.filter(state, args, ""), false
+	case "echo":
+		return echo(args[1:]), false
+	case "uname":
+		return sh.uname(state, args), false
+	case "wget", "curl", "tftp":
+		return sh.download(state, args), false
+	case "sudo", "su":
+		return "", false
+	}
+
+	state.fail(127, "-bash: %s: command not found\n", args[0])
+	return "", false
+}
+
+// uname prints the fields of the persona selected by the flags, in the
+// order of uname, the processor and hardware platform being unknown.
+func (sh *Shell) uname(state *shellState, args []string) string {
+	persona := sh.persona
+	fields := []struct {
+		flag  byte
+		value string
+	}{
+		{'s', "Linux"},
+		{'n', persona.Hostname},
+		{'r', persona.KernelRelease},
+		{'v', persona.KernelVersion},
+		{'m', persona.Machine},
+		{'p', "unknown"},
+		{'i', "unknown"},
+		{'o', "GNU/Linux"},
+	}
+	long := map[string]byte{"--all": 'a', "--kernel-name": 's', "--nodename": 'n', "--kernel-release": 'r',
+		"--kernel-version": 'v', "--machine": 'm', "--processor": 'p', "--hardware-platform": 'i', "--operating-system": 'o'}
+
+	var flags []byte
+	for _, arg := range args[1:] {
+		if flag, ok := long[arg]; ok {
+			flags = append(flags, flag)
+			continue
+		}
+		if len(arg) < 2 || arg[0] != '-' || strings.HasPrefix(arg, "--") {
+			state.fail(1, "uname: extra operand '%s'\nTry 'uname --help' for more information.\n", arg)
+			return ""
+		}
+		for i := 1; i < len(arg); i++ {
+			if !strings.ContainsRune("asnrvmpio", rune(arg[i])) {
+				state.fail(1, "uname: invalid option -- '%c'\nTry 'uname --help' for more information.\n", arg[i])
+				return ""
+			}
+			flags = append(flags, arg[i])
+		}
+	}
+	if len(flags) == 0 {
+		flags = []byte{'s'}
+	}
+
+	var values []string
+	for _, field := range fields {
+		all := slices.Contains(flags, 'a') && field.value != "unknown"
+		if all || slices.Contains(flags, field.flag) {
+			values = append(values, field.value)
+		}
+	}
+
+	return strings.Join(values, " ") + "\n"
+}
+
+// free prints the memory figures of the persona in KiB, or in the unit of
+// the flags.
+func (sh *Shell) free(state *shellState, args []string) string {
+	flags, _ := splitFlags(args[1:])
+	total, used, free, shared, cache, available := sh.persona.memory()
+	swap := sh.persona.SwapMB
+
+	format := func(mb int) string {
+		switch {
+		case strings.Contains(flags, "h"):
+			if mb == 0 {
+				return "0B"
+			}
+			if mb >= 1024 {
+				return fmt.Sprintf("%.1fG", float64(mb)/1024)
+			}
+			return fmt.Sprintf("%dM", mb)
+		case strings.Contains(flags, "g"):
+			return strconv.Itoa(mb / 1024)
+		case strings.Contains(flags, "m"):
+			return strconv.Itoa(mb)
+		}
+		return strconv.Itoa(mb * 1024)
+	}
+
+	return fmt.Sprintf("%19s%12s%12s%12s%12s%12s\n", "total", "used", "free", "shared", "buff/cache", "available") +
+		fmt.Sprintf("%-7s%12s%12s%12s%12s%12s%12s\n", "Mem:", format(total), format(used), format(free), format(shared), format(cache), format(available)) +
+		fmt.Sprintf("%-7s%12s%12s%12s\n", "Swap:", format(swap), format(0), format(swap))
+}
+
+// w shows the session of the user as the only one logged in.
+func (sh *Shell) w(state *shellState, args []string) string {
+	now := time.Now()
+	return sh.persona.uptime(now) +
+		"USER     TTY      FROM             LOGIN@   IDLE   JCPU   PCPU WHAT\n" +
+		fmt.Sprintf("%-8s pts/0    %-16s %-8s 0.00s  0.00s  0.00s w\n", state.user, state.from, state.login.Format("15:04"))
+}
+
+// echo prints args as bash's builtin does, with its -n, -e and -E flags.
+func echo(args []string) string {
+	newline, escapes := true, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' && strings.Trim(args[0][1:], "neE") == "" {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'n':
+				newline = false
+			case 'e':
+				escapes = true
+			case 'E':
+				escapes = false
+			}
+		}
+		args = args[1:]
+	}
+
+	out := strings.Join(args, " ")
+	if escapes {
+		var stop bool
+		out, stop = echoEscapes(out)
+		newline = newline && !stop
+	}
+	if newline {
+		out += "\n"
+	}
+
+	return out
+}
+
+// echoEscapes interprets the backslash escapes of echo -e, reporting whether
+// \c stopped the output.
+func echoEscapes(s string) (string, bool) {
+	simple := map[byte]byte{'\\': '\\', 'a': '\a', 'b': '\b', 'e': 0x1b, 'E': 0x1b, 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v'}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if c, ok := simple[s[i]]; ok {
+			b.WriteByte(c)
+			continue
+		}
+		switch s[i] {
+		case 'c':
+			return b.String(), true
+		case 'x', '0':
+			base, digits, valid := 16, 2, "0123456789abcdefABCDEF"
+			if s[i] == '0' {
+				base, digits, valid = 8, 3, "01234567"
+			}
+			end := i + 1
+			for end < len(s) && end < i+1+digits && strings.IndexByte(valid, s[end]) >= 0 {
+				end++
+			}
+			if end == i+1 && s[i] == 'x' {
+				b.WriteString("\\x")
+				continue
+			}
+			n, _ := strconv.ParseUint(s[i+1:end], base, 8)
+			b.WriteByte(byte(n))
+			i = end - 1
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String(), false
+}
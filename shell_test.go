@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShellAccepts(t *testing.T) {
+	shell := NewShell(nil, []string{"root:123456", "admin:*"}, 3, time.Hour, nil, nil, nil, nil)
+
+	if !shell.Accepts("203.0.113.7", "root", "123456") || !shell.Accepts("203.0.113.7", "admin", "anything") {
+		t.Error("configured credentials refused")
+	}
+
+	for i := 1; i < 3; i++ {
+		if shell.Accepts("203.0.113.8", "oracle", "oracle") {
+			t.Fatalf("accepted after %d attempts", i)
+		}
+	}
+	if !shell.Accepts("203.0.113.8", "oracle", "oracle") {
+		t.Fatal("refused after 3 attempts")
+	}
+	if shell.Accepts("203.0.113.8", "oracle", "other") {
+		t.Error("accepted another password after one stuck")
+	}
+}
+
+func TestShellExecute(t *testing.T) {
+	fileSystem, err := LoadFileSystem("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shell := NewShell(nil, nil, 0, time.Hour, fileSystem, nil, nil, nil)
+	state := newShellState("root", fileSystem.View(nil))
+
+	tests := []struct {
+		line   string
+		output string
+		status int
+	}{
+		{"echo hello > /tmp/a; echo world >> /tmp/a", "", 0},
+		{"cat /tmp/a", "hello\nworld\n", 0},
+		{"cat /tmp/a | wc -l", "2\n", 0},
+		{"cat /nonexistent 2>/dev/null; echo $?", "1\n", 0},
+		{"echo x > /nonexistent/a", "-bash: /nonexistent/a: No such file or directory\n", 1},
+	}
+	for _, test := range tests {
+		output, status, exit := shell.execute(state, test.line)
+		if output != test.output || status != test.status || exit {
+			t.Errorf("%s = %q, %d, %t, want %q, %d", test.line, output, status, exit, test.output, test.status)
+		}
+	}
+
+	if _, _, exit := shell.execute(state, "exit"); !exit {
+		t.Error("exit didn't end the session")
+	}
+}
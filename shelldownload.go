@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// downloadRequest is a file a download command asks for, and where it saves
+// it, an empty target standing for the standard output.
+type downloadRequest struct {
+	url    string
+	target string
+	quiet  bool
+}
+
+// download emulates wget, curl and tftp, capturing a "download" event for
+// each URL. With a downloader, the payload is fetched, kept as a sample and
+// saved to the fake filesystem, the command succeeding. Without one, or
+// when fetching fails, the host can't be resolved, after a while, as if the
+// network were slow rather than unreachable, attackers tending to try a few
+// more things then.
+func (sh *Shell) download(state *shellState, args []string) string {
+	name := args[0]
+	var requests []downloadRequest
+	switch name {
+	case "wget":
+		requests = wgetRequests(args)
+	case "curl":
+		requests = curlRequests(args)
+	case "tftp":
+		requests = tftpRequests(args)
+	}
+	if len(requests) == 0 {
+		switch name {
+		case "wget":
+			state.fail(1, "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n\nTry `wget --help' for more options.\n")
+		case "curl":
+			state.fail(2, "curl: try 'curl --help' or 'curl --manual' for more information\n")
+		case "tftp":
+			state.fail(1, "BusyBox v1.22.1 (Debian 1:1.22.0-19+b3) multi-call binary.\n\nUsage: tftp [OPTIONS] HOST [PORT]\n")
+		}
+		return ""
+	}
+
+	var out strings.Builder
+	for _, request := range requests {
+		sshInfo := newSSHInfo(state.ctx, "download")
+		sshInfo.URL = request.url
+
+		var payload *Payload
+		var err error
+		if sh.downloader != nil {
+			payload, err = sh.downloader.Fetch(state.ctx, request.url, downloadUserAgents[name])
+			if err != nil {
+				slog.Debug("Failed to fetch payload", "url", request.url, "error", err)
+			}
+		}
+		if payload != nil {
+			sshInfo.FileSHA256 = payload.SHA256
+			sshInfo.FileSize = int64(len(payload.Data))
+			if request.target != "" {
+				sshInfo.Path = state.resolve(request.target)
+			}
+		}
+		state.capture(sshInfo)
+		slog.Info("Download", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "url", request.url, "sha256", sshInfo.FileSHA256)
+		if payload != nil {
+			// Kept before being written, for the sample to record the URL
+			sh.keepSample(state.ctx, state.record, state.capture, payload.Data, sshInfo.Path, request.url)
+		}
+
+		host := request.url
+		if u, err := url.Parse(request.url); err == nil && u.Host != "" {
+			host = u.Hostname()
+		}
+		if payload == nil {
+			if sh.downloader == nil {
+				time.Sleep(2 * time.Second)
+			}
+			switch name {
+			case "wget":
+				state.fail(4, "wget: unable to resolve host address ‘%s’\n", host)
+			case "curl":
+				state.fail(6, "curl: (6) Could not resolve host: %s\n", host)
+			case "tftp":
+				state.fail(1, "tftp: bad address '%s'\n", host)
+			}
+			continue
+		}
+
+		if request.target == "" {
+			out.Write(payload.Data)
+			continue
+		}
+		if err := state.fs.WriteFile(state.resolve(request.target), payload.Data, false, state.user); err != nil {
+			state.fail(1, "%s: %s: %s\n", name, request.target, fsErrorText(err))
+			continue
+		}
+		if name == "wget" && !request.quiet {
+			wgetLog(state, request, host, len(payload.Data))
+		}
+	}
+
+	return out.String()
+}
+
+// downloadUserAgents are those of the tools of a Debian 9 host.
+var downloadUserAgents = map[string]string{
+	"wget": "Wget/1.18 (linux-gnu)",
+	"curl": "curl/7.52.1",
+}
+
+// wgetRequests saves each URL under the name of its last path element, or
+// the file of -O, in the directory of -P.
+func wgetRequests(args []string) []downloadRequest {
+	var urls []string
+	var output, prefix string
+	quiet := false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-O" || arg == "-P") && i+1 < len(args):
+			if arg == "-O" {
+				output = args[i+1]
+			} else {
+				prefix = args[i+1]
+			}
+			i++
+		case strings.HasPrefix(arg, "--output-document="):
+			output = strings.TrimPrefix(arg, "--output-document=")
+		case strings.HasPrefix(arg, "--directory-prefix="):
+			prefix = strings.TrimPrefix(arg, "--directory-prefix=")
+		case strings.HasPrefix(arg, "-P") && !strings.HasPrefix(arg, "--"):
+			prefix = arg[2:]
+		case (arg == "-U" || arg == "-t" || arg == "-T" || arg == "-o" || arg == "-a" || arg == "-e") && i+1 < len(args):
+			i++
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-"):
+			// Grouped flags, e.g. "-qO-" or "-Ofile"
+			flags, value, hasOutput := strings.Cut(arg[1:], "O")
+			quiet = quiet || strings.Contains(flags, "q")
+			if hasOutput {
+				if value == "" && i+1 < len(args) {
+					value = args[i+1]
+					i++
+				}
+				output = value
+			}
+		default:
+			urls = append(urls, withScheme(arg, "http"))
+		}
+	}
+
+	requests := make([]downloadRequest, len(urls))
+	for i, rawURL := range urls {
+		target := output
+		if target == "" {
+			target = path.Join(prefix, remoteName(rawURL))
+		}
+		if target == "-" {
+			target = ""
+		}
+		requests[i] = downloadRequest{url: rawURL, target: target, quiet: quiet}
+	}
+
+	return requests
+}
+
+// curlRequests writes each URL to the standard output, or to the file of -o,
+// or under the name of its last path element with -O.
+func curlRequests(args []string) []downloadRequest {
+	var requests []downloadRequest
+	var outputs []string
+	remote := false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o" && i+1 < len(args):
+			outputs = append(outputs, args[i+1])
+			i++
+		case strings.HasPrefix(arg, "--output="):
+			outputs = append(outputs, strings.TrimPrefix(arg, "--output="))
+		case arg == "-O" || arg == "--remote-name":
+			remote = true
+		case (arg == "-A" || arg == "-H" || arg == "-d" || arg == "-X" || arg == "-u" || arg == "-e" || arg == "-m" ||
+			arg == "--connect-timeout" || arg == "--user-agent" || arg == "--header") && i+1 < len(args):
+			i++
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-"):
+			// Grouped flags, e.g. "-sLO" or "-fsSLo file"
+			remote = remote || strings.Contains(arg, "O")
+			if strings.HasSuffix(arg, "o") && i+1 < len(args) {
+				outputs = append(outputs, args[i+1])
+				i++
+			}
+		default:
+			requests = append(requests, downloadRequest{url: withScheme(arg, "http")})
+		}
+	}
+
+	for i := range requests {
+		switch {
+		case i < len(outputs):
+			requests[i].target = outputs[i]
+		case remote:
+			requests[i].target = remoteName(requests[i].url)
+		}
+		if requests[i].target == "-" {
+			requests[i].target = ""
+		}
+	}
+
+	return requests
+}
+
+// tftpRequests handles the busybox form, "tftp -g -r file [-l local] host",
+// and the interactive client one, "tftp host -c get file".
+func tftpRequests(args []string) []downloadRequest {
+	var remote, local, host string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-r" || arg == "-l") && i+1 < len(args):
+			if arg == "-r" {
+				remote = args[i+1]
+			} else {
+				local = args[i+1]
+			}
+			i++
+		case arg == "-c" && i+2 < len(args) && args[i+1] == "get":
+			remote = args[i+2]
+			if i+3 < len(args) {
+				local = args[i+3]
+			}
+			i += 3
+		case strings.HasPrefix(arg, "-"):
+		case host == "":
+			host = arg
+		}
+	}
+	if remote == "" || host == "" {
+		return nil
+	}
+	if local == "" {
+		local = path.Base(remote)
+	}
+
+	return []downloadRequest{{url: "tftp://" + host + "/" + strings.TrimPrefix(remote, "/"), target: local}}
+}
+
+// withScheme adds scheme to rawURL if it has none, as download tools do.
+func withScheme(rawURL string, scheme string) string {
+	if strings.Contains(rawURL, "://") {
+		return rawURL
+	}
+
+	return scheme + "://" + rawURL
+}
+
+// remoteName is the name a URL is saved under, its last path element.
+func remoteName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "index.html"
+	}
+	if name := path.Base(u.Path); name != "." && name != "/" && name != "" {
+		return name
+	}
+
+	return "index.html"
+}
+
+// wgetLog writes the progress wget reports on standard error for a
+// successful download.
+func wgetLog(state *shellState, request downloadRequest, host string, size int) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	fmt.Fprintf(&state.stderr, "--%s--  %s\nConnecting to %[3]s (%[3]s)... connected.\nHTTP request sent, awaiting response... 200 OK\n", now, request.url, host)
+	fmt.Fprintf(&state.stderr, "Length: %d [application/octet-stream]\nSaving to: ‘%s’\n\n", size, request.target)
+	fmt.Fprintf(&state.stderr, "%-20s100%%[===================>] %9d  --.-KB/s    in 0s\n\n", path.Base(request.target), size)
+	fmt.Fprintf(&state.stderr, "%s - ‘%s’ saved [%d/%d]\n\n", now, request.target, size, size)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// splitFlags separates the flags of args from its operands, returning the
+// letters of the short flags.
+func splitFlags(args []string) (string, []string) {
+	var flags strings.Builder
+	var operands []string
+	for i, arg := range args {
+		if arg == "--" {
+			operands = append(operands, args[i+1:]...)
+			break
+		}
+		if len(arg) > 1 && arg[0] == '-' {
+			if !strings.HasPrefix(arg, "--") {
+				flags.WriteString(arg[1:])
+			}
+			continue
+		}
+		operands = append(operands, strings.Trim(arg, `"'`))
+	}
+
+	return flags.String(), operands
+}
+
+func (sh *Shell) cd(state *shellState, args []string) {
+	name, target := "~", state.home
+	if len(args) > 1 && args[1] != "~" {
+		name = strings.Trim(args[1], `"'`)
+		target = state.resolve(name)
+	}
+
+	node, err := state.fs.Stat(target)
+	switch {
+	case err != nil:
+		state.fail(1, "-bash: cd: %s: %s\n", name, fsErrorText(err))
+	case !node.isDir():
+		state.fail(1, "-bash: cd: %s: Not a directory\n", name)
+	case !readable(node, state.user):
+		state.fail(1, "-bash: cd: %s: Permission denied\n", name)
+	default:
+		state.cwd = target
+	}
+}
+
+func (sh *Shell) ls(state *shellState, args []string) string {
+	flags, operands := splitFlags(args[1:])
+	all := strings.Contains(flags, "a")
+	almostAll := strings.Contains(flags, "A")
+	long := strings.Contains(flags, "l")
+	if len(operands) == 0 {
+		operands = []string{"."}
+	}
+
+	var files []fsEntry
+	var dirs []string
+	for _, operand := range operands {
+		node, err := state.fs.Stat(state.resolve(operand))
+		switch {
+		case err != nil:
+			state.fail(2, "ls: cannot access '%s': %s\n", operand, fsErrorText(err))
+		case node.isDir():
+			dirs = append(dirs, operand)
+		default:
+			files = append(files, fsEntry{name: operand, node: node})
+		}
+	}
+
+	var out strings.Builder
+	if len(files) > 0 {
+		out.WriteString(lsList(files, long, false))
+	}
+	for _, dir := range dirs {
+		full := state.resolve(dir)
+		if len(operands) > 1 {
+			if out.Len() > 0 {
+				out.WriteString("\n")
+			}
+			fmt.Fprintf(&out, "%s:\n", dir)
+		}
+
+		node, _ := state.fs.Stat(full)
+		if !readable(node, state.user) {
+			state.fail(2, "ls: cannot open directory '%s': Permission denied\n", dir)
+			continue
+		}
+		entries, _ := state.fs.ReadDir(full)
+		var shown []fsEntry
+		if all {
+			parent, _ := state.fs.Stat(path.Dir(full))
+			shown = append(shown, fsEntry{name: ".", node: node}, fsEntry{name: "..", node: parent})
+		}
+		for _, entry := range entries {
+			if all || almostAll || !strings.HasPrefix(entry.name, ".") {
+				shown = append(shown, entry)
+			}
+		}
+		out.WriteString(lsList(shown, long, true))
+	}
+
+	return out.String()
+}
+
+// lsList formats entries as ls does, in the long format with their
+// attributes aligned in columns, preceded by the blocks they take up when
+// listing a directory.
+func lsList(entries []fsEntry, long bool, total bool) string {
+	if !long {
+		if len(entries) == 0 {
+			return ""
+		}
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.name
+		}
+		return strings.Join(names, "  ") + "\n"
+	}
+
+	var blocks int64
+	var linksWidth, ownerWidth, groupWidth, sizeWidth int
+	links := make([]int, len(entries))
+	for i, entry := range entries {
+		blocks += (entry.node.Size() + 4095) / 4096 * 4
+		links[i] = 1
+		if entry.node.isDir() {
+			links[i] = 2
+			for _, child := range entry.node.children {
+				if child.isDir() {
+					links[i]++
+				}
+			}
+		}
+		linksWidth = max(linksWidth, len(strconv.Itoa(links[i])))
+		ownerWidth = max(ownerWidth, len(entry.node.owner))
+		groupWidth = max(groupWidth, len(entry.node.group))
+		sizeWidth = max(sizeWidth, len(strconv.FormatInt(entry.node.Size(), 10)))
+	}
+
+	var out strings.Builder
+	if total {
+		fmt.Fprintf(&out, "total %d\n", blocks)
+	}
+	for i, entry := range entries {
+		fmt.Fprintf(&out, "%s %*d %-*s %-*s %*d %s %s\n", lsMode(entry.node.mode), linksWidth, links[i],
+			ownerWidth, entry.node.owner, groupWidth, entry.node.group, sizeWidth, entry.node.Size(),
+			lsTime(entry.node.modTime), entry.name)
+	}
+
+	return out.String()
+}
+
+func lsMode(mode fs.FileMode) string {
+	b := []byte("-rwxrwxrwx")
+	if mode.IsDir() {
+		b[0] = 'd'
+	}
+	for i := 0; i < 9; i++ {
+		if mode&(1<<(8-i)) == 0 {
+			b[i+1] = '-'
+		}
+	}
+	if mode&fs.ModeSticky != 0 {
+		if b[9] == 'x' {
+			b[9] = 't'
+		} else {
+			b[9] = 'T'
+		}
+	}
+
+	return string(b)
+}
+
+// lsTime shows the time of day for recent times and the year for others.
+func lsTime(t time.Time) string {
+	if age := time.Since(t); age < 180*24*time.Hour && age > -time.Hour {
+		return t.Format("Jan _2 15:04")
+	}
+
+	return t.Format("Jan _2  2006")
+}
+
+func (sh *Shell) cat(state *shellState, args []string) string {
+	_, operands := splitFlags(args[1:])
+
+	var out strings.Builder
+	for _, operand := range operands {
+		node, err := state.fs.Stat(state.resolve(operand))
+		switch {
+		case err != nil:
+			state.fail(1, "cat: %s: %s\n", operand, fsErrorText(err))
+		case node.isDir():
+			state.fail(1, "cat: %s: Is a directory\n", operand)
+		case !readable(node, state.user):
+			state.fail(1, "cat: %s: Permission denied\n", operand)
+		default:
+			out.Write(node.content)
+		}
+	}
+
+	return out.String()
+}
+
+func (sh *Shell) touch(state *shellState, args []string) {
+	_, operands := splitFlags(args[1:])
+	if len(operands) == 0 {
+		state.fail(1, "touch: missing file operand\n")
+	}
+
+	for _, operand := range operands {
+		if err := state.fs.Touch(state.resolve(operand), state.user); err != nil {
+			state.fail(1, "touch: cannot touch '%s': %s\n", operand, fsErrorText(err))
+		}
+	}
+}
+
+func (sh *Shell) mkdir(state *shellState, args []string) {
+	flags, operands := splitFlags(args[1:])
+	if len(operands) == 0 {
+		state.fail(1, "mkdir: missing operand\n")
+	}
+
+	for _, operand := range operands {
+		full := state.resolve(operand)
+		var err error
+		if strings.Contains(flags, "p") {
+			parts := splitPath(full)
+			for i := range parts {
+				err = state.fs.Mkdir("/"+strings.Join(parts[:i+1], "/"), state.user)
+				if errors.Is(err, fs.ErrExist) {
+					err = nil
+				}
+				if err != nil {
+					break
+				}
+			}
+		} else {
+			err = state.fs.Mkdir(full, state.user)
+		}
+		if err != nil {
+			state.fail(1, "mkdir: cannot create directory ‘%s’: %s\n", operand, fsErrorText(err))
+		}
+	}
+}
+
+func (sh *Shell) rm(state *shellState, args []string) {
+	flags, operands := splitFlags(args[1:])
+	recursive := strings.ContainsAny(flags, "rR")
+	force := strings.Contains(flags, "f")
+	if len(operands) == 0 && !force {
+		state.fail(1, "rm: missing operand\n")
+	}
+
+	for _, operand := range operands {
+		full := state.resolve(operand)
+		node, err := state.fs.Stat(full)
+		switch {
+		case err != nil:
+			if !force {
+				state.fail(1, "rm: cannot remove '%s': %s\n", operand, fsErrorText(err))
+			}
+		case node.isDir() && !recursive:
+			state.fail(1, "rm: cannot remove '%s': Is a directory\n", operand)
+		default:
+			if err := state.fs.Remove(full, recursive, state.user); err != nil {
+				state.fail(1, "rm: cannot remove '%s': %s\n", operand, fsErrorText(err))
+			}
+		}
+	}
+}
+
+func (sh *Shell) chmod(state *shellState, args []string) {
+	args = args[1:]
+	if len(args) > 0 && args[0] == "-R" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		state.fail(1, "chmod: missing operand\n")
+		return
+	}
+
+	for _, operand := range args[1:] {
+		operand = strings.Trim(operand, `"'`)
+		full := state.resolve(operand)
+		node, err := state.fs.Stat(full)
+		if err != nil {
+			state.fail(1, "chmod: cannot access '%s': %s\n", operand, fsErrorText(err))
+			continue
+		}
+		perm, ok := chmodMode(args[0], node.mode)
+		if !ok {
+			state.fail(1, "chmod: invalid mode: ‘%s’\n", args[0])
+			return
+		}
+		if err := state.fs.Chmod(full, perm, state.user); err != nil {
+			state.fail(1, "chmod: changing permissions of '%s': Operation not permitted\n", operand)
+		}
+	}
+}
+
+// chmodMode applies the octal or symbolic mode spec to the permissions of
+// current, e.g. "755", "+x" or "u=rwx,go-w".
+func chmodMode(spec string, current fs.FileMode) (fs.FileMode, bool) {
+	if n, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		perm := fs.FileMode(n) & fs.ModePerm
+		if n&0o1000 != 0 {
+			perm |= fs.ModeSticky
+		}
+		return perm, true
+	}
+
+	perm := current & (fs.ModePerm | fs.ModeSticky)
+	for _, clause := range strings.Split(spec, ",") {
+		i := strings.IndexAny(clause, "+-=")
+		if i < 0 {
+			return 0, false
+		}
+
+		var mask fs.FileMode
+		for _, who := range clause[:i] {
+			switch who {
+			case 'u':
+				mask |= 0o700
+			case 'g':
+				mask |= 0o070
+			case 'o':
+				mask |= 0o007
+			case 'a':
+				mask |= 0o777
+			default:
+				return 0, false
+			}
+		}
+		if mask == 0 {
+			mask = 0o777
+		}
+
+		var bits fs.FileMode
+		for _, what := range clause[i+1:] {
+			switch what {
+			case 'r':
+				bits |= 0o444 & mask
+			case 'w':
+				bits |= 0o222 & mask
+			case 'x':
+				bits |= 0o111 & mask
+			case 't':
+				bits |= fs.ModeSticky
+			case 's':
+			default:
+				return 0, false
+			}
+		}
+
+		switch clause[i] {
+		case '+':
+			perm |= bits
+		case '-':
+			perm &^= bits
+		case '=':
+			perm = perm&^mask | bits
+		}
+	}
+
+	return perm, true
+}
+
+// copyOrMove copies or moves, as cp or mv, files to a file or into a
+// directory. Directories aren't copied.
+func (sh *Shell) copyOrMove(state *shellState, args []string) {
+	name := args[0]
+	_, operands := splitFlags(args[1:])
+	if len(operands) < 2 {
+		state.fail(1, "%s: missing file operand\n", name)
+		return
+	}
+
+	destination := operands[len(operands)-1]
+	destinationPath := state.resolve(destination)
+	node, err := state.fs.Stat(destinationPath)
+	intoDir := err == nil && node.isDir()
+	if len(operands) > 2 && !intoDir {
+		state.fail(1, "%s: target '%s' is not a directory\n", name, destination)
+		return
+	}
+
+	for _, source := range operands[:len(operands)-1] {
+		sourcePath := state.resolve(source)
+		target := destinationPath
+		if intoDir {
+			target = path.Join(destinationPath, path.Base(sourcePath))
+		}
+
+		node, err := state.fs.Stat(sourcePath)
+		switch {
+		case err != nil:
+			state.fail(1, "%s: cannot stat '%s': %s\n", name, source, fsErrorText(err))
+		case name == "mv":
+			if err := state.fs.Rename(sourcePath, target, state.user); err != nil {
+				state.fail(1, "mv: cannot move '%s' to '%s': %s\n", source, destination, fsErrorText(err))
+			}
+		case node.isDir():
+			state.fail(1, "cp: -r not specified; omitting directory '%s'\n", source)
+		case !readable(node, state.user):
+			state.fail(1, "cp: cannot open '%s' for reading: Permission denied\n", source)
+		default:
+			if err := state.fs.WriteFile(target, node.content, false, state.user); err != nil {
+				state.fail(1, "cp: cannot create regular file '%s': %s\n", destination, fsErrorText(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// textFilters are the commands attackers pipe command output through, e.g.
+// "cat /proc/cpuinfo | grep name | wc -l", emulated so the figures they
+// extract agree with those of the other commands.
+var textFilters = map[string]bool{
+	"grep": true, "egrep": true, "head": true, "tail": true, "wc": true, "sort": true, "uniq": true, "cut": true, "awk": true,
+}
+
+// filter runs the text filter of args over input, or over the files given
+// as operands.
+func (sh *Shell) filter(state *shellState, args []string, input string) string {
+	name := args[0]
+	var files []string
+	text := func() string {
+		if len(files) == 0 {
+			return input
+		}
+		var b strings.Builder
+		for _, file := range files {
+			node, err := state.fs.Stat(state.resolve(file))
+			switch {
+			case err != nil:
+				state.fail(2, "%s: %s: %s\n", name, file, fsErrorText(err))
+			case node.isDir():
+				state.fail(2, "%s: %s: Is a directory\n", name, file)
+			case !readable(node, state.user):
+				state.fail(2, "%s: %s: Permission denied\n", name, file)
+			default:
+				b.Write(node.content)
+			}
+		}
+		return b.String()
+	}
+
+	switch name {
+	case "grep", "egrep":
+		flags, operands := splitFlags(args[1:])
+		if len(operands) == 0 {
+			state.fail(2, "Usage: grep [OPTION]... PATTERN [FILE]...\nTry 'grep --help' for more information.\n")
+			return ""
+		}
+		files = operands[1:]
+		return grep(state, operands[0], flags, name == "egrep", text())
+	case "head", "tail":
+		count := 10
+		for i := 1; i < len(args); i++ {
+			arg := args[i]
+			switch {
+			case arg == "-n" && i+1 < len(args):
+				count, _ = strconv.Atoi(args[i+1])
+				i++
+			case strings.HasPrefix(arg, "-n"):
+				count, _ = strconv.Atoi(arg[2:])
+			case len(arg) > 1 && arg[0] == '-':
+				if n, err := strconv.Atoi(arg[1:]); err == nil {
+					count = n
+				}
+			default:
+				files = append(files, arg)
+			}
+		}
+		lines := splitLines(text())
+		if name == "head" {
+			return strings.Join(lines[:min(count, len(lines))], "")
+		}
+		return strings.Join(lines[max(len(lines)-count, 0):], "")
+	case "wc":
+		var flags string
+		flags, files = splitFlags(args[1:])
+		content := text()
+		counts := map[byte]int{'l': strings.Count(content, "\n"), 'w': len(strings.Fields(content)), 'c': len(content)}
+		var values []string
+		for _, flag := range []byte("lwc") {
+			if flags == "" || strings.IndexByte(flags, flag) >= 0 {
+				values = append(values, strconv.Itoa(counts[flag]))
+			}
+		}
+		if len(files) > 0 {
+			values = append(values, files[0])
+		} else if len(values) > 1 {
+			for i, value := range values {
+				values[i] = fmt.Sprintf("%7s", value)
+			}
+		}
+		return strings.Join(values, " ") + "\n"
+	case "sort":
+		var flags string
+		flags, files = splitFlags(args[1:])
+		lines := splitLines(text())
+		if strings.Contains(flags, "n") {
+			slices.SortStableFunc(lines, func(a, b string) int {
+				x, _ := strconv.ParseFloat(strings.Fields(a + " 0")[0], 64)
+				y, _ := strconv.ParseFloat(strings.Fields(b + " 0")[0], 64)
+				return cmp.Compare(x, y)
+			})
+		} else {
+			slices.Sort(lines)
+		}
+		if strings.Contains(flags, "r") {
+			slices.Reverse(lines)
+		}
+		if strings.Contains(flags, "u") {
+			lines = slices.Compact(lines)
+		}
+		return strings.Join(lines, "")
+	case "uniq":
+		_, files = splitFlags(args[1:])
+		return strings.Join(slices.Compact(splitLines(text())), "")
+	case "cut":
+		return cut(state, args, &files, text)
+	case "awk":
+		return awk(state, args, &files, text)
+	}
+
+	return input
+}
+
+// splitLines splits text into lines, keeping their line feed, adding one to
+// the last line if missing.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if last := len(lines) - 1; lines[last] == "" {
+		lines = lines[:last]
+	} else {
+		lines[last] += "\n"
+	}
+
+	return lines
+}
+
+func grep(state *shellState, pattern string, flags string, extended bool, text string) string {
+	if !extended && !strings.Contains(flags, "E") {
+		pattern = basicRegexp(pattern)
+	}
+	if strings.Contains(flags, "F") {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if strings.Contains(flags, "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		state.fail(2, "grep: Unmatched ( or \\(\n")
+		return ""
+	}
+
+	var matched []string
+	for _, line := range splitLines(text) {
+		if re.MatchString(strings.TrimSuffix(line, "\n")) != strings.Contains(flags, "v") {
+			matched = append(matched, line)
+		}
+	}
+	if len(matched) == 0 {
+		state.status = 1
+	}
+	if strings.Contains(flags, "c") {
+		return fmt.Sprintf("%d\n", len(matched))
+	}
+
+	return strings.Join(matched, "")
+}
+
+// basicRegexp turns a POSIX basic regular expression, where the special
+// characters of extended ones are literal unless escaped, into an extended
+// one.
+func basicRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern) && strings.IndexByte("+?(){}|", pattern[i+1]) >= 0:
+			i++
+			b.WriteByte(pattern[i])
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteByte(c)
+			b.WriteByte(pattern[i])
+		case strings.IndexByte("+?(){}|", c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// cut selects the fields given with -f, separated by the delimiter of -d.
+func cut(state *shellState, args []string, files *[]string, text func() string) string {
+	delimiter, list := "\t", ""
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-d" || arg == "-f") && i+1 < len(args):
+			if arg == "-d" {
+				delimiter = args[i+1]
+			} else {
+				list = args[i+1]
+			}
+			i++
+		case strings.HasPrefix(arg, "-d"):
+			delimiter = arg[2:]
+		case strings.HasPrefix(arg, "-f"):
+			list = arg[2:]
+		default:
+			*files = append(*files, arg)
+		}
+	}
+	if list == "" || delimiter == "" {
+		state.fail(1, "cut: you must specify a list of bytes, characters, or fields\nTry 'cut --help' for more information.\n")
+		return ""
+	}
+	delimiter = delimiter[:1]
+
+	var b strings.Builder
+	for _, line := range splitLines(text()) {
+		fields := strings.Split(strings.TrimSuffix(line, "\n"), delimiter)
+		if len(fields) == 1 {
+			b.WriteString(line)
+			continue
+		}
+		var selected []string
+		for i, field := range fields {
+			if fieldSelected(list, i+1) {
+				selected = append(selected, field)
+			}
+		}
+		b.WriteString(strings.Join(selected, delimiter) + "\n")
+	}
+
+	return b.String()
+}
+
+// fieldSelected reports whether the list of cut, e.g. "1,3-5", selects the
+// field n.
+func fieldSelected(list string, n int) bool {
+	for _, part := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if from == "" {
+			first, err = 1, nil
+		}
+		if err != nil {
+			continue
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(to); to == "" || err != nil {
+				last = n
+			}
+		}
+		if n >= first && n <= last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// awkProgram matches the programs of awk that are emulated, printing fields
+// of the lines matching an optional pattern.
+var awkProgram = regexp.MustCompile(`^\s*(?:/(.*)/)?\s*\{\s*print\s*(.*?)\s*;?\s*\}\s*$`)
+
+func awk(state *shellState, args []string, files *[]string, text func() string) string {
+	separator, program := "", ""
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-F" && i+1 < len(args):
+			separator = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-F"):
+			separator = arg[2:]
+		case program == "":
+			program = arg
+		default:
+			*files = append(*files, arg)
+		}
+	}
+
+	match := awkProgram.FindStringSubmatch(program)
+	if match == nil {
+		return ""
+	}
+	var pattern *regexp.Regexp
+	if match[1] != "" {
+		var err error
+		if pattern, err = regexp.Compile(match[1]); err != nil {
+			state.fail(2, "awk: line 1: regular expression compile failed\n")
+			return ""
+		}
+	}
+	items := strings.Split(match[2], ",")
+	if match[2] == "" {
+		items = []string{"$0"}
+	}
+
+	var b strings.Builder
+	for _, line := range splitLines(text()) {
+		line = strings.TrimSuffix(line, "\n")
+		if pattern != nil && !pattern.MatchString(line) {
+			continue
+		}
+		fields := strings.Fields(line)
+		if separator != "" {
+			fields = strings.Split(line, separator)
+		}
+
+		values := make([]string, len(items))
+		for i, item := range items {
+			item = strings.TrimSpace(item)
+			switch {
+			case item == "$0":
+				values[i] = line
+			case item == "NF":
+				values[i] = strconv.Itoa(len(fields))
+			case item == "$NF":
+				if len(fields) > 0 {
+					values[i] = fields[len(fields)-1]
+				}
+			case strings.HasPrefix(item, "$"):
+				if n, err := strconv.Atoi(item[1:]); err == nil && n >= 1 && n <= len(fields) {
+					values[i] = fields[n-1]
+				}
+			default:
+				values[i] = strings.Trim(item, `"`)
+			}
+		}
+		b.WriteString(strings.Join(values, " ") + "\n")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// simulatedClientVersions are the client versions simulated connections
+// announce by default, those of common brute forcing tools.
+var simulatedClientVersions = []string{
+	"SSH-2.0-Go",
+	"SSH-2.0-libssh2_1.10.0",
+	"SSH-2.0-libssh_0.9.6",
+	"SSH-2.0-paramiko_3.4.0",
+	"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6",
+	"SSH-2.0-PuTTY_Release_0.78",
+}
+
+// simulationResult is the outcome of a simulated connection.
+type simulationResult struct {
+	outcome string
+	elapsed time.Duration
+}
+
+// simulate runs the simulate subcommand: it makes synthetic SSH connections
+// to a running honeypot at a steady rate, each trying a credential and
+// possibly a public key, to check the sinks and alerts end to end and
+// measure the throughput of the honeypot.
+func simulate(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML configuration file (env CONFIG_FILE)")
+	target := flags.String("target", "", "host:port of the honeypot, default localhost and the first SSH_PORT")
+	rate := flags.Float64("rate", 10, "connections per second")
+	duration := flags.Duration("duration", 10*time.Second, "how long to run for")
+	count := flags.Int("count", 0, "stop after this many connections, only the duration applies when 0")
+	concurrency := flags.Int("concurrency", 100, "connections open at once at most, the rate dropping when reached")
+	credentialsPath := flags.String("credentials", "", "file of user:password pairs, one per line, as written by export-credentials --list pairs, vendor defaults when unset")
+	clientVersions := flags.String("client-versions", strings.Join(simulatedClientVersions, ","), "comma separated client versions to announce")
+	keys := flags.Int("keys", 5, "public keys to generate and offer")
+	keyRatio := flags.Float64("key-ratio", 0.2, "share of the connections offering a public key before the password")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout of each connection")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: ssh-honeypot simulate [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Makes synthetic SSH connections to a running honeypot, to check its sinks\nand alerts and measure its throughput. Only run it against your own\nhoneypot.\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument '%s'", flags.Arg(0))
+	}
+	if *rate <= 0 {
+		return fmt.Errorf("rate must be positive, got %g", *rate)
+	}
+	if *concurrency <= 0 {
+		return fmt.Errorf("concurrency must be positive, got %d", *concurrency)
+	}
+	if *keyRatio < 0 || *keyRatio > 1 {
+		return fmt.Errorf("key ratio must be between 0 and 1, got %g", *keyRatio)
+	}
+
+	// Picks up the SSH port from the configuration file
+	if _, err := NewReloader(*configPath); err != nil {
+		return err
+	}
+	if *target == "" {
+		*target = net.JoinHostPort("localhost", splitList(getEnv("SSH_PORT", "2222"))[0])
+	}
+
+	credentials, err := simulatedCredentials(*credentialsPath)
+	if err != nil {
+		return err
+	}
+	var versions []string
+	for _, version := range splitList(*clientVersions) {
+		if !strings.HasPrefix(version, "SSH-2.0-") {
+			version = "SSH-2.0-" + version
+		}
+		versions = append(versions, version)
+	}
+	if len(versions) == 0 {
+		return errors.New("no client version to announce")
+	}
+	signers := make([]gossh.Signer, 0, *keys)
+	for i := 0; i < *keys; i++ {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		signer, err := gossh.NewSignerFromKey(key)
+		if err != nil {
+			return err
+		}
+		signers = append(signers, signer)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	fmt.Printf("Simulating %g connections per second against %s for %s\n", *rate, *target, *duration)
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []simulationResult
+		slots   = make(chan struct{}, *concurrency)
+	)
+	started := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+
+loop:
+	for n := 0; *count == 0 || n < *count; n++ {
+		select {
+		case <-ctx.Done():
+			break loop
+		case slots <- struct{}{}:
+		}
+		select {
+		case <-ctx.Done():
+			<-slots
+			break loop
+		case <-ticker.C:
+		}
+
+		credential := credentials[mathrand.Intn(len(credentials))]
+		config := &gossh.ClientConfig{
+			User:            credential.User,
+			ClientVersion:   versions[mathrand.Intn(len(versions))],
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			Timeout:         *timeout,
+		}
+		if len(signers) > 0 && mathrand.Float64() < *keyRatio {
+			config.Auth = append(config.Auth, gossh.PublicKeys(signers[mathrand.Intn(len(signers))]))
+		}
+		config.Auth = append(config.Auth, gossh.Password(credential.Password))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			result := simulateConnection(*target, config, *timeout)
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	printSimulationResults(results, time.Since(started))
+	return nil
+}
+
+// simulatedCredentials reads the user:password pairs of path, or returns the
+// vendor default credentials when path is empty.
+func simulatedCredentials(path string) ([]triedCredential, error) {
+	var credentials []triedCredential
+	if path == "" {
+		for pair := range defaultCredentials {
+			user, password, _ := strings.Cut(pair, "\x00")
+			credentials = append(credentials, triedCredential{User: user, Password: password})
+		}
+		return credentials, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		user, password, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("%s: '%s' is not a user:password pair", path, line)
+		}
+		credentials = append(credentials, triedCredential{User: user, Password: password})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("%s: no credentials", path)
+	}
+
+	return credentials, nil
+}
+
+// simulateConnection connects to target and authenticates as set by config,
+// closing the connection as soon as authentication is over, successful or
+// not.
+func simulateConnection(target string, config *gossh.ClientConfig, timeout time.Duration) simulationResult {
+	started := time.Now()
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return simulationResult{outcome: "connect failed", elapsed: time.Since(started)}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, _, _, err := gossh.NewClientConn(conn, target, config)
+	elapsed := time.Since(started)
+	switch {
+	case err == nil:
+		client.Close()
+		return simulationResult{outcome: "accepted", elapsed: elapsed}
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return simulationResult{outcome: "rejected", elapsed: elapsed}
+	default:
+		return simulationResult{outcome: "handshake failed", elapsed: elapsed}
+	}
+}
+
+// printSimulationResults prints the connections by outcome, the rate reached
+// and the time connections took to get through authentication.
+func printSimulationResults(results []simulationResult, elapsed time.Duration) {
+	outcomes := map[string]int{}
+	latencies := make([]time.Duration, 0, len(results))
+	for _, result := range results {
+		outcomes[result.outcome]++
+		if result.outcome == "accepted" || result.outcome == "rejected" {
+			latencies = append(latencies, result.elapsed)
+		}
+	}
+
+	fmt.Printf("\n%d connections in %s, %.1f per second\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	for _, outcome := range []string{"rejected", "accepted", "handshake failed", "connect failed"} {
+		if outcomes[outcome] > 0 {
+			fmt.Printf("  %-17s %d\n", outcome, outcomes[outcome])
+		}
+	}
+	if len(latencies) == 0 {
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Millisecond)
+	}
+	fmt.Printf("Authentication time: p50 %s, p95 %s, p99 %s, max %s\n", percentile(0.5), percentile(0.95), percentile(0.99), percentile(1))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sink stores batches of enriched events. Failed batches are retried by the
+// pipeline against every sink, so writing the same batch twice must not
+// duplicate its events.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, batch Batch) error
+}
+
+// sinkRegistry lists the sinks configured from the environment, in the
+// order they are set up. InfluxDB is set up on its own, as the credential
+// statistics and geohashes are written to it too. fromEnv returns a nil Sink
+// when env, the setting enabling the sink, is unset.
+var sinkRegistry = []struct {
+	env     string
+	fromEnv func(tracer trace.Tracer) (Sink, error)
+}{
+	{"STDOUT_EVENTS", stdoutSinkFromEnv},
+	{"EVENT_FILE_PATH", fileSinkFromEnv},
+	{"ELASTICSEARCH_URL", elasticsearchSinkFromEnv},
+	{"KAFKA_BROKERS", kafkaSinkFromEnv},
+	{"POSTGRES_DSN", postgresSinkFromEnv},
+	{"SQLITE_PATH", sqliteSinkFromEnv},
+	{"CLICKHOUSE_URL", clickhouseSinkFromEnv},
+	{"WEBHOOK_URLS", webhookSinkFromEnv},
+	{"SYSLOG_ADDR", syslogSinkFromEnv},
+	{"GELF_ADDR", gelfSinkFromEnv},
+	{"LOKI_URL", lokiSinkFromEnv},
+	{"NATS_URL", natsSinkFromEnv},
+	{"REDIS_URL", redisStreamSinkFromEnv},
+	{"S3_BUCKET", s3ArchiveSinkFromEnv},
+	{"MQTT_BROKER", mqttSinkFromEnv},
+	{"HPFEEDS_HOST", hpfeedsSinkFromEnv},
+}
+
+// Fanout writes every batch to all of its sinks concurrently, retrying each
+// sink on its own, so a failing sink neither holds up nor duplicates writes
+// to the others. With spools, the batches a sink couldn't take in time are
+// kept on disk, and those coming after them too so they stay in order, until
+// the sink is back.
+type Fanout struct {
+	sinks  []Sink
+	spools []*Spool
+	// anonymizers anonymize the events of the sink at the same index, before
+	// they are written or spooled
+	anonymizers []*Anonymizer
+	maxElapsed  time.Duration
+	tracer      trace.Tracer
+
+	mu     sync.Mutex
+	health []SinkHealth
+}
+
+// SinkHealth is how writing to a sink has been going.
+type SinkHealth struct {
+	Name      string     `json:"name"`
+	Written   int64      `json:"written"`
+	Failures  int64      `json:"failures"`
+	LastWrite *time.Time `json:"last_write,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	// LastErrorAt is when the last batch given up on was, the sink being
+	// healthy if it wrote since
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// Spooled and SpoolSize are the batches waiting in the spool of the sink
+	Spooled   int   `json:"spooled,omitempty"`
+	SpoolSize int64 `json:"spool_size,omitempty"`
+}
+
+func NewFanout(sinks []Sink, maxElapsed time.Duration, tracer trace.Tracer) *Fanout {
+	health := make([]SinkHealth, len(sinks))
+	for i, sink := range sinks {
+		health[i].Name = sink.Name()
+	}
+
+	return &Fanout{sinks: sinks, maxElapsed: maxElapsed, tracer: tracer, health: health}
+}
+
+// EnableSpools gives every sink a spool in dir, of up to maxSize bytes.
+func (f *Fanout) EnableSpools(dir string, maxSize int64) error {
+	spools := make([]*Spool, len(f.sinks))
+	for i, sink := range f.sinks {
+		spool, err := NewSpool(dir, sink.Name(), maxSize)
+		if err != nil {
+			return fmt.Errorf("%s: %w", sink.Name(), err)
+		}
+		if batches, _ := spool.Len(); batches > 0 {
+			slog.Info("Found spooled batches", "sink", sink.Name(), "batches", batches)
+		}
+		spools[i] = spool
+	}
+	f.spools = spools
+
+	return nil
+}
+
+// Anonymize has the events written to the sinks named, or to every sink when
+// none is, anonymized by anonymizer, in their spools too. The other sinks
+// get them in clear.
+func (f *Fanout) Anonymize(anonymizer *Anonymizer, names []string) error {
+	anonymizers := make([]*Anonymizer, len(f.sinks))
+	selected := map[string]bool{}
+	for _, name := range names {
+		selected[name] = true
+	}
+	for i, sink := range f.sinks {
+		if len(names) == 0 || selected[sink.Name()] {
+			anonymizers[i] = anonymizer
+			delete(selected, sink.Name())
+		}
+	}
+	for _, name := range names {
+		if selected[name] {
+			return fmt.Errorf("no sink '%s' configured", name)
+		}
+	}
+	f.anonymizers = anonymizers
+
+	return nil
+}
+
+// Anonymized reports whether the events written to the sink named are
+// anonymized.
+func (f *Fanout) Anonymized(name string) bool {
+	for i, sink := range f.sinks {
+		if sink.Name() == name && f.anonymizers != nil {
+			return f.anonymizers[i] != nil
+		}
+	}
+
+	return false
+}
+
+// Health returns how writing to each sink has been going, in the order they
+// were set up.
+func (f *Fanout) Health() []SinkHealth {
+	f.mu.Lock()
+	health := slices.Clone(f.health)
+	f.mu.Unlock()
+
+	for i, spool := range f.spools {
+		health[i].Spooled, health[i].SpoolSize = spool.Len()
+	}
+
+	return health
+}
+
+func (f *Fanout) recordHealth(i int, events int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	health := &f.health[i]
+	if err != nil {
+		health.Failures++
+		health.LastError = err.Error()
+		health.LastErrorAt = &now
+		return
+	}
+	health.Written += int64(events)
+	health.LastWrite = &now
+}
+
+// Write is a BatchWriter. Its errors are permanent, the sinks that failed
+// having already been retried, so the pipeline doesn't retry the batch as a
+// whole.
+func (f *Fanout) Write(ctx context.Context, batch Batch) error {
+	errs := make([]error, len(f.sinks))
+	var wg sync.WaitGroup
+	for i, sink := range f.sinks {
+		wg.Add(1)
+		go func(i int, sink Sink) {
+			defer wg.Done()
+			if err := f.writeOrSpool(ctx, i, sink, batch); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", sink.Name(), err)
+			}
+		}(i, sink)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return backoff.Permanent(err)
+	}
+	return nil
+}
+
+// writeOrSpool writes batch to the sink at i, spooling it when the sink
+// fails, or has spooled batches it must come after, anonymized if the sink
+// is.
+func (f *Fanout) writeOrSpool(ctx context.Context, i int, sink Sink, batch Batch) error {
+	if f.anonymizers != nil {
+		batch = anonymizeBatch(batch, f.anonymizers[i])
+	}
+
+	var spool *Spool
+	if f.spools != nil {
+		spool = f.spools[i]
+	}
+	if spool != nil {
+		if batches, _ := spool.Len(); batches > 0 {
+			return f.spool(spool, sink, batch)
+		}
+	}
+
+	err := f.write(ctx, sink, batch)
+	f.recordHealth(i, len(batch.Events), err)
+	if err != nil && spool != nil {
+		slog.Warn("Spooling batch for unavailable sink", "sink", sink.Name(), "events", len(batch.Events), "error", err)
+		return f.spool(spool, sink, batch)
+	}
+
+	return err
+}
+
+func (f *Fanout) spool(spool *Spool, sink Sink, batch Batch) error {
+	if err := spool.Append(batch); err != nil {
+		slog.Error("Failed to spool batch, dropping it", "sink", sink.Name(), "events", len(batch.Events), "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// ReplaySpools tries the sinks with spooled batches every interval, writing
+// them back in order for as long as the sink takes them.
+func (f *Fanout) ReplaySpools(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for i, spool := range f.spools {
+			f.replay(i, spool)
+		}
+	}
+}
+
+func (f *Fanout) replay(i int, spool *Spool) {
+	sink := f.sinks[i]
+	total := 0
+	for {
+		if batches, _ := spool.Len(); batches == 0 {
+			break
+		}
+
+		replayed, err := spool.Replay(context.Background(), 100, func(ctx context.Context, batch Batch) error {
+			started := time.Now()
+			err := sink.Write(ctx, batch)
+			metrics.RecordSinkWrite(ctx, sink.Name(), started, err)
+			f.recordHealth(i, len(batch.Events), err)
+			return err
+		})
+		total += replayed
+		if err != nil {
+			slog.Warn("Failed to replay spooled batches", "sink", sink.Name(), "replayed", total, "error", err)
+			return
+		}
+	}
+
+	if total > 0 {
+		slog.Info("Replayed spooled batches", "sink", sink.Name(), "batches", total)
+	}
+}
+
+func (f *Fanout) write(ctx context.Context, sink Sink, batch Batch) error {
+	ctx, span := f.tracer.Start(
+		ctx,
+		"writeToSink",
+		trace.WithAttributes(
+			attribute.String("sink", sink.Name()),
+			attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	backoffSettings := backoff.NewExponentialBackOff()
+	backoffSettings.MaxElapsedTime = f.maxElapsed
+
+	attempts := 0
+	err := backoff.Retry(func() error {
+		attempts++
+		started := time.Now()
+		err := sink.Write(ctx, batch)
+		metrics.RecordSinkWrite(ctx, sink.Name(), started, err)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to write to sink", "sink", sink.Name(), "attempt", attempts, "error", err)
+		}
+		return err
+	}, backoff.WithContext(backoffSettings, ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Wrote %d events in %d attempts", len(batch.Events), attempts))
+	return nil
+}
+
+// anonymizeBatch returns batch with its events anonymized, unless anonymizer
+// is nil. Its pre-encoded form is left as is, the pipeline encoder being
+// anonymized on its own by AnonymizingEncoder.
+func anonymizeBatch(batch Batch, anonymizer *Anonymizer) Batch {
+	if anonymizer == nil {
+		return batch
+	}
+
+	events := make([]Event, len(batch.Events))
+	for i, event := range batch.Events {
+		events[i] = anonymizer.Anonymize(event)
+	}
+	batch.Events = events
+
+	return batch
+}
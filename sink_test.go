@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// fakeSink is a Sink keeping the events written, failing while failing is
+// set.
+type fakeSink struct {
+	name string
+
+	mu      sync.Mutex
+	failing bool
+	events  []Event
+}
+
+func (s *fakeSink) Name() string {
+	return s.name
+}
+
+func (s *fakeSink) Write(ctx context.Context, batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failing {
+		return errors.New("unavailable")
+	}
+	s.events = append(s.events, batch.Events...)
+	return nil
+}
+
+func (s *fakeSink) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+func (s *fakeSink) users() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]string, len(s.events))
+	for i, event := range s.events {
+		users[i] = event.SSHInfo.User
+	}
+	return users
+}
+
+func TestFanoutIsolatesFailingSinks(t *testing.T) {
+	healthy, failing := &fakeSink{name: "healthy"}, &fakeSink{name: "failing", failing: true}
+	fanout := NewFanout([]Sink{healthy, failing}, time.Millisecond, noop.NewTracerProvider().Tracer("test"))
+
+	if err := fanout.Write(context.Background(), spoolBatch("root")); err == nil {
+		t.Error("failing sink not reported")
+	}
+	if users := healthy.users(); len(users) != 1 {
+		t.Errorf("healthy sink got %v", users)
+	}
+
+	health := fanout.Health()
+	if health[0].Written != 1 || health[0].Failures != 0 || health[1].Failures != 1 || health[1].LastError == "" {
+		t.Errorf("health = %+v", health)
+	}
+}
+
+func TestFanoutSpoolsInOrder(t *testing.T) {
+	sink := &fakeSink{name: "sink", failing: true}
+	fanout := NewFanout([]Sink{sink}, time.Millisecond, noop.NewTracerProvider().Tracer("test"))
+	if err := fanout.EnableSpools(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	fanout.Write(context.Background(), spoolBatch("root"))
+	// Spooled after the first one, although the sink is back
+	sink.setFailing(false)
+	fanout.Write(context.Background(), spoolBatch("admin"))
+	if users := sink.users(); len(users) != 0 {
+		t.Fatalf("sink got %v ahead of the spooled batch", users)
+	}
+
+	fanout.replay(0, fanout.spools[0])
+	if users := sink.users(); len(users) != 2 || users[0] != "root" || users[1] != "admin" {
+		t.Errorf("sink got %v, want [root admin]", users)
+	}
+	if health := fanout.Health(); health[0].Spooled != 0 {
+		t.Errorf("%d batches left spooled", health[0].Spooled)
+	}
+}
+
+func TestFanoutAnonymizesSelectedSinks(t *testing.T) {
+	anonymized, clear := &fakeSink{name: "anonymized", failing: true}, &fakeSink{name: "clear"}
+	fanout := NewFanout([]Sink{anonymized, clear}, time.Millisecond, noop.NewTracerProvider().Tracer("test"))
+	if err := fanout.EnableSpools(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	anonymizer, err := NewAnonymizer([]string{"user"}, "", "salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fanout.Anonymize(anonymizer, []string{"elasticsearch"}); err == nil {
+		t.Error("sink not configured selected")
+	}
+	if err := fanout.Anonymize(anonymizer, []string{"anonymized"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fanout.Write(context.Background(), spoolBatch("root"))
+	if users := clear.users(); len(users) != 1 || users[0] != "root" {
+		t.Errorf("unselected sink got %v, want [root]", users)
+	}
+
+	// Spooled anonymized
+	anonymized.setFailing(false)
+	fanout.replay(0, fanout.spools[0])
+	if users := anonymized.users(); len(users) != 1 || users[0] == "root" {
+		t.Errorf("selected sink got %v", users)
+	}
+	if !fanout.Anonymized("anonymized") || fanout.Anonymized("clear") {
+		t.Error("Anonymized doesn't report the selection")
+	}
+}
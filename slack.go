@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"text/template"
+)
+
+const defaultSlackTemplate = `{{if .Digest}}:clipboard: *{{slack .Summary}}*
+{{range .Digest}}• {{slack .Summary}}
+{{end}}{{else}}:rotating_light: *{{slack .Summary}}* ({{.Rule}}, {{.Severity}})
+*IP:* {{slack .Event.SSHInfo.RemoteHost}}{{with .Event.IPInfo}}{{if .Country}} — {{slack .City}}, {{slack .Region}}, {{slack .Country}}{{end}}{{if .Org}} ({{slack .Org}}){{end}}{{end}}
+*Method:* {{.Event.SSHInfo.Function}}  *User:* ` + "`{{slack .Event.SSHInfo.User}}`" + `{{if .Event.SSHInfo.Password}}  *Password:* ` + "`{{slack .Event.SSHInfo.Password}}`" + `{{end}}{{if .Event.SSHInfo.KeyType}}  *Key:* {{.Event.SSHInfo.KeyType}}{{end}}
+*Client:* {{slack .Event.SSHInfo.ClientVersion}}{{if .DashboardURL}}
+<{{.DashboardURL}}|Open dashboard>{{end}}{{end}}`
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+type SlackNotifier struct {
+	webhookURL string
+	channel    string
+	template   *template.Template
+}
+
+func NewSlackNotifier(webhookURL string, channel string, templateText string) (*SlackNotifier, error) {
+	tmpl, err := parseAlertTemplate("slack", templateText, template.FuncMap{
+		"slack": slackEscaper.Replace,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SlackNotifier{
+		webhookURL: webhookURL,
+		channel:    channel,
+		template:   tmpl,
+	}, nil
+}
+
+func (n *SlackNotifier) Name() string {
+	return "slack"
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, alert Alert) error {
+	var text bytes.Buffer
+	if err := n.template.Execute(&text, alert); err != nil {
+		return err
+	}
+
+	payload := map[string]string{
+		"text": text.String(),
+	}
+	if n.channel != "" {
+		payload["channel"] = n.channel
+	}
+
+	return postJSON(ctx, n.webhookURL, payload, nil)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// errSpoolFull is returned for batches that would take a spool over its
+// maximum size, which are dropped.
+var errSpoolFull = errors.New("spool full")
+
+// spooledBatch is a Batch as written to a spool file.
+type spooledBatch struct {
+	Events  []Event `json:"events"`
+	Encoded string  `json:"encoded,omitempty"`
+}
+
+// spooledLine is a line read from a spool file, the batch it holds unless
+// corrupt.
+type spooledLine struct {
+	batch   Batch
+	raw     []byte
+	corrupt bool
+}
+
+// Spool keeps the batches a sink couldn't take on disk, one JSON line each,
+// in the order they came, until they can be replayed. Batches are only
+// appended at the end and removed from the start, by a single replayer.
+type Spool struct {
+	sink    string
+	path    string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	batches int
+}
+
+// NewSpool opens the spool of sink in dir, keeping the batches a previous
+// run left.
+func NewSpool(dir string, sink string, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{sink: sink, path: filepath.Join(dir, sink+".jsonl"), maxSize: maxSize}
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A batch cut short, by a crash while appending it, would
+			// corrupt the next one
+			if len(line) > 0 {
+				if err := os.Truncate(s.path, s.size); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.size += int64(len(line))
+		s.batches++
+	}
+	metrics.RecordSpool(sink, int64(s.batches), s.size)
+
+	return s, nil
+}
+
+// Len returns the number of batches and bytes spooled.
+func (s *Spool) Len() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.batches, s.size
+}
+
+// Append spools batch after those already spooled.
+func (s *Spool) Append(batch Batch) error {
+	spooled := spooledBatch{Events: batch.Events}
+	if batch.Encoded != nil {
+		spooled.Encoded = batch.Encoded.String()
+	}
+	line, err := json.Marshal(spooled)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+int64(len(line)) > s.maxSize {
+		return errSpoolFull
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		// A batch cut short, e.g. by a full disk, would corrupt the next one
+		if truncateErr := file.Truncate(s.size); truncateErr != nil {
+			err = errors.Join(err, truncateErr)
+		}
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	s.size += int64(len(line))
+	s.batches++
+	metrics.RecordSpool(s.sink, 1, int64(len(line)))
+	return nil
+}
+
+// Replay writes the spooled batches with write, oldest first, up to max of
+// them, removing those written. It stops at the first that fails, to keep
+// the order, returning the number of batches replayed. Corrupt batches are
+// moved to a file of their own, the spool path suffixed with .corrupt,
+// rather than blocking the others.
+func (s *Spool) Replay(ctx context.Context, max int, write func(ctx context.Context, batch Batch) error) (int, error) {
+	lines, err := s.peek(max)
+	if err != nil {
+		return 0, err
+	}
+
+	var replayed int
+	var consumed int64
+	for _, line := range lines {
+		if line.corrupt {
+			if err = s.quarantine(line.raw); err != nil {
+				break
+			}
+		} else if err = write(ctx, line.batch); err != nil {
+			break
+		}
+		replayed++
+		consumed += int64(len(line.raw))
+	}
+
+	if replayed > 0 {
+		if dropErr := s.drop(replayed, consumed); dropErr != nil {
+			return replayed, dropErr
+		}
+	}
+
+	return replayed, err
+}
+
+// peek reads up to max of the oldest lines.
+func (s *Spool) peek(max int) ([]spooledLine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.batches == 0 {
+		return nil, nil
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []spooledLine
+	reader := bufio.NewReader(file)
+	for len(lines) < max {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var spooled spooledBatch
+		if err := json.Unmarshal(line, &spooled); err != nil {
+			slog.Warn("Skipping corrupt spooled batch", "sink", s.sink, "error", err)
+			lines = append(lines, spooledLine{raw: line, corrupt: true})
+			continue
+		}
+		batch := Batch{Events: spooled.Events}
+		if spooled.Encoded != "" {
+			batch.Encoded = bytes.NewBufferString(spooled.Encoded)
+		}
+		lines = append(lines, spooledLine{batch: batch, raw: line})
+	}
+
+	return lines, nil
+}
+
+// quarantine appends the corrupt line to the .corrupt file of the spool, for
+// it to be looked into.
+func (s *Spool) quarantine(line []byte) error {
+	file, err := os.OpenFile(s.path+".corrupt", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// drop removes the n oldest batches, taking length bytes, by copying the
+// others to a new file replacing the spool.
+func (s *Spool) drop(n int, length int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n == s.batches {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	} else if err := s.rewriteFrom(length); err != nil {
+		return err
+	}
+
+	s.batches -= n
+	s.size -= length
+	metrics.RecordSpool(s.sink, -int64(n), -length)
+	return nil
+}
+
+// rewriteFrom replaces the spool file with its content past offset.
+func (s *Spool) rewriteFrom(offset int64) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, file); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+func spoolBatch(user string) Batch {
+	return Batch{Events: []Event{{SSHInfo: SSHInfo{User: user, Function: "password"}}}}
+}
+
+// replayUsers replays up to max batches of spool, returning the users of
+// their events.
+func replayUsers(t *testing.T, spool *Spool, max int) []string {
+	t.Helper()
+
+	var users []string
+	_, err := spool.Replay(context.Background(), max, func(ctx context.Context, batch Batch) error {
+		for _, event := range batch.Events {
+			users = append(users, event.SSHInfo.User)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return users
+}
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir, "test", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"root", "admin", "oracle"} {
+		if err := spool.Append(spoolBatch(user)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Failed batches stay spooled, along with those after them
+	replayed, err := spool.Replay(context.Background(), 10, func(ctx context.Context, batch Batch) error {
+		if batch.Events[0].SSHInfo.User == "admin" {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	if replayed != 1 || err == nil {
+		t.Fatalf("replayed %d batches, error %v, want 1 and an error", replayed, err)
+	}
+
+	// And are kept across restarts
+	if spool, err = NewSpool(dir, "test", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if batches, _ := spool.Len(); batches != 2 {
+		t.Fatalf("%d batches spooled, want 2", batches)
+	}
+	if users := replayUsers(t, spool, 10); !slices.Equal(users, []string{"admin", "oracle"}) {
+		t.Errorf("replayed %v, want [admin oracle]", users)
+	}
+	if batches, size := spool.Len(); batches != 0 || size != 0 {
+		t.Errorf("%d batches of %d bytes left", batches, size)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	spool, err := NewSpool(t.TempDir(), "test", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(spoolBatch("root")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for a single batch
+	_, spool.maxSize = spool.Len()
+	if err := spool.Append(spoolBatch("admin")); !errors.Is(err, errSpoolFull) {
+		t.Errorf("error = %v, want errSpoolFull", err)
+	}
+}
+
+func TestSpoolSkipsCorruptBatches(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir, "test", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(spoolBatch("root")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch cut short, the next ones landing after it
+	file, err := os.OpenFile(spool.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("{\"events\":[{\"ssh\n")
+	file.Close()
+	if spool, err = NewSpool(dir, "test", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(spoolBatch("admin")); err != nil {
+		t.Fatal(err)
+	}
+
+	if users := replayUsers(t, spool, 10); !slices.Equal(users, []string{"root", "admin"}) {
+		t.Errorf("replayed %v, want [root admin]", users)
+	}
+	if batches, _ := spool.Len(); batches != 0 {
+		t.Errorf("%d batches left", batches)
+	}
+	if quarantined, err := os.ReadFile(spool.path + ".corrupt"); err != nil || string(quarantined) != "{\"events\":[{\"ssh\n" {
+		t.Errorf("quarantined %q, error %v", quarantined, err)
+	}
+}
+
+func TestSpoolTruncatesCutTail(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir, "test", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(spoolBatch("root")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while appending a batch
+	file, err := os.OpenFile(spool.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"events":[{"ssh`)
+	file.Close()
+
+	if spool, err = NewSpool(dir, "test", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(spoolBatch("admin")); err != nil {
+		t.Fatal(err)
+	}
+	if users := replayUsers(t, spool, 10); !slices.Equal(users, []string{"root", "admin"}) {
+		t.Errorf("replayed %v, want [root admin]", users)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxSprays bounds the (source IP, password) pairs SprayDetector follows.
+const maxSprays = 100000
+
+type sprayKey struct {
+	remoteHost string
+	password   string
+}
+
+// spray is what a source IP did with a password since first trying it in
+// the window.
+type spray struct {
+	first    time.Time
+	users    map[string]struct{}
+	ports    map[string]struct{}
+	reported bool
+}
+
+// SprayDetector spots password spraying: a source IP trying the same
+// password against many usernames, or against many of the honeypot's ports,
+// within a window, rather than many passwords against a username.
+type SprayDetector struct {
+	window   time.Duration
+	minUsers int
+	minPorts int
+
+	mu        sync.Mutex
+	sprays    map[sprayKey]*spray
+	lastPrune time.Time
+}
+
+// NewSprayDetector returns nil when neither minUsers nor minPorts is set.
+func NewSprayDetector(window time.Duration, minUsers int, minPorts int) *SprayDetector {
+	if minUsers <= 0 && minPorts <= 0 {
+		return nil
+	}
+
+	return &SprayDetector{window: window, minUsers: minUsers, minPorts: minPorts, sprays: map[sprayKey]*spray{}}
+}
+
+// Observe counts the password attempt of sshInfo, returning a "spray" event,
+// a copy of it carrying the usernames and ports the password was tried
+// against, the first time the attempts make a spray in the window.
+func (d *SprayDetector) Observe(sshInfo SSHInfo) (SSHInfo, bool) {
+	if !isPasswordAttempt(sshInfo) || sshInfo.Password == "" {
+		return SSHInfo{}, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := sshInfo.Timestamp
+	d.prune(now)
+
+	key := sprayKey{sshInfo.RemoteHost, sshInfo.Password}
+	s, found := d.sprays[key]
+	if found && now.Sub(s.first) > d.window {
+		delete(d.sprays, key)
+		found = false
+	}
+	if !found {
+		if len(d.sprays) >= maxSprays {
+			return SSHInfo{}, false
+		}
+		s = &spray{first: now, users: map[string]struct{}{}, ports: map[string]struct{}{}}
+		d.sprays[key] = s
+	}
+	if s.reported {
+		return SSHInfo{}, false
+	}
+	// Once enough are seen to tell, the sets stop growing
+	if len(s.users) < max(d.minUsers, 1) {
+		s.users[sshInfo.User] = struct{}{}
+	}
+	if len(s.ports) < max(d.minPorts, 1) {
+		s.ports[sshInfo.LocalPort] = struct{}{}
+	}
+
+	byUsers := d.minUsers > 0 && len(s.users) >= d.minUsers
+	byPorts := d.minPorts > 0 && len(s.ports) >= d.minPorts
+	if !byUsers && !byPorts {
+		return SSHInfo{}, false
+	}
+	s.reported = true
+
+	sshInfo.Function = "spray"
+	sshInfo.SprayUsernames, sshInfo.SprayPorts = len(s.users), len(s.ports)
+	return sshInfo, true
+}
+
+// prune forgets the sprays whose window is over, at most once a window.
+func (d *SprayDetector) prune(now time.Time) {
+	if now.Sub(d.lastPrune) < d.window {
+		return
+	}
+	d.lastPrune = now
+
+	for key, s := range d.sprays {
+		if now.Sub(s.first) > d.window {
+			delete(d.sprays, key)
+		}
+	}
+}
+
+// Capture wraps capture to follow the attempt making a spray with a "spray"
+// event of its own.
+func (d *SprayDetector) Capture(capture func(SSHInfo) bool) func(SSHInfo) bool {
+	if d == nil {
+		return capture
+	}
+
+	return func(sshInfo SSHInfo) bool {
+		captured := capture(sshInfo)
+		if sprayInfo, found := d.Observe(sshInfo); found {
+			slog.Warn("Password spraying", "remote_host", sshInfo.RemoteHost, "usernames", sprayInfo.SprayUsernames, "ports", sprayInfo.SprayPorts)
+			capture(sprayInfo)
+		}
+
+		return captured
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteTime is fixed width, so that times compare as strings.
+const sqliteTime = "2006-01-02T15:04:05.000000000Z"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	id          TEXT PRIMARY KEY,
+	time        TEXT NOT NULL,
+	function    TEXT NOT NULL,
+	protocol    TEXT,
+	session_id  TEXT,
+	remote_host TEXT NOT NULL,
+	user        TEXT,
+	password    TEXT,
+	key_type    TEXT,
+	command     TEXT,
+	country     TEXT,
+	org         TEXT,
+	tool        TEXT,
+	document    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_time ON events (time);
+CREATE INDEX IF NOT EXISTS events_remote_host ON events (remote_host, time);
+`
+
+// SQLiteSink stores events in a local SQLite database, for single node
+// deployments without any external service. The most queried fields get
+// their own columns, the whole EventDocument is kept as JSON in document,
+// queryable with the SQLite JSON functions.
+type SQLiteSink struct {
+	db     *sql.DB
+	tracer trace.Tracer
+}
+
+// NewSQLiteSink opens, or creates, the database at path and its schema.
+func NewSQLiteSink(path string, tracer trace.Tracer) (*SQLiteSink, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite serializes writers anyway, a single connection avoids busy errors.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %v", err)
+	}
+
+	return &SQLiteSink{db: db, tracer: tracer}, nil
+}
+
+func sqliteSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	path := os.Getenv("SQLITE_PATH")
+	if path == "" {
+		return nil, nil
+	}
+
+	return NewSQLiteSink(path, tracer)
+}
+
+func (s *SQLiteSink) Name() string {
+	return "sqlite"
+}
+
+func (s *SQLiteSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToSQLite",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	if err := s.insert(ctx, batch.Events); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Stored %d events", len(batch.Events)))
+	return nil
+}
+
+func (s *SQLiteSink) insert(ctx context.Context, events []Event) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO events
+		(id, time, function, protocol, session_id, remote_host, user, password, key_type, command, country, org, tool, document)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		document := newEventDocument(event)
+		encoded, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.ExecContext(ctx, document.ID, document.Timestamp.Format(sqliteTime), document.Function,
+			nullString(document.Protocol), nullString(document.SessionID), document.RemoteHost, nullString(document.User),
+			nullString(document.Password), nullString(document.KeyType), nullString(document.Command),
+			nullString(document.Country), nullString(document.Org), nullString(document.Tool), string(encoded))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Enforce deletes the events older than before, making the sink a
+// RetentionTarget.
+func (s *SQLiteSink) Enforce(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM events WHERE time < ?", before.UTC().Format(sqliteTime))
+	return err
+}
+
+func (s *SQLiteSink) Close() error {
+	return s.db.Close()
+}
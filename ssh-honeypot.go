@@ -2,32 +2,53 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/cenkalti/backoff/v4"
-	"github.com/gliderlabs/ssh"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/marceloalmeida/ssh-honeypot/enrich"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
-	gossh "golang.org/x/crypto/ssh"
 )
 
 var (
 	DeadlineTimeout = 30 * time.Second
 	IdleTimeout     = 10 * time.Second
-	ipinfoIoToken   = os.Getenv("IPINFOIO_TOKEN")
-	influxdbUrl     = os.Getenv("INFLUXDB_URL")
-	influxdbToken   = os.Getenv("INFLUXDB_TOKEN")
-	influxdbOrg     = os.Getenv("INFLUXDB_ORG")
-	influxdbBucket  = os.Getenv("INFLUXDB_BUCKET")
-	hostKeyPath     = os.Getenv("HOST_KEY_PATH")
+	influxdbUrl     string
+	// influxMeasurement and influxSessionMeasurement are the InfluxDB
+	// measurements of events and of session_end events
+	influxMeasurement        string
+	influxSessionMeasurement string
+	hostKeyPath              string
+	geoipOffline             bool
+	seenIPs                  *SeenFilter
+	geoCache                 *GeoCache
 )
 
+// loadSettings reads the settings kept in globals from the environment, once
+// the configuration file had the chance to provide defaults for it. These
+// only apply at startup, unlike the reloadable Settings.
+func loadSettings() {
+	influxdbUrl = os.Getenv("INFLUXDB_URL")
+	influxMeasurement = getEnv("INFLUXDB_MEASUREMENT", "request")
+	influxSessionMeasurement = getEnv("INFLUXDB_SESSION_MEASUREMENT", "session")
+	hostKeyPath = os.Getenv("HOST_KEY_PATH")
+	geoipOffline = os.Getenv("GEOIP_OFFLINE") == "true"
+}
+
 type IPInfo struct {
 	IP        string  `json:"ip"`
 	City      string  `json:"city"`
@@ -46,24 +67,92 @@ type SSHInfo struct {
 	LocalHost     string
 	LocalPort     string
 	ClientVersion string
+	HASSH         string
+	SessionID     string
 	Password      string
 	Key           string
-	Function      string
-	Timestamp     time.Time
-}
+	KeyType       string
+	// KeyFingerprint and KeyMD5 are the SHA256 and MD5 fingerprints of Key,
+	// in the formats of ssh-keygen -l, and KeyBits its size
+	KeyFingerprint string
+	KeyMD5         string
+	KeyBits        int
+	Function       string
+	Protocol       string
+	Command        string
+	Subsystem      string
+	FileOperation  string
+	Path           string
+	FileSize       int64
+	FileSHA256     string
+	// SampleDuplicate is whether the sample was already in the store,
+	// captured over another connection
+	SampleDuplicate bool
+	// SampleDropped is whether the sample wasn't kept, the store being full
+	SampleDropped bool
+	// YaraMatches are the YARA rules the sample matches
+	YaraMatches []string
+	URL         string
+	// HTTPMethod and UserAgent are those of the requests of the HTTP
+	// listener
+	HTTPMethod    string
+	UserAgent     string
+	ForwardHost   string
+	ForwardPort   string
+	Anomaly       string
+	AnomalyDetail string
+	// Policy is the policy action applied to the connection, unless the
+	// default one
+	Policy  string
+	Node    NodeIdentity
+	Attempt int
+	// AttemptCount is how many identical attempts the event stands for, when
+	// collapsed by the pipeline's Deduper
+	AttemptCount int
+	// SprayUsernames and SprayPorts are how many usernames and ports the
+	// password was tried against, for spray events
+	SprayUsernames int
+	SprayPorts     int
+	// Canarytoken is the kind of the token triggered, for canarytoken events
+	Canarytoken string
+	// Accepted is whether the password attempt let the client in
+	Accepted bool
+	Signals  TimingSignals
+	Duration time.Duration
+	// Channels, BytesIn and BytesOut are the session channels a connection
+	// opened and their traffic, for session_end events
+	Channels  int
+	BytesIn   int64
+	BytesOut  int64
+	Timestamp time.Time
 
-func loadHostKey(hostKeyPath string) (ssh.Signer, error) {
-	keyBytes, err := os.ReadFile(hostKeyPath)
-	if err != nil {
-		return nil, err
-	}
-
-	signer, err := gossh.ParsePrivateKey(keyBytes)
-	if err != nil {
-		return nil, err
-	}
+	// AgentForwarding is whether the client asked for its ssh-agent to be
+	// forwarded to the session
+	AgentForwarding bool
+	// KeystrokeIntervals are the intervals between the keystrokes of a
+	// command line entered in the shell
+	KeystrokeIntervals []time.Duration
+	// Env are the environment variables the client set on the session, as
+	// "NAME=value"
+	Env []string
+	// Term, TermWidth, TermHeight and TermModes are those of the pty
+	// requested for the session, the size being the new one for window
+	// changes
+	Term       string
+	TermWidth  int
+	TermHeight int
+	TermModes  string
+	// X11AuthProtocol, X11AuthCookie and X11Screen are those of an X11
+	// forwarding request
+	X11AuthProtocol string
+	X11AuthCookie   string
+	X11Screen       string
+}
 
-	return signer, nil
+// isPasswordAttempt reports whether sshInfo is a password guess, made with
+// the password or the keyboard-interactive method.
+func isPasswordAttempt(sshInfo SSHInfo) bool {
+	return sshInfo.Function == "password" || sshInfo.Function == "keyboard_interactive"
 }
 
 func getIpInfo(host string, ctx context.Context, tracer trace.Tracer) (IPInfo, error) {
@@ -72,238 +161,957 @@ func getIpInfo(host string, ctx context.Context, tracer trace.Tracer) (IPInfo, e
 		"getIpInfo")
 	defer span.End()
 
-	if ipinfoIoToken != "" {
-		tmp, err := getIpInfoIo(host, childCtx, tracer)
+	if cached, found := geoMemory.Get(ctx, host); found {
+		span.AddEvent("IP info found on cache")
+		metrics.RecordGeoLookup(ctx, "cache")
+		span.SetStatus(codes.Ok, fmt.Sprintf("Got IP info from cache for '%s'", host))
+		return cached, nil
+	}
+
+	// Local lookups are cheap, the disk cache and the seen filter only
+	// spare online ones.
+	if geoCache != nil && geoipCity == nil {
+		if ipInfo, found := geoCache.Get(childCtx, host); found {
+			geoMemory.Set(host, ipInfo, "disk_cache")
+			span.AddEvent("IP info found on disk cache")
+			metrics.RecordGeoLookup(ctx, "disk_cache")
+			span.SetStatus(codes.Ok, fmt.Sprintf("Got IP info from disk cache for '%s'", host))
+			return ipInfo, nil
+		}
+	}
+	// An IP enriched within the seen filter window whose result is no longer
+	// cached, expired or evicted, is left to the offline providers, keeping
+	// the usage of the online ones constant
+	offlineOnly := seenIPs != nil && geoipCity == nil && seenIPs.Contains(host)
+	if offlineOnly {
+		span.AddEvent("IP already enriched within the seen filter window, skipping online providers")
+	}
+
+	ipInfo, provider, err := lookupIpInfo(host, childCtx, tracer, offlineOnly)
+	if err != nil && offlineOnly {
+		slog.DebugContext(childCtx, "IP already enriched within the seen filter window, writing without IP info", "remote_host", host)
+		metrics.RecordGeoLookup(ctx, "seen_filter")
+		span.SetStatus(codes.Ok, fmt.Sprintf("Skipped lookup of '%s', already enriched", host))
+		return IPInfo{IP: host}, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return IPInfo{}, err
+	}
+
+	geoMemory.Set(host, ipInfo, provider)
+	if geoCache != nil && geoipCity == nil {
+		geoCache.Set(childCtx, host, ipInfo)
+	}
+	if seenIPs != nil {
+		seenIPs.Add(host)
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Got IP info for '%s'", host))
+	return ipInfo, nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if subcommand, found := subcommands[os.Args[1]]; found {
+			if err := subcommand(os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					return
+				}
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	configPath, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	reloader, err := NewReloader(configPath)
+	if err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+	loadSettings()
+
+	// The terminal UI shows the last log lines instead
+	var logOutput io.Writer = os.Stderr
+	tui, err := tuiFromEnv()
+	if err != nil {
+		fatal("Failed to start the terminal UI", "error", err)
+	}
+	if tui != nil {
+		logOutput = tui
+	}
+	if err := initLogger(logOutput, getEnv("LOG_FORMAT", "text"), getEnv("LOG_LEVEL", "info")); err != nil {
+		fatal("Failed to configure logging", "error", err)
+	}
+
+	if err := inheritSystemdSockets(); err != nil {
+		fatal("Failed to inherit the sockets from systemd", "error", err)
+	}
+
+	undoRuntime := tuneRuntime()
+	defer undoRuntime()
+
+	shutdown, collectorCheck := initTracer()
+	defer shutdown()
+
+	tracer := otel.Tracer("ssh-honeypot")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	api := NewAPI(currentSettings().APIToken)
+	// Only served beyond the loopback interface with a token, which a
+	// reload can't take away then
+	apiListenAddr, dashboardListenAddr := os.Getenv("API_LISTEN_ADDR"), os.Getenv("DASHBOARD_LISTEN_ADDR")
+	checkAPIExposure := func(token string) error {
+		for _, addr := range []string{apiListenAddr, dashboardListenAddr} {
+			if addr == "" {
+				continue
+			}
+			if err := checkExposure(addr, token); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := checkAPIExposure(currentSettings().APIToken); err != nil {
+		fatal("Failed to configure the API", "error", err)
+	}
+	reloader.OnReload(func(s *Settings) error {
+		if err := checkAPIExposure(s.APIToken); err != nil {
+			return err
+		}
+		api.SetToken(s.APIToken)
+		return nil
+	})
+	health := NewHealth(splitList(os.Getenv("READINESS_IGNORE")), getEnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second))
+	health.Register("otlp", collectorCheck, false)
+	api.HandleProbe("/healthz", health.Handler(true))
+	api.HandleProbe("/readyz", health.Handler(false))
+	api.Handle("/api/config", func(r *http.Request) (any, error) {
+		return currentSettings().View(), nil
+	})
+	// Read by the enrichment of the pipeline, set before it starts
+	seenFilter, err := NewSeenFilter(
+		getEnv("SEEN_FILTER_PATH", "./seen_ips.filter"),
+		getEnvDuration("SEEN_FILTER_WINDOW", 24*time.Hour),
+		uint64(getEnvInt("SEEN_FILTER_CAPACITY", 1000000)),
+		getEnvFloat("SEEN_FILTER_FP_RATE", 0.001),
+	)
+	if err != nil {
+		fatal("Failed to create seen IP filter", "error", err)
+	}
+	seenIPs = seenFilter
+	go persistSeenFilter(seenIPs, time.Minute)
+	defer func() {
+		if err := seenIPs.Save(); err != nil {
+			slog.Error("Failed to save seen IP filter", "error", err)
+		}
+	}()
+
+	// Set to empty, GEO_CACHE_PATH disables the cache
+	geoCachePath, found := os.LookupEnv("GEO_CACHE_PATH")
+	if !found {
+		geoCachePath = "./geo_cache.db"
+	}
+	if geoCachePath != "" {
+		if geoCache, err = NewGeoCache(geoCachePath, getEnvDuration("GEO_CACHE_TTL", 7*24*time.Hour)); err != nil {
+			fatal("Failed to open geolocation cache", "error", err)
+		}
+		defer geoCache.Close()
+		go purgeGeoCache(geoCache, time.Hour)
+	}
+
+	listeners := map[string]Listener{}
+	allowlistLog, err := allowlistLogFromEnv()
+	if err != nil {
+		fatal("Failed to open allowlist log", "error", err)
+	}
+
+	// Alerted on by the pipeline, and looked for in the attempts below
+	honeytokens := NewHoneytokens(splitList(os.Getenv("ALERT_HONEYTOKENS")))
+	var capture func(SSHInfo) bool
+	forwardAddr := os.Getenv("FLEET_FORWARD_ADDR")
+	if forwardAddr != "" {
+		forwarder, err := NewFleetForwarder(forwardAddr, os.Getenv("FLEET_TOKEN"), os.Getenv("FLEET_TLS_CA"), os.Getenv("FLEET_TLS_CERT"), os.Getenv("FLEET_TLS_KEY"), getEnvInt("FLEET_QUEUE_SIZE", 4096))
 		if err != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			return IPInfo{}, err
-		}
-
-		span.AddEvent("Got IP info from ipinfo.io")
-		span.SetStatus(codes.Ok, fmt.Sprintf("Got IP info from ipinfo.io for '%s'", host))
-
-		return IPInfo{
-			IP:        host,
-			City:      tmp.City,
-			Region:    tmp.Region,
-			Country:   tmp.Country,
-			Latitude:  tmp.Latitude,
-			Longitude: tmp.Longitude,
-			Org:       tmp.Org,
-			Timezone:  tmp.Timezone,
-		}, nil
+			fatal("Failed to configure fleet forwarding", "error", err)
+		}
+		forwarder.Start()
+		defer forwarder.Close()
+		capture = forwarder.Capture
+		slog.Info("Forwarding events to fleet server", "addr", forwardAddr, "node_id", node.ID)
 	} else {
-		tmp, err := getIpApi(host, childCtx, tracer)
+		pipeline, stopPipeline := startPipeline(api, health, reloader, tui, honeytokens, tracer)
+		defer stopPipeline()
+		capture = pipeline.Capture
+	}
+	// Edges leave the events derived from the attempts to the fleet server,
+	// seeing those of the whole fleet
+	if forwardAddr == "" {
+		// Attempts using a honeytoken are followed by an event of their own
+		capture = honeytokens.Capture(capture)
+		// So are the attempts making a password spray
+		capture = NewSprayDetector(getEnvDuration("SPRAY_WINDOW", 10*time.Minute),
+			getEnvInt("SPRAY_MIN_USERNAMES", 5), getEnvInt("SPRAY_MIN_PORTS", 3)).Capture(capture)
+		// And the first events of clients never seen before
+		clientVersions, err := clientVersionStatsFromEnv()
 		if err != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			return IPInfo{}, err
+			fatal("Failed to configure client version statistics", "error", err)
 		}
+		defer func() {
+			if err := clientVersions.Save(); err != nil {
+				slog.Error("Failed to save client version statistics", "error", err)
+			}
+		}()
+		go clientVersions.Run(time.Minute)
+		capture = clientVersions.Capture(capture)
+		api.Handle("/api/client-versions", func(r *http.Request) (any, error) {
+			return clientVersions.Clients(), nil
+		})
+	}
+	// None of which sees the events of allowlisted IPs
+	capture = allowlistCapture(capture, allowlistLog)
+	// Closed once the listeners are stopped, before the pipeline
+	captureGate := NewCaptureGate(capture)
+	capture = captureGate.Capture
 
-		span.AddEvent("Got IP info from ip-api.com'")
-		span.SetStatus(codes.Ok, fmt.Sprintf("Got IP info from ip-api.com for '%s'", host))
+	// The events of the edges go through the same capture as the local ones
+	if fleetListenAddr := os.Getenv("FLEET_LISTEN_ADDR"); fleetListenAddr != "" && forwardAddr == "" {
+		if err := checkFleetExposure(fleetListenAddr, os.Getenv("FLEET_TOKEN"), os.Getenv("FLEET_TLS_CLIENT_CA")); err != nil {
+			fatal("Failed to configure fleet server", "error", err)
+		}
+		fleetServer, err := NewFleetServer(capture, os.Getenv("FLEET_TOKEN"), os.Getenv("FLEET_TLS_CERT"), os.Getenv("FLEET_TLS_KEY"), os.Getenv("FLEET_TLS_CLIENT_CA"))
+		if err != nil {
+			fatal("Failed to configure fleet server", "error", err)
+		}
+		listeners["fleet"] = Listener{
+			Serve: func() error {
+				return fleetServer.ListenAndServe(fleetListenAddr)
+			},
+			Shutdown: fleetServer.Shutdown,
+		}
+	}
 
-		return IPInfo{
-			IP:        host,
-			City:      tmp.City,
-			Region:    tmp.Region,
-			Country:   tmp.Country,
-			Latitude:  tmp.Lat,
-			Longitude: tmp.Lon,
-			Org:       tmp.Org,
-			Timezone:  tmp.Timezone,
-		}, nil
+	if hostKeyPath == "" {
+		hostKeyPath = "./host_key"
 	}
-}
+	// Listeners with host keys of their own get a ring of their own, the
+	// others share the default one
+	sshPorts := splitList(getEnv("SSH_PORT", "2222"))
+	var hostKeyRings []*HostKeyRing
+	ringsByPath := map[string]*HostKeyRing{}
+	listenerHostKeys := map[string]*HostKeyRing{}
+	for _, port := range sshPorts {
+		path := getEnv("HOST_KEY_PATH_"+port, hostKeyPath)
+		hostKeys, found := ringsByPath[path]
+		if !found {
+			keyTypes := splitList(getEnv("HOST_KEY_TYPES_"+port, getEnv("HOST_KEY_TYPES", "rsa")))
+			hostKeys, err = NewHostKeyRing(path, keyTypes, getEnvDuration("HOST_KEY_ROTATE_OVERLAP", 24*time.Hour), tracer)
+			if err != nil {
+				fatal("Failed to load host keys", "port", port, "error", err)
+			}
+			go hostKeys.Run(ctx, getEnvDuration("HOST_KEY_ROTATE_INTERVAL", 0))
+			ringsByPath[path] = hostKeys
+			hostKeyRings = append(hostKeyRings, hostKeys)
+		}
+		listenerHostKeys[port] = hostKeys
+	}
+	api.Handle("/api/host-keys", func(r *http.Request) (any, error) {
+		var keys []HostKeyInfo
+		for _, hostKeys := range hostKeyRings {
+			keys = append(keys, hostKeys.Keys()...)
+		}
+		return keys, nil
+	})
+	api.HandleAction("/api/host-keys/rotate", func(r *http.Request) (any, error) {
+		var keys []HostKeyInfo
+		for _, hostKeys := range hostKeyRings {
+			if err := hostKeys.Rotate(); err != nil {
+				return nil, err
+			}
+			keys = append(keys, hostKeys.Keys()...)
+		}
+		return keys, nil
+	})
 
-func processRequest(writeAPI InfluxdbWriteAPI, sshContext ssh.Context, ctx context.Context, tracer trace.Tracer) error {
-	childCtx, span := tracer.Start(
-		ctx,
-		"processRequest")
-	defer span.End()
+	persona, err := personaFromEnv()
+	if err != nil {
+		fatal("Failed to load the shell persona", "error", err)
+	}
+	var shell *Shell
+	if os.Getenv("SHELL_ENABLED") == "true" {
+		if shell, err = shellFromEnv(persona, tracer); err != nil {
+			fatal("Failed to set up the shell", "error", err)
+		}
+	}
 
-	remote_host, remote_port, _ := net.SplitHostPort(sshContext.RemoteAddr().String())
-	local_host, local_port, _ := net.SplitHostPort(sshContext.LocalAddr().String())
+	// Producers of events running outside of the listeners, stopped with ctx
+	var producers sync.WaitGroup
+	canarytokens, err := canarytokensFromEnv(tracer)
+	if err != nil {
+		fatal("Failed to set up Canarytokens", "error", err)
+	}
+	if canarytokens != nil {
+		if shell != nil {
+			if err := canarytokens.Plant(shell.fileSystem); err != nil {
+				fatal("Failed to plant Canarytokens", "error", err)
+			}
+		}
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			canarytokens.Run(ctx, capture, getEnvDuration("CANARYTOKENS_POLL_INTERVAL", 10*time.Minute))
+		}()
+	}
 
-	sshInfo := SSHInfo{
-		User:          sshContext.User(),
-		RemoteHost:    remote_host,
-		RemotePort:    remote_port,
-		LocalHost:     local_host,
-		LocalPort:     local_port,
-		ClientVersion: sshContext.ClientVersion(),
+	activeSessions := NewSessionTracker()
+	api.Handle("/api/sessions", func(r *http.Request) (any, error) {
+		return activeSessions.Sessions(), nil
+	})
+	if tui != nil {
+		tui.WatchSessions(activeSessions)
 	}
 
-	sshInfo.Timestamp = time.Now()
+	network, _, err := listenAddrs(sshPorts[0])
+	if err != nil {
+		fatal("Failed to configure the listeners", "error", err)
+	}
 
-	function := sshContext.Value("Function")
-	if function != nil {
-		sshInfo.Function = function.(string)
+	// Serves TARPIT_PORT, and the SSH connections the policies send to it
+	tarpit := tarpitFromEnv(capture)
+	serverEnv := SSHServerEnv{
+		Capture:             capture,
+		Shell:               shell,
+		Tarpit:              tarpit,
+		Sessions:            activeSessions,
+		PolicyLookupTimeout: getEnvDuration("POLICY_LOOKUP_TIMEOUT", 2*time.Second),
+		Tracer:              tracer,
 	}
 
-	password := sshContext.Value("Password")
-	if password != nil {
-		sshInfo.Password = password.(string)
+	slog.Info("Connection timeouts", "max_timeout", currentSettings().MaxTimeout, "idle_timeout", currentSettings().IdleTimeout)
+
+	// Shared by the SSH listeners and those of the other protocols
+	connLimiter, err := connLimiterFromEnv()
+	if err != nil {
+		fatal("Failed to set up the connection limit", "error", err)
+	}
+	if connLimiter != nil {
+		slog.Info("Connection limit", "max_connections", cap(connLimiter.slots), "overflow", connLimiter.policy)
 	}
 
-	key := sshContext.Value("Key")
-	if key != nil {
-		sshInfo.Key = key.(string)
+	serviceListeners, err := protocolListeners(ServiceEnv{Hostname: persona.Hostname, OS: persona.OSName + " " + persona.OSVersionID, Capture: capture}, network, connLimiter)
+	if err != nil {
+		fatal("Failed to configure the listeners", "error", err)
+	}
+	for name, listener := range serviceListeners {
+		listeners[name] = listener
 	}
 
-	if (net.ParseIP(remote_host).IsPrivate() || net.ParseIP(remote_host).IsLoopback()) && os.Getenv("INFLUXDB_WRITE_PRIVATE_IPS") != "true" {
-		span.AddEvent("Request from private or loopback IP, or 'INFLUXDB_WRITE_PRIVATE_IPS' is set, skipping write to InfluxDB")
-		log.Printf("Request to '%s' from private or loopback IP: '%s', or 'INFLUXDB_WRITE_PRIVATE_IPS' is set to '%s', skipping write to InfluxDB", sshInfo.Function, remote_host, os.Getenv("INFLUXDB_WRITE_PRIVATE_IPS"))
-		sshContext.Done()
-	} else {
-		span.AddEvent("Request inccoming")
-		log.Printf("Request to '%s' from '%s'", sshInfo.Function, remote_host)
-		ipInfo, err := getIpInfo(sshInfo.RemoteHost, childCtx, tracer)
+	if tarpitPort := os.Getenv("TARPIT_PORT"); tarpitPort != "" {
+		_, tarpitAddrs, err := listenAddrs(tarpitPort)
 		if err != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			log.Printf("Failed to get IP info: %v", err)
-			return err
+			fatal("Failed to configure the listeners", "error", err)
+		}
+		listeners["tarpit"] = Listener{
+			Serve: func() error {
+				return tarpit.ListenAndServe(network, tarpitAddrs)
+			},
+			Shutdown: tarpit.Shutdown,
 		}
+		slog.Info("Starting tarpit", "port", tarpitPort)
+	}
 
-		if writeToInfluxDB(writeAPI, ipInfo, sshInfo, childCtx, tracer) != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			log.Printf("Failed to write to InfluxDB: %v", err)
-			return err
+	go reloader.Run(ctx, getEnvDuration("CONFIG_WATCH_INTERVAL", 5*time.Second))
+
+	supervisor := NewSupervisor()
+	for _, port := range sshPorts {
+		_, addrs, err := listenAddrs(port)
+		if err != nil {
+			fatal("Failed to configure the listeners", "error", err)
 		}
+		server := newServer(port, listenerHostKeys[port], serverEnv)
+
+		// A single listener keeps the name it had before ports could be added
+		name := "ssh"
+		if len(sshPorts) > 1 {
+			name = "ssh-" + port
+		}
+		slog.Info("Starting ssh server", "port", port, "network", network, "addrs", addrs, "listener", name)
+		supervisor.Supervise(ctx, tracer, name, Listener{
+			Serve: func() error {
+				listener, err := connLimiter.Listen(network, addrs)
+				if err != nil {
+					return err
+				}
+				return server.Serve(listener)
+			},
+			Shutdown: func(ctx context.Context) error {
+				err := server.Shutdown(ctx)
+				if err != nil {
+					server.Close()
+				}
+				return err
+			},
+		})
+		health.Register(name, listenerCheck(supervisor, name), true)
+	}
+	for name, listener := range listeners {
+		supervisor.Supervise(ctx, tracer, name, listener)
+	}
+	if apiListenAddr != "" {
+		supervisor.Supervise(ctx, tracer, "api", Listener{
+			Serve: func() error {
+				return api.ListenAndServe(apiListenAddr)
+			},
+			Shutdown: api.Shutdown,
+		})
+	}
+	if pprofPort := os.Getenv("PPROF_PORT"); pprofPort != "" {
+		slog.Info("Serving profiles", "addr", "127.0.0.1:"+pprofPort)
+		supervisor.Supervise(ctx, tracer, "pprof", debugListener(pprofPort))
+	}
+	if dashboardListenAddr != "" {
+		dashboard := NewDashboard(api)
+		supervisor.Supervise(ctx, tracer, "dashboard", Listener{
+			Serve: func() error {
+				return dashboard.ListenAndServe(dashboardListenAddr)
+			},
+			Shutdown: dashboard.Shutdown,
+		})
+	}
+
+	listenerPorts := append(slices.Clone(sshPorts), os.Getenv("TELNET_PORT"), os.Getenv("TARPIT_PORT"))
+	if unmatched := systemdSockets.Unmatched(listenerPorts); len(unmatched) > 0 {
+		slog.Warn("Sockets passed by systemd match no listener port", "addrs", unmatched)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Failed to notify systemd of readiness", "error", err)
+	}
+	watchdogDone := make(chan struct{})
+	go runSystemdWatchdog(watchdogDone)
+
+	// Quitting the terminal UI stops the honeypot as SIGINT does, the
+	// terminal being restored before the shutdown is logged
+	tuiDone := make(chan struct{})
+	if tui != nil {
+		go func() {
+			defer close(tuiDone)
+			if err := tui.Run(ctx, stop); err != nil {
+				slog.Error("Terminal UI failed", "error", err)
+			}
+		}()
+	} else {
+		close(tuiDone)
 	}
 
-	span.AddEvent("Request successfully processed")
-	span.SetStatus(codes.Ok, fmt.Sprintf("Request to '%s' from '%s' successfully processed", sshInfo.Function, remote_host))
-	return nil
+	// On SIGINT or SIGTERM, stop accepting connections and give the open
+	// ones a grace period. The deferred calls then flush the pipeline, the
+	// InfluxDB client and the tracer provider before exiting.
+	<-ctx.Done()
+	stop()
+	<-tuiDone
+	sdNotify("STOPPING=1")
+	close(watchdogDone)
+	gracePeriod := getEnvDuration("SHUTDOWN_GRACE_PERIOD", 5*time.Second)
+	slog.Info("Shutting down", "grace_period", gracePeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	// Releases the SSH connections trapped by the policies as well
+	tarpit.Shutdown(shutdownCtx)
+	supervisor.Shutdown(shutdownCtx)
+	producers.Wait()
+	captureGate.Close()
+	if allowlistLog != nil {
+		if err := allowlistLog.Close(); err != nil {
+			slog.Error("Failed to close allowlist log", "error", err)
+		}
+	}
+	slog.Info("Listeners stopped, flushing")
 }
 
-func processRequestExponentialBackoff(writeAPI InfluxdbWriteAPI, sshContext ssh.Context, ctx context.Context, tracer trace.Tracer) error {
-	childCtx, span := tracer.Start(
-		ctx,
-		"processRequestExponentialBackoff")
-	defer span.End()
+// startPipeline sets up the processing of captured events: enrichment,
+// analysis, alerting and storage in the configured sinks, registering the analysis
+// endpoints on api, the checks of its dependencies on health and what tui
+// shows, when set, the use of honeytokens always being alerted on. The
+// returned function stops it, flushing what is queued.
+func startPipeline(api *API, health *Health, reloader *Reloader, tui *TUI, honeytokens *Honeytokens, tracer trace.Tracer) (*Pipeline, func()) {
+	if err := openGeoIP(os.Getenv("GEOIP_CITY_DB"), os.Getenv("GEOIP_ASN_DB")); err != nil {
+		fatal("Failed to open GeoLite2 databases", "error", err)
+	}
+	if err := setupGeoChain(splitList(getEnv("GEO_PROVIDERS", "geolite2,ipinfo.io,ip-api.com")),
+		getEnvInt("GEO_BREAKER_THRESHOLD", 3), getEnvDuration("GEO_BREAKER_COOLDOWN", time.Minute)); err != nil {
+		fatal("Failed to configure geolocation", "error", err)
+	}
+	slog.Info("Geolocation providers", "providers", geoProviderNames())
+	memoryCache, err := geoMemoryCacheFromEnv()
+	if err != nil {
+		fatal("Failed to configure geolocation cache", "error", err)
+	}
+	geoMemory = memoryCache
+	metrics.ObserveGeoCache(func() int64 { return int64(memoryCache.Len()) })
+
+	var anonymizer *Anonymizer
+	if fields := splitList(os.Getenv("ANONYMIZE")); len(fields) > 0 {
+		var err error
+		if anonymizer, err = NewAnonymizer(fields, os.Getenv("ANONYMIZE_CREDENTIALS"), os.Getenv("ANONYMIZE_SALT")); err != nil {
+			fatal("Failed to configure anonymization", "error", err)
+		}
+	}
+
+	var sinks []Sink
+	var encoder BatchEncoder
+	var client influxdb2.Client
+	var writeAPI InfluxdbWriteAPI
+	var influxTarget InfluxTarget
+	if influxdbUrl != "" {
+		var err error
+		if influxTarget, err = influxTargetFromEnv(); err != nil {
+			fatal("Failed to configure InfluxDB", "error", err)
+		}
+		slog.Info("Writing events to InfluxDB", "version", influxTarget.Version, "bucket", influxTarget.Bucket)
+
+		client = newInfluxDBClient(influxdbUrl, influxTarget)
+		writeAPI = newInfluxdbWriteAPI(client, influxTarget)
+
+		health.Register("influxdb", func(ctx context.Context) error {
+			_, err := client.Ping(ctx)
+			return err
+		}, false)
+
+		tags, err := influxTagsFromEnv()
+		if err != nil {
+			fatal("Failed to configure InfluxDB", "error", err)
+		}
+		encoder = LineProtocolEncoder{Measurement: influxMeasurement, SessionMeasurement: influxSessionMeasurement, Tags: tags}
+		sinks = append(sinks, influxSink{writeAPI: writeAPI, tracer: tracer})
+	}
+
+	var retentionTargets []RetentionTarget
+	var closers []io.Closer
+	for _, entry := range sinkRegistry {
+		sink, err := entry.fromEnv(tracer)
+		if err != nil {
+			fatal("Failed to set up sink", "env", entry.env, "error", err)
+		}
+		if sink == nil {
+			continue
+		}
+
+		slog.Info("Writing events to sink", "sink", sink.Name())
+		sinks = append(sinks, sink)
+		if target, ok := sink.(RetentionTarget); ok {
+			retentionTargets = append(retentionTargets, target)
+		}
+		if closer, ok := sink.(io.Closer); ok {
+			closers = append(closers, closer)
+		}
+	}
+
+	if len(sinks) == 0 {
+		envs := []string{"INFLUXDB_URL"}
+		for _, entry := range sinkRegistry {
+			envs = append(envs, entry.env)
+		}
+		fatal("No event sink configured, set one of " + strings.Join(envs, ", "))
+	}
 
-	backoffSettings := backoff.NewExponentialBackOff()
-	backoffSettings.MaxElapsedTime = 30 * time.Minute
-	backoffContext := backoff.WithContext(backoffSettings, childCtx)
+	config := pipelineConfigFromEnv()
+	fanout := NewFanout(sinks, config.WriteMaxElapsed, tracer)
+	if anonymizer != nil {
+		if err := fanout.Anonymize(anonymizer, splitList(os.Getenv("ANONYMIZE_SINKS"))); err != nil {
+			fatal("Failed to configure anonymization", "error", err)
+		}
+		if fanout.Anonymized("influxdb") {
+			encoder = AnonymizingEncoder{BatchEncoder: encoder, Anonymizer: anonymizer}
+		}
+	}
+	if dir := os.Getenv("SPOOL_DIR"); dir != "" {
+		if err := fanout.EnableSpools(dir, int64(getEnvInt("SPOOL_MAX_SIZE", 100<<20))); err != nil {
+			fatal("Failed to open spool", "error", err)
+		}
+		go fanout.ReplaySpools(getEnvDuration("SPOOL_REPLAY_INTERVAL", 30*time.Second))
+	}
+	pipeline := NewPipeline(config, encoder, fanout.Write, tracer)
 
-	operation := func() error {
-		return processRequest(writeAPI, sshContext, backoffContext.Context(), tracer)
+	fingerprints, err := LoadFingerprintDB(os.Getenv("CLIENT_FINGERPRINTS_PATH"))
+	if err != nil {
+		fatal("Failed to load client fingerprints", "error", err)
+	}
+	pipeline.Annotate(fingerprints.Annotate)
+	// The reports of the reputation enrichers, bounded like the geolocation
+	// cache
+	enrichCache := NewLRUCache[string, any](getEnvInt("ENRICH_CACHE_SIZE", 100000), 0, nil, nil)
+	if apiKey := os.Getenv("ABUSEIPDB_API_KEY"); apiKey != "" {
+		abuseIPDB := enrich.NewAbuseIPDB(apiKey,
+			enrich.WithCache(enrichCache),
+			enrich.WithCacheTTL(getEnvDuration("ABUSEIPDB_CACHE_TTL", 24*time.Hour)),
+			enrich.WithDailyLimit(getEnvInt("ABUSEIPDB_DAILY_LIMIT", 1000)),
+			enrich.WithTracer(tracer))
+		pipeline.Annotate(annotateAbuseIPDB(abuseIPDB))
+	}
+	if os.Getenv("GREYNOISE_ENABLED") == "true" {
+		greyNoise := enrich.NewGreyNoise(os.Getenv("GREYNOISE_API_KEY"),
+			enrich.WithCache(enrichCache),
+			enrich.WithCacheTTL(getEnvDuration("GREYNOISE_CACHE_TTL", 24*time.Hour)),
+			enrich.WithEnterprise(os.Getenv("GREYNOISE_ENTERPRISE") == "true"),
+			enrich.WithTracer(tracer))
+		pipeline.Annotate(annotateGreyNoise(greyNoise))
 	}
+	if apiKey := os.Getenv("VIRUSTOTAL_API_KEY"); apiKey != "" {
+		virusTotal := enrich.NewVirusTotal(apiKey,
+			enrich.WithCache(enrichCache),
+			enrich.WithCacheTTL(getEnvDuration("VIRUSTOTAL_CACHE_TTL", 7*24*time.Hour)),
+			enrich.WithMinuteLimit(getEnvInt("VIRUSTOTAL_MINUTE_LIMIT", 4)),
+			enrich.WithDailyLimit(getEnvInt("VIRUSTOTAL_DAILY_LIMIT", 500)),
+			enrich.WithTracer(tracer))
+		pipeline.Annotate(annotateVirusTotal(virusTotal))
+	}
+	if zones := splitList(os.Getenv("DNSBL_ZONES")); len(zones) > 0 {
+		dnsbl := enrich.NewDNSBL(zones,
+			enrich.WithCache(enrichCache),
+			enrich.WithCacheTTL(getEnvDuration("DNSBL_CACHE_TTL", time.Hour)),
+			enrich.WithTimeout(getEnvDuration("DNSBL_TIMEOUT", 2*time.Second)),
+			enrich.WithTracer(tracer))
+		pipeline.Annotate(annotateDNSBL(dnsbl))
+	}
+	pipeline.Annotate(annotateHumanLikelihood)
+	pipeline.Annotate(annotatePassword)
 
-	err := backoff.Retry(operation, backoffContext)
+	wordlists, err := LoadWordlists(splitList(os.Getenv("PASSWORD_WORDLISTS")))
 	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		log.Printf("Failed to process request: %v", err)
-		return err
+		fatal("Failed to load password wordlists", "error", err)
 	}
+	pipeline.Annotate(wordlists.Annotate)
+	pipeline.Annotate(annotateAttackTechniques)
 
-	span.AddEvent("Successfully processed request")
-	span.SetStatus(codes.Ok, "Successfully processed request")
-	log.Printf("Successfully processed request")
-	return nil
-}
+	attackers, err := NewAttackerStore(getEnv("ATTACKER_STORE_PATH", "./attackers.json"), getEnvDuration("ATTACKER_RETENTION", 30*24*time.Hour))
+	if err != nil {
+		fatal("Failed to load attacker store", "error", err)
+	}
+	go persistAttackerStore(attackers, time.Minute)
+	pipeline.Annotate(attackers.Annotate)
 
-func main() {
-	shutdown := initTracer()
-	defer shutdown()
+	keyIndex, err := NewKeyIndex(os.Getenv("KEY_CAMPAIGNS_PATH"))
+	if err != nil {
+		fatal("Failed to load key campaigns", "error", err)
+	}
+	pipeline.Annotate(keyIndex.Annotate)
 
-	tracer := otel.Tracer("ssh-honeypot")
-	ctx := context.Background()
+	campaigns := NewCampaignClusterer(
+		getEnvInt("CAMPAIGN_MIN_CREDENTIALS", 3),
+		getEnvFloat("CAMPAIGN_SIMILARITY", 0.6),
+		getEnvDuration("CAMPAIGN_TTL", 7*24*time.Hour),
+		os.Getenv("CAMPAIGN_MATCH_HASSH") == "true")
+	pipeline.Annotate(campaigns.Annotate)
 
-	if influxdbUrl == "" {
-		log.Fatal("INFLUXDB_URL is not set")
+	notifiers, err := notifiersFromEnv()
+	if err != nil {
+		fatal("Failed to configure notifiers", "error", err)
+	}
+	alertRules := func(ruleNames []string) []string {
+		ruleNames = honeytokens.AlertRules(ruleNames)
+		if os.Getenv("CANARYTOKENS_PATH") != "" {
+			ruleNames = withAlertRule(ruleNames, "canarytoken")
+		}
+		return ruleNames
+	}
+	alerter, err := NewAlerter(alertRules(currentSettings().AlertRules), notifiers, os.Getenv("DASHBOARD_URL"),
+		NewAlertThrottle(getEnvDuration("ALERT_DEDUP_WINDOW", 10*time.Minute), getEnvInt("ALERT_RATE_LIMIT", 30)), tracer)
+	if err != nil {
+		fatal("Failed to configure alerting", "error", err)
 	}
+	alerter.Start()
+	reloader.OnReload(func(s *Settings) error {
+		return alerter.SetRules(alertRules(s.AlertRules))
+	})
+	pipeline.Observe(alerter.Observe)
 
-	if influxdbToken == "" {
-		log.Fatal("INFLUXDB_TOKEN is not set")
+	// Annotations are alerts of their own rules, delivered to dashboards
+	var annotators []Notifier
+	if grafanaURL := os.Getenv("GRAFANA_URL"); grafanaURL != "" {
+		annotators = append(annotators, NewGrafanaAnnotator(grafanaURL, os.Getenv("GRAFANA_API_KEY"), os.Getenv("GRAFANA_DASHBOARD_UID")))
+	}
+	if os.Getenv("ANNOTATION_INFLUXDB") == "true" {
+		if client == nil {
+			fatal("ANNOTATION_INFLUXDB is set without INFLUXDB_URL")
+		}
+		annotators = append(annotators, InfluxAnnotator{writeAPI: writeAPI})
+	}
+	var annotator *Alerter
+	if len(annotators) > 0 {
+		annotator, err = NewAlerter(splitList(getEnv("ANNOTATION_RULES", "first_seen_ip,session,payload")), annotators, "",
+			NewAlertThrottle(getEnvDuration("ALERT_DEDUP_WINDOW", 10*time.Minute), 0), tracer)
+		if err != nil {
+			fatal("Failed to configure annotations", "error", err)
+		}
+		annotator.Start()
+		pipeline.Observe(annotator.Observe)
 	}
 
-	if influxdbOrg == "" {
-		log.Fatal("INFLUXDB_ORG is not set")
+	var banner *Banner
+	if threshold := getEnvInt("BAN_THRESHOLD", 0); threshold > 0 {
+		logPath, command, banURL := os.Getenv("BAN_LOG_PATH"), os.Getenv("BAN_COMMAND"), os.Getenv("BAN_URL")
+		if logPath == "" && command == "" && banURL == "" {
+			fatal("BAN_THRESHOLD is set without BAN_LOG_PATH, BAN_COMMAND or BAN_URL")
+		}
+		banner = NewBanner(threshold, getEnvDuration("BAN_FIND_TIME", 10*time.Minute), getEnvDuration("BAN_TIME", time.Hour), logPath, command, banURL, tracer)
+		banner.Start()
+		pipeline.Observe(banner.Observe)
 	}
 
-	if influxdbBucket == "" {
-		log.Fatal("INFLUXDB_BUCKET is not set")
+	credentialStats := NewCredentialStats(getEnvInt("CREDENTIAL_STATS_TOP_N", 10))
+	pipeline.Observe(func(ctx context.Context, event Event) {
+		credentialStats.Observe(ctx, anonymizer.Anonymize(event))
+	})
+	if interval := getEnvDuration("CREDENTIAL_STATS_INTERVAL", 5*time.Minute); client != nil && interval > 0 {
+		go writeCredentialStats(credentialStats, writeAPI, interval, tracer)
+	}
+
+	geohashes := NewGeohashAggregator(getEnvInt("GEOHASH_PRECISION", 4))
+	pipeline.Observe(geohashes.Observe)
+	if interval := getEnvDuration("GEOHASH_INTERVAL", time.Minute); client != nil && interval > 0 {
+		go writeGeohashes(geohashes, writeAPI, interval, tracer)
 	}
 
-	client := influxdb2.NewClient(influxdbUrl, influxdbToken)
-	defer client.Close()
+	recentEvents := NewRecentEvents(getEnvInt("API_RECENT_EVENTS", 100), anonymizer)
+	pipeline.Observe(recentEvents.Observe)
+	sources := NewSourceCounter()
+	pipeline.Observe(sources.Observe)
+	sourceStats := NewSourceStats()
+	pipeline.Observe(func(ctx context.Context, event Event) {
+		sourceStats.Observe(ctx, anonymizer.Anonymize(event))
+	})
+	attackMap := NewAttackMap()
+	pipeline.Observe(func(ctx context.Context, event Event) {
+		attackMap.Observe(ctx, anonymizer.Anonymize(event))
+	})
+	liveStats := NewLiveStats(credentialStats, sourceStats, getEnvInt("CREDENTIAL_STATS_TOP_N", 10))
+	pipeline.Observe(liveStats.Observe)
+	metrics.ObserveLive(liveStats.Gauges)
+	stream := NewEventStream(anonymizer)
+	pipeline.Observe(stream.Observe)
+	api.HandleStream("/events", stream)
 
-	writeAPI := InfluxdbWriteAPI{
-		WriteAPIBlocking: client.WriteAPIBlocking(influxdbOrg, influxdbBucket),
-		WriteAPI:         client.WriteAPI(influxdbOrg, influxdbBucket),
+	if taxiiURL := os.Getenv("TAXII_PUSH_URL"); os.Getenv("STIX_ENABLED") == "true" || taxiiURL != "" {
+		feed := NewStixFeed(getEnv("STIX_IDENTITY", "ssh-honeypot"), getEnvDuration("STIX_RETENTION", 7*24*time.Hour), anonymizer)
+		pipeline.Observe(feed.Observe)
+		api.HandleGet("/taxii2/", feed)
+		if taxiiURL != "" {
+			pusher := NewTAXIIPusher(feed, taxiiURL, os.Getenv("TAXII_USERNAME"), os.Getenv("TAXII_PASSWORD"), tracer)
+			go pusher.Run(getEnvDuration("TAXII_PUSH_INTERVAL", time.Hour))
+		}
 	}
-	defer writeAPI.WriteAPI.Flush()
 
-	ssh.Handle(func(s ssh.Session) {
-		s.Context().SetValue("Function", "session")
+	var misp *MISPPublisher
+	if mispURL := os.Getenv("MISP_URL"); mispURL != "" {
+		misp = NewMISPPublisher(mispURL, os.Getenv("MISP_API_KEY"), getEnvInt("MISP_DISTRIBUTION", 0), getEnvInt("MISP_THREAT_LEVEL", 3),
+			splitList(os.Getenv("MISP_TAGS")), anonymizer, tracer)
+		pipeline.Observe(misp.Observe)
+		go misp.Run(getEnvDuration("MISP_INTERVAL", time.Hour))
+	}
 
-		go processRequestExponentialBackoff(writeAPI, s.Context(), ctx, tracer)
+	var dshield *DShieldSubmitter
+	if os.Getenv("DSHIELD_ENABLED") == "true" {
+		userID, apiKey := os.Getenv("DSHIELD_USER_ID"), os.Getenv("DSHIELD_API_KEY")
+		if userID == "" || apiKey == "" {
+			fatal("DSHIELD_USER_ID and DSHIELD_API_KEY are required to submit to DShield")
+		}
+		dshield, err = NewDShieldSubmitter(getEnv("DSHIELD_URL", "https://secure.dshield.org/api/file/sshlog"), userID, apiKey, anonymizer, tracer)
+		if err != nil {
+			fatal("Failed to configure DShield submission", "error", err)
+		}
+		pipeline.Observe(dshield.Observe)
+		go dshield.Run(getEnvDuration("DSHIELD_INTERVAL", 30*time.Minute))
+	}
 
-		log.Printf("Opened connection from '%s' to '%s@%s'", s.RemoteAddr().String(), s.User(), s.LocalAddr().String())
+	abuseReporter, err := abuseIPDBReporterFromEnv(anonymizer, tracer)
+	if err != nil {
+		fatal("Failed to configure AbuseIPDB reporting", "error", err)
+	}
+	if abuseReporter != nil {
+		pipeline.Observe(abuseReporter.Observe)
+		go abuseReporter.Run()
+	}
 
-		i := 0
-		for {
-			i += 1
-			log.Printf("Session active seconds: %d", i)
-			select {
-			case <-time.After(time.Second):
-				continue
-			case <-s.Context().Done():
-				log.Printf("Closed connection from '%s' to '%s@%s'", s.RemoteAddr().String(), s.User(), s.LocalAddr().String())
-				return
+	xarf, err := xarfReporterFromEnv(anonymizer, tracer)
+	if err != nil {
+		fatal("Failed to configure X-ARF abuse reports", "error", err)
+	}
+	if xarf != nil {
+		pipeline.Observe(xarf.Observe)
+		go xarf.Run(getEnvDuration("XARF_INTERVAL", time.Hour))
+	}
+
+	if interval := getEnvDuration("REPORT_INTERVAL", 0); interval > 0 {
+		var webhook *ReportWebhook
+		if webhookURL := os.Getenv("REPORT_WEBHOOK_URL"); webhookURL != "" {
+			headers, err := parseWebhookHeaders(splitList(os.Getenv("REPORT_WEBHOOK_HEADERS")))
+			if err != nil {
+				fatal("Failed to configure report webhook", "error", err)
 			}
+			webhook = NewReportWebhook(webhookURL, headers)
+		}
+
+		reports := NewReportCollector()
+		pipeline.Observe(reports.Observe)
+		go runReports(reports, interval, os.Getenv("REPORT_DIR"), webhook, reportNotifiers(notifiers, splitList(os.Getenv("REPORT_NOTIFIERS"))), tracer)
+	}
+	if interval := getEnvDuration("SMTP_DIGEST_INTERVAL", 0); interval > 0 {
+		// A report of its own, so the digest can be hourly with daily reports
+		digest := NewReportCollector()
+		pipeline.Observe(digest.Observe)
+		go runReports(digest, interval, "", nil, reportNotifiers(notifiers, []string{"email"}), tracer)
+	}
+
+	if maxAge := getEnvDuration("RETENTION_MAX_AGE", 0); maxAge > 0 {
+		retention := NewRetentionManager(maxAge, tracer)
+		// Only InfluxDB 2.x has the delete API, the retention of the others
+		// being set on the database
+		if client != nil && influxTarget.Version == 2 {
+			retention.Manage(influxRetention{
+				deleteAPI:    client.DeleteAPI(),
+				org:          influxTarget.Org,
+				bucket:       influxTarget.Bucket,
+				measurements: []string{influxMeasurement, influxSessionMeasurement, "credential_stats", "geohash", "annotation"},
+			})
+		} else if client != nil {
+			slog.Warn("Retention isn't enforced on InfluxDB, set it on the database instead", "version", influxTarget.Version)
+		}
+		for _, target := range retentionTargets {
+			retention.Manage(target)
+		}
+		if reportDir := os.Getenv("REPORT_DIR"); reportDir != "" {
+			retention.Manage(fileRetention{dir: reportDir})
+		}
+		go retention.Run(getEnvDuration("RETENTION_INTERVAL", time.Hour))
+	}
+
+	api.Handle("/api/credentials", func(r *http.Request) (any, error) {
+		return credentialStats.Summaries(), nil
+	})
+	api.Handle("/api/keys", func(r *http.Request) (any, error) {
+		return keyIndex.Reused(), nil
+	})
+	api.Handle("/api/attackers", func(r *http.Request) (any, error) {
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			limit = 100
 		}
+		return attackers.Attackers(limit), nil
 	})
+	api.Handle("/api/geohashes", func(r *http.Request) (any, error) {
+		return geohashes.Totals(), nil
+	})
+	api.Handle("/api/campaigns", func(r *http.Request) (any, error) {
+		return campaigns.Campaigns(), nil
+	})
+	api.Handle("/api/events", func(r *http.Request) (any, error) {
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			limit = 100
+		}
+		return recentEvents.Events(limit), nil
+	})
+	api.Handle("/api/countries", func(r *http.Request) (any, error) {
+		return sources.Countries(), nil
+	})
+	api.Handle("/api/asns", func(r *http.Request) (any, error) {
+		return sources.ASNs(), nil
+	})
+	api.Handle("/api/top-attackers", func(r *http.Request) (any, error) {
+		query := r.URL.Query()
+		window := time.Hour
+		if value := query.Get("window"); value != "" {
+			var err error
+			if window, err = time.ParseDuration(value); err != nil {
+				return nil, err
+			}
+		}
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			limit = 10
+		}
+		return sourceStats.Top(window, limit, splitList(query.Get("by")))
+	})
+	api.Handle("/api/attack-map", func(r *http.Request) (any, error) {
+		query := r.URL.Query()
+		window := time.Hour
+		if value := query.Get("window"); value != "" {
+			var err error
+			if window, err = time.ParseDuration(value); err != nil {
+				return nil, err
+			}
+		}
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			limit = 1000
+		}
+		return attackMap.GeoJSON(window, limit)
+	})
+	api.Handle("/api/stats", func(r *http.Request) (any, error) {
+		return liveStats.Snapshot(), nil
+	})
+	api.Handle("/api/sinks", func(r *http.Request) (any, error) {
+		return struct {
+			Sinks    []SinkHealth    `json:"sinks"`
+			Pipeline []StageSnapshot `json:"pipeline"`
+		}{fanout.Health(), pipeline.Stats()}, nil
+	})
+	if tui != nil {
+		tui.Watch(recentEvents, liveStats, credentialStats, fanout.Health, pipeline.Stats)
+	}
 
-	if hostKeyPath == "" {
-		hostKeyPath = "./host_key"
-		if _, err := os.Stat(hostKeyPath); os.IsNotExist(err) {
-			log.Printf("Generating host key...")
-			_, _, err := GenerateKey(hostKeyPath)
-			if err != nil {
-				log.Fatalf("Failed to generate host key: %v", err)
+	pipeline.Start()
+	go logPipelineStats(pipeline, getEnvDuration("PIPELINE_STATS_INTERVAL", time.Minute))
+
+	return pipeline, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), getEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 5*time.Second))
+		defer cancel()
+		pipeline.Shutdown(ctx)
+		alerter.Close()
+		if annotator != nil {
+			annotator.Close()
+		}
+		if banner != nil {
+			banner.Close()
+		}
+		if misp != nil {
+			// The drain may have used up ctx
+			publishCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			misp.Publish(publishCtx)
+			cancel()
+		}
+		if dshield != nil {
+			submitCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			dshield.Submit(submitCtx)
+			cancel()
+		}
+		if xarf != nil {
+			sendCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			xarf.Send(sendCtx)
+			cancel()
+		}
+		if err := attackers.Save(); err != nil {
+			slog.Error("Failed to save attacker store", "error", err)
+		}
+		if client != nil {
+			writeAPI.WriteAPI.Flush()
+			client.Close()
+		}
+		for _, closer := range closers {
+			if err := closer.Close(); err != nil {
+				slog.Error("Failed to close sink", "error", err)
 			}
 		}
 	}
-	hostKey, err := loadHostKey(hostKeyPath)
-	if err != nil {
-		log.Fatalf("Failed to load host key: %v", err)
-	}
-
-	sshPort := os.Getenv("SSH_PORT")
-	if sshPort == "" {
-		sshPort = "2222"
-	}
-
-	log.Printf("Starting ssh server on port '%s'...", sshPort)
-	log.Printf("Connections will only last %s\n", DeadlineTimeout)
-	log.Printf("Timeout after %s of no activity\n", IdleTimeout)
-	server := &ssh.Server{
-		Addr:        ":" + sshPort,
-		MaxTimeout:  DeadlineTimeout,
-		IdleTimeout: IdleTimeout,
-		Version:     "OpenSSH_7.4p1 Debian-10+deb9u7",
-		PublicKeyHandler: func(s ssh.Context, key ssh.PublicKey) bool {
-			s.SetValue("Function", "public_key")
-			s.SetValue("Key", string(gossh.MarshalAuthorizedKey(key)))
-			go processRequestExponentialBackoff(writeAPI, s, ctx, tracer)
-			return false
-		},
-		PasswordHandler: func(s ssh.Context, password string) bool {
-			s.SetValue("Function", "password")
-			s.SetValue("Password", password)
-			go processRequestExponentialBackoff(writeAPI, s, ctx, tracer)
-
-			return false
-		},
-	}
-
-	server.AddHostKey(hostKey)
-	log.Fatal(server.ListenAndServe())
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.opentelemetry.io/otel/trace"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// SSHServerEnv is what the SSH servers of the listeners are built with.
+type SSHServerEnv struct {
+	Capture func(SSHInfo) bool
+	// Shell lets attackers in, when set
+	Shell *Shell
+	// Tarpit takes the connections the policies trap
+	Tarpit   *Tarpit
+	Sessions *SessionTracker
+	// PolicyLookupTimeout bounds the geolocation of the connections for the
+	// policies
+	PolicyLookupTimeout time.Duration
+	Tracer              trace.Tracer
+}
+
+// newServer sets up the SSH server of the listener on port, serving the
+// host keys of hostKeys.
+func newServer(port string, hostKeys *HostKeyRing, env SSHServerEnv) *ssh.Server {
+	capture, shell, tracer := env.Capture, env.Shell, env.Tracer
+	sessionHandler := newSessionHandler(env)
+
+	// Timeouts and the version are left to the reloadable Settings, read as
+	// every connection is accepted.
+	server := &ssh.Server{
+		Handler: sessionHandler,
+		ServerConfigCallback: func(s ssh.Context) *gossh.ServerConfig {
+			config := &gossh.ServerConfig{ServerVersion: "SSH-2.0-" + s.Value(serverVersionKey{}).(string)}
+			if banner := currentSettings().ListenerBanner(port); banner != "" {
+				record := getConnRecord(s)
+				config.BannerCallback = func(gossh.ConnMetadata) string {
+					record.recordBanner()
+					return banner
+				}
+				config.AuthLogCallback = func(gossh.ConnMetadata, string, error) {
+					record.recordAuthRequest()
+				}
+			}
+			return config
+		},
+		ConnCallback: func(s ssh.Context, conn net.Conn) net.Conn {
+			metrics.RecordConnection("ssh")
+			settings := currentSettings()
+			remoteHost, _ := addrHostPort(conn.RemoteAddr())
+			switch policy := evaluatePolicy(settings, remoteHost, env.PolicyLookupTimeout, tracer); policy {
+			case PolicyDrop:
+				return nil
+			case PolicyTarpit:
+				// Dropped when the tarpit is full
+				env.Tarpit.Trap(conn)
+				return nil
+			default:
+				s.SetValue(policyKey{}, policy)
+			}
+			// The remote address is only in the context after the handshake
+			s.SetValue(serverVersionKey{}, settings.Version(port, conn.RemoteAddr()))
+			s.SetValue(hostKeyRingKey{}, hostKeys)
+			return newDeadlineConn(newSniffConn(conn, attachConnRecord(s), capture), settings.MaxTimeout, settings.IdleTimeout)
+		},
+		PublicKeyHandler: func(s ssh.Context, key ssh.PublicKey) bool {
+			sshInfo := newSSHInfo(s, "public_key")
+			sshInfo.Key = string(gossh.MarshalAuthorizedKey(key))
+			sshInfo.KeyType = key.Type()
+			sshInfo.KeyFingerprint = gossh.FingerprintSHA256(key)
+			sshInfo.KeyMD5 = "MD5:" + gossh.FingerprintLegacyMD5(key)
+			sshInfo.KeyBits = keyBits(key)
+			if getConnRecord(s).observeAttempt(&sshInfo) {
+				capture(sshInfo)
+			}
+
+			return false
+		},
+		PasswordHandler: func(s ssh.Context, password string) bool {
+			sshInfo := newSSHInfo(s, "password")
+			sshInfo.Password = password
+			sshInfo.Accepted = policyAccepts(s, shell, sshInfo.RemoteHost, password)
+			if getConnRecord(s).observeAttempt(&sshInfo) {
+				capture(sshInfo)
+			}
+
+			return sshInfo.Accepted
+		},
+		// Asks for the password as OpenSSH does through PAM, for the tools
+		// falling back to keyboard-interactive when password is refused.
+		KeyboardInteractiveHandler: func(s ssh.Context, challenge gossh.KeyboardInteractiveChallenge) bool {
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			if err != nil || len(answers) != 1 {
+				return false
+			}
+
+			sshInfo := newSSHInfo(s, "keyboard_interactive")
+			sshInfo.Password = answers[0]
+			sshInfo.Accepted = policyAccepts(s, shell, sshInfo.RemoteHost, answers[0])
+			if getConnRecord(s).observeAttempt(&sshInfo) {
+				capture(sshInfo)
+			}
+
+			return sshInfo.Accepted
+		},
+		// Attackers probe for hosts to relay through, the intent is recorded
+		// but nothing is forwarded.
+		LocalPortForwardingCallback: func(s ssh.Context, destinationHost string, destinationPort uint32) bool {
+			sshInfo := newSSHInfo(s, "local_forward")
+			sshInfo.ForwardHost = destinationHost
+			sshInfo.ForwardPort = strconv.FormatUint(uint64(destinationPort), 10)
+			capture(sshInfo)
+			slog.Info("Denied port forwarding", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "destination", net.JoinHostPort(destinationHost, sshInfo.ForwardPort))
+
+			return false
+		},
+		// Attackers ask for listeners to reach their own services through
+		// the host, the bind address is recorded but never listened on.
+		ReversePortForwardingCallback: func(s ssh.Context, bindHost string, bindPort uint32) bool {
+			sshInfo := newSSHInfo(s, "reverse_forward")
+			sshInfo.ForwardHost = bindHost
+			sshInfo.ForwardPort = strconv.FormatUint(uint64(bindPort), 10)
+			capture(sshInfo)
+			slog.Info("Denied reverse port forwarding", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "bind", net.JoinHostPort(bindHost, sshInfo.ForwardPort))
+
+			return false
+		},
+	}
+
+	for _, hostKey := range hostKeys.Signers() {
+		server.AddHostKey(hostKey)
+	}
+	server.ChannelHandlers = map[string]ssh.ChannelHandler{
+		"session":      sessionChannelHandler(capture),
+		"direct-tcpip": ssh.DirectTCPIPHandler,
+	}
+	server.RequestHandlers = map[string]ssh.RequestHandler{
+		"hostkeys-prove-00@openssh.com": hostKeys.HandleProve,
+		"tcpip-forward":                 (&ssh.ForwardedTCPHandler{}).HandleSSHRequest,
+	}
+	// Refused otherwise, like servers without sftp-server
+	if shell != nil {
+		server.SubsystemHandlers = map[string]ssh.SubsystemHandler{"sftp": sessionHandler}
+	}
+
+	return server
+}
+
+// newSessionHandler returns the handler of the session channels, and of the
+// sftp subsystem when the shell is enabled, capturing a session event for
+// each.
+func newSessionHandler(env SSHServerEnv) func(ssh.Session) {
+	capture, shell, sessions := env.Capture, env.Shell, env.Sessions
+
+	return func(s ssh.Session) {
+		record := getConnRecord(s.Context())
+		sshInfo := newSSHInfo(s.Context(), "session")
+		sshInfo.Signals = record.TimingSignals()
+		sshInfo.Command = s.RawCommand()
+		sshInfo.Subsystem = s.Subsystem()
+		sshInfo.AgentForwarding = ssh.AgentRequested(s)
+		env := s.Environ()
+		sshInfo.Env = env[:min(len(env), maxSessionEnv)]
+		pty, windowChanges, isPty := s.Pty()
+		if isPty {
+			sshInfo.Term = pty.Term
+			sshInfo.TermWidth, sshInfo.TermHeight = pty.Window.Width, pty.Window.Height
+			sshInfo.TermModes = record.PtyModes()
+		}
+
+		capture(sshInfo)
+		connHostKeys(s.Context()).Announce(s.Context())
+
+		kind := "session"
+		switch {
+		case shell != nil && s.RawCommand() != "":
+			kind = "exec"
+		case shell != nil && s.Subsystem() == "sftp":
+			kind = "sftp"
+		case shell != nil && s.Subsystem() == "":
+			kind = "shell"
+		}
+		untrack := sessions.Track(ActiveSession{
+			SessionID:  sshInfo.SessionID,
+			RemoteHost: sshInfo.RemoteHost,
+			User:       sshInfo.User,
+			Kind:       kind,
+			Command:    s.RawCommand(),
+			Started:    time.Now(),
+		})
+		defer untrack()
+
+		if isPty {
+			go func() {
+				// The first one is the window of the pty request
+				<-windowChanges
+				for window := range windowChanges {
+					if record.recordWindowChange() > maxWindowChangeEvents {
+						continue
+					}
+					changeInfo := newSSHInfo(s.Context(), "window_change")
+					changeInfo.TermWidth, changeInfo.TermHeight = window.Width, window.Height
+					capture(changeInfo)
+				}
+			}()
+		}
+
+		if shell != nil && s.RawCommand() != "" {
+			slog.Info("Exec", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User, "command", s.RawCommand())
+			shell.Exec(s, record, capture)
+			return
+		}
+
+		if shell != nil && s.Subsystem() == "sftp" {
+			slog.Info("Opened SFTP session", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User)
+			shell.ServeSFTP(s, record, capture)
+			slog.Info("Closed SFTP session", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User)
+			return
+		}
+
+		if shell != nil && s.RawCommand() == "" && s.Subsystem() == "" {
+			slog.Info("Opened shell", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User)
+			shell.Run(s, record, capture)
+			slog.Info("Closed shell", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User)
+			return
+		}
+
+		go func() {
+			buf := make([]byte, 256)
+			for {
+				n, err := s.Read(buf)
+				if n > 0 {
+					record.recordInput(n)
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		slog.Info("Opened session", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User)
+		<-s.Context().Done()
+		slog.Info("Closed session", "remote_host", sshInfo.RemoteHost, "user", sshInfo.User)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// StdoutSink writes every event to w as a line of JSON, laid out as an
+// EventDocument or as cowrie does, see eventLineEncoder, for log shippers to
+// pick up. Logs go to stderr, so they don't interleave with events.
+type StdoutSink struct {
+	encode func(*json.Encoder, Event) error
+	tracer trace.Tracer
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewStdoutSink(w io.Writer, format string, tracer trace.Tracer) (*StdoutSink, error) {
+	encode, err := eventLineEncoder(format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StdoutSink{w: w, encode: encode, tracer: tracer}, nil
+}
+
+func stdoutSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	if os.Getenv("STDOUT_EVENTS") != "true" {
+		return nil, nil
+	}
+
+	return NewStdoutSink(os.Stdout, getEnv("STDOUT_FORMAT", "document"), tracer)
+}
+
+func (s *StdoutSink) Name() string {
+	return "stdout"
+}
+
+func (s *StdoutSink) Write(ctx context.Context, batch Batch) error {
+	_, span := s.tracer.Start(
+		ctx,
+		"writeToStdout",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, event := range batch.Events {
+		if err := s.encode(encoder, event); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(lines.Bytes()); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Wrote %d events", len(batch.Events)))
+	return nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	stixMediaType  = "application/stix+json;version=2.1"
+	taxiiMediaType = "application/taxii+json;version=2.1"
+
+	// The API root and collection the feed is served as.
+	taxiiAPIRoot    = "/taxii2/honeypot/"
+	taxiiCollection = "5f2a1b7e-3c4d-4e8f-9a0b-1c2d3e4f5a6b"
+
+	// Indicators kept in the feed, the new ones being dropped beyond it.
+	maxStixIndicators = 10000
+
+	// How often an indicator seen again gets a new version.
+	stixModifyInterval = time.Hour
+
+	// Objects served per page of the TAXII collection.
+	taxiiPageSize = 1000
+)
+
+// stixNamespace derives the IDs of the STIX objects, so an indicator keeps
+// its ID across restarts and nodes.
+var stixNamespace = uuid.MustParse("0b5b7d8e-2f6a-4c1e-8d3b-9e7f4a6c2d10")
+
+type stixIdentity struct {
+	Type          string    `json:"type"`
+	SpecVersion   string    `json:"spec_version"`
+	ID            string    `json:"id"`
+	Created       time.Time `json:"created"`
+	Modified      time.Time `json:"modified"`
+	Name          string    `json:"name"`
+	IdentityClass string    `json:"identity_class"`
+}
+
+type stixIndicator struct {
+	Type           string    `json:"type"`
+	SpecVersion    string    `json:"spec_version"`
+	ID             string    `json:"id"`
+	CreatedByRef   string    `json:"created_by_ref"`
+	Created        time.Time `json:"created"`
+	Modified       time.Time `json:"modified"`
+	Name           string    `json:"name"`
+	IndicatorTypes []string  `json:"indicator_types"`
+	Pattern        string    `json:"pattern"`
+	PatternType    string    `json:"pattern_type"`
+	ValidFrom      time.Time `json:"valid_from"`
+
+	// When the version was added to the feed, its events being observed
+	// some time after they happened
+	added time.Time
+}
+
+// StixFeed turns the attacks observed into STIX 2.1 indicators, for threat
+// intelligence platforms: the source IPs and the hashes of the files
+// uploaded or downloaded. The feed is served as a TAXII 2.1 collection and
+// can be pushed to a TAXII server. Indicators not seen for the retention
+// period are dropped.
+type StixFeed struct {
+	identity   stixIdentity
+	retention  time.Duration
+	anonymizer *Anonymizer
+
+	mu         sync.Mutex
+	indicators map[string]*stixIndicator
+}
+
+func NewStixFeed(name string, retention time.Duration, anonymizer *Anonymizer) *StixFeed {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &StixFeed{
+		identity: stixIdentity{
+			Type:          "identity",
+			SpecVersion:   "2.1",
+			ID:            "identity--" + uuid.NewSHA1(stixNamespace, []byte(name)).String(),
+			Created:       created,
+			Modified:      created,
+			Name:          name,
+			IdentityClass: "system",
+		},
+		retention:  retention,
+		anonymizer: anonymizer,
+		indicators: map[string]*stixIndicator{},
+	}
+}
+
+// Observe adds the indicators of event to the feed, or renews them.
+func (f *StixFeed) Observe(ctx context.Context, event Event) {
+	sshInfo := f.anonymizer.Anonymize(event).SSHInfo
+	now := sshInfo.Timestamp.UTC()
+
+	if ip := net.ParseIP(sshInfo.RemoteHost); ip != nil {
+		addressType := "ipv6-addr"
+		if ip.To4() != nil {
+			addressType = "ipv4-addr"
+		}
+		f.add(now, fmt.Sprintf("[%s:value = '%s']", addressType, sshInfo.RemoteHost), "SSH honeypot attacker "+sshInfo.RemoteHost)
+	}
+	if sshInfo.FileSHA256 != "" {
+		f.add(now, fmt.Sprintf("[file:hashes.'SHA-256' = '%s']", sshInfo.FileSHA256), "SSH honeypot payload "+sshInfo.FileSHA256)
+	}
+}
+
+func (f *StixFeed) add(now time.Time, pattern string, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if indicator, found := f.indicators[pattern]; found {
+		if now.Sub(indicator.Modified) >= stixModifyInterval {
+			indicator.Modified = now
+			indicator.added = time.Now()
+		}
+		return
+	}
+	if len(f.indicators) >= maxStixIndicators {
+		f.prune(now)
+		if len(f.indicators) >= maxStixIndicators {
+			return
+		}
+	}
+
+	f.indicators[pattern] = &stixIndicator{
+		Type:           "indicator",
+		SpecVersion:    "2.1",
+		ID:             "indicator--" + uuid.NewSHA1(stixNamespace, []byte(pattern)).String(),
+		CreatedByRef:   f.identity.ID,
+		Created:        now,
+		Modified:       now,
+		Name:           name,
+		IndicatorTypes: []string{"malicious-activity"},
+		Pattern:        pattern,
+		PatternType:    "stix",
+		ValidFrom:      now,
+		added:          time.Now(),
+	}
+}
+
+// prune drops the indicators not seen for the retention period.
+func (f *StixFeed) prune(now time.Time) {
+	for pattern, indicator := range f.indicators {
+		if now.Sub(indicator.Modified) > f.retention {
+			delete(f.indicators, pattern)
+		}
+	}
+}
+
+// Indicators returns copies of the indicators added to the feed after since,
+// the first added first.
+func (f *StixFeed) Indicators(since time.Time) []stixIndicator {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prune(time.Now())
+	var indicators []stixIndicator
+	for _, indicator := range f.indicators {
+		if indicator.added.After(since) {
+			indicators = append(indicators, *indicator)
+		}
+	}
+	sort.Slice(indicators, func(i, j int) bool {
+		if !indicators[i].added.Equal(indicators[j].added) {
+			return indicators[i].added.Before(indicators[j].added)
+		}
+		return indicators[i].ID < indicators[j].ID
+	})
+
+	return indicators
+}
+
+type taxiiError struct {
+	Title      string `json:"title"`
+	HTTPStatus string `json:"http_status"`
+}
+
+func writeTAXIIError(w http.ResponseWriter, status int, title string) {
+	w.Header().Set("Content-Type", taxiiMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(taxiiError{Title: title, HTTPStatus: strconv.Itoa(status)})
+}
+
+// ServeHTTP serves the feed as a read-only TAXII 2.1 server with a single
+// API root and collection, under /taxii2/.
+func (f *StixFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	collection := map[string]any{
+		"id":          taxiiCollection,
+		"title":       "SSH honeypot indicators",
+		"description": "Source IPs and payload hashes observed by " + f.identity.Name,
+		"can_read":    true,
+		"can_write":   false,
+		"media_types": []string{stixMediaType},
+	}
+	collectionPath := taxiiAPIRoot + "collections/" + taxiiCollection + "/"
+
+	var response any
+	switch r.URL.Path {
+	case "/taxii2/":
+		response = map[string]any{
+			"title":     "SSH honeypot",
+			"default":   taxiiAPIRoot,
+			"api_roots": []string{taxiiAPIRoot},
+		}
+	case taxiiAPIRoot:
+		response = map[string]any{
+			"title":              "SSH honeypot",
+			"versions":           []string{taxiiMediaType},
+			"max_content_length": 0,
+		}
+	case taxiiAPIRoot + "collections/":
+		response = map[string]any{"collections": []any{collection}}
+	case collectionPath:
+		response = collection
+	case collectionPath + "objects/":
+		f.serveObjects(w, r)
+		return
+	default:
+		writeTAXIIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", taxiiMediaType)
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveObjects serves the indicators added after the added_after parameter,
+// by pages of limit objects.
+func (f *StixFeed) serveObjects(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if addedAfter := r.URL.Query().Get("added_after"); addedAfter != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, addedAfter); err != nil {
+			writeTAXIIError(w, http.StatusBadRequest, "Invalid added_after")
+			return
+		}
+	}
+	limit := taxiiPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 && n < limit {
+			limit = n
+		}
+	}
+
+	indicators := f.Indicators(since)
+	more := len(indicators) > limit
+	if more {
+		indicators = indicators[:limit]
+	}
+
+	objects := []any{f.identity}
+	for _, indicator := range indicators {
+		objects = append(objects, indicator)
+	}
+	if len(indicators) > 0 {
+		w.Header().Set("X-TAXII-Date-Added-First", indicators[0].added.Format(time.RFC3339Nano))
+		w.Header().Set("X-TAXII-Date-Added-Last", indicators[len(indicators)-1].added.Format(time.RFC3339Nano))
+	}
+	w.Header().Set("Content-Type", taxiiMediaType)
+	json.NewEncoder(w).Encode(map[string]any{"more": more, "objects": objects})
+}
+
+// TAXIIPusher pushes the indicators of a feed to the collection of a TAXII
+// 2.1 server, those added since the last successful push every time.
+type TAXIIPusher struct {
+	feed     *StixFeed
+	url      string
+	username string
+	password string
+	client   *http.Client
+	tracer   trace.Tracer
+
+	pushed time.Time
+}
+
+func NewTAXIIPusher(feed *StixFeed, url string, username string, password string, tracer trace.Tracer) *TAXIIPusher {
+	return &TAXIIPusher{
+		feed:     feed,
+		url:      url,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		tracer:   tracer,
+	}
+}
+
+// Run pushes the new indicators every interval.
+func (p *TAXIIPusher) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.Push()
+	}
+}
+
+func (p *TAXIIPusher) Push() {
+	indicators := p.feed.Indicators(p.pushed)
+	if len(indicators) == 0 {
+		return
+	}
+
+	ctx, span := p.tracer.Start(
+		context.Background(),
+		"pushTAXII",
+		trace.WithAttributes(attribute.Int("indicators", len(indicators))))
+	defer span.End()
+
+	for len(indicators) > 0 {
+		page := indicators[:min(len(indicators), taxiiPageSize)]
+		indicators = indicators[len(page):]
+
+		objects := []any{p.feed.identity}
+		for _, indicator := range page {
+			objects = append(objects, indicator)
+		}
+		if err := p.post(ctx, objects); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.ErrorContext(ctx, "Failed to push indicators to TAXII server", "url", p.url, "error", err)
+			return
+		}
+		// Pages are pushed oldest first, so the next push resumes after
+		// the last one that went through
+		p.pushed = page[len(page)-1].added
+	}
+
+	span.SetStatus(codes.Ok, "Pushed indicators to TAXII server")
+}
+
+func (p *TAXIIPusher) post(ctx context.Context, objects []any) error {
+	body, err := json.Marshal(map[string]any{"objects": objects})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", taxiiMediaType)
+	req.Header.Set("Content-Type", taxiiMediaType)
+	if p.username != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Buffers the events of each stream client, those of clients too slow to
+// keep up being dropped.
+const eventStreamBuffer = 256
+
+// EventStream broadcasts every enriched event, anonymized as for the sinks,
+// to its clients as Server-Sent Events.
+type EventStream struct {
+	mu         sync.Mutex
+	clients    map[chan EventDocument]struct{}
+	anonymizer *Anonymizer
+}
+
+func NewEventStream(anonymizer *Anonymizer) *EventStream {
+	return &EventStream{clients: map[chan EventDocument]struct{}{}, anonymizer: anonymizer}
+}
+
+func (s *EventStream) Observe(ctx context.Context, event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.clients) == 0 {
+		return
+	}
+	document := newEventDocument(s.anonymizer.Anonymize(event))
+	for client := range s.clients {
+		select {
+		case client <- document:
+		default:
+		}
+	}
+}
+
+func (s *EventStream) subscribe() chan EventDocument {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client := make(chan EventDocument, eventStreamBuffer)
+	s.clients[client] = struct{}{}
+	return client
+}
+
+func (s *EventStream) unsubscribe(client chan EventDocument) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.clients, client)
+}
+
+// ServeHTTP streams the events until the client goes away, only those of the
+// functions listed in the function query parameter when set, e.g.
+// "?function=password,command".
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	functions := splitList(r.URL.Query().Get("function"))
+
+	client := s.subscribe()
+	defer s.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep proxies from closing an idle stream
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case document := <-client:
+			if len(functions) > 0 && !slices.Contains(functions, document.Function) {
+				continue
+			}
+			data, err := json.Marshal(document)
+			if err != nil {
+				slog.Error("Failed to encode streamed event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", document.Function, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
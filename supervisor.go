@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gliderlabs/ssh"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ListenerState string
+
+const (
+	ListenerStarting   ListenerState = "starting"
+	ListenerRunning    ListenerState = "running"
+	ListenerRestarting ListenerState = "restarting"
+	ListenerStopped    ListenerState = "stopped"
+
+	// A listener that served for at least this long before failing is
+	// considered healthy, and its restart backoff starts over.
+	listenerHealthyAfter = time.Minute
+)
+
+type ListenerStatus struct {
+	Name      string        `json:"name"`
+	State     ListenerState `json:"state"`
+	Restarts  int           `json:"restarts"`
+	LastError string        `json:"last_error,omitempty"`
+	Since     time.Time     `json:"since"`
+}
+
+// Listener is a server kept running by the Supervisor. Shutdown stops it
+// from accepting connections and waits for the open ones until ctx is done,
+// closing them then.
+type Listener struct {
+	Serve    func() error
+	Shutdown func(ctx context.Context) error
+}
+
+type Supervisor struct {
+	mu        sync.RWMutex
+	listeners map[string]*ListenerStatus
+	shutdowns map[string]func(ctx context.Context) error
+	wg        sync.WaitGroup
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		listeners: map[string]*ListenerStatus{},
+		shutdowns: map[string]func(ctx context.Context) error{},
+	}
+}
+
+// Supervise runs the listener in the background and restarts it with
+// exponential backoff whenever it returns an error, until ctx is cancelled
+// or it reports that the server was closed on purpose.
+func (s *Supervisor) Supervise(ctx context.Context, tracer trace.Tracer, name string, listener Listener) {
+	s.setState(name, ListenerStarting, nil)
+	if listener.Shutdown != nil {
+		s.mu.Lock()
+		s.shutdowns[name] = listener.Shutdown
+		s.mu.Unlock()
+	}
+	serve := listener.Serve
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		backoffSettings := backoff.NewExponentialBackOff()
+		backoffSettings.MaxInterval = time.Minute
+		backoffSettings.MaxElapsedTime = 0
+
+		for {
+			started := time.Now()
+			s.setState(name, ListenerRunning, nil)
+			err := serve()
+
+			if errors.Is(err, ssh.ErrServerClosed) || errors.Is(err, http.ErrServerClosed) || ctx.Err() != nil {
+				s.setState(name, ListenerStopped, nil)
+				slog.Info("Listener stopped", "listener", name)
+				return
+			}
+
+			if time.Since(started) >= listenerHealthyAfter {
+				backoffSettings.Reset()
+			}
+
+			wait := backoffSettings.NextBackOff()
+			s.setState(name, ListenerRestarting, err)
+			s.reportFailure(ctx, tracer, name, err, wait)
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				s.setState(name, ListenerStopped, nil)
+				return
+			}
+		}
+	}()
+}
+
+// Wait blocks until every supervised listener has stopped.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Shutdown stops every listener at once, giving their open connections
+// until ctx is done to finish, then waits for them to stop. The ctx given to
+// Supervise must be cancelled as well, so none of them gets restarted.
+func (s *Supervisor) Shutdown(ctx context.Context) {
+	s.mu.RLock()
+	var wg sync.WaitGroup
+	for name, shutdown := range s.shutdowns {
+		wg.Add(1)
+		go func(name string, shutdown func(ctx context.Context) error) {
+			defer wg.Done()
+			if err := shutdown(ctx); err != nil {
+				slog.Warn("Listener did not shut down cleanly", "listener", name, "error", err)
+			}
+		}(name, shutdown)
+	}
+	s.mu.RUnlock()
+
+	wg.Wait()
+	s.Wait()
+}
+
+// Statuses returns a snapshot of the state of every supervised listener.
+func (s *Supervisor) Statuses() []ListenerStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make([]ListenerStatus, 0, len(s.listeners))
+	for _, status := range s.listeners {
+		statuses = append(statuses, *status)
+	}
+
+	return statuses
+}
+
+func (s *Supervisor) setState(name string, state ListenerState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, ok := s.listeners[name]
+	if !ok {
+		status = &ListenerStatus{Name: name}
+		s.listeners[name] = status
+	}
+
+	if state == ListenerRestarting {
+		status.Restarts++
+	}
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	if status.State != state {
+		status.State = state
+		status.Since = time.Now()
+	}
+}
+
+func (s *Supervisor) reportFailure(ctx context.Context, tracer trace.Tracer, name string, err error, wait time.Duration) {
+	ctx, span := tracer.Start(
+		ctx,
+		"listenerFailure",
+		trace.WithAttributes(attribute.String("listener", name)))
+	defer span.End()
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	slog.ErrorContext(ctx, "Listener failed, restarting", "listener", name, "wait", wait, "error", err)
+}
+
+// CaptureGate passes events on to capture until closed, dropping the later
+// ones, so the producers still running at shutdown, such as SSH handlers
+// unwinding past the grace period, are cut off before the pipeline stops.
+type CaptureGate struct {
+	capture func(SSHInfo) bool
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewCaptureGate(capture func(SSHInfo) bool) *CaptureGate {
+	return &CaptureGate{capture: capture}
+}
+
+func (g *CaptureGate) Capture(sshInfo SSHInfo) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.closed {
+		slog.Debug("Shutting down, dropping event", "function", sshInfo.Function, "remote_host", sshInfo.RemoteHost)
+		return false
+	}
+
+	return g.capture(sshInfo)
+}
+
+// Close waits for the events being captured and drops those that follow.
+func (g *CaptureGate) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.closed = true
+}
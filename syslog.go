@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// syslogEnterpriseID qualifies the RFC 5424 structured data ID. 32473 is the
+// enterprise number reserved for documentation, honeypots have none of their
+// own.
+const syslogEnterpriseID = "32473"
+
+// syslogEvents names and rates every event function, for the CEF header.
+var syslogEvents = map[string]struct {
+	name     string
+	severity int
+}{
+	"password":             {"Password authentication attempt", 5},
+	"public_key":           {"Public key authentication attempt", 5},
+	"keyboard_interactive": {"Keyboard-interactive authentication attempt", 5},
+	"session":              {"Session opened", 6},
+	"command":              {"Command executed", 8},
+	"anomaly":              {"Protocol anomaly", 4},
+	"tarpit":               {"Client left the tarpit", 6},
+	"file":                 {"File changed", 8},
+	"download":             {"Payload download", 8},
+	"sample":               {"Sample captured", 8},
+	"local_forward":        {"Port forwarding request", 7},
+	"reverse_forward":      {"Reverse port forwarding request", 7},
+	"x11":                  {"X11 forwarding request", 7},
+	"window_change":        {"Terminal resized", 6},
+	"session_end":          {"Session ended", 6},
+	"http_request":         {"HTTP request", 4},
+	"honeytoken":           {"Honeytoken used", 10},
+	"spray":                {"Password spraying", 7},
+	"client_anomaly":       {"SSH client never seen before", 5},
+	"canarytoken":          {"Canarytoken triggered", 10},
+}
+
+// SyslogSink sends every event to a syslog server over UDP, TCP or TLS, as an
+// RFC 5424 message carrying either a CEF record or the event as structured
+// data. TCP and TLS messages are framed by octet counting (RFC 6587).
+type SyslogSink struct {
+	addr      string
+	network   string
+	format    string
+	facility  int
+	hostname  string
+	tlsConfig *tls.Config
+	tracer    trace.Tracer
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func NewSyslogSink(addr string, network string, format string, facility int, tracer trace.Tracer) (*SyslogSink, error) {
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown syslog protocol '%s', expected 'udp', 'tcp' or 'tls'", network)
+	}
+	switch format {
+	case "cef", "rfc5424":
+	default:
+		return nil, fmt.Errorf("unknown syslog format '%s', expected 'cef' or 'rfc5424'", format)
+	}
+	if facility < 0 || facility > 23 {
+		return nil, fmt.Errorf("invalid syslog facility %d, expected 0 to 23", facility)
+	}
+
+	s := &SyslogSink{
+		addr:     addr,
+		network:  network,
+		format:   format,
+		facility: facility,
+		hostname: node.ID,
+		tracer:   tracer,
+	}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(addr)
+		s.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+
+	return s, nil
+}
+
+func syslogSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	addr := os.Getenv("SYSLOG_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+
+	return NewSyslogSink(addr, getEnv("SYSLOG_PROTOCOL", "udp"), getEnv("SYSLOG_FORMAT", "cef"), getEnvInt("SYSLOG_FACILITY", 16), tracer)
+}
+
+func (s *SyslogSink) Name() string {
+	return "syslog"
+}
+
+func (s *SyslogSink) Write(ctx context.Context, batch Batch) error {
+	_, span := s.tracer.Start(
+		ctx,
+		"writeToSyslog",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, event := range batch.Events {
+		if err := s.send(s.message(event)); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Sent %d events", len(batch.Events)))
+	return nil
+}
+
+// send writes message, dialing first when not connected. The connection is
+// dropped on errors so the next attempt reconnects.
+func (s *SyslogSink) send(message string) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		var err error
+		if s.network == "tls" {
+			s.conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+		} else {
+			s.conn, err = dialer.Dial(s.network, s.addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.network != "udp" {
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.conn.Write([]byte(message)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// message formats event as an RFC 5424 message, with a notice severity, or
+// alert for honeytokens and Canarytokens.
+func (s *SyslogSink) message(event Event) string {
+	sshInfo := event.SSHInfo
+	severity := 5
+	if sshInfo.Function == "honeytoken" || sshInfo.Function == "canarytoken" {
+		severity = 1
+	}
+	header := fmt.Sprintf("<%d>1 %s %s ssh-honeypot - %s",
+		s.facility*8+severity, sshInfo.Timestamp.UTC().Format(time.RFC3339Nano), syslogHeaderField(s.hostname), syslogHeaderField(sshInfo.Function))
+
+	if s.format == "cef" {
+		return header + " - " + cefRecord(event)
+	}
+
+	return header + " " + syslogStructuredData(event) + " " + syslogEvents[sshInfo.Function].name
+}
+
+func syslogHeaderField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func syslogStructuredData(event Event) string {
+	document := newEventDocument(event)
+	params := [][2]string{
+		{"function", document.Function},
+		{"protocol", document.Protocol},
+		{"remote_host", document.RemoteHost},
+		{"remote_port", document.RemotePort},
+		{"local_port", document.LocalPort},
+		{"user", document.User},
+		{"password", document.Password},
+		{"key_type", document.KeyType},
+		{"command", document.Command},
+		{"subsystem", document.Subsystem},
+		{"env", strings.Join(document.Env, " ")},
+		{"term", document.Term},
+		{"file_operation", document.FileOperation},
+		{"path", document.Path},
+		{"file_sha256", document.FileSHA256},
+		{"yara_matches", strings.Join(document.YaraMatches, ",")},
+		{"url", document.URL},
+		{"http_method", document.HTTPMethod},
+		{"user_agent", document.UserAgent},
+		{"forward_host", document.ForwardHost},
+		{"forward_port", document.ForwardPort},
+		{"x11_auth_protocol", document.X11AuthProtocol},
+		{"x11_screen", document.X11Screen},
+		{"client_version", document.ClientVersion},
+		{"hassh", document.HASSH},
+		{"session_id", document.SessionID},
+		{"anomaly", document.Anomaly},
+		{"country", document.Country},
+		{"org", document.Org},
+		{"tool", document.Tool},
+		{"campaign", document.Campaign},
+		{"techniques", strings.Join(document.Techniques, ",")},
+		{"event_id", document.ID},
+	}
+
+	var b strings.Builder
+	b.WriteString("[honeypot@" + syslogEnterpriseID)
+	for _, param := range params {
+		if param[1] != "" {
+			fmt.Fprintf(&b, ` %s="%s"`, param[0], syslogParamEscaper.Replace(param[1]))
+		}
+	}
+	b.WriteString("]")
+
+	return b.String()
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// cefRecord formats event as an ArcSight Common Event Format record, the
+// fields without a standard key going to the labeled custom and flex strings.
+func cefRecord(event Event) string {
+	document := newEventDocument(event)
+	kind, ok := syslogEvents[document.Function]
+	if !ok {
+		kind.name, kind.severity = document.Function, 5
+	}
+
+	extensions := [][2]string{
+		{"rt", strconv.FormatInt(document.Timestamp.UnixMilli(), 10)},
+		{"src", document.RemoteHost},
+		{"spt", document.RemotePort},
+		{"dst", document.LocalHost},
+		{"dpt", document.LocalPort},
+		{"app", document.Protocol},
+		{"suser", document.User},
+		{"dvchost", document.NodeID},
+		{"externalId", document.ID},
+		{"cs1Label", "password"},
+		{"cs1", document.Password},
+		{"cs2Label", "command"},
+		{"cs2", document.Command},
+		{"cs3Label", "clientVersion"},
+		{"cs3", document.ClientVersion},
+		{"cs4Label", "hassh"},
+		{"cs4", document.HASSH},
+		{"cs5Label", "tool"},
+		{"cs5", document.Tool},
+		{"cs6Label", "campaign"},
+		{"cs6", document.Campaign},
+		{"flexString1Label", "country"},
+		{"flexString1", document.Country},
+		{"flexString2Label", "org"},
+		{"flexString2", document.Org},
+		{"cat", document.Anomaly},
+		{"act", document.FileOperation},
+		{"filePath", document.Path},
+		{"fileHash", document.FileSHA256},
+		{"request", document.URL},
+		{"requestMethod", document.HTTPMethod},
+		{"requestClientApplication", document.UserAgent},
+		{"dhost", document.ForwardHost},
+		{"cn1Label", "forwardPort"},
+		{"cn1", document.ForwardPort},
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|ssh-honeypot|ssh-honeypot|1.0|%s|%s|%d|",
+		cefHeaderEscaper.Replace(document.Function), cefHeaderEscaper.Replace(kind.name), kind.severity)
+
+	first := true
+	for i, extension := range extensions {
+		// Skip empty values, and the labels of empty custom and flex strings
+		if extension[1] == "" || (strings.HasSuffix(extension[0], "Label") && i+1 < len(extensions) && extensions[i+1][1] == "") {
+			continue
+		}
+		if !first {
+			b.WriteString(" ")
+		}
+		first = false
+		b.WriteString(extension[0] + "=" + cefExtensionEscaper.Replace(extension[1]))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The first file descriptor passed by systemd, after stdin, stdout and
+// stderr.
+const systemdFirstFD = 3
+
+// SystemdSockets are the listening sockets passed by systemd socket
+// activation, so the honeypot can listen on privileged ports like 22 without
+// running as root or with CAP_NET_BIND_SERVICE. Each is taken over by the
+// listener of its port.
+type SystemdSockets struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+var systemdSockets = &SystemdSockets{listeners: map[string]net.Listener{}}
+
+// inheritSystemdSockets takes the sockets passed through LISTEN_FDS when
+// they are meant for this process, unsetting the variables so processes
+// started by the honeypot don't take them for theirs.
+func inheritSystemdSockets() error {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return fmt.Errorf("invalid LISTEN_FDS '%s'", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(key)
+	}
+
+	systemdSockets.mu.Lock()
+	defer systemdSockets.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", systemdFirstFD+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// The listener holds a duplicate of the descriptor, closed on exec
+		file := os.NewFile(uintptr(systemdFirstFD+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("socket %s isn't a listening TCP socket: %v", name, err)
+		}
+
+		_, port := addrHostPort(listener.Addr())
+		if _, found := systemdSockets.listeners[port]; found {
+			listener.Close()
+			return fmt.Errorf("several sockets listen on port %s", port)
+		}
+		systemdSockets.listeners[port] = listener
+		slog.Info("Inherited socket from systemd", "name", name, "addr", listener.Addr().String())
+	}
+
+	return nil
+}
+
+// take returns the socket listening on port, once, or nil when there is
+// none. A listener restarting after a failure binds the port itself.
+func (s *SystemdSockets) take(port string) net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	listener := s.listeners[port]
+	delete(s.listeners, port)
+	return listener
+}
+
+// Unmatched returns the addresses of the sockets whose port isn't among
+// ports, which no listener will take over.
+func (s *SystemdSockets) Unmatched(ports []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var addrs []string
+	for port, listener := range s.listeners {
+		if !slices.Contains(ports, port) {
+			addrs = append(addrs, listener.Addr().String())
+		}
+	}
+	return addrs
+}
+
+// sdNotify sends state, e.g. "READY=1", to the service manager through
+// NOTIFY_SOCKET, when started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets are given with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// runSystemdWatchdog pings the systemd watchdog at half its timeout, when
+// WatchdogSec is set on the service, until done is closed.
+func runSystemdWatchdog(done <-chan struct{}) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Failed to ping the systemd watchdog", "error", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tarpit traps SSH clients in an endless banner, as endlessh does: RFC 4253
+// lets servers send lines of text before their version, which clients wait
+// through, so a random line is dripped every delay and the version never
+// comes. Clients take turns in a queue served by a single goroutine, rather
+// than a goroutine each, keeping thousands of them cheap. Once one leaves, a
+// tarpit event records how long it stayed.
+type Tarpit struct {
+	delay      time.Duration
+	lineLength int
+	capture    func(SSHInfo) bool
+
+	// slots caps the clients trapped at once, no more are accepted until
+	// one leaves
+	slots chan struct{}
+	wake  chan struct{}
+	done  chan struct{}
+
+	mu       sync.Mutex
+	listener net.Listener
+	clients  []*tarpitClient
+	stopped  bool
+}
+
+// tarpitClient is a trapped client, due its next line at next. released is
+// closed once it leaves, for clients handed over by Trap.
+type tarpitClient struct {
+	conn      net.Conn
+	connected time.Time
+	next      time.Time
+	released  chan struct{}
+}
+
+func NewTarpit(delay time.Duration, lineLength int, maxClients int, capture func(SSHInfo) bool) *Tarpit {
+	t := &Tarpit{
+		delay:      delay,
+		lineLength: max(lineLength, 3),
+		capture:    capture,
+		slots:      make(chan struct{}, max(maxClients, 1)),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go t.drip()
+
+	return t
+}
+
+func tarpitFromEnv(capture func(SSHInfo) bool) *Tarpit {
+	return NewTarpit(getEnvDuration("TARPIT_DELAY", 10*time.Second), getEnvInt("TARPIT_LINE_LENGTH", 32),
+		getEnvInt("TARPIT_MAX_CLIENTS", 4096), capture)
+}
+
+func (t *Tarpit) ListenAndServe(network string, addrs []string) error {
+	listener, err := listen(network, addrs)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	t.mu.Lock()
+	t.listener = listener
+	t.mu.Unlock()
+
+	for {
+		select {
+		case t.slots <- struct{}{}:
+		case <-t.done:
+			return net.ErrClosed
+		}
+
+		conn, err := listener.Accept()
+		if err != nil {
+			<-t.slots
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		metrics.RecordConnection("tarpit")
+		if !t.add(&tarpitClient{conn: conn}) {
+			conn.Close()
+			return net.ErrClosed
+		}
+	}
+}
+
+// Trap traps conn, accepted by another listener, e.g. an SSH one applying a
+// policy, and returns once it is released. It returns false right away,
+// leaving conn open, when the tarpit is full or shut down.
+func (t *Tarpit) Trap(conn net.Conn) bool {
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		return false
+	}
+
+	client := &tarpitClient{conn: conn, released: make(chan struct{})}
+	if !t.add(client) {
+		return false
+	}
+	<-client.released
+
+	return true
+}
+
+// add queues client, whose slot is taken, unless the tarpit is shut down.
+func (t *Tarpit) add(client *tarpitClient) bool {
+	now := time.Now()
+	client.connected, client.next = now, now.Add(t.delay)
+
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		<-t.slots
+		return false
+	}
+	// The delay being the same for every client, appending keeps the queue
+	// ordered by next line
+	t.clients = append(t.clients, client)
+	t.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// drip sends the client at the head of the queue its next line once due,
+// and puts it back at the end, until Shutdown.
+func (t *Tarpit) drip() {
+	timer := time.NewTimer(0)
+	<-timer.C
+
+	for {
+		t.mu.Lock()
+		if len(t.clients) == 0 {
+			t.mu.Unlock()
+			select {
+			case <-t.wake:
+				continue
+			case <-t.done:
+				return
+			}
+		}
+		client := t.clients[0]
+		t.mu.Unlock()
+
+		timer.Reset(time.Until(client.next))
+		select {
+		case <-timer.C:
+		case <-t.done:
+			timer.Stop()
+			return
+		}
+
+		t.mu.Lock()
+		t.clients = t.clients[1:]
+		t.mu.Unlock()
+
+		// A client not reading fills its buffers, it is skipped rather than
+		// holding up the others
+		client.conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := client.conn.Write(t.line())
+		now := time.Now()
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			t.release(client, now)
+			continue
+		}
+
+		client.next = now.Add(t.delay)
+		t.mu.Lock()
+		// Shutdown released the others while this one was being written to
+		if t.stopped {
+			t.mu.Unlock()
+			t.release(client, now)
+			return
+		}
+		t.clients = append(t.clients, client)
+		t.mu.Unlock()
+	}
+}
+
+// line returns a random line of printable characters, which must not start
+// with "SSH-" for clients to keep waiting for the version.
+func (t *Tarpit) line() []byte {
+	length := 3 + rand.Intn(t.lineLength-2)
+	line := make([]byte, length, length+2)
+	for i := range line {
+		line[i] = byte(32 + rand.Intn(95))
+	}
+	if strings.HasPrefix(string(line), "SSH-") {
+		line[0] = 'X'
+	}
+
+	return append(line, '\r', '\n')
+}
+
+// release closes the connection of client, recording how long it stayed.
+func (t *Tarpit) release(client *tarpitClient, now time.Time) {
+	client.conn.Close()
+	<-t.slots
+	if client.released != nil {
+		close(client.released)
+	}
+
+	remoteHost, remotePort := addrHostPort(client.conn.RemoteAddr())
+	localHost, localPort := addrHostPort(client.conn.LocalAddr())
+	t.capture(SSHInfo{
+		RemoteHost: remoteHost,
+		RemotePort: remotePort,
+		LocalHost:  localHost,
+		LocalPort:  localPort,
+		Function:   "tarpit",
+		Protocol:   "ssh",
+		Duration:   now.Sub(client.connected),
+		Node:       node,
+		Timestamp:  now,
+	})
+}
+
+// Shutdown stops accepting connections and releases the trapped clients,
+// recording how long they stayed so far.
+func (t *Tarpit) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return nil
+	}
+	t.stopped = true
+	close(t.done)
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	clients := t.clients
+	t.clients = nil
+	t.mu.Unlock()
+
+	now := time.Now()
+	for _, client := range clients {
+		t.release(client, now)
+	}
+
+	return nil
+}
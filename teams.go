@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"text/template"
+)
+
+const defaultTeamsTemplate = `{{if .Digest}}{{range .Digest}}- {{.Summary}} ({{.Rule}}){{with .Event.SSHInfo}}{{if .RemoteHost}} from {{.RemoteHost}}{{end}}{{end}}
+{{end}}{{else}}{{.Event.SSHInfo.Function}} attempt from **{{.Event.SSHInfo.RemoteHost}}**{{with .Event.IPInfo}}{{if .Country}} ({{.City}}, {{.Country}}){{end}}{{end}}{{end}}`
+
+type TeamsNotifier struct {
+	webhookURL string
+	template   *template.Template
+}
+
+func NewTeamsNotifier(webhookURL string, templateText string) (*TeamsNotifier, error) {
+	tmpl, err := parseAlertTemplate("teams", templateText, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TeamsNotifier{
+		webhookURL: webhookURL,
+		template:   tmpl,
+	}, nil
+}
+
+func (n *TeamsNotifier) Name() string {
+	return "teams"
+}
+
+func (n *TeamsNotifier) Notify(ctx context.Context, alert Alert) error {
+	var text bytes.Buffer
+	if err := n.template.Execute(&text, alert); err != nil {
+		return err
+	}
+
+	color := "Default"
+	switch alert.Severity {
+	case SeverityCritical:
+		color = "Attention"
+	case SeverityWarning:
+		color = "Warning"
+	}
+
+	body := []map[string]any{
+		{
+			"type":   "TextBlock",
+			"text":   alert.Summary,
+			"size":   "Large",
+			"weight": "Bolder",
+			"color":  color,
+			"wrap":   true,
+		},
+		{
+			"type":     "TextBlock",
+			"text":     text.String(),
+			"wrap":     true,
+			"spacing":  "Small",
+			"isSubtle": true,
+		},
+	}
+
+	if len(alert.Digest) == 0 {
+		details := alertDetails(alert)
+		keys := make([]string, 0, len(details))
+		for key := range details {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		facts := make([]map[string]string, 0, len(keys))
+		for _, key := range keys {
+			facts = append(facts, map[string]string{"title": key, "value": details[key]})
+		}
+		body = append(body, map[string]any{
+			"type":  "FactSet",
+			"facts": facts,
+		})
+	}
+
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	if alert.DashboardURL != "" {
+		card["actions"] = []map[string]string{
+			{"type": "Action.OpenUrl", "title": "Open dashboard", "url": alert.DashboardURL},
+		}
+	}
+
+	return postJSON(ctx, n.webhookURL, map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{
+			{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content":     card,
+			},
+		},
+	}, nil)
+}
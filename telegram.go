@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"text/template"
+)
+
+const defaultTelegramTemplate = `{{if .Digest}}📋 <b>{{html .Summary}}</b>
+{{range .Digest}}• {{html .Summary}} <i>({{.Rule}})</i>{{with .Event.SSHInfo}}{{if .RemoteHost}} — <code>{{html .RemoteHost}}</code>{{end}}{{end}}
+{{end}}{{else}}🚨 <b>{{html .Summary}}</b> <i>({{.Rule}}, {{.Severity}})</i>
+<b>IP:</b> <code>{{html .Event.SSHInfo.RemoteHost}}</code>{{with .Event.IPInfo}}{{if .Country}} — {{html .City}}, {{html .Region}}, {{html .Country}}{{end}}{{if .Org}} ({{html .Org}}){{end}}{{end}}
+<b>Method:</b> {{.Event.SSHInfo.Function}}
+<b>User:</b> <code>{{html .Event.SSHInfo.User}}</code>{{if .Event.SSHInfo.Password}}
+<b>Password:</b> <code>{{html .Event.SSHInfo.Password}}</code>{{end}}{{if .Event.SSHInfo.KeyType}}
+<b>Key:</b> {{.Event.SSHInfo.KeyType}}{{end}}
+<b>Client:</b> {{html .Event.SSHInfo.ClientVersion}}{{if .DashboardURL}}
+<a href="{{html .DashboardURL}}">Open dashboard</a>{{end}}{{end}}`
+
+type TelegramNotifier struct {
+	botToken string
+	chatID   string
+	template *template.Template
+}
+
+func NewTelegramNotifier(botToken string, chatID string, templateText string) (*TelegramNotifier, error) {
+	tmpl, err := parseAlertTemplate("telegram", templateText, template.FuncMap{
+		"html": html.EscapeString,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TelegramNotifier{
+		botToken: botToken,
+		chatID:   chatID,
+		template: tmpl,
+	}, nil
+}
+
+func (n *TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+func (n *TelegramNotifier) Notify(ctx context.Context, alert Alert) error {
+	var text bytes.Buffer
+	if err := n.template.Execute(&text, alert); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", n.botToken)
+	return postJSON(ctx, url, map[string]any{
+		"chat_id":                  n.chatID,
+		"text":                     text.String(),
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}, nil)
+}
@@ -0,0 +1,395 @@
+// Package telemetry holds the OpenTelemetry instruments of the honeypot,
+// recorded through the global MeterProvider so they are exported once an
+// OTLP one is registered.
+package telemetry
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metrics holds the instruments recorded across the honeypot.
+type Metrics struct {
+	connections      metric.Int64Counter
+	rejected         metric.Int64Counter
+	events           metric.Int64Counter
+	enrichDuration   metric.Float64Histogram
+	geoLookups       metric.Int64Counter
+	geoBreakerOpens  metric.Int64Counter
+	geoCacheHits     metric.Int64Counter
+	geoCacheMisses   metric.Int64Counter
+	geoCacheEvicted  metric.Int64Counter
+	geoCacheSize     metric.Int64ObservableGauge
+	ipInfoQuota      metric.Int64UpDownCounter
+	writeDuration    metric.Float64Histogram
+	writeBatchEvents metric.Int64Histogram
+	sinkWrites       metric.Int64Counter
+	sinkDuration     metric.Float64Histogram
+	hostKeyRotations metric.Int64Counter
+	influxRequests   metric.Int64Counter
+	influxDuration   metric.Float64Histogram
+	influxFailures   metric.Int64Counter
+	spoolBatches     metric.Int64UpDownCounter
+	spoolBytes       metric.Int64UpDownCounter
+	bans             metric.Int64Counter
+	dshieldRequests  metric.Int64Counter
+	dshieldLines     metric.Int64Counter
+	abuseIPDBReports metric.Int64Counter
+	xarfReports      metric.Int64Counter
+	policies         metric.Int64Counter
+	samples          metric.Int64Counter
+	dedup            metric.Int64Counter
+	yaraMatches      metric.Int64Counter
+	sessionDuration  metric.Float64Histogram
+	sessionBytes     metric.Int64Histogram
+	liveAttempts     metric.Int64ObservableGauge
+	liveIPs          metric.Int64ObservableGauge
+
+	live            atomic.Pointer[func() LiveGauges]
+	geoCacheEntries atomic.Pointer[func() int64]
+}
+
+// LiveGauges are the live statistics reported as gauges.
+type LiveGauges struct {
+	AttemptsPerMinute int64
+	// UniqueIPs counts the source IPs by window, "1h" or "24h"
+	UniqueIPs map[string]int64
+}
+
+// NewMetrics creates the instruments from meter, logging those that fail to
+// be created.
+func NewMetrics(meter metric.Meter) *Metrics {
+	var m Metrics
+	var err error
+
+	m.connections, err = meter.Int64Counter("honeypot.connections",
+		metric.WithDescription("Connections accepted, by protocol"),
+		metric.WithUnit("{connection}"))
+	reportErr(err, "failed to create connections counter")
+
+	m.rejected, err = meter.Int64Counter("honeypot.connections.rejected",
+		metric.WithDescription("Connections closed on accept, over MAX_CONNECTIONS"),
+		metric.WithUnit("{connection}"))
+	reportErr(err, "failed to create rejected connections counter")
+
+	m.events, err = meter.Int64Counter("honeypot.events",
+		metric.WithDescription("Events captured, by function and protocol"),
+		metric.WithUnit("{event}"))
+	reportErr(err, "failed to create events counter")
+
+	m.enrichDuration, err = meter.Float64Histogram("honeypot.enrich.duration",
+		metric.WithDescription("Time spent enriching and analyzing an event"),
+		metric.WithUnit("s"))
+	reportErr(err, "failed to create enrichment duration histogram")
+
+	m.geoLookups, err = meter.Int64Counter("honeypot.geo.lookups",
+		metric.WithDescription("IP info lookups, by the provider that answered"),
+		metric.WithUnit("{lookup}"))
+	reportErr(err, "failed to create geo lookups counter")
+
+	m.geoBreakerOpens, err = meter.Int64Counter("honeypot.geo.breaker.opens",
+		metric.WithDescription("Geolocation providers skipped after failing or reaching their rate limit, by provider"),
+		metric.WithUnit("{open}"))
+	reportErr(err, "failed to create geo breaker opens counter")
+
+	m.geoCacheHits, err = meter.Int64Counter("honeypot.geo.cache.hits",
+		metric.WithDescription("IP info lookups answered by the in-memory geolocation cache"),
+		metric.WithUnit("{lookup}"))
+	reportErr(err, "failed to create geo cache hits counter")
+
+	m.geoCacheMisses, err = meter.Int64Counter("honeypot.geo.cache.misses",
+		metric.WithDescription("IP info lookups missing the in-memory geolocation cache"),
+		metric.WithUnit("{lookup}"))
+	reportErr(err, "failed to create geo cache misses counter")
+
+	m.geoCacheEvicted, err = meter.Int64Counter("honeypot.geo.cache.evictions",
+		metric.WithDescription("Entries evicted from the in-memory geolocation cache, by reason"),
+		metric.WithUnit("{entry}"))
+	reportErr(err, "failed to create geo cache evictions counter")
+
+	m.geoCacheSize, err = meter.Int64ObservableGauge("honeypot.geo.cache.entries",
+		metric.WithDescription("Entries of the in-memory geolocation cache"),
+		metric.WithUnit("{entry}"))
+	reportErr(err, "failed to create geo cache entries gauge")
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		if entries := m.geoCacheEntries.Load(); entries != nil {
+			o.ObserveInt64(m.geoCacheSize, (*entries)())
+		}
+		return nil
+	}, m.geoCacheSize)
+	reportErr(err, "failed to register geo cache entries callback")
+
+	m.ipInfoQuota, err = meter.Int64UpDownCounter("honeypot.geo.ipinfo.quota",
+		metric.WithDescription("Monthly quota left on the ipinfo.io tokens, by token"),
+		metric.WithUnit("{request}"))
+	reportErr(err, "failed to create ipinfo.io quota counter")
+
+	m.writeDuration, err = meter.Float64Histogram("honeypot.write.duration",
+		metric.WithDescription("Time spent writing a batch, retries included"),
+		metric.WithUnit("s"))
+	reportErr(err, "failed to create write duration histogram")
+
+	m.writeBatchEvents, err = meter.Int64Histogram("honeypot.write.batch_size",
+		metric.WithDescription("Events per written batch"),
+		metric.WithUnit("{event}"))
+	reportErr(err, "failed to create batch size histogram")
+
+	m.sinkWrites, err = meter.Int64Counter("honeypot.sink.writes",
+		metric.WithDescription("Batch write attempts, by sink and outcome"),
+		metric.WithUnit("{write}"))
+	reportErr(err, "failed to create sink writes counter")
+
+	m.sinkDuration, err = meter.Float64Histogram("honeypot.sink.write.duration",
+		metric.WithDescription("Time spent on a batch write attempt, by sink"),
+		metric.WithUnit("s"))
+	reportErr(err, "failed to create sink write duration histogram")
+
+	m.hostKeyRotations, err = meter.Int64Counter("honeypot.host_key.rotations",
+		metric.WithDescription("Host key rotations completed"),
+		metric.WithUnit("{rotation}"))
+	reportErr(err, "failed to create host key rotations counter")
+
+	m.influxRequests, err = meter.Int64Counter("honeypot.influxdb.requests",
+		metric.WithDescription("Write requests sent to InfluxDB, one per flushed batch or retry, by status"),
+		metric.WithUnit("{request}"))
+	reportErr(err, "failed to create InfluxDB requests counter")
+
+	m.influxDuration, err = meter.Float64Histogram("honeypot.influxdb.request.duration",
+		metric.WithDescription("Time spent on a write request to InfluxDB"),
+		metric.WithUnit("s"))
+	reportErr(err, "failed to create InfluxDB request duration histogram")
+
+	m.influxFailures, err = meter.Int64Counter("honeypot.influxdb.failed_batches",
+		metric.WithDescription("Batches of non-blocking writes that failed, by whether they are retried"),
+		metric.WithUnit("{batch}"))
+	reportErr(err, "failed to create InfluxDB failed batches counter")
+
+	m.spoolBatches, err = meter.Int64UpDownCounter("honeypot.spool.batches",
+		metric.WithDescription("Batches spooled on disk waiting for their sink, by sink"),
+		metric.WithUnit("{batch}"))
+	reportErr(err, "failed to create spool batches counter")
+
+	m.spoolBytes, err = meter.Int64UpDownCounter("honeypot.spool.size",
+		metric.WithDescription("Size of the spooled batches, by sink"),
+		metric.WithUnit("By"))
+	reportErr(err, "failed to create spool size counter")
+
+	m.bans, err = meter.Int64Counter("honeypot.bans",
+		metric.WithDescription("Source IPs banned for too many authentication attempts"),
+		metric.WithUnit("{ban}"))
+	reportErr(err, "failed to create bans counter")
+
+	m.dshieldRequests, err = meter.Int64Counter("honeypot.dshield.submissions",
+		metric.WithDescription("Submissions of authentication attempts to DShield, by whether they failed"),
+		metric.WithUnit("{submission}"))
+	reportErr(err, "failed to create DShield submissions counter")
+
+	m.dshieldLines, err = meter.Int64Counter("honeypot.dshield.lines",
+		metric.WithDescription("Authentication attempts submitted to DShield, by whether the submission failed"),
+		metric.WithUnit("{line}"))
+	reportErr(err, "failed to create DShield lines counter")
+
+	m.abuseIPDBReports, err = meter.Int64Counter("honeypot.abuseipdb.reports",
+		metric.WithDescription("Reports of source IPs to AbuseIPDB, by whether they failed"),
+		metric.WithUnit("{report}"))
+	reportErr(err, "failed to create AbuseIPDB reports counter")
+
+	m.xarfReports, err = meter.Int64Counter("honeypot.xarf.reports",
+		metric.WithDescription("Abuse reports mailed in the X-ARF format, by whether they failed"),
+		metric.WithUnit("{report}"))
+	reportErr(err, "failed to create X-ARF reports counter")
+
+	m.policies, err = meter.Int64Counter("honeypot.policies",
+		metric.WithDescription("SSH connections by the policy action applied to them"),
+		metric.WithUnit("{connection}"))
+	reportErr(err, "failed to create policies counter")
+
+	m.dedup, err = meter.Int64Counter("honeypot.dedup.collapsed",
+		metric.WithDescription("Attempts collapsed into an identical one held within PIPELINE_DEDUP_WINDOW"),
+		metric.WithUnit("{event}"))
+	reportErr(err, "failed to create dedup counter")
+
+	m.samples, err = meter.Int64Counter("honeypot.samples",
+		metric.WithDescription("Files uploaded or downloaded by attackers kept in the sample store, by whether they were already in it"),
+		metric.WithUnit("{sample}"))
+	reportErr(err, "failed to create samples counter")
+
+	m.yaraMatches, err = meter.Int64Counter("honeypot.yara.matches",
+		metric.WithDescription("Samples matching YARA rules, by rule"),
+		metric.WithUnit("{sample}"))
+	reportErr(err, "failed to create YARA matches counter")
+
+	m.sessionDuration, err = meter.Float64Histogram("honeypot.session.duration",
+		metric.WithDescription("How long connections opening a session lasted"),
+		metric.WithUnit("s"))
+	reportErr(err, "failed to create session duration histogram")
+
+	m.sessionBytes, err = meter.Int64Histogram("honeypot.session.bytes",
+		metric.WithDescription("Bytes read from and written to the session channels of a connection, by direction"),
+		metric.WithUnit("By"))
+	reportErr(err, "failed to create session bytes histogram")
+
+	m.liveAttempts, err = meter.Int64ObservableGauge("honeypot.live.attempts_per_minute",
+		metric.WithDescription("Authentication attempts over the last whole minute"),
+		metric.WithUnit("{attempt}"))
+	reportErr(err, "failed to create live attempts gauge")
+
+	m.liveIPs, err = meter.Int64ObservableGauge("honeypot.live.unique_ips",
+		metric.WithDescription("Distinct source IPs making attempts, by window"),
+		metric.WithUnit("{ip}"))
+	reportErr(err, "failed to create live unique IPs gauge")
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		live := m.live.Load()
+		if live == nil {
+			return nil
+		}
+		gauges := (*live)()
+		o.ObserveInt64(m.liveAttempts, gauges.AttemptsPerMinute)
+		for window, ips := range gauges.UniqueIPs {
+			o.ObserveInt64(m.liveIPs, ips, metric.WithAttributes(attribute.String("window", window)))
+		}
+		return nil
+	}, m.liveAttempts, m.liveIPs)
+	reportErr(err, "failed to register live statistics callback")
+
+	return &m
+}
+
+// ObserveLive has the live statistics gauges report what live returns when
+// metrics are collected.
+func (m *Metrics) ObserveLive(live func() LiveGauges) {
+	m.live.Store(&live)
+}
+
+func (m *Metrics) RecordConnection(protocol string) {
+	m.connections.Add(context.Background(), 1, metric.WithAttributes(attribute.String("protocol", protocol)))
+}
+
+func (m *Metrics) RecordConnectionRejected() {
+	m.rejected.Add(context.Background(), 1)
+}
+
+func (m *Metrics) RecordEvent(function string, protocol string) {
+	m.events.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("function", function),
+		attribute.String("protocol", protocol)))
+}
+
+func (m *Metrics) RecordEnrichment(ctx context.Context, started time.Time, err error) {
+	m.enrichDuration.Record(ctx, time.Since(started).Seconds(), metric.WithAttributes(attribute.Bool("error", err != nil)))
+}
+
+func (m *Metrics) RecordGeoLookup(ctx context.Context, provider string) {
+	m.geoLookups.Add(ctx, 1, metric.WithAttributes(attribute.String("provider", provider)))
+}
+
+func (m *Metrics) RecordGeoBreakerOpen(provider string) {
+	m.geoBreakerOpens.Add(context.Background(), 1, metric.WithAttributes(attribute.String("provider", provider)))
+}
+
+// ObserveGeoCache has the geolocation cache entries gauge report what entries
+// returns when metrics are collected.
+func (m *Metrics) ObserveGeoCache(entries func() int64) {
+	m.geoCacheEntries.Store(&entries)
+}
+
+func (m *Metrics) RecordGeoCache(ctx context.Context, hit bool) {
+	if hit {
+		m.geoCacheHits.Add(ctx, 1)
+	} else {
+		m.geoCacheMisses.Add(ctx, 1)
+	}
+}
+
+func (m *Metrics) RecordGeoCacheEviction(reason string) {
+	m.geoCacheEvicted.Add(context.Background(), 1, metric.WithAttributes(attribute.String("reason", reason)))
+}
+
+func (m *Metrics) RecordIPInfoQuota(token string, delta int64) {
+	m.ipInfoQuota.Add(context.Background(), delta, metric.WithAttributes(attribute.String("token", token)))
+}
+
+func (m *Metrics) RecordWrite(ctx context.Context, started time.Time, events int, err error) {
+	attributes := metric.WithAttributes(attribute.Bool("error", err != nil))
+	m.writeDuration.Record(ctx, time.Since(started).Seconds(), attributes)
+	m.writeBatchEvents.Record(ctx, int64(events), attributes)
+}
+
+func (m *Metrics) RecordSinkWrite(ctx context.Context, sink string, started time.Time, err error) {
+	attributes := metric.WithAttributes(attribute.String("sink", sink), attribute.Bool("error", err != nil))
+	m.sinkWrites.Add(ctx, 1, attributes)
+	m.sinkDuration.Record(ctx, time.Since(started).Seconds(), attributes)
+}
+
+func (m *Metrics) RecordHostKeyRotation() {
+	m.hostKeyRotations.Add(context.Background(), 1)
+}
+
+func (m *Metrics) RecordInfluxRequest(ctx context.Context, started time.Time, status string) {
+	m.influxRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", status)))
+	m.influxDuration.Record(ctx, time.Since(started).Seconds(), metric.WithAttributes(attribute.String("status", status)))
+}
+
+func (m *Metrics) RecordSpool(sink string, batches int64, bytes int64) {
+	attributes := metric.WithAttributes(attribute.String("sink", sink))
+	m.spoolBatches.Add(context.Background(), batches, attributes)
+	m.spoolBytes.Add(context.Background(), bytes, attributes)
+}
+
+func (m *Metrics) RecordInfluxFailure(retrying bool) {
+	m.influxFailures.Add(context.Background(), 1, metric.WithAttributes(attribute.Bool("retrying", retrying)))
+}
+
+func (m *Metrics) RecordBan(ctx context.Context) {
+	m.bans.Add(ctx, 1)
+}
+
+func (m *Metrics) RecordDShieldSubmission(ctx context.Context, lines int, err error) {
+	attributes := metric.WithAttributes(attribute.Bool("error", err != nil))
+	m.dshieldRequests.Add(ctx, 1, attributes)
+	m.dshieldLines.Add(ctx, int64(lines), attributes)
+}
+
+func (m *Metrics) RecordAbuseIPDBReport(ctx context.Context, err error) {
+	m.abuseIPDBReports.Add(ctx, 1, metric.WithAttributes(attribute.Bool("error", err != nil)))
+}
+
+func (m *Metrics) RecordXARFReport(ctx context.Context, err error) {
+	m.xarfReports.Add(ctx, 1, metric.WithAttributes(attribute.Bool("error", err != nil)))
+}
+
+func (m *Metrics) RecordPolicy(action string) {
+	m.policies.Add(context.Background(), 1, metric.WithAttributes(attribute.String("action", action)))
+}
+
+func (m *Metrics) RecordDedup() {
+	m.dedup.Add(context.Background(), 1)
+}
+
+func (m *Metrics) RecordSample(duplicate bool) {
+	m.samples.Add(context.Background(), 1, metric.WithAttributes(attribute.Bool("duplicate", duplicate)))
+}
+
+func (m *Metrics) RecordYaraMatch(rule string) {
+	m.yaraMatches.Add(context.Background(), 1, metric.WithAttributes(attribute.String("rule", rule)))
+}
+
+func (m *Metrics) RecordSessionEnd(duration time.Duration, bytesIn int64, bytesOut int64) {
+	ctx := context.Background()
+	m.sessionDuration.Record(ctx, duration.Seconds())
+	m.sessionBytes.Record(ctx, bytesIn, metric.WithAttributes(attribute.String("direction", "in")))
+	m.sessionBytes.Record(ctx, bytesOut, metric.WithAttributes(attribute.String("direction", "out")))
+}
+
+func reportErr(err error, message string) {
+	if err != nil {
+		slog.Error(message, "error", err)
+	}
+}
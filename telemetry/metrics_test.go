@@ -0,0 +1,39 @@
+package telemetry
+
+import (
+	"context"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestRecordEvent(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	metrics := NewMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test"))
+
+	metrics.RecordEvent("password", "ssh")
+	metrics.RecordEvent("password", "ssh")
+	metrics.RecordEvent("session", "ssh")
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int64{}
+	for _, scope := range collected.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "honeypot.events" {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				function, _ := point.Attributes.Value("function")
+				counts[function.AsString()] += point.Value
+			}
+		}
+	}
+	if counts["password"] != 2 || counts["session"] != 1 {
+		t.Errorf("honeypot.events = %v", counts)
+	}
+}
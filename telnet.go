@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	telnetIAC  = 255
+	telnetDont = 254
+	telnetDo   = 253
+	telnetWont = 252
+	telnetWill = 251
+	telnetSB   = 250
+	telnetSE   = 240
+	telnetEcho = 1
+
+	telnetMaxAttempts = 3
+	telnetMaxLine     = 256
+)
+
+// TelnetServer captures the credentials botnets try on Telnet, presenting
+// the login prompt of the host of the persona and rejecting every attempt.
+type TelnetServer struct {
+	hostname string
+	system   string
+	capture  func(SSHInfo) bool
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+func NewTelnetServer(hostname string, system string, capture func(SSHInfo) bool) *TelnetServer {
+	return &TelnetServer{
+		hostname: hostname,
+		system:   system,
+		capture:  capture,
+		conns:    map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections on listener until it is closed.
+func (t *TelnetServer) Serve(listener net.Listener) error {
+	defer listener.Close()
+
+	t.mu.Lock()
+	t.listener = listener
+	t.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		metrics.RecordConnection("telnet")
+		t.mu.Lock()
+		t.conns[conn] = struct{}{}
+		t.wg.Add(1)
+		t.mu.Unlock()
+
+		go func() {
+			defer func() {
+				t.mu.Lock()
+				delete(t.conns, conn)
+				t.mu.Unlock()
+				t.wg.Done()
+			}()
+			t.handle(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for the open ones until
+// ctx is done, closing them then.
+func (t *TelnetServer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (t *TelnetServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(currentSettings().MaxTimeout))
+
+	record := newConnRecord()
+	reader := bufio.NewReader(conn)
+	remoteHost, remotePort := addrHostPort(conn.RemoteAddr())
+	localHost, localPort := addrHostPort(conn.LocalAddr())
+
+	io.WriteString(conn, t.system+"\r\n")
+	for i := 0; i < telnetMaxAttempts; i++ {
+		io.WriteString(conn, t.hostname+" login: ")
+		user, err := readTelnetLine(reader)
+		if err != nil {
+			return
+		}
+
+		// Ask the client to stop echoing while the password is typed.
+		conn.Write([]byte{telnetIAC, telnetWill, telnetEcho})
+		io.WriteString(conn, "Password: ")
+		password, err := readTelnetLine(reader)
+		conn.Write([]byte{telnetIAC, telnetWont, telnetEcho})
+		if err != nil {
+			return
+		}
+
+		sshInfo := SSHInfo{
+			User:       user,
+			RemoteHost: remoteHost,
+			RemotePort: remotePort,
+			LocalHost:  localHost,
+			LocalPort:  localPort,
+			Password:   password,
+			Function:   "password",
+			Protocol:   "telnet",
+			Node:       node,
+			Timestamp:  time.Now(),
+		}
+		if record.observeAttempt(&sshInfo) {
+			t.capture(sshInfo)
+		}
+
+		time.Sleep(2 * time.Second)
+		io.WriteString(conn, "\r\nLogin incorrect\r\n")
+	}
+
+	slog.Info("Closed telnet connection", "remote_host", remoteHost)
+}
+
+// readTelnetLine reads a line, leaving out telnet commands and option
+// negotiations.
+func readTelnetLine(reader *bufio.Reader) (string, error) {
+	var line strings.Builder
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch b {
+		case telnetIAC:
+			if err := skipTelnetCommand(reader); err != nil {
+				return "", err
+			}
+		case '\r', '\n':
+			if line.Len() == 0 {
+				continue
+			}
+			return line.String(), nil
+		case 0:
+		default:
+			if line.Len() < telnetMaxLine {
+				line.WriteByte(b)
+			}
+		}
+	}
+}
+
+func skipTelnetCommand(reader *bufio.Reader) error {
+	command, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case telnetWill, telnetWont, telnetDo, telnetDont:
+		_, err = reader.ReadByte()
+		return err
+	case telnetSB:
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == telnetIAC {
+				if next, err := reader.ReadByte(); err != nil || next == telnetSE {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
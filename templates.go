@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// alertTemplateFuncs are available to every notifier template, in addition
+// to the escaping helpers specific to each notifier.
+var alertTemplateFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"join":  strings.Join,
+	// truncate counts runes, not to split a multi-byte character
+	"truncate": func(length int, value string) string {
+		runes := []rune(value)
+		if len(runes) <= length {
+			return value
+		}
+		return string(runes[:max(length, 0)]) + "…"
+	},
+	"default": func(fallback string, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+	"json": func(value any) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// templateFromEnv returns the template text configured through key, read
+// from the file named by key_FILE if set, or fallback otherwise.
+func templateFromEnv(key string, fallback string) (string, error) {
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_FILE: %v", key, err)
+		}
+		return string(content), nil
+	}
+
+	return getEnv(key, fallback), nil
+}
+
+// parseAlertTemplate parses a notifier template with the common functions
+// plus the notifier specific ones.
+func parseAlertTemplate(name string, text string, funcs template.FuncMap) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(alertTemplateFuncs).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+
+	return tmpl, nil
+}
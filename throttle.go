@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type throttleEntry struct {
+	started    time.Time
+	suppressed int
+	last       Alert
+}
+
+// AlertThrottle deduplicates alerts of the same rule for the same source IP
+// within a window, and caps the overall alert rate. Suppressed alerts are not
+// lost: once their window ends they are rolled up into one summary alert.
+type AlertThrottle struct {
+	window    time.Duration
+	perMinute int
+
+	mu           sync.Mutex
+	entries      map[string]*throttleEntry
+	minute       time.Time
+	sentInMinute int
+	rateDropped  int
+}
+
+func NewAlertThrottle(window time.Duration, perMinute int) *AlertThrottle {
+	return &AlertThrottle{
+		window:    window,
+		perMinute: perMinute,
+		entries:   map[string]*throttleEntry{},
+	}
+}
+
+// Allow reports whether alert should be sent now.
+func (t *AlertThrottle) Allow(alert Alert) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	key := alertDedupKey(alert)
+
+	if t.window > 0 {
+		if entry, found := t.entries[key]; found && now.Sub(entry.started) < t.window {
+			entry.suppressed++
+			entry.last = alert
+			return false
+		}
+		t.entries[key] = &throttleEntry{started: now}
+	}
+
+	if t.perMinute > 0 {
+		if now.Sub(t.minute) >= time.Minute {
+			t.minute = now
+			t.sentInMinute = 0
+		}
+		if t.sentInMinute >= t.perMinute {
+			t.rateDropped++
+			return false
+		}
+		t.sentInMinute++
+	}
+
+	return true
+}
+
+// RollUps returns one summary alert for every dedup window that ended with
+// suppressed alerts, plus one for alerts dropped by the rate limit.
+func (t *AlertThrottle) RollUps() []Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var rollUps []Alert
+	now := time.Now()
+
+	for key, entry := range t.entries {
+		if now.Sub(entry.started) < t.window {
+			continue
+		}
+
+		delete(t.entries, key)
+		if entry.suppressed == 0 {
+			continue
+		}
+
+		rollUp := entry.last
+		rollUp.Summary = fmt.Sprintf("%d more '%s' alerts for %s in the last %s (latest: %s)",
+			entry.suppressed, rollUp.Rule, rollUp.Event.SSHInfo.RemoteHost, t.window, rollUp.Summary)
+		rollUp.Timestamp = now
+		rollUps = append(rollUps, rollUp)
+	}
+
+	if t.rateDropped > 0 {
+		rollUps = append(rollUps, Alert{
+			Rule:      "rate_limit",
+			Severity:  SeverityWarning,
+			Summary:   fmt.Sprintf("%d alerts were dropped by the rate limit of %d per minute", t.rateDropped, t.perMinute),
+			Timestamp: now,
+		})
+		t.rateDropped = 0
+	}
+
+	return rollUps
+}
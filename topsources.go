@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	sourceBucketSize = 5 * time.Minute
+	sourceBuckets    = int(24 * time.Hour / sourceBucketSize)
+
+	// Distinct source IPs, ASes and countries tracked per bucket, further
+	// ones being ignored.
+	maxSourcesPerBucket = 10000
+)
+
+// TopSource is a source IP, AS or country, the authentication attempts made
+// from it over a window and when it was last seen.
+type TopSource struct {
+	Value    string    `json:"value"`
+	Attempts int       `json:"attempts"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// TopSources is the ranking of the sources over a window.
+type TopSources struct {
+	Window    string      `json:"window"`
+	Since     time.Time   `json:"since"`
+	Attempts  int         `json:"attempts"`
+	IPs       []TopSource `json:"ips,omitempty"`
+	ASNs      []TopSource `json:"asns,omitempty"`
+	Countries []TopSource `json:"countries,omitempty"`
+}
+
+type sourceBucket struct {
+	start     time.Time
+	ips       map[string]*TopSource
+	asns      map[string]*TopSource
+	countries map[string]*TopSource
+	attempts  int
+}
+
+// SourceStats keeps rolling counts of the authentication attempts per source
+// IP, AS and country over the last day, in 5 minute buckets, so the top
+// attackers over any window up to a day can be ranked without querying the
+// raw events.
+type SourceStats struct {
+	mu      sync.Mutex
+	buckets []*sourceBucket
+}
+
+func NewSourceStats() *SourceStats {
+	return &SourceStats{buckets: make([]*sourceBucket, sourceBuckets)}
+}
+
+// Observe counts the authentication attempts of the event's source, those
+// collapsed by the Deduper included.
+func (s *SourceStats) Observe(ctx context.Context, event Event) {
+	sshInfo := event.SSHInfo
+	if !isPasswordAttempt(sshInfo) && sshInfo.Function != "public_key" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.bucket(sshInfo.Timestamp)
+	if bucket == nil {
+		return
+	}
+
+	attempts := max(sshInfo.AttemptCount, 1)
+	bucket.attempts += attempts
+	countSource(bucket.ips, sshInfo.RemoteHost, attempts, sshInfo.Timestamp)
+	countSource(bucket.asns, event.IPInfo.Org, attempts, sshInfo.Timestamp)
+	countSource(bucket.countries, event.IPInfo.Country, attempts, sshInfo.Timestamp)
+}
+
+func countSource(sources map[string]*TopSource, value string, attempts int, timestamp time.Time) {
+	if value == "" {
+		return
+	}
+
+	source, found := sources[value]
+	if !found {
+		if len(sources) >= maxSourcesPerBucket {
+			return
+		}
+		source = &TopSource{Value: value}
+		sources[value] = source
+	}
+	source.Attempts += attempts
+	if timestamp.After(source.LastSeen) {
+		source.LastSeen = timestamp
+	}
+}
+
+// bucket returns the bucket for timestamp, recycling the slot of a bucket
+// that fell out of the day window. Timestamps older than a day are ignored.
+func (s *SourceStats) bucket(timestamp time.Time) *sourceBucket {
+	start := timestamp.Truncate(sourceBucketSize)
+	if time.Since(start) >= 24*time.Hour {
+		return nil
+	}
+
+	slot := int(start.Unix()/int64(sourceBucketSize/time.Second)) % sourceBuckets
+	bucket := s.buckets[slot]
+	if bucket == nil || !bucket.start.Equal(start) {
+		bucket = &sourceBucket{
+			start:     start,
+			ips:       map[string]*TopSource{},
+			asns:      map[string]*TopSource{},
+			countries: map[string]*TopSource{},
+		}
+		s.buckets[slot] = bucket
+	}
+
+	return bucket
+}
+
+// Top returns the limit sources with the most attempts over window, of the
+// kinds listed in by ("ip", "asn" or "country"), all of them when empty.
+// The window is rounded up to whole buckets.
+func (s *SourceStats) Top(window time.Duration, limit int, by []string) (TopSources, error) {
+	if window <= 0 || window > 24*time.Hour {
+		return TopSources{}, fmt.Errorf("window must be between 0 and 24h, got %s", window)
+	}
+	kinds := map[string]bool{}
+	for _, kind := range by {
+		switch kind {
+		case "ip", "asn", "country":
+			kinds[kind] = true
+		default:
+			return TopSources{}, fmt.Errorf("unknown source kind '%s'", kind)
+		}
+	}
+	all := len(kinds) == 0
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ips := map[string]*TopSource{}
+	asns := map[string]*TopSource{}
+	countries := map[string]*TopSource{}
+	top := TopSources{Window: window.String(), Since: time.Now().Add(-window).Truncate(sourceBucketSize)}
+	for _, bucket := range s.buckets {
+		if bucket == nil || bucket.start.Before(top.Since) {
+			continue
+		}
+
+		top.Attempts += bucket.attempts
+		mergeSources(ips, bucket.ips)
+		mergeSources(asns, bucket.asns)
+		mergeSources(countries, bucket.countries)
+	}
+
+	if all || kinds["ip"] {
+		top.IPs = topSources(ips, limit)
+	}
+	if all || kinds["asn"] {
+		top.ASNs = topSources(asns, limit)
+	}
+	if all || kinds["country"] {
+		top.Countries = topSources(countries, limit)
+	}
+
+	return top, nil
+}
+
+// UniqueIPs returns how many distinct source IPs made attempts over window,
+// rounded up to whole buckets.
+func (s *SourceStats) UniqueIPs(window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ips := map[string]struct{}{}
+	since := time.Now().Add(-window).Truncate(sourceBucketSize)
+	for _, bucket := range s.buckets {
+		if bucket == nil || bucket.start.Before(since) {
+			continue
+		}
+		for ip := range bucket.ips {
+			ips[ip] = struct{}{}
+		}
+	}
+
+	return len(ips)
+}
+
+func mergeSources(into map[string]*TopSource, from map[string]*TopSource) {
+	for value, source := range from {
+		merged, found := into[value]
+		if !found {
+			merged = &TopSource{Value: value}
+			into[value] = merged
+		}
+		merged.Attempts += source.Attempts
+		if source.LastSeen.After(merged.LastSeen) {
+			merged.LastSeen = source.LastSeen
+		}
+	}
+}
+
+// topSources returns the n sources with the most attempts, the most recently
+// seen first among equals.
+func topSources(sources map[string]*TopSource, n int) []TopSource {
+	top := make([]TopSource, 0, len(sources))
+	for _, source := range sources {
+		top = append(top, *source)
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Attempts != top[j].Attempts {
+			return top[i].Attempts > top[j].Attempts
+		}
+		if !top[i].LastSeen.Equal(top[j].LastSeen) {
+			return top[i].LastSeen.After(top[j].LastSeen)
+		}
+		return top[i].Value < top[j].Value
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+// topAttackers runs the top-attackers subcommand: it fetches the top sources
+// from the API of a running honeypot and prints them as tables, or as JSON.
+func topAttackers(args []string) error {
+	flags := flag.NewFlagSet("top-attackers", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML configuration file (env CONFIG_FILE)")
+	apiURL := flags.String("api-url", "", "URL of the honeypot API, default from API_LISTEN_ADDR")
+	window := flags.Duration("window", time.Hour, "window to rank the sources over, up to 24h")
+	limit := flags.Int("limit", 10, "sources to list per kind")
+	by := flags.String("by", "", "comma separated kinds of sources, 'ip', 'asn' or 'country', all of them when unset")
+	asJSON := flags.Bool("json", false, "print the response as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: ssh-honeypot top-attackers [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Lists the source IPs, ASes and countries with the most authentication\nattempts, as counted by a running honeypot, through its API.\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument '%s'", flags.Arg(0))
+	}
+
+	// Picks up the API address and token from the configuration file and
+	// secrets
+	if _, err := NewReloader(*configPath); err != nil {
+		return err
+	}
+	if *apiURL == "" {
+		listenAddr := os.Getenv("API_LISTEN_ADDR")
+		if listenAddr == "" {
+			return errors.New("no API to query, set --api-url or API_LISTEN_ADDR")
+		}
+		host, port, err := net.SplitHostPort(listenAddr)
+		if err != nil {
+			return err
+		}
+		if host == "" || net.ParseIP(host).IsUnspecified() {
+			host = "localhost"
+		}
+		*apiURL = "http://" + net.JoinHostPort(host, port)
+	}
+
+	query := url.Values{}
+	query.Set("window", window.String())
+	query.Set("limit", strconv.Itoa(*limit))
+	if *by != "" {
+		query.Set("by", *by)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(*apiURL, "/")+"/api/top-attackers?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if token := currentSettings().APIToken; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var top TopSources
+	if err := json.NewDecoder(resp.Body).Decode(&top); err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(top)
+	}
+
+	fmt.Printf("%d authentication attempts since %s\n", top.Attempts, top.Since.Local().Format(time.DateTime))
+	kinds := splitList(*by)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, section := range []struct {
+		kind    string
+		sources []TopSource
+	}{{"ip", top.IPs}, {"asn", top.ASNs}, {"country", top.Countries}} {
+		if len(kinds) > 0 && !slices.Contains(kinds, section.kind) {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\tATTEMPTS\tLAST SEEN\n", strings.ToUpper(section.kind))
+		for _, source := range section.sources {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", source.Value, source.Attempts, source.LastSeen.Local().Format(time.DateTime))
+		}
+	}
+
+	return w.Flush()
+}
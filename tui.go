@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	// tuiLogLines is how many log lines the TUI keeps to show
+	tuiLogLines = 100
+	// tuiSparks draw the attempts per minute, from none to the most
+	tuiSparks = " ▁▂▃▄▅▆▇█"
+)
+
+// TUI draws a live view of the honeypot in the terminal: the attempts per
+// minute, the recent events, the sessions in progress, the top credentials
+// and the health of the sinks. While it runs, it takes the place of stderr
+// for the logs, keeping their last lines to show.
+type TUI struct {
+	out      *os.File
+	in       *os.File
+	interval time.Duration
+	started  time.Time
+
+	// Set up as the honeypot starts, before Run
+	sessions    *SessionTracker
+	recent      *RecentEvents
+	live        *LiveStats
+	credentials *CredentialStats
+	sinks       func() []SinkHealth
+	stages      func() []StageSnapshot
+
+	mu      sync.Mutex
+	running bool
+	logs    []string
+	partial []byte
+}
+
+func NewTUI(out *os.File, in *os.File, interval time.Duration) *TUI {
+	return &TUI{out: out, in: in, interval: interval, started: time.Now()}
+}
+
+// tuiFromEnv returns nil unless TUI_ENABLED is set, failing when stdout
+// isn't a terminal.
+func tuiFromEnv() (*TUI, error) {
+	if os.Getenv("TUI_ENABLED") != "true" {
+		return nil, nil
+	}
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, fmt.Errorf("stdout is not a terminal")
+	}
+	if os.Getenv("STDOUT_EVENTS") == "true" {
+		return nil, fmt.Errorf("STDOUT_EVENTS writes to the terminal the TUI draws on")
+	}
+
+	return NewTUI(os.Stdout, os.Stdin, getEnvDuration("TUI_REFRESH_INTERVAL", time.Second)), nil
+}
+
+// Watch has the TUI show what the pipeline observes.
+func (t *TUI) Watch(recent *RecentEvents, live *LiveStats, credentials *CredentialStats, sinks func() []SinkHealth, stages func() []StageSnapshot) {
+	t.recent, t.live, t.credentials, t.sinks, t.stages = recent, live, credentials, sinks, stages
+}
+
+// WatchSessions has the TUI show the sessions in progress.
+func (t *TUI) WatchSessions(sessions *SessionTracker) {
+	t.sessions = sessions
+}
+
+// Write takes the log lines, passed on to stderr unless the TUI runs.
+func (t *TUI) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.running {
+		return os.Stderr.Write(p)
+	}
+
+	t.partial = append(t.partial, p...)
+	for {
+		end := bytes.IndexByte(t.partial, '\n')
+		if end < 0 {
+			break
+		}
+		t.logs = append(t.logs, string(t.partial[:end]))
+		t.partial = t.partial[end+1:]
+	}
+	if len(t.logs) > tuiLogLines {
+		t.logs = t.logs[len(t.logs)-tuiLogLines:]
+	}
+
+	return len(p), nil
+}
+
+// Run draws the view every interval until ctx is done, calling quit when
+// 'q' or Ctrl-C is pressed. The terminal is restored on return, and the log
+// lines of the last screen written back to stderr.
+func (t *TUI) Run(ctx context.Context, quit func()) error {
+	t.mu.Lock()
+	t.running = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.running = false
+		logs := t.logs
+		t.mu.Unlock()
+		for _, line := range logs[max(len(logs)-10, 0):] {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}()
+
+	fd := int(t.in.Fd())
+	if term.IsTerminal(fd) {
+		// Ctrl-C no longer raises SIGINT in raw mode, it is read as a key
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+		go t.readKeys(quit)
+	}
+
+	// Alternate screen, cursor hidden
+	io.WriteString(t.out, "\x1b[?1049h\x1b[?25l")
+	defer io.WriteString(t.out, "\x1b[?25h\x1b[?1049l")
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *TUI) readKeys(quit func()) {
+	buf := make([]byte, 16)
+	for {
+		n, err := t.in.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, key := range buf[:n] {
+			// Ctrl-C, Ctrl-D, q
+			if key == 3 || key == 4 || key == 'q' || key == 'Q' {
+				quit()
+				return
+			}
+		}
+	}
+}
+
+func (t *TUI) draw() {
+	width, height, err := term.GetSize(int(t.out.Fd()))
+	if err != nil || width < 40 || height < 10 {
+		width, height = 80, 24
+	}
+
+	var top, bottom []string
+	top = append(top, t.header(width)...)
+	top = append(top, t.sessionLines(width)...)
+	top = append(top, t.credentialLines(width)...)
+	top = append(top, t.sinkLines(width)...)
+	bottom = t.logLines(width, 5)
+
+	// The recent events take whatever room is left
+	events := t.eventLines(width, height-len(top)-len(bottom))
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	lines := append(append(top, events...), bottom...)
+	for i, line := range lines[:min(len(lines), height)] {
+		if i > 0 {
+			screen.WriteString("\r\n")
+		}
+		screen.WriteString(line)
+		screen.WriteString("\x1b[K")
+	}
+	screen.WriteString("\x1b[J")
+	io.WriteString(t.out, screen.String())
+}
+
+func (t *TUI) header(width int) []string {
+	title := fmt.Sprintf("\x1b[1mssh-honeypot\x1b[0m %s  up %s  (q to quit)", node.ID, time.Since(t.started).Truncate(time.Second))
+	if t.live == nil {
+		return []string{title, ""}
+	}
+
+	minutes := t.live.Minutes(time.Now())
+	peak := 0
+	for _, count := range minutes {
+		peak = max(peak, count)
+	}
+	sparks := []rune(tuiSparks)
+	var spark strings.Builder
+	for _, count := range minutes[max(len(minutes)-(width-30), 0):] {
+		level := 0
+		if peak > 0 {
+			level = (count*(len(sparks)-1) + peak - 1) / peak
+		}
+		spark.WriteRune(sparks[level])
+	}
+
+	hour := t.live.Window("1h", time.Hour)
+	return []string{
+		title,
+		tuiFit(fmt.Sprintf("attempts/min %-6d last hour %d attempts from %d IPs", minutes[len(minutes)-1], hour.Attempts, hour.UniqueIPs), width),
+		fmt.Sprintf("last 60 min  %s", spark.String()),
+		"",
+	}
+}
+
+func (t *TUI) sessionLines(width int) []string {
+	if t.sessions == nil {
+		return nil
+	}
+
+	sessions := t.sessions.Sessions()
+	lines := []string{tuiHeading(fmt.Sprintf("Active sessions (%d)", len(sessions)), width)}
+	for i, session := range sessions {
+		if i == 5 {
+			lines = append(lines, fmt.Sprintf("  ... %d more", len(sessions)-i))
+			break
+		}
+		lines = append(lines, tuiFit(fmt.Sprintf("  %-8s %-39s %-16s %-7s %s",
+			time.Since(session.Started).Truncate(time.Second), session.RemoteHost, session.User, session.Kind, session.Command), width))
+	}
+
+	return append(lines, "")
+}
+
+func (t *TUI) credentialLines(width int) []string {
+	if t.credentials == nil {
+		return nil
+	}
+
+	summary := t.credentials.Summary("1h", time.Hour)
+	lines := []string{tuiHeading("Top credentials (1h)", width)}
+	column := (width - 4) / 2
+	for i := 0; i < 5 && (i < len(summary.Usernames) || i < len(summary.Passwords)); i++ {
+		var user, password string
+		if i < len(summary.Usernames) {
+			user = fmt.Sprintf("%6d %s", summary.Usernames[i].Count, summary.Usernames[i].Value)
+		}
+		if i < len(summary.Passwords) {
+			password = fmt.Sprintf("%6d %s", summary.Passwords[i].Count, summary.Passwords[i].Value)
+		}
+		lines = append(lines, "  "+tuiPad(tuiFit(user, column), column)+tuiFit(password, column))
+	}
+
+	return append(lines, "")
+}
+
+func (t *TUI) sinkLines(width int) []string {
+	if t.sinks == nil {
+		return nil
+	}
+
+	lines := []string{tuiHeading("Sinks", width)}
+	for _, sink := range t.sinks() {
+		status := "\x1b[32mok\x1b[0m  "
+		if sink.LastErrorAt != nil && (sink.LastWrite == nil || sink.LastWrite.Before(*sink.LastErrorAt)) {
+			status = "\x1b[31mfail\x1b[0m"
+		}
+		lastWrite := "never"
+		if sink.LastWrite != nil {
+			lastWrite = time.Since(*sink.LastWrite).Truncate(time.Second).String() + " ago"
+		}
+		line := fmt.Sprintf("%-14s written %-8d failures %-5d spooled %-4d last write %s",
+			sink.Name, sink.Written, sink.Failures, sink.Spooled, lastWrite)
+		if sink.LastError != "" {
+			line += "  " + sink.LastError
+		}
+		lines = append(lines, "  "+status+" "+tuiFit(line, width-7))
+	}
+
+	var stages []string
+	for _, stage := range t.stages() {
+		stages = append(stages, fmt.Sprintf("%s %d/%d", stage.Stage, stage.QueueDepth, stage.Dropped))
+	}
+	lines = append(lines, tuiFit("  queued/dropped: "+strings.Join(stages, "  "), width))
+
+	return append(lines, "")
+}
+
+func (t *TUI) eventLines(width int, rows int) []string {
+	if t.recent == nil || rows < 2 {
+		return nil
+	}
+
+	lines := []string{tuiHeading("Recent events", width)}
+	for _, event := range t.recent.Events(rows - 1) {
+		detail := event.User
+		if event.Password != "" {
+			detail += " / " + event.Password
+		}
+		if event.KeyFingerprint != "" {
+			detail += " " + event.KeyFingerprint
+		}
+		if event.Command != "" {
+			detail += " $ " + event.Command
+		}
+		if event.URL != "" {
+			detail += " " + event.HTTPMethod + " " + event.URL
+		}
+		lines = append(lines, tuiFit(fmt.Sprintf("  %s %-6s %-14s %-39s %-2s %s",
+			event.Timestamp.Local().Format(time.TimeOnly), event.Protocol, event.Function, event.RemoteHost, event.Country, detail), width))
+	}
+
+	return lines
+}
+
+func (t *TUI) logLines(width int, rows int) []string {
+	t.mu.Lock()
+	logs := t.logs[max(len(t.logs)-rows, 0):]
+	t.mu.Unlock()
+
+	lines := []string{"", tuiHeading("Log", width)}
+	for _, line := range logs {
+		lines = append(lines, tuiFit("  "+line, width))
+	}
+
+	return lines
+}
+
+// tuiHeading returns title in bold, underlined to the screen width.
+func tuiHeading(title string, width int) string {
+	return "\x1b[1;4m" + tuiPad(title, width) + "\x1b[0m"
+}
+
+// tuiFit cuts s to width runes, replacing control characters, escape
+// sequences attackers may have sent included.
+func tuiFit(s string, width int) string {
+	var fitted strings.Builder
+	n := 0
+	for _, r := range s {
+		if n == width {
+			break
+		}
+		if r < ' ' || r >= 0x7f && r < 0xa0 || r == utf8.RuneError {
+			r = '?'
+		}
+		fitted.WriteRune(r)
+		n++
+	}
+
+	return fitted.String()
+}
+
+// tuiPad pads s with spaces to width runes.
+func tuiPad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+
+	return s
+}
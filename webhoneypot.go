@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// webMaxBody bounds the login forms read, larger bodies being cut short
+	webMaxBody = 64 << 10
+	// webServer is the Server header, that of the nginx of a Debian 9 host
+	webServer = "nginx/1.10.3"
+)
+
+// webConnKey holds the ConnRecord of an HTTP connection in the context of
+// its requests.
+type webConnKey struct{}
+
+// webUserFields and webPasswordFields are the names login forms give their
+// fields, the first one found being taken.
+var (
+	webUserFields     = []string{"username", "user", "login", "email", "uname", "log", "name"}
+	webPasswordFields = []string{"password", "pass", "passwd", "pwd", "secret"}
+)
+
+var webLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; background: #f2f2f2; }
+form { width: 300px; margin: 120px auto; padding: 24px; background: #fff; border: 1px solid #ddd; }
+input { display: block; width: 100%; margin: 8px 0 16px; padding: 6px; box-sizing: border-box; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<form method="post" action="/login">
+<h2>{{.Title}}</h2>
+{{if .Failed}}<p class="error">Invalid username or password.</p>{{end}}
+<label>Username<input type="text" name="username" autofocus></label>
+<label>Password<input type="password" name="password"></label>
+<input type="submit" value="Log in">
+</form>
+</body>
+</html>
+`))
+
+// WebServer captures the requests web scanners send and the credentials
+// they try, behind a login form or an HTTP basic authentication realm, and
+// rejects every attempt. Requests are captured as "http_request" events and
+// credentials as "password" ones, with the "http" protocol.
+type WebServer struct {
+	// realm is that of the basic authentication asked for, the login form
+	// being served when empty
+	realm   string
+	title   string
+	capture func(SSHInfo) bool
+	server  *http.Server
+}
+
+func NewWebServer(realm string, title string, capture func(SSHInfo) bool) *WebServer {
+	w := &WebServer{realm: realm, title: title, capture: capture}
+	w.server = &http.Server{
+		Handler:           w,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			metrics.RecordConnection("http")
+			return context.WithValue(ctx, webConnKey{}, newConnRecord())
+		},
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+
+	return w
+}
+
+// webServerFromEnv returns nil unless HTTP_PORT or HTTPS_PORT is set.
+func webServerFromEnv(hostname string, capture func(SSHInfo) bool) *WebServer {
+	if os.Getenv("HTTP_PORT") == "" && os.Getenv("HTTPS_PORT") == "" {
+		return nil
+	}
+
+	return NewWebServer(os.Getenv("HTTP_REALM"), getEnv("HTTP_TITLE", hostname+" - Login"), capture)
+}
+
+// webTLSConfig returns the certificate of HTTPS_CERT_FILE and HTTPS_KEY_FILE,
+// or a self-signed one for hostname when they aren't set, as appliances
+// serve.
+func webTLSConfig(hostname string) (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("HTTPS_CERT_FILE"), os.Getenv("HTTPS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	certTemplate := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		DNSNames:              []string{hostname},
+		NotBefore:             templateModTime,
+		NotAfter:              templateModTime.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, certTemplate, certTemplate, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, nil
+}
+
+// Serve answers the requests of the connections accepted on listener until
+// the server is shut down, returning http.ErrServerClosed then.
+func (w *WebServer) Serve(listener net.Listener) error {
+	return w.server.Serve(listener)
+}
+
+// Shutdown stops accepting connections and waits for the open ones until
+// ctx is done.
+func (w *WebServer) Shutdown(ctx context.Context) error {
+	return w.server.Shutdown(ctx)
+}
+
+func (w *WebServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	record, _ := r.Context().Value(webConnKey{}).(*ConnRecord)
+	if record == nil {
+		record = newConnRecord()
+	}
+
+	sshInfo := w.newSSHInfo(r, "http_request")
+	w.capture(sshInfo)
+	slog.Info("HTTP request", "remote_host", sshInfo.RemoteHost, "method", r.Method, "url", sshInfo.URL, "user_agent", sshInfo.UserAgent)
+
+	rw.Header().Set("Server", webServer)
+	if w.realm != "" {
+		if user, password, ok := r.BasicAuth(); ok {
+			w.attempt(r, record, user, password)
+		}
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", w.realm))
+		http.Error(rw, "401 Authorization Required", http.StatusUnauthorized)
+		return
+	}
+
+	failed := false
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(rw, r.Body, webMaxBody)
+		if err := r.ParseForm(); err == nil {
+			user, password := webFormValue(r, webUserFields), webFormValue(r, webPasswordFields)
+			if user != "" || password != "" {
+				w.attempt(r, record, user, password)
+				failed = true
+			}
+		}
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if failed {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}
+	webLoginPage.Execute(rw, struct {
+		Title  string
+		Failed bool
+	}{w.title, failed})
+}
+
+// attempt captures the credentials of a login attempt, and makes the client
+// wait as a server checking them would.
+func (w *WebServer) attempt(r *http.Request, record *ConnRecord, user string, password string) {
+	sshInfo := w.newSSHInfo(r, "password")
+	sshInfo.User, sshInfo.Password = user, password
+	if record.observeAttempt(&sshInfo) {
+		w.capture(sshInfo)
+		slog.Info("HTTP login attempt", "remote_host", sshInfo.RemoteHost, "user", user, "url", sshInfo.URL)
+	}
+
+	time.Sleep(time.Second)
+}
+
+func (w *WebServer) newSSHInfo(r *http.Request, function string) SSHInfo {
+	remoteHost, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+	localHost, localPort := "", ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localHost, localPort = addrHostPort(addr)
+	}
+
+	return SSHInfo{
+		RemoteHost: remoteHost,
+		RemotePort: remotePort,
+		LocalHost:  localHost,
+		LocalPort:  localPort,
+		HTTPMethod: r.Method,
+		Path:       r.URL.Path,
+		URL:        r.URL.RequestURI(),
+		UserAgent:  r.UserAgent(),
+		Function:   function,
+		Protocol:   "http",
+		Node:       node,
+		Timestamp:  time.Now(),
+	}
+}
+
+// webFormValue returns the value of the first of names found in the form of
+// r, whatever their case.
+func webFormValue(r *http.Request, names []string) string {
+	for _, name := range names {
+		for field, values := range r.PostForm {
+			if strings.EqualFold(field, name) && len(values) > 0 {
+				return values[0]
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WebhookSink POSTs every event as a JSON EventDocument to each of its URLs,
+// retrying failed deliveries with an exponential backoff. Each delivery
+// carries the event ID in X-Honeypot-Event-Id, for receivers to drop the
+// duplicates retries may cause, and, when a secret is set, an HMAC-SHA256
+// signature of the timestamp and body in X-Honeypot-Signature.
+type WebhookSink struct {
+	urls       []string
+	headers    map[string]string
+	secret     []byte
+	maxElapsed time.Duration
+	client     *http.Client
+	tracer     trace.Tracer
+}
+
+func NewWebhookSink(urls []string, headers map[string]string, secret string, maxElapsed time.Duration, tracer trace.Tracer) *WebhookSink {
+	return &WebhookSink{
+		urls:       urls,
+		headers:    headers,
+		secret:     []byte(secret),
+		maxElapsed: maxElapsed,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		tracer:     tracer,
+	}
+}
+
+func webhookSinkFromEnv(tracer trace.Tracer) (Sink, error) {
+	urls := splitList(os.Getenv("WEBHOOK_URLS"))
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	headers, err := parseWebhookHeaders(splitList(os.Getenv("WEBHOOK_HEADERS")))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWebhookSink(urls, headers, os.Getenv("WEBHOOK_SECRET"), getEnvDuration("WEBHOOK_MAX_ELAPSED", 30*time.Second), tracer), nil
+}
+
+// parseWebhookHeaders parses "Name: value" specs.
+func parseWebhookHeaders(specs []string) (map[string]string, error) {
+	headers := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		name, value, found := strings.Cut(spec, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header '%s', expected 'Name: value'", spec)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return headers, nil
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+// Write delivers the batch to every URL concurrently, each URL receiving the
+// events in order.
+func (s *WebhookSink) Write(ctx context.Context, batch Batch) error {
+	ctx, span := s.tracer.Start(
+		ctx,
+		"writeToWebhooks",
+		trace.WithAttributes(attribute.Int("batch_size", len(batch.Events))))
+	defer span.End()
+
+	documents := make([]EventDocument, len(batch.Events))
+	for i, event := range batch.Events {
+		documents[i] = newEventDocument(event)
+	}
+
+	errs := make([]error, len(s.urls))
+	var wg sync.WaitGroup
+	for i, url := range s.urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			for _, document := range documents {
+				if err := s.deliver(ctx, url, document); err != nil {
+					errs[i] = fmt.Errorf("%s: %w", url, err)
+					return
+				}
+			}
+		}(i, url)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Delivered %d events to %d webhooks", len(documents), len(s.urls)))
+	return nil
+}
+
+func (s *WebhookSink) deliver(ctx context.Context, url string, document EventDocument) error {
+	body, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	backoffSettings := backoff.NewExponentialBackOff()
+	backoffSettings.MaxElapsedTime = s.maxElapsed
+
+	return backoff.Retry(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Honeypot-Event-Id", document.ID)
+		for name, value := range s.headers {
+			req.Header.Set(name, value)
+		}
+		if len(s.secret) > 0 {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set("X-Honeypot-Timestamp", timestamp)
+			req.Header.Set("X-Honeypot-Signature", "sha256="+s.sign(timestamp, body))
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			err := fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+			// Other client errors won't be fixed by sending the same request again
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+
+		return nil
+	}, backoff.WithContext(backoffSettings, ctx))
+}
+
+// sign computes the hex HMAC-SHA256 of "timestamp.body", binding the
+// signature to its timestamp so receivers can reject replayed deliveries.
+func (s *WebhookSink) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The most common passwords of public breach corpora and the defaults of
+// the devices botnets go after.
+//
+//go:embed wordlist.txt
+var embeddedWordlist string
+
+type wordlist struct {
+	name      string
+	passwords map[string]struct{}
+}
+
+// Wordlists tags passwords found in common credential wordlists, telling
+// generic dictionary attacks apart from bespoke credentials.
+type Wordlists struct {
+	lists []wordlist
+}
+
+// LoadWordlists loads the embedded list, named "common", followed by the
+// lists in specs, each either "name=path" or a path named after its file.
+// Lists are plain text with one password per line.
+func LoadWordlists(specs []string) (*Wordlists, error) {
+	common, err := readWordlist("common", strings.NewReader(embeddedWordlist))
+	if err != nil {
+		return nil, err
+	}
+	w := &Wordlists{lists: []wordlist{common}}
+
+	for _, spec := range specs {
+		name, path, found := strings.Cut(spec, "=")
+		if !found {
+			path = spec
+			name = strings.TrimSuffix(path[strings.LastIndex(path, "/")+1:], ".txt")
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		list, err := readWordlist(name, file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read wordlist '%s': %v", path, err)
+		}
+
+		w.lists = append(w.lists, list)
+	}
+
+	return w, nil
+}
+
+func readWordlist(name string, r io.Reader) (wordlist, error) {
+	list := wordlist{name: name, passwords: map[string]struct{}{}}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if password := strings.TrimRight(scanner.Text(), "\r"); password != "" {
+			list.passwords[password] = struct{}{}
+		}
+	}
+
+	return list, scanner.Err()
+}
+
+// Lookup returns the name of the first list containing password.
+func (w *Wordlists) Lookup(password string) (string, bool) {
+	for _, list := range w.lists {
+		if _, ok := list.passwords[password]; ok {
+			return list.name, true
+		}
+	}
+
+	return "", false
+}
+
+func (w *Wordlists) Annotate(ctx context.Context, event *Event) {
+	if !isPasswordAttempt(event.SSHInfo) {
+		return
+	}
+
+	if name, ok := w.Lookup(event.SSHInfo.Password); ok {
+		event.Analysis.Wordlist = name
+	}
+}
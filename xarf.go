@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxXARFSources bounds the source IPs XARFReporter follows
+	maxXARFSources = 100000
+	// maxXARFLines bounds the attempts attached to a report
+	maxXARFLines  = 100
+	xarfSchemaURL = "http://www.x-arf.org/schema/abuse_login-attack_0.1.2.json"
+)
+
+// xarfSource is what a source IP attempted since it was last reported.
+type xarfSource struct {
+	protocol  string
+	localPort string
+	attempts  int
+	lines     []string
+	first     time.Time
+	last      time.Time
+	reported  time.Time
+}
+
+// xarfReport is a source IP due to be reported.
+type xarfReport struct {
+	ip string
+	xarfSource
+}
+
+// XARFReporter mails abuse reports in the X-ARF format about the source IPs
+// brute-forcing the honeypot, to fixed recipients such as blocklist.de, and
+// to the abuse contact of the network of the IP, as found through RDAP. The
+// attempts are collected and reported on an interval, an IP being reported
+// again only after a while.
+type XARFReporter struct {
+	server         SMTPServer
+	from           string
+	to             []string
+	rdapURL        string
+	minAttempts    int
+	reportInterval time.Duration
+	maxReports     int
+	anonymizer     *Anonymizer
+	client         *http.Client
+	tracer         trace.Tracer
+	// contacts caches the abuse contacts RDAP gave, by IP
+	contacts *LRUCache[string, string]
+
+	mu      sync.Mutex
+	sources map[string]*xarfSource
+
+	sendMu sync.Mutex
+}
+
+// NewXARFReporter returns a reporter mailing from through server to the to
+// addresses, and to the abuse contacts RDAP gives when rdapURL is set.
+func NewXARFReporter(server SMTPServer, from string, to []string, rdapURL string, minAttempts int, reportInterval time.Duration, maxReports int, anonymizer *Anonymizer, tracer trace.Tracer) *XARFReporter {
+	return &XARFReporter{
+		server:         server,
+		from:           from,
+		to:             to,
+		rdapURL:        rdapURL,
+		minAttempts:    max(minAttempts, 1),
+		reportInterval: reportInterval,
+		maxReports:     maxReports,
+		anonymizer:     anonymizer,
+		client:         &http.Client{Timeout: 30 * time.Second},
+		tracer:         tracer,
+		contacts:       NewLRUCache[string, string](1000, 0, nil, nil),
+		sources:        map[string]*xarfSource{},
+	}
+}
+
+// xarfReporterFromEnv returns nil unless XARF_ENABLED is set.
+func xarfReporterFromEnv(anonymizer *Anonymizer, tracer trace.Tracer) (*XARFReporter, error) {
+	if os.Getenv("XARF_ENABLED") != "true" {
+		return nil, nil
+	}
+	server := SMTPServer{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     getEnv("SMTP_PORT", "587"),
+		Security: getEnv("SMTP_SECURITY", SMTPSecurityStartTLS),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+	if server.Host == "" {
+		return nil, fmt.Errorf("SMTP_HOST is required to mail abuse reports")
+	}
+	from := getEnv("XARF_FROM", os.Getenv("SMTP_FROM"))
+	if from == "" {
+		return nil, fmt.Errorf("XARF_FROM or SMTP_FROM is required to mail abuse reports")
+	}
+	to := splitList(os.Getenv("XARF_TO"))
+	var rdapURL string
+	if os.Getenv("XARF_RDAP") == "true" {
+		rdapURL = getEnv("XARF_RDAP_URL", "https://rdap.org/ip/")
+	}
+	if len(to) == 0 && rdapURL == "" {
+		return nil, fmt.Errorf("XARF_TO or XARF_RDAP is required to mail abuse reports")
+	}
+	if anonymizer != nil && anonymizer.truncateIPs {
+		return nil, fmt.Errorf("the source IPs are anonymized")
+	}
+
+	return NewXARFReporter(server, from, to, rdapURL, getEnvInt("XARF_MIN_ATTEMPTS", 5),
+		getEnvDuration("XARF_REPORT_INTERVAL", 7*24*time.Hour), getEnvInt("XARF_MAX_REPORTS", 20), anonymizer, tracer), nil
+}
+
+// Observe collects the authentication attempts of public source IPs.
+func (r *XARFReporter) Observe(ctx context.Context, event Event) {
+	sshInfo := event.SSHInfo
+	if !isPasswordAttempt(sshInfo) && sshInfo.Function != "public_key" {
+		return
+	}
+	if ip := net.ParseIP(sshInfo.RemoteHost); ip == nil || isPrivateIP(ip) {
+		return
+	}
+	// The usernames of the logs are anonymized as configured, the passwords
+	// never sent
+	user := r.anonymizer.Anonymize(event).SSHInfo.User
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := sshInfo.Timestamp
+	source, found := r.sources[sshInfo.RemoteHost]
+	if !found {
+		if len(r.sources) >= maxXARFSources {
+			return
+		}
+		source = &xarfSource{}
+		r.sources[sshInfo.RemoteHost] = source
+	}
+	if now.Sub(source.reported) < r.reportInterval {
+		return
+	}
+	if source.attempts == 0 {
+		source.protocol, source.localPort, source.first = sshInfo.Protocol, sshInfo.LocalPort, now
+	}
+	attempts := max(sshInfo.AttemptCount, 1)
+	source.attempts += attempts
+	source.last = now
+	if len(source.lines) < maxXARFLines {
+		line := fmt.Sprintf("%s %s -> port %s %s %s user=%s",
+			now.UTC().Format(time.RFC3339), net.JoinHostPort(sshInfo.RemoteHost, sshInfo.RemotePort),
+			sshInfo.LocalPort, sshInfo.Protocol, sshInfo.Function, strconv.QuoteToASCII(user))
+		if attempts > 1 {
+			line += fmt.Sprintf(" (%d times)", attempts)
+		}
+		source.lines = append(source.lines, line)
+	}
+}
+
+// Run mails the reports due every interval.
+func (r *XARFReporter) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.Send(context.Background())
+	}
+}
+
+// Send mails a report about the source IPs that made enough attempts, the
+// ones that made the most first, up to the maximum number of reports.
+func (r *XARFReporter) Send(ctx context.Context) {
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	now := time.Now()
+	var due []xarfReport
+	r.mu.Lock()
+	for ip, source := range r.sources {
+		if source.attempts >= r.minAttempts {
+			due = append(due, xarfReport{ip, *source})
+		} else if now.Sub(source.last) > r.reportInterval && now.Sub(source.reported) > r.reportInterval {
+			delete(r.sources, ip)
+		}
+	}
+	slices.SortFunc(due, func(a, b xarfReport) int { return b.attempts - a.attempts })
+	if r.maxReports > 0 && len(due) > r.maxReports {
+		// The others wait for the next run
+		due = due[:r.maxReports]
+	}
+	for _, report := range due {
+		*r.sources[report.ip] = xarfSource{reported: now}
+	}
+	r.mu.Unlock()
+
+	for _, report := range due {
+		r.report(ctx, report)
+	}
+}
+
+func (r *XARFReporter) report(ctx context.Context, report xarfReport) {
+	ctx, span := r.tracer.Start(
+		ctx,
+		"reportXARF",
+		trace.WithAttributes(attribute.String("ip", report.ip), attribute.Int("attempts", report.attempts)))
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	to := slices.Clone(r.to)
+	if r.rdapURL != "" {
+		contact, err := r.abuseContact(ctx, report.ip)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to look up abuse contact", "ip", report.ip, "error", err)
+		} else if contact != "" && !slices.Contains(to, contact) {
+			to = append(to, contact)
+		}
+	}
+	if len(to) == 0 {
+		span.SetStatus(codes.Ok, "No abuse contact")
+		slog.DebugContext(ctx, "No abuse contact to report to", "ip", report.ip)
+		return
+	}
+	span.SetAttributes(attribute.StringSlice("to", to))
+
+	message, err := r.message(report, to)
+	if err == nil {
+		err = r.server.Send(ctx, r.from, to, message)
+	}
+	metrics.RecordXARFReport(ctx, err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Failed to mail abuse report", "ip", report.ip, "to", to, "error", err)
+		return
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("Reported '%s'", report.ip))
+	slog.InfoContext(ctx, "Mailed abuse report", "ip", report.ip, "to", to, "attempts", report.attempts)
+}
+
+// message renders the X-ARF mail about report: an explanation for humans,
+// the report.txt for machines, and the attempts as logfile.log.
+func (r *XARFReporter) message(report xarfReport, to []string) ([]byte, error) {
+	now := time.Now()
+	domain := r.from[strings.LastIndex(r.from, "@")+1:]
+	id := uuid.NewString() + "@" + strings.Trim(domain, "<> ")
+	sourceType := "ipv4"
+	if strings.Contains(report.ip, ":") {
+		sourceType = "ipv6"
+	}
+	first, last := report.first.UTC().Format(time.RFC3339), report.last.UTC().Format(time.RFC3339)
+
+	explanation := fmt.Sprintf("Hello,\r\n\r\n"+
+		"%s made %d %s login attempts on port %s of a honeypot,\r\n"+
+		"from %s to %s.\r\n"+
+		"No legitimate login is ever made to this host. The attempts are attached\r\n"+
+		"as logfile.log, and described in report.txt in the X-ARF format\r\n"+
+		"(http://www.x-arf.org/).\r\n\r\n"+
+		"This report was generated automatically.\r\n",
+		report.ip, report.attempts, strings.ToUpper(report.protocol), report.localPort, first, last)
+	xarf := strings.Join([]string{
+		"Reported-From: " + r.from,
+		"Category: abuse",
+		"Report-Type: login-attack",
+		"Service: " + report.protocol,
+		"Version: 0.2",
+		"User-Agent: ssh-honeypot",
+		"Date: " + now.Format(time.RFC1123Z),
+		"Source-Type: " + sourceType,
+		"Source: " + report.ip,
+		"Port: " + report.localPort,
+		"Report-ID: " + id,
+		"Schema-URL: " + xarfSchemaURL,
+		"Attachment: text/plain",
+		"Occurrences: " + strconv.Itoa(report.attempts),
+		"TLP: green",
+	}, "\r\n") + "\r\n"
+	logs := strings.Join(report.lines, "\r\n") + "\r\n"
+
+	var message bytes.Buffer
+	body := multipart.NewWriter(&message)
+	headers := []string{
+		"From: " + r.from,
+		"To: " + strings.Join(to, ", "),
+		"Subject: abuse report about " + report.ip + " - " + now.UTC().Format(time.RFC3339),
+		"Date: " + now.Format(time.RFC1123Z),
+		"Message-ID: <" + id + ">",
+		"Auto-Submitted: auto-generated",
+		"X-XARF: PLAIN",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + body.Boundary(),
+	}
+	message.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", explanation},
+		{`text/plain; charset=utf-8; name="report.txt"`, xarf},
+		{`text/plain; charset=utf-8; name="logfile.log"`, logs},
+	} {
+		// The content is ASCII, the usernames being quoted
+		writer, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"7bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(writer, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+type rdapEntity struct {
+	Roles      []string          `json:"roles"`
+	VCardArray []json.RawMessage `json:"vcardArray"`
+	Entities   []rdapEntity      `json:"entities"`
+}
+
+// abuseContact returns the email address of the abuse contact RDAP gives
+// for the network of ip, or "" if none.
+func (r *XARFReporter) abuseContact(ctx context.Context, ip string) (string, error) {
+	if cached, found := r.contacts.Get(ip); found {
+		return cached, nil
+	}
+
+	ctx, span := r.tracer.Start(ctx, "lookupRDAP", trace.WithAttributes(attribute.String("ip", ip)))
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.rdapURL+ip, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	var network struct {
+		Entities []rdapEntity `json:"entities"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&network); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	contact := rdapAbuseEmail(network.Entities)
+	r.contacts.Set(ip, contact, 24*time.Hour)
+	span.SetStatus(codes.Ok, fmt.Sprintf("Got abuse contact '%s'", contact))
+	return contact, nil
+}
+
+// rdapAbuseEmail returns the email of the first entity with the abuse role,
+// the entities being nested in one another.
+func rdapAbuseEmail(entities []rdapEntity) string {
+	for _, entity := range entities {
+		if slices.Contains(entity.Roles, "abuse") {
+			if email := vcardEmail(entity.VCardArray); email != "" {
+				return email
+			}
+		}
+		if email := rdapAbuseEmail(entity.Entities); email != "" {
+			return email
+		}
+	}
+
+	return ""
+}
+
+// vcardEmail returns the email of a jCard, ["vcard", [[name, params, type,
+// value], ...]].
+func vcardEmail(vcard []json.RawMessage) string {
+	if len(vcard) < 2 {
+		return ""
+	}
+	var properties [][]any
+	if json.Unmarshal(vcard[1], &properties) != nil {
+		return ""
+	}
+	for _, property := range properties {
+		if len(property) < 4 || property[0] != "email" {
+			continue
+		}
+		if email, ok := property[3].(string); ok && email != "" {
+			return email
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxYaraResults bounds the scan results kept by SHA256.
+const maxYaraResults = 10000
+
+// errYaraBusy is handed for the samples left unscanned, the maximum number
+// of scans running already.
+var errYaraBusy = errors.New("too many YARA scans running")
+
+// YaraScanner scans samples with the yara command line tool, against the
+// rules of the .yar and .yara files under a directory. The directory is
+// read again for every scan, so rules can be added without a restart. At
+// most maxScans run at once, and results are kept by SHA256 for cacheTTL.
+type YaraScanner struct {
+	command  string
+	rulesDir string
+	timeout  time.Duration
+	tracer   trace.Tracer
+
+	slots    chan struct{}
+	results  *LRUCache[string, []string]
+	cacheTTL time.Duration
+}
+
+func NewYaraScanner(command string, rulesDir string, timeout time.Duration, maxScans int, cacheTTL time.Duration, tracer trace.Tracer) (*YaraScanner, error) {
+	if _, err := exec.LookPath(command); err != nil {
+		return nil, err
+	}
+	y := &YaraScanner{
+		command:  command,
+		rulesDir: rulesDir,
+		timeout:  timeout,
+		tracer:   tracer,
+		slots:    make(chan struct{}, max(maxScans, 1)),
+		results:  NewLRUCache[string, []string](maxYaraResults, 0, nil, nil),
+		cacheTTL: cacheTTL,
+	}
+	if _, err := y.rules(); err != nil {
+		return nil, err
+	}
+
+	return y, nil
+}
+
+// yaraScannerFromEnv returns nil unless YARA_RULES_DIR is set.
+func yaraScannerFromEnv(tracer trace.Tracer) (*YaraScanner, error) {
+	rulesDir := os.Getenv("YARA_RULES_DIR")
+	if rulesDir == "" {
+		return nil, nil
+	}
+
+	return NewYaraScanner(getEnv("YARA_COMMAND", "yara"), rulesDir, getEnvDuration("YARA_TIMEOUT", 30*time.Second),
+		getEnvInt("YARA_MAX_SCANS", 2), getEnvDuration("YARA_CACHE_TTL", 24*time.Hour), tracer)
+}
+
+// rules lists the rule files under the rules directory.
+func (y *YaraScanner) rules() ([]string, error) {
+	var rules []string
+	err := filepath.WalkDir(y.rulesDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ext := filepath.Ext(path); !entry.IsDir() && (ext == ".yar" || ext == ".yara") {
+			rules = append(rules, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no .yar or .yara rules in '%s'", y.rulesDir)
+	}
+
+	return rules, nil
+}
+
+// ScanSample hands done the rules the sample of the given SHA256 at path
+// matches, right away when scanned before, or else once scanned in the
+// background. While the maximum number of scans are running, done gets
+// errYaraBusy instead.
+func (y *YaraScanner) ScanSample(hash string, path string, done func([]string, error)) {
+	if matches, found := y.results.Get(hash); found {
+		done(matches, nil)
+		return
+	}
+
+	select {
+	case y.slots <- struct{}{}:
+	default:
+		done(nil, errYaraBusy)
+		return
+	}
+	go func() {
+		defer func() { <-y.slots }()
+
+		matches, err := y.Scan(context.Background(), path)
+		if err == nil {
+			y.results.Set(hash, matches, y.cacheTTL)
+		}
+		done(matches, err)
+	}()
+}
+
+// Scan returns the names of the rules the file at path matches, sorted.
+func (y *YaraScanner) Scan(ctx context.Context, path string) ([]string, error) {
+	ctx, span := y.tracer.Start(ctx, "yaraScan", trace.WithAttributes(attribute.String("path", path)))
+	defer span.End()
+
+	matches, err := y.scan(ctx, path)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.StringSlice("matches", matches))
+	span.SetStatus(codes.Ok, fmt.Sprintf("Matched %d rules", len(matches)))
+	return matches, nil
+}
+
+func (y *YaraScanner) scan(ctx context.Context, path string) ([]string, error) {
+	rules, err := y.rules()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, y.timeout)
+	defer cancel()
+
+	// Prints a "<rule> <path>" line for every rule matching
+	args := append([]string{"--no-warnings"}, rules...)
+	cmd := exec.CommandContext(ctx, y.command, append(args, path)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var matches []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if rule, _, found := strings.Cut(scanner.Text(), " "); found && !slices.Contains(matches, rule) {
+			matches = append(matches, rule)
+		}
+	}
+	slices.Sort(matches)
+
+	return matches, nil
+}
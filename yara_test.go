@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// fakeYara returns a yara command matching every file with the "evil" rule,
+// slowly, counting its runs in the returned file.
+func fakeYara(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	command := filepath.Join(dir, "yara")
+	script := "#!/bin/sh\necho run >> " + runs + "\nsleep 0.2\nfor last; do :; done\necho \"evil $last\"\n"
+	if err := os.WriteFile(command, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "rules.yar"), []byte("rule evil { condition: true }\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return command, runs
+}
+
+func TestYaraScanSample(t *testing.T) {
+	command, runs := fakeYara(t)
+	scanner, err := NewYaraScanner(command, filepath.Dir(command), 5*time.Second, 1, time.Hour, noop.NewTracerProvider().Tracer("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		matches []string
+		err     error
+	}
+	results := make(chan result, 3)
+	done := func(matches []string, err error) {
+		results <- result{matches, err}
+	}
+
+	// A single scan runs at once, the other sample is left unscanned
+	scanner.ScanSample("a", command, done)
+	scanner.ScanSample("b", command, done)
+	if busy := <-results; !errors.Is(busy.err, errYaraBusy) {
+		t.Fatalf("second scan error = %v, want errYaraBusy", busy.err)
+	}
+	if scanned := <-results; scanned.err != nil || !slices.Equal(scanned.matches, []string{"evil"}) {
+		t.Fatalf("scan = %v, %v", scanned.matches, scanned.err)
+	}
+
+	// The sample seen again isn't scanned again
+	scanner.ScanSample("a", command, done)
+	if cached := <-results; cached.err != nil || !slices.Equal(cached.matches, []string{"evil"}) {
+		t.Fatalf("cached scan = %v, %v", cached.matches, cached.err)
+	}
+	if count, _ := os.ReadFile(runs); strings.Count(string(count), "run") != 1 {
+		t.Errorf("yara ran %d times, want 1", strings.Count(string(count), "run"))
+	}
+}